@@ -0,0 +1,129 @@
+package common
+
+import (
+	"encoding/json"
+	"flag"
+	"net/http"
+	"time"
+
+	"github.com/VictoriaMetrics/VictoriaMetrics/app/vmstorage"
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/logger"
+	"github.com/VictoriaMetrics/metrics"
+)
+
+var atomicBatch = flag.Bool("insert.atomicBatch", false, "Whether to reject the whole request if any row has a timestamp, which would be dropped by the storage, "+
+	"instead of storing the rest of rows. Such timestamps are negative, exceed the current time by more than 2 days or are outside -retentionPeriod if rows are written to the local storage. "+
+	"The flag applies only to formats, which are parsed in full before writing: Prometheus remote write, OTLP, OpenTSDB HTTP, Elasticsearch bulk and CloudWatch EMF. "+
+	"Line-based formats such as Influx, Graphite, OpenTSDB telnet and Prometheus text are written in blocks of lines while being read, so they aren't validated. "+
+	"The flag cannot be used together with -opentsdbhttp.streamParse")
+
+var atomicBatchJSONErrors = flag.Bool("insert.atomicBatchJSONErrors", false, "Whether to return JSON response with the index and the reason of the first failing row "+
+	"for requests rejected according to -insert.atomicBatch instead of plain text error. Rows are counted from zero since the start of the request")
+
+// maxTimestampAhead is the maximum duration in milliseconds timestamps may exceed the current time by.
+//
+// It must match the limit used by lib/storage.
+const maxTimestampAhead = 2 * 24 * 3600 * 1000
+
+var atomicBatchRejections = metrics.NewCounter(`vm_insert_atomic_batch_rejections_total`)
+
+// IsAtomicBatch returns true if -insert.atomicBatch is set.
+func IsAtomicBatch() bool {
+	return *atomicBatch
+}
+
+// ValidateTimestamps returns an error if -insert.atomicBatch is set and any of n timestamps
+// returned by getTimestamp would be dropped by the storage.
+//
+// It must be called for all the rows of a request before writing them via ctx, so the request isn't stored partially.
+// It mustn't be used by protocols, which write rows in blocks while reading the request.
+// getTimestamp must return the timestamp in milliseconds for the row with the given index.
+// Timestamps aren't validated if they are overridden with SetServerTimestamp.
+// The returned error is AtomicBatchError with the index of the failing row counted since the last SetContext call.
+func (ctx *InsertCtx) ValidateTimestamps(n int, getTimestamp func(i int) int64) error {
+	if !*atomicBatch || ctx.serverTimestamp != 0 {
+		return nil
+	}
+	minTimestamp, maxTimestamp := getTimestampRange()
+	for i := 0; i < n; i++ {
+		timestamp := getTimestamp(i)
+		if timestamp < minTimestamp || timestamp > maxTimestamp {
+			atomicBatchRejections.Inc()
+			return &AtomicBatchError{
+				RowIndex: ctx.validatedRows + i,
+				err: NewParseError(ErrBadTimestamp, "timestamp %d is outside the accepted range [%d..%d]; rejecting the whole batch according to -insert.atomicBatch",
+					timestamp, minTimestamp, maxTimestamp),
+			}
+		}
+	}
+	ctx.validatedRows += n
+	return nil
+}
+
+// AtomicBatchError is returned when the batch is rejected according to -insert.atomicBatch.
+type AtomicBatchError struct {
+	// RowIndex is the index of the first failing row in the request.
+	RowIndex int
+
+	err error
+}
+
+// Error implements error interface.
+func (abe *AtomicBatchError) Error() string {
+	return abe.err.Error()
+}
+
+// atomicBatchErrorResponse is the response for the request rejected according to -insert.atomicBatch. See -insert.atomicBatchJSONErrors.
+type atomicBatchErrorResponse struct {
+	Error     string                  `json:"error"`
+	FailedRow atomicBatchErrorFailure `json:"failedRow"`
+}
+
+type atomicBatchErrorFailure struct {
+	Index  int    `json:"index"`
+	Code   string `json:"code"`
+	Reason string `json:"reason"`
+}
+
+// WriteAtomicBatchError writes JSON response with the first failing row to w if err is AtomicBatchError
+// and -insert.atomicBatchJSONErrors is set.
+//
+// It returns false without writing the response otherwise, so the caller must write the error response on its own.
+func WriteAtomicBatchError(w http.ResponseWriter, req *http.Request, err error) bool {
+	if !*atomicBatchJSONErrors {
+		return false
+	}
+	abe, ok := err.(*AtomicBatchError)
+	if !ok {
+		return false
+	}
+	errStr := err.Error()
+	logger.Errorf("error in %q: %s", req.URL.Path, errStr)
+	resp := &atomicBatchErrorResponse{
+		Error: "the request is rejected according to -insert.atomicBatch",
+		FailedRow: atomicBatchErrorFailure{
+			Index:  abe.RowIndex,
+			Code:   GetParseErrorCode(abe).Error(),
+			Reason: errStr,
+		},
+	}
+	data, jsonErr := json.Marshal(resp)
+	if jsonErr != nil {
+		logger.Panicf("BUG: cannot marshal atomic batch error response: %s", jsonErr)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusBadRequest)
+	_, _ = w.Write(data)
+	return true
+}
+
+// getTimestampRange returns the range of timestamps in milliseconds accepted by the storage.
+//
+// The retention is taken into account only for the local storage, since it is unknown for -storageNode and for the sink.
+func getTimestampRange() (int64, int64) {
+	now := time.Now().UnixNano() / 1e6
+	if getSink() == nil && getStorageNodes() == nil && vmstorage.Storage != nil {
+		return vmstorage.GetMinMaxTimestamps()
+	}
+	return 0, now + maxTimestampAhead
+}
@@ -0,0 +1,105 @@
+package common
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestInsertCtxValidateTimestamps(t *testing.T) {
+	defer func() {
+		*atomicBatch = false
+	}()
+	startTestStorageNode()
+	defer stopTestStorageNode()
+
+	now := time.Now().UnixNano() / 1e6
+	f := func(serverTimestamp int64, timestamps []int64, resultExpected bool) {
+		t.Helper()
+		var ctx InsertCtx
+		ctx.SetServerTimestamp(serverTimestamp)
+		err := ctx.ValidateTimestamps(len(timestamps), func(i int) int64 { return timestamps[i] })
+		if (err == nil) != resultExpected {
+			t.Fatalf("unexpected error for timestamps %v: %v", timestamps, err)
+		}
+		if err != nil && GetParseErrorCode(err) != ErrBadTimestamp {
+			t.Fatalf("expecting ErrBadTimestamp; got %s", err)
+		}
+	}
+	badTimestamps := []int64{now, -1, now}
+	futureTimestamps := []int64{now + 3*24*3600*1000}
+
+	// Timestamps aren't validated by default
+	f(0, badTimestamps, true)
+
+	*atomicBatch = true
+	f(0, nil, true)
+	f(0, []int64{0, now, now + 3600*1000}, true)
+	f(0, badTimestamps, false)
+	f(0, futureTimestamps, false)
+
+	// Timestamps overridden with the server time aren't validated
+	f(now, badTimestamps, true)
+}
+
+func TestWriteAtomicBatchError(t *testing.T) {
+	defer func() {
+		*atomicBatch = false
+		*atomicBatchJSONErrors = false
+	}()
+	startTestStorageNode()
+	defer stopTestStorageNode()
+
+	*atomicBatch = true
+	now := time.Now().UnixNano() / 1e6
+	var ctx InsertCtx
+	ctx.SetContext(nil)
+	if err := ctx.ValidateTimestamps(2, func(i int) int64 { return now }); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	timestamps := []int64{now, -1, -2}
+	err := ctx.ValidateTimestamps(len(timestamps), func(i int) int64 { return timestamps[i] })
+	abe, ok := err.(*AtomicBatchError)
+	if !ok {
+		t.Fatalf("expecting AtomicBatchError; got %v", err)
+	}
+	if abe.RowIndex != 3 {
+		t.Fatalf("unexpected row index; got %d; want 3", abe.RowIndex)
+	}
+	req := httptest.NewRequest("POST", "/api/v1/import/prometheus", nil)
+
+	// Plain text errors are returned by default
+	w := httptest.NewRecorder()
+	if WriteAtomicBatchError(w, req, err) {
+		t.Fatalf("unexpected JSON response when -insert.atomicBatchJSONErrors isn't set")
+	}
+
+	*atomicBatchJSONErrors = true
+	if WriteAtomicBatchError(w, req, errors.New("some error")) {
+		t.Fatalf("unexpected JSON response for non-atomic batch error")
+	}
+	if !WriteAtomicBatchError(w, req, WrapParseError(err, "cannot import file %q: %s", "foo.prom", err)) {
+		t.Fatalf("expecting JSON response for atomic batch error")
+	}
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("unexpected status code; got %d; want %d", w.Code, http.StatusBadRequest)
+	}
+	var resp atomicBatchErrorResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("cannot unmarshal response %q: %s", w.Body.String(), err)
+	}
+	if resp.FailedRow.Index != 3 || resp.FailedRow.Code != ErrBadTimestamp.Error() || !strings.Contains(resp.FailedRow.Reason, "timestamp -1") {
+		t.Fatalf("unexpected response: %s", w.Body.String())
+	}
+
+	// Row indexes are reset by SetContext
+	ctx.SetContext(nil)
+	err = ctx.ValidateTimestamps(1, func(i int) int64 { return -1 })
+	if abe, ok := err.(*AtomicBatchError); !ok || abe.RowIndex != 0 {
+		t.Fatalf("expecting AtomicBatchError for row 0; got %v", err)
+	}
+}
@@ -0,0 +1,235 @@
+package common
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"io"
+	"log/syslog"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/bytesutil"
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/logger"
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/prompb"
+	"github.com/VictoriaMetrics/metrics"
+)
+
+var (
+	auditLog = flag.String("insert.auditLog", "", "Destination for audit events of HTTP insert requests. Either path to a file or `syslog`. "+
+		"Every event is a JSON line with the client identity, the number of written rows, a sample of metric names and the result of the request. "+
+		"Audit events are disabled by default. See also -insert.auditLogMaxEventsPerSecond and -insert.auditLogMaxMetricNames")
+	auditLogMaxEventsPerSecond = flag.Float64("insert.auditLogMaxEventsPerSecond", 1000, "The maximum number of audit events per second to write to -insert.auditLog. "+
+		"Events above the limit are dropped. See vm_insert_audit_events_dropped_total metric")
+	auditLogMaxMetricNames = flag.Int("insert.auditLogMaxMetricNames", 10, "The maximum number of distinct metric names to put into a single audit event. "+
+		"Rows for other metric names are counted in `otherMetricRows` field")
+)
+
+// auditQueueSize is the maximum number of audit events waiting to be written to -insert.auditLog.
+const auditQueueSize = 1024
+
+// auditLogger writes audit events to -insert.auditLog.
+type auditLogger struct {
+	w       io.WriteCloser
+	queue   chan *AuditEvent
+	limiter rateLimiter
+	wg      sync.WaitGroup
+}
+
+// al is non-nil if -insert.auditLog is set.
+var al *auditLogger
+
+// InitAuditLog opens -insert.auditLog if it is set.
+//
+// InitAuditLog must be called after flag.Parse call.
+func InitAuditLog() {
+	if len(*auditLog) == 0 {
+		return
+	}
+	w, err := openAuditLog(*auditLog)
+	if err != nil {
+		logger.Fatalf("cannot open -insert.auditLog=%q: %s", *auditLog, err)
+	}
+	al = newAuditLogger(w)
+	logger.Infof("writing audit events for insert requests to -insert.auditLog=%q", *auditLog)
+}
+
+// StopAuditLog writes the pending audit events and closes -insert.auditLog.
+func StopAuditLog() {
+	if al == nil {
+		return
+	}
+	al.stop()
+	al = nil
+}
+
+func openAuditLog(dst string) (io.WriteCloser, error) {
+	if dst == "syslog" {
+		return syslog.New(syslog.LOG_INFO|syslog.LOG_DAEMON, "victoria-metrics-audit")
+	}
+	return os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+}
+
+func newAuditLogger(w io.WriteCloser) *auditLogger {
+	l := &auditLogger{
+		w:     w,
+		queue: make(chan *AuditEvent, auditQueueSize),
+	}
+	l.wg.Add(1)
+	go func() {
+		defer l.wg.Done()
+		l.run()
+	}()
+	return l
+}
+
+func (l *auditLogger) run() {
+	var buf []byte
+	for ae := range l.queue {
+		data, err := json.Marshal(ae)
+		if err != nil {
+			logger.Panicf("BUG: cannot marshal audit event: %s", err)
+		}
+		buf = append(buf[:0], data...)
+		buf = append(buf, '\n')
+		if _, err := l.w.Write(buf); err != nil {
+			auditWriteErrors.Inc()
+			logger.Errorf("cannot write audit event to -insert.auditLog=%q: %s", *auditLog, err)
+			continue
+		}
+		auditEventsWritten.Inc()
+	}
+}
+
+func (l *auditLogger) stop() {
+	close(l.queue)
+	l.wg.Wait()
+	if err := l.w.Close(); err != nil {
+		logger.Errorf("cannot close -insert.auditLog=%q: %s", *auditLog, err)
+	}
+}
+
+// push queues ae for writing. ae is dropped if the rate limit is exceeded or the queue is full.
+func (l *auditLogger) push(ae *AuditEvent) {
+	if ok, _ := l.limiter.allow(time.Now(), *auditLogMaxEventsPerSecond); !ok {
+		auditEventsDropped.Inc()
+		return
+	}
+	select {
+	case l.queue <- ae:
+	default:
+		auditEventsDropped.Inc()
+	}
+}
+
+// AuditEvent is an audit event for a single HTTP insert request.
+//
+// Rows and metric names are registered concurrently by InsertCtx for the request.
+type AuditEvent struct {
+	Time            time.Time `json:"time"`
+	Identity        string    `json:"identity"`
+	RemoteAddr      string    `json:"remoteAddr"`
+	Path            string    `json:"path"`
+	RequestID       string    `json:"requestID,omitempty"`
+	Rows            uint64    `json:"rows"`
+	MetricNames     []string  `json:"metricNames"`
+	OtherMetricRows uint64    `json:"otherMetricRows"`
+	StatusCode      int       `json:"statusCode"`
+	Result          string    `json:"result"`
+	DurationSeconds float64   `json:"durationSeconds"`
+
+	mu             sync.Mutex
+	metricNamesMap map[string]struct{}
+
+	l         *auditLogger
+	sw        *StatusResponseWriter
+	startTime time.Time
+}
+
+type auditEventKey struct{}
+
+// WithAuditEvent starts recording audit event for req if -insert.auditLog is set.
+//
+// The returned w and req must be used for serving the request, so the event captures written rows and the response status.
+// Call Finish on the returned event after serving the request. The returned event is nil if audit events are disabled.
+func WithAuditEvent(w http.ResponseWriter, req *http.Request) (http.ResponseWriter, *http.Request, *AuditEvent) {
+	l := al
+	if l == nil {
+		return w, req, nil
+	}
+	identity, _, _ := req.BasicAuth()
+	now := time.Now()
+	sw := &StatusResponseWriter{
+		ResponseWriter: w,
+	}
+	ae := &AuditEvent{
+		Time:        now,
+		Identity:    identity,
+		RemoteAddr:  req.RemoteAddr,
+		Path:        req.URL.Path,
+		RequestID:   GetRequestID(req),
+		MetricNames: []string{},
+
+		l:         l,
+		sw:        sw,
+		startTime: now,
+	}
+	ctx := context.WithValue(req.Context(), auditEventKey{}, ae)
+	return sw, req.WithContext(ctx), ae
+}
+
+// getAuditEvent returns audit event for the request with the given reqCtx.
+func getAuditEvent(reqCtx context.Context) *AuditEvent {
+	if reqCtx == nil {
+		return nil
+	}
+	ae, _ := reqCtx.Value(auditEventKey{}).(*AuditEvent)
+	return ae
+}
+
+// Finish queues ae for writing to -insert.auditLog.
+//
+// ae may be nil. ae mustn't be used after the call.
+func (ae *AuditEvent) Finish() {
+	if ae == nil {
+		return
+	}
+	ae.mu.Lock()
+	ae.StatusCode = ae.sw.StatusCode()
+	ae.Result = "success"
+	if ae.StatusCode >= 400 {
+		ae.Result = "error"
+	}
+	ae.DurationSeconds = time.Since(ae.startTime).Seconds()
+	ae.metricNamesMap = nil
+	ae.mu.Unlock()
+	ae.l.push(ae)
+}
+
+// addRow registers a row with the given labels in ae.
+func (ae *AuditEvent) addRow(labels []prompb.Label) {
+	name := getMetricName(labels)
+	ae.mu.Lock()
+	ae.Rows++
+	if _, ok := ae.metricNamesMap[bytesutil.ToUnsafeString(name)]; !ok {
+		if len(ae.MetricNames) < *auditLogMaxMetricNames {
+			if ae.metricNamesMap == nil {
+				ae.metricNamesMap = make(map[string]struct{})
+			}
+			s := string(name)
+			ae.metricNamesMap[s] = struct{}{}
+			ae.MetricNames = append(ae.MetricNames, s)
+		} else {
+			ae.OtherMetricRows++
+		}
+	}
+	ae.mu.Unlock()
+}
+
+var (
+	auditEventsWritten = metrics.NewCounter(`vm_insert_audit_events_total`)
+	auditEventsDropped = metrics.NewCounter(`vm_insert_audit_events_dropped_total`)
+	auditWriteErrors   = metrics.NewCounter(`vm_insert_audit_write_errors_total`)
+)
@@ -0,0 +1,96 @@
+package common
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/prompb"
+)
+
+type testAuditWriter struct {
+	bytes.Buffer
+}
+
+func (tw *testAuditWriter) Close() error {
+	return nil
+}
+
+func TestAuditLog(t *testing.T) {
+	// The audit log is disabled
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest("POST", "/api/put", nil)
+	if _, _, ae := WithAuditEvent(w, req); ae != nil {
+		t.Fatalf("expecting nil audit event when the audit log is disabled")
+	}
+
+	defer func(n int) {
+		*auditLogMaxMetricNames = n
+	}(*auditLogMaxMetricNames)
+	*auditLogMaxMetricNames = 2
+
+	var tw testAuditWriter
+	al = newAuditLogger(&tw)
+
+	req = httptest.NewRequest("POST", "/api/put", nil)
+	req.SetBasicAuth("foo", "secret")
+	var aw http.ResponseWriter
+	aw, req, ae := WithAuditEvent(w, req)
+	if ae == nil {
+		t.Fatalf("expecting non-nil audit event")
+	}
+
+	var ctx InsertCtx
+	ctx.Reset(0)
+	ctx.SetContext(req.Context())
+	write := func(name string) {
+		ctx.WriteDataPoint(nil, []prompb.Label{
+			{Name: []byte("__name__"), Value: []byte(name)},
+			{Name: []byte("host"), Value: []byte("a")},
+		}, 1, 2)
+	}
+	write("m1")
+	write("m2")
+	write("m1")
+	// The limit on the number of metric names is reached
+	write("m3")
+	write("m3")
+	ctx.SetContext(nil)
+
+	aw.WriteHeader(http.StatusBadRequest)
+	ae.Finish()
+	StopAuditLog()
+
+	lines := strings.Split(strings.TrimSpace(tw.String()), "\n")
+	if len(lines) != 1 {
+		t.Fatalf("unexpected number of audit events; got %d; want 1; log:\n%s", len(lines), tw.String())
+	}
+	var event AuditEvent
+	if err := json.Unmarshal([]byte(lines[0]), &event); err != nil {
+		t.Fatalf("cannot parse audit event %q: %s", lines[0], err)
+	}
+	if event.Identity != "foo" {
+		t.Fatalf("unexpected identity; got %q; want %q", event.Identity, "foo")
+	}
+	if event.Path != "/api/put" {
+		t.Fatalf("unexpected path; got %q; want %q", event.Path, "/api/put")
+	}
+	if event.Rows != 5 {
+		t.Fatalf("unexpected rows; got %d; want 5", event.Rows)
+	}
+	if s := strings.Join(event.MetricNames, ","); s != "m1,m2" {
+		t.Fatalf("unexpected metric names; got %q; want %q", s, "m1,m2")
+	}
+	if event.OtherMetricRows != 2 {
+		t.Fatalf("unexpected otherMetricRows; got %d; want 2", event.OtherMetricRows)
+	}
+	if event.StatusCode != http.StatusBadRequest || event.Result != "error" {
+		t.Fatalf("unexpected status; got %d, %q; want %d, %q", event.StatusCode, event.Result, http.StatusBadRequest, "error")
+	}
+	if strings.Contains(lines[0], "secret") {
+		t.Fatalf("audit event mustn't contain the password: %s", lines[0])
+	}
+}
@@ -0,0 +1,183 @@
+package common
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/fs"
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/logger"
+	"github.com/VictoriaMetrics/metrics"
+)
+
+var (
+	dumpBodiesDir = flag.String("insert.dumpBodiesDir", "", "Directory for dumping raw bodies of HTTP insert requests before parsing together with request metadata. "+
+		"This may help debugging malformed data from clients. Note that the bodies may contain sensitive data, so protect the directory accordingly. "+
+		"See also -insert.dumpBodiesMaxFiles and -insert.dumpBodiesMaxTotalSize")
+	dumpBodiesMaxFiles     = flag.Int("insert.dumpBodiesMaxFiles", 10, "The maximum number of request bodies to dump per protocol to -insert.dumpBodiesDir")
+	dumpBodiesMaxTotalSize = flag.Int64("insert.dumpBodiesMaxTotalSize", 64*1024*1024, "The maximum total size of request bodies to dump to -insert.dumpBodiesDir. "+
+		"Bodies are truncated when the limit is reached")
+)
+
+// redactedHeaders contains headers, which values aren't dumped to -insert.dumpBodiesDir.
+var redactedHeaders = []string{"Authorization", "Proxy-Authorization", "Cookie"}
+
+// InitBodyDumps creates -insert.dumpBodiesDir if it is set.
+//
+// InitBodyDumps must be called after flag.Parse call.
+func InitBodyDumps() {
+	if len(*dumpBodiesDir) == 0 {
+		return
+	}
+	if err := fs.MkdirAllIfNotExist(*dumpBodiesDir); err != nil {
+		logger.Fatalf("cannot create -insert.dumpBodiesDir=%q: %s", *dumpBodiesDir, err)
+	}
+	logger.Infof("dumping raw request bodies to -insert.dumpBodiesDir=%q; the bodies may contain sensitive data", *dumpBodiesDir)
+}
+
+// dumpedBodyBytes is the total size of bodies dumped to -insert.dumpBodiesDir.
+var dumpedBodyBytes int64
+
+// BodyDumper dumps raw request bodies for a single protocol to -insert.dumpBodiesDir.
+type BodyDumper struct {
+	protocol string
+	files    int64
+
+	dumpedBodies *metrics.Counter
+}
+
+// NewBodyDumper returns new BodyDumper for the given protocol.
+//
+// It must be called only once per protocol, usually during package initialization.
+func NewBodyDumper(protocol string) *BodyDumper {
+	return &BodyDumper{
+		protocol:     protocol,
+		dumpedBodies: metrics.NewCounter(fmt.Sprintf(`vm_insert_dumped_bodies_total{protocol=%q}`, protocol)),
+	}
+}
+
+// NewReader returns a reader for r body of req, which captures the read data if the body must be dumped.
+//
+// Call Finish on the returned reader after reading the body in order to dump it.
+func (bd *BodyDumper) NewReader(req *http.Request, r io.Reader) *BodyDumpReader {
+	bdr := &BodyDumpReader{
+		r: r,
+	}
+	if len(*dumpBodiesDir) == 0 || atomic.LoadInt64(&dumpedBodyBytes) >= *dumpBodiesMaxTotalSize {
+		return bdr
+	}
+	n := atomic.AddInt64(&bd.files, 1)
+	if n > int64(*dumpBodiesMaxFiles) {
+		atomic.AddInt64(&bd.files, -1)
+		return bdr
+	}
+	bdr.bd = bd
+	bdr.req = req
+	bdr.seq = n
+	bdr.startTime = time.Now()
+	return bdr
+}
+
+// BodyDumpReader captures the data read from request body for dumping it to -insert.dumpBodiesDir.
+type BodyDumpReader struct {
+	r io.Reader
+
+	// bd is nil if the body mustn't be dumped.
+	bd        *BodyDumper
+	req       *http.Request
+	seq       int64
+	startTime time.Time
+
+	buf       []byte
+	truncated bool
+}
+
+// Read reads data from the underlying reader.
+func (bdr *BodyDumpReader) Read(p []byte) (int, error) {
+	n, err := bdr.r.Read(p)
+	if bdr.bd != nil && n > 0 && !bdr.truncated {
+		bdr.capture(p[:n])
+	}
+	return n, err
+}
+
+func (bdr *BodyDumpReader) capture(data []byte) {
+	size := int64(len(data))
+	total := atomic.AddInt64(&dumpedBodyBytes, size)
+	if excess := total - *dumpBodiesMaxTotalSize; excess > 0 {
+		if excess > size {
+			excess = size
+		}
+		atomic.AddInt64(&dumpedBodyBytes, -excess)
+		data = data[:size-excess]
+		bdr.truncated = true
+	}
+	bdr.buf = append(bdr.buf, data...)
+}
+
+// bodyDumpMetadata is written next to the dumped body.
+type bodyDumpMetadata struct {
+	Protocol   string              `json:"protocol"`
+	Timestamp  time.Time           `json:"timestamp"`
+	Method     string              `json:"method"`
+	URL        string              `json:"url"`
+	RemoteAddr string              `json:"remoteAddr"`
+	Headers    map[string][]string `json:"headers"`
+	Size       int                 `json:"size"`
+	Truncated  bool                `json:"truncated"`
+}
+
+// Finish dumps the captured body to -insert.dumpBodiesDir.
+//
+// Write errors are logged, since the dump is optional.
+func (bdr *BodyDumpReader) Finish() {
+	bd := bdr.bd
+	if bd == nil {
+		return
+	}
+	bdr.bd = nil
+	if len(bdr.buf) == 0 {
+		// Nothing to dump. Release the file slot for the next request.
+		atomic.AddInt64(&bd.files, -1)
+		return
+	}
+	headers := make(map[string][]string, len(bdr.req.Header))
+	for k, vs := range bdr.req.Header {
+		headers[k] = vs
+	}
+	for _, k := range redactedHeaders {
+		if _, ok := headers[k]; ok {
+			headers[k] = []string{"<redacted>"}
+		}
+	}
+	md := &bodyDumpMetadata{
+		Protocol:   bd.protocol,
+		Timestamp:  bdr.startTime,
+		Method:     bdr.req.Method,
+		URL:        bdr.req.URL.String(),
+		RemoteAddr: bdr.req.RemoteAddr,
+		Headers:    headers,
+		Size:       len(bdr.buf),
+		Truncated:  bdr.truncated,
+	}
+	mdData, err := json.MarshalIndent(md, "", "  ")
+	if err != nil {
+		logger.Panicf("BUG: cannot marshal body dump metadata: %s", err)
+	}
+	prefix := filepath.Join(*dumpBodiesDir, fmt.Sprintf("%s-%d-%d", bd.protocol, bdr.startTime.UnixNano(), bdr.seq))
+	if err := ioutil.WriteFile(prefix+".body", bdr.buf, 0600); err != nil {
+		logger.Errorf("cannot dump request body: %s", err)
+		return
+	}
+	if err := ioutil.WriteFile(prefix+".json", mdData, 0600); err != nil {
+		logger.Errorf("cannot dump request metadata: %s", err)
+		return
+	}
+	bd.dumpedBodies.Inc()
+}
@@ -0,0 +1,95 @@
+package common
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestBodyDumper(t *testing.T) {
+	defer func(dir string, maxFiles int, maxTotalSize int64) {
+		*dumpBodiesDir = dir
+		*dumpBodiesMaxFiles = maxFiles
+		*dumpBodiesMaxTotalSize = maxTotalSize
+		atomic.StoreInt64(&dumpedBodyBytes, 0)
+	}(*dumpBodiesDir, *dumpBodiesMaxFiles, *dumpBodiesMaxTotalSize)
+
+	dir, err := ioutil.TempDir("", "body_dump_test")
+	if err != nil {
+		t.Fatalf("cannot create temporary dir: %s", err)
+	}
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+	*dumpBodiesDir = dir
+	*dumpBodiesMaxFiles = 2
+	*dumpBodiesMaxTotalSize = 10
+	atomic.StoreInt64(&dumpedBodyBytes, 0)
+
+	bd := NewBodyDumper("test")
+	dump := func(body string) {
+		t.Helper()
+		req := httptest.NewRequest("POST", "/write?db=foo", strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer secret")
+		req.Header.Set("Content-Type", "text/plain")
+		bdr := bd.NewReader(req, req.Body)
+		data, err := ioutil.ReadAll(bdr)
+		if err != nil {
+			t.Fatalf("cannot read body: %s", err)
+		}
+		if string(data) != body {
+			t.Fatalf("unexpected body read; got %q; want %q", data, body)
+		}
+		bdr.Finish()
+	}
+	// Empty bodies aren't dumped
+	dump("")
+	dump("foo 123")
+	// The body is truncated to -insert.dumpBodiesMaxTotalSize
+	dump("bar 456")
+	// -insert.dumpBodiesMaxFiles is reached
+	dump("baz 789")
+
+	bodies, err := filepath.Glob(filepath.Join(dir, "test-*.body"))
+	if err != nil {
+		t.Fatalf("cannot list dumped bodies: %s", err)
+	}
+	if len(bodies) != 2 {
+		t.Fatalf("unexpected number of dumped bodies; got %d; want 2", len(bodies))
+	}
+	var dumped []string
+	for _, path := range bodies {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatalf("cannot read dumped body: %s", err)
+		}
+		dumped = append(dumped, string(data))
+
+		mdData, err := ioutil.ReadFile(strings.TrimSuffix(path, ".body") + ".json")
+		if err != nil {
+			t.Fatalf("cannot read dumped metadata: %s", err)
+		}
+		var md bodyDumpMetadata
+		if err := json.Unmarshal(mdData, &md); err != nil {
+			t.Fatalf("cannot parse dumped metadata: %s", err)
+		}
+		if md.Protocol != "test" || md.URL != "/write?db=foo" || md.Size != len(data) || md.Truncated != (len(data) < len("foo 123")) {
+			t.Fatalf("unexpected metadata: %+v", md)
+		}
+		if s := md.Headers["Authorization"]; len(s) != 1 || s[0] != "<redacted>" {
+			t.Fatalf("Authorization header must be redacted; got %q", s)
+		}
+		if s := md.Headers["Content-Type"]; len(s) != 1 || s[0] != "text/plain" {
+			t.Fatalf("unexpected Content-Type header: %q", s)
+		}
+	}
+	all := strings.Join(dumped, "|")
+	if all != "foo 123|bar" && all != "bar|foo 123" {
+		t.Fatalf("unexpected dumped bodies: %q", dumped)
+	}
+}
@@ -0,0 +1,224 @@
+package common
+
+import (
+	"flag"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/bytesutil"
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/prompb"
+)
+
+var constantTagsWindow = flag.Duration("debug.constantTagsWindow", 0, "The window for detecting tags with a single value across all the series of a metric. "+
+	"Such tags are candidates for promotion to global labels. They are exposed at /debug/insert/constant-tags page of -debug.insertListenAddr. "+
+	"The detection adds overhead per ingested row, so it is disabled by default")
+
+const (
+	// maxConstantTagsMetrics is the maximum number of distinct metric names tracked per window.
+	//
+	// Rows for metric names above this limit are counted in untrackedRows.
+	maxConstantTagsMetrics = 1000
+
+	// maxConstantTagsKeysPerMetric is the maximum number of distinct tag keys tracked per metric.
+	//
+	// Tags with keys above this limit are ignored.
+	maxConstantTagsKeysPerMetric = 64
+)
+
+// constantTagsEnabled is set to non-zero when constant tags must be detected.
+var constantTagsEnabled uint32
+
+// constantTagsTracker tracks tag values per metric during the current window.
+type constantTagsTracker struct {
+	mu sync.Mutex
+
+	windowStart   time.Time
+	metrics       map[string]*metricTagsStats
+	untrackedRows uint64
+
+	// last contains the report for the last completed window.
+	last *constantTagsReport
+}
+
+type metricTagsStats struct {
+	rows uint64
+	tags map[string]*tagValueStats
+}
+
+type tagValueStats struct {
+	value string
+	rows  uint64
+
+	// varying is set if more than one value has been observed for the tag.
+	varying bool
+}
+
+var ctt constantTagsTracker
+
+// startConstantTagsTracking enables constant tags detection if -debug.constantTagsWindow is set.
+func startConstantTagsTracking() {
+	if *constantTagsWindow <= 0 {
+		return
+	}
+	ctt.mu.Lock()
+	ctt.resetLocked(time.Now())
+	ctt.last = nil
+	ctt.mu.Unlock()
+	atomic.StoreUint32(&constantTagsEnabled, 1)
+}
+
+// stopConstantTagsTracking disables constant tags detection.
+func stopConstantTagsTracking() {
+	atomic.StoreUint32(&constantTagsEnabled, 0)
+}
+
+// trackConstantTags registers tags from labels for the metric name from labels if constant tags detection is enabled.
+func trackConstantTags(labels []prompb.Label) {
+	if atomic.LoadUint32(&constantTagsEnabled) == 0 {
+		return
+	}
+	name := getMetricName(labels)
+	if len(name) == 0 {
+		return
+	}
+	now := time.Now()
+
+	ctt.mu.Lock()
+	defer ctt.mu.Unlock()
+
+	ctt.rotateLocked(now)
+	mts := ctt.metrics[bytesutil.ToUnsafeString(name)]
+	if mts == nil {
+		if len(ctt.metrics) >= maxConstantTagsMetrics {
+			ctt.untrackedRows++
+			return
+		}
+		mts = &metricTagsStats{
+			tags: make(map[string]*tagValueStats),
+		}
+		ctt.metrics[string(name)] = mts
+	}
+	mts.rows++
+	for _, label := range labels {
+		if len(label.Name) == 0 || string(label.Name) == "__name__" {
+			continue
+		}
+		tvs := mts.tags[bytesutil.ToUnsafeString(label.Name)]
+		if tvs == nil {
+			if len(mts.tags) >= maxConstantTagsKeysPerMetric {
+				continue
+			}
+			tvs = &tagValueStats{
+				value: string(label.Value),
+			}
+			mts.tags[string(label.Name)] = tvs
+		}
+		tvs.rows++
+		if !tvs.varying && tvs.value != bytesutil.ToUnsafeString(label.Value) {
+			// Release the value, since it is no longer needed.
+			tvs.value = ""
+			tvs.varying = true
+		}
+	}
+}
+
+// rotateLocked completes the current window if it is older than -debug.constantTagsWindow.
+func (ct *constantTagsTracker) rotateLocked(now time.Time) {
+	if now.Sub(ct.windowStart) < *constantTagsWindow {
+		return
+	}
+	ct.last = ct.reportLocked(now, true)
+	ct.resetLocked(now)
+}
+
+func (ct *constantTagsTracker) resetLocked(now time.Time) {
+	ct.windowStart = now
+	ct.metrics = make(map[string]*metricTagsStats)
+	ct.untrackedRows = 0
+}
+
+type constantTagsReport struct {
+	Window         string              `json:"window"`
+	WindowStart    time.Time           `json:"windowStart"`
+	WindowEnd      time.Time           `json:"windowEnd"`
+	Complete       bool                `json:"complete"`
+	Candidates     []constantTagsEntry `json:"candidates"`
+	TrackedMetrics int                 `json:"trackedMetrics"`
+	UntrackedRows  uint64              `json:"untrackedRows"`
+}
+
+type constantTagsEntry struct {
+	Metric string        `json:"metric"`
+	Rows   uint64        `json:"rows"`
+	Tags   []constantTag `json:"tags"`
+}
+
+type constantTag struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+// reportLocked returns constant tags detected in the current window.
+//
+// A tag is reported if it has a single value in all the rows of the metric.
+// Metrics without varying tags are skipped, since all their rows may belong to a single series.
+func (ct *constantTagsTracker) reportLocked(now time.Time, complete bool) *constantTagsReport {
+	ctr := &constantTagsReport{
+		Window:         constantTagsWindow.String(),
+		WindowStart:    ct.windowStart,
+		WindowEnd:      now,
+		Complete:       complete,
+		Candidates:     []constantTagsEntry{},
+		TrackedMetrics: len(ct.metrics),
+		UntrackedRows:  ct.untrackedRows,
+	}
+	for name, mts := range ct.metrics {
+		var tags []constantTag
+		hasVaryingTags := false
+		for key, tvs := range mts.tags {
+			if tvs.varying || tvs.rows != mts.rows {
+				hasVaryingTags = true
+				continue
+			}
+			tags = append(tags, constantTag{
+				Key:   key,
+				Value: tvs.value,
+			})
+		}
+		if !hasVaryingTags || len(tags) == 0 {
+			continue
+		}
+		sort.Slice(tags, func(i, j int) bool {
+			return tags[i].Key < tags[j].Key
+		})
+		ctr.Candidates = append(ctr.Candidates, constantTagsEntry{
+			Metric: name,
+			Rows:   mts.rows,
+			Tags:   tags,
+		})
+	}
+	sort.Slice(ctr.Candidates, func(i, j int) bool {
+		return ctr.Candidates[i].Metric < ctr.Candidates[j].Metric
+	})
+	return ctr
+}
+
+// getConstantTagsReport returns constant tags for the last completed window.
+//
+// The report for the current window is returned if there are no completed windows yet.
+// nil is returned if constant tags detection is disabled.
+func getConstantTagsReport() *constantTagsReport {
+	if atomic.LoadUint32(&constantTagsEnabled) == 0 {
+		return nil
+	}
+	now := time.Now()
+	ctt.mu.Lock()
+	defer ctt.mu.Unlock()
+	ctt.rotateLocked(now)
+	if ctt.last != nil {
+		return ctt.last
+	}
+	return ctt.reportLocked(now, false)
+}
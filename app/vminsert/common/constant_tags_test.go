@@ -0,0 +1,90 @@
+package common
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/prompb"
+)
+
+func TestConstantTagsHandler(t *testing.T) {
+	defer func(window time.Duration) {
+		*constantTagsWindow = window
+		stopConstantTagsTracking()
+	}(*constantTagsWindow)
+
+	// Detection is disabled
+	w := httptest.NewRecorder()
+	debugHandler(w, httptest.NewRequest("GET", "/debug/insert/constant-tags", nil))
+	if w.Code != 404 {
+		t.Fatalf("unexpected status code for disabled detection; got %d; want 404", w.Code)
+	}
+
+	*constantTagsWindow = time.Hour
+	startConstantTagsTracking()
+
+	track := func(name string, tags ...string) {
+		labels := []prompb.Label{
+			{Name: []byte("__name__"), Value: []byte(name)},
+		}
+		for i := 0; i < len(tags); i += 2 {
+			labels = append(labels, prompb.Label{
+				Name:  []byte(tags[i]),
+				Value: []byte(tags[i+1]),
+			})
+		}
+		trackConstantTags(labels)
+	}
+	track("foo", "region", "us", "host", "a", "dc", "x")
+	track("foo", "region", "us", "host", "b", "dc", "x")
+	track("foo", "region", "us", "host", "c")
+
+	// A single series must be skipped
+	track("bar", "region", "us")
+	track("bar", "region", "us")
+
+	// All the tags vary
+	track("baz", "host", "a")
+	track("baz", "host", "b")
+
+	w = httptest.NewRecorder()
+	debugHandler(w, httptest.NewRequest("GET", "/debug/insert/constant-tags", nil))
+	if w.Code != 200 {
+		t.Fatalf("unexpected status code; got %d; want 200; body: %s", w.Code, w.Body.String())
+	}
+	var ctr constantTagsReport
+	if err := json.Unmarshal(w.Body.Bytes(), &ctr); err != nil {
+		t.Fatalf("cannot parse response: %s", err)
+	}
+	if ctr.Complete {
+		t.Fatalf("the window mustn't be complete")
+	}
+	if ctr.TrackedMetrics != 3 {
+		t.Fatalf("unexpected number of tracked metrics; got %d; want 3", ctr.TrackedMetrics)
+	}
+	candidatesExpected := []constantTagsEntry{{
+		Metric: "foo",
+		Rows:   3,
+		Tags:   []constantTag{{Key: "region", Value: "us"}},
+	}}
+	if !reflect.DeepEqual(ctr.Candidates, candidatesExpected) {
+		t.Fatalf("unexpected candidates;\ngot\n%+v\nwant\n%+v", ctr.Candidates, candidatesExpected)
+	}
+
+	// The completed window must be returned after the window ends
+	ctt.mu.Lock()
+	ctt.windowStart = ctt.windowStart.Add(-2 * time.Hour)
+	ctt.mu.Unlock()
+	track("foo", "region", "eu", "host", "a")
+	track("foo", "region", "eu", "host", "b")
+	ctr1 := getConstantTagsReport()
+	if !ctr1.Complete {
+		t.Fatalf("the window must be complete")
+	}
+	if !reflect.DeepEqual(ctr1.Candidates, candidatesExpected) {
+		t.Fatalf("unexpected candidates for the completed window;\ngot\n%+v\nwant\n%+v", ctr1.Candidates, candidatesExpected)
+	}
+}
@@ -0,0 +1,140 @@
+package common
+
+import (
+	"compress/zlib"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/logger"
+)
+
+// ContentDecoder decodes request body according to Content-Encoding header.
+//
+// Multiple comma-separated encodings such as `deflate, gzip` are decoded in reverse order,
+// since they are listed in the order they were applied.
+// The decompression ratio for the whole chain is limited by -insert.maxDecompressionRatio.
+type ContentDecoder struct {
+	r  io.Reader
+	cr countingReader
+
+	gzs     []*GzipReader
+	closers []io.Closer
+
+	// decodedBytes is the number of decoded bytes read from r.
+	decodedBytes int64
+}
+
+// GetContentDecoder returns decoder for the body r of req according to req Content-Encoding header.
+//
+// An error is returned if the header contains unsupported encodings.
+// Return the decoder to the pool with PutContentDecoder when no longer needed.
+func GetContentDecoder(r io.Reader, req *http.Request) (*ContentDecoder, error) {
+	return GetHeaderContentDecoder(r, req.Header)
+}
+
+// GetHeaderContentDecoder returns decoder for r according to Content-Encoding header in h.
+//
+// It is used for decoding parts of multipart requests, which have their own headers. See GetContentDecoder for details.
+func GetHeaderContentDecoder(r io.Reader, h http.Header) (*ContentDecoder, error) {
+	// Use the map lookup instead of h.Values, which is missing in Go 1.12. The header key is canonical in both requests and multipart parts.
+	encodings, err := parseContentEncodings(h["Content-Encoding"])
+	if err != nil {
+		return nil, err
+	}
+	v := contentDecoderPool.Get()
+	if v == nil {
+		v = &ContentDecoder{}
+	}
+	cd := v.(*ContentDecoder)
+	cd.cr.r = r
+	cd.r = &cd.cr
+	for i := len(encodings) - 1; i >= 0; i-- {
+		switch encodings[i] {
+		case "gzip":
+			zr, err := GetGzipReader(cd.r)
+			if err != nil {
+				PutContentDecoder(cd)
+				return nil, fmt.Errorf("cannot read gzip-encoded data: %s", err)
+			}
+			cd.gzs = append(cd.gzs, zr)
+			cd.r = zr
+		case "deflate":
+			zr, err := zlib.NewReader(cd.r)
+			if err != nil {
+				PutContentDecoder(cd)
+				return nil, fmt.Errorf("cannot read deflate-encoded data: %s", err)
+			}
+			cd.closers = append(cd.closers, zr)
+			cd.r = zr
+		default:
+			logger.Panicf("BUG: unexpected encoding %q", encodings[i])
+		}
+	}
+	return cd, nil
+}
+
+// PutContentDecoder returns cd to the pool.
+func PutContentDecoder(cd *ContentDecoder) {
+	for _, zr := range cd.gzs {
+		PutGzipReader(zr)
+	}
+	cd.gzs = cd.gzs[:0]
+	for _, c := range cd.closers {
+		_ = c.Close()
+	}
+	cd.closers = cd.closers[:0]
+	cd.r = nil
+	cd.cr.r = nil
+	cd.cr.n = 0
+	cd.decodedBytes = 0
+	contentDecoderPool.Put(cd)
+}
+
+var contentDecoderPool sync.Pool
+
+// IsEncoded returns true if the body is compressed with at least a single encoding.
+func (cd *ContentDecoder) IsEncoded() bool {
+	return len(cd.gzs)+len(cd.closers) > 0
+}
+
+// Read reads decoded data from cd.
+func (cd *ContentDecoder) Read(p []byte) (int, error) {
+	n, err := cd.r.Read(p)
+	if err == ErrZipBomb {
+		// The ratio has been already exceeded at one of gzip layers.
+		return n, err
+	}
+	cd.decodedBytes += int64(n)
+	if ratio := int64(*maxDecompressionRatio); ratio > 0 && cd.decodedBytes > minRatioCheckBytes {
+		if cd.decodedBytes > ratio*cd.cr.n {
+			zipBombRejected.Inc()
+			return n, ErrZipBomb
+		}
+	}
+	return n, err
+}
+
+// parseContentEncodings returns lowercase encodings from Content-Encoding header values.
+//
+// Encodings are matched case-insensitively. Whitespace, empty items and `identity` encodings are ignored.
+func parseContentEncodings(values []string) ([]string, error) {
+	var encodings []string
+	for _, v := range values {
+		for _, encoding := range strings.Split(v, ",") {
+			encoding = strings.ToLower(strings.TrimSpace(encoding))
+			switch encoding {
+			case "", "identity":
+			case "gzip", "x-gzip":
+				encodings = append(encodings, "gzip")
+			case "deflate":
+				encodings = append(encodings, "deflate")
+			default:
+				return nil, fmt.Errorf("unsupported Content-Encoding %q in %q; supported encodings: gzip, deflate, identity", encoding, strings.Join(values, ", "))
+			}
+		}
+	}
+	return encodings, nil
+}
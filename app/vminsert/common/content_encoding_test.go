@@ -0,0 +1,113 @@
+package common
+
+import (
+	"bytes"
+	"compress/zlib"
+	"io/ioutil"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestContentDecoder(t *testing.T) {
+	data := []byte("foo bar baz")
+	gzipped := compressGzip(t, data)
+	deflated := compressDeflate(t, data)
+
+	f := func(headers []string, body, resultExpected []byte, isEncodedExpected bool) {
+		t.Helper()
+		req := httptest.NewRequest("POST", "/", nil)
+		for _, h := range headers {
+			req.Header.Add("Content-Encoding", h)
+		}
+		cd, err := GetContentDecoder(bytes.NewReader(body), req)
+		if err != nil {
+			t.Fatalf("unexpected error for Content-Encoding %q: %s", headers, err)
+		}
+		defer PutContentDecoder(cd)
+		if cd.IsEncoded() != isEncodedExpected {
+			t.Fatalf("unexpected IsEncoded for Content-Encoding %q; got %v; want %v", headers, cd.IsEncoded(), isEncodedExpected)
+		}
+		result, err := ioutil.ReadAll(cd)
+		if err != nil {
+			t.Fatalf("cannot decode data for Content-Encoding %q: %s", headers, err)
+		}
+		if !bytes.Equal(result, resultExpected) {
+			t.Fatalf("unexpected data for Content-Encoding %q; got %q; want %q", headers, result, resultExpected)
+		}
+	}
+	f(nil, data, data, false)
+	f([]string{""}, data, data, false)
+	f([]string{"identity"}, data, data, false)
+	f([]string{"gzip"}, gzipped, data, true)
+	f([]string{"Gzip"}, gzipped, data, true)
+	f([]string{"GZIP"}, gzipped, data, true)
+	f([]string{" gzip "}, gzipped, data, true)
+	f([]string{"gzip, "}, gzipped, data, true)
+	f([]string{"x-gzip"}, gzipped, data, true)
+	f([]string{"identity, gzip"}, gzipped, data, true)
+	f([]string{"deflate"}, deflated, data, true)
+
+	// Concatenated gzip members are decoded as a single stream
+	f([]string{"gzip"}, append(compressGzip(t, data), gzipped...), append(append([]byte{}, data...), data...), true)
+
+	// Multiple encodings are decoded in reverse order
+	f([]string{"gzip, gzip"}, compressGzip(t, gzipped), data, true)
+	f([]string{"gzip", "gzip"}, compressGzip(t, gzipped), data, true)
+	f([]string{"deflate, gzip"}, compressGzip(t, deflated), data, true)
+	f([]string{"gzip, deflate"}, compressDeflate(t, gzipped), data, true)
+}
+
+func TestContentDecoderFailure(t *testing.T) {
+	f := func(header string, body []byte, errSubstr string) {
+		t.Helper()
+		req := httptest.NewRequest("POST", "/", nil)
+		req.Header.Set("Content-Encoding", header)
+		cd, err := GetContentDecoder(bytes.NewReader(body), req)
+		if err == nil {
+			PutContentDecoder(cd)
+			t.Fatalf("expecting non-nil error for Content-Encoding %q", header)
+		}
+		if !strings.Contains(err.Error(), errSubstr) {
+			t.Fatalf("missing %q in the error for Content-Encoding %q: %s", errSubstr, header, err)
+		}
+	}
+	f("snappy", nil, `"snappy"`)
+	f("gzip, br", nil, `"br"`)
+	f("gzip", []byte("foobar"), "gzip")
+	f("deflate", []byte("foobar"), "deflate")
+}
+
+func TestContentDecoderZipBomb(t *testing.T) {
+	defer func(v int) {
+		*maxDecompressionRatio = v
+	}(*maxDecompressionRatio)
+	*maxDecompressionRatio = 100
+
+	// Too high decompression ratio must be detected for multiple encodings.
+	data := make([]byte, 4*minRatioCheckBytes)
+	body := compressGzip(t, compressGzip(t, data))
+	req := httptest.NewRequest("POST", "/", nil)
+	req.Header.Set("Content-Encoding", "gzip, gzip")
+	cd, err := GetContentDecoder(bytes.NewReader(body), req)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer PutContentDecoder(cd)
+	if _, err := ioutil.ReadAll(cd); err != ErrZipBomb {
+		t.Fatalf("unexpected error; got %v; want %v", err, ErrZipBomb)
+	}
+}
+
+func compressDeflate(t *testing.T, data []byte) []byte {
+	t.Helper()
+	var bb bytes.Buffer
+	zw := zlib.NewWriter(&bb)
+	if _, err := zw.Write(data); err != nil {
+		t.Fatalf("cannot compress data: %s", err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatalf("cannot close zlib writer: %s", err)
+	}
+	return bb.Bytes()
+}
@@ -0,0 +1,78 @@
+package common
+
+import (
+	"flag"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/httpserver"
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/logger"
+)
+
+var jsonContentTypes = flag.String("insert.jsonContentTypes", "", "Comma-separated list of `path=contentType` pairs with Content-Type for JSON responses "+
+	"at the given insert paths, for instance, `/api/uid/assign=text/plain`. JSON responses for other paths are returned with `application/json` Content-Type")
+
+// defaultJSONContentType is Content-Type for JSON responses at paths missing in -insert.jsonContentTypes.
+const defaultJSONContentType = "application/json"
+
+var jsonContentTypesByPath map[string]string
+
+// InitContentTypes parses -insert.jsonContentTypes.
+//
+// InitContentTypes must be called after flag.Parse call.
+func InitContentTypes() {
+	m, err := parseContentTypes(*jsonContentTypes)
+	if err != nil {
+		logger.Fatalf("cannot parse -insert.jsonContentTypes=%q: %s", *jsonContentTypes, err)
+	}
+	jsonContentTypesByPath = m
+}
+
+// parseContentTypes parses comma-separated `path=contentType` pairs from s.
+func parseContentTypes(s string) (map[string]string, error) {
+	if len(s) == 0 {
+		return nil, nil
+	}
+	m := make(map[string]string)
+	for _, kv := range strings.Split(s, ",") {
+		n := strings.IndexByte(kv, '=')
+		if n < 0 {
+			return nil, fmt.Errorf("missing `=` in %q", kv)
+		}
+		path := strings.TrimSpace(kv[:n])
+		contentType := strings.TrimSpace(kv[n+1:])
+		if !strings.HasPrefix(path, "/") {
+			return nil, fmt.Errorf("path must start with `/` in %q", kv)
+		}
+		if len(contentType) == 0 {
+			return nil, fmt.Errorf("missing content type in %q", kv)
+		}
+		if _, ok := m[path]; ok {
+			return nil, fmt.Errorf("duplicate path %q", path)
+		}
+		m[path] = contentType
+	}
+	return m, nil
+}
+
+// SetJSONContentType sets Content-Type response header for JSON response to req.
+//
+// The header value is taken from -insert.jsonContentTypes for req path. It defaults to `application/json`.
+func SetJSONContentType(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", getJSONContentType(req))
+}
+
+// WriteJSONResponse writes JSON data response to req with Content-Type set according to -insert.jsonContentTypes.
+//
+// See httpserver.WriteResponse for details.
+func WriteJSONResponse(w http.ResponseWriter, req *http.Request, data []byte) {
+	httpserver.WriteResponse(w, http.StatusOK, getJSONContentType(req), data)
+}
+
+func getJSONContentType(req *http.Request) string {
+	if v, ok := jsonContentTypesByPath[strings.Replace(req.URL.Path, "//", "/", -1)]; ok {
+		return v
+	}
+	return defaultJSONContentType
+}
@@ -0,0 +1,45 @@
+package common
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestParseContentTypesFailure(t *testing.T) {
+	f := func(s string) {
+		t.Helper()
+		if _, err := parseContentTypes(s); err == nil {
+			t.Fatalf("expecting non-nil error when parsing %q", s)
+		}
+	}
+	f("/query")
+	f("/query=")
+	f("query=text/plain")
+	f("/query=text/plain,")
+	f("/query=text/plain,/query=application/json")
+}
+
+func TestSetJSONContentType(t *testing.T) {
+	defer func(m map[string]string) {
+		jsonContentTypesByPath = m
+	}(jsonContentTypesByPath)
+
+	m, err := parseContentTypes(" /api/uid/assign = text/plain; charset=utf-8 ,/query=application/json")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	jsonContentTypesByPath = m
+
+	f := func(path, contentTypeExpected string) {
+		t.Helper()
+		w := httptest.NewRecorder()
+		SetJSONContentType(w, httptest.NewRequest("POST", path, nil))
+		if contentType := w.Header().Get("Content-Type"); contentType != contentTypeExpected {
+			t.Fatalf("unexpected Content-Type for %q; got %q; want %q", path, contentType, contentTypeExpected)
+		}
+	}
+	f("/api/uid/assign", "text/plain; charset=utf-8")
+	f("//api/uid/assign", "text/plain; charset=utf-8")
+	f("/query", "application/json")
+	f("/_bulk", "application/json")
+}
@@ -0,0 +1,153 @@
+package common
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/logger"
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/netutil"
+	"github.com/VictoriaMetrics/metrics"
+)
+
+// defaultTopMetrics is the default number of metrics returned in topMetrics of the debug view.
+const defaultTopMetrics = 20
+
+var debugServer *http.Server
+
+// ServeDebug starts debug server at the given addr.
+//
+// The server returns parse stats, per-protocol parse errors, top metrics by the number of rows
+// and tagsPool stats in a single JSON view. Constant tags detected with -debug.constantTagsWindow
+// are returned at /debug/insert/constant-tags, while the last ingestion time per metric tracked
+// with -debug.lastSeenMaxMetrics is returned at /debug/insert/last-seen. Traces for requests sampled
+// with -insert.traceSampleRate are returned at /debug/insert/traces. It must be stopped with StopDebug.
+func ServeDebug(addr string) {
+	logger.Infof("starting insert debug server at %q", addr)
+	ln, err := netutil.NewTCPListener("insert-debug", addr)
+	if err != nil {
+		logger.Fatalf("cannot start insert debug server at %q: %s", addr, err)
+	}
+	atomic.StoreUint32(&topMetricsEnabled, 1)
+	startConstantTagsTracking()
+	startLastSeenTracking()
+	debugServer = &http.Server{
+		Handler:  http.HandlerFunc(debugHandler),
+		ErrorLog: logger.StdErrorLogger(),
+	}
+	if err := debugServer.Serve(ln); err != nil {
+		if err == http.ErrServerClosed {
+			logger.Infof("stopped insert debug server at %q", addr)
+			return
+		}
+		logger.Fatalf("cannot serve insert debug server at %q: %s", addr, err)
+	}
+}
+
+// StopDebug stops debug server started with ServeDebug.
+func StopDebug() {
+	logger.Infof("stopping insert debug server...")
+	atomic.StoreUint32(&topMetricsEnabled, 0)
+	stopConstantTagsTracking()
+	stopLastSeenTracking()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := debugServer.Shutdown(ctx); err != nil {
+		logger.Errorf("cannot stop insert debug server: %s", err)
+	}
+}
+
+// debugHandler writes debug stats in JSON.
+//
+// The number of returned top metrics may be set via `top` query arg.
+func debugHandler(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/debug/insert/constant-tags" {
+		constantTagsHandler(w)
+		return
+	}
+	if r.URL.Path == "/debug/insert/last-seen" {
+		lastSeenHandler(w, r)
+		return
+	}
+	if r.URL.Path == "/debug/insert/traces" {
+		tracesHandler(w)
+		return
+	}
+	debugRequests.Inc()
+	if r.URL.Path != "/" && r.URL.Path != "/debug/insert" {
+		http.Error(w, "unsupported path; use /debug/insert, /debug/insert/constant-tags, /debug/insert/last-seen or /debug/insert/traces", http.StatusNotFound)
+		return
+	}
+	topN := defaultTopMetrics
+	if s := r.FormValue("top"); len(s) > 0 {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 0 {
+			http.Error(w, "cannot parse `top` query arg: it must be a non-negative integer", http.StatusBadRequest)
+			return
+		}
+		topN = n
+	}
+	writeDebugJSON(w, getDebugStats(topN))
+}
+
+// constantTagsHandler writes tags with constant values per metric in JSON.
+func constantTagsHandler(w http.ResponseWriter) {
+	constantTagsRequests.Inc()
+	ctr := getConstantTagsReport()
+	if ctr == nil {
+		http.Error(w, "constant tags detection is disabled; enable it with -debug.constantTagsWindow", http.StatusNotFound)
+		return
+	}
+	writeDebugJSON(w, ctr)
+}
+
+// lastSeenHandler writes the last ingestion time per metric in JSON.
+//
+// Only metrics, which weren't ingested during the duration from `stale` query arg, are returned if it is set.
+func lastSeenHandler(w http.ResponseWriter, r *http.Request) {
+	lastSeenRequests.Inc()
+	var minAge time.Duration
+	if s := r.FormValue("stale"); len(s) > 0 {
+		d, err := time.ParseDuration(s)
+		if err != nil || d < 0 {
+			http.Error(w, "cannot parse `stale` query arg: it must be a non-negative duration such as 5m", http.StatusBadRequest)
+			return
+		}
+		minAge = d
+	}
+	lsr := getLastSeenReport(time.Now(), minAge)
+	if lsr == nil {
+		http.Error(w, "last seen tracking is disabled; enable it with -debug.lastSeenMaxMetrics", http.StatusNotFound)
+		return
+	}
+	writeDebugJSON(w, lsr)
+}
+
+// tracesHandler writes the most recent traces for requests sampled with -insert.traceSampleRate in JSON.
+func tracesHandler(w http.ResponseWriter) {
+	tracesRequests.Inc()
+	if *traceSampleRate <= 0 {
+		http.Error(w, "request tracing is disabled; enable it with -insert.traceSampleRate", http.StatusNotFound)
+		return
+	}
+	writeDebugJSON(w, recentTraces.getAll())
+}
+
+func writeDebugJSON(w http.ResponseWriter, v interface{}) {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		logger.Panicf("BUG: cannot marshal debug stats: %s", err)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(data)
+}
+
+var (
+	debugRequests        = metrics.NewCounter(`vm_http_requests_total{path="/debug/insert", protocol="debug"}`)
+	constantTagsRequests = metrics.NewCounter(`vm_http_requests_total{path="/debug/insert/constant-tags", protocol="debug"}`)
+	lastSeenRequests     = metrics.NewCounter(`vm_http_requests_total{path="/debug/insert/last-seen", protocol="debug"}`)
+	tracesRequests       = metrics.NewCounter(`vm_http_requests_total{path="/debug/insert/traces", protocol="debug"}`)
+)
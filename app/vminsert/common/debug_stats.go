@@ -0,0 +1,255 @@
+package common
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/bytesutil"
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/prompb"
+)
+
+// maxRecentParseErrors is the maximum number of recent parse errors kept per protocol.
+const maxRecentParseErrors = 10
+
+// maxTrackedMetrics is the maximum number of distinct metric names tracked for the top metrics view.
+//
+// Rows for metric names above this limit are counted in untrackedMetricRows.
+const maxTrackedMetrics = 10000
+
+// protocolStats contains debug stats for a single protocol.
+//
+// The stats are exposed via -debug.insertListenAddr.
+type protocolStats struct {
+	mu           sync.Mutex
+	parseErrors  uint64
+	errorsByCode map[string]uint64
+	recentErrors []recentParseError
+	nextRecent   int
+
+	tagsPool *TagsPoolStats
+}
+
+type recentParseError struct {
+	Time      time.Time `json:"time"`
+	Error     string    `json:"error"`
+	RequestID string    `json:"requestID,omitempty"`
+}
+
+var (
+	protocolStatsLock sync.Mutex
+	protocolStatsMap  = make(map[string]*protocolStats)
+)
+
+// getProtocolStats returns stats for the given protocol, registering them on the first call.
+func getProtocolStats(protocol string) *protocolStats {
+	protocolStatsLock.Lock()
+	defer protocolStatsLock.Unlock()
+	ps := protocolStatsMap[protocol]
+	if ps == nil {
+		ps = &protocolStats{
+			errorsByCode: make(map[string]uint64),
+		}
+		protocolStatsMap[protocol] = ps
+	}
+	return ps
+}
+
+// addParseError registers err in ps.
+func (ps *protocolStats) addParseError(now time.Time, err error, requestID string) {
+	code := "other"
+	if c := GetParseErrorCode(err); c != nil {
+		code = c.Error()
+	}
+	re := recentParseError{
+		Time:      now,
+		Error:     err.Error(),
+		RequestID: requestID,
+	}
+
+	ps.mu.Lock()
+	ps.parseErrors++
+	ps.errorsByCode[code]++
+	if len(ps.recentErrors) < maxRecentParseErrors {
+		ps.recentErrors = append(ps.recentErrors, re)
+	} else {
+		ps.recentErrors[ps.nextRecent] = re
+	}
+	ps.nextRecent = (ps.nextRecent + 1) % maxRecentParseErrors
+	ps.mu.Unlock()
+}
+
+// TagsPoolStats contains stats for tagsPool of a single protocol parser.
+type TagsPoolStats struct {
+	unmarshalCalls uint64
+	tagsTotal      uint64
+	maxLen         uint64
+	maxCap         uint64
+}
+
+// NewTagsPoolStats returns new TagsPoolStats for the given protocol.
+//
+// It must be called only once per protocol, usually during package initialization.
+func NewTagsPoolStats(protocol string) *TagsPoolStats {
+	ps := getProtocolStats(protocol)
+	tps := &TagsPoolStats{}
+	ps.mu.Lock()
+	ps.tagsPool = tps
+	ps.mu.Unlock()
+	return tps
+}
+
+// Update registers tagsPool with the given len and cap after a single Unmarshal call.
+func (tps *TagsPoolStats) Update(tagsLen, tagsCap int) {
+	atomic.AddUint64(&tps.unmarshalCalls, 1)
+	atomic.AddUint64(&tps.tagsTotal, uint64(tagsLen))
+	updateMax(&tps.maxLen, uint64(tagsLen))
+	updateMax(&tps.maxCap, uint64(tagsCap))
+}
+
+func updateMax(p *uint64, v uint64) {
+	for {
+		n := atomic.LoadUint64(p)
+		if v <= n || atomic.CompareAndSwapUint64(p, n, v) {
+			return
+		}
+	}
+}
+
+// topMetricsEnabled is set to non-zero when metric names must be tracked for the top metrics view.
+var topMetricsEnabled uint32
+
+var (
+	topMetricsLock      sync.Mutex
+	topMetrics          = make(map[string]*uint64)
+	untrackedMetricRows uint64
+)
+
+// trackMetricName registers a row for the metric name from labels if top metrics tracking is enabled.
+func trackMetricName(labels []prompb.Label) {
+	if atomic.LoadUint32(&topMetricsEnabled) == 0 {
+		return
+	}
+	name := getMetricName(labels)
+	if len(name) == 0 {
+		return
+	}
+	topMetricsLock.Lock()
+	if p := topMetrics[bytesutil.ToUnsafeString(name)]; p != nil {
+		*p++
+	} else if len(topMetrics) < maxTrackedMetrics {
+		n := uint64(1)
+		topMetrics[string(name)] = &n
+	} else {
+		untrackedMetricRows++
+	}
+	topMetricsLock.Unlock()
+}
+
+// getMetricName returns metric name from labels.
+//
+// nil is returned if labels have no metric name.
+func getMetricName(labels []prompb.Label) []byte {
+	for _, label := range labels {
+		if len(label.Name) == 0 || string(label.Name) == "__name__" {
+			return label.Value
+		}
+	}
+	return nil
+}
+
+type debugStats struct {
+	Protocols           map[string]protocolDebugStats `json:"protocols"`
+	TopMetrics          []metricRows                  `json:"topMetrics"`
+	TrackedMetrics      int                           `json:"trackedMetrics"`
+	UntrackedMetricRows uint64                        `json:"untrackedMetricRows"`
+}
+
+type protocolDebugStats struct {
+	ParseErrors       uint64              `json:"parseErrors"`
+	ParseErrorsByCode map[string]uint64   `json:"parseErrorsByCode"`
+	RecentParseErrors []recentParseError  `json:"recentParseErrors"`
+	TagsPool          *tagsPoolDebugStats `json:"tagsPool,omitempty"`
+}
+
+type tagsPoolDebugStats struct {
+	UnmarshalCalls uint64  `json:"unmarshalCalls"`
+	AvgTagsPerCall float64 `json:"avgTagsPerCall"`
+	MaxLen         uint64  `json:"maxLen"`
+	MaxCap         uint64  `json:"maxCap"`
+}
+
+type metricRows struct {
+	Name string `json:"name"`
+	Rows uint64 `json:"rows"`
+}
+
+// getDebugStats returns a snapshot of debug stats with up to topN metrics with the biggest number of rows.
+func getDebugStats(topN int) *debugStats {
+	ds := &debugStats{
+		Protocols: make(map[string]protocolDebugStats),
+	}
+
+	protocolStatsLock.Lock()
+	for protocol, ps := range protocolStatsMap {
+		ds.Protocols[protocol] = ps.snapshot()
+	}
+	protocolStatsLock.Unlock()
+
+	topMetricsLock.Lock()
+	mrs := make([]metricRows, 0, len(topMetrics))
+	for name, p := range topMetrics {
+		mrs = append(mrs, metricRows{
+			Name: name,
+			Rows: *p,
+		})
+	}
+	ds.UntrackedMetricRows = untrackedMetricRows
+	topMetricsLock.Unlock()
+
+	sort.Slice(mrs, func(i, j int) bool {
+		if mrs[i].Rows != mrs[j].Rows {
+			return mrs[i].Rows > mrs[j].Rows
+		}
+		return mrs[i].Name < mrs[j].Name
+	})
+	ds.TrackedMetrics = len(mrs)
+	if len(mrs) > topN {
+		mrs = mrs[:topN]
+	}
+	ds.TopMetrics = mrs
+	return ds
+}
+
+func (ps *protocolStats) snapshot() protocolDebugStats {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	pds := protocolDebugStats{
+		ParseErrors:       ps.parseErrors,
+		ParseErrorsByCode: make(map[string]uint64, len(ps.errorsByCode)),
+		RecentParseErrors: make([]recentParseError, 0, len(ps.recentErrors)),
+	}
+	for code, n := range ps.errorsByCode {
+		pds.ParseErrorsByCode[code] = n
+	}
+	// Return recent errors starting from the newest one.
+	for i := 0; i < len(ps.recentErrors); i++ {
+		n := (ps.nextRecent - 1 - i + len(ps.recentErrors)) % len(ps.recentErrors)
+		pds.RecentParseErrors = append(pds.RecentParseErrors, ps.recentErrors[n])
+	}
+	if tps := ps.tagsPool; tps != nil {
+		calls := atomic.LoadUint64(&tps.unmarshalCalls)
+		tpds := &tagsPoolDebugStats{
+			UnmarshalCalls: calls,
+			MaxLen:         atomic.LoadUint64(&tps.maxLen),
+			MaxCap:         atomic.LoadUint64(&tps.maxCap),
+		}
+		if calls > 0 {
+			tpds.AvgTagsPerCall = float64(atomic.LoadUint64(&tps.tagsTotal)) / float64(calls)
+		}
+		pds.TagsPool = tpds
+	}
+	return pds
+}
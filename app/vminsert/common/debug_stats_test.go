@@ -0,0 +1,125 @@
+package common
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/prompb"
+)
+
+func TestProtocolStatsParseErrors(t *testing.T) {
+	ps := getProtocolStats("test-parse-errors")
+	start := time.Unix(1000, 0)
+	for i := 0; i < maxRecentParseErrors+3; i++ {
+		err := NewParseError(ErrBadValue, "error %d", i)
+		if i%2 == 1 {
+			err = fmt.Errorf("error %d", i)
+		}
+		ps.addParseError(start.Add(time.Duration(i)*time.Second), err, "")
+	}
+	pds := ps.snapshot()
+	if pds.ParseErrors != maxRecentParseErrors+3 {
+		t.Fatalf("unexpected number of parse errors; got %d; want %d", pds.ParseErrors, maxRecentParseErrors+3)
+	}
+	if n := pds.ParseErrorsByCode[ErrBadValue.Error()]; n != 7 {
+		t.Fatalf("unexpected number of %q errors; got %d; want 7", ErrBadValue, n)
+	}
+	if n := pds.ParseErrorsByCode["other"]; n != 6 {
+		t.Fatalf("unexpected number of other errors; got %d; want 6", n)
+	}
+	if len(pds.RecentParseErrors) != maxRecentParseErrors {
+		t.Fatalf("unexpected number of recent errors; got %d; want %d", len(pds.RecentParseErrors), maxRecentParseErrors)
+	}
+	for i, re := range pds.RecentParseErrors {
+		errExpected := fmt.Sprintf("error %d", maxRecentParseErrors+2-i)
+		if re.Error != errExpected {
+			t.Fatalf("unexpected recent error #%d; got %q; want %q", i, re.Error, errExpected)
+		}
+	}
+}
+
+func TestTagsPoolStats(t *testing.T) {
+	tps := NewTagsPoolStats("test-tags-pool")
+	tps.Update(4, 8)
+	tps.Update(2, 16)
+	tps.Update(0, 16)
+	pds := getProtocolStats("test-tags-pool").snapshot()
+	tpdsExpected := &tagsPoolDebugStats{
+		UnmarshalCalls: 3,
+		AvgTagsPerCall: 2,
+		MaxLen:         4,
+		MaxCap:         16,
+	}
+	if *pds.TagsPool != *tpdsExpected {
+		t.Fatalf("unexpected tagsPool stats; got %+v; want %+v", pds.TagsPool, tpdsExpected)
+	}
+}
+
+func TestDebugHandler(t *testing.T) {
+	defer func() {
+		atomic.StoreUint32(&topMetricsEnabled, 0)
+		topMetricsLock.Lock()
+		topMetrics = make(map[string]*uint64)
+		untrackedMetricRows = 0
+		topMetricsLock.Unlock()
+	}()
+	atomic.StoreUint32(&topMetricsEnabled, 1)
+
+	track := func(name string, n int) {
+		labels := []prompb.Label{
+			{Name: []byte("job"), Value: []byte("x")},
+			{Name: []byte("__name__"), Value: []byte(name)},
+		}
+		for i := 0; i < n; i++ {
+			trackMetricName(labels)
+		}
+	}
+	track("foo", 3)
+	track("bar", 5)
+	track("baz", 1)
+
+	pel := NewParseErrorLogger("test-debug-handler")
+	pel.LogWithRequestID(NewParseError(ErrMissingTags, "missing tags"), nil, "req-1")
+
+	w := httptest.NewRecorder()
+	debugHandler(w, httptest.NewRequest("GET", "/debug/insert?top=2", nil))
+	if w.Code != 200 {
+		t.Fatalf("unexpected status code; got %d; want 200; body: %s", w.Code, w.Body.String())
+	}
+	var ds debugStats
+	if err := json.Unmarshal(w.Body.Bytes(), &ds); err != nil {
+		t.Fatalf("cannot parse response: %s", err)
+	}
+	if ds.TrackedMetrics != 3 {
+		t.Fatalf("unexpected number of tracked metrics; got %d; want 3", ds.TrackedMetrics)
+	}
+	topExpected := []metricRows{{Name: "bar", Rows: 5}, {Name: "foo", Rows: 3}}
+	if len(ds.TopMetrics) != len(topExpected) || ds.TopMetrics[0] != topExpected[0] || ds.TopMetrics[1] != topExpected[1] {
+		t.Fatalf("unexpected top metrics; got %+v; want %+v", ds.TopMetrics, topExpected)
+	}
+	pds := ds.Protocols["test-debug-handler"]
+	if pds.ParseErrors != 1 || pds.ParseErrorsByCode[ErrMissingTags.Error()] != 1 {
+		t.Fatalf("unexpected parse errors; got %+v", pds)
+	}
+	if len(pds.RecentParseErrors) != 1 || pds.RecentParseErrors[0].RequestID != "req-1" {
+		t.Fatalf("unexpected recent parse errors; got %+v", pds.RecentParseErrors)
+	}
+
+	// Invalid top arg
+	w = httptest.NewRecorder()
+	debugHandler(w, httptest.NewRequest("GET", "/debug/insert?top=-1", nil))
+	if w.Code != 400 {
+		t.Fatalf("unexpected status code for invalid top arg; got %d; want 400", w.Code)
+	}
+
+	// Unknown path
+	w = httptest.NewRecorder()
+	debugHandler(w, httptest.NewRequest("GET", "/foo", nil))
+	if w.Code != 404 {
+		t.Fatalf("unexpected status code for unknown path; got %d; want 404", w.Code)
+	}
+}
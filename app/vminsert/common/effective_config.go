@@ -0,0 +1,117 @@
+package common
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// ShapingConfig is the effective configuration of features, which modify or drop the ingested rows.
+type ShapingConfig struct {
+	ExtraLabels            map[string]string `json:"extraLabels"`
+	AllowExtraLabelsHeader bool              `json:"allowExtraLabelsHeader"`
+	RequiredHeaders        []string          `json:"requiredHeaders"`
+
+	MetricNameExtractRegex    string `json:"metricNameExtractRegex,omitempty"`
+	MetricNameExtractTemplate string `json:"metricNameExtractTemplate,omitempty"`
+	NormalizeLabelNames       bool   `json:"normalizeLabelNames"`
+
+	// SortLabelsProtocols contains protocols with `sort` order in -insert.labelOrder.
+	SortLabelsProtocols []string `json:"sortLabelsProtocols"`
+
+	ExemplarTraceIDs string `json:"exemplarTraceIDs,omitempty"`
+
+	MaxAgeLabel string `json:"maxAgeLabel,omitempty"`
+
+	AllowedMetrics  string          `json:"allowedMetrics,omitempty"`
+	BlockedMetrics  *RulesFileState `json:"blockedMetrics"`
+	ValueTransforms *RulesFileState `json:"valueTransforms"`
+
+	MaxDecompressionRatio int     `json:"maxDecompressionRatio"`
+	ReadTimeoutSeconds    float64 `json:"readTimeoutSeconds"`
+	ReadBufferSize        int     `json:"readBufferSize"`
+
+	BufferRows            int      `json:"bufferRows"`
+	CoalesceMaxRows       int      `json:"coalesceMaxRows"`
+	FlushRetries          int      `json:"flushRetries"`
+	AtomicBatch           bool     `json:"atomicBatch"`
+	AtomicBatchJSONErrors bool     `json:"atomicBatchJSONErrors"`
+	StorageNodes          []string `json:"storageNodes"`
+	Mirror                bool     `json:"mirror"`
+	AuditLog              bool     `json:"auditLog"`
+}
+
+// RulesFileState is the state of rules re-read on SIGHUP.
+type RulesFileState struct {
+	// Path is the path to the file with rules. It is empty if the rules are set only via command-line flags.
+	Path string `json:"path,omitempty"`
+
+	// Rules is the number of the loaded rules.
+	Rules int `json:"rules"`
+
+	// LastLoad is the time of the last successful load of the rules in RFC3339 format.
+	LastLoad string `json:"lastLoad,omitempty"`
+}
+
+// GetShapingConfig returns the effective shaping configuration.
+//
+// Values, which may contain credentials, such as -mirror.remoteWrite url, aren't returned.
+func GetShapingConfig() *ShapingConfig {
+	sc := &ShapingConfig{
+		ExtraLabels:            make(map[string]string, len(staticExtraLabels)),
+		AllowExtraLabelsHeader: *allowExtraLabelsHeader,
+		RequiredHeaders:        []string{},
+		SortLabelsProtocols:    []string{},
+		NormalizeLabelNames:    *normalizeLabelNames,
+		ExemplarTraceIDs:       *exemplarTraceIDs,
+		MaxAgeLabel:            *maxAgeLabel,
+		AllowedMetrics:         *allowedMetrics,
+		BlockedMetrics: &RulesFileState{
+			Path: *blockedMetricsFile,
+		},
+		ValueTransforms: &RulesFileState{
+			Path: *valueTransformsFile,
+		},
+		MaxDecompressionRatio: *maxDecompressionRatio,
+		ReadTimeoutSeconds:    readTimeout.Seconds(),
+		ReadBufferSize:        *readBufferSize,
+		BufferRows:            *insertBufferRows,
+		CoalesceMaxRows:       *coalesceMaxRows,
+		FlushRetries:          *flushRetries,
+		AtomicBatch:           *atomicBatch,
+		AtomicBatchJSONErrors: *atomicBatchJSONErrors,
+		StorageNodes:          append([]string{}, storageNodeAddrs...),
+		Mirror:                len(*mirrorRemoteWrite) > 0,
+		AuditLog:              al != nil,
+	}
+	for _, label := range staticExtraLabels {
+		sc.ExtraLabels[string(label.Name)] = string(label.Value)
+	}
+	for _, rh := range requiredHeaders {
+		sc.RequiredHeaders = append(sc.RequiredHeaders, rh.name)
+	}
+	for _, protocol := range labelOrderProtocols {
+		if sortLabelsProtocols[protocol] {
+			sc.SortLabelsProtocols = append(sc.SortLabelsProtocols, protocol)
+		}
+	}
+	if metricNameExtractor != nil {
+		sc.MetricNameExtractRegex = *metricNameExtractRegex
+		sc.MetricNameExtractTemplate = *metricNameExtractTemplate
+	}
+	if mnf, _ := blockedMetricsFilter.Load().(*metricNameFilter); mnf != nil {
+		sc.BlockedMetrics.Rules = mnf.patterns
+	}
+	sc.BlockedMetrics.LastLoad = formatLoadTime(atomic.LoadInt64(&blockedMetricsLoadTime))
+	if m, _ := valueTransforms.Load().(map[string]valueTransform); m != nil {
+		sc.ValueTransforms.Rules = len(m)
+	}
+	sc.ValueTransforms.LastLoad = formatLoadTime(atomic.LoadInt64(&valueTransformsLoadTime))
+	return sc
+}
+
+func formatLoadTime(t int64) string {
+	if t == 0 {
+		return ""
+	}
+	return time.Unix(t, 0).UTC().Format(time.RFC3339)
+}
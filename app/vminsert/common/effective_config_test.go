@@ -0,0 +1,70 @@
+package common
+
+import (
+	"encoding/json"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/prompb"
+)
+
+func TestGetShapingConfig(t *testing.T) {
+	defer func(expr string, labels []prompb.Label, rhs []requiredHeader, loadTime int64) {
+		*blockedMetrics = expr
+		staticExtraLabels = labels
+		requiredHeaders = rhs
+		blockedMetricsFilter.Store((*metricNameFilter)(nil))
+		atomic.StoreInt64(&blockedMetricsLoadTime, loadTime)
+	}(*blockedMetrics, staticExtraLabels, requiredHeaders, atomic.LoadInt64(&blockedMetricsLoadTime))
+
+	// Default config
+	sc := GetShapingConfig()
+	if len(sc.ExtraLabels) != 0 || len(sc.RequiredHeaders) != 0 || sc.BlockedMetrics.Rules != 0 || sc.ValueTransforms.Rules != 0 {
+		t.Fatalf("unexpected default config: %+v", sc)
+	}
+
+	labels, err := ParseExtraLabels("env=prod,dc=us")
+	if err != nil {
+		t.Fatalf("cannot parse extra labels: %s", err)
+	}
+	staticExtraLabels = labels
+	rhs, err := parseRequiredHeaders("X-Auth-Source=secret,X-Team")
+	if err != nil {
+		t.Fatalf("cannot parse required headers: %s", err)
+	}
+	requiredHeaders = rhs
+	*blockedMetrics = "foo|bar"
+	mnf, err := loadBlockedMetrics()
+	if err != nil {
+		t.Fatalf("cannot load blocked metrics: %s", err)
+	}
+	blockedMetricsFilter.Store(mnf)
+	atomic.StoreInt64(&blockedMetricsLoadTime, time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC).Unix())
+
+	sc = GetShapingConfig()
+	data, err := json.Marshal(sc)
+	if err != nil {
+		t.Fatalf("cannot marshal config: %s", err)
+	}
+	var result struct {
+		ExtraLabels     map[string]string `json:"extraLabels"`
+		RequiredHeaders []string          `json:"requiredHeaders"`
+		BlockedMetrics  RulesFileState    `json:"blockedMetrics"`
+	}
+	if err := json.Unmarshal(data, &result); err != nil {
+		t.Fatalf("cannot unmarshal config: %s", err)
+	}
+	if len(result.ExtraLabels) != 2 || result.ExtraLabels["env"] != "prod" || result.ExtraLabels["dc"] != "us" {
+		t.Fatalf("unexpected extraLabels: %v", result.ExtraLabels)
+	}
+	if len(result.RequiredHeaders) != 2 || result.RequiredHeaders[0] != "X-Auth-Source" || result.RequiredHeaders[1] != "X-Team" {
+		t.Fatalf("unexpected requiredHeaders: %q", result.RequiredHeaders)
+	}
+	if result.BlockedMetrics.Rules != 1 {
+		t.Fatalf("unexpected number of blocked metrics rules; got %d; want 1", result.BlockedMetrics.Rules)
+	}
+	if result.BlockedMetrics.LastLoad != "2020-01-02T03:04:05Z" {
+		t.Fatalf("unexpected lastLoad; got %q; want %q", result.BlockedMetrics.LastLoad, "2020-01-02T03:04:05Z")
+	}
+}
@@ -0,0 +1,81 @@
+package common
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Error codes for ParseError.
+//
+// Use GetParseErrorCode for checking whether the error returned from parser has the given code.
+var (
+	ErrBadFormat        = errors.New("bad format")
+	ErrMissingMetric    = errors.New("missing metric")
+	ErrBadMetric        = errors.New("bad metric")
+	ErrMissingTimestamp = errors.New("missing timestamp")
+	ErrBadTimestamp     = errors.New("bad timestamp")
+	ErrMissingValue     = errors.New("missing value")
+	ErrBadValue         = errors.New("bad value")
+	ErrMissingTags      = errors.New("missing tags")
+	ErrBadTag           = errors.New("bad tag")
+	ErrNullField        = errors.New("null field")
+	ErrParseTimeout     = errors.New("parse timeout")
+)
+
+// ParseError is an error returned by parsers for malformed input.
+type ParseError struct {
+	// Code is one of Err* errors.
+	Code error
+
+	msg string
+}
+
+// NewParseError returns new ParseError with the given code and formatted message.
+func NewParseError(code error, format string, args ...interface{}) error {
+	return &ParseError{
+		Code: code,
+		msg:  fmt.Sprintf(format, args...),
+	}
+}
+
+// Error implements error interface.
+func (pe *ParseError) Error() string {
+	return pe.msg
+}
+
+// WrapParseError returns an error with the message formatted from format and args, which keeps the code of err.
+//
+// It must be used instead of fmt.Errorf for adding context to errors, which may be returned by parsers,
+// so GetParseErrorCode works for the returned error.
+func WrapParseError(err error, format string, args ...interface{}) error {
+	msg := fmt.Sprintf(format, args...)
+	switch t := err.(type) {
+	case *ParseError:
+		return &ParseError{
+			Code: t.Code,
+			msg:  msg,
+		}
+	case *AtomicBatchError:
+		return &AtomicBatchError{
+			RowIndex: t.RowIndex,
+			err:      WrapParseError(t.err, "%s", msg),
+		}
+	default:
+		return errors.New(msg)
+	}
+}
+
+// GetParseErrorCode returns the code for ParseError err.
+//
+// nil is returned if err isn't ParseError. Errors with additional context must be created with WrapParseError,
+// so they keep the code.
+func GetParseErrorCode(err error) error {
+	switch t := err.(type) {
+	case *ParseError:
+		return t.Code
+	case *AtomicBatchError:
+		return GetParseErrorCode(t.err)
+	default:
+		return nil
+	}
+}
@@ -0,0 +1,39 @@
+package common
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestWrapParseError(t *testing.T) {
+	f := func(err, codeExpected error) {
+		t.Helper()
+		wrapped := WrapParseError(err, "cannot parse foo: %s", err)
+		if s := wrapped.Error(); s != "cannot parse foo: "+err.Error() {
+			t.Fatalf("unexpected error message: %q", s)
+		}
+		if code := GetParseErrorCode(wrapped); code != codeExpected {
+			t.Fatalf("unexpected code for %q; got %v; want %v", wrapped, code, codeExpected)
+		}
+		// Wrapping may be nested
+		wrapped = WrapParseError(wrapped, "cannot parse bar: %s", wrapped)
+		if code := GetParseErrorCode(wrapped); code != codeExpected {
+			t.Fatalf("unexpected code for %q; got %v; want %v", wrapped, code, codeExpected)
+		}
+	}
+	f(fmt.Errorf("some error"), nil)
+	f(NewParseError(ErrBadTag, "bad tag"), ErrBadTag)
+	f(&AtomicBatchError{
+		RowIndex: 2,
+		err:      NewParseError(ErrBadTimestamp, "bad timestamp"),
+	}, ErrBadTimestamp)
+
+	// AtomicBatchError keeps the row index after wrapping
+	err := WrapParseError(&AtomicBatchError{
+		RowIndex: 2,
+		err:      NewParseError(ErrBadTimestamp, "bad timestamp"),
+	}, "cannot import file: bad timestamp")
+	if abe, ok := err.(*AtomicBatchError); !ok || abe.RowIndex != 2 {
+		t.Fatalf("expecting AtomicBatchError for row 2; got %#v", err)
+	}
+}
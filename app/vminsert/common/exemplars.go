@@ -0,0 +1,150 @@
+package common
+
+import (
+	"flag"
+	"sync"
+	"time"
+
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/bytesutil"
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/logger"
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/prompb"
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/storage"
+	"github.com/VictoriaMetrics/metrics"
+)
+
+var (
+	exemplarTraceIDs = flag.String("insert.exemplarTraceIDs", "", "How to store trace IDs from exemplars ingested via OpenMetrics and OTLP. "+
+		"`label` adds the trace ID as -insert.exemplarTraceIDLabel label to the data point with the exemplar. "+
+		"`series` stores the exemplar value with the trace ID label in a parallel `<metric>_exemplar` series, while the data point is stored unchanged. "+
+		"Every trace ID creates a new time series, so see -insert.maxExemplarTraceIDsPerSeries. Trace IDs are dropped if empty")
+	exemplarTraceIDLabel         = flag.String("insert.exemplarTraceIDLabel", "trace_id", "Label name for trace IDs from exemplars. See -insert.exemplarTraceIDs")
+	maxExemplarTraceIDsPerSeries = flag.Int("insert.maxExemplarTraceIDsPerSeries", 10, "The maximum number of exemplar trace IDs to store per time series during an hour. "+
+		"Data points with the rest of exemplars are stored without trace IDs in order to bound the number of created time series. See -insert.exemplarTraceIDs")
+)
+
+const (
+	exemplarsModeNone = iota
+	exemplarsModeLabel
+	exemplarsModeSeries
+)
+
+// exemplarsMode is the parsed -insert.exemplarTraceIDs.
+var exemplarsMode = exemplarsModeNone
+
+// InitExemplars parses -insert.exemplarTraceIDs.
+//
+// InitExemplars must be called after flag.Parse call.
+func InitExemplars() {
+	switch *exemplarTraceIDs {
+	case "":
+		exemplarsMode = exemplarsModeNone
+	case "label":
+		exemplarsMode = exemplarsModeLabel
+	case "series":
+		exemplarsMode = exemplarsModeSeries
+	default:
+		logger.Fatalf("unsupported -insert.exemplarTraceIDs=%q; supported values: label, series", *exemplarTraceIDs)
+	}
+	if exemplarsMode != exemplarsModeNone && len(*exemplarTraceIDLabel) == 0 {
+		logger.Fatalf("-insert.exemplarTraceIDLabel cannot be empty when -insert.exemplarTraceIDs is set")
+	}
+}
+
+// Exemplar contains the trace ID of an exemplar attached to a data point.
+type Exemplar struct {
+	TraceID string
+	Value   float64
+
+	// Timestamp is in milliseconds. The timestamp of the data point is used if it is zero.
+	Timestamp int64
+}
+
+// exemplarSuffix is added to the metric name of the parallel series for exemplars.
+const exemplarSuffix = "_exemplar"
+
+// WriteDataPointWithExemplar writes (timestamp, value) with the given labels into ctx buffer
+// together with the trace ID from e according to -insert.exemplarTraceIDs.
+//
+// labels must contain the metric name with empty label name or with `__name__` label name. e may be nil.
+// The data point is written in the same way as in WriteDataPoint. It returns true if the trace ID has been written.
+func (ctx *InsertCtx) WriteDataPointWithExemplar(labels []prompb.Label, timestamp int64, value float64, e *Exemplar) bool {
+	if exemplarsMode == exemplarsModeNone || e == nil || len(e.TraceID) == 0 {
+		ctx.WriteDataPoint(nil, labels, timestamp, value)
+		return false
+	}
+	ctx.exemplarKeyBuf = storage.MarshalMetricNameRaw(ctx.exemplarKeyBuf[:0], labels)
+	if !exemplarTraceIDsLimiter.allow(ctx.exemplarKeyBuf, time.Now()) {
+		limitedExemplarTraceIDs.Inc()
+		ctx.WriteDataPoint(nil, labels, timestamp, value)
+		return false
+	}
+	storedExemplarTraceIDs.Inc()
+
+	dst := append(ctx.exemplarLabelsBuf[:0], labels...)
+	if exemplarsMode == exemplarsModeLabel {
+		dst = append(dst, prompb.Label{
+			Name:  bytesutil.ToUnsafeBytes(*exemplarTraceIDLabel),
+			Value: bytesutil.ToUnsafeBytes(e.TraceID),
+		})
+		ctx.exemplarLabelsBuf = dst
+		ctx.WriteDataPoint(nil, dst, timestamp, value)
+		return true
+	}
+
+	ctx.WriteDataPoint(nil, labels, timestamp, value)
+	for i := range dst {
+		label := &dst[i]
+		if len(label.Name) == 0 || string(label.Name) == "__name__" {
+			ctx.exemplarNameBuf = append(append(ctx.exemplarNameBuf[:0], label.Value...), exemplarSuffix...)
+			label.Value = ctx.exemplarNameBuf
+			break
+		}
+	}
+	dst = append(dst, prompb.Label{
+		Name:  bytesutil.ToUnsafeBytes(*exemplarTraceIDLabel),
+		Value: bytesutil.ToUnsafeBytes(e.TraceID),
+	})
+	ctx.exemplarLabelsBuf = dst
+	if e.Timestamp != 0 {
+		timestamp = e.Timestamp
+	}
+	ctx.WriteDataPoint(nil, dst, timestamp, e.Value)
+	return true
+}
+
+// exemplarLimiter limits the number of trace IDs stored per time series during an hour.
+type exemplarLimiter struct {
+	mu sync.Mutex
+
+	// m maps marshaled series labels to the number of trace IDs stored for the series since resetTime.
+	m         map[string]int
+	resetTime time.Time
+}
+
+// maxExemplarLimiterSeries is the maximum number of time series tracked by exemplarLimiter.
+//
+// Trace IDs for new time series are dropped when the limit is reached until the next hourly reset.
+const maxExemplarLimiterSeries = 100000
+
+var exemplarTraceIDsLimiter = &exemplarLimiter{}
+
+// allow returns true if a trace ID may be stored for the series with the given key.
+func (el *exemplarLimiter) allow(key []byte, now time.Time) bool {
+	el.mu.Lock()
+	defer el.mu.Unlock()
+	if el.m == nil || now.Sub(el.resetTime) >= time.Hour {
+		el.m = make(map[string]int)
+		el.resetTime = now
+	}
+	n, ok := el.m[string(key)]
+	if n >= *maxExemplarTraceIDsPerSeries || !ok && len(el.m) >= maxExemplarLimiterSeries {
+		return false
+	}
+	el.m[string(key)] = n + 1
+	return true
+}
+
+var (
+	storedExemplarTraceIDs  = metrics.NewCounter(`vm_exemplar_trace_ids_total{result="stored"}`)
+	limitedExemplarTraceIDs = metrics.NewCounter(`vm_exemplar_trace_ids_total{result="limited"}`)
+)
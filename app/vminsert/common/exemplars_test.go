@@ -0,0 +1,101 @@
+package common
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/prompb"
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/storage"
+)
+
+func TestInsertCtxWriteDataPointWithExemplar(t *testing.T) {
+	defer func() {
+		exemplarsMode = exemplarsModeNone
+		exemplarTraceIDsLimiter = &exemplarLimiter{}
+	}()
+
+	newLabels := func(tags ...string) []prompb.Label {
+		var labels []prompb.Label
+		for i := 0; i+1 < len(tags); i += 2 {
+			labels = append(labels, prompb.Label{Name: []byte(tags[i]), Value: []byte(tags[i+1])})
+		}
+		return labels
+	}
+	f := func(mode int, e *Exemplar, resultExpected bool, rowsExpected []storage.MetricRow) {
+		t.Helper()
+		exemplarsMode = mode
+		exemplarTraceIDsLimiter = &exemplarLimiter{}
+		var ctx InsertCtx
+		ctx.Reset(0)
+		result := ctx.WriteDataPointWithExemplar(newLabels("", "foo", "job", "x"), 10, 1, e)
+		if result != resultExpected {
+			t.Fatalf("unexpected result; got %v; want %v", result, resultExpected)
+		}
+		if len(ctx.mrs) != len(rowsExpected) {
+			t.Fatalf("unexpected number of rows; got %d; want %d", len(ctx.mrs), len(rowsExpected))
+		}
+		for i, mr := range ctx.mrs {
+			mrExpected := &rowsExpected[i]
+			if !bytes.Equal(mr.MetricNameRaw, mrExpected.MetricNameRaw) || mr.Timestamp != mrExpected.Timestamp || mr.Value != mrExpected.Value {
+				t.Fatalf("unexpected row #%d; got %q %d %v; want %q %d %v", i, mr.MetricNameRaw, mr.Timestamp, mr.Value,
+					mrExpected.MetricNameRaw, mrExpected.Timestamp, mrExpected.Value)
+			}
+		}
+	}
+	row := func(timestamp int64, value float64, tags ...string) storage.MetricRow {
+		return storage.MetricRow{
+			MetricNameRaw: storage.MarshalMetricNameRaw(nil, newLabels(tags...)),
+			Timestamp:     timestamp,
+			Value:         value,
+		}
+	}
+	e := &Exemplar{
+		TraceID:   "abc",
+		Value:     0.5,
+		Timestamp: 5,
+	}
+
+	// Trace IDs aren't stored by default
+	f(exemplarsModeNone, e, false, []storage.MetricRow{row(10, 1, "", "foo", "job", "x")})
+
+	// Missing trace ID
+	f(exemplarsModeLabel, nil, false, []storage.MetricRow{row(10, 1, "", "foo", "job", "x")})
+	f(exemplarsModeLabel, &Exemplar{Value: 2}, false, []storage.MetricRow{row(10, 1, "", "foo", "job", "x")})
+
+	// The trace ID is added as a label to the data point
+	f(exemplarsModeLabel, e, true, []storage.MetricRow{row(10, 1, "", "foo", "job", "x", "trace_id", "abc")})
+
+	// The exemplar is stored in a parallel series
+	f(exemplarsModeSeries, e, true, []storage.MetricRow{
+		row(10, 1, "", "foo", "job", "x"),
+		row(5, 0.5, "", "foo_exemplar", "job", "x", "trace_id", "abc"),
+	})
+
+	// The data point timestamp is used for the exemplar without timestamp
+	f(exemplarsModeSeries, &Exemplar{TraceID: "abc", Value: 2}, true, []storage.MetricRow{
+		row(10, 1, "", "foo", "job", "x"),
+		row(10, 2, "", "foo_exemplar", "job", "x", "trace_id", "abc"),
+	})
+}
+
+func TestExemplarLimiter(t *testing.T) {
+	var el exemplarLimiter
+	now := time.Unix(1600000000, 0)
+	for i := 0; i < *maxExemplarTraceIDsPerSeries; i++ {
+		if !el.allow([]byte("foo"), now) {
+			t.Fatalf("expecting trace ID #%d to be allowed", i)
+		}
+	}
+	if el.allow([]byte("foo"), now) {
+		t.Fatalf("expecting trace ID to be limited")
+	}
+	// Other series aren't limited
+	if !el.allow([]byte("bar"), now) {
+		t.Fatalf("expecting trace ID for another series to be allowed")
+	}
+	// The limit is reset after an hour
+	if !el.allow([]byte("foo"), now.Add(time.Hour)) {
+		t.Fatalf("expecting trace ID to be allowed after the reset")
+	}
+}
@@ -0,0 +1,200 @@
+package common
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/bytesutil"
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/logger"
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/prompb"
+)
+
+var (
+	extraLabelsFlag = flag.String("insert.extraLabels", "", "Comma-separated list of `name=value` labels to add to all the ingested rows. "+
+		"These labels override labels with the same names in the ingested rows and in "+ExtraLabelsHeader+" request header")
+	allowExtraLabelsHeader = flag.Bool("insert.allowExtraLabelsHeader", false, "Whether to add labels from "+ExtraLabelsHeader+" request header "+
+		"in the form `name1=value1,...,nameN=valueN` to all the rows ingested via HTTP. "+
+		"These labels override labels with the same names in the ingested rows. See also -insert.extraLabels")
+	extraLabelsFromEnv = flag.String("ingest.extraLabelFromEnv", "", "Comma-separated list of `name:ENV_VAR` pairs. The label with the given name "+
+		"and the value of the given environment variable is added to all the ingested rows in the same way as labels from -insert.extraLabels. "+
+		"Environment variables are read at startup. Labels for missing or empty environment variables are skipped. "+
+		"Labels from -insert.extraLabels take precedence over these labels")
+)
+
+// ExtraLabelsHeader is the name of HTTP request header with extra labels for the ingested rows.
+const ExtraLabelsHeader = "X-VM-Extra-Labels"
+
+var staticExtraLabels []prompb.Label
+
+// InitExtraLabels parses -insert.extraLabels and -ingest.extraLabelFromEnv.
+//
+// InitExtraLabels must be called after flag.Parse call.
+func InitExtraLabels() {
+	labels, err := ParseExtraLabels(*extraLabelsFlag)
+	if err != nil {
+		logger.Fatalf("cannot parse -insert.extraLabels=%q: %s", *extraLabelsFlag, err)
+	}
+	envLabels, err := parseEnvLabels(*extraLabelsFromEnv, os.LookupEnv)
+	if err != nil {
+		logger.Fatalf("cannot parse -ingest.extraLabelFromEnv=%q: %s", *extraLabelsFromEnv, err)
+	}
+	staticExtraLabels = mergeLabels(envLabels, labels)
+}
+
+// parseEnvLabels parses comma-separated `name:ENV_VAR` pairs from s
+// and returns labels with values of the corresponding environment variables obtained via lookupEnv.
+//
+// Labels for missing or empty environment variables are skipped with a warning.
+func parseEnvLabels(s string, lookupEnv func(key string) (string, bool)) ([]prompb.Label, error) {
+	if len(s) == 0 {
+		return nil, nil
+	}
+	var labels []prompb.Label
+	for _, kv := range strings.Split(s, ",") {
+		n := strings.IndexByte(kv, ':')
+		if n < 0 {
+			return nil, fmt.Errorf("missing `:` in %q", kv)
+		}
+		name := strings.TrimSpace(kv[:n])
+		envName := strings.TrimSpace(kv[n+1:])
+		if len(name) == 0 {
+			return nil, fmt.Errorf("missing label name in %q", kv)
+		}
+		if len(envName) == 0 {
+			return nil, fmt.Errorf("missing environment variable name in %q", kv)
+		}
+		if hasLabel(labels, name) {
+			return nil, fmt.Errorf("duplicate label name %q", name)
+		}
+		value, ok := lookupEnv(envName)
+		if !ok || len(value) == 0 {
+			logger.Errorf("skipping label %q from -ingest.extraLabelFromEnv, since %q environment variable is missing or empty", name, envName)
+			continue
+		}
+		labels = append(labels, prompb.Label{
+			Name:  []byte(name),
+			Value: []byte(value),
+		})
+	}
+	return labels, nil
+}
+
+// ParseExtraLabels parses comma-separated `name=value` labels from s.
+func ParseExtraLabels(s string) ([]prompb.Label, error) {
+	if len(s) == 0 {
+		return nil, nil
+	}
+	var labels []prompb.Label
+	for _, kv := range strings.Split(s, ",") {
+		n := strings.IndexByte(kv, '=')
+		if n < 0 {
+			return nil, fmt.Errorf("missing `=` in %q", kv)
+		}
+		name := strings.TrimSpace(kv[:n])
+		value := strings.TrimSpace(kv[n+1:])
+		if len(name) == 0 {
+			return nil, fmt.Errorf("missing label name in %q", kv)
+		}
+		if hasLabel(labels, name) {
+			return nil, fmt.Errorf("duplicate label name %q", name)
+		}
+		labels = append(labels, prompb.Label{
+			Name:  []byte(name),
+			Value: []byte(value),
+		})
+	}
+	return labels, nil
+}
+
+type extraLabelsKey struct{}
+
+// WithExtraLabels returns req with extra labels from ExtraLabelsHeader
+// if -insert.allowExtraLabelsHeader is set.
+//
+// The labels may be obtained later with GetExtraLabels.
+// An error is returned if the header contains malformed labels.
+func WithExtraLabels(req *http.Request) (*http.Request, error) {
+	if !*allowExtraLabelsHeader {
+		return req, nil
+	}
+	s := req.Header.Get(ExtraLabelsHeader)
+	if len(s) == 0 {
+		return req, nil
+	}
+	labels, err := ParseExtraLabels(s)
+	if err != nil {
+		return req, fmt.Errorf("cannot parse %s header: %s", ExtraLabelsHeader, err)
+	}
+	// Labels from -insert.extraLabels take precedence over labels from the header.
+	labels = mergeLabels(labels, staticExtraLabels)
+	ctx := context.WithValue(req.Context(), extraLabelsKey{}, labels)
+	return req.WithContext(ctx), nil
+}
+
+// GetExtraLabels returns extra labels for req set by WithExtraLabels.
+//
+// nil is returned if req has no extra labels. In this case labels from -insert.extraLabels are used.
+func GetExtraLabels(req *http.Request) []prompb.Label {
+	labels, _ := req.Context().Value(extraLabelsKey{}).([]prompb.Label)
+	return labels
+}
+
+// mergeLabels returns labels from a and b. Labels from b override labels with the same names from a.
+func mergeLabels(a, b []prompb.Label) []prompb.Label {
+	var dst []prompb.Label
+	for _, label := range a {
+		if !hasLabel(b, string(label.Name)) {
+			dst = append(dst, label)
+		}
+	}
+	return append(dst, b...)
+}
+
+func hasLabel(labels []prompb.Label, name string) bool {
+	for _, label := range labels {
+		if string(label.Name) == name {
+			return true
+		}
+	}
+	return false
+}
+
+// SetExtraLabels sets extra labels to add to all the rows written via ctx.
+//
+// Labels from -insert.extraLabels are used if labels is nil.
+// The labels remain set until the next SetExtraLabels call.
+func (ctx *InsertCtx) SetExtraLabels(labels []prompb.Label) {
+	ctx.extraLabels = labels
+}
+
+// ExtraLabels returns extra labels set via SetExtraLabels.
+func (ctx *InsertCtx) ExtraLabels() []prompb.Label {
+	return ctx.extraLabels
+}
+
+// ApplyExtraLabels returns labels with extra labels added.
+//
+// Extra labels override labels with the same names.
+// The returned labels are valid until the next ApplyExtraLabels call.
+func (ctx *InsertCtx) ApplyExtraLabels(labels []prompb.Label) []prompb.Label {
+	extraLabels := ctx.extraLabels
+	if extraLabels == nil {
+		extraLabels = staticExtraLabels
+	}
+	if len(extraLabels) == 0 {
+		return labels
+	}
+	dst := ctx.extraLabelsBuf[:0]
+	for _, label := range labels {
+		if !hasLabel(extraLabels, bytesutil.ToUnsafeString(label.Name)) {
+			dst = append(dst, label)
+		}
+	}
+	dst = append(dst, extraLabels...)
+	ctx.extraLabelsBuf = dst
+	return dst
+}
@@ -0,0 +1,166 @@
+package common
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/prompb"
+)
+
+func TestParseExtraLabelsSuccess(t *testing.T) {
+	f := func(s, resultExpected string) {
+		t.Helper()
+		labels, err := ParseExtraLabels(s)
+		if err != nil {
+			t.Fatalf("unexpected error when parsing %q: %s", s, err)
+		}
+		result := labelsString(labels)
+		if result != resultExpected {
+			t.Fatalf("unexpected labels for %q; got %q; want %q", s, result, resultExpected)
+		}
+	}
+	f("", "")
+	f("env=staging", "env=staging")
+	f("env=staging,region=us", "env=staging,region=us")
+	f(" env = staging , region=", "env=staging,region=")
+}
+
+func TestParseExtraLabelsFailure(t *testing.T) {
+	f := func(s string) {
+		t.Helper()
+		if _, err := ParseExtraLabels(s); err == nil {
+			t.Fatalf("expecting non-nil error when parsing %q", s)
+		}
+	}
+	f("env")
+	f("env=staging,")
+	f("=staging")
+	f("env=staging,env=prod")
+}
+
+func TestParseEnvLabels(t *testing.T) {
+	env := map[string]string{
+		"POD_NAME":  "pod-1",
+		"NAMESPACE": "prod",
+		"EMPTY":     "",
+	}
+	lookupEnv := func(key string) (string, bool) {
+		v, ok := env[key]
+		return v, ok
+	}
+	f := func(s, resultExpected string) {
+		t.Helper()
+		labels, err := parseEnvLabels(s, lookupEnv)
+		if err != nil {
+			t.Fatalf("unexpected error when parsing %q: %s", s, err)
+		}
+		result := labelsString(labels)
+		if result != resultExpected {
+			t.Fatalf("unexpected labels for %q; got %q; want %q", s, result, resultExpected)
+		}
+	}
+	f("", "")
+	f("pod:POD_NAME", "pod=pod-1")
+	f(" pod : POD_NAME ,namespace:NAMESPACE", "pod=pod-1,namespace=prod")
+
+	// Missing and empty env vars are skipped
+	f("pod:POD_NAME,node:NODE_NAME,x:EMPTY", "pod=pod-1")
+
+	fFailure := func(s string) {
+		t.Helper()
+		if _, err := parseEnvLabels(s, lookupEnv); err == nil {
+			t.Fatalf("expecting non-nil error when parsing %q", s)
+		}
+	}
+	fFailure("pod")
+	fFailure("pod=POD_NAME")
+	fFailure(":POD_NAME")
+	fFailure("pod:")
+	fFailure("pod:POD_NAME,pod:NAMESPACE")
+}
+
+func TestWithExtraLabels(t *testing.T) {
+	defer func(allow bool, labels []prompb.Label) {
+		*allowExtraLabelsHeader = allow
+		staticExtraLabels = labels
+	}(*allowExtraLabelsHeader, staticExtraLabels)
+
+	f := func(header, resultExpected string) {
+		t.Helper()
+		req := httptest.NewRequest("POST", "/api/v1/write", nil)
+		req.Header.Set(ExtraLabelsHeader, header)
+		req, err := WithExtraLabels(req)
+		if err != nil {
+			t.Fatalf("unexpected error for %q: %s", header, err)
+		}
+		result := labelsString(GetExtraLabels(req))
+		if result != resultExpected {
+			t.Fatalf("unexpected labels for %q; got %q; want %q", header, result, resultExpected)
+		}
+	}
+
+	// The header is ignored if it isn't allowed
+	*allowExtraLabelsHeader = false
+	staticExtraLabels = nil
+	f("env=staging", "")
+
+	*allowExtraLabelsHeader = true
+	f("", "")
+	f("env=staging,region=us", "env=staging,region=us")
+
+	// Static labels override labels from the header
+	staticExtraLabels = mustParseExtraLabels("region=eu,dc=1")
+	f("env=staging,region=us", "env=staging,region=eu,dc=1")
+
+	// Malformed header
+	req := httptest.NewRequest("POST", "/api/v1/write", nil)
+	req.Header.Set(ExtraLabelsHeader, "env")
+	if _, err := WithExtraLabels(req); err == nil {
+		t.Fatalf("expecting non-nil error for malformed header")
+	}
+}
+
+func TestInsertCtxApplyExtraLabels(t *testing.T) {
+	defer func(labels []prompb.Label) {
+		staticExtraLabels = labels
+	}(staticExtraLabels)
+
+	f := func(extraLabels []prompb.Label, resultExpected string) {
+		t.Helper()
+		var ctx InsertCtx
+		ctx.SetExtraLabels(extraLabels)
+		ctx.AddLabel("", "foo")
+		ctx.AddLabel("env", "prod")
+		ctx.AddLabel("host", "a")
+		result := labelsString(ctx.ApplyExtraLabels(ctx.Labels))
+		if result != resultExpected {
+			t.Fatalf("unexpected labels; got %q; want %q", result, resultExpected)
+		}
+	}
+
+	staticExtraLabels = nil
+	f(nil, "=foo,env=prod,host=a")
+	f(mustParseExtraLabels("env=staging,region=us"), "=foo,host=a,env=staging,region=us")
+
+	// Static labels are used if there are no request labels
+	staticExtraLabels = mustParseExtraLabels("dc=1")
+	f(nil, "=foo,env=prod,host=a,dc=1")
+	f(mustParseExtraLabels("env=staging"), "=foo,host=a,env=staging")
+}
+
+func mustParseExtraLabels(s string) []prompb.Label {
+	labels, err := ParseExtraLabels(s)
+	if err != nil {
+		panic(err)
+	}
+	return labels
+}
+
+func labelsString(labels []prompb.Label) string {
+	a := make([]string, 0, len(labels))
+	for _, label := range labels {
+		a = append(a, string(label.Name)+"="+string(label.Value))
+	}
+	return strings.Join(a, ",")
+}
@@ -0,0 +1,175 @@
+package common
+
+import (
+	"flag"
+	"sync"
+	"time"
+
+	"github.com/VictoriaMetrics/VictoriaMetrics/app/vmstorage"
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/storage"
+	"github.com/VictoriaMetrics/metrics"
+)
+
+var (
+	coalesceMaxRows = flag.Int("insert.coalesceMaxRows", 0, "The maximum number of rows from concurrent small requests to merge into a single storage write. "+
+		"Requests with at least this number of rows are written directly. "+
+		"This amortizes flush overhead for high rate of small requests at the cost of up to -insert.coalesceMaxDelay additional latency. Zero disables coalescing")
+	coalesceMaxDelay = flag.Duration("insert.coalesceMaxDelay", 5*time.Millisecond, "The maximum duration a small request waits for rows from concurrent requests "+
+		"before the merged rows are written to the storage. See -insert.coalesceMaxRows")
+)
+
+// InitFlushCoalescer starts coalescing flushes for small requests if -insert.coalesceMaxRows is set.
+//
+// InitFlushCoalescer must be called after flag.Parse call.
+func InitFlushCoalescer() {
+	if *coalesceMaxRows <= 0 {
+		return
+	}
+	fc := newFlushCoalescer(*coalesceMaxRows, *coalesceMaxDelay, vmstorage.AddRows)
+	flushCoalescerLock.Lock()
+	globalFlushCoalescer = fc
+	flushCoalescerLock.Unlock()
+}
+
+// StopFlushCoalescer writes pending coalesced rows to the storage and stops coalescing.
+func StopFlushCoalescer() {
+	flushCoalescerLock.Lock()
+	fc := globalFlushCoalescer
+	globalFlushCoalescer = nil
+	flushCoalescerLock.Unlock()
+	if fc == nil {
+		return
+	}
+	fc.stop()
+}
+
+var (
+	flushCoalescerLock   sync.Mutex
+	globalFlushCoalescer *flushCoalescer
+)
+
+func getFlushCoalescer() *flushCoalescer {
+	flushCoalescerLock.Lock()
+	fc := globalFlushCoalescer
+	flushCoalescerLock.Unlock()
+	return fc
+}
+
+// flushCoalescer merges rows from concurrent small requests into shared batches.
+//
+// Every request waits until its batch is written and receives the result of the shared write.
+type flushCoalescer struct {
+	maxRows  int
+	maxDelay time.Duration
+	addRows  func(mrs []storage.MetricRow) error
+
+	mu      sync.Mutex
+	cur     *coalescedBatch
+	stopped bool
+}
+
+func newFlushCoalescer(maxRows int, maxDelay time.Duration, addRows func(mrs []storage.MetricRow) error) *flushCoalescer {
+	return &flushCoalescer{
+		maxRows:  maxRows,
+		maxDelay: maxDelay,
+		addRows:  addRows,
+	}
+}
+
+type coalescedBatch struct {
+	rb       rowsBlock
+	requests int
+
+	timer *time.Timer
+	once  sync.Once
+	done  chan struct{}
+	err   error
+}
+
+// shouldCoalesce returns true if rowsLen rows may be merged with rows from concurrent requests.
+func (fc *flushCoalescer) shouldCoalesce(rowsLen int) bool {
+	return rowsLen > 0 && rowsLen < fc.maxRows
+}
+
+// add copies mrs into the current batch and waits until the batch is written to the storage.
+//
+// It returns the result of writing the batch.
+func (fc *flushCoalescer) add(mrs []storage.MetricRow) error {
+	fc.mu.Lock()
+	if fc.stopped {
+		fc.mu.Unlock()
+		return fc.addRows(mrs)
+	}
+	b := fc.cur
+	if b == nil {
+		b = &coalescedBatch{
+			done: make(chan struct{}),
+		}
+		fc.cur = b
+		b.timer = time.AfterFunc(fc.maxDelay, func() {
+			coalescedTimerFlushes.Inc()
+			fc.flush(b)
+		})
+	}
+	b.rb.appendFrom(mrs)
+	b.requests++
+	full := len(b.rb.mrs) >= fc.maxRows
+	fc.mu.Unlock()
+
+	coalescedRequests.Inc()
+	if full {
+		coalescedSizeFlushes.Inc()
+		fc.flush(b)
+	}
+	<-b.done
+	return b.err
+}
+
+// flush writes b to the storage if it isn't written yet.
+func (fc *flushCoalescer) flush(b *coalescedBatch) {
+	fc.mu.Lock()
+	if fc.cur == b {
+		fc.cur = nil
+	}
+	fc.mu.Unlock()
+
+	b.once.Do(func() {
+		b.timer.Stop()
+		coalescedRows.Add(len(b.rb.mrs))
+		coalescedRequestsPerFlush.Update(float64(b.requests))
+		b.err = fc.addRows(b.rb.mrs)
+		close(b.done)
+	})
+}
+
+func (fc *flushCoalescer) stop() {
+	fc.mu.Lock()
+	fc.stopped = true
+	b := fc.cur
+	fc.mu.Unlock()
+	if b != nil {
+		fc.flush(b)
+	}
+}
+
+// appendFrom appends copies of mrs to rb.
+//
+// rb.buf may be re-allocated by subsequent calls, so previously added rows may refer
+// to the old buffer. This is OK, since the old buffer isn't modified anymore.
+func (rb *rowsBlock) appendFrom(mrs []storage.MetricRow) {
+	for i := range mrs {
+		mr := mrs[i]
+		start := len(rb.buf)
+		rb.buf = append(rb.buf, mr.MetricNameRaw...)
+		mr.MetricNameRaw = rb.buf[start:len(rb.buf):len(rb.buf)]
+		rb.mrs = append(rb.mrs, mr)
+	}
+}
+
+var (
+	coalescedRequests         = metrics.NewCounter(`vm_coalesced_requests_total`)
+	coalescedRows             = metrics.NewCounter(`vm_coalesced_rows_total`)
+	coalescedSizeFlushes      = metrics.NewCounter(`vm_coalesced_flushes_total{reason="size"}`)
+	coalescedTimerFlushes     = metrics.NewCounter(`vm_coalesced_flushes_total{reason="timer"}`)
+	coalescedRequestsPerFlush = metrics.NewSummary(`vm_coalesced_requests_per_flush`)
+)
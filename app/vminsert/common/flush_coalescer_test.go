@@ -0,0 +1,184 @@
+package common
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/storage"
+)
+
+type fakeStorage struct {
+	mu      sync.Mutex
+	batches [][]storage.MetricRow
+	err     error
+}
+
+func (fs *fakeStorage) addRows(mrs []storage.MetricRow) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	var rb rowsBlock
+	rb.copyFrom(mrs)
+	fs.batches = append(fs.batches, rb.mrs)
+	return fs.err
+}
+
+func (fs *fakeStorage) batchSizes() []int {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	var a []int
+	for _, mrs := range fs.batches {
+		a = append(a, len(mrs))
+	}
+	return a
+}
+
+func TestFlushCoalescerMergeConcurrentRequests(t *testing.T) {
+	var fs fakeStorage
+	fc := newFlushCoalescer(10, time.Hour, fs.addRows)
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 5)
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			mrs := []storage.MetricRow{
+				{MetricNameRaw: []byte(fmt.Sprintf("foo_%d", i)), Timestamp: 1, Value: float64(i)},
+				{MetricNameRaw: []byte(fmt.Sprintf("bar_%d", i)), Timestamp: 2, Value: float64(i)},
+			}
+			errs <- fc.add(mrs)
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	}
+
+	// All the rows must be written in a single batch when it becomes full.
+	sizes := fs.batchSizes()
+	if len(sizes) != 1 || sizes[0] != 10 {
+		t.Fatalf("unexpected batch sizes; got %v; want [10]", sizes)
+	}
+	var names []string
+	for _, mr := range fs.batches[0] {
+		names = append(names, string(mr.MetricNameRaw))
+	}
+	sort.Strings(names)
+	for i := 0; i < 5; i++ {
+		for _, prefix := range []string{"bar", "foo"} {
+			name := fmt.Sprintf("%s_%d", prefix, i)
+			n := sort.SearchStrings(names, name)
+			if n >= len(names) || names[n] != name {
+				t.Fatalf("missing %q in the written rows %q", name, names)
+			}
+		}
+	}
+}
+
+func TestFlushCoalescerTimerFlush(t *testing.T) {
+	var fs fakeStorage
+	fc := newFlushCoalescer(100, 10*time.Millisecond, fs.addRows)
+	mrs := []storage.MetricRow{
+		{MetricNameRaw: []byte("foo"), Timestamp: 1, Value: 2},
+	}
+	if err := fc.add(mrs); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	sizes := fs.batchSizes()
+	if len(sizes) != 1 || sizes[0] != 1 {
+		t.Fatalf("unexpected batch sizes; got %v; want [1]", sizes)
+	}
+
+	// The next request must go to a new batch.
+	if err := fc.add(mrs); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	sizes = fs.batchSizes()
+	if len(sizes) != 2 {
+		t.Fatalf("unexpected batch sizes; got %v; want [1 1]", sizes)
+	}
+}
+
+func TestFlushCoalescerError(t *testing.T) {
+	fs := fakeStorage{
+		err: errors.New("storage error"),
+	}
+	fc := newFlushCoalescer(4, time.Hour, fs.addRows)
+	mrs := []storage.MetricRow{
+		{MetricNameRaw: []byte("foo")},
+		{MetricNameRaw: []byte("bar")},
+	}
+	errs := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			errs <- fc.add(mrs)
+		}()
+	}
+	// Every request in the batch must receive the error.
+	for i := 0; i < 2; i++ {
+		if err := <-errs; err != fs.err {
+			t.Fatalf("unexpected error; got %v; want %v", err, fs.err)
+		}
+	}
+}
+
+func TestFlushCoalescerStop(t *testing.T) {
+	var fs fakeStorage
+	fc := newFlushCoalescer(100, time.Hour, fs.addRows)
+	mrs := []storage.MetricRow{
+		{MetricNameRaw: []byte("foo")},
+	}
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- fc.add(mrs)
+	}()
+
+	// Wait until the row is added to the pending batch.
+	for {
+		fc.mu.Lock()
+		pending := fc.cur != nil
+		fc.mu.Unlock()
+		if pending {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// Stop must flush the pending batch.
+	fc.stop()
+	if err := <-errCh; err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	// Rows are written directly after stop.
+	if err := fc.add(mrs); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	sizes := fs.batchSizes()
+	if len(sizes) != 2 || sizes[0] != 1 || sizes[1] != 1 {
+		t.Fatalf("unexpected batch sizes; got %v; want [1 1]", sizes)
+	}
+}
+
+func TestFlushCoalescerShouldCoalesce(t *testing.T) {
+	fc := newFlushCoalescer(10, time.Millisecond, nil)
+	f := func(rowsLen int, resultExpected bool) {
+		t.Helper()
+		result := fc.shouldCoalesce(rowsLen)
+		if result != resultExpected {
+			t.Fatalf("unexpected result for %d rows; got %v; want %v", rowsLen, result, resultExpected)
+		}
+	}
+	f(0, false)
+	f(1, true)
+	f(9, true)
+	f(10, false)
+	f(100, false)
+}
@@ -0,0 +1,83 @@
+package common
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"time"
+
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/timerpool"
+	"github.com/VictoriaMetrics/metrics"
+)
+
+var (
+	flushRetries = flag.Int("insert.flushRetries", 0, "The maximum number of retries for writing rows to the storage after a failure. "+
+		"This allows surviving brief storage unavailability without returning errors to clients. "+
+		"Retries are stopped when the client closes the connection. Zero disables retries")
+	flushRetryBackoff = flag.Duration("insert.flushRetryBackoff", 100*time.Millisecond, "The initial delay between retries for writing rows to the storage. "+
+		"The delay is doubled after every retry. See -insert.flushRetries")
+)
+
+// maxFlushRetryBackoff is the maximum delay between retries for writing rows to the storage.
+const maxFlushRetryBackoff = 10 * time.Second
+
+// SetContext sets request context for ctx.
+//
+// Retries for writing rows to the storage are stopped when the context is done. See -insert.flushRetries.
+// The context remains set until the next SetContext call. nil context means the context is never done.
+// Rows written to ctx are registered in the audit event from reqCtx. See -insert.auditLog.
+// Flushes are registered in the request trace from reqCtx. See -insert.traceSampleRate.
+// Row indexes in AtomicBatchError are counted since the SetContext call. See -insert.atomicBatchJSONErrors.
+func (ctx *InsertCtx) SetContext(reqCtx context.Context) {
+	ctx.reqCtx = reqCtx
+	ctx.auditEvent = getAuditEvent(reqCtx)
+	ctx.trace = getRequestTrace(reqCtx)
+	ctx.validatedRows = 0
+}
+
+// Context returns request context set via SetContext.
+func (ctx *InsertCtx) Context() context.Context {
+	return ctx.reqCtx
+}
+
+// withFlushRetries calls f and retries it with exponential backoff on errors up to -insert.flushRetries times.
+//
+// Retries are stopped when reqCtx is done. reqCtx may be nil.
+func withFlushRetries(reqCtx context.Context, f func() error) error {
+	err := f()
+	if err == nil || *flushRetries <= 0 {
+		return err
+	}
+	var done <-chan struct{}
+	if reqCtx != nil {
+		done = reqCtx.Done()
+	}
+	backoff := *flushRetryBackoff
+	for i := 0; i < *flushRetries; i++ {
+		t := timerpool.Get(backoff)
+		select {
+		case <-done:
+			timerpool.Put(t)
+			flushRetriesCanceled.Inc()
+			return fmt.Errorf("%s; retries have been stopped after %d attempts, since the request is canceled", err, i+1)
+		case <-t.C:
+			timerpool.Put(t)
+		}
+		flushRetriesTotal.Inc()
+		if err = f(); err == nil {
+			return nil
+		}
+		backoff *= 2
+		if backoff > maxFlushRetryBackoff {
+			backoff = maxFlushRetryBackoff
+		}
+	}
+	flushRetriesExhausted.Inc()
+	return fmt.Errorf("%s; giving up after %d retries; see -insert.flushRetries", err, *flushRetries)
+}
+
+var (
+	flushRetriesTotal     = metrics.NewCounter(`vm_flush_retries_total`)
+	flushRetriesCanceled  = metrics.NewCounter(`vm_flush_retries_stopped_total{reason="canceled"}`)
+	flushRetriesExhausted = metrics.NewCounter(`vm_flush_retries_stopped_total{reason="exhausted"}`)
+)
@@ -0,0 +1,75 @@
+package common
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestWithFlushRetries(t *testing.T) {
+	defer func(retries int, backoff time.Duration) {
+		*flushRetries = retries
+		*flushRetryBackoff = backoff
+	}(*flushRetries, *flushRetryBackoff)
+	*flushRetryBackoff = time.Millisecond
+
+	f := func(retries, failures int, callsExpected int, okExpected bool) {
+		t.Helper()
+		*flushRetries = retries
+		calls := 0
+		err := withFlushRetries(nil, func() error {
+			calls++
+			if calls <= failures {
+				return fmt.Errorf("storage is unavailable")
+			}
+			return nil
+		})
+		if calls != callsExpected {
+			t.Fatalf("unexpected number of calls; got %d; want %d", calls, callsExpected)
+		}
+		if okExpected && err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if !okExpected && err == nil {
+			t.Fatalf("expecting non-nil error")
+		}
+	}
+
+	// No failures
+	f(0, 0, 1, true)
+	f(3, 0, 1, true)
+
+	// Retries are disabled
+	f(0, 1, 1, false)
+
+	// Transient failure
+	f(3, 2, 3, true)
+	f(3, 3, 4, true)
+
+	// Retries are exhausted
+	f(3, 10, 4, false)
+}
+
+func TestWithFlushRetriesCanceled(t *testing.T) {
+	defer func(retries int, backoff time.Duration) {
+		*flushRetries = retries
+		*flushRetryBackoff = backoff
+	}(*flushRetries, *flushRetryBackoff)
+	*flushRetries = 100
+	*flushRetryBackoff = time.Hour
+
+	reqCtx, cancel := context.WithCancel(context.Background())
+	cancel()
+	calls := 0
+	err := withFlushRetries(reqCtx, func() error {
+		calls++
+		return fmt.Errorf("storage is unavailable")
+	})
+	if err == nil {
+		t.Fatalf("expecting non-nil error")
+	}
+	if calls != 1 {
+		t.Fatalf("unexpected number of calls for canceled request; got %d; want 1", calls)
+	}
+}
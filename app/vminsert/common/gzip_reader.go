@@ -0,0 +1,94 @@
+package common
+
+import (
+	"compress/gzip"
+	"errors"
+	"flag"
+	"io"
+	"sync"
+
+	"github.com/VictoriaMetrics/metrics"
+)
+
+var maxDecompressionRatio = flag.Int("insert.maxDecompressionRatio", 0, "The maximum ratio of decompressed to compressed size for gzipped insert requests. "+
+	"Requests exceeding the ratio are rejected in order to protect from highly compressible malicious payloads wasting CPU. "+
+	"Zero disables the check. It is disabled by default, since legitimate payloads such as Influx line protocol with repeated measurements and tags "+
+	"may have decompression ratio exceeding 100")
+
+// minRatioCheckBytes is the minimum number of decompressed bytes before checking the decompression ratio.
+//
+// Small payloads may have high decompression ratio due to gzip headers overhead,
+// while they cannot waste a lot of CPU.
+const minRatioCheckBytes = 1024 * 1024
+
+// ErrZipBomb is returned when the decompression ratio exceeds -insert.maxDecompressionRatio.
+var ErrZipBomb = errors.New("too high decompression ratio; see -insert.maxDecompressionRatio")
+
+// GzipReader is gzip reader, which rejects payloads with too high decompression ratio.
+type GzipReader struct {
+	zr gzip.Reader
+	cr countingReader
+
+	// decompressedBytes is the number of decompressed bytes read from zr.
+	decompressedBytes int64
+}
+
+// GetGzipReader returns gzip reader for r.
+//
+// The reader reads all the concatenated gzip members from r, since some clients
+// send a separate gzip member per batch of data in a single request body.
+//
+// Return the reader to the pool with PutGzipReader when no longer needed.
+func GetGzipReader(r io.Reader) (*GzipReader, error) {
+	v := gzipReaderPool.Get()
+	if v == nil {
+		v = &GzipReader{}
+	}
+	zr := v.(*GzipReader)
+	zr.cr.r = r
+	if err := zr.zr.Reset(&zr.cr); err != nil {
+		PutGzipReader(zr)
+		return nil, err
+	}
+	// Reset enables multistream mode, but set it explicitly, since data after the first member
+	// is silently dropped without multistream mode.
+	zr.zr.Multistream(true)
+	return zr, nil
+}
+
+// PutGzipReader returns zr to the pool.
+func PutGzipReader(zr *GzipReader) {
+	_ = zr.zr.Close()
+	zr.cr.r = nil
+	zr.cr.n = 0
+	zr.decompressedBytes = 0
+	gzipReaderPool.Put(zr)
+}
+
+var gzipReaderPool sync.Pool
+
+// Read reads decompressed data from zr.
+func (zr *GzipReader) Read(p []byte) (int, error) {
+	n, err := zr.zr.Read(p)
+	zr.decompressedBytes += int64(n)
+	if ratio := int64(*maxDecompressionRatio); ratio > 0 && zr.decompressedBytes > minRatioCheckBytes {
+		if zr.decompressedBytes > ratio*zr.cr.n {
+			zipBombRejected.Inc()
+			return n, ErrZipBomb
+		}
+	}
+	return n, err
+}
+
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	cr.n += int64(n)
+	return n, err
+}
+
+var zipBombRejected = metrics.NewCounter(`vm_zip_bomb_rejected_total`)
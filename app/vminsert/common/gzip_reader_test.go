@@ -0,0 +1,103 @@
+package common
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+func TestGzipReader(t *testing.T) {
+	defer func(v int) {
+		*maxDecompressionRatio = v
+	}(*maxDecompressionRatio)
+
+	f := func(data []byte, ratio int, errExpected error) {
+		t.Helper()
+		*maxDecompressionRatio = ratio
+		zr, err := GetGzipReader(bytes.NewReader(compressGzip(t, data)))
+		if err != nil {
+			t.Fatalf("cannot create gzip reader: %s", err)
+		}
+		defer PutGzipReader(zr)
+		result, err := ioutil.ReadAll(zr)
+		if err != errExpected {
+			t.Fatalf("unexpected error; got %v; want %v", err, errExpected)
+		}
+		if err == nil && !bytes.Equal(result, data) {
+			t.Fatalf("unexpected data after decompression")
+		}
+	}
+
+	// Small payload with high compression ratio
+	f(make([]byte, 1000), 10, nil)
+
+	// Incompressible payload
+	data := make([]byte, 4*minRatioCheckBytes)
+	r := rand.New(rand.NewSource(1))
+	for i := range data {
+		data[i] = byte(r.Intn(256))
+	}
+	f(data, 10, nil)
+
+	// Zip bomb
+	bomb := make([]byte, 16*minRatioCheckBytes)
+	f(bomb, 100, ErrZipBomb)
+
+	// Disabled ratio check
+	f(bomb, 0, nil)
+}
+
+func TestGzipReaderMultiMember(t *testing.T) {
+	f := func(members ...string) {
+		t.Helper()
+		var bb bytes.Buffer
+		for _, m := range members {
+			bb.Write(compressGzip(t, []byte(m)))
+		}
+		zr, err := GetGzipReader(&bb)
+		if err != nil {
+			t.Fatalf("cannot create gzip reader: %s", err)
+		}
+		defer PutGzipReader(zr)
+		result, err := ioutil.ReadAll(zr)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		resultExpected := strings.Join(members, "")
+		if string(result) != resultExpected {
+			t.Fatalf("unexpected data after decompression; got %q; want %q", result, resultExpected)
+		}
+	}
+	f("put foo 1 2 a=b\n")
+	f("put foo 1 2 a=b\n", "put bar 3 4 c=d\n")
+	f("put foo 1 2 a=b\n", "", "put bar 3 4 c=d\n")
+
+	// Trailing garbage after the last member must result in error instead of silent data loss.
+	var bb bytes.Buffer
+	bb.Write(compressGzip(t, []byte("foo")))
+	bb.WriteString("garbage")
+	zr, err := GetGzipReader(&bb)
+	if err != nil {
+		t.Fatalf("cannot create gzip reader: %s", err)
+	}
+	defer PutGzipReader(zr)
+	if _, err := ioutil.ReadAll(zr); err == nil {
+		t.Fatalf("expecting non-nil error for trailing garbage")
+	}
+}
+
+func compressGzip(t *testing.T, data []byte) []byte {
+	t.Helper()
+	var bb bytes.Buffer
+	zw := gzip.NewWriter(&bb)
+	if _, err := zw.Write(data); err != nil {
+		t.Fatalf("cannot compress data: %s", err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatalf("cannot close gzip writer: %s", err)
+	}
+	return bb.Bytes()
+}
@@ -0,0 +1,184 @@
+package common
+
+import (
+	"flag"
+	"sync"
+	"sync/atomic"
+
+	"github.com/VictoriaMetrics/VictoriaMetrics/app/vmstorage"
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/logger"
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/storage"
+	"github.com/VictoriaMetrics/metrics"
+)
+
+var insertBufferRows = flag.Int("insert.bufferRows", 0, "The maximum number of rows to buffer in memory while they are asynchronously written to the storage. "+
+	"This allows absorbing short storage stalls without returning errors to clients. Rows are written synchronously when the buffer is full. "+
+	"Buffered rows are lost on unclean shutdown. Zero disables the buffer")
+
+// InitInsertBuffer starts the in-memory insert buffer if -insert.bufferRows is set.
+//
+// InitInsertBuffer must be called after flag.Parse call.
+func InitInsertBuffer() {
+	if *insertBufferRows <= 0 {
+		return
+	}
+	ib := &insertBuffer{
+		maxRows: int64(*insertBufferRows),
+		ch:      make(chan *rowsBlock, 1024),
+	}
+	ib.wg.Add(1)
+	go func() {
+		defer ib.wg.Done()
+		ib.drain()
+	}()
+	insertBufferLock.Lock()
+	globalInsertBuffer = ib
+	insertBufferLock.Unlock()
+}
+
+// StopInsertBuffer writes all the buffered rows to the storage and stops the insert buffer.
+func StopInsertBuffer() {
+	insertBufferLock.Lock()
+	ib := globalInsertBuffer
+	globalInsertBuffer = nil
+	insertBufferLock.Unlock()
+	if ib == nil {
+		return
+	}
+	// Wait until concurrent tryAdd calls are finished before closing the channel.
+	ib.mu.Lock()
+	ib.stopped = true
+	close(ib.ch)
+	ib.mu.Unlock()
+	ib.wg.Wait()
+}
+
+var (
+	insertBufferLock   sync.Mutex
+	globalInsertBuffer *insertBuffer
+)
+
+func getInsertBuffer() *insertBuffer {
+	insertBufferLock.Lock()
+	ib := globalInsertBuffer
+	insertBufferLock.Unlock()
+	return ib
+}
+
+type insertBuffer struct {
+	maxRows int64
+
+	// rows is the number of rows in ch.
+	rows int64
+
+	// mu protects ch from closing while tryAdd sends to it.
+	mu      sync.RWMutex
+	stopped bool
+	ch      chan *rowsBlock
+
+	wg sync.WaitGroup
+}
+
+// tryAdd copies mrs to ib.
+//
+// false is returned if ib has no room for mrs.
+func (ib *insertBuffer) tryAdd(mrs []storage.MetricRow) bool {
+	n := int64(len(mrs))
+	if atomic.AddInt64(&ib.rows, n) > ib.maxRows {
+		atomic.AddInt64(&ib.rows, -n)
+		insertBufferFull.Inc()
+		return false
+	}
+	rb := getRowsBlock()
+	rb.copyFrom(mrs)
+	ib.mu.RLock()
+	defer ib.mu.RUnlock()
+	if ib.stopped {
+		atomic.AddInt64(&ib.rows, -n)
+		putRowsBlock(rb)
+		return false
+	}
+	select {
+	case ib.ch <- rb:
+		return true
+	default:
+		atomic.AddInt64(&ib.rows, -n)
+		putRowsBlock(rb)
+		insertBufferFull.Inc()
+		return false
+	}
+}
+
+func (ib *insertBuffer) drain() {
+	for rb := range ib.ch {
+		if err := vmstorage.AddRows(rb.mrs); err != nil {
+			insertBufferDroppedRows.Add(len(rb.mrs))
+			logger.Errorf("cannot store %d buffered rows: %s", len(rb.mrs), err)
+		}
+		atomic.AddInt64(&ib.rows, -int64(len(rb.mrs)))
+		putRowsBlock(rb)
+	}
+}
+
+type rowsBlock struct {
+	mrs []storage.MetricRow
+	buf []byte
+}
+
+func (rb *rowsBlock) copyFrom(mrs []storage.MetricRow) {
+	rb.buf = rb.buf[:0]
+	for i := range mrs {
+		rb.buf = append(rb.buf, mrs[i].MetricNameRaw...)
+	}
+	rb.mrs = append(rb.mrs[:0], mrs...)
+	buf := rb.buf
+	for i := range rb.mrs {
+		mr := &rb.mrs[i]
+		n := len(mr.MetricNameRaw)
+		mr.MetricNameRaw = buf[:n:n]
+		buf = buf[n:]
+	}
+}
+
+func (rb *rowsBlock) reset() {
+	for i := range rb.mrs {
+		rb.mrs[i].MetricNameRaw = nil
+	}
+	rb.mrs = rb.mrs[:0]
+	rb.buf = rb.buf[:0]
+}
+
+func getRowsBlock() *rowsBlock {
+	v := rowsBlockPool.Get()
+	if v == nil {
+		return &rowsBlock{}
+	}
+	return v.(*rowsBlock)
+}
+
+func putRowsBlock(rb *rowsBlock) {
+	rb.reset()
+	rowsBlockPool.Put(rb)
+}
+
+var rowsBlockPool sync.Pool
+
+var (
+	insertBufferFull        = metrics.NewCounter(`vm_insert_buffer_full_total`)
+	insertBufferDroppedRows = metrics.NewCounter(`vm_insert_buffer_dropped_rows_total`)
+
+	_ = metrics.NewGauge(`vm_insert_buffer_rows`, func() float64 {
+		ib := getInsertBuffer()
+		if ib == nil {
+			return 0
+		}
+		return float64(atomic.LoadInt64(&ib.rows))
+	})
+	_ = metrics.NewGauge(`vm_insert_buffer_capacity_rows`, func() float64 {
+		ib := getInsertBuffer()
+		if ib == nil {
+			return 0
+		}
+		return float64(ib.maxRows)
+	})
+)
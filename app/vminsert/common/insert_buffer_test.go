@@ -0,0 +1,72 @@
+package common
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/storage"
+)
+
+func TestRowsBlockCopyFrom(t *testing.T) {
+	mrs := []storage.MetricRow{
+		{MetricNameRaw: []byte("foo"), Timestamp: 1, Value: 2},
+		{MetricNameRaw: []byte("barbaz"), Timestamp: 3, Value: 4},
+		{MetricNameRaw: nil, Timestamp: 5, Value: 6},
+	}
+	var rb rowsBlock
+	rb.copyFrom(mrs)
+	if len(rb.mrs) != len(mrs) {
+		t.Fatalf("unexpected number of rows; got %d; want %d", len(rb.mrs), len(mrs))
+	}
+	for i := range mrs {
+		if string(rb.mrs[i].MetricNameRaw) != string(mrs[i].MetricNameRaw) {
+			t.Fatalf("unexpected metric name at position %d; got %q; want %q", i, rb.mrs[i].MetricNameRaw, mrs[i].MetricNameRaw)
+		}
+		if rb.mrs[i].Timestamp != mrs[i].Timestamp || rb.mrs[i].Value != mrs[i].Value {
+			t.Fatalf("unexpected row at position %d; got %+v; want %+v", i, rb.mrs[i], mrs[i])
+		}
+	}
+
+	// Modify the original rows. This mustn't affect the copy.
+	mrs[0].MetricNameRaw[0] = 'x'
+	if string(rb.mrs[0].MetricNameRaw) != "foo" {
+		t.Fatalf("the copy must be independent of the original rows; got %q", rb.mrs[0].MetricNameRaw)
+	}
+
+	rb.reset()
+	if !reflect.DeepEqual(rb.mrs, []storage.MetricRow{}) {
+		t.Fatalf("non-empty rows after reset: %+v", rb.mrs)
+	}
+}
+
+func TestInsertBufferTryAdd(t *testing.T) {
+	ib := &insertBuffer{
+		maxRows: 3,
+		ch:      make(chan *rowsBlock, 10),
+	}
+	mrs := []storage.MetricRow{
+		{MetricNameRaw: []byte("foo")},
+		{MetricNameRaw: []byte("bar")},
+	}
+	if !ib.tryAdd(mrs) {
+		t.Fatalf("expecting rows to be added to empty buffer")
+	}
+	if ib.tryAdd(mrs) {
+		t.Fatalf("expecting rows not to be added to full buffer")
+	}
+	if !ib.tryAdd(mrs[:1]) {
+		t.Fatalf("expecting a single row to be added to the buffer")
+	}
+	if ib.rows != 3 {
+		t.Fatalf("unexpected number of buffered rows; got %d; want 3", ib.rows)
+	}
+
+	ib.stopped = true
+	ib.rows = 0
+	if ib.tryAdd(mrs) {
+		t.Fatalf("expecting rows not to be added to stopped buffer")
+	}
+	if ib.rows != 0 {
+		t.Fatalf("unexpected number of buffered rows; got %d; want 0", ib.rows)
+	}
+}
@@ -1,7 +1,9 @@
 package common
 
 import (
+	"context"
 	"fmt"
+	"time"
 
 	"github.com/VictoriaMetrics/VictoriaMetrics/app/vmstorage"
 	"github.com/VictoriaMetrics/VictoriaMetrics/lib/bytesutil"
@@ -15,6 +17,53 @@ type InsertCtx struct {
 
 	mrs            []storage.MetricRow
 	metricNamesBuf []byte
+
+	// metricNamesCache maps marshaled metric names to their interned copies
+	// in metricNamesBuf for the current request.
+	metricNamesCache map[string][]byte
+	metricNameTmp    []byte
+
+	// extraLabels are added to all the written rows. See SetExtraLabels.
+	extraLabels    []prompb.Label
+	extraLabelsBuf []prompb.Label
+
+	// extractedLabelsBuf holds labels with labels extracted from the metric name. See -insert.metricNameExtractRegex.
+	extractedLabelsBuf []prompb.Label
+
+	// normalizedLabelsBuf holds labels with normalized names. See -insert.normalizeLabelNames.
+	normalizedLabelsBuf []prompb.Label
+
+	// maxAgeLabelsBuf holds labels without the max age label. See -insert.maxAgeLabel.
+	maxAgeLabelsBuf []prompb.Label
+
+	// sortLabels is set if labels must be sorted in canonical order before marshaling. See SetLabelOrder.
+	sortLabels bool
+
+	// sortedLabelsBuf holds labels sorted in canonical order. See -insert.labelOrder.
+	sortedLabelsBuf []prompb.Label
+
+	// exemplarLabelsBuf, exemplarNameBuf and exemplarKeyBuf are used for writing exemplar trace IDs. See WriteDataPointWithExemplar.
+	exemplarLabelsBuf []prompb.Label
+	exemplarNameBuf   []byte
+	exemplarKeyBuf    []byte
+
+	// reqCtx is the context of the current request. See SetContext.
+	reqCtx context.Context
+
+	// auditEvent registers the written rows for -insert.auditLog. It is nil if the audit log is disabled.
+	auditEvent *AuditEvent
+
+	// trace registers flushes for the sampled request. It is nil if the request isn't sampled. See -insert.traceSampleRate.
+	trace *RequestTrace
+
+	// deferredSince is the time when flushing rows has been deferred by FlushBufsBatched. It is zero if there are no deferred rows.
+	deferredSince time.Time
+
+	// validatedRows is the number of rows validated by ValidateTimestamps since the last SetContext call.
+	validatedRows int
+
+	// serverTimestamp overrides timestamps for all the written rows if non-zero. See SetServerTimestamp.
+	serverTimestamp int64
 }
 
 // Reset resets ctx for future fill with rowsLen rows.
@@ -35,6 +84,18 @@ func (ctx *InsertCtx) Reset(rowsLen int) {
 	}
 	ctx.mrs = ctx.mrs[:0]
 	ctx.metricNamesBuf = ctx.metricNamesBuf[:0]
+
+	for k := range ctx.metricNamesCache {
+		delete(ctx.metricNamesCache, k)
+	}
+	ctx.metricNameTmp = ctx.metricNameTmp[:0]
+	ctx.extraLabelsBuf = ctx.extraLabelsBuf[:0]
+	ctx.extractedLabelsBuf = ctx.extractedLabelsBuf[:0]
+	ctx.normalizedLabelsBuf = ctx.normalizedLabelsBuf[:0]
+	ctx.maxAgeLabelsBuf = ctx.maxAgeLabelsBuf[:0]
+	ctx.sortedLabelsBuf = ctx.sortedLabelsBuf[:0]
+	ctx.exemplarLabelsBuf = ctx.exemplarLabelsBuf[:0]
+	ctx.deferredSince = time.Time{}
 }
 
 func (ctx *InsertCtx) marshalMetricNameRaw(prefix []byte, labels []prompb.Label) []byte {
@@ -45,24 +106,109 @@ func (ctx *InsertCtx) marshalMetricNameRaw(prefix []byte, labels []prompb.Label)
 	return metricNameRaw[:len(metricNameRaw):len(metricNameRaw)]
 }
 
+// prepareDataPoint applies the common ingestion pipeline to the data point with the given labels, timestamp and value.
+//
+// It extracts labels from the metric name, normalizes label names, applies max age labels,
+// value transforms and value rounding, and tracks the data point for audit and metric stats.
+// It returns false if the data point must be dropped.
+func (ctx *InsertCtx) prepareDataPoint(labels []prompb.Label, timestamp int64, value float64) ([]prompb.Label, float64, bool) {
+	labels = ctx.extractMetricNameLabels(labels)
+	labels = ctx.normalizeLabelNames(labels)
+	labels, ok := ctx.applyMaxAgeLabel(labels, timestamp)
+	if !ok || !isMetricAllowed(labels) {
+		return labels, value, false
+	}
+	if ctx.auditEvent != nil {
+		ctx.auditEvent.addRow(labels)
+	}
+	value = transformValue(labels, value)
+	value = roundValue(value)
+	trackMetricName(labels)
+	trackConstantTags(labels)
+	trackLastSeen(labels)
+	return labels, value, true
+}
+
 // WriteDataPoint writes (timestamp, value) with the given prefix and lables into ctx buffer.
+//
+// Labels are extracted from the metric name according to -insert.metricNameExtractRegex.
+// Label names are normalized according to -insert.normalizeLabelNames.
+// The label with the maximum age is removed according to -insert.maxAgeLabel and the data point is dropped if it is older than the maximum age.
+// The data point is dropped if its metric name isn't allowed by -ingest.allowedMetrics or -ingest.blockedMetrics.
+// The value is transformed according to -insert.valueTransformsFile and then rounded according to -insert.significantFigures.
+// Extra labels are added to labels if prefix is empty. Otherwise the caller
+// must add extra labels to the labels marshaled in prefix with ApplyExtraLabels.
+// Labels are sorted according to -insert.labelOrder if it is set for the protocol passed to SetLabelOrder.
+// Labels marshaled in prefix aren't sorted.
 func (ctx *InsertCtx) WriteDataPoint(prefix []byte, labels []prompb.Label, timestamp int64, value float64) {
+	labels, value, ok := ctx.prepareDataPoint(labels, timestamp, value)
+	if !ok {
+		return
+	}
+	if len(prefix) == 0 {
+		labels = ctx.ApplyExtraLabels(labels)
+	}
+	labels = ctx.sortLabelsIfNeeded(labels)
 	metricNameRaw := ctx.marshalMetricNameRaw(prefix, labels)
 	ctx.addRow(metricNameRaw, timestamp, value)
 }
 
+// WriteDataPointInterned writes (timestamp, value) with the given prefix and labels into ctx buffer.
+//
+// Unlike WriteDataPoint, it stores only a single copy of the marshaled metric name
+// for all the data points with identical labels within the current request.
+// This reduces memory usage and allocations for big batches with many data points
+// per time series.
+//
+// Metric name extraction, label names normalization, max age labels, metric filters, value transforms, value rounding, extra labels and label order are applied in the same way as in WriteDataPoint.
+func (ctx *InsertCtx) WriteDataPointInterned(prefix []byte, labels []prompb.Label, timestamp int64, value float64) {
+	labels, value, ok := ctx.prepareDataPoint(labels, timestamp, value)
+	if !ok {
+		return
+	}
+	if len(prefix) == 0 {
+		labels = ctx.ApplyExtraLabels(labels)
+	}
+	labels = ctx.sortLabelsIfNeeded(labels)
+	ctx.metricNameTmp = append(ctx.metricNameTmp[:0], prefix...)
+	ctx.metricNameTmp = storage.MarshalMetricNameRaw(ctx.metricNameTmp, labels)
+	metricNameRaw, ok := ctx.metricNamesCache[string(ctx.metricNameTmp)]
+	if !ok {
+		start := len(ctx.metricNamesBuf)
+		ctx.metricNamesBuf = append(ctx.metricNamesBuf, ctx.metricNameTmp...)
+		metricNameRaw = ctx.metricNamesBuf[start:]
+		metricNameRaw = metricNameRaw[:len(metricNameRaw):len(metricNameRaw)]
+		if ctx.metricNamesCache == nil {
+			ctx.metricNamesCache = make(map[string][]byte)
+		}
+		// Use metricNameRaw as a key without copying it, since it remains
+		// unchanged until the next Reset call.
+		ctx.metricNamesCache[bytesutil.ToUnsafeString(metricNameRaw)] = metricNameRaw
+	}
+	ctx.addRow(metricNameRaw, timestamp, value)
+}
+
 // WriteDataPointExt writes (timestamp, value) with the given metricNameRaw and labels into ctx buffer.
 //
 // It returns metricNameRaw for the given labels if len(metricNameRaw) == 0.
+// The data point is dropped in the same way as in WriteDataPoint if its metric name isn't allowed.
 func (ctx *InsertCtx) WriteDataPointExt(metricNameRaw []byte, labels []prompb.Label, timestamp int64, value float64) []byte {
+	labels, value, ok := ctx.prepareDataPoint(labels, timestamp, value)
+	if !ok {
+		return metricNameRaw
+	}
 	if len(metricNameRaw) == 0 {
-		metricNameRaw = ctx.marshalMetricNameRaw(nil, labels)
+		metricNameRaw = ctx.marshalMetricNameRaw(nil, ctx.sortLabelsIfNeeded(ctx.ApplyExtraLabels(labels)))
 	}
 	ctx.addRow(metricNameRaw, timestamp, value)
 	return metricNameRaw
 }
 
 func (ctx *InsertCtx) addRow(metricNameRaw []byte, timestamp int64, value float64) {
+	if ctx.serverTimestamp != 0 {
+		timestamp = ctx.serverTimestamp
+		serverTimeRows.Inc()
+	}
 	mrs := ctx.mrs
 	if cap(mrs) > len(mrs) {
 		mrs = mrs[:len(mrs)+1]
@@ -96,10 +242,95 @@ func (ctx *InsertCtx) AddLabel(name, value string) {
 	ctx.Labels = labels
 }
 
+// RowsCount returns the number of rows buffered in ctx.
+func (ctx *InsertCtx) RowsCount() int {
+	return len(ctx.mrs)
+}
+
 // FlushBufs flushes buffered rows to the underlying storage.
+//
+// Rows are routed to -storageNode instances if they are set.
+// Otherwise they are written asynchronously if -insert.bufferRows is set and the buffer has enough room for them.
+// Otherwise small batches of rows are merged with rows from concurrent requests if -insert.coalesceMaxRows is set.
+//
+// Failed writes to the local storage and to -storageNode instances are retried according to -insert.flushRetries.
+// Rows are written to the sink instead if it is set with SetSink. A copy of rows is sent to -mirror.remoteWrite if it is set.
 func (ctx *InsertCtx) FlushBufs() error {
-	if err := vmstorage.AddRows(ctx.mrs); err != nil {
+	mirrorRows(ctx.mrs)
+	if ctx.trace != nil {
+		startTime := time.Now()
+		defer func(rows int) {
+			ctx.trace.addFlush(rows, time.Since(startTime))
+		}(len(ctx.mrs))
+	}
+	return flushRows(ctx.reqCtx, ctx.mrs)
+}
+
+// flushRows writes mrs to the sink, to -storageNode instances or to the local storage.
+//
+// Retries for writing rows to the local storage are stopped when reqCtx is done. reqCtx may be nil.
+func flushRows(reqCtx context.Context, mrs []storage.MetricRow) error {
+	if sink := getSink(); sink != nil {
+		return sink.AddRows(mrs)
+	}
+	if sns := getStorageNodes(); sns != nil {
+		return sns.addRows(reqCtx, mrs, false)
+	}
+	return withFlushRetries(reqCtx, func() error {
+		return addRowsLocal(mrs)
+	})
+}
+
+// addRowsLocal writes mrs to the local storage.
+func addRowsLocal(mrs []storage.MetricRow) error {
+	if ib := getInsertBuffer(); ib != nil && ib.tryAdd(mrs) {
+		return nil
+	}
+	if fc := getFlushCoalescer(); fc != nil && fc.shouldCoalesce(len(mrs)) {
+		if err := fc.add(mrs); err != nil {
+			return fmt.Errorf("cannot store metrics: %s", err)
+		}
+		return nil
+	}
+	if err := vmstorage.AddRows(mrs); err != nil {
 		return fmt.Errorf("cannot store metrics: %s", err)
 	}
 	return nil
 }
+
+// FlushBufsSync flushes buffered rows to the underlying storage bypassing -insert.bufferRows.
+//
+// Rows are persisted to disk when the call returns. If -storageNode is set, then rows
+// are persisted to disk by storage nodes when the call returns. If sink is set with SetSink, then rows are written to the sink.
+func (ctx *InsertCtx) FlushBufsSync() error {
+	mirrorRows(ctx.mrs)
+	if ctx.trace != nil {
+		startTime := time.Now()
+		defer func(rows int) {
+			ctx.trace.addFlush(rows, time.Since(startTime))
+		}(len(ctx.mrs))
+	}
+	if sink := getSink(); sink != nil {
+		return sink.AddRows(ctx.mrs)
+	}
+	if sns := getStorageNodes(); sns != nil {
+		return sns.addRows(ctx.reqCtx, ctx.mrs, true)
+	}
+	return addRowsLocalSync(ctx.reqCtx, ctx.mrs)
+}
+
+// addRowsLocalSync writes mrs to the local storage bypassing -insert.bufferRows and persists them to disk.
+//
+// Retries for writing rows are stopped when reqCtx is done. reqCtx may be nil.
+func addRowsLocalSync(reqCtx context.Context, mrs []storage.MetricRow) error {
+	err := withFlushRetries(reqCtx, func() error {
+		return vmstorage.AddRows(mrs)
+	})
+	if err != nil {
+		return fmt.Errorf("cannot store metrics: %s", err)
+	}
+	if err := vmstorage.FlushToDisk(); err != nil {
+		return fmt.Errorf("cannot flush metrics to disk: %s", err)
+	}
+	return nil
+}
@@ -0,0 +1,71 @@
+package common
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/VictoriaMetrics/VictoriaMetrics/app/vminsert/concurrencylimiter"
+	"github.com/VictoriaMetrics/VictoriaMetrics/app/vmstorage"
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/storage"
+)
+
+func TestFlushBufsSyncLocalStorage(t *testing.T) {
+	path, err := ioutil.TempDir("", "vminsert-sync-test")
+	if err != nil {
+		t.Fatalf("cannot create temporary dir: %s", err)
+	}
+	defer func(dataPath string) {
+		*vmstorage.DataPath = dataPath
+		_ = os.RemoveAll(path)
+	}(*vmstorage.DataPath)
+	*vmstorage.DataPath = path
+	vmstorage.InitWithoutMetrics()
+	defer func() {
+		vmstorage.Stop()
+		vmstorage.Storage = nil
+	}()
+
+	pendingRows := func() uint64 {
+		var m storage.Metrics
+		vmstorage.Storage.UpdateMetrics(&m)
+		return m.TableMetrics.PendingRows
+	}
+	timestamp := time.Now().UnixNano() / 1e6
+
+	// Rows written with FlushBufsSync must be flushed to disk.
+	var ctx InsertCtx
+	ctx.Reset(1)
+	ctx.AddLabel("", "foo")
+	ctx.WriteDataPoint(nil, ctx.Labels, timestamp, 42)
+	if err := ctx.FlushBufsSync(); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if n := pendingRows(); n != 0 {
+		t.Fatalf("unexpected number of pending rows after FlushBufsSync; got %d; want 0", n)
+	}
+
+	// Rows routed from sync inserts at other instances must be flushed to disk.
+	concurrencylimiter.Init()
+	defer func() {
+		*storageNodeInsertAuthKey = ""
+	}()
+	*storageNodeInsertAuthKey = "secret"
+	mr := storage.MetricRow{
+		MetricNameRaw: ctx.mrs[0].MetricNameRaw,
+		Timestamp:     timestamp + 1,
+		Value:         43,
+	}
+	data := mr.Marshal(nil)
+	req := httptest.NewRequest("POST", fmt.Sprintf("%s?authKey=secret&sync=1", StorageNodeInsertPath), bytes.NewReader(data))
+	if err := InsertStorageNodeHandler(req, 1024); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if n := pendingRows(); n != 0 {
+		t.Fatalf("unexpected number of pending rows after sync insert from storage node; got %d; want 0", n)
+	}
+}
@@ -0,0 +1,53 @@
+package common
+
+import (
+	"fmt"
+	"testing"
+)
+
+func BenchmarkInsertCtxWriteDataPoint(b *testing.B) {
+	benchmarkInsertCtxWriteDataPoint(b, func(ic *InsertCtx, timestamp int64, value float64) {
+		ic.WriteDataPoint(nil, ic.Labels, timestamp, value)
+	})
+}
+
+func BenchmarkInsertCtxWriteDataPointInterned(b *testing.B) {
+	benchmarkInsertCtxWriteDataPoint(b, func(ic *InsertCtx, timestamp int64, value float64) {
+		ic.WriteDataPointInterned(nil, ic.Labels, timestamp, value)
+	})
+}
+
+func benchmarkInsertCtxWriteDataPoint(b *testing.B, writeDataPoint func(ic *InsertCtx, timestamp int64, value float64)) {
+	// A typical homogeneous batch: a few metrics for a few hosts with many samples each.
+	const rowsCount = 1000
+	type row struct {
+		metric string
+		host   string
+		dc     string
+	}
+	rows := make([]row, rowsCount)
+	for i := range rows {
+		rows[i] = row{
+			metric: fmt.Sprintf("cpu.usage_%d", i%5),
+			host:   fmt.Sprintf("host-%d", i%4),
+			dc:     "us-east-1",
+		}
+	}
+	b.ReportAllocs()
+	b.SetBytes(rowsCount)
+	for i := 0; i < b.N; i++ {
+		// Use fresh InsertCtx on every iteration in order to measure
+		// allocations needed for buffers growth.
+		var ic InsertCtx
+		ic.Reset(rowsCount)
+		for j := range rows {
+			r := &rows[j]
+			ic.Labels = ic.Labels[:0]
+			ic.AddLabel("", r.metric)
+			ic.AddLabel("host", r.host)
+			ic.AddLabel("dc", r.dc)
+			writeDataPoint(&ic, int64(j), float64(j))
+		}
+		b.ReportMetric(float64(len(ic.metricNamesBuf)), "metricNamesBytes/op")
+	}
+}
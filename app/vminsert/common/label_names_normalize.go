@@ -0,0 +1,111 @@
+package common
+
+import (
+	"flag"
+	"sync"
+
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/bytesutil"
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/prompb"
+	"github.com/VictoriaMetrics/metrics"
+)
+
+var normalizeLabelNames = flag.Bool("insert.normalizeLabelNames", false, "Whether to replace chars disallowed in Prometheus label names with `_` in label names of the ingested rows. "+
+	"For instance, OpenTSDB tag key `host.region` is stored as `host_region`, so it may be queried via PromQL. "+
+	"If multiple labels of a row have the same name after the normalization, then only the first label is kept")
+
+// isValidLabelName returns true if name matches `[a-zA-Z_][a-zA-Z0-9_]*`.
+func isValidLabelName(name []byte) bool {
+	if len(name) == 0 {
+		return false
+	}
+	for i, c := range name {
+		if !isLabelNameChar(c) || i == 0 && c >= '0' && c <= '9' {
+			return false
+		}
+	}
+	return true
+}
+
+func isLabelNameChar(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_'
+}
+
+// normalizeLabelName returns name with chars disallowed in Prometheus label names replaced with `_`.
+//
+// `_` is prepended to names starting with a digit.
+func normalizeLabelName(name []byte) []byte {
+	var dst []byte
+	if len(name) > 0 && name[0] >= '0' && name[0] <= '9' {
+		dst = append(dst, '_')
+	}
+	for _, c := range name {
+		if !isLabelNameChar(c) {
+			c = '_'
+		}
+		dst = append(dst, c)
+	}
+	return dst
+}
+
+// normalizedLabelNames caches results of normalizeLabelName calls, since the number of distinct label names is usually small.
+var normalizedLabelNames struct {
+	mu    sync.RWMutex
+	cache map[string][]byte
+}
+
+func getNormalizedLabelName(name []byte) []byte {
+	nln := &normalizedLabelNames
+	nln.mu.RLock()
+	s, ok := nln.cache[bytesutil.ToUnsafeString(name)]
+	nln.mu.RUnlock()
+	if ok {
+		return s
+	}
+	s = normalizeLabelName(name)
+	nln.mu.Lock()
+	if nln.cache == nil || len(nln.cache) >= maxMetricNameFilterCacheSize {
+		nln.cache = make(map[string][]byte)
+	}
+	nln.cache[string(name)] = s
+	nln.mu.Unlock()
+	return s
+}
+
+// normalizeLabelNames returns labels with label names normalized according to -insert.normalizeLabelNames.
+//
+// The metric name isn't modified. Labels with duplicate names after the normalization are dropped.
+// The returned labels are valid until the next normalizeLabelNames call.
+func (ctx *InsertCtx) normalizeLabelNames(labels []prompb.Label) []prompb.Label {
+	if !*normalizeLabelNames {
+		return labels
+	}
+	needNormalize := false
+	for _, label := range labels {
+		if len(label.Name) > 0 && string(label.Name) != "__name__" && !isValidLabelName(label.Name) {
+			needNormalize = true
+			break
+		}
+	}
+	if !needNormalize {
+		return labels
+	}
+	dst := ctx.normalizedLabelsBuf[:0]
+	for _, label := range labels {
+		if len(label.Name) > 0 && string(label.Name) != "__name__" && !isValidLabelName(label.Name) {
+			label.Name = getNormalizedLabelName(label.Name)
+		}
+		if hasLabel(dst, bytesutil.ToUnsafeString(label.Name)) {
+			labelNameCollisions.Inc()
+			continue
+		}
+		dst = append(dst, label)
+	}
+	ctx.normalizedLabelsBuf = dst
+	normalizedLabelNamesRows.Inc()
+	return dst
+}
+
+var (
+	normalizedLabelNamesRows = metrics.NewCounter(`vm_normalized_label_names_rows_total`)
+	labelNameCollisions      = metrics.NewCounter(`vm_label_name_collisions_total`)
+)
@@ -0,0 +1,65 @@
+package common
+
+import (
+	"testing"
+
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/prompb"
+)
+
+func TestNormalizeLabelName(t *testing.T) {
+	f := func(name, resultExpected string) {
+		t.Helper()
+		if isValidLabelName([]byte(name)) != (name == resultExpected) {
+			t.Fatalf("unexpected isValidLabelName result for %q", name)
+		}
+		result := string(normalizeLabelName([]byte(name)))
+		if result != resultExpected {
+			t.Fatalf("unexpected normalized name for %q; got %q; want %q", name, result, resultExpected)
+		}
+	}
+	f("host", "host")
+	f("_host_1", "_host_1")
+	f("host.region", "host_region")
+	f("host-name/x", "host_name_x")
+	f("1host", "_1host")
+	f("хост", "________")
+}
+
+func TestInsertCtxNormalizeLabelNames(t *testing.T) {
+	defer func() {
+		*normalizeLabelNames = false
+	}()
+	f := func(tags []string, resultExpected string) {
+		t.Helper()
+		labels := []prompb.Label{{Name: []byte("__name__"), Value: []byte("foo.bar")}}
+		for i := 0; i+1 < len(tags); i += 2 {
+			labels = append(labels, prompb.Label{Name: []byte(tags[i]), Value: []byte(tags[i+1])})
+		}
+		var ctx InsertCtx
+		for i := 0; i < 2; i++ {
+			// The second call uses cached names.
+			ctx.Reset(0)
+			result := labelsString(ctx.normalizeLabelNames(labels))
+			if result != resultExpected {
+				t.Fatalf("unexpected labels; got %s; want %s", result, resultExpected)
+			}
+		}
+	}
+
+	// The normalization is disabled
+	f([]string{"host.region", "us"}, `__name__=foo.bar,host.region=us`)
+
+	*normalizeLabelNames = true
+
+	// The metric name isn't modified
+	f(nil, `__name__=foo.bar`)
+	f([]string{"host", "a", "job", "x"}, `__name__=foo.bar,host=a,job=x`)
+	f([]string{"host.region", "us", "job", "x"}, `__name__=foo.bar,host_region=us,job=x`)
+
+	// Collisions
+	collisions := labelNameCollisions.Get()
+	f([]string{"host.region", "us", "host_region", "eu", "host-region", "ap"}, `__name__=foo.bar,host_region=us`)
+	if n := labelNameCollisions.Get() - collisions; n != 4 {
+		t.Fatalf("unexpected number of collisions; got %d; want 4", n)
+	}
+}
@@ -0,0 +1,126 @@
+package common
+
+import (
+	"flag"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/logger"
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/prompb"
+	"github.com/VictoriaMetrics/metrics"
+)
+
+var labelOrder = flag.String("insert.labelOrder", "", "Comma-separated list of `protocol=order` pairs with the order of labels in the ingested rows for the given protocols, "+
+	"for instance, `opentsdb=sort,prometheus=preserve`. `preserve` keeps labels in the order they are received from the client. "+
+	"`sort` puts the metric name first and sorts the rest of labels by name, so rows sent with distinct tag order share the same metric name "+
+	"in -mirror.remoteWrite and in the storage cache. Protocols missing in the list preserve label order. "+
+	"Supported protocols: emf, esbulk, graphite, influx, opentsdb, opentsdb-http, otlp, prometheus, prometheus-text")
+
+// labelOrderProtocols contains protocols supported by -insert.labelOrder.
+var labelOrderProtocols = []string{"emf", "esbulk", "graphite", "influx", "opentsdb", "opentsdb-http", "otlp", "prometheus", "prometheus-text"}
+
+// sortLabelsProtocols contains protocols with `sort` order in -insert.labelOrder.
+var sortLabelsProtocols map[string]bool
+
+// InitLabelOrder parses -insert.labelOrder.
+//
+// InitLabelOrder must be called after flag.Parse call.
+func InitLabelOrder() {
+	m, err := parseLabelOrder(*labelOrder)
+	if err != nil {
+		logger.Fatalf("cannot parse -insert.labelOrder=%q: %s", *labelOrder, err)
+	}
+	sortLabelsProtocols = m
+}
+
+// parseLabelOrder parses comma-separated `protocol=order` pairs from s.
+//
+// It returns protocols with `sort` order.
+func parseLabelOrder(s string) (map[string]bool, error) {
+	if len(s) == 0 {
+		return nil, nil
+	}
+	m := make(map[string]bool)
+	seen := make(map[string]bool)
+	for _, kv := range strings.Split(s, ",") {
+		n := strings.IndexByte(kv, '=')
+		if n < 0 {
+			return nil, fmt.Errorf("missing `=` in %q", kv)
+		}
+		protocol := strings.TrimSpace(kv[:n])
+		order := strings.TrimSpace(kv[n+1:])
+		if !isLabelOrderProtocol(protocol) {
+			return nil, fmt.Errorf("unsupported protocol %q in %q; supported protocols: %s", protocol, kv, strings.Join(labelOrderProtocols, ", "))
+		}
+		if seen[protocol] {
+			return nil, fmt.Errorf("duplicate protocol %q", protocol)
+		}
+		seen[protocol] = true
+		switch order {
+		case "preserve":
+		case "sort":
+			m[protocol] = true
+		default:
+			return nil, fmt.Errorf("unsupported order %q in %q; supported orders: preserve, sort", order, kv)
+		}
+	}
+	return m, nil
+}
+
+func isLabelOrderProtocol(protocol string) bool {
+	for _, p := range labelOrderProtocols {
+		if p == protocol {
+			return true
+		}
+	}
+	return false
+}
+
+// SetLabelOrder sets the order of labels for rows written via ctx according to -insert.labelOrder for the given protocol.
+//
+// The order remains set until the next SetLabelOrder call.
+func (ctx *InsertCtx) SetLabelOrder(protocol string) {
+	ctx.sortLabels = sortLabelsProtocols[protocol]
+}
+
+// sortLabelsIfNeeded returns labels in canonical order if ctx must sort labels. See SetLabelOrder.
+//
+// The metric name goes first, while the rest of labels are sorted by name.
+// labels aren't modified. The returned labels are valid until the next sortLabelsIfNeeded call.
+func (ctx *InsertCtx) sortLabelsIfNeeded(labels []prompb.Label) []prompb.Label {
+	if !ctx.sortLabels {
+		return labels
+	}
+	if sort.IsSorted(canonicalLabels(labels)) {
+		return labels
+	}
+	dst := append(ctx.sortedLabelsBuf[:0], labels...)
+	// Use sort.Stable instead of sort.Slice, since sort.Slice allocates.
+	// Stable sorting keeps the original order of labels with identical names.
+	sort.Stable(canonicalLabels(dst))
+	ctx.sortedLabelsBuf = dst
+	sortedLabelsRows.Inc()
+	return dst
+}
+
+// canonicalLabels implements sort.Interface for sorting labels in canonical order.
+type canonicalLabels []prompb.Label
+
+func (cl canonicalLabels) Len() int      { return len(cl) }
+func (cl canonicalLabels) Swap(i, j int) { cl[i], cl[j] = cl[j], cl[i] }
+func (cl canonicalLabels) Less(i, j int) bool {
+	a := canonicalLabelName(cl[i].Name)
+	b := canonicalLabelName(cl[j].Name)
+	return string(a) < string(b)
+}
+
+// canonicalLabelName returns an empty name for the metric name label, so it goes first.
+func canonicalLabelName(name []byte) []byte {
+	if string(name) == "__name__" {
+		return nil
+	}
+	return name
+}
+
+var sortedLabelsRows = metrics.NewCounter(`vm_sorted_labels_rows_total`)
@@ -0,0 +1,100 @@
+package common
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/prompb"
+)
+
+func TestParseLabelOrderFailure(t *testing.T) {
+	f := func(s string) {
+		t.Helper()
+		if _, err := parseLabelOrder(s); err == nil {
+			t.Fatalf("expecting non-nil error when parsing %q", s)
+		}
+	}
+	f("opentsdb")
+	f("opentsdb=")
+	f("opentsdb=canonical")
+	f("carbon=sort")
+	f("opentsdb=sort,")
+	f("opentsdb=sort,opentsdb=preserve")
+}
+
+func TestParseLabelOrderSuccess(t *testing.T) {
+	m, err := parseLabelOrder(" opentsdb = sort ,prometheus=preserve,opentsdb-http=sort")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(m) != 2 || !m["opentsdb"] || !m["opentsdb-http"] {
+		t.Fatalf("unexpected protocols with sorted labels: %v", m)
+	}
+}
+
+func TestInsertCtxLabelOrder(t *testing.T) {
+	defer func(m map[string]bool) {
+		sortLabelsProtocols = m
+	}(sortLabelsProtocols)
+	sortLabelsProtocols = map[string]bool{
+		"opentsdb": true,
+	}
+
+	f := func(protocol string, tags []string, resultExpected string) {
+		t.Helper()
+		var labels []prompb.Label
+		for i := 0; i+1 < len(tags); i += 2 {
+			labels = append(labels, prompb.Label{Name: []byte(tags[i]), Value: []byte(tags[i+1])})
+		}
+		var ctx InsertCtx
+		ctx.Reset(0)
+		ctx.SetLabelOrder(protocol)
+		result := labelsString(ctx.sortLabelsIfNeeded(labels))
+		if result != resultExpected {
+			t.Fatalf("unexpected labels; got %s; want %s", result, resultExpected)
+		}
+	}
+
+	// Label order is preserved for protocols missing in -insert.labelOrder
+	f("prometheus", []string{"job", "x", "__name__", "foo", "host", "a"}, `job=x,__name__=foo,host=a`)
+
+	// The metric name goes first
+	f("opentsdb", []string{"job", "x", "__name__", "foo", "host", "a"}, `__name__=foo,host=a,job=x`)
+	f("opentsdb", []string{"job", "x", "", "foo", "host", "a"}, `=foo,host=a,job=x`)
+	f("opentsdb", []string{"__name__", "foo", "host", "a", "job", "x"}, `__name__=foo,host=a,job=x`)
+
+	// Labels with identical names keep their order
+	f("opentsdb", []string{"host", "b", "__name__", "foo", "host", "a"}, `__name__=foo,host=b,host=a`)
+}
+
+func TestInsertCtxLabelOrderMetricNameRaw(t *testing.T) {
+	defer func(m map[string]bool) {
+		sortLabelsProtocols = m
+	}(sortLabelsProtocols)
+	sortLabelsProtocols = map[string]bool{
+		"opentsdb": true,
+	}
+
+	write := func(protocol string, tags ...string) []byte {
+		var ctx InsertCtx
+		ctx.Reset(1)
+		ctx.SetLabelOrder(protocol)
+		ctx.AddLabel("", "foo")
+		for i := 0; i+1 < len(tags); i += 2 {
+			ctx.AddLabel(tags[i], tags[i+1])
+		}
+		ctx.WriteDataPoint(nil, ctx.Labels, 1, 2)
+		return ctx.mrs[0].MetricNameRaw
+	}
+
+	a := write("opentsdb", "host", "a", "job", "x")
+	b := write("opentsdb", "job", "x", "host", "a")
+	if !bytes.Equal(a, b) {
+		t.Fatalf("expecting identical metric names for sorted labels; got %q and %q", a, b)
+	}
+	a = write("prometheus", "host", "a", "job", "x")
+	b = write("prometheus", "job", "x", "host", "a")
+	if bytes.Equal(a, b) {
+		t.Fatalf("expecting distinct metric names for labels in the original order; got %q", a)
+	}
+}
@@ -0,0 +1,133 @@
+package common
+
+import (
+	"flag"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/bytesutil"
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/prompb"
+)
+
+var lastSeenMaxMetrics = flag.Int("debug.lastSeenMaxMetrics", 0, "The maximum number of metric names to track the last ingestion time for. "+
+	"The last ingestion time per metric is exposed at /debug/insert/last-seen page of -debug.insertListenAddr, so metrics, which stopped reporting, may be detected. "+
+	"Rows for metric names above the limit aren't tracked. The tracking is disabled by default")
+
+// lastSeenEnabled is set to non-zero when the last ingestion time per metric must be tracked.
+var lastSeenEnabled uint32
+
+// lastSeenTracker tracks the last ingestion time per metric name.
+type lastSeenTracker struct {
+	mu sync.RWMutex
+
+	// metrics contains unix timestamps in seconds for the last ingested row per metric name.
+	//
+	// The timestamps are updated atomically under read lock.
+	metrics map[string]*int64
+
+	// untrackedRows is the number of rows for metric names above -debug.lastSeenMaxMetrics.
+	untrackedRows uint64
+}
+
+var lst lastSeenTracker
+
+// startLastSeenTracking enables last ingestion time tracking if -debug.lastSeenMaxMetrics is set.
+func startLastSeenTracking() {
+	if *lastSeenMaxMetrics <= 0 {
+		return
+	}
+	lst.mu.Lock()
+	lst.metrics = make(map[string]*int64)
+	atomic.StoreUint64(&lst.untrackedRows, 0)
+	lst.mu.Unlock()
+	atomic.StoreUint32(&lastSeenEnabled, 1)
+}
+
+// stopLastSeenTracking disables last ingestion time tracking.
+func stopLastSeenTracking() {
+	atomic.StoreUint32(&lastSeenEnabled, 0)
+}
+
+// trackLastSeen registers the current time as the last ingestion time for the metric name from labels
+// if the tracking is enabled.
+func trackLastSeen(labels []prompb.Label) {
+	if atomic.LoadUint32(&lastSeenEnabled) == 0 {
+		return
+	}
+	name := getMetricName(labels)
+	if len(name) == 0 {
+		return
+	}
+	now := time.Now().Unix()
+
+	lst.mu.RLock()
+	p := lst.metrics[bytesutil.ToUnsafeString(name)]
+	lst.mu.RUnlock()
+	if p != nil {
+		atomic.StoreInt64(p, now)
+		return
+	}
+
+	lst.mu.Lock()
+	if p := lst.metrics[bytesutil.ToUnsafeString(name)]; p != nil {
+		atomic.StoreInt64(p, now)
+	} else if len(lst.metrics) < *lastSeenMaxMetrics {
+		lst.metrics[string(name)] = &now
+	} else {
+		atomic.AddUint64(&lst.untrackedRows, 1)
+	}
+	lst.mu.Unlock()
+}
+
+type lastSeenReport struct {
+	TrackedMetrics int              `json:"trackedMetrics"`
+	MaxMetrics     int              `json:"maxMetrics"`
+	UntrackedRows  uint64           `json:"untrackedRows"`
+	Metrics        []lastSeenMetric `json:"metrics"`
+}
+
+type lastSeenMetric struct {
+	Metric   string    `json:"metric"`
+	LastSeen time.Time `json:"lastSeen"`
+	Age      string    `json:"age"`
+}
+
+// getLastSeenReport returns the last ingestion time for metrics, which weren't seen during minAge.
+//
+// Metrics are sorted by the last ingestion time, so the most stale metrics go first.
+// nil is returned if the tracking is disabled.
+func getLastSeenReport(now time.Time, minAge time.Duration) *lastSeenReport {
+	if atomic.LoadUint32(&lastSeenEnabled) == 0 {
+		return nil
+	}
+	lsr := &lastSeenReport{
+		MaxMetrics:    *lastSeenMaxMetrics,
+		UntrackedRows: atomic.LoadUint64(&lst.untrackedRows),
+		Metrics:       []lastSeenMetric{},
+	}
+	lst.mu.RLock()
+	lsr.TrackedMetrics = len(lst.metrics)
+	for name, p := range lst.metrics {
+		lastSeen := time.Unix(atomic.LoadInt64(p), 0)
+		age := now.Sub(lastSeen)
+		if age < minAge {
+			continue
+		}
+		lsr.Metrics = append(lsr.Metrics, lastSeenMetric{
+			Metric:   name,
+			LastSeen: lastSeen,
+			Age:      age.Truncate(time.Second).String(),
+		})
+	}
+	lst.mu.RUnlock()
+	sort.Slice(lsr.Metrics, func(i, j int) bool {
+		a, b := &lsr.Metrics[i], &lsr.Metrics[j]
+		if !a.LastSeen.Equal(b.LastSeen) {
+			return a.LastSeen.Before(b.LastSeen)
+		}
+		return a.Metric < b.Metric
+	})
+	return lsr
+}
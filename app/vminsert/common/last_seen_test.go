@@ -0,0 +1,90 @@
+package common
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/prompb"
+)
+
+func TestLastSeenHandler(t *testing.T) {
+	defer func(n int) {
+		*lastSeenMaxMetrics = n
+		stopLastSeenTracking()
+	}(*lastSeenMaxMetrics)
+
+	// Tracking is disabled
+	w := httptest.NewRecorder()
+	debugHandler(w, httptest.NewRequest("GET", "/debug/insert/last-seen", nil))
+	if w.Code != 404 {
+		t.Fatalf("unexpected status code for disabled tracking; got %d; want 404", w.Code)
+	}
+
+	*lastSeenMaxMetrics = 2
+	startLastSeenTracking()
+
+	track := func(name string) {
+		trackLastSeen([]prompb.Label{
+			{Name: []byte("__name__"), Value: []byte(name)},
+			{Name: []byte("host"), Value: []byte("a")},
+		})
+	}
+	track("foo")
+	track("bar")
+	track("bar")
+	// The limit on the number of tracked metrics is reached
+	track("baz")
+
+	// Make foo stale
+	lst.mu.RLock()
+	atomic.AddInt64(lst.metrics["foo"], -3600)
+	lst.mu.RUnlock()
+
+	f := func(url string, metricsExpected []string) {
+		t.Helper()
+		w := httptest.NewRecorder()
+		debugHandler(w, httptest.NewRequest("GET", url, nil))
+		if w.Code != 200 {
+			t.Fatalf("unexpected status code; got %d; want 200; body: %s", w.Code, w.Body.String())
+		}
+		var lsr lastSeenReport
+		if err := json.Unmarshal(w.Body.Bytes(), &lsr); err != nil {
+			t.Fatalf("cannot parse response: %s", err)
+		}
+		if lsr.TrackedMetrics != 2 {
+			t.Fatalf("unexpected number of tracked metrics; got %d; want 2", lsr.TrackedMetrics)
+		}
+		if lsr.UntrackedRows != 1 {
+			t.Fatalf("unexpected number of untracked rows; got %d; want 1", lsr.UntrackedRows)
+		}
+		var names []string
+		for _, m := range lsr.Metrics {
+			names = append(names, m.Metric)
+		}
+		if len(names) != len(metricsExpected) {
+			t.Fatalf("unexpected metrics; got %q; want %q", names, metricsExpected)
+		}
+		for i := range names {
+			if names[i] != metricsExpected[i] {
+				t.Fatalf("unexpected metrics; got %q; want %q", names, metricsExpected)
+			}
+		}
+	}
+	f("/debug/insert/last-seen", []string{"foo", "bar"})
+	f("/debug/insert/last-seen?stale=10m", []string{"foo"})
+	f("/debug/insert/last-seen?stale=2h", nil)
+
+	w = httptest.NewRecorder()
+	debugHandler(w, httptest.NewRequest("GET", "/debug/insert/last-seen?stale=foo", nil))
+	if w.Code != 400 {
+		t.Fatalf("unexpected status code for invalid stale arg; got %d; want 400", w.Code)
+	}
+
+	lsr := getLastSeenReport(time.Now(), 0)
+	if age := lsr.Metrics[0].Age; age != "1h0m0s" && age != "1h0m1s" {
+		t.Fatalf("unexpected age for stale metric: %q", age)
+	}
+}
@@ -0,0 +1,94 @@
+package common
+
+import (
+	"flag"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/bytesutil"
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/prompb"
+	"github.com/VictoriaMetrics/metrics"
+)
+
+var maxAgeLabel = flag.String("insert.maxAgeLabel", "", "Label name with the maximum age for the ingested data points, for instance, `__max_age__`. "+
+	"The label is removed from rows, while data points with timestamps older than its value such as `7d` are dropped at ingestion. "+
+	"This is an ingestion filter, not a per-series retention: the stored data points are kept during -retentionPeriod. "+
+	"Rows with invalid values are stored as is without the label. The filter is disabled by default")
+
+// applyMaxAgeLabel removes -insert.maxAgeLabel label from labels and checks the timestamp against the maximum age from the label value.
+//
+// It returns false if the data point with the given timestamp in milliseconds is older than the maximum age and must be dropped.
+// The returned labels are valid until the next applyMaxAgeLabel call.
+func (ctx *InsertCtx) applyMaxAgeLabel(labels []prompb.Label, timestamp int64) ([]prompb.Label, bool) {
+	labelName := *maxAgeLabel
+	if len(labelName) == 0 {
+		return labels, true
+	}
+	idx := -1
+	for i, label := range labels {
+		if string(label.Name) == labelName {
+			idx = i
+			break
+		}
+	}
+	if idx < 0 {
+		return labels, true
+	}
+	value := labels[idx].Value
+	dst := append(ctx.maxAgeLabelsBuf[:0], labels[:idx]...)
+	dst = append(dst, labels[idx+1:]...)
+	ctx.maxAgeLabelsBuf = dst
+
+	maxAge, err := parseMaxAge(bytesutil.ToUnsafeString(value))
+	if err != nil {
+		invalidMaxAgeRows.Inc()
+		return dst, true
+	}
+	if ctx.serverTimestamp == 0 && timestamp < time.Now().UnixNano()/1e6-int64(maxAge/time.Millisecond) {
+		expiredMaxAgeRows.Inc()
+		return dst, false
+	}
+	acceptedMaxAgeRows.Inc()
+	return dst, true
+}
+
+// parseMaxAge parses the maximum age such as `12h`, `7d`, `2w` or `1y`.
+func parseMaxAge(s string) (time.Duration, error) {
+	if len(s) == 0 {
+		return 0, fmt.Errorf("max age cannot be empty")
+	}
+	var unit time.Duration
+	switch s[len(s)-1] {
+	case 'd':
+		unit = 24 * time.Hour
+	case 'w':
+		unit = 7 * 24 * time.Hour
+	case 'y':
+		unit = 365 * 24 * time.Hour
+	}
+	var d time.Duration
+	if unit > 0 {
+		n, err := strconv.ParseFloat(s[:len(s)-1], 64)
+		if err != nil {
+			return 0, fmt.Errorf("cannot parse max age %q: %s", s, err)
+		}
+		d = time.Duration(n * float64(unit))
+	} else {
+		var err error
+		d, err = time.ParseDuration(s)
+		if err != nil {
+			return 0, fmt.Errorf("cannot parse max age %q: %s", s, err)
+		}
+	}
+	if d <= 0 {
+		return 0, fmt.Errorf("max age %q must be positive", s)
+	}
+	return d, nil
+}
+
+var (
+	acceptedMaxAgeRows = metrics.NewCounter(`vm_max_age_label_rows_total{result="accepted"}`)
+	expiredMaxAgeRows  = metrics.NewCounter(`vm_max_age_label_rows_total{result="expired"}`)
+	invalidMaxAgeRows  = metrics.NewCounter(`vm_max_age_label_rows_total{result="invalid"}`)
+)
@@ -0,0 +1,97 @@
+package common
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/prompb"
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/storage"
+)
+
+func TestParseMaxAgeSuccess(t *testing.T) {
+	f := func(s string, dExpected time.Duration) {
+		t.Helper()
+		d, err := parseMaxAge(s)
+		if err != nil {
+			t.Fatalf("unexpected error when parsing %q: %s", s, err)
+		}
+		if d != dExpected {
+			t.Fatalf("unexpected duration for %q; got %s; want %s", s, d, dExpected)
+		}
+	}
+	f("30m", 30*time.Minute)
+	f("12h", 12*time.Hour)
+	f("7d", 7*24*time.Hour)
+	f("1.5d", 36*time.Hour)
+	f("2w", 14*24*time.Hour)
+	f("1y", 365*24*time.Hour)
+}
+
+func TestParseMaxAgeFailure(t *testing.T) {
+	f := func(s string) {
+		t.Helper()
+		if _, err := parseMaxAge(s); err == nil {
+			t.Fatalf("expecting non-nil error when parsing %q", s)
+		}
+	}
+	f("")
+	f("d")
+	f("7")
+	f("foo")
+	f("-1d")
+	f("0h")
+}
+
+func TestInsertCtxMaxAgeLabel(t *testing.T) {
+	defer func() {
+		*maxAgeLabel = ""
+	}()
+
+	newLabels := func(tags ...string) []prompb.Label {
+		var labels []prompb.Label
+		for i := 0; i+1 < len(tags); i += 2 {
+			labels = append(labels, prompb.Label{Name: []byte(tags[i]), Value: []byte(tags[i+1])})
+		}
+		return labels
+	}
+	f := func(tags []string, timestamp int64, tagsExpected []string) {
+		t.Helper()
+		var ctx InsertCtx
+		ctx.Reset(0)
+		ctx.WriteDataPoint(nil, newLabels(tags...), timestamp, 1)
+		if tagsExpected == nil {
+			if len(ctx.mrs) != 0 {
+				t.Fatalf("expecting the row to be dropped; got %q", ctx.mrs[0].MetricNameRaw)
+			}
+			return
+		}
+		if len(ctx.mrs) != 1 {
+			t.Fatalf("unexpected number of rows; got %d; want 1", len(ctx.mrs))
+		}
+		metricNameRawExpected := storage.MarshalMetricNameRaw(nil, newLabels(tagsExpected...))
+		if !bytes.Equal(ctx.mrs[0].MetricNameRaw, metricNameRawExpected) {
+			t.Fatalf("unexpected metric name; got %q; want %q", ctx.mrs[0].MetricNameRaw, metricNameRawExpected)
+		}
+	}
+
+	now := time.Now().UnixNano() / 1e6
+	day := int64(24 * 3600 * 1000)
+
+	// The label is stored as is if the filter is disabled
+	f([]string{"__name__", "foo", "__max_age__", "7d"}, now-30*day, []string{"__name__", "foo", "__max_age__", "7d"})
+
+	*maxAgeLabel = "__max_age__"
+
+	// Rows without the label are stored
+	f([]string{"__name__", "foo", "job", "x"}, now-30*day, []string{"__name__", "foo", "job", "x"})
+
+	// The label is removed
+	f([]string{"__name__", "foo", "__max_age__", "7d", "job", "x"}, now-day, []string{"__name__", "foo", "job", "x"})
+
+	// Data points older than the maximum age are dropped
+	f([]string{"__name__", "foo", "__max_age__", "7d", "job", "x"}, now-8*day, nil)
+
+	// Rows with invalid values are stored without the label
+	f([]string{"__name__", "foo", "__max_age__", "forever"}, now-30*day, []string{"__name__", "foo"})
+}
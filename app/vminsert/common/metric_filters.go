@@ -0,0 +1,241 @@
+package common
+
+import (
+	"bufio"
+	"bytes"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/bytesutil"
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/logger"
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/procutil"
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/prompb"
+	"github.com/VictoriaMetrics/metrics"
+)
+
+var allowedMetrics = flag.String("ingest.allowedMetrics", "", "Regular expression for metric names to accept. Data points for other metrics are dropped. "+
+	"The regular expression must match the whole metric name. Multiple patterns may be combined with `|`, for instance, `node_.*|process_.*`. "+
+	"All the metrics are accepted if empty. See also -ingest.blockedMetrics")
+
+var (
+	blockedMetrics = flag.String("ingest.blockedMetrics", "", "Regular expression for metric names to drop, for instance, a known high-cardinality metric. "+
+		"The regular expression must match the whole metric name. Metrics matching -ingest.allowedMetrics are never dropped. See also -ingest.blockedMetricsFile")
+	blockedMetricsFile = flag.String("ingest.blockedMetricsFile", "", "Path to file with regular expressions for metric names to drop, one per line, in addition to -ingest.blockedMetrics. "+
+		"Lines starting with # are ignored. The file is re-read on SIGHUP, so problematic metrics may be blocked without restart")
+)
+
+// allowedMetricsFilter is set from -ingest.allowedMetrics. It is nil if all the metrics are allowed.
+var allowedMetricsFilter *metricNameFilter
+
+// blockedMetricsFilter contains *metricNameFilter built from -ingest.blockedMetrics and -ingest.blockedMetricsFile.
+//
+// It contains nil if no metrics are blocked.
+var blockedMetricsFilter atomic.Value
+
+// blockedMetricsLoadTime is the unix timestamp in seconds for the last successful load of blocked metrics.
+var blockedMetricsLoadTime int64
+
+var (
+	blockedMetricsStopCh chan struct{}
+	blockedMetricsWG     sync.WaitGroup
+)
+
+// InitMetricFilters parses -ingest.allowedMetrics and -ingest.blockedMetrics and starts re-reading -ingest.blockedMetricsFile on SIGHUP.
+//
+// InitMetricFilters must be called after flag.Parse call.
+func InitMetricFilters() {
+	if len(*allowedMetrics) > 0 {
+		mnf, err := newMetricNameFilter(*allowedMetrics)
+		if err != nil {
+			logger.Fatalf("cannot parse -ingest.allowedMetrics=%q: %s", *allowedMetrics, err)
+		}
+		allowedMetricsFilter = mnf
+		if len(*blockedMetrics) > 0 || len(*blockedMetricsFile) > 0 {
+			logger.Infof("-ingest.allowedMetrics takes precedence over -ingest.blockedMetrics, so only metrics matching -ingest.allowedMetrics are accepted")
+		}
+	}
+	mnf, err := loadBlockedMetrics()
+	if err != nil {
+		logger.Fatalf("cannot load blocked metrics: %s", err)
+	}
+	blockedMetricsFilter.Store(mnf)
+	atomic.StoreInt64(&blockedMetricsLoadTime, time.Now().Unix())
+	if len(*blockedMetricsFile) == 0 {
+		return
+	}
+
+	sighupCh := procutil.NewSighupChan()
+	blockedMetricsStopCh = make(chan struct{})
+	blockedMetricsWG.Add(1)
+	go func() {
+		defer blockedMetricsWG.Done()
+		for {
+			select {
+			case <-sighupCh:
+			case <-blockedMetricsStopCh:
+				return
+			}
+			blockedMetricsReloads.Inc()
+			mnf, err := loadBlockedMetrics()
+			if err != nil {
+				blockedMetricsReloadErrors.Inc()
+				logger.Errorf("cannot reload -ingest.blockedMetricsFile; continuing using the previously loaded patterns: %s", err)
+				continue
+			}
+			blockedMetricsFilter.Store(mnf)
+			atomic.StoreInt64(&blockedMetricsLoadTime, time.Now().Unix())
+			logger.Infof("reloaded blocked metrics from %q", *blockedMetricsFile)
+		}
+	}()
+}
+
+// StopMetricFilters stops re-reading -ingest.blockedMetricsFile on SIGHUP.
+func StopMetricFilters() {
+	if blockedMetricsStopCh == nil {
+		return
+	}
+	close(blockedMetricsStopCh)
+	blockedMetricsWG.Wait()
+	blockedMetricsStopCh = nil
+}
+
+var (
+	blockedMetricsReloads      = metrics.NewCounter(`vm_blocked_metrics_reloads_total`)
+	blockedMetricsReloadErrors = metrics.NewCounter(`vm_blocked_metrics_reload_errors_total`)
+)
+
+// loadBlockedMetrics returns filter for -ingest.blockedMetrics and -ingest.blockedMetricsFile.
+//
+// nil is returned if no metrics are blocked.
+func loadBlockedMetrics() (*metricNameFilter, error) {
+	var exprs []string
+	if len(*blockedMetrics) > 0 {
+		exprs = append(exprs, *blockedMetrics)
+	}
+	if len(*blockedMetricsFile) > 0 {
+		data, err := ioutil.ReadFile(*blockedMetricsFile)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read -ingest.blockedMetricsFile: %s", err)
+		}
+		fileExprs, err := parseMetricPatterns(data)
+		if err != nil {
+			return nil, fmt.Errorf("cannot parse -ingest.blockedMetricsFile=%q: %s", *blockedMetricsFile, err)
+		}
+		exprs = append(exprs, fileExprs...)
+	}
+	if len(exprs) == 0 {
+		return nil, nil
+	}
+	for i, expr := range exprs {
+		exprs[i] = "(?:" + expr + ")"
+	}
+	mnf, err := newMetricNameFilter(strings.Join(exprs, "|"))
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse -ingest.blockedMetrics: %s", err)
+	}
+	mnf.patterns = len(exprs)
+	return mnf, nil
+}
+
+// parseMetricPatterns returns regular expressions from data with one expression per line.
+func parseMetricPatterns(data []byte) ([]string, error) {
+	var exprs []string
+	sc := bufio.NewScanner(bytes.NewReader(data))
+	lineNum := 0
+	for sc.Scan() {
+		lineNum++
+		line := strings.TrimSpace(sc.Text())
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if _, err := regexp.Compile(line); err != nil {
+			return nil, fmt.Errorf("line %d: %s", lineNum, err)
+		}
+		exprs = append(exprs, line)
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	return exprs, nil
+}
+
+// maxMetricNameFilterCacheSize is the maximum number of metric names with cached match results per filter.
+//
+// The cache is reset when it reaches the limit.
+const maxMetricNameFilterCacheSize = 100000
+
+// metricNameFilter matches metric names against a regular expression.
+//
+// Match results are cached, since the number of distinct metric names is usually small.
+type metricNameFilter struct {
+	re *regexp.Regexp
+
+	// patterns is the number of patterns combined into re.
+	patterns int
+
+	mu    sync.RWMutex
+	cache map[string]bool
+}
+
+func newMetricNameFilter(expr string) (*metricNameFilter, error) {
+	re, err := regexp.Compile("^(?:" + expr + ")$")
+	if err != nil {
+		return nil, fmt.Errorf("cannot compile regexp: %s", err)
+	}
+	return &metricNameFilter{
+		re:    re,
+		cache: make(map[string]bool),
+	}, nil
+}
+
+// match returns true if name matches mnf.
+func (mnf *metricNameFilter) match(name []byte) bool {
+	mnf.mu.RLock()
+	ok, found := mnf.cache[bytesutil.ToUnsafeString(name)]
+	mnf.mu.RUnlock()
+	if found {
+		return ok
+	}
+	ok = mnf.re.Match(name)
+	mnf.mu.Lock()
+	if len(mnf.cache) >= maxMetricNameFilterCacheSize {
+		mnf.cache = make(map[string]bool)
+	}
+	mnf.cache[string(name)] = ok
+	mnf.mu.Unlock()
+	return ok
+}
+
+// isMetricAllowed returns false if the data point with the given labels must be dropped
+// according to -ingest.allowedMetrics and -ingest.blockedMetrics.
+//
+// -ingest.allowedMetrics takes precedence over -ingest.blockedMetrics if both are set.
+func isMetricAllowed(labels []prompb.Label) bool {
+	if mnf := allowedMetricsFilter; mnf != nil {
+		if !mnf.match(getMetricName(labels)) {
+			metricNotAllowedRows.Inc()
+			return false
+		}
+		return true
+	}
+	mnf, _ := blockedMetricsFilter.Load().(*metricNameFilter)
+	if mnf == nil {
+		return true
+	}
+	if mnf.match(getMetricName(labels)) {
+		metricBlockedRows.Inc()
+		return false
+	}
+	return true
+}
+
+var (
+	metricNotAllowedRows = metrics.NewCounter(`vm_rows_dropped_total{reason="metric_not_allowed"}`)
+	metricBlockedRows    = metrics.NewCounter(`vm_rows_dropped_total{reason="metric_blocked"}`)
+)
@@ -0,0 +1,171 @@
+package common
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/prompb"
+)
+
+func TestMetricNameFilter(t *testing.T) {
+	f := func(expr, name string, resultExpected bool) {
+		t.Helper()
+		mnf, err := newMetricNameFilter(expr)
+		if err != nil {
+			t.Fatalf("cannot create filter: %s", err)
+		}
+		for i := 0; i < 2; i++ {
+			// The second match uses cached result.
+			if result := mnf.match([]byte(name)); result != resultExpected {
+				t.Fatalf("unexpected result for %q matching %q; got %v; want %v", name, expr, result, resultExpected)
+			}
+		}
+	}
+	f("foo", "foo", true)
+	f("foo", "foobar", false)
+	f("foo", "barfoo", false)
+	f("node_.*|process_.*", "node_cpu", true)
+	f("node_.*|process_.*", "process_cpu", true)
+	f("node_.*|process_.*", "go_gc", false)
+	f("node_.*", "", false)
+
+	if _, err := newMetricNameFilter("foo("); err == nil {
+		t.Fatalf("expecting non-nil error for invalid regexp")
+	}
+}
+
+func TestInsertCtxAllowedMetrics(t *testing.T) {
+	mnf, err := newMetricNameFilter("foo.*")
+	if err != nil {
+		t.Fatalf("cannot create filter: %s", err)
+	}
+	allowedMetricsFilter = mnf
+	defer func() {
+		allowedMetricsFilter = nil
+	}()
+
+	droppedBefore := metricNotAllowedRows.Get()
+	var ctx InsertCtx
+	ctx.Reset(0)
+	write := func(name string) {
+		labels := []prompb.Label{
+			{Name: []byte("__name__"), Value: []byte(name)},
+			{Name: []byte("job"), Value: []byte("x")},
+		}
+		ctx.WriteDataPoint(nil, labels, 1, 1)
+		ctx.WriteDataPointInterned(nil, labels, 2, 2)
+		ctx.WriteDataPointExt(nil, labels, 3, 3)
+	}
+	write("foo")
+	write("foobar")
+	write("bar")
+	if len(ctx.mrs) != 6 {
+		t.Fatalf("unexpected number of written rows; got %d; want 6", len(ctx.mrs))
+	}
+	if n := metricNotAllowedRows.Get() - droppedBefore; n != 3 {
+		t.Fatalf("unexpected number of dropped rows; got %d; want 3", n)
+	}
+}
+
+func TestLoadBlockedMetrics(t *testing.T) {
+	defer func(expr, path string) {
+		*blockedMetrics = expr
+		*blockedMetricsFile = path
+	}(*blockedMetrics, *blockedMetricsFile)
+
+	f, err := ioutil.TempFile("", "blocked_metrics")
+	if err != nil {
+		t.Fatalf("cannot create temporary file: %s", err)
+	}
+	defer func() {
+		_ = os.Remove(f.Name())
+	}()
+	if _, err := f.WriteString("# abusive metrics\nbar_.*\n\nbaz\n"); err != nil {
+		t.Fatalf("cannot write temporary file: %s", err)
+	}
+	_ = f.Close()
+
+	*blockedMetrics = "foo"
+	*blockedMetricsFile = f.Name()
+	mnf, err := loadBlockedMetrics()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if mnf.patterns != 3 {
+		t.Fatalf("unexpected number of patterns; got %d; want 3", mnf.patterns)
+	}
+	for _, name := range []string{"foo", "bar_x", "baz"} {
+		if !mnf.match([]byte(name)) {
+			t.Fatalf("%q must be blocked", name)
+		}
+	}
+	for _, name := range []string{"foobar", "bar", "bazz"} {
+		if mnf.match([]byte(name)) {
+			t.Fatalf("%q mustn't be blocked", name)
+		}
+	}
+
+	// Invalid file
+	if err := ioutil.WriteFile(f.Name(), []byte("bar(\n"), 0600); err != nil {
+		t.Fatalf("cannot write temporary file: %s", err)
+	}
+	if _, err := loadBlockedMetrics(); err == nil {
+		t.Fatalf("expecting non-nil error for invalid file")
+	}
+
+	// Nothing is blocked
+	*blockedMetrics = ""
+	*blockedMetricsFile = ""
+	mnf, err = loadBlockedMetrics()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if mnf != nil {
+		t.Fatalf("expecting nil filter")
+	}
+}
+
+func TestInsertCtxBlockedMetrics(t *testing.T) {
+	mnf, err := newMetricNameFilter("bar.*")
+	if err != nil {
+		t.Fatalf("cannot create filter: %s", err)
+	}
+	blockedMetricsFilter.Store(mnf)
+	defer blockedMetricsFilter.Store((*metricNameFilter)(nil))
+
+	write := func(ctx *InsertCtx, name string) {
+		ctx.WriteDataPoint(nil, []prompb.Label{
+			{Name: []byte("__name__"), Value: []byte(name)},
+		}, 1, 1)
+	}
+	blockedBefore := metricBlockedRows.Get()
+	var ctx InsertCtx
+	ctx.Reset(0)
+	write(&ctx, "foo")
+	write(&ctx, "bar")
+	write(&ctx, "barbaz")
+	if len(ctx.mrs) != 1 {
+		t.Fatalf("unexpected number of written rows; got %d; want 1", len(ctx.mrs))
+	}
+	if n := metricBlockedRows.Get() - blockedBefore; n != 2 {
+		t.Fatalf("unexpected number of blocked rows; got %d; want 2", n)
+	}
+
+	// -ingest.allowedMetrics takes precedence
+	amnf, err := newMetricNameFilter("bar")
+	if err != nil {
+		t.Fatalf("cannot create filter: %s", err)
+	}
+	allowedMetricsFilter = amnf
+	defer func() {
+		allowedMetricsFilter = nil
+	}()
+	ctx.Reset(0)
+	write(&ctx, "foo")
+	write(&ctx, "bar")
+	write(&ctx, "barbaz")
+	if len(ctx.mrs) != 1 {
+		t.Fatalf("unexpected number of written rows; got %d; want 1", len(ctx.mrs))
+	}
+}
@@ -0,0 +1,143 @@
+package common
+
+import (
+	"flag"
+	"regexp"
+	"sync"
+
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/bytesutil"
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/logger"
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/prompb"
+	"github.com/VictoriaMetrics/metrics"
+)
+
+var (
+	metricNameExtractRegex = flag.String("insert.metricNameExtractRegex", "", "Regular expression with named groups for extracting labels from metric names, "+
+		"for instance, `(?P<app>\\w+)\\.(?P<host>\\w+)\\.(?P<name>\\w+)`. Every named group except of `name` becomes a label, "+
+		"while the metric name is replaced with -insert.metricNameExtractTemplate. The regular expression must match the whole metric name. "+
+		"Metric names, which don't match the regular expression, are left unchanged")
+	metricNameExtractTemplate = flag.String("insert.metricNameExtractTemplate", "$name", "Template for metric names matching -insert.metricNameExtractRegex. "+
+		"Named groups may be referred as `$group` or `${group}`")
+)
+
+// metricNameExtractor is set from -insert.metricNameExtractRegex. It is nil if labels mustn't be extracted from metric names.
+var metricNameExtractor *labelsExtractor
+
+// InitMetricNameExtract parses -insert.metricNameExtractRegex.
+//
+// InitMetricNameExtract must be called after flag.Parse call.
+func InitMetricNameExtract() {
+	if len(*metricNameExtractRegex) == 0 {
+		return
+	}
+	le, err := newLabelsExtractor(*metricNameExtractRegex, *metricNameExtractTemplate)
+	if err != nil {
+		logger.Fatalf("cannot parse -insert.metricNameExtractRegex=%q: %s", *metricNameExtractRegex, err)
+	}
+	metricNameExtractor = le
+}
+
+// labelsExtractor extracts labels from metric names.
+//
+// Extraction results are cached, since the number of distinct metric names is usually small.
+type labelsExtractor struct {
+	re       *regexp.Regexp
+	template string
+
+	mu    sync.RWMutex
+	cache map[string]*extractedLabels
+}
+
+// extractedLabels contains the result of labelsExtractor.extract call.
+//
+// It mustn't be modified, since it is shared among concurrent goroutines.
+type extractedLabels struct {
+	// name is the new metric name. It is nil if the original metric name doesn't match.
+	name   []byte
+	labels []prompb.Label
+}
+
+func newLabelsExtractor(expr, template string) (*labelsExtractor, error) {
+	re, err := regexp.Compile("^(?:" + expr + ")$")
+	if err != nil {
+		return nil, err
+	}
+	return &labelsExtractor{
+		re:       re,
+		template: template,
+		cache:    make(map[string]*extractedLabels),
+	}, nil
+}
+
+// extract returns labels extracted from metric name.
+func (le *labelsExtractor) extract(name []byte) *extractedLabels {
+	le.mu.RLock()
+	el := le.cache[bytesutil.ToUnsafeString(name)]
+	le.mu.RUnlock()
+	if el != nil {
+		return el
+	}
+	el = &extractedLabels{}
+	if match := le.re.FindSubmatchIndex(name); match != nil {
+		el.name = le.re.Expand(nil, []byte(le.template), name, match)
+		for i, groupName := range le.re.SubexpNames() {
+			if len(groupName) == 0 || groupName == "name" || match[2*i] < 0 {
+				continue
+			}
+			el.labels = append(el.labels, prompb.Label{
+				Name:  []byte(groupName),
+				Value: append([]byte{}, name[match[2*i]:match[2*i+1]]...),
+			})
+		}
+		if len(el.name) == 0 {
+			// Do not produce series without metric names.
+			el.name = nil
+			el.labels = nil
+		}
+	}
+	le.mu.Lock()
+	if len(le.cache) >= maxMetricNameFilterCacheSize {
+		le.cache = make(map[string]*extractedLabels)
+	}
+	le.cache[string(name)] = el
+	le.mu.Unlock()
+	return el
+}
+
+// extractMetricNameLabels returns labels with labels extracted from the metric name according to -insert.metricNameExtractRegex.
+//
+// Extracted labels override labels with the same names.
+// The returned labels are valid until the next extractMetricNameLabels call.
+func (ctx *InsertCtx) extractMetricNameLabels(labels []prompb.Label) []prompb.Label {
+	le := metricNameExtractor
+	if le == nil {
+		return labels
+	}
+	name := getMetricName(labels)
+	if len(name) == 0 {
+		return labels
+	}
+	el := le.extract(name)
+	if el.name == nil {
+		return labels
+	}
+	dst := ctx.extractedLabelsBuf[:0]
+	for _, label := range labels {
+		if len(label.Name) == 0 || string(label.Name) == "__name__" {
+			dst = append(dst, prompb.Label{
+				Name:  label.Name,
+				Value: el.name,
+			})
+			continue
+		}
+		if !hasLabel(el.labels, bytesutil.ToUnsafeString(label.Name)) {
+			dst = append(dst, label)
+		}
+	}
+	dst = append(dst, el.labels...)
+	ctx.extractedLabelsBuf = dst
+	metricNameExtractedRows.Inc()
+	return dst
+}
+
+var metricNameExtractedRows = metrics.NewCounter(`vm_metric_name_extracted_rows_total`)
@@ -0,0 +1,59 @@
+package common
+
+import (
+	"testing"
+
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/prompb"
+)
+
+func TestExtractMetricNameLabels(t *testing.T) {
+	defer func() {
+		metricNameExtractor = nil
+	}()
+	f := func(expr, template string, labels []prompb.Label, resultExpected string) {
+		t.Helper()
+		le, err := newLabelsExtractor(expr, template)
+		if err != nil {
+			t.Fatalf("cannot create extractor: %s", err)
+		}
+		metricNameExtractor = le
+		var ctx InsertCtx
+		for i := 0; i < 2; i++ {
+			// The second call uses cached result.
+			ctx.Reset(0)
+			result := labelsString(ctx.extractMetricNameLabels(labels))
+			if result != resultExpected {
+				t.Fatalf("unexpected labels; got %s; want %s", result, resultExpected)
+			}
+		}
+	}
+	newLabels := func(nameLabel, name string, tags ...string) []prompb.Label {
+		labels := []prompb.Label{{Name: []byte(nameLabel), Value: []byte(name)}}
+		for i := 0; i+1 < len(tags); i += 2 {
+			labels = append(labels, prompb.Label{Name: []byte(tags[i]), Value: []byte(tags[i+1])})
+		}
+		return labels
+	}
+	const expr = `(?P<app>\w+)\.(?P<host>\w+)\.(?P<name>\w+)`
+
+	f(expr, "$name", newLabels("__name__", "myapp.host1.requests"), `__name__=requests,app=myapp,host=host1`)
+	f(expr, "$name", newLabels("", "myapp.host1.requests", "job", "x"), `=requests,job=x,app=myapp,host=host1`)
+
+	// Extracted labels override existing labels
+	f(expr, "$name", newLabels("__name__", "myapp.host1.requests", "host", "h", "job", "x"), `__name__=requests,job=x,app=myapp,host=host1`)
+
+	// Custom template
+	f(expr, "${app}_$name", newLabels("__name__", "myapp.host1.requests"), `__name__=myapp_requests,app=myapp,host=host1`)
+
+	// Unmatched names are left unchanged
+	f(expr, "$name", newLabels("__name__", "myapp.requests"), `__name__=myapp.requests`)
+	f(expr, "$name", newLabels("__name__", "myapp.host1.requests.total"), `__name__=myapp.host1.requests.total`)
+	f(expr, "$name", newLabels("job", "x"), `job=x`)
+
+	// Empty resulting metric name
+	f(`(?P<app>\w+)\.(?P<name>\w*)`, "$name", newLabels("__name__", "myapp."), `__name__=myapp.`)
+
+	if _, err := newLabelsExtractor("foo(", "$name"); err == nil {
+		t.Fatalf("expecting non-nil error for invalid regexp")
+	}
+}
@@ -0,0 +1,61 @@
+package common
+
+import (
+	"flag"
+	"time"
+
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/storage"
+	"github.com/VictoriaMetrics/metrics"
+)
+
+var minFlushRows = flag.Int("insert.minFlushRows", 0, "The minimum number of rows to accumulate from successive batches of a single request before writing them to the storage. "+
+	"This reduces the number of storage writes for streamed requests and long-lived connections, which send rows in small batches. "+
+	"Accumulated rows are written when the request ends or when they wait for more than a second. "+
+	"Unlike -insert.coalesceMaxRows, rows from distinct requests aren't merged. Zero disables accumulating")
+
+// maxDeferredFlushDelay is the maximum duration rows may wait in InsertCtx for reaching -insert.minFlushRows.
+const maxDeferredFlushDelay = time.Second
+
+var deferredFlushes = metrics.NewCounter(`vm_insert_deferred_flushes_total`)
+
+// ResetBatch prepares ctx for adding the next batch of rowsLen rows from the same request.
+//
+// Unlike Reset, rows deferred by FlushBufsBatched are kept in ctx.
+func (ctx *InsertCtx) ResetBatch(rowsLen int) {
+	if ctx.deferredSince.IsZero() {
+		ctx.Reset(rowsLen)
+		return
+	}
+	ctx.Labels = ctx.Labels[:0]
+	if n := len(ctx.mrs) + rowsLen - cap(ctx.mrs); n > 0 {
+		ctx.mrs = append(ctx.mrs[:cap(ctx.mrs)], make([]storage.MetricRow, n)...)[:len(ctx.mrs)]
+	}
+}
+
+// FlushBufsBatched flushes buffered rows to the underlying storage if there are at least -insert.minFlushRows rows.
+//
+// Otherwise the rows are kept in ctx until the next FlushBufsBatched call, so they are written together
+// with the rows from the next batch of the same request. Call ResetBatch instead of Reset before adding the next batch.
+// Call FlushDeferred when the request ends.
+func (ctx *InsertCtx) FlushBufsBatched() error {
+	if *minFlushRows > 0 && len(ctx.mrs) < *minFlushRows {
+		if ctx.deferredSince.IsZero() {
+			ctx.deferredSince = time.Now()
+		}
+		if time.Since(ctx.deferredSince) < maxDeferredFlushDelay {
+			deferredFlushes.Inc()
+			return nil
+		}
+	}
+	ctx.deferredSince = time.Time{}
+	return ctx.FlushBufs()
+}
+
+// FlushDeferred flushes rows deferred by FlushBufsBatched to the underlying storage.
+func (ctx *InsertCtx) FlushDeferred() error {
+	if ctx.deferredSince.IsZero() {
+		return nil
+	}
+	ctx.deferredSince = time.Time{}
+	return ctx.FlushBufs()
+}
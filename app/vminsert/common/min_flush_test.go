@@ -0,0 +1,98 @@
+package common
+
+import (
+	"testing"
+	"time"
+
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/prompb"
+)
+
+func TestInsertCtxFlushBufsBatched(t *testing.T) {
+	defer func(n int) {
+		*minFlushRows = n
+	}(*minFlushRows)
+
+	f := func(minRows int, batches []int, flushesExpected int) {
+		t.Helper()
+		*minFlushRows = minRows
+		tsn := startTestStorageNode()
+		defer stopTestStorageNode()
+
+		var ctx InsertCtx
+		rowsTotal := 0
+		for _, n := range batches {
+			ctx.ResetBatch(n)
+			for i := 0; i < n; i++ {
+				ctx.WriteDataPoint(nil, []prompb.Label{{Name: []byte("__name__"), Value: []byte("foo")}}, int64(rowsTotal), 1)
+				rowsTotal++
+			}
+			if err := ctx.FlushBufsBatched(); err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+		}
+		if err := ctx.FlushDeferred(); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if flushes := tsn.requestsCount(); flushes != flushesExpected {
+			t.Fatalf("unexpected number of flushes; got %d; want %d", flushes, flushesExpected)
+		}
+		mrs := tsn.rows()
+		if len(mrs) != rowsTotal {
+			t.Fatalf("unexpected number of written rows; got %d; want %d", len(mrs), rowsTotal)
+		}
+		for i := range mrs {
+			if mrs[i].Timestamp != int64(i) {
+				t.Fatalf("unexpected timestamp for row #%d; got %d", i, mrs[i].Timestamp)
+			}
+		}
+	}
+
+	// Accumulating is disabled
+	f(0, []int{1, 2, 3}, 3)
+
+	// Small batches are accumulated
+	f(5, []int{1, 2, 3}, 1)
+	f(5, []int{1, 2, 3, 1, 1}, 2)
+
+	// Big batches are flushed immediately
+	f(5, []int{10, 10}, 2)
+
+	// The rest of rows is flushed by FlushDeferred
+	f(5, []int{10, 1}, 2)
+}
+
+func TestInsertCtxFlushBufsBatchedMaxDelay(t *testing.T) {
+	defer func(n int) {
+		*minFlushRows = n
+	}(*minFlushRows)
+	*minFlushRows = 100
+
+	tsn := startTestStorageNode()
+	defer stopTestStorageNode()
+
+	var ctx InsertCtx
+	ctx.ResetBatch(1)
+	ctx.WriteDataPoint(nil, []prompb.Label{{Name: []byte("__name__"), Value: []byte("foo")}}, 1, 1)
+	if err := ctx.FlushBufsBatched(); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if tsn.requestsCount() != 0 {
+		t.Fatalf("expecting deferred flush")
+	}
+
+	// Rows waiting for too long are flushed on the next call.
+	ctx.deferredSince = time.Now().Add(-2 * maxDeferredFlushDelay)
+	ctx.ResetBatch(0)
+	if err := ctx.FlushBufsBatched(); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if flushes, rows := tsn.requestsCount(), len(tsn.rows()); flushes != 1 || rows != 1 {
+		t.Fatalf("unexpected flushes; got %d flushes with %d rows; want 1 flush with 1 row", flushes, rows)
+	}
+	if err := ctx.FlushDeferred(); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if tsn.requestsCount() != 1 {
+		t.Fatalf("unexpected flush by FlushDeferred without deferred rows")
+	}
+}
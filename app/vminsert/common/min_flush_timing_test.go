@@ -0,0 +1,50 @@
+package common
+
+import (
+	"fmt"
+	"testing"
+)
+
+func BenchmarkInsertCtxFlushBufsBatched(b *testing.B) {
+	for _, minRows := range []int{0, 1000} {
+		b.Run(fmt.Sprintf("minFlushRows=%d", minRows), func(b *testing.B) {
+			benchmarkInsertCtxFlushBufsBatched(b, minRows)
+		})
+	}
+}
+
+func benchmarkInsertCtxFlushBufsBatched(b *testing.B, minRows int) {
+	defer func(n int) {
+		*minFlushRows = n
+	}(*minFlushRows)
+	*minFlushRows = minRows
+
+	tsn := startTestStorageNode()
+	defer stopTestStorageNode()
+
+	// A streamed request with 10000 rows arriving in batches of 10 rows.
+	const batches = 1000
+	const rowsPerBatch = 10
+	b.ReportAllocs()
+	b.SetBytes(batches * rowsPerBatch)
+	var ic InsertCtx
+	for i := 0; i < b.N; i++ {
+		ic.Reset(0)
+		for j := 0; j < batches; j++ {
+			ic.ResetBatch(rowsPerBatch)
+			for k := 0; k < rowsPerBatch; k++ {
+				ic.Labels = ic.Labels[:0]
+				ic.AddLabel("", "cpu.usage")
+				ic.AddLabel("host", "host-1")
+				ic.WriteDataPointInterned(nil, ic.Labels, int64(k), float64(k))
+			}
+			if err := ic.FlushBufsBatched(); err != nil {
+				b.Fatalf("unexpected error: %s", err)
+			}
+		}
+		if err := ic.FlushDeferred(); err != nil {
+			b.Fatalf("unexpected error: %s", err)
+		}
+	}
+	b.ReportMetric(float64(tsn.requestsCount())/float64(b.N), "flushes/op")
+}
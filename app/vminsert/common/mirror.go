@@ -0,0 +1,318 @@
+package common
+
+import (
+	"bytes"
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/encoding"
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/logger"
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/storage"
+	"github.com/VictoriaMetrics/metrics"
+	"github.com/golang/snappy"
+)
+
+var (
+	mirrorRemoteWrite = flag.String("mirror.remoteWrite", "", "URL of Prometheus remote write endpoint to send a copy of all the ingested rows to, "+
+		"for instance, http://old-system:8428/api/v1/write. This allows dual-writing during gradual migrations. "+
+		"Rows are dropped if the endpoint doesn't accept them or if it cannot keep up with ingestion. Doesn't work if empty")
+	mirrorFlushInterval = flag.Duration("mirror.flushInterval", time.Second, "The maximum duration rows are buffered before being sent to -mirror.remoteWrite")
+	mirrorSendTimeout   = flag.Duration("mirror.sendTimeout", 30*time.Second, "Timeout for sending buffered rows to -mirror.remoteWrite")
+)
+
+// maxMirrorBufSize is the size of marshaled rows buffered for -mirror.remoteWrite,
+// which triggers sending the rows before -mirror.flushInterval.
+const maxMirrorBufSize = 4 * 1024 * 1024
+
+// maxPendingMirrorBufs is the maximum number of full buffers waiting to be sent to -mirror.remoteWrite.
+//
+// Rows are dropped if the endpoint is too slow to keep up with ingestion, so it cannot slow down ingestion.
+const maxPendingMirrorBufs = 4
+
+// InitMirror starts sending a copy of ingested rows to -mirror.remoteWrite.
+//
+// InitMirror must be called after flag.Parse call.
+func InitMirror() {
+	if len(*mirrorRemoteWrite) == 0 {
+		return
+	}
+	m := newMirror(*mirrorRemoteWrite, *mirrorFlushInterval, *mirrorSendTimeout)
+	logger.Infof("mirroring ingested rows to -mirror.remoteWrite=%q", *mirrorRemoteWrite)
+	mirrorLock.Lock()
+	globalMirror = m
+	mirrorLock.Unlock()
+}
+
+// StopMirror sends buffered rows to -mirror.remoteWrite and stops mirroring.
+func StopMirror() {
+	mirrorLock.Lock()
+	m := globalMirror
+	globalMirror = nil
+	mirrorLock.Unlock()
+	if m == nil {
+		return
+	}
+	m.stop()
+}
+
+var (
+	mirrorLock   sync.Mutex
+	globalMirror *mirror
+)
+
+// mirrorRows sends a copy of mrs to -mirror.remoteWrite if it is set.
+func mirrorRows(mrs []storage.MetricRow) {
+	mirrorLock.Lock()
+	m := globalMirror
+	mirrorLock.Unlock()
+	if m == nil {
+		return
+	}
+	m.addRows(mrs)
+}
+
+// mirror buffers rows in Prometheus remote write format and sends them to remote write endpoint.
+//
+// Mirroring errors aren't returned to the caller, since the mirror is a secondary destination.
+type mirror struct {
+	url    string
+	client *http.Client
+
+	mu        sync.Mutex
+	buf       []byte
+	rows      int
+	tsBuf     []byte
+	labelBuf  []byte
+	sampleBuf []byte
+
+	// pendingBufs contains full buffers, which are sent to the endpoint by the flusher goroutine.
+	pendingBufs chan *mirrorBuf
+
+	stopCh chan struct{}
+	wg     sync.WaitGroup
+}
+
+func newMirror(url string, flushInterval, sendTimeout time.Duration) *mirror {
+	m := &mirror{
+		url: url,
+		client: &http.Client{
+			Timeout: sendTimeout,
+		},
+		pendingBufs: make(chan *mirrorBuf, maxPendingMirrorBufs),
+		stopCh:      make(chan struct{}),
+	}
+	m.wg.Add(1)
+	go func() {
+		defer m.wg.Done()
+		m.flusher(flushInterval)
+	}()
+	return m
+}
+
+func (m *mirror) flusher(flushInterval time.Duration) {
+	t := time.NewTicker(flushInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-m.stopCh:
+			return
+		case mb := <-m.pendingBufs:
+			m.send(mb)
+		case <-t.C:
+			m.flush()
+		}
+	}
+}
+
+func (m *mirror) stop() {
+	close(m.stopCh)
+	m.wg.Wait()
+	for {
+		select {
+		case mb := <-m.pendingBufs:
+			m.send(mb)
+		default:
+			m.flush()
+			return
+		}
+	}
+}
+
+// mirrorBuf contains marshaled rows for sending to the endpoint in a single request.
+type mirrorBuf struct {
+	buf  []byte
+	rows int
+}
+
+// addRows adds mrs to m buffer.
+//
+// The buffer is passed to the flusher goroutine when it becomes big enough. It is dropped
+// if the flusher goroutine lags behind by maxPendingMirrorBufs buffers, so addRows never waits for the endpoint.
+func (m *mirror) addRows(mrs []storage.MetricRow) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i := range mrs {
+		m.buf = m.marshalTimeSeries(m.buf, &mrs[i])
+	}
+	m.rows += len(mrs)
+	if len(m.buf) < maxMirrorBufSize {
+		return
+	}
+	mb := m.takeBufLocked()
+	select {
+	case m.pendingBufs <- mb:
+	default:
+		mirrorRowsDropped.Add(mb.rows)
+	}
+}
+
+// takeBufLocked returns buffered rows and resets the buffer. m.mu must be locked by the caller.
+func (m *mirror) takeBufLocked() *mirrorBuf {
+	mb := &mirrorBuf{
+		buf:  m.buf,
+		rows: m.rows,
+	}
+	m.buf = nil
+	m.rows = 0
+	return mb
+}
+
+// marshalTimeSeries appends mr as TimeSeries field of Prometheus WriteRequest to dst and returns the result.
+//
+// Concatenated TimeSeries fields form valid WriteRequest.
+// See https://github.com/prometheus/prometheus/blob/master/prompb/remote.proto
+func (m *mirror) marshalTimeSeries(dst []byte, mr *storage.MetricRow) []byte {
+	ts := m.tsBuf[:0]
+	src := mr.MetricNameRaw
+	for len(src) > 0 {
+		name, tail, ok := unmarshalMetricNameRawBytes(src)
+		if !ok {
+			break
+		}
+		value, tail, ok := unmarshalMetricNameRawBytes(tail)
+		if !ok {
+			break
+		}
+		src = tail
+		if len(name) == 0 {
+			name = metricNameLabel
+		}
+		label := m.labelBuf[:0]
+		label = appendPBBytesField(label, 1, name)
+		label = appendPBBytesField(label, 2, value)
+		ts = appendPBBytesField(ts, 1, label)
+		m.labelBuf = label
+	}
+	sample := m.sampleBuf[:0]
+	sample = appendPBTag(sample, 1, pbWireTypeFixed64)
+	var b [8]byte
+	binary.LittleEndian.PutUint64(b[:], math.Float64bits(mr.Value))
+	sample = append(sample, b[:]...)
+	sample = appendPBTag(sample, 2, pbWireTypeVarint)
+	sample = appendPBVarint(sample, uint64(mr.Timestamp))
+	ts = appendPBBytesField(ts, 2, sample)
+	m.sampleBuf = sample
+	m.tsBuf = ts
+	return appendPBBytesField(dst, 1, ts)
+}
+
+var metricNameLabel = []byte("__name__")
+
+// unmarshalMetricNameRawBytes unmarshals a single byte slice encoded by storage.MarshalMetricNameRaw from src.
+func unmarshalMetricNameRawBytes(src []byte) ([]byte, []byte, bool) {
+	if len(src) < 2 {
+		return nil, src, false
+	}
+	n := int(encoding.UnmarshalUint16(src))
+	src = src[2:]
+	if len(src) < n {
+		return nil, src, false
+	}
+	return src[:n], src[n:], true
+}
+
+// flush sends buffered rows to the endpoint.
+//
+// It must be called only by the flusher goroutine or after the flusher goroutine is stopped.
+func (m *mirror) flush() {
+	m.mu.Lock()
+	mb := m.takeBufLocked()
+	m.mu.Unlock()
+	m.send(mb)
+}
+
+// send sends rows from mb to the endpoint.
+//
+// The rows are dropped if the endpoint doesn't accept them.
+func (m *mirror) send(mb *mirrorBuf) {
+	if mb.rows == 0 {
+		return
+	}
+	if err := m.sendRequest(snappy.Encode(nil, mb.buf)); err != nil {
+		mirrorSendErrors.Inc()
+		mirrorRowsDropped.Add(mb.rows)
+		logger.Errorf("cannot send %d rows to -mirror.remoteWrite=%q: %s", mb.rows, m.url, err)
+		return
+	}
+	mirrorRowsSent.Add(mb.rows)
+}
+
+func (m *mirror) sendRequest(data []byte) error {
+	mirrorSendRequests.Inc()
+	req, err := http.NewRequest("POST", m.url, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Encoding", "snappy")
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+	resp, err := m.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	if resp.StatusCode/100 != 2 {
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("unexpected response code %d from %q: %q", resp.StatusCode, m.url, body)
+	}
+	_, _ = io.Copy(ioutil.Discard, resp.Body)
+	return nil
+}
+
+var (
+	mirrorRowsSent     = metrics.NewCounter(`vm_mirror_rows_sent_total`)
+	mirrorRowsDropped  = metrics.NewCounter(`vm_mirror_rows_dropped_total`)
+	mirrorSendRequests = metrics.NewCounter(`vm_mirror_send_requests_total`)
+	mirrorSendErrors   = metrics.NewCounter(`vm_mirror_send_errors_total`)
+)
+
+const (
+	pbWireTypeVarint  = 0
+	pbWireTypeFixed64 = 1
+	pbWireTypeBytes   = 2
+)
+
+func appendPBTag(dst []byte, num, wireType uint64) []byte {
+	return appendPBVarint(dst, num<<3|wireType)
+}
+
+func appendPBVarint(dst []byte, v uint64) []byte {
+	var b [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(b[:], v)
+	return append(dst, b[:n]...)
+}
+
+func appendPBBytesField(dst []byte, num uint64, b []byte) []byte {
+	dst = appendPBTag(dst, num, pbWireTypeBytes)
+	dst = appendPBVarint(dst, uint64(len(b)))
+	return append(dst, b...)
+}
@@ -0,0 +1,145 @@
+package common
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/prompb"
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/storage"
+	"github.com/golang/snappy"
+)
+
+func TestMirror(t *testing.T) {
+	reqs := make(chan *prompb.WriteRequest, 1)
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Content-Encoding") != "snappy" {
+			t.Errorf("unexpected Content-Encoding: %q", r.Header.Get("Content-Encoding"))
+		}
+		data, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			t.Errorf("cannot read request: %s", err)
+		}
+		data, err = snappy.Decode(nil, data)
+		if err != nil {
+			t.Errorf("cannot decode request: %s", err)
+		}
+		var wr prompb.WriteRequest
+		if err := wr.Unmarshal(data); err != nil {
+			t.Errorf("cannot unmarshal request: %s", err)
+		}
+		reqs <- &wr
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer s.Close()
+
+	m := newMirror(s.URL, time.Hour, time.Second)
+	labels := []prompb.Label{
+		{Name: []byte("__name__"), Value: []byte("foo")},
+		{Name: []byte("job"), Value: []byte("x")},
+	}
+	mrs := []storage.MetricRow{
+		{
+			MetricNameRaw: storage.MarshalMetricNameRaw(nil, labels),
+			Timestamp:     1234,
+			Value:         -1.5,
+		},
+		{
+			MetricNameRaw: storage.MarshalMetricNameRaw(nil, labels[1:]),
+			Timestamp:     1235,
+			Value:         2,
+		},
+	}
+	m.addRows(mrs)
+	m.stop()
+
+	wr := <-reqs
+	if len(wr.Timeseries) != 2 {
+		t.Fatalf("unexpected number of time series; got %d; want 2", len(wr.Timeseries))
+	}
+	f := func(ts *prompb.TimeSeries, labelsExpected string, timestampExpected int64, valueExpected float64) {
+		t.Helper()
+		if s := labelsString(ts.Labels); s != labelsExpected {
+			t.Fatalf("unexpected labels; got %q; want %q", s, labelsExpected)
+		}
+		if len(ts.Samples) != 1 {
+			t.Fatalf("unexpected number of samples; got %d; want 1", len(ts.Samples))
+		}
+		sample := ts.Samples[0]
+		if sample.Timestamp != timestampExpected || sample.Value != valueExpected {
+			t.Fatalf("unexpected sample; got %+v; want {Value:%v Timestamp:%d}", sample, valueExpected, timestampExpected)
+		}
+	}
+	f(&wr.Timeseries[0], "__name__=foo,job=x", 1234, -1.5)
+	f(&wr.Timeseries[1], "job=x", 1235, 2)
+}
+
+func TestMirrorSlowEndpoint(t *testing.T) {
+	unblock := make(chan struct{})
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-unblock
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer s.Close()
+
+	m := newMirror(s.URL, time.Hour, time.Minute)
+	mr := storage.MetricRow{
+		MetricNameRaw: storage.MarshalMetricNameRaw(nil, []prompb.Label{{Name: []byte("__name__"), Value: []byte("foo")}}),
+		Value:         1,
+	}
+	rowsPerBuf := maxMirrorBufSize/len(m.marshalTimeSeries(nil, &mr)) + 1
+	mrs := make([]storage.MetricRow, rowsPerBuf)
+	for i := range mrs {
+		mrs[i] = mr
+	}
+
+	// Fill up more buffers than the flusher goroutine may hold while it waits for the endpoint.
+	rowsDropped := mirrorRowsDropped.Get()
+	startTime := time.Now()
+	for i := 0; i < maxPendingMirrorBufs+3; i++ {
+		m.addRows(mrs)
+	}
+	if d := time.Since(startTime); d > 10*time.Second {
+		t.Fatalf("addRows mustn't wait for the endpoint; it took %s", d)
+	}
+	if mirrorRowsDropped.Get() == rowsDropped {
+		t.Fatalf("expecting dropped rows when the endpoint cannot keep up with ingestion")
+	}
+	close(unblock)
+	m.stop()
+}
+
+func TestInsertCtxStorageNode(t *testing.T) {
+	tsn := startTestStorageNode()
+	defer stopTestStorageNode()
+
+	var ctx InsertCtx
+	ctx.Reset(1)
+	ctx.AddLabel("", "foo")
+	ctx.AddLabel("job", "x")
+	ctx.WriteDataPoint(nil, ctx.Labels, 1234, 42)
+	if err := ctx.FlushBufs(); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if n := tsn.syncRequestsCount(); n != 0 {
+		t.Fatalf("unexpected number of sync requests after FlushBufs; got %d; want 0", n)
+	}
+
+	// Storage nodes must persist rows flushed with FlushBufsSync before responding.
+	if err := ctx.FlushBufsSync(); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if n := tsn.syncRequestsCount(); n != 1 {
+		t.Fatalf("unexpected number of sync requests after FlushBufsSync; got %d; want 1", n)
+	}
+	mrs := tsn.rows()
+	if len(mrs) != 2 {
+		t.Fatalf("unexpected number of rows sent to storage node; got %d; want 2", len(mrs))
+	}
+	mr := &mrs[0]
+	if mr.Timestamp != 1234 || mr.Value != 42 {
+		t.Fatalf("unexpected row sent to storage node; got %+v", mr)
+	}
+}
@@ -0,0 +1,140 @@
+package common
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/VictoriaMetrics/metrics"
+)
+
+// Formats of files uploaded via multipart/form-data requests.
+const (
+	FormatPrometheus  = "prometheus"
+	FormatOpenMetrics = "openmetrics"
+	FormatInflux      = "influx"
+)
+
+// formatsByExtension maps file name extensions to file formats.
+var formatsByExtension = map[string]string{
+	".prom":   FormatPrometheus,
+	".txt":    FormatPrometheus,
+	".om":     FormatOpenMetrics,
+	".lp":     FormatInflux,
+	".influx": FormatInflux,
+}
+
+// formatFieldName is the name of the form field with the format for the subsequent files without known extension.
+const formatFieldName = "format"
+
+// maxFormatFieldLen is the maximum length of the format form field value.
+const maxFormatFieldLen = 64
+
+// MultipartFile is a file from multipart/form-data request.
+type MultipartFile struct {
+	// Name is the file name from the request.
+	Name string
+
+	// Format is the format of the file. See Format* constants.
+	Format string
+
+	// R contains the decoded file contents.
+	R io.Reader
+}
+
+// IsMultipartRequest returns true if req body has multipart/form-data content type.
+func IsMultipartRequest(req *http.Request) bool {
+	mediaType, _, err := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	return err == nil && mediaType == "multipart/form-data"
+}
+
+// ForEachMultipartFile calls f for every file in multipart/form-data req body in a streaming manner.
+//
+// Files are decoded according to Content-Encoding header of their parts. Files with `.gz` extension are decoded as gzip
+// if the header is missing. The file format is inferred from the file name extension. Files with unknown extensions
+// get the format from the preceding `format` form field or defaultFormat if the field is missing.
+// Other form fields are ignored. f must read the file contents from MultipartFile.R before returning.
+func ForEachMultipartFile(req *http.Request, defaultFormat string, f func(mf *MultipartFile) error) error {
+	_, params, err := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	if err != nil {
+		return fmt.Errorf("cannot parse Content-Type header: %s", err)
+	}
+	boundary := params["boundary"]
+	if len(boundary) == 0 {
+		return fmt.Errorf("missing boundary in Content-Type header for multipart/form-data request")
+	}
+	mr := multipart.NewReader(NewReadTimeoutReader(req.Body), boundary)
+	format := defaultFormat
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("cannot read multipart/form-data request: %s", err)
+		}
+		name := part.FileName()
+		if len(name) == 0 {
+			if part.FormName() == formatFieldName {
+				if format, err = readFormatField(part); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+		if err := processMultipartFile(part, name, format, f); err != nil {
+			return WrapParseError(err, "cannot import file %q: %s", name, err)
+		}
+		multipartFiles.Inc()
+	}
+}
+
+func processMultipartFile(part *multipart.Part, name, format string, f func(mf *MultipartFile) error) error {
+	h := http.Header(part.Header)
+	baseName := name
+	if strings.HasSuffix(name, ".gz") {
+		baseName = strings.TrimSuffix(name, ".gz")
+		if len(h.Get("Content-Encoding")) == 0 {
+			h = http.Header{
+				"Content-Encoding": []string{"gzip"},
+			}
+		}
+	}
+	if v, ok := formatsByExtension[path.Ext(baseName)]; ok {
+		format = v
+	}
+	cd, err := GetHeaderContentDecoder(part, h)
+	if err != nil {
+		return fmt.Errorf("cannot read encoded data: %s", err)
+	}
+	defer PutContentDecoder(cd)
+	mf := &MultipartFile{
+		Name:   name,
+		Format: format,
+		R:      cd,
+	}
+	return f(mf)
+}
+
+// readFormatField reads the value of the format form field from part.
+func readFormatField(part *multipart.Part) (string, error) {
+	data, err := ioutil.ReadAll(io.LimitReader(part, maxFormatFieldLen+1))
+	if err != nil {
+		return "", fmt.Errorf("cannot read %q form field: %s", formatFieldName, err)
+	}
+	format := strings.TrimSpace(string(data))
+	switch format {
+	case FormatPrometheus, FormatOpenMetrics, FormatInflux:
+		return format, nil
+	default:
+		return "", fmt.Errorf("unsupported %q form field value %q; supported values: %s, %s, %s",
+			formatFieldName, format, FormatPrometheus, FormatOpenMetrics, FormatInflux)
+	}
+}
+
+var multipartFiles = metrics.NewCounter(`vm_multipart_import_files_total`)
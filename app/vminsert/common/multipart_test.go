@@ -0,0 +1,135 @@
+package common
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http/httptest"
+	"net/textproto"
+	"reflect"
+	"testing"
+)
+
+func TestIsMultipartRequest(t *testing.T) {
+	f := func(contentType string, resultExpected bool) {
+		t.Helper()
+		req := httptest.NewRequest("POST", "/api/v1/import/prometheus", nil)
+		req.Header.Set("Content-Type", contentType)
+		if result := IsMultipartRequest(req); result != resultExpected {
+			t.Fatalf("unexpected result for %q; got %v; want %v", contentType, result, resultExpected)
+		}
+	}
+	f("", false)
+	f("text/plain", false)
+	f("multipart/mixed; boundary=foo", false)
+	f("multipart/form-data; boundary=foo", true)
+	f("Multipart/Form-Data; boundary=foo", true)
+}
+
+func TestForEachMultipartFile(t *testing.T) {
+	type file struct {
+		Name   string
+		Format string
+		Data   string
+	}
+	gzipData := func(s string) []byte {
+		var bb bytes.Buffer
+		zw := gzip.NewWriter(&bb)
+		if _, err := zw.Write([]byte(s)); err != nil {
+			t.Fatalf("cannot compress data: %s", err)
+		}
+		if err := zw.Close(); err != nil {
+			t.Fatalf("cannot close gzip writer: %s", err)
+		}
+		return bb.Bytes()
+	}
+
+	var bb bytes.Buffer
+	mw := multipart.NewWriter(&bb)
+	writeFile := func(name string, data []byte, contentEncoding string) {
+		h := make(textproto.MIMEHeader)
+		h.Set("Content-Disposition", `form-data; name="file"; filename="`+name+`"`)
+		if len(contentEncoding) > 0 {
+			h.Set("Content-Encoding", contentEncoding)
+		}
+		w, err := mw.CreatePart(h)
+		if err != nil {
+			t.Fatalf("cannot create part: %s", err)
+		}
+		if _, err := w.Write(data); err != nil {
+			t.Fatalf("cannot write part: %s", err)
+		}
+	}
+	writeField := func(name, value string) {
+		if err := mw.WriteField(name, value); err != nil {
+			t.Fatalf("cannot write field: %s", err)
+		}
+	}
+	writeFile("a.prom", []byte("foo 1\n"), "")
+	writeFile("b", []byte("bar 2\n"), "")
+	writeField("comment", "ignored")
+	writeField("format", "influx")
+	writeFile("c.lp.gz", gzipData("cpu value=1\n"), "")
+	writeFile("d.data", gzipData("mem value=2\n"), "gzip")
+	writeFile("e.om", []byte("baz 3\n# EOF\n"), "")
+	if err := mw.Close(); err != nil {
+		t.Fatalf("cannot close multipart writer: %s", err)
+	}
+
+	req := httptest.NewRequest("POST", "/api/v1/import/prometheus", &bb)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	var files []file
+	err := ForEachMultipartFile(req, FormatPrometheus, func(mf *MultipartFile) error {
+		data, err := ioutil.ReadAll(mf.R)
+		if err != nil {
+			return err
+		}
+		files = append(files, file{
+			Name:   mf.Name,
+			Format: mf.Format,
+			Data:   string(data),
+		})
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	filesExpected := []file{
+		{Name: "a.prom", Format: FormatPrometheus, Data: "foo 1\n"},
+		{Name: "b", Format: FormatPrometheus, Data: "bar 2\n"},
+		{Name: "c.lp.gz", Format: FormatInflux, Data: "cpu value=1\n"},
+		{Name: "d.data", Format: FormatInflux, Data: "mem value=2\n"},
+		{Name: "e.om", Format: FormatOpenMetrics, Data: "baz 3\n# EOF\n"},
+	}
+	if !reflect.DeepEqual(files, filesExpected) {
+		t.Fatalf("unexpected files;\ngot\n%+v\nwant\n%+v", files, filesExpected)
+	}
+}
+
+func TestForEachMultipartFileFailure(t *testing.T) {
+	f := func(contentType, body string) {
+		t.Helper()
+		req := httptest.NewRequest("POST", "/api/v1/import/prometheus", bytes.NewBufferString(body))
+		req.Header.Set("Content-Type", contentType)
+		err := ForEachMultipartFile(req, FormatPrometheus, func(mf *MultipartFile) error {
+			_, err := ioutil.ReadAll(mf.R)
+			return err
+		})
+		if err == nil {
+			t.Fatalf("expecting non-nil error")
+		}
+	}
+
+	// Missing boundary
+	f("multipart/form-data", "")
+
+	// Truncated body
+	f("multipart/form-data; boundary=foo", "--foo\r\nContent-Disposition: form-data; name=\"file\"; filename=\"a.prom\"\r\n\r\nfoo 1\n")
+
+	// Unsupported format
+	f("multipart/form-data; boundary=foo", "--foo\r\nContent-Disposition: form-data; name=\"format\"\r\n\r\ncsv\r\n--foo--\r\n")
+
+	// Invalid gzip data
+	f("multipart/form-data; boundary=foo", "--foo\r\nContent-Disposition: form-data; name=\"file\"; filename=\"a.prom.gz\"\r\n\r\nfoo 1\n\r\n--foo--\r\n")
+}
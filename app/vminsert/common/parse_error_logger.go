@@ -0,0 +1,118 @@
+package common
+
+import (
+	"flag"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/logger"
+	"github.com/VictoriaMetrics/metrics"
+)
+
+var parseErrorsLogRate = flag.Float64("insert.parseErrorsLogRate", 0, "The maximum number of parse errors per second to log per protocol together with the truncated payload. "+
+	"This gives visibility into broken clients without flooding the log. Logging of parse errors is disabled if zero")
+
+// maxLoggedPayloadLen is the maximum number of payload bytes logged by ParseErrorLogger.
+const maxLoggedPayloadLen = 512
+
+// ParseErrorLogger logs a sample of parse errors for a single protocol.
+//
+// The number of logged errors is limited by -insert.parseErrorsLogRate with a token bucket.
+type ParseErrorLogger struct {
+	protocol string
+	stats    *protocolStats
+
+	rateLimiter
+
+	loggedErrors     *metrics.Counter
+	suppressedErrors *metrics.Counter
+}
+
+// NewParseErrorLogger returns new ParseErrorLogger for the given protocol.
+//
+// It must be called only once per protocol, usually during package initialization.
+func NewParseErrorLogger(protocol string) *ParseErrorLogger {
+	return &ParseErrorLogger{
+		protocol:         protocol,
+		stats:            getProtocolStats(protocol),
+		loggedErrors:     metrics.NewCounter(fmt.Sprintf(`vm_parse_errors_logged_total{protocol=%q}`, protocol)),
+		suppressedErrors: metrics.NewCounter(fmt.Sprintf(`vm_parse_errors_log_suppressed_total{protocol=%q}`, protocol)),
+	}
+}
+
+// Log logs err together with the truncated payload if the -insert.parseErrorsLogRate limit isn't exceeded.
+func (pel *ParseErrorLogger) Log(err error, payload []byte) {
+	pel.LogWithRequestID(err, payload, "")
+}
+
+// LogWithRequestID is like Log, but also logs the given requestID if it isn't empty.
+//
+// See WithRequestID.
+//
+// The error is registered in debug stats regardless of -insert.parseErrorsLogRate. See ServeDebug.
+func (pel *ParseErrorLogger) LogWithRequestID(err error, payload []byte, requestID string) {
+	if pel.stats != nil {
+		pel.stats.addParseError(time.Now(), err, requestID)
+	}
+	rate := *parseErrorsLogRate
+	if rate <= 0 {
+		return
+	}
+	ok, suppressed := pel.allow(time.Now(), rate)
+	if !ok {
+		pel.suppressedErrors.Inc()
+		return
+	}
+	pel.loggedErrors.Inc()
+	truncated := ""
+	if len(payload) > maxLoggedPayloadLen {
+		truncated = fmt.Sprintf(" (truncated from %d bytes)", len(payload))
+		payload = payload[:maxLoggedPayloadLen]
+	}
+	requestIDStr := ""
+	if len(requestID) > 0 {
+		requestIDStr = fmt.Sprintf(" (request_id=%s)", requestID)
+	}
+	logger.Errorf("cannot parse %s data%s: %s; payload%s: %q; %d parse errors have been suppressed since the previous message; see -insert.parseErrorsLogRate",
+		pel.protocol, requestIDStr, err, truncated, payload, suppressed)
+}
+
+// rateLimiter limits the rate of events with token bucket algorithm.
+type rateLimiter struct {
+	mu         sync.Mutex
+	tokens     float64
+	lastUpdate time.Time
+	suppressed uint64
+}
+
+// allow returns true if an event may be registered at the given time with the given rate limit per second.
+//
+// It also returns the number of events suppressed since the previous allowed event.
+func (rl *rateLimiter) allow(now time.Time, rate float64) (bool, uint64) {
+	burst := rate
+	if burst < 1 {
+		burst = 1
+	}
+
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	if rl.lastUpdate.IsZero() {
+		rl.tokens = burst
+	} else if d := now.Sub(rl.lastUpdate); d > 0 {
+		rl.tokens += d.Seconds() * rate
+		if rl.tokens > burst {
+			rl.tokens = burst
+		}
+	}
+	rl.lastUpdate = now
+	if rl.tokens < 1 {
+		rl.suppressed++
+		return false, 0
+	}
+	rl.tokens--
+	suppressed := rl.suppressed
+	rl.suppressed = 0
+	return true, suppressed
+}
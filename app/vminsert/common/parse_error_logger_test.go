@@ -0,0 +1,56 @@
+package common
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseErrorLoggerAllow(t *testing.T) {
+	var pel ParseErrorLogger
+	start := time.Unix(1000, 0)
+	f := func(d time.Duration, rate float64, okExpected bool, suppressedExpected uint64) {
+		t.Helper()
+		ok, suppressed := pel.allow(start.Add(d), rate)
+		if ok != okExpected {
+			t.Fatalf("unexpected ok at %s; got %v; want %v", d, ok, okExpected)
+		}
+		if suppressed != suppressedExpected {
+			t.Fatalf("unexpected suppressed at %s; got %d; want %d", d, suppressed, suppressedExpected)
+		}
+	}
+
+	// A single error per second
+	f(0, 1, true, 0)
+	f(100*time.Millisecond, 1, false, 0)
+	f(500*time.Millisecond, 1, false, 0)
+	f(1100*time.Millisecond, 1, true, 2)
+	f(1200*time.Millisecond, 1, false, 0)
+
+	// Tokens don't accumulate above the burst
+	f(10*time.Second, 1, true, 1)
+	f(10*time.Second, 1, false, 0)
+
+	// Higher rate allows bursts
+	f(20*time.Second, 3, true, 1)
+	f(20*time.Second, 3, true, 0)
+	f(20*time.Second, 3, true, 0)
+	f(20*time.Second, 3, false, 0)
+
+	// Rates below 1 allow an error per 1/rate seconds
+	f(21*time.Second, 0.5, false, 0)
+	f(22*time.Second, 0.5, true, 2)
+}
+
+func TestParseErrorLoggerLogDisabled(t *testing.T) {
+	defer func(rate float64) {
+		*parseErrorsLogRate = rate
+	}(*parseErrorsLogRate)
+	*parseErrorsLogRate = 0
+
+	// Counters are nil, so Log must return before touching them.
+	var pel ParseErrorLogger
+	pel.Log(ErrBadFormat, []byte("foo"))
+	if !pel.lastUpdate.IsZero() {
+		t.Fatalf("unexpected token bucket update when logging is disabled")
+	}
+}
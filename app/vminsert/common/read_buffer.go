@@ -0,0 +1,65 @@
+package common
+
+import (
+	"flag"
+	"io"
+
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/bytesutil"
+	"github.com/VictoriaMetrics/metrics"
+)
+
+var readBufferSize = flag.Int("insert.readBufferSize", 0, "The size in bytes of the buffer for reading the whole body of OpenTSDB HTTP and OTLP insert requests. "+
+	"Request bodies up to this size are read without buffer growth reallocations, while buffers grown by bigger requests are released after the request. "+
+	"This bounds memory usage per concurrent request. Set it to the typical request size, which is exposed in vm_max_request_size_bytes metric. "+
+	"By default the buffer grows dynamically and keeps its capacity for subsequent requests")
+
+// ReadRequestBody reads the whole r into bb.
+//
+// If -insert.readBufferSize is set, then the data is read into a buffer with the capacity of -insert.readBufferSize,
+// which is allocated only once per bb. The buffer grows only if it becomes full. Call ReleaseReadBuffer
+// when bb is reset in order to release the grown buffer.
+//
+// It returns the number of bytes read.
+func ReadRequestBody(bb *bytesutil.ByteBuffer, r io.Reader) (int64, error) {
+	size := *readBufferSize
+	if size <= 0 {
+		return bb.ReadFrom(r)
+	}
+	b := bb.B
+	if cap(b) < size {
+		b = make([]byte, len(bb.B), size)
+		copy(b, bb.B)
+	}
+	bLen := len(b)
+	offset := bLen
+	b = b[:cap(b)]
+	for {
+		if offset == len(b) {
+			readBufferGrows.Inc()
+			b = append(b, make([]byte, len(b))...)
+			b = b[:cap(b)]
+		}
+		n, err := r.Read(b[offset:])
+		offset += n
+		if err != nil {
+			bb.B = b[:offset]
+			if err == io.EOF {
+				err = nil
+			}
+			return int64(offset - bLen), err
+		}
+	}
+}
+
+// ReleaseReadBuffer releases bb buffer if it has been grown above -insert.readBufferSize by ReadRequestBody.
+//
+// bb is reset.
+func ReleaseReadBuffer(bb *bytesutil.ByteBuffer) {
+	if size := *readBufferSize; size > 0 && cap(bb.B) > size {
+		bb.B = nil
+		return
+	}
+	bb.Reset()
+}
+
+var readBufferGrows = metrics.NewCounter(`vm_insert_read_buffer_grows_total`)
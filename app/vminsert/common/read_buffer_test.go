@@ -0,0 +1,63 @@
+package common
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/bytesutil"
+)
+
+func TestReadRequestBody(t *testing.T) {
+	defer func(n int) {
+		*readBufferSize = n
+	}(*readBufferSize)
+
+	f := func(bufSize int, s string, capExpected int) {
+		t.Helper()
+		*readBufferSize = bufSize
+		var bb bytesutil.ByteBuffer
+		for i := 0; i < 2; i++ {
+			// The second read re-uses the buffer.
+			n, err := ReadRequestBody(&bb, strings.NewReader(s))
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if n != int64(len(s)) {
+				t.Fatalf("unexpected number of bytes read; got %d; want %d", n, len(s))
+			}
+			if string(bb.B) != s {
+				t.Fatalf("unexpected data read; got %q; want %q", bb.B, s)
+			}
+			if capExpected > 0 && cap(bb.B) != capExpected {
+				t.Fatalf("unexpected buffer capacity; got %d; want %d", cap(bb.B), capExpected)
+			}
+			ReleaseReadBuffer(&bb)
+			if len(bb.B) != 0 {
+				t.Fatalf("expecting empty buffer after release")
+			}
+		}
+	}
+
+	// Dynamic buffer
+	f(0, "", 0)
+	f(0, strings.Repeat("x", 10000), 0)
+
+	// The data fits the buffer
+	f(1024, "", 1024)
+	f(1024, "foo", 1024)
+	f(1024, strings.Repeat("x", 1000), 1024)
+
+	// The data exceeds the buffer
+	f(1024, strings.Repeat("x", 3000), 0)
+
+	// The grown buffer is released
+	*readBufferSize = 1024
+	var bb bytesutil.ByteBuffer
+	if _, err := ReadRequestBody(&bb, strings.NewReader(strings.Repeat("x", 3000))); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	ReleaseReadBuffer(&bb)
+	if bb.B != nil {
+		t.Fatalf("expecting released buffer; got buffer with capacity %d", cap(bb.B))
+	}
+}
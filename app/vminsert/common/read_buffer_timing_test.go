@@ -0,0 +1,32 @@
+package common
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/bytesutil"
+)
+
+func BenchmarkReadRequestBody(b *testing.B) {
+	// Medium-sized request
+	data := bytes.Repeat([]byte(`{"metric":"foo","timestamp":1,"value":2,"tags":{"a":"b"}},`), 4*1024)
+	for _, bufSize := range []int{0, 512 * 1024} {
+		b.Run(fmt.Sprintf("readBufferSize_%d", bufSize), func(b *testing.B) {
+			defer func(n int) {
+				*readBufferSize = n
+			}(*readBufferSize)
+			*readBufferSize = bufSize
+			b.ReportAllocs()
+			b.SetBytes(int64(len(data)))
+			for i := 0; i < b.N; i++ {
+				// Use fresh buffer on every iteration in order to measure allocations
+				// for buffers growth in pooled contexts, which had been released by GC.
+				var bb bytesutil.ByteBuffer
+				if _, err := ReadRequestBody(&bb, bytes.NewReader(data)); err != nil {
+					panic(fmt.Errorf("unexpected error: %s", err))
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,63 @@
+package common
+
+import (
+	"errors"
+	"flag"
+	"io"
+	"time"
+
+	"github.com/VictoriaMetrics/metrics"
+)
+
+var readTimeout = flag.Duration("insert.readTimeout", time.Minute, "The maximum duration for reading the whole request body from a client. "+
+	"This protects from slow clients trickling data, including chunked uploads without Content-Length, "+
+	"since such clients occupy concurrent insert slots. The timeout isn't applied to streamed Influx line protocol requests without size limit "+
+	"and to OpenTSDB HTTP requests authorized via -opentsdbhttp.unlimitedStreamAuthKey. "+
+	"Zero disables the timeout")
+
+// ErrReadTimeout is returned when the request body cannot be read in -insert.readTimeout.
+var ErrReadTimeout = errors.New("cannot read request body in -insert.readTimeout")
+
+// NewReadTimeoutReader returns a reader for r, which fails with ErrReadTimeout
+// if reading from r takes more than -insert.readTimeout.
+//
+// A single stalled Read call on the underlying connection is interrupted
+// by the network-level read timeout.
+func NewReadTimeoutReader(r io.Reader) io.Reader {
+	if *readTimeout <= 0 {
+		return r
+	}
+	return &readTimeoutReader{
+		r:        r,
+		deadline: time.Now().Add(*readTimeout),
+	}
+}
+
+type readTimeoutReader struct {
+	r        io.Reader
+	deadline time.Time
+	timedOut bool
+}
+
+func (rtr *readTimeoutReader) Read(p []byte) (int, error) {
+	if rtr.timedOut {
+		return 0, ErrReadTimeout
+	}
+	if time.Now().After(rtr.deadline) {
+		rtr.setTimedOut()
+		return 0, ErrReadTimeout
+	}
+	n, err := rtr.r.Read(p)
+	if err == nil && time.Now().After(rtr.deadline) {
+		rtr.setTimedOut()
+		err = ErrReadTimeout
+	}
+	return n, err
+}
+
+func (rtr *readTimeoutReader) setTimedOut() {
+	rtr.timedOut = true
+	slowClientTimeouts.Inc()
+}
+
+var slowClientTimeouts = metrics.NewCounter(`vm_slow_client_timeouts_total`)
@@ -0,0 +1,63 @@
+package common
+
+import (
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReadTimeoutReader(t *testing.T) {
+	defer func(d time.Duration) {
+		*readTimeout = d
+	}(*readTimeout)
+
+	// Fast reader
+	*readTimeout = time.Second
+	data, err := ioutil.ReadAll(NewReadTimeoutReader(strings.NewReader("foo bar")))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if string(data) != "foo bar" {
+		t.Fatalf("unexpected data; got %q; want %q", data, "foo bar")
+	}
+
+	// Slow reader
+	timeoutsBefore := slowClientTimeouts.Get()
+	*readTimeout = 50 * time.Millisecond
+	r := NewReadTimeoutReader(&slowReader{
+		r:     strings.NewReader("foo bar baz"),
+		delay: 20 * time.Millisecond,
+	})
+	if _, err := ioutil.ReadAll(r); err != ErrReadTimeout {
+		t.Fatalf("unexpected error; got %v; want %v", err, ErrReadTimeout)
+	}
+	if _, err := r.Read(make([]byte, 1)); err != ErrReadTimeout {
+		t.Fatalf("unexpected error on subsequent read; got %v; want %v", err, ErrReadTimeout)
+	}
+	if n := slowClientTimeouts.Get() - timeoutsBefore; n != 1 {
+		t.Fatalf("unexpected number of slow client timeouts; got %d; want 1", n)
+	}
+
+	// Disabled timeout
+	*readTimeout = 0
+	sr := strings.NewReader("foo")
+	if r := NewReadTimeoutReader(sr); r != io.Reader(sr) {
+		t.Fatalf("expecting the original reader when the timeout is disabled")
+	}
+}
+
+// slowReader returns a single byte per Read call after the given delay.
+type slowReader struct {
+	r     io.Reader
+	delay time.Duration
+}
+
+func (sr *slowReader) Read(p []byte) (int, error) {
+	time.Sleep(sr.delay)
+	if len(p) > 1 {
+		p = p[:1]
+	}
+	return sr.r.Read(p)
+}
@@ -0,0 +1,68 @@
+package common
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// RequestIDHeader is the name of HTTP header with request ID.
+//
+// The request ID is read from the request header or generated if missing.
+// It is returned in the response header.
+const RequestIDHeader = "X-Request-ID"
+
+// maxRequestIDLen is the maximum length of request ID accepted from clients.
+const maxRequestIDLen = 128
+
+type requestIDKey struct{}
+
+// WithRequestID returns req with request ID from RequestIDHeader.
+//
+// A new request ID is generated if the header is missing or contains invalid request ID.
+// The request ID is set in RequestIDHeader response header and may be obtained later with GetRequestID.
+func WithRequestID(w http.ResponseWriter, req *http.Request) *http.Request {
+	id := req.Header.Get(RequestIDHeader)
+	if !isValidRequestID(id) {
+		id = newRequestID()
+	}
+	w.Header().Set(RequestIDHeader, id)
+	ctx := context.WithValue(req.Context(), requestIDKey{}, id)
+	return req.WithContext(ctx)
+}
+
+// GetRequestID returns request ID for req set by WithRequestID.
+//
+// An empty string is returned if req has no request ID.
+func GetRequestID(req *http.Request) string {
+	id, _ := req.Context().Value(requestIDKey{}).(string)
+	return id
+}
+
+// isValidRequestID returns true if id may be safely put into logs and response headers.
+func isValidRequestID(id string) bool {
+	if len(id) == 0 || len(id) > maxRequestIDLen {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if c := id[i]; c < 0x21 || c > 0x7e {
+			return false
+		}
+	}
+	return true
+}
+
+func newRequestID() string {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		// Fall back to unique, but predictable request id.
+		return fmt.Sprintf("%x-%x", time.Now().UnixNano(), atomic.AddUint64(&requestIDFallbackCounter, 1))
+	}
+	return hex.EncodeToString(b[:])
+}
+
+var requestIDFallbackCounter uint64
@@ -0,0 +1,62 @@
+package common
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestWithRequestID(t *testing.T) {
+	f := func(header string, keepExpected bool) {
+		t.Helper()
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest("POST", "/api/put", nil)
+		if len(header) > 0 {
+			req.Header.Set(RequestIDHeader, header)
+		}
+		req = WithRequestID(w, req)
+		id := GetRequestID(req)
+		if keepExpected && id != header {
+			t.Fatalf("unexpected request id; got %q; want %q", id, header)
+		}
+		if !keepExpected {
+			if id == header {
+				t.Fatalf("expecting new request id instead of %q", header)
+			}
+			if !isValidRequestID(id) {
+				t.Fatalf("invalid generated request id %q", id)
+			}
+		}
+		if respID := w.Header().Get(RequestIDHeader); respID != id {
+			t.Fatalf("unexpected request id in response header; got %q; want %q", respID, id)
+		}
+	}
+
+	// Request id from the client
+	f("abc-123", true)
+	f(strings.Repeat("a", maxRequestIDLen), true)
+
+	// Missing or invalid request id
+	f("", false)
+	f("foo bar", false)
+	f("foo\"bar\x01", false)
+	f(strings.Repeat("a", maxRequestIDLen+1), false)
+}
+
+func TestGetRequestIDMissing(t *testing.T) {
+	req := httptest.NewRequest("POST", "/api/put", nil)
+	if id := GetRequestID(req); id != "" {
+		t.Fatalf("unexpected request id for request without id: %q", id)
+	}
+}
+
+func TestNewRequestIDUnique(t *testing.T) {
+	m := make(map[string]bool)
+	for i := 0; i < 100; i++ {
+		id := newRequestID()
+		if m[id] {
+			t.Fatalf("duplicate request id %q", id)
+		}
+		m[id] = true
+	}
+}
@@ -0,0 +1,53 @@
+package common
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+
+	"github.com/VictoriaMetrics/metrics"
+)
+
+// MaxRequestSize tracks the maximum request size seen for a single protocol.
+//
+// The size is exposed in `vm_max_request_size_bytes{protocol="..."}` gauge.
+// It may be reset with ResetMaxRequestSizes.
+type MaxRequestSize struct {
+	max uint64
+}
+
+var (
+	maxRequestSizesLock sync.Mutex
+	maxRequestSizes     []*MaxRequestSize
+)
+
+// NewMaxRequestSize returns new MaxRequestSize for the given protocol.
+//
+// It must be called only once per protocol, usually during package initialization.
+func NewMaxRequestSize(protocol string) *MaxRequestSize {
+	mrs := &MaxRequestSize{}
+	metrics.NewGauge(fmt.Sprintf(`vm_max_request_size_bytes{protocol=%q}`, protocol), func() float64 {
+		return float64(atomic.LoadUint64(&mrs.max))
+	})
+	maxRequestSizesLock.Lock()
+	maxRequestSizes = append(maxRequestSizes, mrs)
+	maxRequestSizesLock.Unlock()
+	return mrs
+}
+
+// Update registers a request with the given size.
+//
+// Requests exceeding -maxInsertRequestSize must be registered too with the number of bytes read,
+// so the gauge shows that the limit is hit.
+func (mrs *MaxRequestSize) Update(size int64) {
+	updateMax(&mrs.max, uint64(size))
+}
+
+// ResetMaxRequestSizes resets maximum request sizes for all the protocols.
+func ResetMaxRequestSizes() {
+	maxRequestSizesLock.Lock()
+	for _, mrs := range maxRequestSizes {
+		atomic.StoreUint64(&mrs.max, 0)
+	}
+	maxRequestSizesLock.Unlock()
+}
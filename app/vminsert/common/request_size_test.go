@@ -0,0 +1,26 @@
+package common
+
+import (
+	"sync/atomic"
+	"testing"
+)
+
+func TestMaxRequestSize(t *testing.T) {
+	mrs := NewMaxRequestSize("test-max-request-size")
+	f := func(maxExpected uint64) {
+		t.Helper()
+		if n := atomic.LoadUint64(&mrs.max); n != maxExpected {
+			t.Fatalf("unexpected max request size; got %d; want %d", n, maxExpected)
+		}
+	}
+	f(0)
+	mrs.Update(100)
+	mrs.Update(10)
+	f(100)
+	mrs.Update(1000)
+	f(1000)
+	ResetMaxRequestSizes()
+	f(0)
+	mrs.Update(10)
+	f(10)
+}
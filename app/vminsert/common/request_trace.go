@@ -0,0 +1,218 @@
+package common
+
+import (
+	"context"
+	"flag"
+	"io"
+	"math"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/VictoriaMetrics/metrics"
+)
+
+var traceSampleRate = flag.Float64("insert.traceSampleRate", 0, "The fraction of HTTP insert requests in the range [0..1] to record detailed traces for. "+
+	"Every trace contains the time spent on reading the request body, parsing and flushing rows, the number of written rows and the error if any. "+
+	"The most recent traces are returned at /debug/insert/traces page of -debug.insertListenAddr. Tracing is disabled by default")
+
+// maxRecentTraces is the maximum number of recent request traces kept for /debug/insert/traces.
+const maxRecentTraces = 100
+
+// maxTraceErrorLen is the maximum length of the error response body kept in a request trace.
+const maxTraceErrorLen = 512
+
+// RequestTrace is a detailed trace for a single sampled HTTP insert request.
+//
+// Rows and flushes are registered concurrently by InsertCtx for the request.
+type RequestTrace struct {
+	// The following fields are updated atomically while serving the request.
+	// They go first in order to be aligned to 64 bits on 32-bit architectures.
+	readDuration  int64
+	flushDuration int64
+	flushes       uint64
+	rows          uint64
+	bodyBytes     uint64
+
+	Time            time.Time `json:"time"`
+	Path            string    `json:"path"`
+	RequestID       string    `json:"requestID,omitempty"`
+	ReadSeconds     float64   `json:"readSeconds"`
+	ParseSeconds    float64   `json:"parseSeconds"`
+	FlushSeconds    float64   `json:"flushSeconds"`
+	Flushes         uint64    `json:"flushes"`
+	Rows            uint64    `json:"rows"`
+	BodyBytes       uint64    `json:"bodyBytes"`
+	StatusCode      int       `json:"statusCode"`
+	Error           string    `json:"error,omitempty"`
+	DurationSeconds float64   `json:"durationSeconds"`
+
+	// responseBuf holds the beginning of the response body. It is put into Error if the request fails.
+	responseBuf []byte
+
+	sw        *StatusResponseWriter
+	startTime time.Time
+}
+
+type requestTraceKey struct{}
+
+// sampledRequests is the number of HTTP insert requests considered for sampling. See -insert.traceSampleRate.
+var sampledRequests uint64
+
+// WithRequestTrace starts recording a trace for req if it is sampled according to -insert.traceSampleRate.
+//
+// The returned w and req must be used for serving the request, so the trace captures the time spent on reading the request body,
+// written rows and the response. Call Finish on the returned trace after serving the request.
+// The returned trace is nil if req isn't sampled, so non-sampled requests are served without overhead.
+func WithRequestTrace(w http.ResponseWriter, req *http.Request) (http.ResponseWriter, *http.Request, *RequestTrace) {
+	rate := *traceSampleRate
+	if rate <= 0 {
+		return w, req, nil
+	}
+	// Sample every 1/rate request instead of using random numbers, so the sampling is cheap and the fraction is exact.
+	n := atomic.AddUint64(&sampledRequests, 1)
+	if math.Floor(float64(n)*rate) == math.Floor(float64(n-1)*rate) {
+		return w, req, nil
+	}
+	now := time.Now()
+	rt := &RequestTrace{
+		Time:      now,
+		Path:      req.URL.Path,
+		RequestID: GetRequestID(req),
+
+		startTime: now,
+	}
+	rt.sw = &StatusResponseWriter{
+		ResponseWriter: &traceResponseWriter{
+			ResponseWriter: w,
+			rt:             rt,
+		},
+	}
+	if req.Body != nil {
+		req.Body = &traceBody{
+			ReadCloser: req.Body,
+			rt:         rt,
+		}
+	}
+	ctx := context.WithValue(req.Context(), requestTraceKey{}, rt)
+	tracedRequests.Inc()
+	return rt.sw, req.WithContext(ctx), rt
+}
+
+// getRequestTrace returns request trace for the request with the given reqCtx.
+func getRequestTrace(reqCtx context.Context) *RequestTrace {
+	if reqCtx == nil {
+		return nil
+	}
+	rt, _ := reqCtx.Value(requestTraceKey{}).(*RequestTrace)
+	return rt
+}
+
+// Finish registers rt in the list of recent traces returned at /debug/insert/traces.
+//
+// rt may be nil. rt mustn't be used after the call.
+func (rt *RequestTrace) Finish() {
+	if rt == nil {
+		return
+	}
+	d := time.Since(rt.startTime)
+	readDuration := time.Duration(atomic.LoadInt64(&rt.readDuration))
+	flushDuration := time.Duration(atomic.LoadInt64(&rt.flushDuration))
+	rt.DurationSeconds = d.Seconds()
+	rt.ReadSeconds = readDuration.Seconds()
+	rt.FlushSeconds = flushDuration.Seconds()
+	// Parsing isn't timed separately, since it is interleaved with reading in all the protocols.
+	// Flushes may run concurrently with parsing, so the parse time is bounded by zero.
+	if parseDuration := d - readDuration - flushDuration; parseDuration > 0 {
+		rt.ParseSeconds = parseDuration.Seconds()
+	}
+	rt.Flushes = atomic.LoadUint64(&rt.flushes)
+	rt.Rows = atomic.LoadUint64(&rt.rows)
+	rt.BodyBytes = atomic.LoadUint64(&rt.bodyBytes)
+	rt.StatusCode = rt.sw.StatusCode()
+	if rt.StatusCode >= 400 {
+		rt.Error = string(rt.responseBuf)
+	}
+	rt.responseBuf = nil
+	rt.sw = nil
+	recentTraces.add(rt)
+}
+
+// addFlush registers a flush of the given number of rows, which took d, in rt.
+func (rt *RequestTrace) addFlush(rows int, d time.Duration) {
+	atomic.AddUint64(&rt.flushes, 1)
+	atomic.AddUint64(&rt.rows, uint64(rows))
+	atomic.AddInt64(&rt.flushDuration, int64(d))
+}
+
+// traceBody measures the time spent on reading the request body.
+type traceBody struct {
+	io.ReadCloser
+	rt *RequestTrace
+}
+
+func (tb *traceBody) Read(p []byte) (int, error) {
+	startTime := time.Now()
+	n, err := tb.ReadCloser.Read(p)
+	atomic.AddInt64(&tb.rt.readDuration, int64(time.Since(startTime)))
+	atomic.AddUint64(&tb.rt.bodyBytes, uint64(n))
+	return n, err
+}
+
+// traceResponseWriter captures the beginning of the response body, so it may be put into the trace on errors.
+type traceResponseWriter struct {
+	http.ResponseWriter
+	rt *RequestTrace
+}
+
+func (tw *traceResponseWriter) Write(p []byte) (int, error) {
+	if n := maxTraceErrorLen - len(tw.rt.responseBuf); n > 0 {
+		if n > len(p) {
+			n = len(p)
+		}
+		tw.rt.responseBuf = append(tw.rt.responseBuf, p[:n]...)
+	}
+	return tw.ResponseWriter.Write(p)
+}
+
+// Flush implements http.Flusher.
+func (tw *traceResponseWriter) Flush() {
+	if fw, ok := tw.ResponseWriter.(http.Flusher); ok {
+		fw.Flush()
+	}
+}
+
+// traceRing holds the most recent request traces.
+type traceRing struct {
+	mu     sync.Mutex
+	traces []*RequestTrace
+	next   int
+}
+
+var recentTraces traceRing
+
+func (tr *traceRing) add(rt *RequestTrace) {
+	tr.mu.Lock()
+	if len(tr.traces) < maxRecentTraces {
+		tr.traces = append(tr.traces, rt)
+	} else {
+		tr.traces[tr.next] = rt
+	}
+	tr.next = (tr.next + 1) % maxRecentTraces
+	tr.mu.Unlock()
+}
+
+// getAll returns recent traces starting from the most recent one.
+func (tr *traceRing) getAll() []*RequestTrace {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	traces := make([]*RequestTrace, 0, len(tr.traces))
+	for i := 1; i <= len(tr.traces); i++ {
+		idx := (tr.next - i + maxRecentTraces) % maxRecentTraces
+		traces = append(traces, tr.traces[idx])
+	}
+	return traces
+}
+
+var tracedRequests = metrics.NewCounter(`vm_insert_traced_requests_total`)
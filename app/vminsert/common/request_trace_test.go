@@ -0,0 +1,117 @@
+package common
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/prompb"
+)
+
+func TestRequestTraceSampling(t *testing.T) {
+	defer func() {
+		*traceSampleRate = 0
+		sampledRequests = 0
+	}()
+
+	f := func(rate float64, requests, tracesExpected int) {
+		t.Helper()
+		*traceSampleRate = rate
+		sampledRequests = 0
+		traces := 0
+		for i := 0; i < requests; i++ {
+			w := httptest.NewRecorder()
+			req := httptest.NewRequest("POST", "/api/put", nil)
+			if _, _, rt := WithRequestTrace(w, req); rt != nil {
+				traces++
+			}
+		}
+		if traces != tracesExpected {
+			t.Fatalf("unexpected number of traces for rate=%v; got %d; want %d", rate, traces, tracesExpected)
+		}
+	}
+	f(0, 100, 0)
+	f(0.1, 100, 10)
+	f(0.25, 100, 25)
+	f(1, 100, 100)
+}
+
+func TestRequestTrace(t *testing.T) {
+	defer func() {
+		*traceSampleRate = 0
+		recentTraces = traceRing{}
+	}()
+	*traceSampleRate = 1
+
+	startTestStorageNode()
+	defer stopTestStorageNode()
+
+	f := func(body string, statusCode int, errorExpected string) {
+		t.Helper()
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest("POST", "/api/put", strings.NewReader(body))
+		var tw http.ResponseWriter
+		tw, req, rt := WithRequestTrace(w, req)
+		if rt == nil {
+			t.Fatalf("expecting non-nil trace")
+		}
+		if _, err := ioutil.ReadAll(req.Body); err != nil {
+			t.Fatalf("cannot read request body: %s", err)
+		}
+
+		var ctx InsertCtx
+		ctx.Reset(0)
+		ctx.SetContext(req.Context())
+		ctx.WriteDataPoint(nil, []prompb.Label{{Name: []byte("__name__"), Value: []byte("foo")}}, 1, 2)
+		ctx.WriteDataPoint(nil, []prompb.Label{{Name: []byte("__name__"), Value: []byte("bar")}}, 1, 2)
+		if err := ctx.FlushBufs(); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if statusCode >= 400 {
+			http.Error(tw, errorExpected, statusCode)
+		} else {
+			tw.WriteHeader(statusCode)
+		}
+		rt.Finish()
+
+		traces := recentTraces.getAll()
+		if len(traces) == 0 || traces[0] != rt {
+			t.Fatalf("expecting the trace to be the most recent one")
+		}
+		if rt.Rows != 2 || rt.Flushes != 1 {
+			t.Fatalf("unexpected rows and flushes; got %d and %d; want 2 and 1", rt.Rows, rt.Flushes)
+		}
+		if rt.BodyBytes != uint64(len(body)) {
+			t.Fatalf("unexpected body bytes; got %d; want %d", rt.BodyBytes, len(body))
+		}
+		if rt.StatusCode != statusCode {
+			t.Fatalf("unexpected status code; got %d; want %d", rt.StatusCode, statusCode)
+		}
+		if strings.TrimSpace(rt.Error) != errorExpected {
+			t.Fatalf("unexpected error; got %q; want %q", rt.Error, errorExpected)
+		}
+		if rt.DurationSeconds < rt.ReadSeconds+rt.FlushSeconds {
+			t.Fatalf("the request duration %v cannot be smaller than read and flush durations %v and %v", rt.DurationSeconds, rt.ReadSeconds, rt.FlushSeconds)
+		}
+	}
+	f("foo 1 2", http.StatusNoContent, "")
+	f("bar 1 2", http.StatusBadRequest, "cannot parse request")
+}
+
+func TestTraceRing(t *testing.T) {
+	var tr traceRing
+	for i := 0; i < maxRecentTraces+5; i++ {
+		tr.add(&RequestTrace{Rows: uint64(i)})
+	}
+	traces := tr.getAll()
+	if len(traces) != maxRecentTraces {
+		t.Fatalf("unexpected number of traces; got %d; want %d", len(traces), maxRecentTraces)
+	}
+	for i, rt := range traces {
+		if n := uint64(maxRecentTraces + 4 - i); rt.Rows != n {
+			t.Fatalf("unexpected trace #%d; got rows=%d; want %d", i, rt.Rows, n)
+		}
+	}
+}
@@ -0,0 +1,96 @@
+package common
+
+import (
+	"flag"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/logger"
+)
+
+var requiredHeadersFlag = flag.String("insert.requiredHeaders", "", "Comma-separated list of HTTP headers, which must be present in every write request, "+
+	"for instance, `X-Auth-Source`. The header value may be enforced with `Name=value` syntax, for instance, `X-Auth-Source=proxy`. "+
+	"Requests without the header are rejected with 400 Bad Request, while requests with other header value are rejected with 401 Unauthorized. "+
+	"This is useful when a proxy in front of VictoriaMetrics authenticates clients and injects the header")
+
+// requiredHeader is a header from -insert.requiredHeaders.
+type requiredHeader struct {
+	name string
+
+	// value is the required header value if hasValue is set.
+	value    string
+	hasValue bool
+}
+
+var requiredHeaders []requiredHeader
+
+// InitRequiredHeaders parses -insert.requiredHeaders.
+//
+// InitRequiredHeaders must be called after flag.Parse call.
+func InitRequiredHeaders() {
+	rhs, err := parseRequiredHeaders(*requiredHeadersFlag)
+	if err != nil {
+		logger.Fatalf("cannot parse -insert.requiredHeaders=%q: %s", *requiredHeadersFlag, err)
+	}
+	requiredHeaders = rhs
+}
+
+// parseRequiredHeaders parses comma-separated `Name` or `Name=value` headers from s.
+func parseRequiredHeaders(s string) ([]requiredHeader, error) {
+	if len(s) == 0 {
+		return nil, nil
+	}
+	var rhs []requiredHeader
+	for _, item := range strings.Split(s, ",") {
+		var rh requiredHeader
+		rh.name = item
+		if n := strings.IndexByte(item, '='); n >= 0 {
+			rh.name = item[:n]
+			rh.value = strings.TrimSpace(item[n+1:])
+			rh.hasValue = true
+		}
+		rh.name = http.CanonicalHeaderKey(strings.TrimSpace(rh.name))
+		if len(rh.name) == 0 {
+			return nil, fmt.Errorf("missing header name in %q", item)
+		}
+		for _, x := range rhs {
+			if x.name == rh.name {
+				return nil, fmt.Errorf("duplicate header %q", rh.name)
+			}
+		}
+		rhs = append(rhs, rh)
+	}
+	return rhs, nil
+}
+
+// CheckRequiredHeaders verifies whether req contains headers from -insert.requiredHeaders.
+//
+// It returns status code for the response together with non-nil error if req doesn't contain the required headers.
+func CheckRequiredHeaders(req *http.Request) (int, error) {
+	for _, rh := range requiredHeaders {
+		values, ok := req.Header[rh.name]
+		if !ok {
+			return http.StatusBadRequest, fmt.Errorf("missing required %s header; see -insert.requiredHeaders", rh.name)
+		}
+		if rh.hasValue && (len(values) != 1 || values[0] != rh.value) {
+			// Do not return the expected value, since it may be used as a shared secret.
+			return http.StatusUnauthorized, fmt.Errorf("unexpected value for %s header; see -insert.requiredHeaders", rh.name)
+		}
+	}
+	return 0, nil
+}
+
+// setRequiredHeaders sets headers from -insert.requiredHeaders in h, so requests sent by the current instance pass CheckRequiredHeaders
+// at other instances with the same -insert.requiredHeaders.
+//
+// Headers without the required value are set to `vminsert`, since only their presence is checked.
+func setRequiredHeaders(h http.Header) {
+	for _, rh := range requiredHeaders {
+		value := "vminsert"
+		if rh.hasValue {
+			value = rh.value
+		}
+		h.Set(rh.name, value)
+	}
+}
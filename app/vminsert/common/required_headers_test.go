@@ -0,0 +1,87 @@
+package common
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestParseRequiredHeadersFailure(t *testing.T) {
+	f := func(s string) {
+		t.Helper()
+		if _, err := parseRequiredHeaders(s); err == nil {
+			t.Fatalf("expecting non-nil error when parsing %q", s)
+		}
+	}
+	f(",")
+	f("X-Auth-Source,")
+	f("=proxy")
+	f("X-Auth-Source,x-auth-source=proxy")
+}
+
+func TestCheckRequiredHeaders(t *testing.T) {
+	defer func(rhs []requiredHeader) {
+		requiredHeaders = rhs
+	}(requiredHeaders)
+
+	rhs, err := parseRequiredHeaders("x-auth-source, X-Tenant = foo")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	requiredHeaders = rhs
+
+	f := func(headers map[string][]string, statusCodeExpected int) {
+		t.Helper()
+		req := httptest.NewRequest("POST", "/api/put", nil)
+		for k, vs := range headers {
+			for _, v := range vs {
+				req.Header.Add(k, v)
+			}
+		}
+		statusCode, err := CheckRequiredHeaders(req)
+		if statusCodeExpected == 0 {
+			if err != nil {
+				t.Fatalf("unexpected error for headers %v: %s", headers, err)
+			}
+			return
+		}
+		if err == nil {
+			t.Fatalf("expecting non-nil error for headers %v", headers)
+		}
+		if statusCode != statusCodeExpected {
+			t.Fatalf("unexpected status code for headers %v; got %d; want %d", headers, statusCode, statusCodeExpected)
+		}
+	}
+	f(map[string][]string{"X-Auth-Source": {"proxy"}, "X-Tenant": {"foo"}}, 0)
+	f(map[string][]string{"X-Auth-Source": {""}, "x-tenant": {"foo"}}, 0)
+	f(nil, 400)
+	f(map[string][]string{"X-Tenant": {"foo"}}, 400)
+	f(map[string][]string{"X-Auth-Source": {"proxy"}}, 400)
+	f(map[string][]string{"X-Auth-Source": {"proxy"}, "X-Tenant": {"bar"}}, 401)
+	f(map[string][]string{"X-Auth-Source": {"proxy"}, "X-Tenant": {"foo", "bar"}}, 401)
+
+	// No required headers
+	requiredHeaders = nil
+	f(nil, 0)
+}
+
+func TestSetRequiredHeaders(t *testing.T) {
+	defer func(rhs []requiredHeader) {
+		requiredHeaders = rhs
+	}(requiredHeaders)
+
+	rhs, err := parseRequiredHeaders("x-auth-source, X-Tenant = foo")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	requiredHeaders = rhs
+
+	// Requests sent to other instances must pass the check for the same -insert.requiredHeaders.
+	req := httptest.NewRequest("POST", StorageNodeInsertPath, nil)
+	setRequiredHeaders(req.Header)
+	if statusCode, err := CheckRequiredHeaders(req); err != nil {
+		t.Fatalf("unexpected error with status code %d: %s", statusCode, err)
+	}
+	if v := req.Header.Get("X-Tenant"); v != "foo" {
+		t.Fatalf("unexpected X-Tenant header value; got %q; want %q", v, "foo")
+	}
+}
@@ -0,0 +1,160 @@
+package common
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/logger"
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/storage"
+	"github.com/VictoriaMetrics/metrics"
+)
+
+// RetryBuffer retains rows, which couldn't be written to the storage, and periodically retries writing them.
+//
+// It is intended for protocols without a way to tell the client to retry, such as OpenTSDB telnet put protocol.
+// The buffer is kept in memory, so its contents are lost on restart.
+type RetryBuffer struct {
+	name    string
+	maxRows int
+
+	mu sync.Mutex
+
+	// blocks contains rows in the order they were added, so the oldest rows are retried and dropped first.
+	blocks []*rowsBlock
+
+	// rows is the number of rows in blocks and in the block, which is being retried.
+	rows int
+
+	stopCh chan struct{}
+	wg     sync.WaitGroup
+
+	retriedRows *metrics.Counter
+	droppedRows *metrics.Counter
+}
+
+// NewRetryBuffer starts a buffer with the given name, which retains up to maxRows rows and retries writing them every interval.
+//
+// The oldest rows are dropped when the buffer is full. Call Stop when the buffer is no longer needed.
+func NewRetryBuffer(name string, maxRows int, interval time.Duration) *RetryBuffer {
+	rb := &RetryBuffer{
+		name:    name,
+		maxRows: maxRows,
+		stopCh:  make(chan struct{}),
+
+		retriedRows: metrics.GetOrCreateCounter(fmt.Sprintf(`vm_retry_buffer_retried_rows_total{name=%q}`, name)),
+		droppedRows: metrics.GetOrCreateCounter(fmt.Sprintf(`vm_retry_buffer_dropped_rows_total{name=%q}`, name)),
+	}
+	metrics.GetOrCreateGauge(fmt.Sprintf(`vm_retry_buffer_rows{name=%q}`, name), func() float64 {
+		rb.mu.Lock()
+		n := rb.rows
+		rb.mu.Unlock()
+		return float64(n)
+	})
+	rb.wg.Add(1)
+	go func() {
+		defer rb.wg.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-rb.stopCh:
+				return
+			case <-ticker.C:
+				rb.retry()
+			}
+		}
+	}()
+	return rb
+}
+
+// Stop stops rb.
+//
+// Rows remaining in rb are retried for the last time and then dropped on failure.
+func (rb *RetryBuffer) Stop() {
+	close(rb.stopCh)
+	rb.wg.Wait()
+	rb.retry()
+
+	rb.mu.Lock()
+	if rb.rows > 0 {
+		logger.Errorf("dropping %d rows from %s retry buffer on shutdown, since they couldn't be written to the storage", rb.rows, rb.name)
+		rb.droppedRows.Add(rb.rows)
+	}
+	for _, b := range rb.blocks {
+		putRowsBlock(b)
+	}
+	rb.blocks = nil
+	rb.rows = 0
+	rb.mu.Unlock()
+}
+
+// RetryLater copies rows from ctx to rb, so they are written to the storage later.
+//
+// Call it after FlushBufs failure instead of returning the error to the client, which cannot retry.
+func (ctx *InsertCtx) RetryLater(rb *RetryBuffer) {
+	rb.add(ctx.mrs)
+}
+
+func (rb *RetryBuffer) add(mrs []storage.MetricRow) {
+	if len(mrs) == 0 {
+		return
+	}
+	if len(mrs) > rb.maxRows {
+		rb.droppedRows.Add(len(mrs))
+		return
+	}
+	b := getRowsBlock()
+	b.copyFrom(mrs)
+
+	rb.mu.Lock()
+	// The block, which is being retried, isn't dropped, so the buffer may temporarily exceed maxRows by its size.
+	for rb.rows+len(b.mrs) > rb.maxRows && len(rb.blocks) > 0 {
+		oldest := rb.blocks[0]
+		rb.blocks[0] = nil
+		rb.blocks = rb.blocks[1:]
+		rb.rows -= len(oldest.mrs)
+		rb.droppedRows.Add(len(oldest.mrs))
+		putRowsBlock(oldest)
+	}
+	rb.blocks = append(rb.blocks, b)
+	rb.rows += len(b.mrs)
+	rb.mu.Unlock()
+}
+
+// retry writes buffered rows to the storage in the order they were added.
+//
+// It stops on the first failure, so the rest of rows are retried on the next call.
+func (rb *RetryBuffer) retry() {
+	for {
+		rb.mu.Lock()
+		if len(rb.blocks) == 0 {
+			rb.mu.Unlock()
+			return
+		}
+		// Remove the block from blocks while writing it, so it isn't dropped by concurrent add calls.
+		b := rb.blocks[0]
+		rb.blocks[0] = nil
+		rb.blocks = rb.blocks[1:]
+		rb.mu.Unlock()
+
+		// Write rows without holding the lock, so add calls aren't blocked by slow storage.
+		err := flushRows(nil, b.mrs)
+
+		rb.mu.Lock()
+		if err != nil {
+			// Return the block to the head of blocks, so it is retried first on the next call.
+			rb.blocks = append(rb.blocks, nil)
+			copy(rb.blocks[1:], rb.blocks)
+			rb.blocks[0] = b
+			rows := rb.rows
+			rb.mu.Unlock()
+			logger.Errorf("cannot write %d buffered rows from %s retry buffer; retrying later: %s", rows, rb.name, err)
+			return
+		}
+		rb.rows -= len(b.mrs)
+		rb.mu.Unlock()
+		rb.retriedRows.Add(len(b.mrs))
+		putRowsBlock(b)
+	}
+}
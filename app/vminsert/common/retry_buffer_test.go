@@ -0,0 +1,68 @@
+package common
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/prompb"
+)
+
+func TestRetryBuffer(t *testing.T) {
+	tsn := startTestStorageNode()
+	defer stopTestStorageNode()
+	tsn.setError(fmt.Errorf("storage is unavailable"))
+
+	rb := NewRetryBuffer("test", 3, time.Hour)
+	droppedRows := rb.droppedRows.Get()
+
+	var ctx InsertCtx
+	write := func(timestamps ...int64) {
+		t.Helper()
+		ctx.Reset(len(timestamps))
+		for _, ts := range timestamps {
+			ctx.WriteDataPoint(nil, []prompb.Label{{Name: []byte("__name__"), Value: []byte("foo")}}, ts, 1)
+		}
+		if err := ctx.FlushBufs(); err == nil {
+			t.Fatalf("expecting non-nil error")
+		}
+		ctx.RetryLater(rb)
+	}
+	write(1)
+	write(2, 3)
+	// The oldest batch is dropped, since the buffer is full.
+	write(4)
+	// Too big batch is dropped.
+	write(5, 6, 7, 8)
+	if n := rb.droppedRows.Get() - droppedRows; n != 5 {
+		t.Fatalf("unexpected number of dropped rows; got %d; want 5", n)
+	}
+
+	// The storage is still unavailable.
+	rb.retry()
+	if rb.rows != 3 || len(tsn.rows()) != 0 {
+		t.Fatalf("unexpected rows after failed retry; buffered %d, written %d; want 3, 0", rb.rows, len(tsn.rows()))
+	}
+
+	tsn.setError(nil)
+	rb.retry()
+	if rb.rows != 0 {
+		t.Fatalf("unexpected number of buffered rows after successful retry; got %d; want 0", rb.rows)
+	}
+	var timestamps []int64
+	for _, mr := range tsn.rows() {
+		timestamps = append(timestamps, mr.Timestamp)
+	}
+	if s := fmt.Sprint(timestamps); s != "[2 3 4]" {
+		t.Fatalf("unexpected timestamps of retried rows; got %s; want [2 3 4]", s)
+	}
+
+	// Rows remaining on Stop are dropped.
+	tsn.setError(fmt.Errorf("storage is unavailable"))
+	write(9)
+	droppedRows = rb.droppedRows.Get()
+	rb.Stop()
+	if n := rb.droppedRows.Get() - droppedRows; n != 1 {
+		t.Fatalf("unexpected number of rows dropped on Stop; got %d; want 1", n)
+	}
+}
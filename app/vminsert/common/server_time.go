@@ -0,0 +1,45 @@
+package common
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/VictoriaMetrics/metrics"
+)
+
+// GetServerTimestamp returns the current server time in milliseconds if client timestamps must be ignored for req.
+//
+// Client timestamps are ignored if useServerTime is set or if req contains `use_server_time=1` query arg.
+// This is an escape hatch for clients with broken clocks. 0 is returned if client timestamps must be used.
+func GetServerTimestamp(req *http.Request, useServerTime bool) int64 {
+	if !useServerTime {
+		q := req.URL.Query()
+		if _, ok := q["use_server_time"]; !ok {
+			return 0
+		}
+		if v := q.Get("use_server_time"); v == "0" || v == "false" {
+			return 0
+		}
+	}
+	serverTimeRequests.Inc()
+	return time.Now().UnixNano() / 1e6
+}
+
+// SetServerTimestamp sets the timestamp in milliseconds for all the rows written via ctx
+// instead of timestamps passed by the caller.
+//
+// Timestamps passed by the caller are used if timestamp is 0.
+// The timestamp remains set until the next SetServerTimestamp call.
+func (ctx *InsertCtx) SetServerTimestamp(timestamp int64) {
+	ctx.serverTimestamp = timestamp
+}
+
+// ServerTimestamp returns the timestamp set via SetServerTimestamp.
+func (ctx *InsertCtx) ServerTimestamp() int64 {
+	return ctx.serverTimestamp
+}
+
+var (
+	serverTimeRequests = metrics.NewCounter(`vm_server_time_requests_total`)
+	serverTimeRows     = metrics.NewCounter(`vm_server_time_rows_total`)
+)
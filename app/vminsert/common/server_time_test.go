@@ -0,0 +1,48 @@
+package common
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestGetServerTimestamp(t *testing.T) {
+	f := func(url string, useServerTime, resultExpected bool) {
+		t.Helper()
+		req := httptest.NewRequest("POST", url, nil)
+		ts := GetServerTimestamp(req, useServerTime)
+		if result := ts != 0; result != resultExpected {
+			t.Fatalf("unexpected result for %q, useServerTime=%v; got %v; want %v", url, useServerTime, result, resultExpected)
+		}
+		if ts != 0 {
+			if d := time.Now().UnixNano()/1e6 - ts; d < 0 || d > 10000 {
+				t.Fatalf("unexpected server timestamp: %d", ts)
+			}
+		}
+	}
+	f("/write", false, false)
+	f("/write", true, true)
+	f("/write?use_server_time=1", false, true)
+	f("/write?use_server_time", false, true)
+	f("/write?use_server_time=true", false, true)
+	f("/write?use_server_time=0", false, false)
+	f("/write?use_server_time=false", false, false)
+	f("/write?use_server_time=0", true, true)
+}
+
+func TestInsertCtxServerTimestamp(t *testing.T) {
+	var ctx InsertCtx
+	ctx.Reset(2)
+	ctx.AddLabel("", "foo")
+	ctx.WriteDataPoint(nil, ctx.Labels, 123, 1)
+	ctx.SetServerTimestamp(456)
+	ctx.WriteDataPoint(nil, ctx.Labels, 123, 2)
+	ctx.SetServerTimestamp(0)
+	ctx.WriteDataPoint(nil, ctx.Labels, 789, 3)
+	timestamps := []int64{123, 456, 789}
+	for i, mr := range ctx.mrs {
+		if mr.Timestamp != timestamps[i] {
+			t.Fatalf("unexpected timestamp for row #%d; got %d; want %d", i, mr.Timestamp, timestamps[i])
+		}
+	}
+}
@@ -0,0 +1,88 @@
+package common
+
+import (
+	"sync"
+
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/storage"
+)
+
+// Sink accepts rows flushed from InsertCtx instead of the storage.
+//
+// This allows routing ingested rows to a test collector or to a secondary system.
+type Sink interface {
+	// AddRows adds mrs to the sink.
+	//
+	// mrs are re-used by the caller after AddRows returns,
+	// so the sink must copy them if they are used afterwards.
+	AddRows(mrs []storage.MetricRow) error
+}
+
+var (
+	sinkLock   sync.Mutex
+	globalSink Sink
+)
+
+// SetSink sets sink for all the rows flushed from InsertCtx.
+//
+// The rows are written to the storage or routed to -storageNode instances if sink is nil.
+// -mirror.remoteWrite is applied regardless of the sink.
+func SetSink(sink Sink) {
+	sinkLock.Lock()
+	globalSink = sink
+	sinkLock.Unlock()
+}
+
+func getSink() Sink {
+	sinkLock.Lock()
+	sink := globalSink
+	sinkLock.Unlock()
+	return sink
+}
+
+// RowsCollector is a Sink, which collects rows in memory.
+//
+// It may be passed to SetSink in tests in order to verify rows flushed from InsertCtx.
+type RowsCollector struct {
+	mu  sync.Mutex
+	mrs []storage.MetricRow
+	err error
+}
+
+// AddRows implements Sink interface.
+//
+// It returns the error passed to Reset instead of collecting mrs if the error isn't nil.
+func (rc *RowsCollector) AddRows(mrs []storage.MetricRow) error {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	if rc.err != nil {
+		return rc.err
+	}
+	for i := range mrs {
+		mr := mrs[i]
+		mr.MetricNameRaw = append([]byte{}, mr.MetricNameRaw...)
+		rc.mrs = append(rc.mrs, mr)
+	}
+	return nil
+}
+
+// Reset drops the collected rows and makes AddRows return err if err isn't nil.
+func (rc *RowsCollector) Reset(err error) {
+	rc.mu.Lock()
+	rc.mrs = nil
+	rc.err = err
+	rc.mu.Unlock()
+}
+
+// Rows returns a copy of the collected rows.
+func (rc *RowsCollector) Rows() []storage.MetricRow {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	return append([]storage.MetricRow{}, rc.mrs...)
+}
+
+// RowsCount returns the number of collected rows.
+func (rc *RowsCollector) RowsCount() int {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	return len(rc.mrs)
+}
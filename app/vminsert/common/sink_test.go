@@ -0,0 +1,36 @@
+package common
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestInsertCtxSink(t *testing.T) {
+	var rc RowsCollector
+	SetSink(&rc)
+	defer SetSink(nil)
+
+	var ctx InsertCtx
+	ctx.Reset(1)
+	ctx.AddLabel("", "foo")
+	ctx.WriteDataPoint(nil, ctx.Labels, 1234, 42)
+	if err := ctx.FlushBufs(); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	mrs := rc.Rows()
+	if len(mrs) != 1 {
+		t.Fatalf("unexpected number of rows written to the sink; got %d; want 1", len(mrs))
+	}
+	if mr := &mrs[0]; mr.Timestamp != 1234 || mr.Value != 42 {
+		t.Fatalf("unexpected row written to the sink; got %+v", mr)
+	}
+
+	// Sink errors are returned to the caller.
+	rc.Reset(fmt.Errorf("sink is unavailable"))
+	if err := ctx.FlushBufsSync(); err == nil {
+		t.Fatalf("expecting non-nil error")
+	}
+	if n := rc.RowsCount(); n != 0 {
+		t.Fatalf("unexpected number of rows after failed write; got %d; want 0", n)
+	}
+}
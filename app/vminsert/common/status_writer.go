@@ -0,0 +1,44 @@
+package common
+
+import (
+	"net/http"
+)
+
+// StatusResponseWriter captures the status code of the response written to the underlying http.ResponseWriter.
+type StatusResponseWriter struct {
+	http.ResponseWriter
+	statusCode int
+}
+
+// WriteHeader writes statusCode to the underlying http.ResponseWriter.
+func (sw *StatusResponseWriter) WriteHeader(statusCode int) {
+	if sw.statusCode == 0 {
+		sw.statusCode = statusCode
+	}
+	sw.ResponseWriter.WriteHeader(statusCode)
+}
+
+// Write writes p to the underlying http.ResponseWriter.
+func (sw *StatusResponseWriter) Write(p []byte) (int, error) {
+	if sw.statusCode == 0 {
+		sw.statusCode = http.StatusOK
+	}
+	return sw.ResponseWriter.Write(p)
+}
+
+// Flush implements http.Flusher.
+func (sw *StatusResponseWriter) Flush() {
+	if fw, ok := sw.ResponseWriter.(http.Flusher); ok {
+		fw.Flush()
+	}
+}
+
+// StatusCode returns the status code of the response.
+//
+// http.StatusOK is returned if nothing has been written to sw, since net/http sends it in this case.
+func (sw *StatusResponseWriter) StatusCode() int {
+	if sw.statusCode == 0 {
+		return http.StatusOK
+	}
+	return sw.statusCode
+}
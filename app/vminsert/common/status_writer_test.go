@@ -0,0 +1,41 @@
+package common
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestStatusResponseWriter(t *testing.T) {
+	f := func(write func(w http.ResponseWriter), statusCodeExpected int) {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		sw := &StatusResponseWriter{ResponseWriter: rec}
+		write(sw)
+		if sw.StatusCode() != statusCodeExpected {
+			t.Fatalf("unexpected status code; got %d; want %d", sw.StatusCode(), statusCodeExpected)
+		}
+		if rec.Code != statusCodeExpected {
+			t.Fatalf("unexpected status code in the underlying writer; got %d; want %d", rec.Code, statusCodeExpected)
+		}
+	}
+
+	// Nothing written
+	f(func(w http.ResponseWriter) {}, 200)
+
+	f(func(w http.ResponseWriter) {
+		w.WriteHeader(http.StatusNoContent)
+	}, 204)
+	f(func(w http.ResponseWriter) {
+		_, _ = w.Write([]byte("foo"))
+	}, 200)
+	f(func(w http.ResponseWriter) {
+		http.Error(w, "bad request", http.StatusBadRequest)
+	}, 400)
+
+	// Only the first status code is captured
+	f(func(w http.ResponseWriter) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.WriteHeader(http.StatusOK)
+	}, 503)
+}
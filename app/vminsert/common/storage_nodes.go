@@ -0,0 +1,404 @@
+package common
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	neturl "net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/VictoriaMetrics/VictoriaMetrics/app/vminsert/concurrencylimiter"
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/bytesutil"
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/logger"
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/storage"
+	"github.com/VictoriaMetrics/metrics"
+	xxhash "github.com/cespare/xxhash/v2"
+)
+
+var (
+	storageNodeSendTimeout = flag.Duration("storageNode.sendTimeout", 30*time.Second, "Timeout for a single attempt of sending rows to a -storageNode. "+
+		"Failed attempts are retried according to -insert.flushRetries")
+	storageNodeInsertAuthKey = flag.String("storageNode.insertAuthKey", "", "authKey for rows routed between VictoriaMetrics instances via -storageNode. "+
+		"Instances accept rows from other instances at /internal/insert only if the flag is set and the request has `authKey` query arg with the same value. "+
+		"The flag must be set to the same value at the instances with -storageNode and at the storage nodes. The endpoint is disabled by default")
+)
+
+var storageNodeAddrs stringsFlag
+
+func init() {
+	flag.Var(&storageNodeAddrs, "storageNode", "Address of VictoriaMetrics instance to route ingested series to in the form host:port. "+
+		"The flag may be set multiple times or may contain comma-separated addresses. Every series is routed to a single node "+
+		"by a consistent hash of its labels. Rows are stored locally if the flag is empty")
+}
+
+// stringsFlag is a flag accepting multiple values either via repeated flags or via comma-separated list.
+type stringsFlag []string
+
+// String implements flag.Value interface.
+func (sf *stringsFlag) String() string {
+	return strings.Join(*sf, ",")
+}
+
+// Set implements flag.Value interface.
+func (sf *stringsFlag) Set(value string) error {
+	for _, s := range strings.Split(value, ",") {
+		s = strings.TrimSpace(s)
+		if len(s) == 0 {
+			return fmt.Errorf("empty value in %q", value)
+		}
+		*sf = append(*sf, s)
+	}
+	return nil
+}
+
+// maxStorageNodeBufSize is the size of marshaled rows for a single storage node, which are sent in a single request.
+//
+// Bigger batches of rows are split into multiple requests.
+const maxStorageNodeBufSize = 4 * 1024 * 1024
+
+// StorageNodeInsertPath is the path for accepting rows routed from other VictoriaMetrics instances.
+//
+// See InsertStorageNodeHandler.
+const StorageNodeInsertPath = "/internal/insert"
+
+// InitStorageNodes starts routing ingested rows to -storageNode addresses.
+//
+// InitStorageNodes must be called after flag.Parse call.
+func InitStorageNodes() {
+	if len(storageNodeAddrs) == 0 {
+		return
+	}
+	if len(*storageNodeInsertAuthKey) == 0 {
+		logger.Fatalf("-storageNode.insertAuthKey must be set when -storageNode is set, since storage nodes reject rows without authKey")
+	}
+	seen := make(map[string]bool, len(storageNodeAddrs))
+	for _, addr := range storageNodeAddrs {
+		if seen[addr] {
+			logger.Fatalf("duplicate -storageNode=%q", addr)
+		}
+		seen[addr] = true
+	}
+	sns := newStorageNodes(storageNodeAddrs, *storageNodeSendTimeout)
+	logger.Infof("routing ingested series to %d storage nodes: %s", len(storageNodeAddrs), storageNodeAddrs.String())
+	storageNodesLock.Lock()
+	globalStorageNodes = sns
+	storageNodesLock.Unlock()
+}
+
+// StopStorageNodes stops routing rows to storage nodes.
+func StopStorageNodes() {
+	storageNodesLock.Lock()
+	globalStorageNodes = nil
+	storageNodesLock.Unlock()
+}
+
+var (
+	storageNodesLock   sync.Mutex
+	globalStorageNodes *storageNodes
+)
+
+func getStorageNodes() *storageNodes {
+	storageNodesLock.Lock()
+	sns := globalStorageNodes
+	storageNodesLock.Unlock()
+	return sns
+}
+
+// storageNodes routes rows to a set of storage nodes.
+type storageNodes struct {
+	nodes []*storageNode
+}
+
+func newStorageNodes(addrs []string, sendTimeout time.Duration) *storageNodes {
+	client := &http.Client{
+		Timeout: sendTimeout,
+	}
+	sns := &storageNodes{}
+	for _, addr := range addrs {
+		sns.nodes = append(sns.nodes, newStorageNode(addr, client))
+	}
+	return sns
+}
+
+// addRows sends mrs to storage nodes.
+//
+// Rows are sent to all the nodes in parallel before returning, so the error is returned to the client if some nodes didn't accept the rows.
+// Failed sends are retried according to -insert.flushRetries until reqCtx is done. reqCtx may be nil.
+// If sync is set, then storage nodes persist the rows to disk before responding.
+func (sns *storageNodes) addRows(reqCtx context.Context, mrs []storage.MetricRow, sync bool) error {
+	nbs := getNodeBatches(len(sns.nodes))
+	defer putNodeBatches(nbs)
+	for i := range mrs {
+		mr := &mrs[i]
+		nbs.nbs[sns.getNodeIdx(mr.MetricNameRaw)].add(mr)
+	}
+	errs := make(chan error, len(sns.nodes))
+	workers := 0
+	for i, sn := range sns.nodes {
+		nb := &nbs.nbs[i]
+		if nb.rows == 0 {
+			continue
+		}
+		workers++
+		go func(sn *storageNode, nb *nodeBatch) {
+			errs <- sn.sendBatch(reqCtx, nb, sync)
+		}(sn, nb)
+	}
+	var firstErr error
+	for i := 0; i < workers; i++ {
+		if err := <-errs; err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// getNodeIdx returns the index of storage node for the series with the given metricNameRaw.
+func (sns *storageNodes) getNodeIdx(metricNameRaw []byte) int {
+	h := xxhash.Sum64(metricNameRaw)
+	return jumpHash(h, len(sns.nodes))
+}
+
+// jumpHash returns bucket in the range [0 ... buckets) for the given key.
+//
+// Only a small share of keys is moved to other buckets when the number of buckets changes.
+// See https://arxiv.org/abs/1406.2294
+func jumpHash(key uint64, buckets int) int {
+	var b int64 = -1
+	var j int64
+	for j < int64(buckets) {
+		b = j
+		key = key*2862933555777941757 + 1
+		j = int64(float64(b+1) * (float64(int64(1)<<31) / float64((key>>33)+1)))
+	}
+	return int(b)
+}
+
+// storageNode sends rows to a single storage node.
+type storageNode struct {
+	addr   string
+	url    string
+	client *http.Client
+
+	rowsSent     *metrics.Counter
+	sendRequests *metrics.Counter
+	sendErrors   *metrics.Counter
+}
+
+func newStorageNode(addr string, client *http.Client) *storageNode {
+	url := addr
+	if !strings.Contains(url, "://") {
+		url = "http://" + url
+	}
+	url = strings.TrimSuffix(url, "/") + StorageNodeInsertPath + "?authKey=" + neturl.QueryEscape(*storageNodeInsertAuthKey)
+	return &storageNode{
+		addr:   addr,
+		url:    url,
+		client: client,
+
+		rowsSent:     metrics.NewCounter(fmt.Sprintf(`vm_storage_node_rows_sent_total{addr=%q}`, addr)),
+		sendRequests: metrics.NewCounter(fmt.Sprintf(`vm_storage_node_send_requests_total{addr=%q}`, addr)),
+		sendErrors:   metrics.NewCounter(fmt.Sprintf(`vm_storage_node_send_errors_total{addr=%q}`, addr)),
+	}
+}
+
+// sendBatch sends rows from nb to sn in requests of up to maxStorageNodeBufSize bytes.
+//
+// Failed requests are retried according to -insert.flushRetries until reqCtx is done.
+func (sn *storageNode) sendBatch(reqCtx context.Context, nb *nodeBatch, sync bool) error {
+	start := 0
+	for i, end := range nb.ends {
+		data := nb.buf[start:end]
+		rows := nb.chunkRows[i]
+		err := withFlushRetries(reqCtx, func() error {
+			if err := sn.send(data, sync); err != nil {
+				sn.sendErrors.Inc()
+				return err
+			}
+			return nil
+		})
+		if err != nil {
+			err = fmt.Errorf("cannot send %d rows to -storageNode=%q: %s", rows, sn.addr, err)
+			logger.Errorf("%s", err)
+			return err
+		}
+		sn.rowsSent.Add(rows)
+		start = end
+	}
+	return nil
+}
+
+func (sn *storageNode) send(data []byte, sync bool) error {
+	sn.sendRequests.Inc()
+	url := sn.url
+	if sync {
+		url += "&sync=1"
+	}
+	req, err := http.NewRequest("POST", url, bytes.NewReader(data))
+	if err != nil {
+		logger.Panicf("BUG: cannot create request for -storageNode=%q: %s", sn.addr, err)
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+	setRequiredHeaders(req.Header)
+	resp, err := sn.client.Do(req)
+	if err != nil {
+		if ue, ok := err.(*neturl.Error); ok {
+			// Do not expose the url with authKey in logs.
+			err = ue.Err
+		}
+		return err
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	if resp.StatusCode/100 != 2 {
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("unexpected response code %d: %q", resp.StatusCode, body)
+	}
+	_, _ = io.Copy(ioutil.Discard, resp.Body)
+	return nil
+}
+
+// nodeBatch holds rows marshaled for a single storage node.
+type nodeBatch struct {
+	buf []byte
+
+	// ends contains offsets in buf for the ends of chunks sent in a single request.
+	ends []int
+
+	// chunkRows contains the number of rows per chunk.
+	chunkRows []int
+
+	rows int
+}
+
+func (nb *nodeBatch) reset() {
+	nb.buf = nb.buf[:0]
+	nb.ends = nb.ends[:0]
+	nb.chunkRows = nb.chunkRows[:0]
+	nb.rows = 0
+}
+
+// add appends mr to nb. It starts new chunk if the current chunk exceeds maxStorageNodeBufSize.
+func (nb *nodeBatch) add(mr *storage.MetricRow) {
+	n := len(nb.ends)
+	if n == 0 || len(nb.buf)-nb.chunkStart() >= maxStorageNodeBufSize {
+		nb.ends = append(nb.ends, len(nb.buf))
+		nb.chunkRows = append(nb.chunkRows, 0)
+		n++
+	}
+	nb.buf = mr.Marshal(nb.buf)
+	nb.ends[n-1] = len(nb.buf)
+	nb.chunkRows[n-1]++
+	nb.rows++
+}
+
+// chunkStart returns the offset of the current chunk in nb.buf.
+func (nb *nodeBatch) chunkStart() int {
+	if n := len(nb.ends); n > 1 {
+		return nb.ends[n-2]
+	}
+	return 0
+}
+
+// nodeBatches holds rows marshaled for every storage node.
+type nodeBatches struct {
+	nbs []nodeBatch
+}
+
+var nodeBatchesPool sync.Pool
+
+func getNodeBatches(nodes int) *nodeBatches {
+	v := nodeBatchesPool.Get()
+	if v == nil {
+		v = &nodeBatches{}
+	}
+	nbs := v.(*nodeBatches)
+	if n := nodes - cap(nbs.nbs); n > 0 {
+		nbs.nbs = append(nbs.nbs[:cap(nbs.nbs)], make([]nodeBatch, n)...)
+	}
+	nbs.nbs = nbs.nbs[:nodes]
+	return nbs
+}
+
+func putNodeBatches(nbs *nodeBatches) {
+	for i := range nbs.nbs {
+		nbs.nbs[i].reset()
+	}
+	nodeBatchesPool.Put(nbs)
+}
+
+// InsertStorageNodeHandler writes rows sent by other VictoriaMetrics instances with -storageNode to the local storage.
+//
+// The request must contain `authKey` query arg matching -storageNode.insertAuthKey.
+// The rows aren't routed to -storageNode instances of the current instance.
+// Requests with `sync=1` query arg are sent for sync inserts, so the rows are persisted to disk before returning. See FlushBufsSync.
+func InsertStorageNodeHandler(req *http.Request, maxSize int64) error {
+	authKey := *storageNodeInsertAuthKey
+	if len(authKey) == 0 {
+		return fmt.Errorf("%s is disabled; set -storageNode.insertAuthKey in order to accept rows from other instances", StorageNodeInsertPath)
+	}
+	if req.URL.Query().Get("authKey") != authKey {
+		return fmt.Errorf("invalid authKey; it must match the value from -storageNode.insertAuthKey command line flag")
+	}
+	return storageNodeConcurrencyLimiter.Do(func() error {
+		return insertStorageNodeHandlerInternal(req, maxSize)
+	})
+}
+
+var storageNodeConcurrencyLimiter = concurrencylimiter.NewLimiter("native")
+
+func insertStorageNodeHandlerInternal(req *http.Request, maxSize int64) error {
+	bb := storageNodeReadBufPool.Get()
+	defer func() {
+		ReleaseReadBuffer(bb)
+		storageNodeReadBufPool.Put(bb)
+	}()
+	reqLen, err := ReadRequestBody(bb, io.LimitReader(req.Body, maxSize+1))
+	if err != nil {
+		return fmt.Errorf("cannot read request: %s", err)
+	}
+	if reqLen > maxSize {
+		return fmt.Errorf("too big request; mustn't exceed %d bytes", maxSize)
+	}
+	mrs, err := unmarshalMetricRows(nil, bb.B)
+	if err != nil {
+		return err
+	}
+	if req.URL.Query().Get("sync") == "1" {
+		err = addRowsLocalSync(req.Context(), mrs)
+	} else {
+		err = withFlushRetries(req.Context(), func() error {
+			return addRowsLocal(mrs)
+		})
+	}
+	if err != nil {
+		return err
+	}
+	storageNodeInsertRows.Add(len(mrs))
+	return nil
+}
+
+var storageNodeReadBufPool bytesutil.ByteBufferPool
+
+// unmarshalMetricRows appends rows marshaled with storage.MetricRow.Marshal from src to dst and returns the result.
+func unmarshalMetricRows(dst []storage.MetricRow, src []byte) ([]storage.MetricRow, error) {
+	for len(src) > 0 {
+		dst = append(dst, storage.MetricRow{})
+		mr := &dst[len(dst)-1]
+		tail, err := mr.Unmarshal(src)
+		if err != nil {
+			return dst, fmt.Errorf("cannot unmarshal row #%d: %s", len(dst), err)
+		}
+		src = tail
+	}
+	return dst, nil
+}
+
+var storageNodeInsertRows = metrics.NewCounter(`vm_storage_node_insert_rows_total`)
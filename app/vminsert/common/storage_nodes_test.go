@@ -0,0 +1,319 @@
+package common
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/storage"
+)
+
+func TestJumpHash(t *testing.T) {
+	// The same key must be always mapped to the same bucket.
+	for key := uint64(0); key < 1000; key++ {
+		b := jumpHash(key, 5)
+		if b < 0 || b >= 5 {
+			t.Fatalf("unexpected bucket for key %d; got %d; want [0...5)", key, b)
+		}
+		if b2 := jumpHash(key, 5); b2 != b {
+			t.Fatalf("unstable bucket for key %d; got %d and %d", key, b, b2)
+		}
+	}
+
+	// Keys may move only to the new bucket when the number of buckets increases.
+	moved := 0
+	for key := uint64(0); key < 10000; key++ {
+		b := jumpHash(key*0x9E3779B97F4A7C15, 4)
+		b2 := jumpHash(key*0x9E3779B97F4A7C15, 5)
+		if b2 != b {
+			if b2 != 4 {
+				t.Fatalf("key %d moved from bucket %d to bucket %d instead of the new bucket 4", key, b, b2)
+			}
+			moved++
+		}
+	}
+	if moved < 1500 || moved > 2500 {
+		t.Fatalf("unexpected number of moved keys; got %d; want approximately 2000", moved)
+	}
+}
+
+func TestStringsFlag(t *testing.T) {
+	var sf stringsFlag
+	if err := sf.Set("a:1"); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if err := sf.Set("b:2, c:3"); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if s := sf.String(); s != "a:1,b:2,c:3" {
+		t.Fatalf("unexpected value; got %q; want %q", s, "a:1,b:2,c:3")
+	}
+	if err := sf.Set("d:4,,e:5"); err == nil {
+		t.Fatalf("expecting non-nil error for empty value")
+	}
+}
+
+func TestStorageNodesAddRows(t *testing.T) {
+	*storageNodeInsertAuthKey = "secret"
+	defer func() {
+		*storageNodeInsertAuthKey = ""
+	}()
+	var mu sync.Mutex
+	received := make(map[string][]storage.MetricRow)
+	newServer := func(name string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != StorageNodeInsertPath {
+				t.Errorf("unexpected path %q", r.URL.Path)
+			}
+			if authKey := r.URL.Query().Get("authKey"); authKey != "secret" {
+				t.Errorf("unexpected authKey %q", authKey)
+			}
+			data, err := ioutil.ReadAll(r.Body)
+			if err != nil {
+				t.Errorf("cannot read request: %s", err)
+			}
+			mrs, err := unmarshalMetricRows(nil, data)
+			if err != nil {
+				t.Errorf("cannot unmarshal rows: %s", err)
+			}
+			mu.Lock()
+			received[name] = append(received[name], mrs...)
+			mu.Unlock()
+			w.WriteHeader(http.StatusNoContent)
+		}))
+	}
+	s1 := newServer("s1")
+	defer s1.Close()
+	s2 := newServer("s2")
+	defer s2.Close()
+
+	sns := newStorageNodes([]string{s1.URL, s2.URL}, time.Second)
+	var mrs []storage.MetricRow
+	for i := 0; i < 100; i++ {
+		mrs = append(mrs, storage.MetricRow{
+			MetricNameRaw: []byte(fmt.Sprintf("metric_%d", i)),
+			Timestamp:     int64(i),
+			Value:         float64(i),
+		})
+	}
+	if err := sns.addRows(nil, mrs, false); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if err := sns.addRows(nil, mrs[:10], false); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	// Every series must be sent to a single node.
+	nodeNames := map[*storageNode]string{
+		sns.nodes[0]: "s1",
+		sns.nodes[1]: "s2",
+	}
+	expected := make(map[string][]storage.MetricRow)
+	for _, mr := range append(mrs, mrs[:10]...) {
+		name := nodeNames[sns.nodes[sns.getNodeIdx(mr.MetricNameRaw)]]
+		expected[name] = append(expected[name], mr)
+	}
+	if len(expected["s1"]) == 0 || len(expected["s2"]) == 0 {
+		t.Fatalf("series must be spread among all the nodes; got %d and %d rows", len(expected["s1"]), len(expected["s2"]))
+	}
+	if !reflect.DeepEqual(received, expected) {
+		t.Fatalf("unexpected rows received by storage nodes;\ngot\n%v\nwant\n%v", received, expected)
+	}
+}
+
+func TestStorageNodesSendError(t *testing.T) {
+	origBackoff := *flushRetryBackoff
+	defer func() {
+		*flushRetries = 0
+		*flushRetryBackoff = origBackoff
+	}()
+	var requests int32
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&requests, 1) <= 2 {
+			http.Error(w, "storage is unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer s.Close()
+
+	sns := newStorageNodes([]string{s.URL}, time.Second)
+	mrs := []storage.MetricRow{{
+		MetricNameRaw: []byte("foo"),
+		Timestamp:     1,
+		Value:         2,
+	}}
+
+	// The error is returned to the caller instead of dropping rows.
+	if err := sns.addRows(nil, mrs, false); err == nil {
+		t.Fatalf("expecting non-nil error")
+	}
+	sn := sns.nodes[0]
+	if n := sn.rowsSent.Get(); n != 0 {
+		t.Fatalf("unexpected number of sent rows; got %d; want 0", n)
+	}
+
+	// Failed sends are retried according to -insert.flushRetries.
+	*flushRetries = 1
+	*flushRetryBackoff = time.Millisecond
+	if err := sns.addRows(nil, mrs, false); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if n := atomic.LoadInt32(&requests); n != 3 {
+		t.Fatalf("unexpected number of requests; got %d; want 3", n)
+	}
+	if n := sn.sendErrors.Get(); n != 2 {
+		t.Fatalf("unexpected number of send errors; got %d; want 2", n)
+	}
+	if n := sn.rowsSent.Get(); n != 1 {
+		t.Fatalf("unexpected number of sent rows; got %d; want 1", n)
+	}
+}
+
+func TestNodeBatchAdd(t *testing.T) {
+	var nb nodeBatch
+	mr := &storage.MetricRow{
+		MetricNameRaw: make([]byte, maxStorageNodeBufSize/2),
+	}
+	for i := 0; i < 5; i++ {
+		nb.add(mr)
+	}
+	// Chunks are closed after they reach maxStorageNodeBufSize.
+	if len(nb.ends) != 3 || nb.ends[2] != len(nb.buf) {
+		t.Fatalf("unexpected chunk ends %v for buf of %d bytes", nb.ends, len(nb.buf))
+	}
+	if !reflect.DeepEqual(nb.chunkRows, []int{2, 2, 1}) || nb.rows != 5 {
+		t.Fatalf("unexpected rows per chunk %v; total rows %d", nb.chunkRows, nb.rows)
+	}
+	nb.reset()
+	if len(nb.buf) != 0 || len(nb.ends) != 0 || nb.rows != 0 {
+		t.Fatalf("nodeBatch must be empty after reset")
+	}
+}
+
+func TestInsertStorageNodeHandlerAuth(t *testing.T) {
+	defer func() {
+		*storageNodeInsertAuthKey = ""
+	}()
+	f := func(authKey, requestURL string) {
+		t.Helper()
+		*storageNodeInsertAuthKey = authKey
+		req := httptest.NewRequest("POST", requestURL, strings.NewReader(""))
+		if err := InsertStorageNodeHandler(req, 1024); err == nil {
+			t.Fatalf("expecting non-nil error for authKey=%q and url=%q", authKey, requestURL)
+		}
+	}
+
+	// The endpoint is disabled by default
+	f("", StorageNodeInsertPath)
+	f("", StorageNodeInsertPath+"?authKey=")
+
+	// Requests without valid authKey are rejected
+	f("secret", StorageNodeInsertPath)
+	f("secret", StorageNodeInsertPath+"?authKey=foo")
+}
+
+// testStorageNode is a storage node, which collects rows routed to it in tests.
+type testStorageNode struct {
+	s   *httptest.Server
+	sns *storageNodes
+
+	mu           sync.Mutex
+	mrs          []storage.MetricRow
+	requests     int
+	syncRequests int
+	err          error
+}
+
+var (
+	testStorageNodeOnce sync.Once
+	testNode            *testStorageNode
+)
+
+// startTestStorageNode routes all the flushed rows to the test storage node.
+//
+// The test storage node is shared among tests, since storage node metrics cannot be registered multiple times for the same address.
+// stopTestStorageNode must be called when the test is finished.
+func startTestStorageNode() *testStorageNode {
+	testStorageNodeOnce.Do(func() {
+		tsn := &testStorageNode{}
+		tsn.s = httptest.NewServer(http.HandlerFunc(tsn.handler))
+		tsn.sns = newStorageNodes([]string{tsn.s.URL}, time.Second)
+		testNode = tsn
+	})
+	tsn := testNode
+	tsn.mu.Lock()
+	tsn.mrs = nil
+	tsn.requests = 0
+	tsn.syncRequests = 0
+	tsn.err = nil
+	tsn.mu.Unlock()
+	storageNodesLock.Lock()
+	globalStorageNodes = tsn.sns
+	storageNodesLock.Unlock()
+	return tsn
+}
+
+func stopTestStorageNode() {
+	StopStorageNodes()
+}
+
+func (tsn *testStorageNode) handler(w http.ResponseWriter, r *http.Request) {
+	data, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	tsn.mu.Lock()
+	defer tsn.mu.Unlock()
+	if tsn.err != nil {
+		http.Error(w, tsn.err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	mrs, err := unmarshalMetricRows(tsn.mrs, data)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	tsn.mrs = mrs
+	tsn.requests++
+	if r.URL.Query().Get("sync") == "1" {
+		tsn.syncRequests++
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// rows returns rows received by tsn.
+func (tsn *testStorageNode) rows() []storage.MetricRow {
+	tsn.mu.Lock()
+	defer tsn.mu.Unlock()
+	return append([]storage.MetricRow{}, tsn.mrs...)
+}
+
+// requestsCount returns the number of requests accepted by tsn.
+func (tsn *testStorageNode) requestsCount() int {
+	tsn.mu.Lock()
+	defer tsn.mu.Unlock()
+	return tsn.requests
+}
+
+// syncRequestsCount returns the number of requests with `sync=1` query arg accepted by tsn.
+func (tsn *testStorageNode) syncRequestsCount() int {
+	tsn.mu.Lock()
+	defer tsn.mu.Unlock()
+	return tsn.syncRequests
+}
+
+// setError makes tsn reject requests with err if err isn't nil.
+func (tsn *testStorageNode) setError(err error) {
+	tsn.mu.Lock()
+	tsn.err = err
+	tsn.mu.Unlock()
+}
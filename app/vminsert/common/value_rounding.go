@@ -0,0 +1,47 @@
+package common
+
+import (
+	"flag"
+	"math"
+	"strconv"
+
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/bytesutil"
+	"github.com/VictoriaMetrics/metrics"
+)
+
+var significantFigures = flag.Int("insert.significantFigures", 0, "The number of significant decimal digits to round the ingested values to, for instance, `5` rounds 12.3456789 to 12.346. "+
+	"This improves compression for values with spurious precision, such as sensor readings. Subnormal values are stored as zero. "+
+	"Values are stored as is if the flag is zero or exceeds 16")
+
+// smallestNormalFloat64 is the smallest positive normal float64 value. Smaller non-zero values are subnormal.
+const smallestNormalFloat64 = 2.2250738585072014e-308
+
+// roundValue rounds v to -insert.significantFigures significant digits.
+func roundValue(v float64) float64 {
+	digits := *significantFigures
+	if digits <= 0 || digits > 16 {
+		return v
+	}
+	if v == 0 || math.IsNaN(v) || math.IsInf(v, 0) {
+		return v
+	}
+	if math.Abs(v) < smallestNormalFloat64 {
+		roundedValues.Inc()
+		return 0
+	}
+	// Round via decimal representation, since it gives the closest float64 to the rounded decimal value
+	// unlike multiplying by powers of 10.
+	var buf [32]byte
+	b := strconv.AppendFloat(buf[:0], v, 'e', digits-1, 64)
+	f, err := strconv.ParseFloat(bytesutil.ToUnsafeString(b), 64)
+	if err != nil {
+		// This shouldn't happen, since b is a valid float.
+		return v
+	}
+	if f != v {
+		roundedValues.Inc()
+	}
+	return f
+}
+
+var roundedValues = metrics.NewCounter(`vm_rounded_values_total`)
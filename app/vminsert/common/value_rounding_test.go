@@ -0,0 +1,51 @@
+package common
+
+import (
+	"math"
+	"testing"
+)
+
+func TestRoundValue(t *testing.T) {
+	defer func(n int) {
+		*significantFigures = n
+	}(*significantFigures)
+
+	f := func(digits int, v, resultExpected float64) {
+		t.Helper()
+		*significantFigures = digits
+		result := roundValue(v)
+		if math.IsNaN(resultExpected) {
+			if !math.IsNaN(result) {
+				t.Fatalf("unexpected result for %v; got %v; want NaN", v, result)
+			}
+			return
+		}
+		if result != resultExpected {
+			t.Fatalf("unexpected result for %v with %d digits; got %v; want %v", v, digits, result, resultExpected)
+		}
+	}
+
+	// Rounding is disabled
+	f(0, 12.3456789, 12.3456789)
+	f(17, 12.3456789, 12.3456789)
+	f(0, 5e-324, 5e-324)
+
+	f(5, 12.3456789, 12.346)
+	f(5, -12.3456789, -12.346)
+	f(3, 123456, 123000)
+	f(3, 0.000123456, 0.000123)
+	f(2, 0.1+0.2, 0.3)
+	f(1, 9.6, 10)
+	f(3, 1.5e300, 1.5e300)
+
+	// Special values are left as is
+	f(3, 0, 0)
+	f(3, math.Inf(1), math.Inf(1))
+	f(3, math.Inf(-1), math.Inf(-1))
+	f(3, math.NaN(), math.NaN())
+
+	// Subnormal values are stored as zero
+	f(3, 5e-324, 0)
+	f(3, -1e-310, 0)
+	f(3, 2.2250738585072014e-308, 2.23e-308)
+}
@@ -0,0 +1,163 @@
+package common
+
+import (
+	"bufio"
+	"bytes"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/bytesutil"
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/logger"
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/procutil"
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/prompb"
+	"github.com/VictoriaMetrics/metrics"
+)
+
+var valueTransformsFile = flag.String("insert.valueTransformsFile", "", "Path to file with per-metric value transforms applied to the ingested values. "+
+	"Every line must contain `metric_name scale [offset]`, so the stored value is `value*scale+offset`. "+
+	"Lines starting with # are ignored. Values for metrics missing in the file are stored as is. The file is re-read on SIGHUP")
+
+// valueTransform is a transform for metric values.
+type valueTransform struct {
+	scale  float64
+	offset float64
+}
+
+// valueTransforms contains map[string]valueTransform from -insert.valueTransformsFile.
+var valueTransforms atomic.Value
+
+// valueTransformsLoadTime is the unix timestamp in seconds for the last successful load of -insert.valueTransformsFile.
+var valueTransformsLoadTime int64
+
+var (
+	valueTransformsStopCh chan struct{}
+	valueTransformsWG     sync.WaitGroup
+)
+
+// InitValueTransforms loads -insert.valueTransformsFile and starts re-reading it on SIGHUP.
+//
+// InitValueTransforms must be called after flag.Parse call.
+func InitValueTransforms() {
+	if len(*valueTransformsFile) == 0 {
+		return
+	}
+	m, err := loadValueTransforms(*valueTransformsFile)
+	if err != nil {
+		logger.Fatalf("cannot load -insert.valueTransformsFile: %s", err)
+	}
+	valueTransforms.Store(m)
+	atomic.StoreInt64(&valueTransformsLoadTime, time.Now().Unix())
+	logger.Infof("loaded %d value transforms from %q", len(m), *valueTransformsFile)
+
+	sighupCh := procutil.NewSighupChan()
+	valueTransformsStopCh = make(chan struct{})
+	valueTransformsWG.Add(1)
+	go func() {
+		defer valueTransformsWG.Done()
+		for {
+			select {
+			case <-sighupCh:
+			case <-valueTransformsStopCh:
+				return
+			}
+			valueTransformsReloads.Inc()
+			m, err := loadValueTransforms(*valueTransformsFile)
+			if err != nil {
+				valueTransformsReloadErrors.Inc()
+				logger.Errorf("cannot reload -insert.valueTransformsFile; continuing using the previously loaded transforms: %s", err)
+				continue
+			}
+			valueTransforms.Store(m)
+			atomic.StoreInt64(&valueTransformsLoadTime, time.Now().Unix())
+			logger.Infof("reloaded %d value transforms from %q", len(m), *valueTransformsFile)
+		}
+	}()
+}
+
+// StopValueTransforms stops re-reading -insert.valueTransformsFile on SIGHUP.
+func StopValueTransforms() {
+	if valueTransformsStopCh == nil {
+		return
+	}
+	close(valueTransformsStopCh)
+	valueTransformsWG.Wait()
+	valueTransformsStopCh = nil
+}
+
+var (
+	valueTransformsReloads      = metrics.NewCounter(`vm_value_transforms_reloads_total`)
+	valueTransformsReloadErrors = metrics.NewCounter(`vm_value_transforms_reload_errors_total`)
+)
+
+func loadValueTransforms(path string) (map[string]valueTransform, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read %q: %s", path, err)
+	}
+	m, err := parseValueTransforms(data)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse %q: %s", path, err)
+	}
+	return m, nil
+}
+
+func parseValueTransforms(data []byte) (map[string]valueTransform, error) {
+	m := make(map[string]valueTransform)
+	sc := bufio.NewScanner(bytes.NewReader(data))
+	lineNum := 0
+	for sc.Scan() {
+		lineNum++
+		line := strings.TrimSpace(sc.Text())
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 && len(fields) != 3 {
+			return nil, fmt.Errorf("line %d: unexpected number of fields; got %d; want `metric_name scale [offset]`", lineNum, len(fields))
+		}
+		var vt valueTransform
+		var err error
+		if vt.scale, err = strconv.ParseFloat(fields[1], 64); err != nil {
+			return nil, fmt.Errorf("line %d: cannot parse scale: %s", lineNum, err)
+		}
+		if len(fields) == 3 {
+			if vt.offset, err = strconv.ParseFloat(fields[2], 64); err != nil {
+				return nil, fmt.Errorf("line %d: cannot parse offset: %s", lineNum, err)
+			}
+		}
+		name := fields[0]
+		if _, ok := m[name]; ok {
+			return nil, fmt.Errorf("line %d: duplicate transform for metric %q", lineNum, name)
+		}
+		m[name] = vt
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func getValueTransforms() map[string]valueTransform {
+	m, _ := valueTransforms.Load().(map[string]valueTransform)
+	return m
+}
+
+// transformValue returns value transformed according to -insert.valueTransformsFile
+// for the metric name from labels.
+func transformValue(labels []prompb.Label, value float64) float64 {
+	m := getValueTransforms()
+	if len(m) == 0 {
+		return value
+	}
+	vt, ok := m[bytesutil.ToUnsafeString(getMetricName(labels))]
+	if !ok {
+		return value
+	}
+	return value*vt.scale + vt.offset
+}
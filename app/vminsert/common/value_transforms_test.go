@@ -0,0 +1,106 @@
+package common
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestParseValueTransformsSuccess(t *testing.T) {
+	f := func(s string, mExpected map[string]valueTransform) {
+		t.Helper()
+		m, err := parseValueTransforms([]byte(s))
+		if err != nil {
+			t.Fatalf("unexpected error when parsing %q: %s", s, err)
+		}
+		if !reflect.DeepEqual(m, mExpected) {
+			t.Fatalf("unexpected transforms for %q;\ngot\n%+v\nwant\n%+v", s, m, mExpected)
+		}
+	}
+	f("", map[string]valueTransform{})
+	f("# comment\n\n", map[string]valueTransform{})
+	f("net.bytes 8", map[string]valueTransform{
+		"net.bytes": {scale: 8},
+	})
+	f("net.bytes 8\n  temp.fahrenheit 1.8 32  \n# temp.kelvin 1 273.15\n", map[string]valueTransform{
+		"net.bytes":       {scale: 8},
+		"temp.fahrenheit": {scale: 1.8, offset: 32},
+	})
+}
+
+func TestParseValueTransformsFailure(t *testing.T) {
+	f := func(s string) {
+		t.Helper()
+		if _, err := parseValueTransforms([]byte(s)); err == nil {
+			t.Fatalf("expecting non-nil error when parsing %q", s)
+		}
+	}
+	f("net.bytes")
+	f("net.bytes 8 0 1")
+	f("net.bytes foo")
+	f("net.bytes 8 foo")
+	f("net.bytes 8\nnet.bytes 16")
+}
+
+func TestLoadValueTransforms(t *testing.T) {
+	if _, err := loadValueTransforms("non-existing-file"); err == nil {
+		t.Fatalf("expecting non-nil error for missing file")
+	}
+
+	f, err := ioutil.TempFile("", "value_transforms")
+	if err != nil {
+		t.Fatalf("cannot create temporary file: %s", err)
+	}
+	defer func() {
+		_ = os.Remove(f.Name())
+	}()
+	if _, err := f.WriteString("net.bytes 8\n"); err != nil {
+		t.Fatalf("cannot write temporary file: %s", err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatalf("cannot close temporary file: %s", err)
+	}
+	m, err := loadValueTransforms(f.Name())
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	mExpected := map[string]valueTransform{
+		"net.bytes": {scale: 8},
+	}
+	if !reflect.DeepEqual(m, mExpected) {
+		t.Fatalf("unexpected transforms;\ngot\n%+v\nwant\n%+v", m, mExpected)
+	}
+}
+
+func TestInsertCtxTransformValue(t *testing.T) {
+	defer func(m map[string]valueTransform) {
+		valueTransforms.Store(m)
+	}(getValueTransforms())
+	valueTransforms.Store(map[string]valueTransform{
+		"net.bytes":       {scale: 8},
+		"temp.fahrenheit": {scale: 1.8, offset: 32},
+	})
+
+	f := func(nameLabel, metric string, valueExpected float64) {
+		t.Helper()
+		var ctx InsertCtx
+		ctx.AddLabel(nameLabel, metric)
+		ctx.AddLabel("host", "a")
+		ctx.WriteDataPoint(nil, ctx.Labels, 123, 10)
+		ctx.WriteDataPointInterned(nil, ctx.Labels, 123, 10)
+		ctx.WriteDataPointExt(nil, ctx.Labels, 123, 10)
+		for _, mr := range ctx.mrs {
+			if mr.Value != valueExpected {
+				t.Fatalf("unexpected value for %q; got %v; want %v", metric, mr.Value, valueExpected)
+			}
+		}
+	}
+	f("", "net.bytes", 80)
+	f("__name__", "net.bytes", 80)
+	f("", "temp.fahrenheit", 50)
+
+	// Unmapped metrics pass through
+	f("", "net.packets", 10)
+	f("host", "net.bytes", 10)
+}
@@ -3,14 +3,32 @@ package concurrencylimiter
 import (
 	"flag"
 	"fmt"
+	"net/http"
 	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/logger"
 	"github.com/VictoriaMetrics/VictoriaMetrics/lib/timerpool"
 	"github.com/VictoriaMetrics/metrics"
 )
 
-var maxConcurrentInserts = flag.Int("maxConcurrentInserts", runtime.GOMAXPROCS(-1)*4, "The maximum number of concurrent inserts")
+var (
+	maxConcurrentInserts            = flag.Int("maxConcurrentInserts", runtime.GOMAXPROCS(-1)*4, "The maximum number of concurrent inserts")
+	maxConcurrentInsertsPerProtocol = flag.String("maxConcurrentInsertsPerProtocol", "", "Comma-separated list of `protocol=N` pairs with the maximum number of concurrent inserts "+
+		"for the given protocols, for instance, `opentsdb-http=4,prometheus=16`. Such protocols don't contend with other protocols for -maxConcurrentInserts slots. "+
+		"Supported protocols: emf, esbulk, graphite, influx, native, opentsdb, opentsdb-http, otlp, prometheus, prometheus-text")
+	maxBypassRequestSize = flag.Int64("maxConcurrentInsertsBypassSize", 0, "Uncompressed OpenTSDB HTTP requests with Content-Length up to this size in bytes bypass "+
+		"-maxConcurrentInserts and -maxConcurrentInsertsPerProtocol limits, since they are cheap to parse. This reduces contention for fleets of agents sending tiny requests. "+
+		"The number of concurrent requests bypassing the limits is capped at 16*-maxConcurrentInserts. Keep the value small, for instance, 4096. Zero disables the bypass")
+)
+
+// maxBypassInflightFactor is the multiplier for -maxConcurrentInserts, which gives the maximum number
+// of concurrent requests bypassing the limits.
+const maxBypassInflightFactor = 16
 
 var (
 	// ch is the channel for limiting concurrent calls to Do.
@@ -26,10 +44,75 @@ var (
 // Init must be called after flag.Parse call.
 func Init() {
 	ch = make(chan struct{}, *maxConcurrentInserts)
+	limits, err := parseProtocolLimits(*maxConcurrentInsertsPerProtocol)
+	if err != nil {
+		logger.Fatalf("cannot parse -maxConcurrentInsertsPerProtocol=%q: %s", *maxConcurrentInsertsPerProtocol, err)
+	}
+	limitersLock.Lock()
+	defer limitersLock.Unlock()
+	for protocol, n := range limits {
+		l := limiters[protocol]
+		if l == nil {
+			logger.Fatalf("unsupported protocol %q in -maxConcurrentInsertsPerProtocol=%q", protocol, *maxConcurrentInsertsPerProtocol)
+		}
+		l.ch = make(chan struct{}, n)
+	}
+}
+
+// MaxConcurrentInserts returns the maximum number of concurrent inserts shared by protocols without own limits.
+func MaxConcurrentInserts() int {
+	return cap(ch)
+}
+
+// ProtocolLimits returns the maximum number of concurrent inserts for protocols with own limits.
+//
+// See -maxConcurrentInsertsPerProtocol.
+func ProtocolLimits() map[string]int {
+	limitersLock.Lock()
+	defer limitersLock.Unlock()
+	m := make(map[string]int)
+	for protocol, l := range limiters {
+		if l.ch != nil {
+			m[protocol] = cap(l.ch)
+		}
+	}
+	return m
+}
+
+// parseProtocolLimits parses comma-separated `protocol=N` pairs from s.
+func parseProtocolLimits(s string) (map[string]int, error) {
+	if len(s) == 0 {
+		return nil, nil
+	}
+	m := make(map[string]int)
+	for _, kv := range strings.Split(s, ",") {
+		n := strings.IndexByte(kv, '=')
+		if n < 0 {
+			return nil, fmt.Errorf("missing `=` in %q", kv)
+		}
+		protocol := strings.TrimSpace(kv[:n])
+		limit, err := strconv.Atoi(strings.TrimSpace(kv[n+1:]))
+		if err != nil {
+			return nil, fmt.Errorf("cannot parse limit in %q: %s", kv, err)
+		}
+		if limit <= 0 {
+			return nil, fmt.Errorf("limit must be positive in %q", kv)
+		}
+		if _, ok := m[protocol]; ok {
+			return nil, fmt.Errorf("duplicate protocol %q", protocol)
+		}
+		m[protocol] = limit
+	}
+	return m, nil
 }
 
 // Do calls f with the limited concurrency.
 func Do(f func() error) error {
+	return do(ch, f, "-maxConcurrentInserts")
+}
+
+// do calls f with the concurrency limited by ch. flagName is the flag setting cap(ch).
+func do(ch chan struct{}, f func() error, flagName string) error {
 	// Limit the number of conurrent f calls in order to prevent from excess
 	// memory usage and CPU trashing.
 	select {
@@ -53,11 +136,96 @@ func Do(f func() error) error {
 	case <-t.C:
 		timerpool.Put(t)
 		concurrencyLimitTimeout.Inc()
-		return fmt.Errorf("the server is overloaded with %d concurrent inserts; either increase -maxConcurrentInserts or reduce the load", cap(ch))
+		return fmt.Errorf("the server is overloaded with %d concurrent inserts; either increase %s or reduce the load", cap(ch), flagName)
 	}
 }
 
+// Limiter limits concurrent inserts for a single protocol.
+//
+// It uses -maxConcurrentInserts slots shared with other protocols unless the protocol limit is set
+// with -maxConcurrentInsertsPerProtocol.
+type Limiter struct {
+	// ch is nil if the protocol uses the global limit.
+	ch chan struct{}
+
+	inflight int64
+}
+
 var (
+	limitersLock sync.Mutex
+	limiters     = make(map[string]*Limiter)
+)
+
+// NewLimiter returns new Limiter for the given protocol.
+//
+// It must be called only once per protocol during package initialization, i.e. before Init call.
+func NewLimiter(protocol string) *Limiter {
+	l := &Limiter{}
+	limitersLock.Lock()
+	if limiters[protocol] != nil {
+		logger.Panicf("BUG: duplicate limiter for protocol %q", protocol)
+	}
+	limiters[protocol] = l
+	limitersLock.Unlock()
+	metrics.NewGauge(fmt.Sprintf(`vm_concurrent_insert_inflight{protocol=%q}`, protocol), func() float64 {
+		return float64(atomic.LoadInt64(&l.inflight))
+	})
+	registerLimitGauges(protocol, KindConcurrency, l.limit, l.current)
+	return l
+}
+
+// Do calls f with the concurrency limited for the protocol.
+func (l *Limiter) Do(f func() error) error {
+	g := func() error {
+		atomic.AddInt64(&l.inflight, 1)
+		err := f()
+		atomic.AddInt64(&l.inflight, -1)
+		return err
+	}
+	if l.ch == nil {
+		return Do(g)
+	}
+	return do(l.ch, g, "-maxConcurrentInsertsPerProtocol")
+}
+
+// DoRequest calls f for req with the concurrency limited for the protocol.
+//
+// Small uncompressed requests bypass the limit if -maxConcurrentInsertsBypassSize is set.
+func (l *Limiter) DoRequest(req *http.Request, f func() error) error {
+	if !canBypass(req) {
+		return l.Do(f)
+	}
+	if n := atomic.AddInt64(&bypassInflight, 1); n > int64(maxBypassInflightFactor*cap(ch)) {
+		atomic.AddInt64(&bypassInflight, -1)
+		return l.Do(f)
+	}
+	bypassedRequests.Inc()
+	atomic.AddInt64(&l.inflight, 1)
+	err := f()
+	atomic.AddInt64(&l.inflight, -1)
+	atomic.AddInt64(&bypassInflight, -1)
+	return err
+}
+
+// canBypass returns true if req may bypass concurrency limits according to -maxConcurrentInsertsBypassSize.
+//
+// Requests without Content-Length and compressed requests never bypass the limits,
+// since their size after decompression is unknown in advance.
+func canBypass(req *http.Request) bool {
+	maxSize := *maxBypassRequestSize
+	if maxSize <= 0 || req.ContentLength < 0 || req.ContentLength > maxSize {
+		return false
+	}
+	ce := req.Header.Get("Content-Encoding")
+	return len(ce) == 0 || strings.EqualFold(strings.TrimSpace(ce), "identity")
+}
+
+// bypassInflight is the number of in-flight requests bypassing concurrency limits.
+var bypassInflight int64
+
+var (
+	bypassedRequests = metrics.NewCounter(`vm_concurrent_insert_bypassed_total`)
+
 	concurrencyLimitReached = metrics.NewCounter(`vm_concurrent_insert_limit_reached_total`)
 	concurrencyLimitTimeout = metrics.NewCounter(`vm_concurrent_insert_limit_timeout_total`)
 
@@ -0,0 +1,146 @@
+package concurrencylimiter
+
+import (
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestParseProtocolLimits(t *testing.T) {
+	f := func(s string, resultExpected map[string]int) {
+		t.Helper()
+		m, err := parseProtocolLimits(s)
+		if err != nil {
+			t.Fatalf("unexpected error for %q: %s", s, err)
+		}
+		if len(m) != len(resultExpected) {
+			t.Fatalf("unexpected result for %q; got %v; want %v", s, m, resultExpected)
+		}
+		for k, v := range resultExpected {
+			if m[k] != v {
+				t.Fatalf("unexpected result for %q; got %v; want %v", s, m, resultExpected)
+			}
+		}
+	}
+	f("", nil)
+	f("influx=2", map[string]int{"influx": 2})
+	f("opentsdb-http=4, prometheus = 16", map[string]int{"opentsdb-http": 4, "prometheus": 16})
+
+	fError := func(s string) {
+		t.Helper()
+		if _, err := parseProtocolLimits(s); err == nil {
+			t.Fatalf("expecting non-nil error for %q", s)
+		}
+	}
+	fError("influx")
+	fError("influx=foo")
+	fError("influx=0")
+	fError("influx=1,influx=2")
+}
+
+func TestLimiterDo(t *testing.T) {
+	origWaitDuration := waitDuration
+	waitDuration = 10 * time.Millisecond
+	defer func() {
+		waitDuration = origWaitDuration
+	}()
+	ch = make(chan struct{}, 1)
+
+	l := &Limiter{}
+	if err := l.Do(func() error {
+		if n := atomic.LoadInt64(&l.inflight); n != 1 {
+			t.Fatalf("unexpected number of in-flight inserts; got %d; want 1", n)
+		}
+		// The global limit is shared with other protocols.
+		if err := Do(func() error { return nil }); err == nil {
+			t.Fatalf("expecting non-nil error when the global limit is reached")
+		}
+		return nil
+	}); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if n := atomic.LoadInt64(&l.inflight); n != 0 {
+		t.Fatalf("unexpected number of in-flight inserts; got %d; want 0", n)
+	}
+
+	// The protocol limit doesn't contend with the global limit.
+	l.ch = make(chan struct{}, 1)
+	if err := l.Do(func() error {
+		if err := Do(func() error { return nil }); err != nil {
+			t.Fatalf("unexpected error for the global limit: %s", err)
+		}
+		if err := l.Do(func() error { return nil }); err == nil {
+			t.Fatalf("expecting non-nil error when the protocol limit is reached")
+		}
+		return nil
+	}); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+}
+
+func TestCanBypass(t *testing.T) {
+	defer func(n int64) {
+		*maxBypassRequestSize = n
+	}(*maxBypassRequestSize)
+
+	f := func(maxSize, contentLength int64, contentEncoding string, resultExpected bool) {
+		t.Helper()
+		*maxBypassRequestSize = maxSize
+		req := httptest.NewRequest("POST", "/api/put", nil)
+		req.ContentLength = contentLength
+		if len(contentEncoding) > 0 {
+			req.Header.Set("Content-Encoding", contentEncoding)
+		}
+		if result := canBypass(req); result != resultExpected {
+			t.Fatalf("unexpected result for maxSize=%d, contentLength=%d, contentEncoding=%q; got %v; want %v",
+				maxSize, contentLength, contentEncoding, result, resultExpected)
+		}
+	}
+
+	// The bypass is disabled
+	f(0, 100, "", false)
+
+	f(4096, 0, "", true)
+	f(4096, 100, "", true)
+	f(4096, 4096, "identity", true)
+
+	// Too big request
+	f(4096, 4097, "", false)
+
+	// Unknown size
+	f(4096, -1, "", false)
+	f(4096, 100, "gzip", false)
+}
+
+func TestLimiterDoRequest(t *testing.T) {
+	origWaitDuration := waitDuration
+	waitDuration = 10 * time.Millisecond
+	defer func(n int64) {
+		waitDuration = origWaitDuration
+		*maxBypassRequestSize = n
+	}(*maxBypassRequestSize)
+	*maxBypassRequestSize = 4096
+	ch = make(chan struct{}, 1)
+
+	small := httptest.NewRequest("POST", "/api/put", strings.NewReader("[]"))
+	big := httptest.NewRequest("POST", "/api/put", strings.NewReader(strings.Repeat(" ", 5000)))
+
+	l := &Limiter{}
+	if err := l.Do(func() error {
+		// Small requests bypass the exhausted limit.
+		if err := l.DoRequest(small, func() error { return nil }); err != nil {
+			t.Fatalf("unexpected error for small request: %s", err)
+		}
+		if err := l.DoRequest(big, func() error { return nil }); err == nil {
+			t.Fatalf("expecting non-nil error for big request when the limit is reached")
+		}
+		return nil
+	}); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if n := atomic.LoadInt64(&bypassInflight); n != 0 {
+		t.Fatalf("unexpected number of in-flight bypassed requests; got %d; want 0", n)
+	}
+}
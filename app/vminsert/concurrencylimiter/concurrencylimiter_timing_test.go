@@ -0,0 +1,41 @@
+package concurrencylimiter
+
+import (
+	"fmt"
+	"net/http/httptest"
+	"runtime"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func BenchmarkLimiterDoRequestTiny(b *testing.B) {
+	for _, bypassSize := range []int64{0, 4096} {
+		b.Run(fmt.Sprintf("bypassSize_%d", bypassSize), func(b *testing.B) {
+			defer func(n int64) {
+				*maxBypassRequestSize = n
+			}(*maxBypassRequestSize)
+			*maxBypassRequestSize = bypassSize
+			ch = make(chan struct{}, runtime.GOMAXPROCS(-1))
+			l := &Limiter{}
+			req := httptest.NewRequest("POST", "/api/put", strings.NewReader(`{"metric":"foo","timestamp":1,"value":2,"tags":{"host":"a"}}`))
+			var n uint64
+			b.ReportAllocs()
+			// Simulate high rate of tiny requests from many agents.
+			b.SetParallelism(8)
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					if err := l.DoRequest(req, func() error {
+						atomic.AddUint64(&n, 1)
+						return nil
+					}); err != nil {
+						panic(fmt.Errorf("unexpected error: %s", err))
+					}
+				}
+			})
+			if atomic.LoadUint64(&n) != uint64(b.N) {
+				b.Fatalf("unexpected number of calls; got %d; want %d", n, b.N)
+			}
+		})
+	}
+}
@@ -0,0 +1,155 @@
+package concurrencylimiter
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/logger"
+	"github.com/VictoriaMetrics/metrics"
+)
+
+// Kinds of ingestion limits exposed in `vm_ingest_limit` metrics.
+const (
+	// KindConcurrency is the limit on concurrent inserts. See -maxConcurrentInserts and -maxConcurrentInsertsPerProtocol.
+	KindConcurrency = "concurrency"
+
+	// KindConnections is the limit on concurrent TCP connections, such as -opentsdb.maxConnections.
+	KindConnections = "connections"
+)
+
+// ConnLimiter limits the number of concurrent TCP connections for a single protocol.
+//
+// Connections are checked against the limit before their data is inserted, so the connection limit takes precedence
+// over concurrency limits for the protocol.
+type ConnLimiter struct {
+	conns int64
+
+	// maxConns points to the flag with the maximum number of concurrent connections. Zero means no limit.
+	maxConns *int
+
+	rejected *metrics.Counter
+}
+
+var (
+	connLimitersLock sync.Mutex
+	connLimiters     = make(map[string]*ConnLimiter)
+)
+
+// NewConnLimiter returns new ConnLimiter for the given protocol with the limit from maxConns flag.
+//
+// It must be called only once per protocol during package initialization.
+func NewConnLimiter(protocol string, maxConns *int) *ConnLimiter {
+	cl := &ConnLimiter{
+		maxConns: maxConns,
+		rejected: metrics.NewCounter(fmt.Sprintf(`vm_ingest_limit_reached_total{protocol=%q, kind=%q}`, protocol, KindConnections)),
+	}
+	connLimitersLock.Lock()
+	if connLimiters[protocol] != nil {
+		logger.Panicf("BUG: duplicate connection limiter for protocol %q", protocol)
+	}
+	connLimiters[protocol] = cl
+	connLimitersLock.Unlock()
+	registerLimitGauges(protocol, KindConnections, cl.limit, cl.current)
+	return cl
+}
+
+// Acquire registers new connection and returns true if the connection limit isn't exceeded.
+//
+// Release must be called when the accepted connection is closed. The connection must be closed
+// without calling Release if false is returned.
+func (cl *ConnLimiter) Acquire() bool {
+	n := atomic.AddInt64(&cl.conns, 1)
+	if maxConns := *cl.maxConns; maxConns > 0 && n > int64(maxConns) {
+		atomic.AddInt64(&cl.conns, -1)
+		cl.rejected.Inc()
+		return false
+	}
+	return true
+}
+
+// Release unregisters the connection registered via Acquire.
+func (cl *ConnLimiter) Release() {
+	atomic.AddInt64(&cl.conns, -1)
+}
+
+func (cl *ConnLimiter) limit() int {
+	if *cl.maxConns <= 0 {
+		return 0
+	}
+	return *cl.maxConns
+}
+
+func (cl *ConnLimiter) current() int {
+	return int(atomic.LoadInt64(&cl.conns))
+}
+
+// limit returns the maximum number of concurrent inserts for the protocol.
+func (l *Limiter) limit() int {
+	if l.ch == nil {
+		return cap(ch)
+	}
+	return cap(l.ch)
+}
+
+func (l *Limiter) current() int {
+	return int(atomic.LoadInt64(&l.inflight))
+}
+
+// registerLimitGauges registers `vm_ingest_limit` and `vm_ingest_limit_current` gauges for the given protocol and kind.
+func registerLimitGauges(protocol, kind string, limit, current func() int) {
+	metrics.NewGauge(fmt.Sprintf(`vm_ingest_limit{protocol=%q, kind=%q}`, protocol, kind), func() float64 {
+		return float64(limit())
+	})
+	metrics.NewGauge(fmt.Sprintf(`vm_ingest_limit_current{protocol=%q, kind=%q}`, protocol, kind), func() float64 {
+		return float64(current())
+	})
+}
+
+// IngestLimit is the state of a single ingestion limit.
+type IngestLimit struct {
+	Protocol string `json:"protocol"`
+	Kind     string `json:"kind"`
+
+	// Limit is the maximum value for Current. Zero means no limit.
+	Limit int `json:"limit"`
+
+	// Shared is set if the limit is shared with other protocols. See -maxConcurrentInserts.
+	Shared bool `json:"shared,omitempty"`
+
+	Current int `json:"current"`
+}
+
+// IngestLimits returns the state of concurrency and connection limits for all the protocols sorted by protocol and kind.
+func IngestLimits() []IngestLimit {
+	var lims []IngestLimit
+	limitersLock.Lock()
+	for protocol, l := range limiters {
+		lims = append(lims, IngestLimit{
+			Protocol: protocol,
+			Kind:     KindConcurrency,
+			Limit:    l.limit(),
+			Shared:   l.ch == nil,
+			Current:  l.current(),
+		})
+	}
+	limitersLock.Unlock()
+	connLimitersLock.Lock()
+	for protocol, cl := range connLimiters {
+		lims = append(lims, IngestLimit{
+			Protocol: protocol,
+			Kind:     KindConnections,
+			Limit:    cl.limit(),
+			Current:  cl.current(),
+		})
+	}
+	connLimitersLock.Unlock()
+	sort.Slice(lims, func(i, j int) bool {
+		if lims[i].Protocol != lims[j].Protocol {
+			return lims[i].Protocol < lims[j].Protocol
+		}
+		return lims[i].Kind < lims[j].Kind
+	})
+	return lims
+}
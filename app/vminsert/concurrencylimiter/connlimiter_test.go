@@ -0,0 +1,71 @@
+package concurrencylimiter
+
+import (
+	"testing"
+)
+
+func TestConnLimiter(t *testing.T) {
+	maxConns := 0
+	cl := NewConnLimiter("test-conns", &maxConns)
+
+	// Connections aren't limited by default
+	for i := 0; i < 3; i++ {
+		if !cl.Acquire() {
+			t.Fatalf("unexpected rejection for connection #%d without limit", i)
+		}
+	}
+
+	maxConns = 4
+	if !cl.Acquire() {
+		t.Fatalf("unexpected rejection below the limit")
+	}
+	if cl.Acquire() {
+		t.Fatalf("expecting rejection above the limit")
+	}
+	if n := cl.current(); n != 4 {
+		t.Fatalf("unexpected number of connections; got %d; want 4", n)
+	}
+	cl.Release()
+	if !cl.Acquire() {
+		t.Fatalf("unexpected rejection after releasing a connection")
+	}
+
+	var lim *IngestLimit
+	lims := IngestLimits()
+	for i := range lims {
+		if lims[i].Protocol == "test-conns" {
+			lim = &lims[i]
+		}
+	}
+	if lim == nil {
+		t.Fatalf("missing connection limit in %v", lims)
+	}
+	if lim.Kind != KindConnections || lim.Limit != 4 || lim.Current != 4 || lim.Shared {
+		t.Fatalf("unexpected connection limit: %+v", lim)
+	}
+}
+
+func TestIngestLimitsConcurrency(t *testing.T) {
+	ch = make(chan struct{}, 8)
+	l := NewLimiter("test-concurrency")
+	f := func(limitExpected int, sharedExpected bool) {
+		t.Helper()
+		for _, lim := range IngestLimits() {
+			if lim.Protocol != "test-concurrency" {
+				continue
+			}
+			if lim.Kind != KindConcurrency || lim.Limit != limitExpected || lim.Shared != sharedExpected {
+				t.Fatalf("unexpected concurrency limit: %+v", lim)
+			}
+			return
+		}
+		t.Fatalf("missing concurrency limit")
+	}
+
+	// The protocol uses -maxConcurrentInserts slots by default
+	f(8, true)
+
+	// The protocol limit takes precedence over -maxConcurrentInserts
+	l.ch = make(chan struct{}, 2)
+	f(2, false)
+}
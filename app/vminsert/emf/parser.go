@@ -0,0 +1,235 @@
+package emf
+
+import (
+	"math"
+	"strings"
+
+	"github.com/VictoriaMetrics/VictoriaMetrics/app/vminsert/common"
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/bytesutil"
+	"github.com/valyala/fastjson"
+)
+
+// Rows contains rows parsed from CloudWatch embedded metric format documents.
+type Rows struct {
+	Rows []Row
+
+	tagsPool []Tag
+
+	// buf holds copies of metric names and tags, since p is re-used
+	// for every document in the request.
+	buf []byte
+	p   fastjson.Parser
+}
+
+// Reset resets rs.
+func (rs *Rows) Reset() {
+	// Release references to objects, so they can be GC'ed.
+
+	for i := range rs.Rows {
+		rs.Rows[i].reset()
+	}
+	rs.Rows = rs.Rows[:0]
+
+	for i := range rs.tagsPool {
+		rs.tagsPool[i].reset()
+	}
+	rs.tagsPool = rs.tagsPool[:0]
+
+	rs.buf = rs.buf[:0]
+}
+
+// Unmarshal unmarshals newline-delimited CloudWatch embedded metric format documents from s.
+//
+// Every metric from `_aws.CloudWatchMetrics` directives is converted into a row per dimension set
+// with the value taken from the top-level document member with the metric name.
+// Arrays of values result in a row per value. Dimensions are converted into tags
+// with values from the top-level document members. `Namespace` is stored in `namespace` tag.
+// `_aws.Timestamp` is used as the timestamp for all the rows of the document.
+// Other fields are ignored.
+//
+// See https://docs.aws.amazon.com/AmazonCloudWatch/latest/monitoring/CloudWatch_Embedded_Metric_Format_Specification.html
+func (rs *Rows) Unmarshal(s string) error {
+	rs.Reset()
+	for len(s) > 0 {
+		n := strings.IndexByte(s, '\n')
+		line := s
+		if n >= 0 {
+			line = s[:n]
+			s = s[n+1:]
+		} else {
+			s = ""
+		}
+		if len(strings.TrimSpace(line)) == 0 {
+			// Skip empty line
+			continue
+		}
+		if err := rs.unmarshalDocument(line); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (rs *Rows) unmarshalDocument(line string) error {
+	v, err := rs.p.Parse(line)
+	if err != nil {
+		return common.NewParseError(common.ErrBadFormat, "cannot parse json line %q: %s", line, err)
+	}
+	o, err := v.Object()
+	if err != nil {
+		return common.NewParseError(common.ErrBadFormat, "document must be an object; got %q", line)
+	}
+	aws := o.Get("_aws")
+	if aws == nil || aws.Type() != fastjson.TypeObject {
+		return common.NewParseError(common.ErrBadFormat, "missing `_aws` object in %q", line)
+	}
+	tsv := aws.Get("Timestamp")
+	if tsv == nil {
+		return common.NewParseError(common.ErrMissingTimestamp, "missing `_aws.Timestamp` in %q", line)
+	}
+	tsf, err := tsv.Float64()
+	if err != nil || math.IsNaN(tsf) || math.IsInf(tsf, 0) {
+		return common.NewParseError(common.ErrBadTimestamp, "`_aws.Timestamp` must be a number of milliseconds; got %s", tsv)
+	}
+	timestamp := int64(tsf)
+
+	directives := aws.Get("CloudWatchMetrics")
+	if directives == nil || directives.Type() != fastjson.TypeArray {
+		return common.NewParseError(common.ErrBadFormat, "missing `_aws.CloudWatchMetrics` array in %q", line)
+	}
+	for _, d := range directives.GetArray() {
+		if err := rs.unmarshalDirective(o, d, timestamp); err != nil {
+			return common.WrapParseError(err, "cannot unmarshal `CloudWatchMetrics` directive %s in %q: %s", d, line, err)
+		}
+	}
+	return nil
+}
+
+func (rs *Rows) unmarshalDirective(o *fastjson.Object, d *fastjson.Value, timestamp int64) error {
+	if d.Type() != fastjson.TypeObject {
+		return common.NewParseError(common.ErrBadFormat, "directive must be an object")
+	}
+	namespace := d.GetStringBytes("Namespace")
+	if len(namespace) == 0 {
+		return common.NewParseError(common.ErrMissingTags, "missing `Namespace`")
+	}
+	metrics := d.Get("Metrics")
+	if metrics == nil || metrics.Type() != fastjson.TypeArray {
+		return common.NewParseError(common.ErrMissingMetric, "missing `Metrics` array")
+	}
+	var dimensionSets []*fastjson.Value
+	if dims := d.Get("Dimensions"); dims != nil {
+		if dims.Type() != fastjson.TypeArray {
+			return common.NewParseError(common.ErrBadTag, "`Dimensions` must be an array of dimension sets; got %s", dims)
+		}
+		dimensionSets = dims.GetArray()
+	}
+	if len(dimensionSets) == 0 {
+		// Store metrics without dimensions.
+		return rs.unmarshalMetrics(o, metrics, namespace, nil, timestamp)
+	}
+	for _, ds := range dimensionSets {
+		if ds.Type() != fastjson.TypeArray {
+			return common.NewParseError(common.ErrBadTag, "dimension set must be an array of dimension names; got %s", ds)
+		}
+		if err := rs.unmarshalMetrics(o, metrics, namespace, ds.GetArray(), timestamp); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (rs *Rows) unmarshalMetrics(o *fastjson.Object, metrics *fastjson.Value, namespace []byte, dims []*fastjson.Value, timestamp int64) error {
+	// Collect tags at first, since they must be shared among all the rows for the dimension set.
+	tagsStart := len(rs.tagsPool)
+	rs.tagsPool = append(rs.tagsPool, Tag{
+		Key:   "namespace",
+		Value: rs.copyString(namespace),
+	})
+	for _, dim := range dims {
+		key := dim.GetStringBytes()
+		if len(key) == 0 {
+			return common.NewParseError(common.ErrBadTag, "dimension name must be non-empty string; got %s", dim)
+		}
+		value := o.Get(bytesutil.ToUnsafeString(key))
+		if value == nil {
+			return common.NewParseError(common.ErrMissingTags, "missing value for dimension %q", key)
+		}
+		if value.Type() != fastjson.TypeString {
+			return common.NewParseError(common.ErrBadTag, "value for dimension %q must be a string; got %s", key, value)
+		}
+		rs.tagsPool = append(rs.tagsPool, Tag{
+			Key:   rs.copyString(key),
+			Value: rs.copyString(value.GetStringBytes()),
+		})
+	}
+	tags := rs.tagsPool[tagsStart:]
+	tags = tags[:len(tags):len(tags)]
+
+	for _, m := range metrics.GetArray() {
+		name := m.GetStringBytes("Name")
+		if len(name) == 0 {
+			return common.NewParseError(common.ErrMissingMetric, "missing metric `Name` in %s", m)
+		}
+		value := o.Get(bytesutil.ToUnsafeString(name))
+		if value == nil {
+			return common.NewParseError(common.ErrMissingValue, "missing value for metric %q", name)
+		}
+		metric := rs.copyString(name)
+		switch value.Type() {
+		case fastjson.TypeNumber:
+			rs.appendRow(metric, tags, value.GetFloat64(), timestamp)
+		case fastjson.TypeArray:
+			for _, item := range value.GetArray() {
+				if item.Type() != fastjson.TypeNumber {
+					return common.NewParseError(common.ErrBadValue, "values for metric %q must be numbers; got %s", name, item)
+				}
+				rs.appendRow(metric, tags, item.GetFloat64(), timestamp)
+			}
+		default:
+			return common.NewParseError(common.ErrBadValue, "value for metric %q must be a number or an array of numbers; got %s", name, value)
+		}
+	}
+	return nil
+}
+
+func (rs *Rows) appendRow(metric string, tags []Tag, value float64, timestamp int64) {
+	rs.Rows = append(rs.Rows, Row{
+		Metric:    metric,
+		Tags:      tags,
+		Value:     value,
+		Timestamp: timestamp,
+	})
+}
+
+func (rs *Rows) copyString(b []byte) string {
+	start := len(rs.buf)
+	rs.buf = append(rs.buf, b...)
+	return bytesutil.ToUnsafeString(rs.buf[start:])
+}
+
+// Row is a single datapoint extracted from CloudWatch embedded metric format document.
+type Row struct {
+	Metric    string
+	Tags      []Tag
+	Value     float64
+	Timestamp int64
+}
+
+func (r *Row) reset() {
+	r.Metric = ""
+	r.Tags = nil
+	r.Value = 0
+	r.Timestamp = 0
+}
+
+// Tag is a dimension from CloudWatch embedded metric format document.
+type Tag struct {
+	Key   string
+	Value string
+}
+
+func (t *Tag) reset() {
+	t.Key = ""
+	t.Value = ""
+}
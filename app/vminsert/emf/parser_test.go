@@ -0,0 +1,138 @@
+package emf
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/VictoriaMetrics/VictoriaMetrics/app/vminsert/common"
+)
+
+func TestRowsUnmarshalFailure(t *testing.T) {
+	f := func(s string, codeExpected error) {
+		t.Helper()
+		var rows Rows
+		err := rows.Unmarshal(s)
+		if err == nil {
+			t.Fatalf("expecting non-nil error when parsing %q", s)
+		}
+		if code := common.GetParseErrorCode(err); code != codeExpected {
+			t.Fatalf("unexpected error code for %q; got %v; want %v; err: %s", s, code, codeExpected, err)
+		}
+
+		// Try again
+		if err := rows.Unmarshal(s); err == nil {
+			t.Fatalf("expecting non-nil error when parsing %q", s)
+		}
+	}
+
+	// Invalid json
+	f("{g", common.ErrBadFormat)
+
+	// Document isn't an object
+	f("123", common.ErrBadFormat)
+
+	// Missing or invalid `_aws`
+	f(`{"x":1}`, common.ErrBadFormat)
+	f(`{"_aws":1}`, common.ErrBadFormat)
+
+	// Missing or invalid timestamp
+	f(`{"_aws":{"CloudWatchMetrics":[]}}`, common.ErrMissingTimestamp)
+	f(`{"_aws":{"Timestamp":"foo","CloudWatchMetrics":[]}}`, common.ErrBadTimestamp)
+
+	// Missing directives
+	f(`{"_aws":{"Timestamp":1}}`, common.ErrBadFormat)
+
+	// Invalid directive
+	f(`{"_aws":{"Timestamp":1,"CloudWatchMetrics":[1]}}`, common.ErrBadFormat)
+	f(`{"_aws":{"Timestamp":1,"CloudWatchMetrics":[{"Metrics":[{"Name":"x"}]}]},"x":1}`, common.ErrMissingTags)
+	f(`{"_aws":{"Timestamp":1,"CloudWatchMetrics":[{"Namespace":"ns"}]},"x":1}`, common.ErrMissingMetric)
+	f(`{"_aws":{"Timestamp":1,"CloudWatchMetrics":[{"Namespace":"ns","Metrics":[{"Unit":"Count"}]}]},"x":1}`, common.ErrMissingMetric)
+
+	// Invalid dimensions
+	f(`{"_aws":{"Timestamp":1,"CloudWatchMetrics":[{"Namespace":"ns","Dimensions":"foo","Metrics":[{"Name":"x"}]}]},"x":1}`, common.ErrBadTag)
+	f(`{"_aws":{"Timestamp":1,"CloudWatchMetrics":[{"Namespace":"ns","Dimensions":["foo"],"Metrics":[{"Name":"x"}]}]},"x":1}`, common.ErrBadTag)
+	f(`{"_aws":{"Timestamp":1,"CloudWatchMetrics":[{"Namespace":"ns","Dimensions":[["foo"]],"Metrics":[{"Name":"x"}]}]},"x":1}`, common.ErrMissingTags)
+	f(`{"_aws":{"Timestamp":1,"CloudWatchMetrics":[{"Namespace":"ns","Dimensions":[["foo"]],"Metrics":[{"Name":"x"}]}]},"x":1,"foo":2}`, common.ErrBadTag)
+
+	// Missing or invalid values
+	f(`{"_aws":{"Timestamp":1,"CloudWatchMetrics":[{"Namespace":"ns","Metrics":[{"Name":"x"}]}]}}`, common.ErrMissingValue)
+	f(`{"_aws":{"Timestamp":1,"CloudWatchMetrics":[{"Namespace":"ns","Metrics":[{"Name":"x"}]}]},"x":"1"}`, common.ErrBadValue)
+	f(`{"_aws":{"Timestamp":1,"CloudWatchMetrics":[{"Namespace":"ns","Metrics":[{"Name":"x"}]}]},"x":[1,"2"]}`, common.ErrBadValue)
+}
+
+func TestRowsUnmarshalSuccess(t *testing.T) {
+	f := func(s string, rowsExpected []Row) {
+		t.Helper()
+		var rows Rows
+		if err := rows.Unmarshal(s); err != nil {
+			t.Fatalf("cannot unmarshal %q: %s", s, err)
+		}
+		if !reflect.DeepEqual(rows.Rows, rowsExpected) {
+			t.Fatalf("unexpected rows;\ngot\n%+v;\nwant\n%+v", rows.Rows, rowsExpected)
+		}
+
+		// Try unmarshaling again
+		if err := rows.Unmarshal(s); err != nil {
+			t.Fatalf("cannot unmarshal %q: %s", s, err)
+		}
+		if !reflect.DeepEqual(rows.Rows, rowsExpected) {
+			t.Fatalf("unexpected rows on the second unmarshal;\ngot\n%+v;\nwant\n%+v", rows.Rows, rowsExpected)
+		}
+	}
+
+	// Empty input
+	f("", nil)
+	f("\n\n", nil)
+
+	// No directives
+	f(`{"_aws":{"Timestamp":1574109732004,"CloudWatchMetrics":[]},"x":1}`, nil)
+
+	// Metric without dimensions
+	f(`{"_aws":{"Timestamp":1574109732004,"CloudWatchMetrics":[{"Namespace":"ns","Metrics":[{"Name":"x"}]}]},"x":1.5}`, []Row{{
+		Metric:    "x",
+		Tags:      []Tag{{Key: "namespace", Value: "ns"}},
+		Value:     1.5,
+		Timestamp: 1574109732004,
+	}})
+
+	// Example from the spec with ignored fields
+	f(`{"_aws":{"Timestamp":1574109732004,"CloudWatchMetrics":[{"Namespace":"lambda-function-metrics",`+
+		`"Dimensions":[["functionVersion"]],"Metrics":[{"Name":"time","Unit":"Milliseconds"}]}]},`+
+		`"functionVersion":"$LATEST","time":100,"requestId":"989ffbf8-9ace-4817-a57c-e4dd734019ee"}`, []Row{{
+		Metric: "time",
+		Tags: []Tag{
+			{Key: "namespace", Value: "lambda-function-metrics"},
+			{Key: "functionVersion", Value: "$LATEST"},
+		},
+		Value:     100,
+		Timestamp: 1574109732004,
+	}})
+
+	// Multiple dimension sets, multiple metrics and array values
+	tagsService := []Tag{
+		{Key: "namespace", Value: "app"},
+		{Key: "service", Value: "api"},
+	}
+	tagsServiceHost := []Tag{
+		{Key: "namespace", Value: "app"},
+		{Key: "service", Value: "api"},
+		{Key: "host", Value: "h1"},
+	}
+	f(`{"_aws":{"Timestamp":123,"CloudWatchMetrics":[{"Namespace":"app","Dimensions":[["service"],["service","host"]],`+
+		`"Metrics":[{"Name":"latency"},{"Name":"errors"}]}]},"service":"api","host":"h1","latency":[10,20],"errors":0}`, []Row{
+		{Metric: "latency", Tags: tagsService, Value: 10, Timestamp: 123},
+		{Metric: "latency", Tags: tagsService, Value: 20, Timestamp: 123},
+		{Metric: "errors", Tags: tagsService, Value: 0, Timestamp: 123},
+		{Metric: "latency", Tags: tagsServiceHost, Value: 10, Timestamp: 123},
+		{Metric: "latency", Tags: tagsServiceHost, Value: 20, Timestamp: 123},
+		{Metric: "errors", Tags: tagsServiceHost, Value: 0, Timestamp: 123},
+	})
+
+	// Multiple documents
+	f(`{"_aws":{"Timestamp":1,"CloudWatchMetrics":[{"Namespace":"a","Metrics":[{"Name":"x"}]}]},"x":1}
+{"_aws":{"Timestamp":2,"CloudWatchMetrics":[{"Namespace":"b","Metrics":[{"Name":"y"}]}]},"y":2}
+`, []Row{
+		{Metric: "x", Tags: []Tag{{Key: "namespace", Value: "a"}}, Value: 1, Timestamp: 1},
+		{Metric: "y", Tags: []Tag{{Key: "namespace", Value: "b"}}, Value: 2, Timestamp: 2},
+	})
+}
@@ -0,0 +1,165 @@
+package emf
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"runtime"
+	"sync"
+
+	"github.com/VictoriaMetrics/VictoriaMetrics/app/vminsert/common"
+	"github.com/VictoriaMetrics/VictoriaMetrics/app/vminsert/concurrencylimiter"
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/bytesutil"
+	"github.com/VictoriaMetrics/metrics"
+)
+
+var (
+	rowsInserted  = metrics.NewCounter(`vm_rows_inserted_total{type="emf"}`)
+	rowsPerInsert = metrics.NewSummary(`vm_rows_per_insert{type="emf"}`)
+	tagsPerRow    = metrics.NewSummary(`vm_tags_per_row{type="emf"}`)
+
+	gzipRequests     = metrics.NewCounter(`vm_insert_requests_total{protocol="emf", encoding="gzip"}`)
+	identityRequests = metrics.NewCounter(`vm_insert_requests_total{protocol="emf", encoding="identity"}`)
+)
+
+var useServerTime = flag.Bool("emf.useServerTime", false, "Whether to ignore timestamps in CloudWatch embedded metric format documents "+
+	"and store all the data points with the server time instead. This may be enabled for a single request with `use_server_time=1` query arg")
+
+// InsertHandler processes newline-delimited CloudWatch embedded metric format documents.
+//
+// See https://docs.aws.amazon.com/AmazonCloudWatch/latest/monitoring/CloudWatch_Embedded_Metric_Format_Specification.html
+func InsertHandler(req *http.Request, maxSize int64) error {
+	return concurrencyLimiter.Do(func() error {
+		return insertHandlerInternal(req, maxSize)
+	})
+}
+
+func insertHandlerInternal(req *http.Request, maxSize int64) error {
+	emfReadCalls.Inc()
+
+	dr := bodyDumper.NewReader(req, req.Body)
+	defer dr.Finish()
+	r := common.NewReadTimeoutReader(dr)
+	cd, err := common.GetContentDecoder(r, req)
+	if err != nil {
+		return fmt.Errorf("cannot read encoded CloudWatch EMF data: %s", err)
+	}
+	defer common.PutContentDecoder(cd)
+	if cd.IsEncoded() {
+		gzipRequests.Inc()
+	} else {
+		identityRequests.Inc()
+	}
+	r = cd
+
+	ctx := getPushCtx()
+	defer putPushCtx(ctx)
+	ctx.Common.SetLabelOrder("emf")
+	ctx.Common.SetExtraLabels(common.GetExtraLabels(req))
+	ctx.Common.SetServerTimestamp(common.GetServerTimestamp(req, *useServerTime))
+	ctx.Common.SetContext(req.Context())
+	if err := ctx.Read(r, maxSize); err != nil {
+		return err
+	}
+	return ctx.InsertRows()
+}
+
+func (ctx *pushCtx) InsertRows() error {
+	rows := ctx.Rows.Rows
+	ic := &ctx.Common
+	if err := ic.ValidateTimestamps(len(rows), func(i int) int64 { return rows[i].Timestamp }); err != nil {
+		return err
+	}
+	ic.Reset(len(rows))
+	tagsTotal := 0
+	for i := range rows {
+		r := &rows[i]
+		tagsTotal += len(r.Tags)
+		ic.Labels = ic.Labels[:0]
+		ic.AddLabel("", r.Metric)
+		for j := range r.Tags {
+			tag := &r.Tags[j]
+			ic.AddLabel(tag.Key, tag.Value)
+		}
+		ic.WriteDataPointInterned(nil, ic.Labels, r.Timestamp, r.Value)
+	}
+	rowsInserted.Add(len(rows))
+	rowsPerInsert.Update(float64(len(rows)))
+	if len(rows) > 0 {
+		tagsPerRow.Update(float64(tagsTotal) / float64(len(rows)))
+	}
+	return ic.FlushBufs()
+}
+
+func (ctx *pushCtx) Read(r io.Reader, maxSize int64) error {
+	lr := io.LimitReader(r, maxSize+1)
+	reqLen, err := ctx.reqBuf.ReadFrom(lr)
+	maxRequestSize.Update(reqLen)
+	if err != nil {
+		emfReadErrors.Inc()
+		return fmt.Errorf("cannot read request: %s", err)
+	}
+	if reqLen > maxSize {
+		emfReadErrors.Inc()
+		return fmt.Errorf("too big request; mustn't exceed %d bytes", maxSize)
+	}
+	if err := ctx.Rows.Unmarshal(bytesutil.ToUnsafeString(ctx.reqBuf.B)); err != nil {
+		emfUnmarshalErrors.Inc()
+		emfParseErrorLogger.Log(err, ctx.reqBuf.B)
+		return fmt.Errorf("cannot unmarshal CloudWatch EMF request with size %d: %s", reqLen, err)
+	}
+	return nil
+}
+
+var (
+	emfReadCalls       = metrics.NewCounter(`vm_read_calls_total{name="emf"}`)
+	emfReadErrors      = metrics.NewCounter(`vm_read_errors_total{name="emf"}`)
+	emfUnmarshalErrors = metrics.NewCounter(`vm_unmarshal_errors_total{name="emf"}`)
+)
+
+var emfParseErrorLogger = common.NewParseErrorLogger("emf")
+
+var concurrencyLimiter = concurrencylimiter.NewLimiter("emf")
+
+var maxRequestSize = common.NewMaxRequestSize("emf")
+
+var bodyDumper = common.NewBodyDumper("emf")
+
+type pushCtx struct {
+	Rows   Rows
+	Common common.InsertCtx
+
+	reqBuf bytesutil.ByteBuffer
+}
+
+func (ctx *pushCtx) reset() {
+	ctx.Rows.Reset()
+	ctx.Common.Reset(0)
+	ctx.Common.SetContext(nil)
+	ctx.reqBuf.Reset()
+}
+
+func getPushCtx() *pushCtx {
+	select {
+	case ctx := <-pushCtxPoolCh:
+		return ctx
+	default:
+		if v := pushCtxPool.Get(); v != nil {
+			return v.(*pushCtx)
+		}
+		return &pushCtx{}
+	}
+}
+
+func putPushCtx(ctx *pushCtx) {
+	ctx.reset()
+	select {
+	case pushCtxPoolCh <- ctx:
+	default:
+		pushCtxPool.Put(ctx)
+	}
+}
+
+var pushCtxPool sync.Pool
+var pushCtxPoolCh = make(chan *pushCtx, runtime.GOMAXPROCS(-1))
@@ -0,0 +1,229 @@
+package esbulk
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/bytesutil"
+	"github.com/valyala/fastjson"
+)
+
+// Rows contains rows parsed from Elasticsearch bulk request.
+type Rows struct {
+	Rows []Row
+
+	// Items contains bulk actions for every document in the request.
+	//
+	// It is used for building Elasticsearch-compatible response.
+	Items []string
+
+	tagsPool []Tag
+
+	// buf holds copies of metric names and tags, since p is re-used
+	// for every line in the request.
+	buf    []byte
+	path   []byte
+	p      fastjson.Parser
+	action string
+}
+
+// Reset resets rs.
+func (rs *Rows) Reset() {
+	// Release references to objects, so they can be GC'ed.
+
+	for i := range rs.Rows {
+		rs.Rows[i].reset()
+	}
+	rs.Rows = rs.Rows[:0]
+
+	for i := range rs.Items {
+		rs.Items[i] = ""
+	}
+	rs.Items = rs.Items[:0]
+
+	for i := range rs.tagsPool {
+		rs.tagsPool[i].reset()
+	}
+	rs.tagsPool = rs.tagsPool[:0]
+
+	rs.buf = rs.buf[:0]
+	rs.path = rs.path[:0]
+	rs.action = ""
+}
+
+// Unmarshal unmarshals Elasticsearch bulk request from s.
+//
+// Every numeric field in the source document is converted into a row
+// with the metric name equal to the dot-separated path to the field.
+// String fields are converted into tags shared by all the rows
+// of the document. `@timestamp` field is used as the timestamp for
+// all the rows of the document. Other fields are ignored.
+//
+// See https://www.elastic.co/guide/en/elasticsearch/reference/current/docs-bulk.html
+//
+// s must be unchanged until rs is in use.
+func (rs *Rows) Unmarshal(s string) error {
+	rs.Reset()
+	for len(s) > 0 {
+		n := strings.IndexByte(s, '\n')
+		line := s
+		if n >= 0 {
+			line = s[:n]
+			s = s[n+1:]
+		} else {
+			s = ""
+		}
+		if len(strings.TrimSpace(line)) == 0 {
+			// Skip empty line
+			continue
+		}
+		if err := rs.unmarshalLine(line); err != nil {
+			return err
+		}
+	}
+	if len(rs.action) > 0 {
+		return fmt.Errorf("missing source document for %q action", rs.action)
+	}
+	return nil
+}
+
+func (rs *Rows) unmarshalLine(line string) error {
+	v, err := rs.p.Parse(line)
+	if err != nil {
+		return fmt.Errorf("cannot parse json line %q: %s", line, err)
+	}
+	if len(rs.action) > 0 {
+		// The line contains source document for the previous action.
+		if err := rs.unmarshalDocument(v); err != nil {
+			return fmt.Errorf("cannot unmarshal document %q: %s", line, err)
+		}
+		rs.Items = append(rs.Items, rs.action)
+		rs.action = ""
+		return nil
+	}
+	o, err := v.Object()
+	if err != nil || o.Len() != 1 {
+		return fmt.Errorf("action line must contain an object with a single key; got %q", line)
+	}
+	var action string
+	o.Visit(func(k []byte, _ *fastjson.Value) {
+		action = string(k)
+	})
+	switch action {
+	case "index", "create", "update":
+		rs.action = action
+	case "delete":
+		// Delete action has no source document and has no sense for metrics.
+		// Just acknowledge it.
+		rs.Items = append(rs.Items, action)
+	default:
+		return fmt.Errorf("unsupported action %q in %q", action, line)
+	}
+	return nil
+}
+
+func (rs *Rows) unmarshalDocument(v *fastjson.Value) error {
+	o, err := v.Object()
+	if err != nil {
+		return fmt.Errorf("document must be an object: %s", err)
+	}
+	if rs.action == "update" {
+		// Do not store updates.
+		return nil
+	}
+	timestamp := time.Now().UnixNano() / 1e6
+	if tsv := o.Get("@timestamp"); tsv != nil {
+		tsb := tsv.GetStringBytes()
+		if tsb == nil {
+			return fmt.Errorf("`@timestamp` field must be a string; got %s", tsv)
+		}
+		t, err := time.Parse(time.RFC3339Nano, string(tsb))
+		if err != nil {
+			return fmt.Errorf("cannot parse `@timestamp` field: %s", err)
+		}
+		timestamp = t.UnixNano() / 1e6
+	}
+
+	// Collect tags at first, since they must be shared among all the rows of the document.
+	tagsStart := len(rs.tagsPool)
+	rs.visitFields(o, func(path []byte, v *fastjson.Value) {
+		if v.Type() != fastjson.TypeString {
+			return
+		}
+		rs.tagsPool = append(rs.tagsPool, Tag{
+			Key:   rs.copyString(path),
+			Value: rs.copyString(v.GetStringBytes()),
+		})
+	})
+	var tags []Tag
+	if len(rs.tagsPool) > tagsStart {
+		tags = rs.tagsPool[tagsStart:]
+		tags = tags[:len(tags):len(tags)]
+	}
+
+	rs.visitFields(o, func(path []byte, v *fastjson.Value) {
+		if v.Type() != fastjson.TypeNumber {
+			return
+		}
+		rs.Rows = append(rs.Rows, Row{
+			Metric:    rs.copyString(path),
+			Tags:      tags,
+			Value:     v.GetFloat64(),
+			Timestamp: timestamp,
+		})
+	})
+	return nil
+}
+
+func (rs *Rows) visitFields(o *fastjson.Object, f func(path []byte, v *fastjson.Value)) {
+	prefixLen := len(rs.path)
+	o.Visit(func(k []byte, v *fastjson.Value) {
+		if prefixLen == 0 && string(k) == "@timestamp" {
+			return
+		}
+		rs.path = rs.path[:prefixLen]
+		if prefixLen > 0 {
+			rs.path = append(rs.path, '.')
+		}
+		rs.path = append(rs.path, k...)
+		if v.Type() == fastjson.TypeObject {
+			rs.visitFields(v.GetObject(), f)
+			return
+		}
+		f(rs.path, v)
+	})
+	rs.path = rs.path[:prefixLen]
+}
+
+func (rs *Rows) copyString(b []byte) string {
+	start := len(rs.buf)
+	rs.buf = append(rs.buf, b...)
+	return bytesutil.ToUnsafeString(rs.buf[start:])
+}
+
+// Row is a single datapoint extracted from Elasticsearch document.
+type Row struct {
+	Metric    string
+	Tags      []Tag
+	Value     float64
+	Timestamp int64
+}
+
+func (r *Row) reset() {
+	r.Metric = ""
+	r.Tags = nil
+	r.Value = 0
+	r.Timestamp = 0
+}
+
+// Tag is a string field from Elasticsearch document.
+type Tag struct {
+	Key   string
+	Value string
+}
+
+func (t *Tag) reset() {
+	t.Key = ""
+	t.Value = ""
+}
@@ -0,0 +1,127 @@
+package esbulk
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestRowsUnmarshalFailure(t *testing.T) {
+	f := func(s string) {
+		t.Helper()
+		var rows Rows
+		if err := rows.Unmarshal(s); err == nil {
+			t.Fatalf("expecting non-nil error when parsing %q", s)
+		}
+
+		// Try again
+		if err := rows.Unmarshal(s); err == nil {
+			t.Fatalf("expecting non-nil error when parsing %q", s)
+		}
+	}
+
+	// Invalid json
+	f("{g")
+
+	// Unsupported action
+	f(`{"foo":{}}`)
+
+	// Action with multiple keys
+	f(`{"index":{},"create":{}}`)
+
+	// Missing source document
+	f(`{"index":{}}`)
+
+	// Source document isn't an object
+	f(`{"index":{}}
+123`)
+
+	// Invalid timestamp
+	f(`{"index":{}}
+{"@timestamp":"foobar","x":1}`)
+	f(`{"index":{}}
+{"@timestamp":123,"x":1}`)
+}
+
+func TestRowsUnmarshalSuccess(t *testing.T) {
+	f := func(s string, rowsExpected *Rows) {
+		t.Helper()
+		var rows Rows
+		if err := rows.Unmarshal(s); err != nil {
+			t.Fatalf("cannot unmarshal %q: %s", s, err)
+		}
+		if !reflect.DeepEqual(rows.Rows, rowsExpected.Rows) {
+			t.Fatalf("unexpected rows;\ngot\n%+v;\nwant\n%+v", rows.Rows, rowsExpected.Rows)
+		}
+		if !reflect.DeepEqual(rows.Items, rowsExpected.Items) {
+			t.Fatalf("unexpected items;\ngot\n%q;\nwant\n%q", rows.Items, rowsExpected.Items)
+		}
+
+		// Try unmarshaling again
+		if err := rows.Unmarshal(s); err != nil {
+			t.Fatalf("cannot unmarshal %q: %s", s, err)
+		}
+		if !reflect.DeepEqual(rows.Rows, rowsExpected.Rows) {
+			t.Fatalf("unexpected rows;\ngot\n%+v;\nwant\n%+v", rows.Rows, rowsExpected.Rows)
+		}
+
+		rows.Reset()
+		if len(rows.Rows) != 0 {
+			t.Fatalf("non-empty rows after reset: %+v", rows.Rows)
+		}
+	}
+
+	// Empty body
+	f("", &Rows{})
+	f("\n\n", &Rows{})
+
+	// Metricbeat document
+	f(`{"index":{"_index":"metricbeat-7.3.0"}}
+{"@timestamp":"2019-08-20T10:00:00.123Z","metricset":{"name":"cpu"},"host":{"name":"foo"},"system":{"cpu":{"cores":4,"total":{"pct":0.25}}},"ok":true}
+`, &Rows{
+		Rows: []Row{
+			{
+				Metric: "system.cpu.cores",
+				Tags: []Tag{
+					{Key: "metricset.name", Value: "cpu"},
+					{Key: "host.name", Value: "foo"},
+				},
+				Value:     4,
+				Timestamp: 1566295200123,
+			},
+			{
+				Metric: "system.cpu.total.pct",
+				Tags: []Tag{
+					{Key: "metricset.name", Value: "cpu"},
+					{Key: "host.name", Value: "foo"},
+				},
+				Value:     0.25,
+				Timestamp: 1566295200123,
+			},
+		},
+		Items: []string{"index"},
+	})
+
+	// Multiple actions
+	f(`{"create":{}}
+{"@timestamp":"2019-08-20T10:00:00Z","x":1}
+{"delete":{"_id":"1"}}
+{"update":{"_id":"2"}}
+{"doc":{"y":2}}
+{"index":{}}
+{"@timestamp":"2019-08-20T10:00:01Z","a":"b","z":-3}`, &Rows{
+		Rows: []Row{
+			{
+				Metric:    "x",
+				Value:     1,
+				Timestamp: 1566295200000,
+			},
+			{
+				Metric:    "z",
+				Tags:      []Tag{{Key: "a", Value: "b"}},
+				Value:     -3,
+				Timestamp: 1566295201000,
+			},
+		},
+		Items: []string{"create", "delete", "update", "index"},
+	})
+}
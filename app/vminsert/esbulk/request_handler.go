@@ -0,0 +1,184 @@
+package esbulk
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"runtime"
+	"strconv"
+	"sync"
+
+	"github.com/VictoriaMetrics/VictoriaMetrics/app/vminsert/common"
+	"github.com/VictoriaMetrics/VictoriaMetrics/app/vminsert/concurrencylimiter"
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/bytesutil"
+	"github.com/VictoriaMetrics/metrics"
+)
+
+var (
+	rowsInserted  = metrics.NewCounter(`vm_rows_inserted_total{type="esbulk"}`)
+	rowsPerInsert = metrics.NewSummary(`vm_rows_per_insert{type="esbulk"}`)
+	tagsPerRow    = metrics.NewSummary(`vm_tags_per_row{type="esbulk"}`)
+)
+
+// InsertHandler processes Elasticsearch bulk requests sent by Metricbeat.
+//
+// It writes Elasticsearch-compatible response to w on success.
+//
+// See https://www.elastic.co/guide/en/elasticsearch/reference/current/docs-bulk.html
+func InsertHandler(w http.ResponseWriter, req *http.Request, maxSize int64) error {
+	return concurrencyLimiter.Do(func() error {
+		return insertHandlerInternal(w, req, maxSize)
+	})
+}
+
+func insertHandlerInternal(w http.ResponseWriter, req *http.Request, maxSize int64) error {
+	esbulkReadCalls.Inc()
+
+	dr := bodyDumper.NewReader(req, req.Body)
+	defer dr.Finish()
+	r := common.NewReadTimeoutReader(dr)
+	cd, err := common.GetContentDecoder(r, req)
+	if err != nil {
+		return fmt.Errorf("cannot read encoded Elasticsearch bulk data: %s", err)
+	}
+	defer common.PutContentDecoder(cd)
+	r = cd
+
+	ctx := getPushCtx()
+	defer putPushCtx(ctx)
+	ctx.Common.SetLabelOrder("esbulk")
+	ctx.Common.SetExtraLabels(common.GetExtraLabels(req))
+	ctx.Common.SetContext(req.Context())
+	if err := ctx.Read(r, maxSize); err != nil {
+		return err
+	}
+	if err := ctx.InsertRows(); err != nil {
+		return err
+	}
+	common.WriteJSONResponse(w, req, marshalBulkResponse(nil, ctx.Rows.Items))
+	return nil
+}
+
+// marshalBulkResponse appends bulk API response for the given items to dst and returns the result.
+func marshalBulkResponse(dst []byte, items []string) []byte {
+	dst = append(dst, `{"took":0,"errors":false,"items":[`...)
+	for i, action := range items {
+		if i > 0 {
+			dst = append(dst, ',')
+		}
+		status := 201
+		if action == "update" || action == "delete" {
+			status = 200
+		}
+		dst = append(dst, `{"`...)
+		dst = append(dst, action...)
+		dst = append(dst, `":{"status":`...)
+		dst = strconv.AppendInt(dst, int64(status), 10)
+		dst = append(dst, "}}"...)
+	}
+	dst = append(dst, "]}"...)
+	return dst
+}
+
+func (ctx *pushCtx) InsertRows() error {
+	rows := ctx.Rows.Rows
+	ic := &ctx.Common
+	if err := ic.ValidateTimestamps(len(rows), func(i int) int64 { return rows[i].Timestamp }); err != nil {
+		return err
+	}
+	ic.Reset(len(rows))
+	tagsTotal := 0
+	for i := range rows {
+		r := &rows[i]
+		tagsTotal += len(r.Tags)
+		ic.Labels = ic.Labels[:0]
+		ic.AddLabel("", r.Metric)
+		for j := range r.Tags {
+			tag := &r.Tags[j]
+			ic.AddLabel(tag.Key, tag.Value)
+		}
+		ic.WriteDataPointInterned(nil, ic.Labels, r.Timestamp, r.Value)
+	}
+	rowsInserted.Add(len(rows))
+	rowsPerInsert.Update(float64(len(rows)))
+	if len(rows) > 0 {
+		tagsPerRow.Update(float64(tagsTotal) / float64(len(rows)))
+	}
+	return ic.FlushBufs()
+}
+
+func (ctx *pushCtx) Read(r io.Reader, maxSize int64) error {
+	lr := io.LimitReader(r, maxSize+1)
+	reqLen, err := ctx.reqBuf.ReadFrom(lr)
+	maxRequestSize.Update(reqLen)
+	if err != nil {
+		esbulkReadErrors.Inc()
+		return fmt.Errorf("cannot read request: %s", err)
+	}
+	if reqLen > maxSize {
+		esbulkReadErrors.Inc()
+		// reqLen is the lower bound for the dropped data size, since the rest of the request isn't read.
+		rejectedRequestBytes.Add(int(reqLen))
+		return fmt.Errorf("too big packed request; mustn't exceed %d bytes", maxSize)
+	}
+	if err := ctx.Rows.Unmarshal(bytesutil.ToUnsafeString(ctx.reqBuf.B)); err != nil {
+		esbulkUnmarshalErrors.Inc()
+		esbulkParseErrorLogger.Log(err, ctx.reqBuf.B)
+		return fmt.Errorf("cannot unmarshal Elasticsearch bulk request with size %d: %s", reqLen, err)
+	}
+	return nil
+}
+
+var (
+	esbulkReadCalls       = metrics.NewCounter(`vm_read_calls_total{name="esbulk"}`)
+	esbulkReadErrors      = metrics.NewCounter(`vm_read_errors_total{name="esbulk"}`)
+	esbulkUnmarshalErrors = metrics.NewCounter(`vm_unmarshal_errors_total{name="esbulk"}`)
+
+	rejectedRequestBytes = metrics.NewCounter(`vm_rejected_request_bytes_total{protocol="esbulk"}`)
+)
+
+var esbulkParseErrorLogger = common.NewParseErrorLogger("esbulk")
+
+var concurrencyLimiter = concurrencylimiter.NewLimiter("esbulk")
+
+var maxRequestSize = common.NewMaxRequestSize("esbulk")
+
+var bodyDumper = common.NewBodyDumper("esbulk")
+
+type pushCtx struct {
+	Rows   Rows
+	Common common.InsertCtx
+
+	reqBuf bytesutil.ByteBuffer
+}
+
+func (ctx *pushCtx) reset() {
+	ctx.Rows.Reset()
+	ctx.Common.Reset(0)
+	ctx.Common.SetContext(nil)
+	ctx.reqBuf.Reset()
+}
+
+func getPushCtx() *pushCtx {
+	select {
+	case ctx := <-pushCtxPoolCh:
+		return ctx
+	default:
+		if v := pushCtxPool.Get(); v != nil {
+			return v.(*pushCtx)
+		}
+		return &pushCtx{}
+	}
+}
+
+func putPushCtx(ctx *pushCtx) {
+	ctx.reset()
+	select {
+	case pushCtxPoolCh <- ctx:
+	default:
+		pushCtxPool.Put(ctx)
+	}
+}
+
+var pushCtxPool sync.Pool
+var pushCtxPoolCh = make(chan *pushCtx, runtime.GOMAXPROCS(-1))
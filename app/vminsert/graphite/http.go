@@ -0,0 +1,54 @@
+package graphite
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/VictoriaMetrics/VictoriaMetrics/app/vminsert/common"
+	"github.com/VictoriaMetrics/metrics"
+)
+
+var (
+	gzipRequests     = metrics.NewCounter(`vm_insert_requests_total{protocol="graphite-http", encoding="gzip"}`)
+	identityRequests = metrics.NewCounter(`vm_insert_requests_total{protocol="graphite-http", encoding="identity"}`)
+)
+
+var bodyDumper = common.NewBodyDumper("graphite-http")
+
+// InsertHTTPHandler processes graphite plaintext protocol lines sent in HTTP request body.
+//
+// This is useful for environments, which cannot send data to arbitrary TCP ports.
+func InsertHTTPHandler(req *http.Request) error {
+	return concurrencyLimiter.Do(func() error {
+		return insertHTTPHandlerInternal(req)
+	})
+}
+
+func insertHTTPHandlerInternal(req *http.Request) error {
+	dr := bodyDumper.NewReader(req, req.Body)
+	defer dr.Finish()
+	r := common.NewReadTimeoutReader(dr)
+	cd, err := common.GetContentDecoder(r, req)
+	if err != nil {
+		return fmt.Errorf("cannot read encoded graphite plaintext protocol data: %s", err)
+	}
+	defer common.PutContentDecoder(cd)
+	if cd.IsEncoded() {
+		gzipRequests.Inc()
+	} else {
+		identityRequests.Inc()
+	}
+	r = cd
+
+	ctx := getPushCtx()
+	defer putPushCtx(ctx)
+	ctx.Common.SetLabelOrder("graphite")
+	ctx.Common.SetExtraLabels(common.GetExtraLabels(req))
+	ctx.Common.SetContext(req.Context())
+	for ctx.Read(r) {
+		if err := ctx.InsertRows(); err != nil {
+			return err
+		}
+	}
+	return ctx.Error()
+}
@@ -0,0 +1,83 @@
+package graphite
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/VictoriaMetrics/VictoriaMetrics/app/vminsert/common"
+)
+
+func TestPushCtxReadMultiLineBody(t *testing.T) {
+	f := func(r io.Reader, rowsExpected []Row) {
+		t.Helper()
+		ctx := getPushCtx()
+		defer putPushCtx(ctx)
+		var rows []Row
+		for ctx.Read(r) {
+			for _, row := range ctx.Rows.Rows {
+				// Copy the row, since it refers to ctx buffers, which are re-used by the next Read call.
+				row.Metric = copyString(row.Metric)
+				var tags []Tag
+				for _, tag := range row.Tags {
+					tags = append(tags, Tag{
+						Key:   copyString(tag.Key),
+						Value: copyString(tag.Value),
+					})
+				}
+				row.Tags = tags
+				rows = append(rows, row)
+			}
+		}
+		if err := ctx.Error(); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if !reflect.DeepEqual(rows, rowsExpected) {
+			t.Fatalf("unexpected rows;\ngot\n%+v;\nwant\n%+v", rows, rowsExpected)
+		}
+	}
+
+	const body = "foo.bar 1.5 1000\n\nbaz;env=prod;dc=a 2 1001\nqux 3 1002"
+	rowsExpected := []Row{
+		{Metric: "foo.bar", Value: 1.5, Timestamp: 1000000},
+		{Metric: "baz", Tags: []Tag{{Key: "env", Value: "prod"}, {Key: "dc", Value: "a"}}, Value: 2, Timestamp: 1001000},
+		{Metric: "qux", Value: 3, Timestamp: 1002000},
+	}
+
+	// Plain body
+	f(strings.NewReader(body), rowsExpected)
+
+	// Gzipped body
+	var bb bytes.Buffer
+	zw := gzip.NewWriter(&bb)
+	if _, err := zw.Write([]byte(body)); err != nil {
+		t.Fatalf("cannot compress body: %s", err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatalf("cannot close gzip writer: %s", err)
+	}
+	zr, err := common.GetGzipReader(&bb)
+	if err != nil {
+		t.Fatalf("cannot read gzipped body: %s", err)
+	}
+	defer common.PutGzipReader(zr)
+	f(zr, rowsExpected)
+}
+
+func TestPushCtxReadMultiLineBodyFailure(t *testing.T) {
+	ctx := getPushCtx()
+	defer putPushCtx(ctx)
+	r := strings.NewReader("foo.bar 1 1000\nbaz\nqux 3 1002\n")
+	for ctx.Read(r) {
+	}
+	if err := ctx.Error(); err == nil {
+		t.Fatalf("expecting non-nil error for invalid line")
+	}
+}
+
+func copyString(s string) string {
+	return string(append([]byte{}, s...))
+}
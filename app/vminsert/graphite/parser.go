@@ -37,6 +37,7 @@ func (rs *Rows) Reset() {
 func (rs *Rows) Unmarshal(s string) error {
 	var err error
 	rs.Rows, rs.tagsPool, err = unmarshalRows(rs.Rows[:0], s, rs.tagsPool[:0])
+	tagsPoolStats.Update(len(rs.tagsPool), cap(rs.tagsPool))
 	if err != nil {
 		return err
 	}
@@ -17,13 +17,14 @@ import (
 var (
 	rowsInserted  = metrics.NewCounter(`vm_rows_inserted_total{type="graphite"}`)
 	rowsPerInsert = metrics.NewSummary(`vm_rows_per_insert{type="graphite"}`)
+	tagsPerRow    = metrics.NewSummary(`vm_tags_per_row{type="graphite"}`)
 )
 
 // insertHandler processes remote write for graphite plaintext protocol.
 //
 // See https://graphite.readthedocs.io/en/latest/feeding-carbon.html#the-plaintext-protocol
 func insertHandler(r io.Reader) error {
-	return concurrencylimiter.Do(func() error {
+	return concurrencyLimiter.Do(func() error {
 		return insertHandlerInternal(r)
 	})
 }
@@ -31,6 +32,7 @@ func insertHandler(r io.Reader) error {
 func insertHandlerInternal(r io.Reader) error {
 	ctx := getPushCtx()
 	defer putPushCtx(ctx)
+	ctx.Common.SetLabelOrder("graphite")
 	for ctx.Read(r) {
 		if err := ctx.InsertRows(); err != nil {
 			return err
@@ -43,8 +45,10 @@ func (ctx *pushCtx) InsertRows() error {
 	rows := ctx.Rows.Rows
 	ic := &ctx.Common
 	ic.Reset(len(rows))
+	tagsTotal := 0
 	for i := range rows {
 		r := &rows[i]
+		tagsTotal += len(r.Tags)
 		ic.Labels = ic.Labels[:0]
 		ic.AddLabel("", r.Metric)
 		for j := range r.Tags {
@@ -55,6 +59,9 @@ func (ctx *pushCtx) InsertRows() error {
 	}
 	rowsInserted.Add(len(rows))
 	rowsPerInsert.Update(float64(len(rows)))
+	if len(rows) > 0 {
+		tagsPerRow.Update(float64(tagsTotal) / float64(len(rows)))
+	}
 	return ic.FlushBufs()
 }
 
@@ -87,6 +94,7 @@ func (ctx *pushCtx) Read(r io.Reader) bool {
 	}
 	if err := ctx.Rows.Unmarshal(bytesutil.ToUnsafeString(ctx.reqBuf)); err != nil {
 		graphiteUnmarshalErrors.Inc()
+		graphiteParseErrorLogger.Log(err, ctx.reqBuf)
 		ctx.err = fmt.Errorf("cannot unmarshal graphite plaintext protocol data with size %d: %s", len(ctx.reqBuf), err)
 		return false
 	}
@@ -129,6 +137,7 @@ func (ctx *pushCtx) Error() error {
 func (ctx *pushCtx) reset() {
 	ctx.Rows.Reset()
 	ctx.Common.Reset(0)
+	ctx.Common.SetContext(nil)
 	ctx.reqBuf = ctx.reqBuf[:0]
 	ctx.tailBuf = ctx.tailBuf[:0]
 
@@ -141,6 +150,12 @@ var (
 	graphiteUnmarshalErrors = metrics.NewCounter(`vm_unmarshal_errors_total{name="graphite"}`)
 )
 
+var graphiteParseErrorLogger = common.NewParseErrorLogger("graphite")
+
+var concurrencyLimiter = concurrencylimiter.NewLimiter("graphite")
+
+var tagsPoolStats = common.NewTagsPoolStats("graphite")
+
 func getPushCtx() *pushCtx {
 	select {
 	case ctx := <-pushCtxPoolCh:
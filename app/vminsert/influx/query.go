@@ -0,0 +1,19 @@
+package influx
+
+import (
+	"net/http"
+
+	"github.com/VictoriaMetrics/VictoriaMetrics/app/vminsert/common"
+)
+
+// emptyQueryResponse is the response for InfluxDB query API requests.
+const emptyQueryResponse = `{"results":[{"series":[{"values":[]}]}]}`
+
+// QueryHandler emulates empty response for InfluxDB query API at /query.
+//
+// This is required for TSBS benchmark and for clients, which query the database before writing data.
+// Some client libraries refuse parsing the response without `application/json` Content-Type,
+// so it is set explicitly. It may be overridden with -insert.jsonContentTypes.
+func QueryHandler(w http.ResponseWriter, req *http.Request) {
+	common.WriteJSONResponse(w, req, []byte(emptyQueryResponse))
+}
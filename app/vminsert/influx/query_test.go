@@ -0,0 +1,20 @@
+package influx
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestQueryHandler(t *testing.T) {
+	w := httptest.NewRecorder()
+	QueryHandler(w, httptest.NewRequest("GET", "/query?q=show+databases", nil))
+	if w.Code != 200 {
+		t.Fatalf("unexpected status code; got %d; want 200", w.Code)
+	}
+	if contentType := w.Header().Get("Content-Type"); contentType != "application/json" {
+		t.Fatalf("unexpected Content-Type; got %q; want %q", contentType, "application/json")
+	}
+	if body := w.Body.String(); body != emptyQueryResponse {
+		t.Fatalf("unexpected response body; got %q; want %q", body, emptyQueryResponse)
+	}
+}
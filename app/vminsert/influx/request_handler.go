@@ -1,7 +1,6 @@
 package influx
 
 import (
-	"compress/gzip"
 	"flag"
 	"fmt"
 	"io"
@@ -20,18 +19,21 @@ import (
 var (
 	measurementFieldSeparator = flag.String("influxMeasurementFieldSeparator", "_", "Separator for `{measurement}{separator}{field_name}` metric name when inserted via Influx line protocol")
 	skipSingleField           = flag.Bool("influxSkipSingleField", false, "Uses `{measurement}` instead of `{measurement}{separator}{field_name}` for metic name if Influx line contains only a single field")
+	useServerTime             = flag.Bool("influxUseServerTime", false, "Whether to ignore timestamps in Influx line protocol requests and store all the data points with the server time instead. "+
+		"This may be enabled for a single request with `use_server_time=1` query arg")
 )
 
 var (
 	rowsInserted  = metrics.NewCounter(`vm_rows_inserted_total{type="influx"}`)
 	rowsPerInsert = metrics.NewSummary(`vm_rows_per_insert{type="influx"}`)
+	tagsPerRow    = metrics.NewSummary(`vm_tags_per_row{type="influx"}`)
 )
 
 // InsertHandler processes remote write for influx line protocol.
 //
 // See https://github.com/influxdata/influxdb/blob/4cbdc197b8117fee648d62e2e5be75c6575352f0/tsdb/README.md
 func InsertHandler(req *http.Request) error {
-	return concurrencylimiter.Do(func() error {
+	return concurrencyLimiter.Do(func() error {
 		return insertHandlerInternal(req)
 	})
 }
@@ -39,16 +41,27 @@ func InsertHandler(req *http.Request) error {
 func insertHandlerInternal(req *http.Request) error {
 	influxReadCalls.Inc()
 
-	r := req.Body
-	if req.Header.Get("Content-Encoding") == "gzip" {
-		zr, err := getGzipReader(r)
-		if err != nil {
-			return fmt.Errorf("cannot read gzipped influx line protocol data: %s", err)
-		}
-		defer putGzipReader(zr)
-		r = zr
+	dr := bodyDumper.NewReader(req, req.Body)
+	defer dr.Finish()
+	var r io.Reader = dr
+	cd, err := common.GetContentDecoder(r, req)
+	if err != nil {
+		return fmt.Errorf("cannot read encoded influx line protocol data: %s", err)
 	}
+	defer common.PutContentDecoder(cd)
+	return insertReader(req, cd)
+}
 
+// InsertReader processes Influx line protocol data from r.
+//
+// r must contain decoded data, for instance, a file from multipart request. Query args and headers are taken from req.
+func InsertReader(req *http.Request, r io.Reader) error {
+	return concurrencyLimiter.Do(func() error {
+		return insertReader(req, r)
+	})
+}
+
+func insertReader(req *http.Request, r io.Reader) error {
 	q := req.URL.Query()
 	tsMultiplier := int64(1e6)
 	switch q.Get("precision") {
@@ -71,6 +84,10 @@ func insertHandlerInternal(req *http.Request) error {
 
 	ctx := getPushCtx()
 	defer putPushCtx(ctx)
+	ctx.Common.SetLabelOrder("influx")
+	ctx.Common.SetExtraLabels(common.GetExtraLabels(req))
+	ctx.Common.SetServerTimestamp(common.GetServerTimestamp(req, *useServerTime))
+	ctx.Common.SetContext(req.Context())
 	for ctx.Read(r, tsMultiplier) {
 		if err := ctx.InsertRows(db); err != nil {
 			return err
@@ -88,15 +105,17 @@ func (ctx *pushCtx) InsertRows(db string) error {
 	ic := &ctx.Common
 	ic.Reset(rowsLen)
 	rowsTotal := 0
+	tagsTotal := 0
 	for i := range rows {
 		r := &rows[i]
+		tagsTotal += len(r.Tags)
 		ic.Labels = ic.Labels[:0]
 		ic.AddLabel("db", db)
 		for j := range r.Tags {
 			tag := &r.Tags[j]
 			ic.AddLabel(tag.Key, tag.Value)
 		}
-		ctx.metricNameBuf = storage.MarshalMetricNameRaw(ctx.metricNameBuf[:0], ic.Labels)
+		ctx.metricNameBuf = storage.MarshalMetricNameRaw(ctx.metricNameBuf[:0], ic.ApplyExtraLabels(ic.Labels))
 		ctx.metricGroupBuf = append(ctx.metricGroupBuf[:0], r.Measurement...)
 		skipFieldKey := len(r.Fields) == 1 && *skipSingleField
 		if !skipFieldKey {
@@ -117,28 +136,12 @@ func (ctx *pushCtx) InsertRows(db string) error {
 	}
 	rowsInserted.Add(rowsTotal)
 	rowsPerInsert.Update(float64(rowsTotal))
-	return ic.FlushBufs()
-}
-
-func getGzipReader(r io.Reader) (*gzip.Reader, error) {
-	v := gzipReaderPool.Get()
-	if v == nil {
-		return gzip.NewReader(r)
+	if len(rows) > 0 {
+		tagsPerRow.Update(float64(tagsTotal) / float64(len(rows)))
 	}
-	zr := v.(*gzip.Reader)
-	if err := zr.Reset(r); err != nil {
-		return nil, err
-	}
-	return zr, nil
-}
-
-func putGzipReader(zr *gzip.Reader) {
-	_ = zr.Close()
-	gzipReaderPool.Put(zr)
+	return ic.FlushBufs()
 }
 
-var gzipReaderPool sync.Pool
-
 func (ctx *pushCtx) Read(r io.Reader, tsMultiplier int64) bool {
 	if ctx.err != nil {
 		return false
@@ -153,6 +156,7 @@ func (ctx *pushCtx) Read(r io.Reader, tsMultiplier int64) bool {
 	}
 	if err := ctx.Rows.Unmarshal(bytesutil.ToUnsafeString(ctx.reqBuf)); err != nil {
 		influxUnmarshalErrors.Inc()
+		influxParseErrorLogger.Log(err, ctx.reqBuf)
 		ctx.err = fmt.Errorf("cannot unmarshal influx line protocol data with size %d: %s", len(ctx.reqBuf), err)
 		return false
 	}
@@ -189,6 +193,14 @@ var (
 	influxUnmarshalErrors = metrics.NewCounter(`vm_unmarshal_errors_total{name="influx"}`)
 )
 
+var influxParseErrorLogger = common.NewParseErrorLogger("influx")
+
+var concurrencyLimiter = concurrencylimiter.NewLimiter("influx")
+
+var bodyDumper = common.NewBodyDumper("influx")
+
+var tagsPoolStats = common.NewTagsPoolStats("influx")
+
 type pushCtx struct {
 	Rows   Rows
 	Common common.InsertCtx
@@ -211,6 +223,7 @@ func (ctx *pushCtx) Error() error {
 func (ctx *pushCtx) reset() {
 	ctx.Rows.Reset()
 	ctx.Common.Reset(0)
+	ctx.Common.SetContext(nil)
 
 	ctx.reqBuf = ctx.reqBuf[:0]
 	ctx.tailBuf = ctx.tailBuf[:0]
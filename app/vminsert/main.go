@@ -1,36 +1,76 @@
 package vminsert
 
 import (
+	"encoding/json"
 	"flag"
 	"fmt"
 	opentsdbhttp "github.com/VictoriaMetrics/VictoriaMetrics/app/vminsert/opentsdb-http"
 	"net/http"
 	"strings"
+	"sync/atomic"
 
+	"github.com/VictoriaMetrics/VictoriaMetrics/app/vminsert/common"
 	"github.com/VictoriaMetrics/VictoriaMetrics/app/vminsert/concurrencylimiter"
+	"github.com/VictoriaMetrics/VictoriaMetrics/app/vminsert/emf"
+	"github.com/VictoriaMetrics/VictoriaMetrics/app/vminsert/esbulk"
 	"github.com/VictoriaMetrics/VictoriaMetrics/app/vminsert/graphite"
 	"github.com/VictoriaMetrics/VictoriaMetrics/app/vminsert/influx"
 	"github.com/VictoriaMetrics/VictoriaMetrics/app/vminsert/opentsdb"
+	"github.com/VictoriaMetrics/VictoriaMetrics/app/vminsert/otlp"
 	"github.com/VictoriaMetrics/VictoriaMetrics/app/vminsert/prometheus"
+	prometheustext "github.com/VictoriaMetrics/VictoriaMetrics/app/vminsert/prometheus-text"
 	"github.com/VictoriaMetrics/VictoriaMetrics/lib/httpserver"
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/logger"
 	"github.com/VictoriaMetrics/metrics"
 )
 
 var (
-	graphiteListenAddr   = flag.String("graphiteListenAddr", "", "TCP and UDP address to listen for Graphite plaintext data. Usually :2003 must be set. Doesn't work if empty")
-	opentsdbListenAddr   = flag.String("opentsdbListenAddr", "", "TCP and UDP address to listen for OpentTSDB put messages. Usually :4242 must be set. Doesn't work if empty")
+	graphiteListenAddr = flag.String("graphiteListenAddr", "", "TCP and UDP address to listen for Graphite plaintext data. Usually :2003 must be set. Doesn't work if empty")
+	opentsdbListenAddr = flag.String("opentsdbListenAddr", "", "TCP and UDP address to listen for OpentTSDB put messages. Usually :4242 must be set. Doesn't work if empty. "+
+		"Multiple comma-separated addresses may be set. Every address may be prefixed with `name=` such as `internal=:4242,dmz=:4243`. "+
+		"The name is added as `listener` label to per-listener metrics such as vm_rows_inserted_total")
+	graphiteHTTPPath     = flag.String("graphiteHTTPPath", "/api/graphite/write", "HTTP path for accepting Graphite plaintext data in request body. Disabled if empty")
+	emfHTTPPath          = flag.String("emfHTTPPath", "/api/v1/import/emf", "HTTP path for accepting AWS CloudWatch embedded metric format documents in request body. Disabled if empty")
+	otlpGRPCListenAddr   = flag.String("otlp.grpcListenAddr", "", "TCP address to listen for OpenTelemetry OTLP/gRPC metrics. Usually :4317 must be set. Plaintext HTTP/2 (h2c) is served unless -otlp.grpcTLS* flags are set. Doesn't work if empty")
 	maxInsertRequestSize = flag.Int("maxInsertRequestSize", 32*1024*1024, "The maximum size of a single insert request in bytes")
+	insertAdminAuthKey   = flag.String("insertAdminAuthKey", "", "authKey, which must be passed in query string to /admin/insert/* and /debug/insert/config pages. These pages are disabled if empty")
 )
 
+var debugListenAddr = flag.String("debug.insertListenAddr", "", "TCP address to listen for debug requests returning parse stats, per-protocol parse errors, top metrics "+
+	"and tagsPool stats in JSON at /debug/insert. This keeps the debug view off the ingestion port. "+
+	"Tracking top metrics adds small overhead per ingested row. Doesn't work if empty")
+
 // Init initializes vminsert.
 func Init() {
 	concurrencylimiter.Init()
+	common.InitInsertBuffer()
+	common.InitFlushCoalescer()
+	common.InitStorageNodes()
+	common.InitMirror()
+	common.InitExtraLabels()
+	common.InitContentTypes()
+	common.InitRequiredHeaders()
+	common.InitBodyDumps()
+	common.InitValueTransforms()
+	common.InitMetricFilters()
+	common.InitMetricNameExtract()
+	common.InitAuditLog()
+	common.InitLabelOrder()
+	common.InitExemplars()
+	opentsdb.InitFlags()
+	opentsdbhttp.InitFlags()
 	if len(*graphiteListenAddr) > 0 {
 		go graphite.Serve(*graphiteListenAddr)
 	}
 	if len(*opentsdbListenAddr) > 0 {
 		go opentsdb.Serve(*opentsdbListenAddr)
 	}
+	if len(*otlpGRPCListenAddr) > 0 {
+		go otlp.ServeGRPC(*otlpGRPCListenAddr, int64(*maxInsertRequestSize))
+	}
+	if len(*debugListenAddr) > 0 {
+		go common.ServeDebug(*debugListenAddr)
+	}
 }
 
 // Stop stops vminsert.
@@ -41,17 +81,108 @@ func Stop() {
 	if len(*opentsdbListenAddr) > 0 {
 		opentsdb.Stop()
 	}
+	if len(*otlpGRPCListenAddr) > 0 {
+		otlp.StopGRPC()
+	}
+	if len(*debugListenAddr) > 0 {
+		common.StopDebug()
+	}
+	common.StopValueTransforms()
+	common.StopMetricFilters()
+	common.StopStorageNodes()
+	common.StopMirror()
+	common.StopFlushCoalescer()
+	common.StopInsertBuffer()
+	common.StopAuditLog()
 }
 
 // RequestHandler is a handler for Prometheus remote storage write API
 func RequestHandler(w http.ResponseWriter, r *http.Request) bool {
 	path := strings.Replace(r.URL.Path, "//", "/", -1)
+	if protocol := getProtocol(path); len(protocol) > 0 {
+		sw := &common.StatusResponseWriter{ResponseWriter: w}
+		w = sw
+		defer func() {
+			incStatusClassRequests(protocol, sw.StatusCode())
+		}()
+	}
+	if isOpenTSDBHTTPPath(path) {
+		r = common.WithRequestID(w, r)
+	}
+	if isWritePath(path) {
+		var rt *common.RequestTrace
+		w, r, rt = common.WithRequestTrace(w, r)
+		defer rt.Finish()
+	}
+	if isWritePath(path) {
+		var ae *common.AuditEvent
+		w, r, ae = common.WithAuditEvent(w, r)
+		defer ae.Finish()
+	}
+	if isWritePath(path) && atomic.LoadUint32(&ingestionPaused) != 0 {
+		ingestionPausedRejects.Inc()
+		w.Header().Set("Retry-After", pauseRetryAfterSeconds)
+		http.Error(w, "data ingestion is paused; retry later", http.StatusServiceUnavailable)
+		return true
+	}
+	if isWritePath(path) {
+		// Rows routed from other VictoriaMetrics instances contain the required headers. See -storageNode.
+		if statusCode, err := common.CheckRequiredHeaders(r); err != nil {
+			requiredHeadersRejects.Inc()
+			http.Error(w, err.Error(), statusCode)
+			return true
+		}
+	}
+	if isWritePath(path) {
+		var err error
+		if r, err = common.WithExtraLabels(r); err != nil {
+			extraLabelsHeaderErrors.Inc()
+			httpserver.Errorf(w, "error in %q: %s", r.URL.Path, err)
+			return true
+		}
+	}
+	if len(*graphiteHTTPPath) > 0 && path == *graphiteHTTPPath {
+		graphiteWriteRequests.Inc()
+		if err := graphite.InsertHTTPHandler(r); err != nil {
+			graphiteWriteErrors.Inc()
+			writeInsertError(w, r, err)
+			return true
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return true
+	}
+	if len(*emfHTTPPath) > 0 && path == *emfHTTPPath {
+		emfWriteRequests.Inc()
+		if err := emf.InsertHandler(r, int64(*maxInsertRequestSize)); err != nil {
+			emfWriteErrors.Inc()
+			writeInsertError(w, r, err)
+			return true
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return true
+	}
 	switch path {
 	case "/api/v1/write":
 		prometheusWriteRequests.Inc()
 		if err := prometheus.InsertHandler(r, int64(*maxInsertRequestSize)); err != nil {
 			prometheusWriteErrors.Inc()
-			httpserver.Errorf(w, "error in %q: %s", r.URL.Path, err)
+			writeInsertError(w, r, err)
+			return true
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return true
+	case "/api/v1/import/prometheus":
+		prometheusImportRequests.Inc()
+		var err error
+		if common.IsMultipartRequest(r) {
+			multipartImportRequests.Inc()
+			err = importMultipart(r)
+		} else {
+			err = prometheustext.InsertHandler(r)
+		}
+		if err != nil {
+			prometheusImportErrors.Inc()
+			writeInsertError(w, r, err)
 			return true
 		}
 		w.WriteHeader(http.StatusNoContent)
@@ -60,24 +191,104 @@ func RequestHandler(w http.ResponseWriter, r *http.Request) bool {
 		influxWriteRequests.Inc()
 		if err := influx.InsertHandler(r); err != nil {
 			influxWriteErrors.Inc()
-			httpserver.Errorf(w, "error in %q: %s", r.URL.Path, err)
+			writeInsertError(w, r, err)
 			return true
 		}
 		w.WriteHeader(http.StatusNoContent)
 		return true
 	case "/query":
-		// Emulate fake response for influx query.
-		// This is required for TSBS benchmark.
 		influxQueryRequests.Inc()
-		fmt.Fprintf(w, `{"results":[{"series":[{"values":[]}]}]}`)
+		influx.QueryHandler(w, r)
+		return true
+	case "/_bulk":
+		esbulkWriteRequests.Inc()
+		if err := esbulk.InsertHandler(w, r, int64(*maxInsertRequestSize)); err != nil {
+			esbulkWriteErrors.Inc()
+			writeInsertError(w, r, err)
+			return true
+		}
+		return true
+	case "/api/rollup":
+		opentsdbHttpRollupRequests.Inc()
+		if err := opentsdbhttp.RollupHandler(w, r, int64(*maxInsertRequestSize)); err != nil {
+			opentsdbHttpRollupErrors.Inc()
+			writeOpenTSDBHTTPError(w, r, err)
+			return true
+		}
+		w.WriteHeader(http.StatusNoContent)
 		return true
 	case "/api/put":
 		opentsdbHttpWriteRequests.Inc()
-		if err := opentsdbhttp.InsertHandler(r, int64(*maxInsertRequestSize)); err != nil {
+		if err := opentsdbhttp.InsertHandler(w, r, int64(*maxInsertRequestSize)); err != nil {
 			opentsdbHttpWriteErrors.Inc()
-			httpserver.Errorf(w, "error in %q: %s", r.URL.Path, err)
+			writeOpenTSDBHTTPError(w, r, err)
+			return true
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return true
+	case "/api/uid/assign":
+		opentsdbHttpUIDAssignRequests.Inc()
+		if err := opentsdbhttp.UIDAssignHandler(w, r, int64(*maxInsertRequestSize)); err != nil {
+			opentsdbHttpUIDAssignErrors.Inc()
+			httpserver.Errorf(w, "error in %q (request_id=%s): %s", r.URL.Path, common.GetRequestID(r), err)
+			return true
+		}
+		return true
+	case common.StorageNodeInsertPath:
+		storageNodeInsertRequests.Inc()
+		if err := common.InsertStorageNodeHandler(r, int64(*maxInsertRequestSize)); err != nil {
+			storageNodeInsertErrors.Inc()
+			writeInsertError(w, r, err)
+			return true
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return true
+	case "/v1/metrics":
+		otlpWriteRequests.Inc()
+		if err := otlp.InsertHandler(w, r, int64(*maxInsertRequestSize)); err != nil {
+			otlpWriteErrors.Inc()
+			writeInsertError(w, r, err)
+			return true
+		}
+		return true
+	case "/debug/insert/config":
+		insertConfigRequests.Inc()
+		if len(*insertAdminAuthKey) == 0 {
+			httpserver.Errorf(w, "%q is disabled; set -insertAdminAuthKey command line flag in order to enable it", path)
 			return true
 		}
+		authKey := r.FormValue("authKey")
+		if authKey != *insertAdminAuthKey {
+			httpserver.Errorf(w, "invalid authKey %q. It must match the value from -insertAdminAuthKey command line flag", authKey)
+			return true
+		}
+		data, err := json.MarshalIndent(getInsertConfig(), "", "  ")
+		if err != nil {
+			logger.Panicf("BUG: cannot marshal insert config: %s", err)
+		}
+		httpserver.WriteResponse(w, http.StatusOK, "application/json", data)
+		return true
+	case "/admin/insert/pause", "/admin/insert/resume", "/admin/insert/resetMaxRequestSize":
+		insertAdminRequests.Inc()
+		if len(*insertAdminAuthKey) == 0 {
+			httpserver.Errorf(w, "%q is disabled; set -insertAdminAuthKey command line flag in order to enable it", path)
+			return true
+		}
+		authKey := r.FormValue("authKey")
+		if authKey != *insertAdminAuthKey {
+			httpserver.Errorf(w, "invalid authKey %q. It must match the value from -insertAdminAuthKey command line flag", authKey)
+			return true
+		}
+		switch path {
+		case "/admin/insert/pause":
+			atomic.StoreUint32(&ingestionPaused, 1)
+			logger.Infof("data ingestion via http has been paused")
+		case "/admin/insert/resume":
+			atomic.StoreUint32(&ingestionPaused, 0)
+			logger.Infof("data ingestion via http has been resumed")
+		default:
+			common.ResetMaxRequestSizes()
+		}
 		w.WriteHeader(http.StatusNoContent)
 		return true
 	default:
@@ -86,10 +297,191 @@ func RequestHandler(w http.ResponseWriter, r *http.Request) bool {
 	}
 }
 
+// writeInsertError writes err for the failed insert request r to w.
+//
+// See -insert.atomicBatchJSONErrors.
+func writeInsertError(w http.ResponseWriter, r *http.Request, err error) {
+	if common.WriteAtomicBatchError(w, r, err) {
+		return
+	}
+	httpserver.Errorf(w, "error in %q: %s", r.URL.Path, err)
+}
+
+// writeOpenTSDBHTTPError is like writeInsertError, but adds request id to plain text errors for OpenTSDB HTTP requests.
+func writeOpenTSDBHTTPError(w http.ResponseWriter, r *http.Request, err error) {
+	if common.WriteAtomicBatchError(w, r, err) {
+		return
+	}
+	if opentsdbhttp.WriteIdempotencyConflictError(w, r, err) {
+		return
+	}
+	httpserver.Errorf(w, "error in %q (request_id=%s): %s", r.URL.Path, common.GetRequestID(r), err)
+}
+
+// importMultipart imports files uploaded via multipart/form-data request to /api/v1/import/prometheus.
+//
+// Every file is parsed by the parser for its format while it is read from the request body.
+func importMultipart(r *http.Request) error {
+	return common.ForEachMultipartFile(r, common.FormatPrometheus, func(mf *common.MultipartFile) error {
+		switch mf.Format {
+		case common.FormatInflux:
+			return influx.InsertReader(r, mf.R)
+		default:
+			return prometheustext.InsertReader(r, mf.R, mf.Format == common.FormatOpenMetrics)
+		}
+	})
+}
+
+func isWritePath(path string) bool {
+	if len(*graphiteHTTPPath) > 0 && path == *graphiteHTTPPath {
+		return true
+	}
+	if len(*emfHTTPPath) > 0 && path == *emfHTTPPath {
+		return true
+	}
+	switch path {
+	case "/api/v1/write", "/api/v1/import/prometheus", "/write", "/api/v2/write", "/_bulk", "/api/put", "/api/rollup", "/v1/metrics",
+		common.StorageNodeInsertPath:
+		return true
+	default:
+		return false
+	}
+}
+
+// getProtocol returns the ingestion protocol for the given path.
+//
+// An empty string is returned if path doesn't belong to ingestion protocols.
+func getProtocol(path string) string {
+	if len(*graphiteHTTPPath) > 0 && path == *graphiteHTTPPath {
+		return "graphite"
+	}
+	if len(*emfHTTPPath) > 0 && path == *emfHTTPPath {
+		return "emf"
+	}
+	switch path {
+	case "/api/v1/write":
+		return "prometheus"
+	case "/api/v1/import/prometheus":
+		return "prometheus-text"
+	case "/write", "/api/v2/write", "/query":
+		return "influx"
+	case "/_bulk":
+		return "esbulk"
+	case "/api/put", "/api/rollup", "/api/uid/assign":
+		return "opentsdb-http"
+	case "/v1/metrics":
+		return "otlp"
+	case common.StorageNodeInsertPath:
+		return "native"
+	default:
+		return ""
+	}
+}
+
+// incStatusClassRequests increments vm_http_requests_total{protocol="...", code="Nxx"} counter
+// for the status class of the final statusCode.
+func incStatusClassRequests(protocol string, statusCode int) {
+	counters := statusClassRequests[protocol]
+	class := statusCode / 100
+	if counters == nil || class < 1 || class >= len(counters) {
+		return
+	}
+	counters[class].Inc()
+}
+
+// statusClassRequests contains vm_http_requests_total{protocol="...", code="Nxx"} counters
+// for protocols returned from getProtocol indexed by the status class.
+var statusClassRequests = newStatusClassRequests("graphite", "emf", "prometheus", "prometheus-text", "influx", "esbulk", "opentsdb-http", "otlp", "native")
+
+func newStatusClassRequests(protocols ...string) map[string][]*metrics.Counter {
+	m := make(map[string][]*metrics.Counter, len(protocols))
+	for _, protocol := range protocols {
+		counters := make([]*metrics.Counter, 6)
+		for class := 1; class < len(counters); class++ {
+			counters[class] = metrics.NewCounter(fmt.Sprintf(`vm_http_requests_total{protocol=%q, code="%dxx"}`, protocol, class))
+		}
+		m[protocol] = counters
+	}
+	return m
+}
+
+// isOpenTSDBHTTPPath returns true if path belongs to OpenTSDB HTTP API.
+//
+// Requests to such paths are tagged with request id. See common.WithRequestID.
+func isOpenTSDBHTTPPath(path string) bool {
+	switch path {
+	case "/api/put", "/api/rollup", "/api/uid/assign":
+		return true
+	default:
+		return false
+	}
+}
+
+// insertConfig is the effective ingestion configuration returned at /debug/insert/config.
+type insertConfig struct {
+	// Protocols maps enabled protocols to their listen addresses or HTTP paths.
+	Protocols map[string][]string `json:"protocols"`
+
+	MaxInsertRequestSize            int                              `json:"maxInsertRequestSize"`
+	MaxConcurrentInserts            int                              `json:"maxConcurrentInserts"`
+	MaxConcurrentInsertsPerProtocol map[string]int                   `json:"maxConcurrentInsertsPerProtocol"`
+	IngestLimits                    []concurrencylimiter.IngestLimit `json:"ingestLimits"`
+	IngestionPaused                 bool                             `json:"ingestionPaused"`
+
+	Shaping *common.ShapingConfig `json:"shaping"`
+}
+
+func getInsertConfig() *insertConfig {
+	protocols := map[string][]string{
+		"prometheus":      {"/api/v1/write"},
+		"prometheus-text": {"/api/v1/import/prometheus"},
+		"influx":          {"/write", "/api/v2/write"},
+		"esbulk":          {"/_bulk"},
+		"opentsdb-http":   {"/api/put", "/api/rollup"},
+		"otlp":            {"/v1/metrics"},
+		"native":          {common.StorageNodeInsertPath},
+	}
+	if len(*graphiteHTTPPath) > 0 {
+		protocols["graphite"] = append(protocols["graphite"], *graphiteHTTPPath)
+	}
+	if len(*graphiteListenAddr) > 0 {
+		protocols["graphite"] = append(protocols["graphite"], *graphiteListenAddr)
+	}
+	if len(*emfHTTPPath) > 0 {
+		protocols["emf"] = []string{*emfHTTPPath}
+	}
+	if len(*opentsdbListenAddr) > 0 {
+		protocols["opentsdb"] = strings.Split(*opentsdbListenAddr, ",")
+	}
+	if len(*otlpGRPCListenAddr) > 0 {
+		protocols["otlp"] = append(protocols["otlp"], *otlpGRPCListenAddr)
+	}
+	return &insertConfig{
+		Protocols:                       protocols,
+		MaxInsertRequestSize:            *maxInsertRequestSize,
+		MaxConcurrentInserts:            concurrencylimiter.MaxConcurrentInserts(),
+		MaxConcurrentInsertsPerProtocol: concurrencylimiter.ProtocolLimits(),
+		IngestLimits:                    concurrencylimiter.IngestLimits(),
+		IngestionPaused:                 atomic.LoadUint32(&ingestionPaused) != 0,
+		Shaping:                         common.GetShapingConfig(),
+	}
+}
+
+// ingestionPaused is set to non-zero when data ingestion via http is paused
+// with /admin/insert/pause.
+var ingestionPaused uint32
+
+// pauseRetryAfterSeconds is sent in Retry-After header to clients while data ingestion is paused.
+const pauseRetryAfterSeconds = "10"
+
 var (
 	prometheusWriteRequests = metrics.NewCounter(`vm_http_requests_total{path="/api/v1/write", protocol="prometheus"}`)
 	prometheusWriteErrors   = metrics.NewCounter(`vm_http_request_errors_total{path="/api/v1/write", protocol="prometheus"}`)
 
+	prometheusImportRequests = metrics.NewCounter(`vm_http_requests_total{path="/api/v1/import/prometheus", protocol="prometheus-text"}`)
+	prometheusImportErrors   = metrics.NewCounter(`vm_http_request_errors_total{path="/api/v1/import/prometheus", protocol="prometheus-text"}`)
+	multipartImportRequests  = metrics.NewCounter(`vm_multipart_import_requests_total`)
+
 	influxWriteRequests = metrics.NewCounter(`vm_http_requests_total{path="/write", protocol="influx"}`)
 	influxWriteErrors   = metrics.NewCounter(`vm_http_request_errors_total{path="/write", protocol="influx"}`)
 
@@ -98,4 +490,35 @@ var (
 	opentsdbHttpWriteRequests = metrics.NewCounter(`vm_http_requests_total{path="/api/put", protocol="opentsdb-http"}`)
 	opentsdbHttpWriteErrors   = metrics.NewCounter(`vm_http_request_errors_total{path="/api/put", protocol="opentsdb-http"}`)
 
+	opentsdbHttpRollupRequests = metrics.NewCounter(`vm_http_requests_total{path="/api/rollup", protocol="opentsdb-http"}`)
+	opentsdbHttpRollupErrors   = metrics.NewCounter(`vm_http_request_errors_total{path="/api/rollup", protocol="opentsdb-http"}`)
+
+	opentsdbHttpUIDAssignRequests = metrics.NewCounter(`vm_http_requests_total{path="/api/uid/assign", protocol="opentsdb-http"}`)
+	opentsdbHttpUIDAssignErrors   = metrics.NewCounter(`vm_http_request_errors_total{path="/api/uid/assign", protocol="opentsdb-http"}`)
+
+	esbulkWriteRequests = metrics.NewCounter(`vm_http_requests_total{path="/_bulk", protocol="esbulk"}`)
+	esbulkWriteErrors   = metrics.NewCounter(`vm_http_request_errors_total{path="/_bulk", protocol="esbulk"}`)
+
+	graphiteWriteRequests = metrics.NewCounter(`vm_http_requests_total{path="-graphiteHTTPPath", protocol="graphite"}`)
+	graphiteWriteErrors   = metrics.NewCounter(`vm_http_request_errors_total{path="-graphiteHTTPPath", protocol="graphite"}`)
+
+	emfWriteRequests = metrics.NewCounter(`vm_http_requests_total{path="-emfHTTPPath", protocol="emf"}`)
+	emfWriteErrors   = metrics.NewCounter(`vm_http_request_errors_total{path="-emfHTTPPath", protocol="emf"}`)
+
+	otlpWriteRequests = metrics.NewCounter(`vm_http_requests_total{path="/v1/metrics", protocol="otlp"}`)
+	otlpWriteErrors   = metrics.NewCounter(`vm_http_request_errors_total{path="/v1/metrics", protocol="otlp"}`)
+
+	storageNodeInsertRequests = metrics.NewCounter(`vm_http_requests_total{path="/internal/insert", protocol="native"}`)
+	storageNodeInsertErrors   = metrics.NewCounter(`vm_http_request_errors_total{path="/internal/insert", protocol="native"}`)
+
+	extraLabelsHeaderErrors = metrics.NewCounter(`vm_http_request_errors_total{path="*", reason="invalid_extra_labels_header"}`)
+	requiredHeadersRejects  = metrics.NewCounter(`vm_http_request_errors_total{path="*", reason="missing_required_headers"}`)
+
+	insertAdminRequests    = metrics.NewCounter(`vm_http_requests_total{path="/admin/insert/*"}`)
+	insertConfigRequests   = metrics.NewCounter(`vm_http_requests_total{path="/debug/insert/config"}`)
+	ingestionPausedRejects = metrics.NewCounter(`vm_http_request_errors_total{path="*", reason="ingestion_paused"}`)
+
+	_ = metrics.NewGauge(`vm_ingestion_paused`, func() float64 {
+		return float64(atomic.LoadUint32(&ingestionPaused))
+	})
 )
@@ -0,0 +1,45 @@
+package opentsdbhttp
+
+import (
+	"flag"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/VictoriaMetrics/VictoriaMetrics/app/vminsert/common"
+)
+
+func TestInsertHandlerAtomicBatch(t *testing.T) {
+	var rc common.RowsCollector
+	common.SetSink(&rc)
+	defer common.SetSink(nil)
+	if err := flag.Set("insert.atomicBatch", "true"); err != nil {
+		t.Fatalf("cannot set -insert.atomicBatch: %s", err)
+	}
+	defer func() {
+		if err := flag.Set("insert.atomicBatch", "false"); err != nil {
+			t.Fatalf("cannot reset -insert.atomicBatch: %s", err)
+		}
+	}()
+
+	f := func(body string, rowsExpected int, resultExpected bool) {
+		t.Helper()
+		rc.Reset(nil)
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest("POST", "/api/put", strings.NewReader(body))
+		err := insertHandlerInternal(w, req, 1024, false)
+		if (err == nil) != resultExpected {
+			t.Fatalf("unexpected error for %s: %v", body, err)
+		}
+		if rows := rc.RowsCount(); rows != rowsExpected {
+			t.Fatalf("unexpected number of inserted rows; got %d; want %d", rows, rowsExpected)
+		}
+	}
+
+	f(`[{"metric": "foo", "timestamp": 1, "value": 1, "tags": {"a": "b"}},
+		{"metric": "foo", "timestamp": 2, "value": 2, "tags": {"a": "b"}}]`, 2, true)
+
+	// The whole batch is rejected if a single row has a timestamp, which would be dropped by the storage
+	f(`[{"metric": "foo", "timestamp": 1, "value": 1, "tags": {"a": "b"}},
+		{"metric": "foo", "timestamp": 4102444800000, "value": 2, "tags": {"a": "b"}}]`, 0, false)
+}
@@ -0,0 +1,44 @@
+package opentsdbhttp
+
+import (
+	"bytes"
+	"flag"
+
+	"github.com/VictoriaMetrics/metrics"
+)
+
+var stripBOM = flag.Bool("opentsdbhttp.stripBOM", true, "Whether to strip a leading UTF-8 byte order mark and whitespace from OpenTSDB HTTP request bodies before parsing them. "+
+	"Some Windows and Java clients prefix JSON bodies with the byte order mark, which makes them unparseable otherwise")
+
+// utf8BOM is the UTF-8 byte order mark.
+var utf8BOM = []byte("\xef\xbb\xbf")
+
+var strippedBOMs = metrics.NewCounter(`vm_opentsdbhttp_stripped_boms_total`)
+
+// trimBodyPrefix returns data without a leading UTF-8 byte order mark and leading whitespace if -opentsdbhttp.stripBOM is set.
+func trimBodyPrefix(data []byte) []byte {
+	if !*stripBOM {
+		return data
+	}
+	if bytes.HasPrefix(data, utf8BOM) {
+		strippedBOMs.Inc()
+		data = data[len(utf8BOM):]
+	}
+	return bytes.TrimLeft(data, " \t\n\r")
+}
+
+// skipBOM skips a leading UTF-8 byte order mark in js if -opentsdbhttp.stripBOM is set.
+//
+// It must be called before reading the first value from js. Leading whitespace is skipped by js itself.
+func (js *jsonStream) skipBOM() {
+	if !*stripBOM {
+		return
+	}
+	b, err := js.br.Peek(len(utf8BOM))
+	if err != nil || !bytes.Equal(b, utf8BOM) {
+		return
+	}
+	strippedBOMs.Inc()
+	n, _ := js.br.Discard(len(utf8BOM))
+	js.n += int64(n)
+}
@@ -0,0 +1,70 @@
+package opentsdbhttp
+
+import (
+	"bytes"
+	"compress/gzip"
+	"testing"
+
+	"github.com/VictoriaMetrics/VictoriaMetrics/app/vminsert/common"
+)
+
+func TestPushCtxReadBOM(t *testing.T) {
+	defer func() {
+		*stripBOM = true
+		*streamParse = false
+	}()
+
+	f := func(body string, rowsExpected int, errExpected bool) {
+		t.Helper()
+		var zb bytes.Buffer
+		zw := gzip.NewWriter(&zb)
+		if _, err := zw.Write([]byte(body)); err != nil {
+			t.Fatalf("cannot compress body: %s", err)
+		}
+		if err := zw.Close(); err != nil {
+			t.Fatalf("cannot close gzip writer: %s", err)
+		}
+		zr, err := common.GetGzipReader(&zb)
+		if err != nil {
+			t.Fatalf("cannot create gzip reader: %s", err)
+		}
+		defer common.PutGzipReader(zr)
+
+		ctx := getPushCtx()
+		defer putPushCtx(ctx)
+		rows := 0
+		for ctx.Read(zr, 1024) {
+			rows += len(ctx.Rows.Rows)
+		}
+		err = ctx.Error()
+		if errExpected {
+			if err == nil {
+				t.Fatalf("expecting non-nil error for %q", body)
+			}
+			return
+		}
+		if err != nil {
+			t.Fatalf("unexpected error for %q: %s", body, err)
+		}
+		if rows != rowsExpected {
+			t.Fatalf("unexpected number of rows for %q; got %d; want %d", body, rows, rowsExpected)
+		}
+	}
+
+	row := `{"metric": "foo", "timestamp": 1, "value": 2, "tags": {"a": "b"}}`
+	for _, stream := range []bool{false, true} {
+		*streamParse = stream
+
+		*stripBOM = true
+		f(row, 1, false)
+		f("\xef\xbb\xbf"+row, 1, false)
+		f("\xef\xbb\xbf \r\n["+row+","+row+"]", 2, false)
+
+		// The byte order mark is accepted only at the start of the body
+		f(" \xef\xbb\xbf"+row, 0, true)
+
+		*stripBOM = false
+		f(row, 1, false)
+		f("\xef\xbb\xbf"+row, 0, true)
+	}
+}
@@ -0,0 +1,84 @@
+package opentsdbhttp
+
+import (
+	"math"
+	"sort"
+
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/bytesutil"
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/encoding"
+	"github.com/VictoriaMetrics/metrics"
+)
+
+// DuplicatesCollapsedHeader is the name of response header with the number of rows collapsed
+// for requests with `no_duplicates` query arg.
+const DuplicatesCollapsedHeader = "X-Duplicates-Collapsed"
+
+// rowsDeduplicator collapses rows with identical series, timestamp and value within a single request.
+//
+// Rows from distinct requests aren't compared, since this would require checking the storage.
+type rowsDeduplicator struct {
+	seen    map[string]struct{}
+	keyBuf  []byte
+	tagIdxs []int
+
+	// collapsed is the number of collapsed rows since the last reset.
+	collapsed int
+}
+
+func (rd *rowsDeduplicator) reset() {
+	for k := range rd.seen {
+		delete(rd.seen, k)
+	}
+	rd.keyBuf = rd.keyBuf[:0]
+	rd.tagIdxs = rd.tagIdxs[:0]
+	rd.collapsed = 0
+}
+
+// collapse removes duplicate rows from rows and returns the result.
+//
+// Rows are considered identical if they have the same metric, tags in any order, timestamp and value.
+// The first row from duplicates is preserved.
+func (rd *rowsDeduplicator) collapse(rows []Row) []Row {
+	if rd.seen == nil {
+		rd.seen = make(map[string]struct{})
+	}
+	dst := rows[:0]
+	for i := range rows {
+		r := &rows[i]
+		rd.keyBuf = rd.marshalKey(rd.keyBuf[:0], r)
+		if _, ok := rd.seen[string(rd.keyBuf)]; ok {
+			rd.collapsed++
+			continue
+		}
+		rd.seen[string(rd.keyBuf)] = struct{}{}
+		dst = append(dst, *r)
+	}
+	// Release references to the dropped rows, so they can be GC'ed.
+	for i := len(dst); i < len(rows); i++ {
+		rows[i].reset()
+	}
+	duplicatesCollapsed.Add(len(rows) - len(dst))
+	return dst
+}
+
+func (rd *rowsDeduplicator) marshalKey(dst []byte, r *Row) []byte {
+	dst = encoding.MarshalBytes(dst, bytesutil.ToUnsafeBytes(r.Metric))
+	rd.tagIdxs = rd.tagIdxs[:0]
+	for i := range r.Tags {
+		rd.tagIdxs = append(rd.tagIdxs, i)
+	}
+	tags := r.Tags
+	sort.Slice(rd.tagIdxs, func(i, j int) bool {
+		return tags[rd.tagIdxs[i]].Key < tags[rd.tagIdxs[j]].Key
+	})
+	for _, idx := range rd.tagIdxs {
+		tag := &tags[idx]
+		dst = encoding.MarshalBytes(dst, bytesutil.ToUnsafeBytes(tag.Key))
+		dst = encoding.MarshalBytes(dst, bytesutil.ToUnsafeBytes(tag.Value))
+	}
+	dst = encoding.MarshalUint64(dst, uint64(r.Timestamp))
+	dst = encoding.MarshalUint64(dst, math.Float64bits(r.Value))
+	return dst
+}
+
+var duplicatesCollapsed = metrics.NewCounter(`vm_opentsdbhttp_duplicates_collapsed_total`)
@@ -0,0 +1,83 @@
+package opentsdbhttp
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestRowsDeduplicatorCollapse(t *testing.T) {
+	var rd rowsDeduplicator
+	f := func(rows, rowsExpected []Row, collapsedExpected int) {
+		t.Helper()
+		rd.reset()
+		result := rd.collapse(rows)
+		if !reflect.DeepEqual(result, rowsExpected) {
+			t.Fatalf("unexpected rows;\ngot\n%+v\nwant\n%+v", result, rowsExpected)
+		}
+		if rd.collapsed != collapsedExpected {
+			t.Fatalf("unexpected number of collapsed rows; got %d; want %d", rd.collapsed, collapsedExpected)
+		}
+	}
+	tagsAB := []Tag{{Key: "a", Value: "1"}, {Key: "b", Value: "2"}}
+	tagsBA := []Tag{{Key: "b", Value: "2"}, {Key: "a", Value: "1"}}
+	tagsA := []Tag{{Key: "a", Value: "1"}}
+
+	// No rows
+	f(nil, nil, 0)
+
+	// No duplicates
+	f([]Row{
+		{Metric: "foo", Tags: tagsAB, Timestamp: 1, Value: 1},
+		{Metric: "foo", Tags: tagsAB, Timestamp: 2, Value: 1},
+		{Metric: "foo", Tags: tagsAB, Timestamp: 1, Value: 2},
+		{Metric: "foo", Tags: tagsA, Timestamp: 1, Value: 1},
+		{Metric: "bar", Tags: tagsAB, Timestamp: 1, Value: 1},
+	}, []Row{
+		{Metric: "foo", Tags: tagsAB, Timestamp: 1, Value: 1},
+		{Metric: "foo", Tags: tagsAB, Timestamp: 2, Value: 1},
+		{Metric: "foo", Tags: tagsAB, Timestamp: 1, Value: 2},
+		{Metric: "foo", Tags: tagsA, Timestamp: 1, Value: 1},
+		{Metric: "bar", Tags: tagsAB, Timestamp: 1, Value: 1},
+	}, 0)
+
+	// Duplicates with tags in distinct order
+	f([]Row{
+		{Metric: "foo", Tags: tagsAB, Timestamp: 1, Value: 1},
+		{Metric: "bar", Tags: tagsA, Timestamp: 1, Value: 1},
+		{Metric: "foo", Tags: tagsBA, Timestamp: 1, Value: 1},
+		{Metric: "foo", Tags: tagsAB, Timestamp: 1, Value: 1},
+		{Metric: "bar", Tags: tagsA, Timestamp: 1, Value: 1},
+	}, []Row{
+		{Metric: "foo", Tags: tagsAB, Timestamp: 1, Value: 1},
+		{Metric: "bar", Tags: tagsA, Timestamp: 1, Value: 1},
+	}, 3)
+
+	// Tag boundaries are taken into account
+	f([]Row{
+		{Metric: "foo", Tags: []Tag{{Key: "a", Value: "bc"}}, Timestamp: 1, Value: 1},
+		{Metric: "foo", Tags: []Tag{{Key: "ab", Value: "c"}}, Timestamp: 1, Value: 1},
+	}, []Row{
+		{Metric: "foo", Tags: []Tag{{Key: "a", Value: "bc"}}, Timestamp: 1, Value: 1},
+		{Metric: "foo", Tags: []Tag{{Key: "ab", Value: "c"}}, Timestamp: 1, Value: 1},
+	}, 0)
+}
+
+func TestPushCtxReadNoDuplicates(t *testing.T) {
+	f := func(noDuplicates bool, rowsExpected int) {
+		t.Helper()
+		ctx := getPushCtx()
+		defer putPushCtx(ctx)
+		ctx.noDuplicates = noDuplicates
+		r := strings.NewReader(`[{"metric": "foo", "timestamp": 1, "value": 2, "tags": {"a": "b"}},` +
+			`{"metric": "foo", "timestamp": 1, "value": 2, "tags": {"a": "b"}}]`)
+		if !ctx.Read(r, 1024) {
+			t.Fatalf("unexpected error: %s", ctx.Error())
+		}
+		if n := len(ctx.Rows.Rows); n != rowsExpected {
+			t.Fatalf("unexpected number of rows; got %d; want %d", n, rowsExpected)
+		}
+	}
+	f(false, 2)
+	f(true, 1)
+}
@@ -0,0 +1,154 @@
+package opentsdbhttp
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/VictoriaMetrics/VictoriaMetrics/app/vminsert/common"
+	"github.com/VictoriaMetrics/metrics"
+)
+
+var (
+	etagCacheDuration = flag.Duration("opentsdbhttp.etagCacheDuration", 0, "How long to remember ETags of successfully processed OpenTSDB HTTP requests with If-None-Match header. "+
+		"Retries of such requests with identical path, query string and body are acknowledged without ingesting the data again. Zero disables the cache. "+
+		"See also -opentsdbhttp.etagCacheMaxEntries")
+	etagCacheMaxEntries = flag.Int("opentsdbhttp.etagCacheMaxEntries", 100000, "The maximum number of ETags to remember. "+
+		"ETags of new requests aren't remembered when the limit is reached until the older ETags expire. See -opentsdbhttp.etagCacheDuration")
+)
+
+var (
+	duplicateRequests = metrics.NewCounter(`vm_opentsdbhttp_duplicate_requests_total`)
+	etagCacheFull     = metrics.NewCounter(`vm_opentsdbhttp_etag_cache_full_total`)
+
+	_ = metrics.NewGauge(`vm_opentsdbhttp_etag_cache_entries`, func() float64 {
+		return float64(etags.len())
+	})
+)
+
+// etagCache contains ETags of recently processed requests.
+type etagCache struct {
+	mu sync.Mutex
+
+	// m maps ETag to the time in unix nanoseconds when it expires.
+	m map[uint64]int64
+}
+
+var etags = &etagCache{
+	m: make(map[uint64]int64),
+}
+
+func (ec *etagCache) len() int {
+	ec.mu.Lock()
+	n := len(ec.m)
+	ec.mu.Unlock()
+	return n
+}
+
+// has returns true if ec contains unexpired etag.
+func (ec *etagCache) has(etag uint64, now time.Time) bool {
+	ec.mu.Lock()
+	deadline, ok := ec.m[etag]
+	ec.mu.Unlock()
+	return ok && now.UnixNano() < deadline
+}
+
+// add remembers etag for the given duration.
+func (ec *etagCache) add(etag uint64, now time.Time, d time.Duration, maxEntries int) {
+	nowNano := now.UnixNano()
+	ec.mu.Lock()
+	defer ec.mu.Unlock()
+	if _, ok := ec.m[etag]; !ok && len(ec.m) >= maxEntries {
+		// Drop expired entries in order to make room for the new entry.
+		for k, deadline := range ec.m {
+			if deadline <= nowNano {
+				delete(ec.m, k)
+			}
+		}
+		if len(ec.m) >= maxEntries {
+			etagCacheFull.Inc()
+			return
+		}
+	}
+	ec.m[etag] = nowNano + d.Nanoseconds()
+}
+
+// formatETag returns ETag header value for the given etag.
+func formatETag(etag uint64) string {
+	return fmt.Sprintf(`"%016x"`, etag)
+}
+
+// parseIfNoneMatch returns ETags listed in If-None-Match header value s.
+//
+// Weak ETags are treated as strong ones. `*` and unknown ETags are skipped.
+func parseIfNoneMatch(dst []uint64, s string) []uint64 {
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		item = strings.TrimPrefix(item, "W/")
+		if len(item) < 2 || item[0] != '"' || item[len(item)-1] != '"' {
+			continue
+		}
+		etag, err := strconv.ParseUint(item[1:len(item)-1], 16, 64)
+		if err != nil {
+			continue
+		}
+		dst = append(dst, etag)
+	}
+	return dst
+}
+
+// checkETag checks whether req with If-None-Match header has been processed recently.
+//
+// The raw request body is read into ctx.etagBuf in order to calculate its ETag, which is returned.
+// The ETag covers the path and the query string, since they may change the ingested data, for instance, via extra labels.
+// true is returned if the request has been processed during the last -opentsdbhttp.etagCacheDuration
+// and If-None-Match header matches its ETag, so it mustn't be processed again.
+func (ctx *pushCtx) checkETag(req *http.Request, maxSize int64) (uint64, bool, error) {
+	ctx.etagBuf.Reset()
+	n, err := common.ReadRequestBody(&ctx.etagBuf, io.LimitReader(common.NewReadTimeoutReader(req.Body), maxSize+1))
+	if err != nil {
+		opentsdbReadErrors.Inc()
+		return 0, false, fmt.Errorf("cannot read request: %s", err)
+	}
+	if n > maxSize {
+		opentsdbReadErrors.Inc()
+		rejectedRequestBytes.Add(int(n))
+		return 0, false, fmt.Errorf("too big packed request; mustn't exceed %d bytes", maxSize)
+	}
+	d := &ctx.etagDigest
+	d.Reset()
+	_, _ = d.WriteString(req.URL.Path)
+	_, _ = d.WriteString("?")
+	_, _ = d.WriteString(req.URL.RawQuery)
+	_, _ = d.WriteString("\n")
+	_, _ = d.Write(ctx.etagBuf.B)
+	etag := d.Sum64()
+	if !ctx.ifNoneMatch(req.Header.Get("If-None-Match"), etag) {
+		return etag, false, nil
+	}
+	return etag, etags.has(etag, time.Now()), nil
+}
+
+// ifNoneMatch returns true if If-None-Match header value s matches etag.
+func (ctx *pushCtx) ifNoneMatch(s string, etag uint64) bool {
+	if strings.TrimSpace(s) == "*" {
+		return true
+	}
+	ctx.etagsBuf = parseIfNoneMatch(ctx.etagsBuf[:0], s)
+	for _, v := range ctx.etagsBuf {
+		if v == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// isETagRequest returns true if req must be checked for duplicates. See -opentsdbhttp.etagCacheDuration.
+func isETagRequest(req *http.Request) bool {
+	return *etagCacheDuration > 0 && len(req.Header.Get("If-None-Match")) > 0
+}
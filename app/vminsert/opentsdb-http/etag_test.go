@@ -0,0 +1,120 @@
+package opentsdbhttp
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/VictoriaMetrics/VictoriaMetrics/app/vminsert/common"
+)
+
+func TestParseIfNoneMatch(t *testing.T) {
+	f := func(s string, etagsExpected []uint64) {
+		t.Helper()
+		etags := parseIfNoneMatch(nil, s)
+		if len(etags) != len(etagsExpected) {
+			t.Fatalf("unexpected etags for %q; got %x; want %x", s, etags, etagsExpected)
+		}
+		for i := range etags {
+			if etags[i] != etagsExpected[i] {
+				t.Fatalf("unexpected etags for %q; got %x; want %x", s, etags, etagsExpected)
+			}
+		}
+	}
+	f("", nil)
+	f("*", nil)
+	f(`"foo"`, nil)
+	f(`00000000000000ff`, nil)
+	f(`"00000000000000ff"`, []uint64{0xff})
+	f(`W/"00000000000000ff", "1", *`, []uint64{0xff, 1})
+}
+
+func TestETagCache(t *testing.T) {
+	ec := &etagCache{
+		m: make(map[uint64]int64),
+	}
+	now := time.Now()
+	ec.add(1, now, time.Minute, 2)
+	ec.add(2, now, time.Second, 2)
+	if !ec.has(1, now) || !ec.has(2, now) {
+		t.Fatalf("expecting added etags in the cache")
+	}
+	if ec.has(3, now) {
+		t.Fatalf("unexpected etag in the cache")
+	}
+
+	// The cache is full
+	ec.add(3, now, time.Minute, 2)
+	if ec.has(3, now) {
+		t.Fatalf("etag mustn't be added to full cache")
+	}
+
+	// Expired etags are dropped when the cache is full
+	later := now.Add(2 * time.Second)
+	if ec.has(2, later) {
+		t.Fatalf("expired etag mustn't be found")
+	}
+	ec.add(3, later, time.Minute, 2)
+	if !ec.has(3, later) || !ec.has(1, later) {
+		t.Fatalf("expecting etags in the cache after dropping expired etags")
+	}
+	if n := ec.len(); n != 2 {
+		t.Fatalf("unexpected number of etags; got %d; want 2", n)
+	}
+}
+
+func TestInsertHandlerETag(t *testing.T) {
+	var rc common.RowsCollector
+	common.SetSink(&rc)
+	defer common.SetSink(nil)
+	defer func(d time.Duration) {
+		*etagCacheDuration = d
+	}(*etagCacheDuration)
+	*etagCacheDuration = time.Minute
+
+	f := func(url, body, ifNoneMatch string, rowsExpected int) string {
+		t.Helper()
+		rc.Reset(nil)
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest("POST", url, strings.NewReader(body))
+		if len(ifNoneMatch) > 0 {
+			req.Header.Set("If-None-Match", ifNoneMatch)
+		}
+		if err := insertHandlerInternal(w, req, 1024, false); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if rows := rc.RowsCount(); rows != rowsExpected {
+			t.Fatalf("unexpected number of inserted rows; got %d; want %d", rows, rowsExpected)
+		}
+		return w.Header().Get("ETag")
+	}
+	body := `{"metric": "foo", "timestamp": 1, "value": 2, "tags": {"a": "b"}}`
+
+	// Requests without If-None-Match header aren't checked
+	if etag := f("/api/put", body, "", 1); etag != "" {
+		t.Fatalf("unexpected ETag for request without If-None-Match header: %q", etag)
+	}
+	f("/api/put", body, "", 1)
+
+	// The retry of request with identical body isn't ingested
+	etag := f("/api/put", body, "*", 1)
+	if etag == "" {
+		t.Fatalf("expecting non-empty ETag")
+	}
+	if s := f("/api/put", body, "*", 0); s != etag {
+		t.Fatalf("unexpected ETag for duplicate request; got %q; want %q", s, etag)
+	}
+	f("/api/put", body, etag, 0)
+
+	// Request with distinct body is ingested
+	body2 := `{"metric": "foo", "timestamp": 2, "value": 2, "tags": {"a": "b"}}`
+	f("/api/put", body2, "*", 1)
+
+	// Request with distinct body and stale ETag is ingested
+	f("/api/put", body2+" ", etag, 1)
+
+	// Request with identical body and distinct query string is ingested
+	f("/api/put?details", body, "*", 1)
+	f("/api/put?details", body, etag, 1)
+}
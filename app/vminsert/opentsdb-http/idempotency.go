@@ -0,0 +1,174 @@
+package opentsdbhttp
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/VictoriaMetrics/VictoriaMetrics/app/vminsert/common"
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/logger"
+	"github.com/VictoriaMetrics/metrics"
+)
+
+var (
+	idempotencyKeyCacheDuration = flag.Duration("opentsdbhttp.idempotencyKeyCacheDuration", 0, "How long to remember results of OpenTSDB HTTP requests with Idempotency-Key header. "+
+		"Retries with the same key get the original result without ingesting the data again. Zero disables the cache. See also -opentsdbhttp.idempotencyKeyCacheMaxEntries")
+	idempotencyKeyCacheMaxEntries = flag.Int("opentsdbhttp.idempotencyKeyCacheMaxEntries", 100000, "The maximum number of Idempotency-Key values to remember. "+
+		"Requests with new keys are processed without remembering their results when the limit is reached until the older keys expire. See -opentsdbhttp.idempotencyKeyCacheDuration")
+)
+
+// IdempotentReplayedHeader is the response header set to `true` when the result of the previous request with the same Idempotency-Key is returned.
+const IdempotentReplayedHeader = "Idempotent-Replayed"
+
+// maxIdempotencyKeyLen is the maximum length of Idempotency-Key header value.
+const maxIdempotencyKeyLen = 256
+
+var (
+	idempotentReplays         = metrics.NewCounter(`vm_opentsdbhttp_idempotent_replays_total`)
+	idempotentConflicts       = metrics.NewCounter(`vm_opentsdbhttp_idempotent_conflicts_total`)
+	idempotencyKeyCacheIsFull = metrics.NewCounter(`vm_opentsdbhttp_idempotency_key_cache_full_total`)
+
+	_ = metrics.NewGauge(`vm_opentsdbhttp_idempotency_key_cache_entries`, func() float64 {
+		return float64(idempotencyKeys.len())
+	})
+)
+
+// idempotencyResult is the result of a request with Idempotency-Key header.
+type idempotencyResult struct {
+	// deadline is the time in unix nanoseconds when the result expires.
+	deadline int64
+
+	// pending is set while the request is processed.
+	pending bool
+
+	// errMsg is the error returned to the client. It is empty on success.
+	errMsg string
+}
+
+// idempotencyCache contains results of recently processed requests with Idempotency-Key header.
+type idempotencyCache struct {
+	mu sync.Mutex
+	m  map[string]*idempotencyResult
+}
+
+var idempotencyKeys = &idempotencyCache{
+	m: make(map[string]*idempotencyResult),
+}
+
+func (ic *idempotencyCache) len() int {
+	ic.mu.Lock()
+	n := len(ic.m)
+	ic.mu.Unlock()
+	return n
+}
+
+// errIdempotencyConflict is returned when a request with the same Idempotency-Key is being processed.
+var errIdempotencyConflict = errors.New("the request with the same Idempotency-Key is being processed; retry later")
+
+// idempotencyConflictRetryAfterSeconds is sent in Retry-After header on errIdempotencyConflict.
+const idempotencyConflictRetryAfterSeconds = "1"
+
+// WriteIdempotencyConflictError writes `409 Conflict` response with Retry-After header to w if err is returned
+// for a request with Idempotency-Key of the request being processed.
+//
+// Clients don't retry `400 Bad Request` responses, while the request may succeed after the original request is processed.
+// It returns false without writing the response otherwise, so the caller must write the error response on its own.
+func WriteIdempotencyConflictError(w http.ResponseWriter, req *http.Request, err error) bool {
+	if err != errIdempotencyConflict {
+		return false
+	}
+	errStr := fmt.Sprintf("error in %q (request_id=%s): %s", req.URL.Path, common.GetRequestID(req), err)
+	logger.Errorf("%s", errStr)
+	w.Header().Set("Retry-After", idempotencyConflictRetryAfterSeconds)
+	http.Error(w, errStr, http.StatusConflict)
+	return true
+}
+
+// begin returns the result of the previous request with the given key if it exists.
+//
+// Otherwise the key is registered as pending and false is returned, so the request must be processed
+// and its result must be passed to finish. errIdempotencyConflict is returned if the request with the same key is being processed.
+func (ic *idempotencyCache) begin(key string, now time.Time, maxEntries int) (*idempotencyResult, bool, error) {
+	nowNano := now.UnixNano()
+	ic.mu.Lock()
+	defer ic.mu.Unlock()
+	if r, ok := ic.m[key]; ok {
+		if r.pending {
+			return nil, false, errIdempotencyConflict
+		}
+		if nowNano < r.deadline {
+			return r, true, nil
+		}
+		delete(ic.m, key)
+	}
+	if len(ic.m) >= maxEntries {
+		// Drop expired entries in order to make room for the new entry.
+		for k, r := range ic.m {
+			if !r.pending && r.deadline <= nowNano {
+				delete(ic.m, k)
+			}
+		}
+		if len(ic.m) >= maxEntries {
+			idempotencyKeyCacheIsFull.Inc()
+			return nil, false, nil
+		}
+	}
+	ic.m[key] = &idempotencyResult{
+		pending: true,
+	}
+	return nil, false, nil
+}
+
+// finish remembers the result of the request with the given key registered via begin for the given duration.
+//
+// The key is forgotten if err isn't a parse error, so the client may retry the request after temporary failures, such as storage errors.
+func (ic *idempotencyCache) finish(key string, err error, now time.Time, d time.Duration) {
+	ic.mu.Lock()
+	defer ic.mu.Unlock()
+	r, ok := ic.m[key]
+	if !ok || !r.pending {
+		// The key hasn't been registered because the cache is full.
+		return
+	}
+	if err != nil && common.GetParseErrorCode(err) == nil {
+		delete(ic.m, key)
+		return
+	}
+	r.pending = false
+	r.deadline = now.UnixNano() + d.Nanoseconds()
+	if err != nil {
+		r.errMsg = err.Error()
+	}
+}
+
+// err returns the error for the cached result.
+func (r *idempotencyResult) err() error {
+	if len(r.errMsg) == 0 {
+		return nil
+	}
+	return errors.New(r.errMsg)
+}
+
+// getIdempotencyKey returns the cache key for req with Idempotency-Key header.
+//
+// An empty key is returned if the cache is disabled or req has no Idempotency-Key header.
+func getIdempotencyKey(req *http.Request, rollup bool) (string, error) {
+	if *idempotencyKeyCacheDuration <= 0 {
+		return "", nil
+	}
+	key := req.Header.Get("Idempotency-Key")
+	if len(key) == 0 {
+		return "", nil
+	}
+	if len(key) > maxIdempotencyKeyLen {
+		return "", fmt.Errorf("too long Idempotency-Key header value; it mustn't exceed %d bytes", maxIdempotencyKeyLen)
+	}
+	// Keys for /api/put and /api/rollup are independent, since the same body has distinct meaning for them.
+	if rollup {
+		return "rollup:" + key, nil
+	}
+	return "put:" + key, nil
+}
@@ -0,0 +1,138 @@
+package opentsdbhttp
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/VictoriaMetrics/VictoriaMetrics/app/vminsert/common"
+)
+
+func TestIdempotencyCache(t *testing.T) {
+	ic := &idempotencyCache{
+		m: make(map[string]*idempotencyResult),
+	}
+	now := time.Now()
+	if _, ok, err := ic.begin("a", now, 2); ok || err != nil {
+		t.Fatalf("unexpected result for new key; ok=%v, err=%v", ok, err)
+	}
+
+	// The request with the same key is being processed
+	if _, _, err := ic.begin("a", now, 2); err != errIdempotencyConflict {
+		t.Fatalf("unexpected error for pending key; got %v; want %v", err, errIdempotencyConflict)
+	}
+
+	ic.finish("a", nil, now, time.Second)
+	r, ok, err := ic.begin("a", now, 2)
+	if !ok || err != nil || r.err() != nil {
+		t.Fatalf("expecting successful result for the processed key; ok=%v, err=%v", ok, err)
+	}
+
+	// Parse errors are remembered
+	_, _, _ = ic.begin("b", now, 2)
+	ic.finish("b", common.NewParseError(common.ErrBadFormat, "bad row"), now, time.Minute)
+	r, ok, _ = ic.begin("b", now, 2)
+	if !ok || r.err() == nil || !strings.Contains(r.err().Error(), "bad row") {
+		t.Fatalf("expecting the original error for the processed key")
+	}
+
+	// The cache is full
+	if _, ok, err := ic.begin("c", now, 2); ok || err != nil {
+		t.Fatalf("unexpected result for new key; ok=%v, err=%v", ok, err)
+	}
+	ic.finish("c", nil, now, time.Minute)
+	if _, ok, _ := ic.begin("c", now, 2); ok {
+		t.Fatalf("the key mustn't be remembered when the cache is full")
+	}
+
+	// Expired results are dropped
+	later := now.Add(2 * time.Second)
+	if _, ok, _ := ic.begin("a", later, 2); ok {
+		t.Fatalf("expired key mustn't be found")
+	}
+
+	// Other errors are forgotten, so the request may be retried
+	ic.finish("a", fmt.Errorf("cannot store metrics"), later, time.Minute)
+	if _, ok, err := ic.begin("a", later, 2); ok || err != nil {
+		t.Fatalf("unexpected result for the key after temporary error; ok=%v, err=%v", ok, err)
+	}
+}
+
+func TestInsertHandlerIdempotencyKey(t *testing.T) {
+	var rc common.RowsCollector
+	common.SetSink(&rc)
+	defer common.SetSink(nil)
+	defer func(d time.Duration) {
+		*idempotencyKeyCacheDuration = d
+	}(*idempotencyKeyCacheDuration)
+	*idempotencyKeyCacheDuration = time.Minute
+
+	f := func(url, body, key string, rowsExpected int, replayedExpected, errExpected bool) {
+		t.Helper()
+		rc.Reset(nil)
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest("POST", url, strings.NewReader(body))
+		if len(key) > 0 {
+			req.Header.Set("Idempotency-Key", key)
+		}
+		err := insertHandlerInternal(w, req, 1024, url == "/api/rollup")
+		if errExpected {
+			if err == nil {
+				t.Fatalf("expecting non-nil error")
+			}
+		} else if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if rows := rc.RowsCount(); rows != rowsExpected {
+			t.Fatalf("unexpected number of rows; got %d; want %d", rows, rowsExpected)
+		}
+		if replayed := w.Header().Get(IdempotentReplayedHeader) == "true"; replayed != replayedExpected {
+			t.Fatalf("unexpected %s header; got %v; want %v", IdempotentReplayedHeader, replayed, replayedExpected)
+		}
+	}
+
+	row := `{"metric": "foo", "timestamp": 1, "value": 2, "tags": {"a": "b"}}`
+	f("/api/put", row, "key1", 1, false, false)
+	f("/api/put", row, "key1", 0, true, false)
+
+	// The key is used instead of the body for detecting retries
+	f("/api/put", `[`+row+`,`+row+`]`, "key1", 0, true, false)
+	f("/api/put", `[`+row+`,`+row+`]`, "key2", 2, false, false)
+
+	// Requests without the key are always processed
+	f("/api/put", row, "", 1, false, false)
+	f("/api/put", row, "", 1, false, false)
+
+	// The original error is returned for the same key
+	f("/api/put", `{"metric": "foo"}`, "key3", 0, false, true)
+	f("/api/put", row, "key3", 0, true, true)
+
+	// Keys for /api/rollup are independent of /api/put
+	f("/api/rollup", `{"metric": "foo", "timestamp": 1, "value": 2, "tags": {"a": "b"}, "interval": "1h", "aggregator": "sum"}`, "key1", 1, false, false)
+
+	// Too long key
+	f("/api/put", row, strings.Repeat("x", maxIdempotencyKeyLen+1), 0, false, true)
+}
+
+func TestWriteIdempotencyConflictError(t *testing.T) {
+	req := httptest.NewRequest("POST", "/api/put", nil)
+
+	w := httptest.NewRecorder()
+	if WriteIdempotencyConflictError(w, req, fmt.Errorf("cannot store metrics")) {
+		t.Fatalf("the response mustn't be written for other errors")
+	}
+
+	w = httptest.NewRecorder()
+	if !WriteIdempotencyConflictError(w, req, errIdempotencyConflict) {
+		t.Fatalf("the response must be written for conflicting Idempotency-Key")
+	}
+	if w.Code != http.StatusConflict {
+		t.Fatalf("unexpected status code; got %d; want %d", w.Code, http.StatusConflict)
+	}
+	if ra := w.Header().Get("Retry-After"); ra != idempotencyConflictRetryAfterSeconds {
+		t.Fatalf("unexpected Retry-After header; got %q; want %q", ra, idempotencyConflictRetryAfterSeconds)
+	}
+}
@@ -0,0 +1,45 @@
+package opentsdbhttp
+
+import (
+	"flag"
+	"net/http"
+	"strconv"
+
+	"github.com/VictoriaMetrics/metrics"
+)
+
+var maxTagsOverrideAuthKey = flag.String("opentsdbhttp.maxTagsOverrideAuthKey", "", "authKey, which allows OpenTSDB HTTP requests with `authKey` query arg "+
+	"to override -opentsdbhttp.maxTagsPerRow with "+MaxTagsPerRowHeader+" request header. The header is ignored for requests without the authKey, "+
+	"so they always get -opentsdbhttp.maxTagsPerRow limit. The header is ignored for all the requests by default")
+
+// MaxTagsPerRowHeader is the request header for overriding -opentsdbhttp.maxTagsPerRow for a single trusted request.
+//
+// See -opentsdbhttp.maxTagsOverrideAuthKey.
+const MaxTagsPerRowHeader = "X-Max-Tags-Per-Row"
+
+var (
+	maxTagsOverridesApplied = metrics.NewCounter(`vm_opentsdbhttp_max_tags_overrides_total{result="applied"}`)
+	maxTagsOverridesIgnored = metrics.NewCounter(`vm_opentsdbhttp_max_tags_overrides_total{result="ignored"}`)
+)
+
+// getMaxTagsPerRow returns the limit on the number of tags per row from MaxTagsPerRowHeader of req.
+//
+// Zero is returned if -opentsdbhttp.maxTagsPerRow must be used, i.e. if the header is missing,
+// if it contains invalid value or if req doesn't contain `authKey` query arg matching -opentsdbhttp.maxTagsOverrideAuthKey.
+func getMaxTagsPerRow(req *http.Request) int {
+	s := req.Header.Get(MaxTagsPerRowHeader)
+	if len(s) == 0 {
+		return 0
+	}
+	if len(*maxTagsOverrideAuthKey) == 0 || req.URL.Query().Get("authKey") != *maxTagsOverrideAuthKey {
+		maxTagsOverridesIgnored.Inc()
+		return 0
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil || n <= 0 {
+		maxTagsOverridesIgnored.Inc()
+		return 0
+	}
+	maxTagsOverridesApplied.Inc()
+	return n
+}
@@ -0,0 +1,66 @@
+package opentsdbhttp
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/valyala/fastjson"
+)
+
+func TestGetMaxTagsPerRow(t *testing.T) {
+	defer func() {
+		*maxTagsOverrideAuthKey = ""
+	}()
+
+	f := func(url, header, authKey string, resultExpected int) {
+		t.Helper()
+		*maxTagsOverrideAuthKey = authKey
+		req := httptest.NewRequest("POST", url, nil)
+		if len(header) > 0 {
+			req.Header.Set(MaxTagsPerRowHeader, header)
+		}
+		if result := getMaxTagsPerRow(req); result != resultExpected {
+			t.Fatalf("unexpected result for url=%q, header=%q; got %d; want %d", url, header, result, resultExpected)
+		}
+	}
+	f("/api/put?authKey=secret", "5000", "secret", 5000)
+	f("/api/put?authKey=secret", "", "secret", 0)
+
+	// Untrusted requests get the default limit
+	f("/api/put", "5000", "secret", 0)
+	f("/api/put?authKey=foo", "5000", "secret", 0)
+	f("/api/put?authKey=", "5000", "", 0)
+
+	// Invalid header values are ignored
+	f("/api/put?authKey=secret", "foo", "secret", 0)
+	f("/api/put?authKey=secret", "-1", "secret", 0)
+	f("/api/put?authKey=secret", "0", "secret", 0)
+}
+
+func TestRowsUnmarshalMaxTagsPerRowOverride(t *testing.T) {
+	defer func(n int) {
+		*maxTagsPerRow = n
+	}(*maxTagsPerRow)
+	*maxTagsPerRow = 1
+
+	var p fastjson.Parser
+	v, err := p.Parse(`{"metric": "foo", "timestamp": 1, "value": 2, "tags": {"a": "b", "c": "d"}}`)
+	if err != nil {
+		t.Fatalf("cannot parse json: %s", err)
+	}
+	var rows Rows
+	if err := rows.Unmarshal(v); err == nil {
+		t.Fatalf("expecting non-nil error for row exceeding -opentsdbhttp.maxTagsPerRow")
+	}
+	rows.MaxTagsPerRow = 2
+	if err := rows.Unmarshal(v); err != nil {
+		t.Fatalf("unexpected error with overridden limit: %s", err)
+	}
+	if len(rows.Rows[0].Tags) != 2 {
+		t.Fatalf("unexpected number of tags; got %d; want 2", len(rows.Rows[0].Tags))
+	}
+	rows.Reset()
+	if rows.MaxTagsPerRow != 0 {
+		t.Fatalf("MaxTagsPerRow must be reset")
+	}
+}
@@ -0,0 +1,38 @@
+package opentsdbhttp
+
+import (
+	"flag"
+	"time"
+
+	"github.com/VictoriaMetrics/VictoriaMetrics/app/vminsert/common"
+	"github.com/VictoriaMetrics/metrics"
+)
+
+var maxParseDuration = flag.Duration("opentsdbhttp.maxParseDuration", 0, "The maximum duration for parsing a single OpenTSDB HTTP request. "+
+	"Requests exceeding the duration are rejected with `parse timeout` error. This protects from pathological JSON bodies, which take too much CPU to parse. "+
+	"The duration is checked between parse steps, so a single step may exceed it. In -opentsdbhttp.streamParse mode the rest of the request body isn't read. "+
+	"Zero means no limit. See also vm_parse_timeouts_total metric")
+
+var parseTimeouts = metrics.NewCounter(`vm_parse_timeouts_total{type="opentsdb-http"}`)
+
+// startParseDeadline starts measuring the parse duration for the current request if -opentsdbhttp.maxParseDuration is set.
+func (ctx *pushCtx) startParseDeadline() {
+	if *maxParseDuration <= 0 {
+		return
+	}
+	ctx.parseDeadline = time.Now().Add(*maxParseDuration)
+}
+
+// checkParseDeadline returns false if parsing the current request takes more than -opentsdbhttp.maxParseDuration.
+//
+// Call ctx.Error in order to obtain the error.
+func (ctx *pushCtx) checkParseDeadline() bool {
+	if ctx.parseDeadline.IsZero() || time.Now().Before(ctx.parseDeadline) {
+		return true
+	}
+	parseTimeouts.Inc()
+	opentsdbUnmarshalErrors.Inc()
+	ctx.err = common.NewParseError(common.ErrParseTimeout, "parsing the request takes more than -opentsdbhttp.maxParseDuration=%s", *maxParseDuration)
+	opentsdbParseErrorLogger.LogWithRequestID(ctx.err, ctx.reqBuf.B, ctx.requestID)
+	return false
+}
@@ -0,0 +1,56 @@
+package opentsdbhttp
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/VictoriaMetrics/VictoriaMetrics/app/vminsert/common"
+)
+
+func TestPushCtxReadParseTimeout(t *testing.T) {
+	defer func(d time.Duration, stream bool) {
+		*maxParseDuration = d
+		*streamParse = stream
+	}(*maxParseDuration, *streamParse)
+
+	body := `[` + strings.Repeat(`{"metric": "foo", "timestamp": 1, "value": 2, "tags": {"a": "b"}},`, 1000) + `{"metric": "foo", "timestamp": 1, "value": 2, "tags": {"a": "b"}}]`
+	f := func(d time.Duration, stream, timeoutExpected bool) {
+		t.Helper()
+		*maxParseDuration = d
+		*streamParse = stream
+		ctx := getPushCtx()
+		defer putPushCtx(ctx)
+		timeoutsBefore := parseTimeouts.Get()
+		rows := 0
+		for ctx.Read(strings.NewReader(body), int64(len(body))) {
+			rows += len(ctx.Rows.Rows)
+		}
+		err := ctx.Error()
+		if !timeoutExpected {
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if rows != 1001 {
+				t.Fatalf("unexpected number of rows; got %d; want 1001", rows)
+			}
+			return
+		}
+		if common.GetParseErrorCode(err) != common.ErrParseTimeout {
+			t.Fatalf("expecting parse timeout error; got %v", err)
+		}
+		if n := parseTimeouts.Get() - timeoutsBefore; n != 1 {
+			t.Fatalf("unexpected number of parse timeouts; got %d; want 1", n)
+		}
+	}
+
+	// The parse duration isn't limited by default
+	f(0, false, false)
+	f(0, true, false)
+
+	f(time.Hour, false, false)
+	f(time.Hour, true, false)
+
+	f(time.Nanosecond, false, true)
+	f(time.Nanosecond, true, true)
+}
@@ -1,21 +1,90 @@
 package opentsdbhttp
 
 import (
-	"fmt"
-	"github.com/valyala/fastjson"
+	"flag"
+	"strconv"
+	"time"
 	"unsafe"
+
+	"github.com/VictoriaMetrics/VictoriaMetrics/app/vminsert/common"
+	"github.com/VictoriaMetrics/VictoriaMetrics/app/vminsert/opentsdb"
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/logger"
+	"github.com/VictoriaMetrics/metrics"
+	"github.com/valyala/fastjson"
 )
 
-const SECOND_MASK int64 = 0x7FFFFFFF00000000
+var (
+	coerceTagValues = flag.Bool("opentsdbhttp.coerceTagValues", false, "Whether to convert numeric and boolean tag values to strings in OpenTSDB HTTP requests. "+
+		"By default such tags are dropped. See also vm_opentsdbhttp_dropped_tags_total metric")
+	maxTagsPerRequest = flag.Int("opentsdbhttp.maxTagsPerRequest", 0, "The maximum number of tags summed across all the rows in a single OpenTSDB HTTP request. "+
+		"Requests exceeding the limit are rejected. This bounds memory usage for big requests with many tags per row. The limit is disabled by default")
+	maxTagsPerRow = flag.Int("opentsdbhttp.maxTagsPerRow", 0, "The maximum number of tags in a single row of OpenTSDB HTTP request. "+
+		"Requests with rows exceeding the limit are rejected without unmarshaling the rest of tags. The limit is disabled by default. See also -opentsdbhttp.maxTagsOverrideAuthKey")
+	allowMetricArrays = flag.Bool("opentsdbhttp.allowMetricArrays", false, "Whether to accept OpenTSDB HTTP rows with `metric` and `value` arrays of equal lengths "+
+		"such as `{\"metric\":[\"a\",\"b\"],\"value\":[1,2],...}`. Such rows are expanded into a row per metric sharing timestamp and tags")
+	parseStringTimestamps = flag.Bool("opentsdbhttp.parseStringTimestamps", false, "Whether to accept OpenTSDB HTTP rows with RFC3339 string timestamps "+
+		"such as `\"2023-01-01T00:00:00Z\"` in addition to numeric timestamps. By default such rows are rejected")
+	defaultValueOnMissing = flag.String("opentsdbhttp.defaultValueOnMissing", "", "The value to store for OpenTSDB HTTP rows without `value` field, for instance, 1 for presence-style heartbeat rows. "+
+		"By default such rows are rejected in the same way as OpenTSDB does. See also vm_opentsdbhttp_default_values_total metric")
+)
 
+// InitFlags must be called after flag.Parse call.
+func InitFlags() {
+	initPushCtxPool()
+	if *streamParse && common.IsAtomicBatch() {
+		logger.Fatalf("-opentsdbhttp.streamParse cannot be used together with -insert.atomicBatch, since streamed requests are written in batches while being read")
+	}
+	if len(*defaultValueOnMissing) == 0 {
+		return
+	}
+	v, err := strconv.ParseFloat(*defaultValueOnMissing, 64)
+	if err != nil {
+		logger.Fatalf("cannot parse -opentsdbhttp.defaultValueOnMissing=%q: %s", *defaultValueOnMissing, err)
+	}
+	missingValueDefault = v
+	hasMissingValueDefault = true
+}
+
+// missingValueDefault is used for rows without value if hasMissingValueDefault is set.
+//
+// See -opentsdbhttp.defaultValueOnMissing.
+var (
+	missingValueDefault    float64
+	hasMissingValueDefault bool
+)
+
+const SECOND_MASK int64 = 0x7FFFFFFF00000000
 
 // Rows contains parsed OpenTSDB rows.
 type Rows struct {
 	Rows []Row
 
+	// MaxTagsPerRow overrides -opentsdbhttp.maxTagsPerRow if it is positive.
+	MaxTagsPerRow int
+
 	tagsPool []Tag
 }
 
+// unmarshalOpts contains options for unmarshaling rows.
+type unmarshalOpts struct {
+	// rollup is set to true when unmarshaling rollup rows.
+	rollup bool
+
+	// maxTagsPerRow is the maximum number of tags per row. Zero means no limit.
+	maxTagsPerRow int
+}
+
+func (rs *Rows) unmarshalOpts(rollup bool) unmarshalOpts {
+	maxTags := *maxTagsPerRow
+	if rs.MaxTagsPerRow > 0 {
+		maxTags = rs.MaxTagsPerRow
+	}
+	return unmarshalOpts{
+		rollup:        rollup,
+		maxTagsPerRow: maxTags,
+	}
+}
+
 // Reset resets rs.
 func (rs *Rows) Reset() {
 	// Release references to objects, so they can be GC'ed.
@@ -24,6 +93,7 @@ func (rs *Rows) Reset() {
 		rs.Rows[i].reset()
 	}
 	rs.Rows = rs.Rows[:0]
+	rs.MaxTagsPerRow = 0
 
 	for i := range rs.tagsPool {
 		rs.tagsPool[i].reset()
@@ -38,11 +108,63 @@ func (rs *Rows) Reset() {
 // s must be unchanged until rs is in use.
 func (rs *Rows) Unmarshal(av *fastjson.Value) error {
 	var err error
-	rs.Rows, rs.tagsPool, err = unmarshalRows(rs.Rows[:0], av, rs.tagsPool[:0])
+	rs.Rows, rs.tagsPool, err = unmarshalRows(rs.Rows[:0], av, rs.tagsPool[:0], rs.unmarshalOpts(false))
+	tagsPoolStats.Update(len(rs.tagsPool), cap(rs.tagsPool))
+	if err != nil {
+		return err
+	}
+	return checkTagsAliasing(rs.Rows)
+}
+
+// UnmarshalRollup unmarshals OpenTSDB rollup rows from http POST body.
+//
+// Rollup fields such as `interval`, `aggregator` and `groupByAggregator`
+// are stored in `rollup_interval`, `rollup_aggregator` and `rollup_group_by_aggregator` tags.
+//
+// See http://opentsdb.net/docs/build/html/api_http/rollup.html
+//
+// s must be unchanged until rs is in use.
+func (rs *Rows) UnmarshalRollup(av *fastjson.Value) error {
+	var err error
+	rs.Rows, rs.tagsPool, err = unmarshalRows(rs.Rows[:0], av, rs.tagsPool[:0], rs.unmarshalOpts(true))
+	tagsPoolStats.Update(len(rs.tagsPool), cap(rs.tagsPool))
 	if err != nil {
 		return err
 	}
-	return err
+	return checkTagsAliasing(rs.Rows)
+}
+
+// UnmarshalConcatenated unmarshals OpenTSDB rows from b containing successive top-level JSON values
+// without enclosing array such as `{...}{...}`. Such bodies are sent by some buggy clients.
+//
+// Rollup rows are unmarshaled if rollup is set. sc is used for scanning b.
+// The number of the parsed JSON documents is returned.
+//
+// sc must be unchanged until rs is in use.
+func (rs *Rows) UnmarshalConcatenated(sc *fastjson.Scanner, b []byte, rollup bool) (int, error) {
+	sc.InitBytes(b)
+	rs.Rows = rs.Rows[:0]
+	rs.tagsPool = rs.tagsPool[:0]
+	docs := 0
+	var err error
+	for sc.Next() {
+		docs++
+		rs.Rows, rs.tagsPool, err = unmarshalRows(rs.Rows, sc.Value(), rs.tagsPool, rs.unmarshalOpts(rollup))
+		if err != nil {
+			break
+		}
+	}
+	tagsPoolStats.Update(len(rs.tagsPool), cap(rs.tagsPool))
+	if err != nil {
+		return docs, common.WrapParseError(err, "cannot unmarshal JSON document #%d: %s", docs, err)
+	}
+	if err := sc.Error(); err != nil {
+		return docs, common.NewParseError(common.ErrBadFormat, "cannot parse JSON document #%d: %s", docs+1, err)
+	}
+	if docs == 0 {
+		return 0, common.NewParseError(common.ErrBadFormat, "cannot unmarshal OpenTSDB body, it is empty")
+	}
+	return docs, checkTagsAliasing(rs.Rows)
 }
 
 // Row is a single OpenTSDB row.
@@ -64,103 +186,300 @@ func ob2s(b []byte) string {
 	return *(*string)(unsafe.Pointer(&b))
 }
 
-func (r *Row) unmarshal(o *fastjson.Value, tagsPool []Tag) ([]Tag, error) {
+func (r *Row) unmarshal(o *fastjson.Value, tagsPool []Tag, opts unmarshalOpts) ([]Tag, error) {
 	r.reset()
 	m := o.GetStringBytes("metric")
 	if m == nil {
-		return tagsPool, fmt.Errorf("missing `metric` field in %s", o)
+		return tagsPool, common.NewParseError(common.ErrMissingMetric, "missing `metric` field in %s", o)
 	}
-	r.Metric = ob2s(m)
+	metric, err := opentsdb.CheckMetric(ob2s(m))
+	if err != nil {
+		return tagsPool, err
+	}
+	r.Metric = metric
+
+	if err := r.unmarshalTimestamp(o); err != nil {
+		return tagsPool, err
+	}
+
+	rawV := o.Get("value")
+	if rawV != nil {
+		if rawV.Type() == fastjson.TypeNull {
+			return tagsPool, newNullFieldError("value", o)
+		}
+		v, err := rawV.Float64()
+		if err != nil {
+			return tagsPool, common.NewParseError(common.ErrBadValue, "invalid `value` field in %s", o)
+		}
+		r.Value = v
+	} else if hasMissingValueDefault {
+		r.Value = missingValueDefault
+		defaultValues.Inc()
+	} else {
+		return tagsPool, common.NewParseError(common.ErrMissingValue, "missing `value` field in %s", o)
+	}
+	return r.unmarshalTags(o, tagsPool, opts)
+}
 
+// newNullFieldError returns an error for JSON null in the given field of o.
+//
+// Nulls usually indicate a serialization bug in the client, so they are reported with a distinct error code.
+func newNullFieldError(field string, o *fastjson.Value) error {
+	nullFieldRows.Inc()
+	return common.NewParseError(common.ErrNullField, "`%s` field cannot be null in %s", field, o)
+}
+
+var nullFieldRows = metrics.NewCounter(`vm_rows_rejected_total{reason="null_field"}`)
+
+func (r *Row) unmarshalTimestamp(o *fastjson.Value) error {
 	rawTs := o.Get("timestamp")
-	if rawTs != nil {
+	if rawTs != nil && rawTs.Type() == fastjson.TypeNull {
+		return newNullFieldError("timestamp", o)
+	}
+	if rawTs != nil && rawTs.Type() == fastjson.TypeString && *parseStringTimestamps {
+		t, err := time.Parse(time.RFC3339Nano, ob2s(rawTs.GetStringBytes()))
+		if err != nil {
+			return common.NewParseError(common.ErrBadTimestamp, "invalid `timestamp` field in %s: %s", o, err)
+		}
+		stringTimestamps.Inc()
+		r.Timestamp = opentsdb.ShiftTimestamp(t.UnixNano() / 1e6)
+	} else if rawTs != nil {
 		ts, err := rawTs.Int64()
 		if err != nil {
 			// if timestamp has fractional part
 			tsF, err := rawTs.Float64()
 			if err != nil {
-				return tagsPool, fmt.Errorf("invalid `timestamp` field in %s", o)
+				return common.NewParseError(common.ErrBadTimestamp, "invalid `timestamp` field in %s", o)
 			}
 			//probably this is millisecs, though logic should be improved (microseconds?)
 			ts = int64(tsF * 1000)
 		}
 		// according to opentsdb/src/core/IncomingDataPoints.java, addPointInternal
-		if ts & SECOND_MASK == 0 {
-			ts *=  1000
-		}
-		r.Timestamp = ts
-	} else {
-		return tagsPool, fmt.Errorf("missing `timestamp` field in %s", o)
-	}
-
-	rawV := o.Get("value")
-	if rawV != nil {
-		v, err := rawV.Float64()
-		if err != nil {
-			return tagsPool, fmt.Errorf("invalid `value` field in %s", o)
+		if ts&SECOND_MASK == 0 {
+			ts *= 1000
 		}
-		r.Value = v
+		r.Timestamp = opentsdb.ShiftTimestamp(ts)
 	} else {
-		return tagsPool, fmt.Errorf("missing `value` field in %s", o)
+		return common.NewParseError(common.ErrMissingTimestamp, "missing `timestamp` field in %s", o)
 	}
+	return nil
+}
 
+// unmarshalTags appends tags from o to tagsPool and sets r.Tags to them.
+func (r *Row) unmarshalTags(o *fastjson.Value, tagsPool []Tag, opts unmarshalOpts) ([]Tag, error) {
 	rawTags := o.GetObject("tags")
 
 	if rawTags == nil {
-		return tagsPool, fmt.Errorf("missing `tags` field in %s", o)
+		if o.Get("tags") != nil {
+			return tagsPool, common.NewParseError(common.ErrBadTag, "invalid `tags` field in %s", o)
+		}
+		if !*opentsdb.AllowNoTags {
+			return tagsPool, common.NewParseError(common.ErrMissingTags, "missing `tags` field in %s", o)
+		}
 	}
 
 	tagsStart := len(tagsPool)
-	tagsPool = unmarshalTags(tagsPool, rawTags)
+	if rawTags != nil {
+		var err error
+		tagsPool, err = unmarshalTags(tagsPool, rawTags, opts.maxTagsPerRow)
+		if err != nil {
+			return tagsPool, common.WrapParseError(err, "cannot unmarshal tags in %s: %s", o, err)
+		}
+		if len(tagsPool) == tagsStart && rawTags.Len() > 0 && !*opentsdb.AllowNoTags {
+			// All the tags have been dropped according to -opentsdb.emptyTagValues or because of unsupported value types.
+			return tagsPool, common.NewParseError(common.ErrMissingTags, "no tags left after dropping invalid tags in %s", o)
+		}
+	}
+	if opts.rollup {
+		var err error
+		tagsPool, err = unmarshalRollupTags(tagsPool, o)
+		if err != nil {
+			return tagsPool, err
+		}
+	}
+	if len(tagsPool) == tagsStart {
+		return tagsPool, nil
+	}
 
 	tags := tagsPool[tagsStart:]
 	r.Tags = tags[:len(tags):len(tags)]
 	return tagsPool, nil
 }
 
-func unmarshalRows(dst []Row, av *fastjson.Value, tagsPool []Tag) ([]Row, []Tag, error) {
+// unmarshalRollupTags appends rollup fields from o to dst as tags.
+//
+// See http://opentsdb.net/docs/build/html/api_http/rollup.html
+func unmarshalRollupTags(dst []Tag, o *fastjson.Value) ([]Tag, error) {
+	interval := o.GetStringBytes("interval")
+	if len(interval) == 0 {
+		return dst, common.NewParseError(common.ErrBadFormat, "missing `interval` field in rollup %s", o)
+	}
+	aggregator := o.GetStringBytes("aggregator")
+	groupByAggregator := o.GetStringBytes("groupByAggregator")
+	if len(aggregator) == 0 && len(groupByAggregator) == 0 {
+		return dst, common.NewParseError(common.ErrBadFormat, "missing `aggregator` or `groupByAggregator` field in rollup %s", o)
+	}
+	dst = append(dst, Tag{
+		Key:   "rollup_interval",
+		Value: ob2s(interval),
+	})
+	if len(aggregator) > 0 {
+		dst = append(dst, Tag{
+			Key:   "rollup_aggregator",
+			Value: ob2s(aggregator),
+		})
+	}
+	if len(groupByAggregator) > 0 {
+		dst = append(dst, Tag{
+			Key:   "rollup_group_by_aggregator",
+			Value: ob2s(groupByAggregator),
+		})
+	}
+	return dst, nil
+}
+
+// appendRows appends rows unmarshaled from o to dst.
+//
+// A single row is appended unless o contains `metric` array and -opentsdbhttp.allowMetricArrays is set.
+func appendRows(dst []Row, o *fastjson.Value, tagsPool []Tag, opts unmarshalOpts) ([]Row, []Tag, error) {
+	if *allowMetricArrays {
+		if m := o.Get("metric"); m != nil && m.Type() == fastjson.TypeArray {
+			return appendMultiMetricRows(dst, o, tagsPool, opts)
+		}
+	}
+	dst = growRows(dst)
+	r := &dst[len(dst)-1]
 	var err error
-	if av == nil {
-		err = fmt.Errorf("cannot unmarshal OpenTSDB body, it is empty")
+	tagsPool, err = r.unmarshal(o, tagsPool, opts)
+	return dst, tagsPool, err
+}
+
+// appendMultiMetricRows appends a row per item of `metric` array in o to dst.
+//
+// Values are taken from `value` array of the same length. All the appended rows share timestamp and tags,
+// so their Tags mustn't be modified.
+func appendMultiMetricRows(dst []Row, o *fastjson.Value, tagsPool []Tag, opts unmarshalOpts) ([]Row, []Tag, error) {
+	names, _ := o.Get("metric").Array()
+	if len(names) == 0 {
+		return dst, tagsPool, common.NewParseError(common.ErrMissingMetric, "empty `metric` array in %s", o)
+	}
+	rawV := o.Get("value")
+	if rawV == nil {
+		return dst, tagsPool, common.NewParseError(common.ErrMissingValue, "missing `value` field in %s", o)
+	}
+	if rawV.Type() == fastjson.TypeNull {
+		return dst, tagsPool, newNullFieldError("value", o)
+	}
+	values, err := rawV.Array()
+	if err != nil {
+		return dst, tagsPool, common.NewParseError(common.ErrBadValue, "`value` field must be an array for `metric` array in %s", o)
+	}
+	if len(values) != len(names) {
+		return dst, tagsPool, common.NewParseError(common.ErrBadFormat, "`metric` and `value` arrays must have equal lengths; got %d and %d items in %s",
+			len(names), len(values), o)
+	}
+	var shared Row
+	if err := shared.unmarshalTimestamp(o); err != nil {
 		return dst, tagsPool, err
 	}
-	if av.Type() == fastjson.TypeObject {
-		if cap(dst) > len(dst) {
-			dst = dst[:len(dst)+1]
-		} else {
-			dst = append(dst, Row{})
+	tagsPool, err = shared.unmarshalTags(o, tagsPool, opts)
+	if err != nil {
+		return dst, tagsPool, err
+	}
+	rowsStart := len(dst)
+	for i, name := range names {
+		m, err := name.StringBytes()
+		if err != nil {
+			return dst[:rowsStart], tagsPool, common.NewParseError(common.ErrMissingMetric, "invalid item #%d in `metric` array in %s", i, o)
+		}
+		metric, err := opentsdb.CheckMetric(ob2s(m))
+		if err != nil {
+			return dst[:rowsStart], tagsPool, err
 		}
+		if values[i].Type() == fastjson.TypeNull {
+			return dst[:rowsStart], tagsPool, newNullFieldError("value", o)
+		}
+		v, err := values[i].Float64()
+		if err != nil {
+			return dst[:rowsStart], tagsPool, common.NewParseError(common.ErrBadValue, "invalid item #%d in `value` array in %s", i, o)
+		}
+		dst = growRows(dst)
 		r := &dst[len(dst)-1]
-		tagsPool, err = r.unmarshal(av, tagsPool)
+		r.Metric = metric
+		r.Tags = shared.Tags
+		r.Value = v
+		r.Timestamp = shared.Timestamp
+	}
+	multiMetricRows.Add(len(names))
+	return dst, tagsPool, nil
+}
+
+var multiMetricRows = metrics.NewCounter(`vm_opentsdbhttp_multi_metric_rows_total`)
+
+func growRows(dst []Row) []Row {
+	if cap(dst) > len(dst) {
+		dst = dst[:len(dst)+1]
+		dst[len(dst)-1].reset()
+		return dst
+	}
+	return append(dst, Row{})
+}
+
+func unmarshalRows(dst []Row, av *fastjson.Value, tagsPool []Tag, opts unmarshalOpts) ([]Row, []Tag, error) {
+	var err error
+	if av == nil {
+		err = common.NewParseError(common.ErrBadFormat, "cannot unmarshal OpenTSDB body, it is empty")
+		return dst, tagsPool, err
+	}
+	if av.Type() == fastjson.TypeObject {
+		dst, tagsPool, err = appendRows(dst, av, tagsPool, opts)
 		if err != nil {
-			err = fmt.Errorf("cannot unmarshal OpenTSDB body %s: %s", av, err)
+			err = common.WrapParseError(err, "cannot unmarshal OpenTSDB body %s: %s", av, err)
 			return dst, tagsPool, err
 		}
 		return dst, tagsPool, nil
 	} else if av.Type() == fastjson.TypeArray {
 		a, _ := av.Array()
 		for _, e := range a {
-			if cap(dst) > len(dst) {
-				dst = dst[:len(dst)+1]
-			} else {
-				dst = append(dst, Row{})
-			}
-			r := &dst[len(dst)-1]
-			tagsPool, err = r.unmarshal(e, tagsPool)
+			dst, tagsPool, err = appendRows(dst, e, tagsPool, opts)
 			if err != nil {
-				err = fmt.Errorf("cannot unmarshal OpenTSDB body %s: %s", e, err)
+				err = common.WrapParseError(err, "cannot unmarshal OpenTSDB body %s: %s", e, err)
+				return dst, tagsPool, err
+			}
+			if *maxTagsPerRequest > 0 && len(tagsPool) > *maxTagsPerRequest {
+				err = common.NewParseError(common.ErrBadFormat, "too many tags in OpenTSDB body; the request contains more than -opentsdbhttp.maxTagsPerRequest=%d tags",
+					*maxTagsPerRequest)
 				return dst, tagsPool, err
 			}
 		}
 		return dst, tagsPool, nil
 	} else {
-		err = fmt.Errorf("cannot unmarshal OpenTSDB body, type is not object or array: %s", av)
+		err = common.NewParseError(common.ErrBadFormat, "cannot unmarshal OpenTSDB body, type is not object or array: %s", av)
 		return dst, tagsPool, err
 	}
 }
 
-func unmarshalTags(dst []Tag, tags *fastjson.Object) []Tag {
+// unmarshalTags appends tags to dst and returns the result.
+//
+// Unmarshaling is stopped as soon as the number of tags exceeds maxTags
+// or the number of tags in dst exceeds -opentsdbhttp.maxTagsPerRequest, so a small gzipped request
+// with a huge tags object cannot blow up dst.
+func unmarshalTags(dst []Tag, tags *fastjson.Object, maxTags int) ([]Tag, error) {
+	var err error
+	tagsStart := len(dst)
 	tags.Visit(func(k []byte, v *fastjson.Value) {
+		if err != nil {
+			return
+		}
+		if maxTags > 0 && len(dst)-tagsStart >= maxTags {
+			err = common.NewParseError(common.ErrBadTag, "too many tags in a single row; it contains more than %d tags; see -opentsdbhttp.maxTagsPerRow", maxTags)
+			return
+		}
+		if *maxTagsPerRequest > 0 && len(dst) >= *maxTagsPerRequest {
+			err = common.NewParseError(common.ErrBadFormat, "too many tags in OpenTSDB body; the request contains more than -opentsdbhttp.maxTagsPerRequest=%d tags",
+				*maxTagsPerRequest)
+			return
+		}
 		if cap(dst) > len(dst) {
 			dst = dst[:len(dst)+1]
 		} else {
@@ -168,17 +487,65 @@ func unmarshalTags(dst []Tag, tags *fastjson.Object) []Tag {
 		}
 		tag := &dst[len(dst)-1]
 
-		tv := v.GetStringBytes()
-		if tv == nil {
-			dst = dst[:len(dst)-1]
+		tag.Key = ob2s(k)
+		switch v.Type() {
+		case fastjson.TypeString:
+			tag.Value = ob2s(v.GetStringBytes())
+		case fastjson.TypeNumber:
+			if !*coerceTagValues {
+				dropTag(&dst)
+				return
+			}
+			tag.Value = string(v.MarshalTo(nil))
+			coercedTags.Inc()
+		case fastjson.TypeTrue:
+			if !*coerceTagValues {
+				dropTag(&dst)
+				return
+			}
+			tag.Value = "true"
+			coercedTags.Inc()
+		case fastjson.TypeFalse:
+			if !*coerceTagValues {
+				dropTag(&dst)
+				return
+			}
+			tag.Value = "false"
+			coercedTags.Inc()
+		default:
+			dropTag(&dst)
 			return
 		}
-		tag.Key = ob2s(k)
-		tag.Value = ob2s(tv)
+		tag.Key, tag.Value = opentsdb.TrimTag(tag.Key, tag.Value)
+		var ok bool
+		ok, err = opentsdb.CheckTag(tag.Key, tag.Value)
+		if err != nil || !ok {
+			// The tag is dropped according to -opentsdb.emptyTagValues or the row is rejected.
+			tag.reset()
+			dst = dst[:len(dst)-1]
+		}
 	})
-	return dst
+	return dst, err
+}
+
+// dropTag drops the last tag with unsupported value type from dst.
+func dropTag(dst *[]Tag) {
+	droppedTags.Inc()
+	tags := *dst
+	tags[len(tags)-1].reset()
+	*dst = tags[:len(tags)-1]
 }
 
+var (
+	coercedTags = metrics.NewCounter(`vm_opentsdbhttp_coerced_tags_total`)
+	droppedTags = metrics.NewCounter(`vm_opentsdbhttp_dropped_tags_total`)
+)
+
+var (
+	defaultValues    = metrics.NewCounter(`vm_opentsdbhttp_default_values_total`)
+	stringTimestamps = metrics.NewCounter(`vm_opentsdbhttp_string_timestamps_total`)
+)
+
 // Tag is an OpenTSDB tag.
 type Tag struct {
 	Key   string
@@ -1,9 +1,15 @@
 package opentsdbhttp
 
 import (
-	"github.com/valyala/fastjson"
+	"flag"
+	"fmt"
 	"reflect"
+	"strings"
 	"testing"
+
+	"github.com/VictoriaMetrics/VictoriaMetrics/app/vminsert/common"
+	"github.com/VictoriaMetrics/VictoriaMetrics/app/vminsert/opentsdb"
+	"github.com/valyala/fastjson"
 )
 
 var parserPool fastjson.ParserPool
@@ -105,17 +111,13 @@ func TestRowsUnmarshalSuccess(t *testing.T) {
 			}},
 		}},
 	})
-	// Empty tag value
+	// Tags with empty values are dropped
 	f(`{"metric": "foobar", "timestamp": 789, "value": -123.456, "tags": {"a":"", "b":"c"}}`, &Rows{
 		Rows: []Row{{
 			Metric:    "foobar",
 			Value:     -123.456,
 			Timestamp: 789000,
 			Tags: []Tag{
-				{
-					Key:   "a",
-					Value: "",
-				},
 				{
 					Key:   "b",
 					Value: "c",
@@ -219,3 +221,735 @@ func TestRowsUnmarshalSuccess(t *testing.T) {
 		},
 	})
 }
+
+func TestRowsUnmarshalAllowNoTags(t *testing.T) {
+	defer func(v bool) {
+		*opentsdb.AllowNoTags = v
+	}(*opentsdb.AllowNoTags)
+	*opentsdb.AllowNoTags = true
+
+	f := func(s string, rowsExpected []Row) {
+		t.Helper()
+		var rows Rows
+		p := parserPool.Get()
+		defer parserPool.Put(p)
+		v, err := p.Parse(s)
+		if err != nil {
+			t.Fatalf("cannot parse json %q: %s", s, err)
+		}
+		if err := rows.Unmarshal(v); err != nil {
+			t.Fatalf("cannot unmarshal %q: %s", s, err)
+		}
+		if !reflect.DeepEqual(rows.Rows, rowsExpected) {
+			t.Fatalf("unexpected rows;\ngot\n%+v;\nwant\n%+v", rows.Rows, rowsExpected)
+		}
+	}
+	f(`{"metric": "foobar", "timestamp": 789, "value": -123.456}`, []Row{{
+		Metric:    "foobar",
+		Value:     -123.456,
+		Timestamp: 789000,
+	}})
+	f(`[{"metric": "foo", "timestamp": 1, "value": 2}, {"metric": "bar", "timestamp": 3, "value": 4, "tags": {"a": "b"}}]`, []Row{
+		{
+			Metric:    "foo",
+			Value:     2,
+			Timestamp: 1000,
+		},
+		{
+			Metric:    "bar",
+			Tags:      []Tag{{Key: "a", Value: "b"}},
+			Value:     4,
+			Timestamp: 3000,
+		},
+	})
+
+	// Invalid tags are still rejected
+	p := parserPool.Get()
+	defer parserPool.Put(p)
+	v, err := p.Parse(`{"metric": "foobar", "timestamp": 789, "value": 1, "tags": 1}`)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	var rows Rows
+	if err := rows.Unmarshal(v); err == nil {
+		t.Fatalf("expecting non-nil error")
+	}
+}
+
+func TestRowsUnmarshalMetricArrays(t *testing.T) {
+	*allowMetricArrays = true
+	defer func() {
+		*allowMetricArrays = false
+	}()
+
+	f := func(s string, rowsExpected []Row) {
+		t.Helper()
+		var rows Rows
+		p := parserPool.Get()
+		defer parserPool.Put(p)
+		v, err := p.Parse(s)
+		if err != nil {
+			t.Fatalf("cannot parse json %q: %s", s, err)
+		}
+		if err := rows.Unmarshal(v); err != nil {
+			t.Fatalf("cannot unmarshal %q: %s", s, err)
+		}
+		if !reflect.DeepEqual(rows.Rows, rowsExpected) {
+			t.Fatalf("unexpected rows;\ngot\n%+v;\nwant\n%+v", rows.Rows, rowsExpected)
+		}
+	}
+	f(`{"metric": ["foo", "bar"], "timestamp": 789, "value": [1, 2.5], "tags": {"host": "a"}}`, []Row{
+		{
+			Metric:    "foo",
+			Tags:      []Tag{{Key: "host", Value: "a"}},
+			Value:     1,
+			Timestamp: 789000,
+		},
+		{
+			Metric:    "bar",
+			Tags:      []Tag{{Key: "host", Value: "a"}},
+			Value:     2.5,
+			Timestamp: 789000,
+		},
+	})
+
+	// Multi-metric objects mixed with regular rows
+	f(`[{"metric": "foo", "timestamp": 1, "value": 2, "tags": {"a": "b"}},
+{"metric": ["bar"], "timestamp": 3, "value": [4], "tags": {"c": "d"}}]`, []Row{
+		{
+			Metric:    "foo",
+			Tags:      []Tag{{Key: "a", Value: "b"}},
+			Value:     2,
+			Timestamp: 1000,
+		},
+		{
+			Metric:    "bar",
+			Tags:      []Tag{{Key: "c", Value: "d"}},
+			Value:     4,
+			Timestamp: 3000,
+		},
+	})
+
+	fFailure := func(s string) {
+		t.Helper()
+		var rows Rows
+		p := parserPool.Get()
+		defer parserPool.Put(p)
+		v, err := p.Parse(s)
+		if err != nil {
+			t.Fatalf("cannot parse json %q: %s", s, err)
+		}
+		if err := rows.Unmarshal(v); err == nil {
+			t.Fatalf("expecting non-nil error for %q", s)
+		}
+	}
+
+	// Mismatched lengths
+	fFailure(`{"metric": ["foo", "bar"], "timestamp": 1, "value": [1], "tags": {"a": "b"}}`)
+	fFailure(`{"metric": ["foo"], "timestamp": 1, "value": [1, 2], "tags": {"a": "b"}}`)
+
+	// Missing or scalar value
+	fFailure(`{"metric": ["foo"], "timestamp": 1, "tags": {"a": "b"}}`)
+	fFailure(`{"metric": ["foo"], "timestamp": 1, "value": 1, "tags": {"a": "b"}}`)
+
+	// Invalid items
+	fFailure(`{"metric": [], "timestamp": 1, "value": [], "tags": {"a": "b"}}`)
+	fFailure(`{"metric": [1], "timestamp": 1, "value": [1], "tags": {"a": "b"}}`)
+	fFailure(`{"metric": ["foo"], "timestamp": 1, "value": ["x"], "tags": {"a": "b"}}`)
+
+	// Missing timestamp and tags
+	fFailure(`{"metric": ["foo"], "value": [1], "tags": {"a": "b"}}`)
+	fFailure(`{"metric": ["foo"], "timestamp": 1, "value": [1]}`)
+
+	// Metric arrays are rejected by default
+	*allowMetricArrays = false
+	fFailure(`{"metric": ["foo"], "timestamp": 1, "value": [1], "tags": {"a": "b"}}`)
+}
+
+func TestRowsUnmarshalDefaultValueOnMissing(t *testing.T) {
+	defer func(v float64, ok bool) {
+		missingValueDefault = v
+		hasMissingValueDefault = ok
+	}(missingValueDefault, hasMissingValueDefault)
+	missingValueDefault = 1
+	hasMissingValueDefault = true
+
+	f := func(s string, rowsExpected []Row) {
+		t.Helper()
+		var rows Rows
+		p := parserPool.Get()
+		defer parserPool.Put(p)
+		v, err := p.Parse(s)
+		if err != nil {
+			t.Fatalf("cannot parse json %q: %s", s, err)
+		}
+		if err := rows.Unmarshal(v); err != nil {
+			t.Fatalf("cannot unmarshal %q: %s", s, err)
+		}
+		if !reflect.DeepEqual(rows.Rows, rowsExpected) {
+			t.Fatalf("unexpected rows;\ngot\n%+v;\nwant\n%+v", rows.Rows, rowsExpected)
+		}
+	}
+	f(`{"metric": "heartbeat", "timestamp": 789, "tags": {"host": "a"}}`, []Row{{
+		Metric:    "heartbeat",
+		Tags:      []Tag{{Key: "host", Value: "a"}},
+		Value:     1,
+		Timestamp: 789000,
+	}})
+
+	// Explicit value is preserved
+	f(`{"metric": "heartbeat", "timestamp": 789, "value": 0, "tags": {"host": "a"}}`, []Row{{
+		Metric:    "heartbeat",
+		Tags:      []Tag{{Key: "host", Value: "a"}},
+		Value:     0,
+		Timestamp: 789000,
+	}})
+
+	// Invalid values are still rejected
+	p := parserPool.Get()
+	defer parserPool.Put(p)
+	v, err := p.Parse(`{"metric": "heartbeat", "timestamp": 789, "value": "x", "tags": {"host": "a"}}`)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	var rows Rows
+	if err := rows.Unmarshal(v); err == nil {
+		t.Fatalf("expecting non-nil error")
+	}
+}
+
+func TestRowsUnmarshalConcatenated(t *testing.T) {
+	f := func(s string, docsExpected int, rowsExpected []Row) {
+		t.Helper()
+		var rows Rows
+		var sc fastjson.Scanner
+		docs, err := rows.UnmarshalConcatenated(&sc, []byte(s), false)
+		if err != nil {
+			t.Fatalf("cannot unmarshal %q: %s", s, err)
+		}
+		if docs != docsExpected {
+			t.Fatalf("unexpected number of documents in %q; got %d; want %d", s, docs, docsExpected)
+		}
+		if !reflect.DeepEqual(rows.Rows, rowsExpected) {
+			t.Fatalf("unexpected rows;\ngot\n%+v;\nwant\n%+v", rows.Rows, rowsExpected)
+		}
+	}
+	f(`{"metric": "foo", "timestamp": 1, "value": 2, "tags": {"a": "b"}}`, 1, []Row{{
+		Metric:    "foo",
+		Tags:      []Tag{{Key: "a", Value: "b"}},
+		Value:     2,
+		Timestamp: 1000,
+	}})
+	f(`{"metric": "foo", "timestamp": 1, "value": 2, "tags": {"a": "b"}}{"metric": "bar", "timestamp": 3, "value": 4, "tags": {"c": "d"}}`, 2, []Row{
+		{
+			Metric:    "foo",
+			Tags:      []Tag{{Key: "a", Value: "b"}},
+			Value:     2,
+			Timestamp: 1000,
+		},
+		{
+			Metric:    "bar",
+			Tags:      []Tag{{Key: "c", Value: "d"}},
+			Value:     4,
+			Timestamp: 3000,
+		},
+	})
+	f(`[{"metric": "foo", "timestamp": 1, "value": 2, "tags": {"a": "b"}}]
+  {"metric": "bar", "timestamp": 3, "value": 4, "tags": {"c": "d"}}
+`, 2, []Row{
+		{
+			Metric:    "foo",
+			Tags:      []Tag{{Key: "a", Value: "b"}},
+			Value:     2,
+			Timestamp: 1000,
+		},
+		{
+			Metric:    "bar",
+			Tags:      []Tag{{Key: "c", Value: "d"}},
+			Value:     4,
+			Timestamp: 3000,
+		},
+	})
+
+	// Invalid documents
+	fFailure := func(s string) {
+		t.Helper()
+		var rows Rows
+		var sc fastjson.Scanner
+		if _, err := rows.UnmarshalConcatenated(&sc, []byte(s), false); err == nil {
+			t.Fatalf("expecting non-nil error when parsing %q", s)
+		}
+	}
+	fFailure(``)
+	fFailure(`   `)
+	fFailure(`{"metric": "foo", "timestamp": 1, "value": 2, "tags": {"a": "b"}}{"metric": "bar"`)
+	fFailure(`{"metric": "foo", "timestamp": 1, "value": 2, "tags": {"a": "b"}}{"metric": "bar", "timestamp": 3, "value": "x", "tags": {"c": "d"}}`)
+	fFailure(`{"metric": "foo", "timestamp": 1, "value": 2, "tags": {"a": "b"}}123`)
+}
+
+func TestRowsUnmarshalErrorCode(t *testing.T) {
+	f := func(s string, codeExpected error) {
+		t.Helper()
+		p := parserPool.Get()
+		defer parserPool.Put(p)
+		v, err := p.Parse(s)
+		if err != nil {
+			t.Fatalf("cannot parse json %q: %s", s, err)
+		}
+		var rows Rows
+		err = rows.Unmarshal(v)
+		if err == nil {
+			t.Fatalf("expecting non-nil error when parsing %q", s)
+		}
+		if common.GetParseErrorCode(err) != codeExpected {
+			t.Fatalf("unexpected error code for %q; got %v; want %v", s, common.GetParseErrorCode(err), codeExpected)
+		}
+	}
+	f(`123`, common.ErrBadFormat)
+	f(`{"timestamp": 1122}`, common.ErrMissingMetric)
+	f(`{"metric": "__name__", "timestamp": 1122, "value": 1, "tags": {"a": "b"}}`, common.ErrBadMetric)
+	f(`{"metric": "aaa"}`, common.ErrMissingTimestamp)
+	f(`{"metric": "aaa", "timestamp": "tststs"}`, common.ErrBadTimestamp)
+	f(`{"metric": "aaa", "timestamp": 1122}`, common.ErrMissingValue)
+	f(`{"metric": "aaa", "timestamp": 1122, "value": "trtr"}`, common.ErrBadValue)
+	f(`{"metric": "aaa", "timestamp": 1122, "value": 33}`, common.ErrMissingTags)
+	f(`{"metric": "aaa", "timestamp": 1122, "value": 0.45, "tags": 1}`, common.ErrBadTag)
+	f(`[{"metric": "aaa", "timestamp": 1122, "value": 1, "tags": {"a": "b"}}, {"metric": "aaa", "timestamp": 1122, "value": "x"}]`, common.ErrBadValue)
+}
+
+func TestRowsUnmarshalRollup(t *testing.T) {
+	f := func(s string, rowsExpected []Row) {
+		t.Helper()
+		var rows Rows
+		p := parserPool.Get()
+		defer parserPool.Put(p)
+		v, err := p.Parse(s)
+		if err != nil {
+			t.Fatalf("cannot parse json %q: %s", s, err)
+		}
+		if err := rows.UnmarshalRollup(v); err != nil {
+			t.Fatalf("cannot unmarshal %q: %s", s, err)
+		}
+		if !reflect.DeepEqual(rows.Rows, rowsExpected) {
+			t.Fatalf("unexpected rows;\ngot\n%+v;\nwant\n%+v", rows.Rows, rowsExpected)
+		}
+	}
+	f(`{"metric": "sys.cpu.nice", "timestamp": 1346846400, "value": 18, "tags": {"host": "web01"}, "interval": "1h", "aggregator": "SUM"}`, []Row{{
+		Metric: "sys.cpu.nice",
+		Tags: []Tag{
+			{Key: "host", Value: "web01"},
+			{Key: "rollup_interval", Value: "1h"},
+			{Key: "rollup_aggregator", Value: "SUM"},
+		},
+		Value:     18,
+		Timestamp: 1346846400000,
+	}})
+	f(`[{"metric": "foo", "timestamp": 1, "value": 2, "tags": {"a": "b"}, "interval": "1m", "groupByAggregator": "MAX"},
+{"metric": "bar", "timestamp": 3, "value": 4, "tags": {}, "interval": "1d", "aggregator": "COUNT", "groupByAggregator": "SUM"}]`, []Row{
+		{
+			Metric: "foo",
+			Tags: []Tag{
+				{Key: "a", Value: "b"},
+				{Key: "rollup_interval", Value: "1m"},
+				{Key: "rollup_group_by_aggregator", Value: "MAX"},
+			},
+			Value:     2,
+			Timestamp: 1000,
+		},
+		{
+			Metric: "bar",
+			Tags: []Tag{
+				{Key: "rollup_interval", Value: "1d"},
+				{Key: "rollup_aggregator", Value: "COUNT"},
+				{Key: "rollup_group_by_aggregator", Value: "SUM"},
+			},
+			Value:     4,
+			Timestamp: 3000,
+		},
+	})
+
+	fail := func(s string) {
+		t.Helper()
+		var rows Rows
+		p := parserPool.Get()
+		defer parserPool.Put(p)
+		v, err := p.Parse(s)
+		if err != nil {
+			t.Fatalf("cannot parse json %q: %s", s, err)
+		}
+		if err := rows.UnmarshalRollup(v); err == nil {
+			t.Fatalf("expecting non-nil error when parsing %q", s)
+		}
+	}
+	// Missing interval
+	fail(`{"metric": "foo", "timestamp": 1, "value": 2, "tags": {"a": "b"}, "aggregator": "SUM"}`)
+	// Missing aggregator
+	fail(`{"metric": "foo", "timestamp": 1, "value": 2, "tags": {"a": "b"}, "interval": "1h"}`)
+}
+
+func TestRowsUnmarshalNonStringTagValues(t *testing.T) {
+	f := func(s string, tagsExpected []Tag) {
+		t.Helper()
+		var rows Rows
+		p := parserPool.Get()
+		defer parserPool.Put(p)
+		v, err := p.Parse(s)
+		if err != nil {
+			t.Fatalf("cannot parse json %q: %s", s, err)
+		}
+		if err := rows.Unmarshal(v); err != nil {
+			t.Fatalf("cannot unmarshal %q: %s", s, err)
+		}
+		if !reflect.DeepEqual(rows.Rows[0].Tags, tagsExpected) {
+			t.Fatalf("unexpected tags;\ngot\n%+v;\nwant\n%+v", rows.Rows[0].Tags, tagsExpected)
+		}
+	}
+	const s = `{"metric": "foo", "timestamp": 1, "value": 2, "tags": {"a": "b", "port": 8080, "ratio": 1.5e3, "ok": true, "bad": false, "n": null, "o": {}}}`
+
+	// Non-string tag values are dropped by default
+	f(s, []Tag{{Key: "a", Value: "b"}})
+
+	// Non-string tag values are coerced to strings
+	defer func(v bool) {
+		*coerceTagValues = v
+	}(*coerceTagValues)
+	*coerceTagValues = true
+	f(s, []Tag{
+		{Key: "a", Value: "b"},
+		{Key: "port", Value: "8080"},
+		{Key: "ratio", Value: "1.5e3"},
+		{Key: "ok", Value: "true"},
+		{Key: "bad", Value: "false"},
+	})
+}
+
+func TestRowsUnmarshalTrimTags(t *testing.T) {
+	f := func(s string, tagsExpected []Tag) {
+		t.Helper()
+		var rows Rows
+		p := parserPool.Get()
+		defer parserPool.Put(p)
+		v, err := p.Parse(s)
+		if err != nil {
+			t.Fatalf("cannot parse json %q: %s", s, err)
+		}
+		if err := rows.Unmarshal(v); err != nil {
+			t.Fatalf("cannot unmarshal %q: %s", s, err)
+		}
+		if !reflect.DeepEqual(rows.Rows[0].Tags, tagsExpected) {
+			t.Fatalf("unexpected tags;\ngot\n%+v;\nwant\n%+v", rows.Rows[0].Tags, tagsExpected)
+		}
+	}
+	const s = `{"metric": "foo", "timestamp": 1, "value": 2, "tags": {"a": " b ", " c ": "d"}}`
+
+	// Whitespace is kept by default
+	f(s, []Tag{{Key: "a", Value: " b "}, {Key: " c ", Value: "d"}})
+
+	trimTagKeys := flag.Lookup("opentsdb.trimTagKeys").Value.String()
+	trimTagValues := flag.Lookup("opentsdb.trimTagValues").Value.String()
+	defer func() {
+		_ = flag.Set("opentsdb.trimTagKeys", trimTagKeys)
+		_ = flag.Set("opentsdb.trimTagValues", trimTagValues)
+	}()
+	setFlag := func(name, value string) {
+		t.Helper()
+		if err := flag.Set(name, value); err != nil {
+			t.Fatalf("cannot set -%s: %s", name, err)
+		}
+	}
+
+	// Trim tag values
+	setFlag("opentsdb.trimTagValues", "true")
+	f(s, []Tag{{Key: "a", Value: "b"}, {Key: " c ", Value: "d"}})
+
+	// Trim tag keys and values
+	setFlag("opentsdb.trimTagKeys", "true")
+	f(s, []Tag{{Key: "a", Value: "b"}, {Key: "c", Value: "d"}})
+}
+
+func TestRowsUnmarshalEmptyTags(t *testing.T) {
+	f := func(s string, tagsExpected []Tag) {
+		t.Helper()
+		var rows Rows
+		p := parserPool.Get()
+		defer parserPool.Put(p)
+		v, err := p.Parse(s)
+		if err != nil {
+			t.Fatalf("cannot parse json %q: %s", s, err)
+		}
+		if err := rows.Unmarshal(v); err != nil {
+			t.Fatalf("cannot unmarshal %q: %s", s, err)
+		}
+		if !reflect.DeepEqual(rows.Rows[0].Tags, tagsExpected) {
+			t.Fatalf("unexpected tags;\ngot\n%+v;\nwant\n%+v", rows.Rows[0].Tags, tagsExpected)
+		}
+	}
+	fail := func(s string) {
+		t.Helper()
+		var rows Rows
+		p := parserPool.Get()
+		defer parserPool.Put(p)
+		v, err := p.Parse(s)
+		if err != nil {
+			t.Fatalf("cannot parse json %q: %s", s, err)
+		}
+		if err := rows.Unmarshal(v); common.GetParseErrorCode(err) != common.ErrBadTag {
+			t.Fatalf("unexpected error when parsing %q; got %v; want %v", s, err, common.ErrBadTag)
+		}
+	}
+	const s = `{"metric": "foo", "timestamp": 1, "value": 2, "tags": {"a": "", "b": "c"}}`
+
+	emptyTagValues := flag.Lookup("opentsdb.emptyTagValues").Value.String()
+	defer func() {
+		_ = flag.Set("opentsdb.emptyTagValues", emptyTagValues)
+	}()
+	setFlag := func(value string) {
+		t.Helper()
+		if err := flag.Set("opentsdb.emptyTagValues", value); err != nil {
+			t.Fatalf("cannot set -opentsdb.emptyTagValues: %s", err)
+		}
+	}
+
+	// Empty tag keys are always rejected
+	fail(`{"metric": "foo", "timestamp": 1, "value": 2, "tags": {"": "c"}}`)
+
+	// Tags with empty values are dropped by default
+	f(s, []Tag{{Key: "b", Value: "c"}})
+
+	// Rows without tags left are rejected unless -opentsdb.allowNoTags is set
+	var rows Rows
+	p := parserPool.Get()
+	defer parserPool.Put(p)
+	v, err := p.Parse(`{"metric": "foo", "timestamp": 1, "value": 2, "tags": {"a": ""}}`)
+	if err != nil {
+		t.Fatalf("cannot parse json: %s", err)
+	}
+	if err := rows.Unmarshal(v); common.GetParseErrorCode(err) != common.ErrMissingTags {
+		t.Fatalf("unexpected error for row without tags left; got %v; want %v", err, common.ErrMissingTags)
+	}
+
+	// Reject rows with empty tag values
+	setFlag("reject")
+	fail(s)
+	setFlag("drop")
+}
+
+func TestRowsUnmarshalMaxTagsPerRequest(t *testing.T) {
+	f := func(s string, errExpected error) {
+		t.Helper()
+		var rows Rows
+		p := parserPool.Get()
+		defer parserPool.Put(p)
+		v, err := p.Parse(s)
+		if err != nil {
+			t.Fatalf("cannot parse json %q: %s", s, err)
+		}
+		err = rows.Unmarshal(v)
+		if errExpected == nil {
+			if err != nil {
+				t.Fatalf("unexpected error when parsing %q: %s", s, err)
+			}
+			return
+		}
+		if common.GetParseErrorCode(err) != errExpected {
+			t.Fatalf("unexpected error when parsing %q; got %v; want %v", s, err, errExpected)
+		}
+	}
+
+	defer func(n int) {
+		*maxTagsPerRequest = n
+	}(*maxTagsPerRequest)
+	*maxTagsPerRequest = 4
+
+	const row = `{"metric": "foo", "timestamp": 1, "value": 2, "tags": {"a": "b", "c": "d"}}`
+	f(`[`+row+`]`, nil)
+	f(`[`+row+`,`+row+`]`, nil)
+	f(`[`+row+`,`+row+`,`+row+`]`, common.ErrBadFormat)
+
+	// Zero means no limit
+	*maxTagsPerRequest = 0
+	f(`[`+row+`,`+row+`,`+row+`]`, nil)
+}
+
+func TestRowsUnmarshalMaxTagsPerRow(t *testing.T) {
+	defer func(n int) {
+		*maxTagsPerRow = n
+	}(*maxTagsPerRow)
+	*maxTagsPerRow = 1000
+
+	// A single row with a huge tags object.
+	var b strings.Builder
+	b.WriteString(`{"metric": "foo", "timestamp": 1, "value": 2, "tags": {`)
+	for i := 0; i < 100000; i++ {
+		if i > 0 {
+			b.WriteString(",")
+		}
+		fmt.Fprintf(&b, `"tag%d": "value%d"`, i, i)
+	}
+	b.WriteString(`}}`)
+	s := b.String()
+
+	p := parserPool.Get()
+	defer parserPool.Put(p)
+	v, err := p.Parse(s)
+	if err != nil {
+		t.Fatalf("cannot parse json: %s", err)
+	}
+	var rows Rows
+	err = rows.Unmarshal(v)
+	if common.GetParseErrorCode(err) != common.ErrBadTag {
+		t.Fatalf("unexpected error; got %v; want %v", common.GetParseErrorCode(err), common.ErrBadTag)
+	}
+	if len(rows.tagsPool) > *maxTagsPerRow {
+		t.Fatalf("tagsPool must be limited by -opentsdbhttp.maxTagsPerRow=%d; got %d tags", *maxTagsPerRow, len(rows.tagsPool))
+	}
+
+	// The limit applies to a single row.
+	*maxTagsPerRow = 2
+	const row = `{"metric": "foo", "timestamp": 1, "value": 2, "tags": {"a": "b", "c": "d"}}`
+	v, err = p.Parse(`[` + row + `,` + row + `]`)
+	if err != nil {
+		t.Fatalf("cannot parse json: %s", err)
+	}
+	if err := rows.Unmarshal(v); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(rows.Rows) != 2 {
+		t.Fatalf("unexpected number of rows; got %d; want 2", len(rows.Rows))
+	}
+
+	// Zero means no limit
+	*maxTagsPerRow = 0
+	v, err = p.Parse(s)
+	if err != nil {
+		t.Fatalf("cannot parse json: %s", err)
+	}
+	if err := rows.Unmarshal(v); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+}
+
+func TestRowsUnmarshalTimestampOffset(t *testing.T) {
+	f := func(s string, timestampExpected int64) {
+		t.Helper()
+		var rows Rows
+		p := parserPool.Get()
+		defer parserPool.Put(p)
+		v, err := p.Parse(s)
+		if err != nil {
+			t.Fatalf("cannot parse json %q: %s", s, err)
+		}
+		if err := rows.Unmarshal(v); err != nil {
+			t.Fatalf("cannot unmarshal %q: %s", s, err)
+		}
+		if ts := rows.Rows[0].Timestamp; ts != timestampExpected {
+			t.Fatalf("unexpected timestamp for %q; got %d; want %d", s, ts, timestampExpected)
+		}
+	}
+
+	offset := flag.Lookup("opentsdb.timestampOffsetSeconds").Value.String()
+	defer func() {
+		_ = flag.Set("opentsdb.timestampOffsetSeconds", offset)
+	}()
+	if err := flag.Set("opentsdb.timestampOffsetSeconds", "946684800"); err != nil {
+		t.Fatalf("cannot set -opentsdb.timestampOffsetSeconds: %s", err)
+	}
+
+	// The offset is applied after timestamps are converted to milliseconds
+	f(`{"metric": "foo", "timestamp": 1000, "value": 1, "tags": {"a": "b"}}`, 946685800000)
+	f(`{"metric": "foo", "timestamp": 1000000000000, "value": 1, "tags": {"a": "b"}}`, 1946684800000)
+}
+
+func TestRowsUnmarshalStringTimestamps(t *testing.T) {
+	f := func(s string, timestampExpected int64, errExpected bool) {
+		t.Helper()
+		var rows Rows
+		p := parserPool.Get()
+		defer parserPool.Put(p)
+		v, err := p.Parse(s)
+		if err != nil {
+			t.Fatalf("cannot parse json %q: %s", s, err)
+		}
+		err = rows.Unmarshal(v)
+		if errExpected {
+			if err == nil {
+				t.Fatalf("expecting non-nil error for %q", s)
+			}
+			if common.GetParseErrorCode(err) != common.ErrBadTimestamp {
+				t.Fatalf("unexpected error code for %q: %s", s, err)
+			}
+			return
+		}
+		if err != nil {
+			t.Fatalf("cannot unmarshal %q: %s", s, err)
+		}
+		if ts := rows.Rows[0].Timestamp; ts != timestampExpected {
+			t.Fatalf("unexpected timestamp for %q; got %d; want %d", s, ts, timestampExpected)
+		}
+	}
+
+	// String timestamps are rejected by default
+	f(`{"metric": "foo", "timestamp": "2023-01-01T00:00:00Z", "value": 1, "tags": {"a": "b"}}`, 0, true)
+
+	*parseStringTimestamps = true
+	defer func() {
+		*parseStringTimestamps = false
+	}()
+	f(`{"metric": "foo", "timestamp": "2023-01-01T00:00:00Z", "value": 1, "tags": {"a": "b"}}`, 1672531200000, false)
+	f(`{"metric": "foo", "timestamp": "2023-01-01T00:00:00.123Z", "value": 1, "tags": {"a": "b"}}`, 1672531200123, false)
+	f(`{"metric": "foo", "timestamp": "2023-01-01T02:00:00+02:00", "value": 1, "tags": {"a": "b"}}`, 1672531200000, false)
+
+	// Numeric timestamps are still accepted
+	f(`{"metric": "foo", "timestamp": 1672531200, "value": 1, "tags": {"a": "b"}}`, 1672531200000, false)
+
+	// Non-parseable strings
+	f(`{"metric": "foo", "timestamp": "yesterday", "value": 1, "tags": {"a": "b"}}`, 0, true)
+	f(`{"metric": "foo", "timestamp": "1672531200", "value": 1, "tags": {"a": "b"}}`, 0, true)
+	f(`{"metric": "foo", "timestamp": "2023-01-01", "value": 1, "tags": {"a": "b"}}`, 0, true)
+}
+
+func TestRowsUnmarshalNullFields(t *testing.T) {
+	defer func(v bool) {
+		*allowMetricArrays = v
+	}(*allowMetricArrays)
+	*allowMetricArrays = true
+
+	f := func(s string) {
+		t.Helper()
+		var rows Rows
+		p := parserPool.Get()
+		defer parserPool.Put(p)
+		v, err := p.Parse(s)
+		if err != nil {
+			t.Fatalf("cannot parse json %q: %s", s, err)
+		}
+		n := nullFieldRows.Get()
+		if err := rows.Unmarshal(v); common.GetParseErrorCode(err) != common.ErrNullField {
+			t.Fatalf("expecting ErrNullField for %q; got %v", s, err)
+		}
+		if nullFieldRows.Get()-n != 1 {
+			t.Fatalf("expecting vm_rows_rejected_total{reason=\"null_field\"} to be incremented for %q", s)
+		}
+	}
+	f(`{"metric": "foo", "timestamp": 1, "value": null, "tags": {"a": "b"}}`)
+	f(`{"metric": "foo", "timestamp": null, "value": 2, "tags": {"a": "b"}}`)
+	f(`[{"metric": "foo", "timestamp": 1, "value": 2, "tags": {"a": "b"}}, {"metric": "foo", "timestamp": 1, "value": null, "tags": {"a": "b"}}]`)
+	f(`{"metric": ["foo", "bar"], "timestamp": 1, "value": null, "tags": {"a": "b"}}`)
+	f(`{"metric": ["foo", "bar"], "timestamp": 1, "value": [1, null], "tags": {"a": "b"}}`)
+	f(`{"metric": ["foo", "bar"], "timestamp": null, "value": [1, 2], "tags": {"a": "b"}}`)
+
+	// Null tag values are dropped in the same way as other non-string tag values.
+	var rows Rows
+	p := parserPool.Get()
+	defer parserPool.Put(p)
+	v, err := p.Parse(`{"metric": "foo", "timestamp": 1, "value": 2, "tags": {"a": "b", "n": null}}`)
+	if err != nil {
+		t.Fatalf("cannot parse json: %s", err)
+	}
+	if err := rows.Unmarshal(v); err != nil {
+		t.Fatalf("unexpected error for null tag value: %s", err)
+	}
+	if tags := rows.Rows[0].Tags; len(tags) != 1 || tags[0].Key != "a" {
+		t.Fatalf("unexpected tags for null tag value: %+v", tags)
+	}
+}
@@ -3,6 +3,8 @@ package opentsdbhttp
 import (
 	"fmt"
 	"testing"
+
+	"github.com/VictoriaMetrics/VictoriaMetrics/app/vminsert/common"
 )
 
 //var parserPool fastjson.ParserPool
@@ -33,3 +35,41 @@ func BenchmarkRowsUnmarshal(b *testing.B) {
 		}
 	})
 }
+
+func BenchmarkInsertRowsConcurrent(b *testing.B) {
+	for _, concurrency := range []int{1, 2, 4, 8} {
+		b.Run(fmt.Sprintf("concurrency-%d", concurrency), func(b *testing.B) {
+			benchmarkInsertRowsConcurrent(b, concurrency)
+		})
+	}
+}
+
+func benchmarkInsertRowsConcurrent(b *testing.B, concurrency int) {
+	const rowsCount = 100000
+	rows := make([]Row, rowsCount)
+	for i := range rows {
+		rows[i] = Row{
+			Metric: fmt.Sprintf("cpu.usage_%d", i%10),
+			Tags: []Tag{
+				{Key: "host", Value: fmt.Sprintf("host-%d", i%100)},
+				{Key: "dc", Value: "us-east-1"},
+			},
+			Value:     float64(i),
+			Timestamp: int64(i),
+		}
+	}
+	flush := func(ic *common.InsertCtx) error { return nil }
+	b.SetBytes(rowsCount)
+	b.ReportAllocs()
+	var ic common.InsertCtx
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if concurrency == 1 {
+			writeRows(&ic, rows)
+			continue
+		}
+		if err := insertRowsConcurrent(rows, concurrency, nil, nil, 0, flush); err != nil {
+			panic(fmt.Errorf("unexpected error: %s", err))
+		}
+	}
+}
@@ -0,0 +1,37 @@
+package opentsdbhttp
+
+import (
+	"fmt"
+	"runtime"
+	"testing"
+)
+
+func BenchmarkPushCtxPool(b *testing.B) {
+	gomaxprocs := runtime.GOMAXPROCS(-1)
+	for _, size := range []int{-1, gomaxprocs, 4 * gomaxprocs, 16 * gomaxprocs} {
+		for _, parallelism := range []int{1, 16, 64} {
+			b.Run(fmt.Sprintf("poolSize=%d/parallelism=%d", size, parallelism), func(b *testing.B) {
+				benchmarkPushCtxPool(b, size, parallelism)
+			})
+		}
+	}
+}
+
+func benchmarkPushCtxPool(b *testing.B, size, parallelism int) {
+	defer func(ch chan *pushCtx) {
+		pushCtxPoolCh = ch
+	}(pushCtxPoolCh)
+	pushCtxPoolCh = newPushCtxPoolCh(size)
+
+	b.ReportAllocs()
+	b.SetParallelism(parallelism)
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			ctx := getPushCtx()
+			// Simulate request processing, which may be preempted by other requests.
+			ctx.reqBuf.B = append(ctx.reqBuf.B[:0], "put"...)
+			runtime.Gosched()
+			putPushCtx(ctx)
+		}
+	})
+}
@@ -1,104 +1,348 @@
 package opentsdbhttp
 
 import (
-	"compress/gzip"
+	"bytes"
+	"context"
+	"flag"
 	"fmt"
 	"io"
 	"net/http"
 	"runtime"
+	"strconv"
 	"sync"
+	"time"
 
 	"github.com/valyala/fastjson"
 	"github.com/VictoriaMetrics/VictoriaMetrics/app/vminsert/common"
 	"github.com/VictoriaMetrics/VictoriaMetrics/app/vminsert/concurrencylimiter"
+	"github.com/VictoriaMetrics/VictoriaMetrics/app/vminsert/opentsdb"
 	"github.com/VictoriaMetrics/VictoriaMetrics/lib/bytesutil"
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/prompb"
 	"github.com/VictoriaMetrics/metrics"
+	xxhash "github.com/cespare/xxhash/v2"
 )
 
+var (
+	gzipRequests     = metrics.NewCounter(`vm_insert_requests_total{protocol="opentsdb-http", encoding="gzip"}`)
+	identityRequests = metrics.NewCounter(`vm_insert_requests_total{protocol="opentsdb-http", encoding="identity"}`)
+
+	syncRequests = metrics.NewCounter(`vm_opentsdbhttp_sync_inserts_total`)
+
+	rejectedRequestBytes = metrics.NewCounter(`vm_rejected_request_bytes_total{protocol="opentsdb-http"}`)
+)
+
+var insertConcurrency = flag.Int("opentsdbhttp.insertConcurrency", 1, "The maximum number of goroutines for inserting rows from a single big OpenTSDB HTTP request. "+
+	"Requests with less than 20000 rows are always inserted by a single goroutine")
+
+var useServerTime = flag.Bool("opentsdbhttp.useServerTime", false, "Whether to ignore timestamps in OpenTSDB HTTP requests and store all the data points with the server time instead. "+
+	"This may be enabled for a single request with `use_server_time=1` query arg")
+
+var allowConcatenatedJSON = flag.Bool("opentsdbhttp.allowConcatenatedJSON", false, "Whether to accept OpenTSDB HTTP request bodies with multiple concatenated JSON documents "+
+	"without enclosing array such as `{...}{...}`, which are sent by some buggy clients. By default only the first document is accepted and the rest of the body results in parse error. "+
+	"See also vm_opentsdbhttp_concatenated_documents_total metric")
+
+var concatenatedDocuments = metrics.NewCounter(`vm_opentsdbhttp_concatenated_documents_total`)
+
+var rejectEmptyBatches = flag.Bool("opentsdbhttp.rejectEmptyBatches", false, "Whether to reject OpenTSDB HTTP requests without data points such as `[]` with parse error. "+
+	"By default such requests succeed without inserting rows, since some clients send empty batches as keepalives during idle periods. "+
+	"See also vm_empty_batch_requests_total metric")
+
+var emptyBatchRequests = metrics.NewCounter(`vm_empty_batch_requests_total{type="opentsdb-http"}`)
+
 var (
 	rowsInserted  = metrics.NewCounter(`vm_rows_inserted_total{type="opentsdb-http"}`)
 	rowsPerInsert = metrics.NewSummary(`vm_rows_per_insert{type="opentsdb-http"}`)
+	tagsPerRow    = metrics.NewSummary(`vm_tags_per_row{type="opentsdb-http"}`)
 )
 
 // InsertHandler processes remote write for openTSDB http protocol.
 //
-func InsertHandler(req *http.Request, maxSize int64) error {
-	return concurrencylimiter.Do(func() error {
-		return insertHandlerInternal(req, maxSize)
+// Identical rows are collapsed if the request contains `no_duplicates` query arg.
+// The number of collapsed rows is returned in DuplicatesCollapsedHeader response header.
+func InsertHandler(w http.ResponseWriter, req *http.Request, maxSize int64) error {
+	return concurrencyLimiter.DoRequest(req, func() error {
+		return insertHandlerInternal(w, req, maxSize, false)
 	})
 }
 
-func insertHandlerInternal(req *http.Request, maxSize int64) error {
-	opentsdbReadCalls.Inc()
+// RollupHandler processes rollup writes for OpenTSDB http protocol.
+//
+// See http://opentsdb.net/docs/build/html/api_http/rollup.html
+func RollupHandler(w http.ResponseWriter, req *http.Request, maxSize int64) error {
+	return concurrencyLimiter.DoRequest(req, func() error {
+		return insertHandlerInternal(w, req, maxSize, true)
+	})
+}
 
-	r := req.Body
+func insertHandlerInternal(w http.ResponseWriter, req *http.Request, maxSize int64, rollup bool) (err error) {
+	opentsdbReadCalls.Inc()
 
-	if req.Header.Get("Content-Encoding") == "gzip" {
-		zr, err := getGzipReader(r)
-		if err != nil {
-			return fmt.Errorf("cannot read gzipped http protocol data: %s", err)
+	idempotencyKey, err := getIdempotencyKey(req, rollup)
+	if err != nil {
+		return err
+	}
+	if len(idempotencyKey) > 0 {
+		r, ok, beginErr := idempotencyKeys.begin(idempotencyKey, time.Now(), *idempotencyKeyCacheMaxEntries)
+		if beginErr != nil {
+			idempotentConflicts.Inc()
+			return beginErr
 		}
-		defer putGzipReader(zr)
-		r = zr
+		if ok {
+			// The request has been already processed. See -opentsdbhttp.idempotencyKeyCacheDuration.
+			idempotentReplays.Inc()
+			w.Header().Set(IdempotentReplayedHeader, "true")
+			return r.err()
+		}
+		// The named result err contains the error returned to the client.
+		defer func() {
+			idempotencyKeys.finish(idempotencyKey, err, time.Now(), *idempotencyKeyCacheDuration)
+		}()
 	}
 
 	ctx := getPushCtx()
 	defer putPushCtx(ctx)
+	ctx.Common.SetLabelOrder("opentsdb-http")
+
+	var body io.Reader = req.Body
+	var etag uint64
+	checkETag := isETagRequest(req)
+	if checkETag {
+		var isDuplicate bool
+		var err error
+		etag, isDuplicate, err = ctx.checkETag(req, maxSize)
+		if err != nil {
+			return err
+		}
+		w.Header().Set("ETag", formatETag(etag))
+		if isDuplicate {
+			// The request has been already processed. See -opentsdbhttp.etagCacheDuration.
+			duplicateRequests.Inc()
+			return nil
+		}
+		body = bytes.NewReader(ctx.etagBuf.B)
+	}
+
+	if isUnlimitedStreamRequest(req) {
+		unlimitedStreamRequests.Inc()
+		ctx.unlimitedSize = true
+	}
+
+	dr := bodyDumper.NewReader(req, body)
+	defer dr.Finish()
+	var r io.Reader = dr
+	if !ctx.unlimitedSize {
+		// The request body may be sent with chunked transfer encoding without Content-Length,
+		// so limit the time needed for reading it. The size is limited in Read.
+		// Trusted unlimited streams may take arbitrary time to read. See -opentsdbhttp.unlimitedStreamAuthKey.
+		r = common.NewReadTimeoutReader(dr)
+	}
+
+	cd, err := common.GetContentDecoder(r, req)
+	if err != nil {
+		return fmt.Errorf("cannot read encoded http protocol data: %s", err)
+	}
+	defer common.PutContentDecoder(cd)
+	if cd.IsEncoded() {
+		gzipRequests.Inc()
+	} else {
+		identityRequests.Inc()
+	}
+	r = cd
+
+	ctx.rollup = rollup
+	ctx.sync = isSyncRequest(req)
+	ctx.noDuplicates = isNoDuplicatesRequest(req)
+	ctx.requestID = common.GetRequestID(req)
+	ctx.Rows.MaxTagsPerRow = getMaxTagsPerRow(req)
+	ctx.Common.SetExtraLabels(common.GetExtraLabels(req))
+	ctx.Common.SetServerTimestamp(common.GetServerTimestamp(req, *useServerTime))
+	ctx.Common.SetContext(req.Context())
+	rowsRead := 0
 	for ctx.Read(r, maxSize) {
+		if len(ctx.Rows.Rows) == 0 {
+			// Nothing to insert, so do not touch the storage. This is important for `sync` requests.
+			continue
+		}
+		rowsRead += len(ctx.Rows.Rows)
 		if err := ctx.InsertRows(); err != nil {
 			return err
 		}
 	}
-	return ctx.Error()
+	// Rows deferred because of -insert.minFlushRows must be written even if the rest of request cannot be parsed.
+	if err := ctx.Common.FlushDeferred(); err != nil {
+		return err
+	}
+	if err := ctx.Error(); err != nil {
+		return err
+	}
+	if rowsRead == 0 {
+		// Empty batches such as `[]` are sent by some clients as keepalives.
+		emptyBatchRequests.Inc()
+		if *rejectEmptyBatches {
+			return common.NewParseError(common.ErrBadFormat, "the request contains no data points; see -opentsdbhttp.rejectEmptyBatches")
+		}
+	}
+	if ctx.noDuplicates {
+		w.Header().Set(DuplicatesCollapsedHeader, strconv.Itoa(ctx.dedup.collapsed))
+	}
+	if checkETag {
+		etags.add(etag, time.Now(), *etagCacheDuration, *etagCacheMaxEntries)
+	}
+	return nil
 }
 
 func (ctx *pushCtx) InsertRows() error {
 	rows := ctx.Rows.Rows
-	ic := &ctx.Common
-	ic.Reset(len(rows))
+	if err := ctx.Common.ValidateTimestamps(len(rows), func(i int) int64 { return rows[i].Timestamp }); err != nil {
+		return err
+	}
+	for i := range rows {
+		tagsPerRow.Update(float64(len(rows[i].Tags)))
+	}
+	var err error
+	if ctx.sync {
+		// Rows must be persisted to disk before returning success to the client.
+		syncRequests.Inc()
+		ic := &ctx.Common
+		writeRows(ic, rows)
+		err = ic.FlushBufsSync()
+	} else if concurrency := *insertConcurrency; concurrency > 1 && len(rows) >= 2*minRowsPerShard {
+		err = insertRowsConcurrent(rows, concurrency, ctx.Common.Context(), ctx.Common.ExtraLabels(), ctx.Common.ServerTimestamp(), flushInsertCtx)
+	} else {
+		ic := &ctx.Common
+		writeRows(ic, rows)
+		err = ic.FlushBufsBatched()
+	}
+	rowsInserted.Add(len(rows))
+	rowsPerInsert.Update(float64(len(rows)))
+	return err
+}
+
+// isSyncRequest returns true if req contains `sync` query arg.
+//
+// See http://opentsdb.net/docs/build/html/api_http/put.html
+func isSyncRequest(req *http.Request) bool {
+	return hasBoolQueryArg(req, "sync")
+}
+
+// isNoDuplicatesRequest returns true if req contains `no_duplicates` query arg.
+//
+// Unlike OpenTSDB, only duplicates within the request are detected.
+func isNoDuplicatesRequest(req *http.Request) bool {
+	return hasBoolQueryArg(req, "no_duplicates")
+}
+
+// hasBoolQueryArg returns true if req contains query arg with the given name, which isn't set to false.
+func hasBoolQueryArg(req *http.Request, name string) bool {
+	q := req.URL.Query()
+	if _, ok := q[name]; !ok {
+		return false
+	}
+	v := q.Get(name)
+	return v != "false" && v != "0"
+}
+
+func writeRows(ic *common.InsertCtx, rows []Row) {
+	ic.ResetBatch(len(rows))
 	for i := range rows {
 		r := &rows[i]
+		if opentsdb.IsDroppedZeroValue(r.Value) {
+			continue
+		}
 		ic.Labels = ic.Labels[:0]
 		ic.AddLabel("", r.Metric)
+		ok := true
 		for j := range r.Tags {
 			tag := &r.Tags[j]
-			ic.AddLabel(tag.Key, tag.Value)
+			var key string
+			if key, ok = opentsdb.RemapTagKey(tag.Key); !ok {
+				break
+			}
+			ic.AddLabel(key, tag.Value)
 		}
-		ic.WriteDataPoint(nil, ic.Labels, r.Timestamp, r.Value)
+		if !ok {
+			continue
+		}
+		ic.WriteDataPointInterned(nil, ic.Labels, r.Timestamp, r.Value)
 	}
-	rowsInserted.Add(len(rows))
-	rowsPerInsert.Update(float64(len(rows)))
+}
+
+func flushInsertCtx(ic *common.InsertCtx) error {
 	return ic.FlushBufs()
 }
 
-func getGzipReader(r io.Reader) (*gzip.Reader, error) {
-	v := gzipReaderPool.Get()
-	if v == nil {
-		return gzip.NewReader(r)
+// minRowsPerShard is the minimum number of rows per goroutine
+// when inserting rows from a single request concurrently.
+const minRowsPerShard = 10000
+
+// insertRowsConcurrent splits rows into up to concurrency shards
+// and writes them with extraLabels via flush in parallel.
+//
+// reqCtx is set on the InsertCtx for every shard. It may be nil.
+// It returns the first error returned by flush.
+func insertRowsConcurrent(rows []Row, concurrency int, reqCtx context.Context, extraLabels []prompb.Label, serverTimestamp int64, flush func(ic *common.InsertCtx) error) error {
+	shards := len(rows) / minRowsPerShard
+	if shards > concurrency {
+		shards = concurrency
 	}
-	zr := v.(*gzip.Reader)
-	if err := zr.Reset(r); err != nil {
-		return nil, err
+	shardLen := (len(rows) + shards - 1) / shards
+	errs := make(chan error, shards)
+	workers := 0
+	for len(rows) > 0 {
+		n := shardLen
+		if n > len(rows) {
+			n = len(rows)
+		}
+		go func(rows []Row) {
+			ic := getInsertCtx()
+			ic.SetContext(reqCtx)
+			ic.SetExtraLabels(extraLabels)
+			ic.SetServerTimestamp(serverTimestamp)
+			ic.SetLabelOrder("opentsdb-http")
+			writeRows(ic, rows)
+			errs <- flush(ic)
+			ic.SetContext(nil)
+			putInsertCtx(ic)
+		}(rows[:n])
+		rows = rows[n:]
+		workers++
 	}
-	return zr, nil
+	var firstErr error
+	for i := 0; i < workers; i++ {
+		if err := <-errs; err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
 }
 
-func putGzipReader(zr *gzip.Reader) {
-	_ = zr.Close()
-	gzipReaderPool.Put(zr)
+func getInsertCtx() *common.InsertCtx {
+	v := insertCtxPool.Get()
+	if v == nil {
+		return &common.InsertCtx{}
+	}
+	return v.(*common.InsertCtx)
 }
 
-var gzipReaderPool sync.Pool
+func putInsertCtx(ic *common.InsertCtx) {
+	ic.Reset(0)
+	insertCtxPool.Put(ic)
+}
 
+var insertCtxPool sync.Pool
 
 func (ctx *pushCtx) Read(r io.Reader, maxSize int64) bool {
 	if ctx.err != nil {
 		return false
 	}
+	if *streamParse {
+		return ctx.readStream(r, maxSize)
+	}
 
 	var err error
 	lr := io.LimitReader(r, maxSize+1)
-	reqLen, err := ctx.reqBuf.ReadFrom(lr)
+	reqLen, err := common.ReadRequestBody(&ctx.reqBuf, lr)
+	maxRequestSize.Update(reqLen)
 
 	if err != nil {
 		opentsdbReadErrors.Inc()
@@ -107,25 +351,69 @@ func (ctx *pushCtx) Read(r io.Reader, maxSize int64) bool {
 	}
 	if reqLen > maxSize {
 		opentsdbReadErrors.Inc()
+		// reqLen is the lower bound for the dropped data size, since the rest of the request isn't read.
+		rejectedRequestBytes.Add(int(reqLen))
 		ctx.err = fmt.Errorf("too big packed request; mustn't exceed %d bytes", maxSize)
 		return false
 	}
 
-	v, err := ctx.parser.ParseBytes(ctx.reqBuf.B)
+	ctx.startParseDeadline()
+	data := removeTrailingCommas(trimBodyPrefix(ctx.reqBuf.B))
+	if *allowConcatenatedJSON {
+		docs, err := ctx.Rows.UnmarshalConcatenated(&ctx.scanner, data, ctx.rollup)
+		if docs > 1 {
+			// Count only documents after the first one, since they are dropped without -opentsdbhttp.allowConcatenatedJSON.
+			concatenatedDocuments.Add(docs - 1)
+		}
+		if err != nil {
+			opentsdbUnmarshalErrors.Inc()
+			opentsdbParseErrorLogger.LogWithRequestID(err, ctx.reqBuf.B, ctx.requestID)
+			ctx.err = common.WrapParseError(err, "cannot unmarshal opentsdb http protocol json documents, length: %d: %s", reqLen, err)
+			return false
+		}
+		if !ctx.checkParseDeadline() {
+			return false
+		}
+	} else if !ctx.unmarshal(data, maxSize) {
+		return false
+	}
+	if ctx.noDuplicates {
+		ctx.Rows.Rows = ctx.dedup.collapse(ctx.Rows.Rows)
+	}
+
+	// The whole request body has been read and parsed.
+	// Make sure the next Read call returns false.
+	ctx.err = io.EOF
+	return true
+}
 
+// unmarshal unmarshals a single JSON document from data into ctx.Rows.
+//
+// It returns false on error. Call ctx.Error in order to obtain the error.
+func (ctx *pushCtx) unmarshal(data []byte, maxSize int64) bool {
+	v, err := ctx.parser.ParseBytes(data)
 	if err != nil {
 		opentsdbUnmarshalErrors.Inc()
-		ctx.err = fmt.Errorf("error parsing json: %s, length: %d, maxSize: %d", err, reqLen, maxSize)
+		opentsdbParseErrorLogger.LogWithRequestID(err, data, ctx.requestID)
+		ctx.err = common.NewParseError(common.ErrBadFormat, "error parsing json: %s, length: %d, maxSize: %d", err, len(data), maxSize)
+		return false
+	}
+	if !ctx.checkParseDeadline() {
 		return false
 	}
 
-	if err := ctx.Rows.Unmarshal(v); err != nil {
+	if ctx.rollup {
+		err = ctx.Rows.UnmarshalRollup(v)
+	} else {
+		err = ctx.Rows.Unmarshal(v)
+	}
+	if err != nil {
 		opentsdbUnmarshalErrors.Inc()
-		ctx.err = fmt.Errorf("cannot unmarshal opentsdb http protocol json %s, %s", v, err)
+		opentsdbParseErrorLogger.LogWithRequestID(err, data, ctx.requestID)
+		ctx.err = common.WrapParseError(err, "cannot unmarshal opentsdb http protocol json %s, %s", v, err)
 		return false
 	}
-
-	return true
+	return ctx.checkParseDeadline()
 }
 
 var (
@@ -134,12 +422,53 @@ var (
 	opentsdbUnmarshalErrors = metrics.NewCounter(`vm_unmarshal_errors_total{name="opentsdb-http"}`)
 )
 
+var opentsdbParseErrorLogger = common.NewParseErrorLogger("opentsdb-http")
+
+var concurrencyLimiter = concurrencylimiter.NewLimiter("opentsdb-http")
+
+var tagsPoolStats = common.NewTagsPoolStats("opentsdb-http")
+
+var maxRequestSize = common.NewMaxRequestSize("opentsdb-http")
+
+var bodyDumper = common.NewBodyDumper("opentsdb-http")
+
 type pushCtx struct {
 	Rows   Rows
 	Common common.InsertCtx
 
-	reqBuf         bytesutil.ByteBuffer
-	parser 		   fastjson.Parser
+	reqBuf bytesutil.ByteBuffer
+
+	// etagBuf holds the raw request body for requests with If-None-Match header. See -opentsdbhttp.etagCacheDuration.
+	etagBuf  bytesutil.ByteBuffer
+	etagsBuf []uint64
+	parser   fastjson.Parser
+	scanner  fastjson.Scanner
+
+	// etagDigest is used for calculating ETags of requests with If-None-Match header.
+	etagDigest xxhash.Digest
+
+	// stream is used for reading the request body in -opentsdbhttp.streamParse mode.
+	stream        jsonStream
+	streamStarted bool
+
+	// unlimitedSize is set to true if the request body may exceed maxSize. See -opentsdbhttp.unlimitedStreamAuthKey.
+	unlimitedSize bool
+
+	// rollup is set to true when processing /api/rollup requests.
+	rollup bool
+
+	// sync is set to true when the client requested synchronous write with `sync` query arg.
+	sync bool
+
+	// noDuplicates is set to true when the client requested collapsing identical rows with `no_duplicates` query arg.
+	noDuplicates bool
+	dedup        rowsDeduplicator
+
+	// requestID is the request ID used in parse error logs. See common.WithRequestID.
+	requestID string
+
+	// parseDeadline is the deadline for parsing the current request. It is zero if -opentsdbhttp.maxParseDuration isn't set.
+	parseDeadline time.Time
 
 	err error
 }
@@ -154,8 +483,20 @@ func (ctx *pushCtx) Error() error {
 func (ctx *pushCtx) reset() {
 	ctx.Rows.Reset()
 	ctx.Common.Reset(0)
-
-	ctx.reqBuf.Reset()
+	ctx.Common.SetContext(nil)
+
+	common.ReleaseReadBuffer(&ctx.reqBuf)
+	common.ReleaseReadBuffer(&ctx.etagBuf)
+	ctx.etagsBuf = ctx.etagsBuf[:0]
+	ctx.stream.reset(nil)
+	ctx.streamStarted = false
+	ctx.unlimitedSize = false
+	ctx.rollup = false
+	ctx.sync = false
+	ctx.noDuplicates = false
+	ctx.dedup.reset()
+	ctx.requestID = ""
+	ctx.parseDeadline = time.Time{}
 
 	ctx.err = nil
 }
@@ -182,5 +523,26 @@ func putPushCtx(ctx *pushCtx) {
 }
 
 var pushCtxPool sync.Pool
-var pushCtxPoolCh = make(chan *pushCtx, runtime.GOMAXPROCS(-1))
+var pushCtxPoolCh = newPushCtxPoolCh(0)
+
+var pushCtxPoolSize = flag.Int("opentsdbhttp.pushCtxPoolSize", 0, "The number of idle contexts for OpenTSDB HTTP requests to keep in a dedicated pool. "+
+	"Contexts above the limit are kept in sync.Pool, which may free them on garbage collection. Zero means the number of available CPU cores. "+
+	"Negative value keeps all the idle contexts in sync.Pool")
 
+// initPushCtxPool applies -opentsdbhttp.pushCtxPoolSize. It must be called after flag.Parse call.
+func initPushCtxPool() {
+	pushCtxPoolCh = newPushCtxPoolCh(*pushCtxPoolSize)
+}
+
+// newPushCtxPoolCh returns a channel for size idle contexts.
+//
+// nil is returned for negative size, so idle contexts are kept only in pushCtxPool.
+func newPushCtxPoolCh(size int) chan *pushCtx {
+	if size < 0 {
+		return nil
+	}
+	if size == 0 {
+		size = runtime.GOMAXPROCS(-1)
+	}
+	return make(chan *pushCtx, size)
+}
@@ -0,0 +1,328 @@
+package opentsdbhttp
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/VictoriaMetrics/VictoriaMetrics/app/vminsert/common"
+)
+
+func TestPushCtxReadSingleBody(t *testing.T) {
+	ctx := getPushCtx()
+	defer putPushCtx(ctx)
+	r := strings.NewReader(`{"metric": "foo", "timestamp": 1, "value": 2, "tags": {"a": "b"}}`)
+	reads := 0
+	for ctx.Read(r, 1024) {
+		reads++
+		if reads > 1 {
+			t.Fatalf("the request body must be read only once")
+		}
+	}
+	if err := ctx.Error(); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if reads != 1 {
+		t.Fatalf("unexpected number of reads; got %d; want 1", reads)
+	}
+}
+
+func TestInsertRowsConcurrent(t *testing.T) {
+	f := func(rowsCount, concurrency int) {
+		t.Helper()
+		rows := make([]Row, rowsCount)
+		var flushedRows uint64
+		flush := func(ic *common.InsertCtx) error {
+			atomic.AddUint64(&flushedRows, uint64(ic.RowsCount()))
+			return nil
+		}
+		if err := insertRowsConcurrent(rows, concurrency, nil, nil, 0, flush); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if n := atomic.LoadUint64(&flushedRows); n != uint64(rowsCount) {
+			t.Fatalf("unexpected number of flushed rows; got %d; want %d", n, rowsCount)
+		}
+	}
+	f(2*minRowsPerShard, 2)
+	f(2*minRowsPerShard+1, 2)
+	f(4*minRowsPerShard-1, 4)
+	f(9*minRowsPerShard+7, 4)
+	f(3*minRowsPerShard, 16)
+
+	// Errors must be propagated
+	rows := make([]Row, 3*minRowsPerShard)
+	flush := func(ic *common.InsertCtx) error {
+		return fmt.Errorf("cannot flush")
+	}
+	if err := insertRowsConcurrent(rows, 3, nil, nil, 0, flush); err == nil {
+		t.Fatalf("expecting non-nil error")
+	}
+}
+
+func TestWriteRowsReservedTagKeys(t *testing.T) {
+	rows := []Row{
+		{
+			Metric: "foo",
+			Tags:   []Tag{{Key: "__name__", Value: "bar"}},
+		},
+		{
+			Metric: "foo",
+			Tags:   []Tag{{Key: "host", Value: "a"}},
+		},
+	}
+	var ic common.InsertCtx
+	writeRows(&ic, rows)
+	if n := ic.RowsCount(); n != 2 {
+		t.Fatalf("unexpected number of rows; got %d; want 2", n)
+	}
+
+	// Rows with reserved tag keys must be rejected if the prefix is empty.
+	prefix := flag.Lookup("opentsdb.reservedTagKeyPrefix").Value.String()
+	defer func() {
+		_ = flag.Set("opentsdb.reservedTagKeyPrefix", prefix)
+	}()
+	if err := flag.Set("opentsdb.reservedTagKeyPrefix", ""); err != nil {
+		t.Fatalf("cannot set flag: %s", err)
+	}
+	writeRows(&ic, rows)
+	if n := ic.RowsCount(); n != 1 {
+		t.Fatalf("unexpected number of rows; got %d; want 1", n)
+	}
+}
+
+func TestIsSyncRequest(t *testing.T) {
+	f := func(url string, resultExpected bool) {
+		t.Helper()
+		req, err := http.NewRequest("POST", url, nil)
+		if err != nil {
+			t.Fatalf("cannot create request: %s", err)
+		}
+		result := isSyncRequest(req)
+		if result != resultExpected {
+			t.Fatalf("unexpected result for %q; got %v; want %v", url, result, resultExpected)
+		}
+	}
+	f("http://localhost/api/put", false)
+	f("http://localhost/api/put?details", false)
+	f("http://localhost/api/put?sync", true)
+	f("http://localhost/api/put?sync=true", true)
+	f("http://localhost/api/put?summary&sync=1", true)
+	f("http://localhost/api/put?sync=false", false)
+	f("http://localhost/api/put?sync=0", false)
+}
+
+func TestIsNoDuplicatesRequest(t *testing.T) {
+	f := func(url string, resultExpected bool) {
+		t.Helper()
+		req, err := http.NewRequest("POST", url, nil)
+		if err != nil {
+			t.Fatalf("cannot create request: %s", err)
+		}
+		result := isNoDuplicatesRequest(req)
+		if result != resultExpected {
+			t.Fatalf("unexpected result for %q; got %v; want %v", url, result, resultExpected)
+		}
+	}
+	f("http://localhost/api/put", false)
+	f("http://localhost/api/put?sync", false)
+	f("http://localhost/api/put?no_duplicates", true)
+	f("http://localhost/api/put?no_duplicates=true&sync", true)
+	f("http://localhost/api/put?no_duplicates=false", false)
+}
+
+func TestPushCtxReadTooBig(t *testing.T) {
+	ctx := getPushCtx()
+	defer putPushCtx(ctx)
+	bytesBefore := rejectedRequestBytes.Get()
+	r := strings.NewReader(`{"metric": "foo", "timestamp": 1, "value": 2, "tags": {"a": "b"}}`)
+	if ctx.Read(r, 10) {
+		t.Fatalf("expecting false from Read for too big request")
+	}
+	if ctx.Error() == nil {
+		t.Fatalf("expecting non-nil error")
+	}
+	if n := rejectedRequestBytes.Get() - bytesBefore; n != 11 {
+		t.Fatalf("unexpected number of rejected bytes; got %d; want 11", n)
+	}
+}
+
+func TestPushCtxReadChunked(t *testing.T) {
+	readTimeout := flag.Lookup("insert.readTimeout").Value.String()
+	defer func() {
+		_ = flag.Set("insert.readTimeout", readTimeout)
+	}()
+	if err := flag.Set("insert.readTimeout", "200ms"); err != nil {
+		t.Fatalf("cannot set flag: %s", err)
+	}
+
+	f := func(chunks []string, delay time.Duration, maxSize int64, rowsExpected int, errExpected bool) {
+		t.Helper()
+		resultCh := make(chan error, 1)
+		var rows int
+		s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			if req.ContentLength >= 0 {
+				resultCh <- fmt.Errorf("unexpected Content-Length: %d", req.ContentLength)
+				return
+			}
+			ctx := getPushCtx()
+			defer putPushCtx(ctx)
+			r := common.NewReadTimeoutReader(req.Body)
+			for ctx.Read(r, maxSize) {
+				rows += len(ctx.Rows.Rows)
+			}
+			resultCh <- ctx.Error()
+		}))
+		defer s.Close()
+
+		pr, pw := io.Pipe()
+		go func() {
+			for _, chunk := range chunks {
+				time.Sleep(delay)
+				if _, err := pw.Write([]byte(chunk)); err != nil {
+					return
+				}
+			}
+			_ = pw.Close()
+		}()
+		// The body is sent with chunked transfer encoding, since its size is unknown.
+		resp, err := http.Post(s.URL, "application/json", pr)
+		if err == nil {
+			_ = resp.Body.Close()
+		}
+		_ = pr.Close()
+		select {
+		case err := <-resultCh:
+			if errExpected != (err != nil) {
+				t.Fatalf("unexpected error: %v; errExpected=%v", err, errExpected)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timeout")
+		}
+		if !errExpected && rows != rowsExpected {
+			t.Fatalf("unexpected number of rows; got %d; want %d", rows, rowsExpected)
+		}
+	}
+
+	chunks := []string{`[{"metric": "foo", "timestamp": 1, `, `"value": 2, "tags": {"a": "b"}},`, `{"metric": "bar", "timestamp": 1, "value": 3, "tags": {"c": "d"}}]`}
+
+	// Chunks within the limit
+	f(chunks, 0, 1024, 2, false)
+
+	// The size limit is enforced across chunk boundaries
+	f(chunks, 0, 50, 0, true)
+
+	// Slow client is cut off by -insert.readTimeout
+	f(chunks, 150*time.Millisecond, 1024, 0, true)
+}
+
+func TestInsertHandlerUnlimitedStreamReadTimeout(t *testing.T) {
+	var rc common.RowsCollector
+	common.SetSink(&rc)
+	defer common.SetSink(nil)
+	readTimeout := flag.Lookup("insert.readTimeout").Value.String()
+	defer func() {
+		_ = flag.Set("insert.readTimeout", readTimeout)
+		*streamParse = false
+		*unlimitedStreamAuthKey = ""
+	}()
+	if err := flag.Set("insert.readTimeout", "200ms"); err != nil {
+		t.Fatalf("cannot set flag: %s", err)
+	}
+	*streamParse = true
+	*unlimitedStreamAuthKey = "secret"
+
+	f := func(url string, rowsExpected int, errExpected bool) {
+		t.Helper()
+		rc.Reset(nil)
+		chunks := []string{`[{"metric": "foo", "timestamp": 1, "value": 2, "tags": {"a": "b"}},`, `{"metric": "bar", "timestamp": 1, "value": 3, "tags": {"c": "d"}}`, `]`}
+		pr, pw := io.Pipe()
+		go func() {
+			for _, chunk := range chunks {
+				time.Sleep(150 * time.Millisecond)
+				if _, err := pw.Write([]byte(chunk)); err != nil {
+					return
+				}
+			}
+			_ = pw.Close()
+		}()
+		defer func() {
+			_ = pr.Close()
+		}()
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest("POST", url, pr)
+		err := insertHandlerInternal(w, req, 1024, false)
+		if errExpected != (err != nil) {
+			t.Fatalf("unexpected error: %v; errExpected=%v", err, errExpected)
+		}
+		if !errExpected {
+			if rows := rc.RowsCount(); rows != rowsExpected {
+				t.Fatalf("unexpected number of rows; got %d; want %d", rows, rowsExpected)
+			}
+		}
+	}
+
+	// Slow client is cut off by -insert.readTimeout
+	f("/api/put", 0, true)
+
+	// Trusted unlimited stream isn't cut off by -insert.readTimeout
+	f("/api/put?authKey=secret", 2, false)
+}
+
+func TestInsertHandlerEmptyBatch(t *testing.T) {
+	var rc common.RowsCollector
+	common.SetSink(&rc)
+	defer common.SetSink(nil)
+	defer func() {
+		*streamParse = false
+		*rejectEmptyBatches = false
+	}()
+
+	f := func(url, body string, rowsExpected int, isEmpty, errExpected bool) {
+		t.Helper()
+		rc.Reset(nil)
+		n := emptyBatchRequests.Get()
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest("POST", url, strings.NewReader(body))
+		err := insertHandlerInternal(w, req, 1024, false)
+		if errExpected {
+			if err == nil {
+				t.Fatalf("expecting non-nil error for %q", body)
+			}
+		} else if err != nil {
+			t.Fatalf("unexpected error for %q: %s", body, err)
+		}
+		if rows := rc.RowsCount(); rows != rowsExpected {
+			t.Fatalf("unexpected number of rows for %q; got %d; want %d", body, rows, rowsExpected)
+		}
+		if isEmptyBatch := emptyBatchRequests.Get() > n; isEmptyBatch != isEmpty {
+			t.Fatalf("unexpected empty batch detection for %q; got %v; want %v", body, isEmptyBatch, isEmpty)
+		}
+	}
+
+	row := `{"metric": "foo", "timestamp": 1, "value": 2, "tags": {"a": "b"}}`
+	for _, stream := range []bool{false, true} {
+		*streamParse = stream
+
+		// Empty batches succeed without inserting rows
+		*rejectEmptyBatches = false
+		f("/api/put", `[]`, 0, true, false)
+		f("/api/put", " [ \n ] ", 0, true, false)
+		f("/api/put?sync=1", `[]`, 0, true, false)
+		f("/api/put", `[`+row+`]`, 1, false, false)
+
+		// Empty batches are rejected
+		*rejectEmptyBatches = true
+		f("/api/put", `[]`, 0, true, true)
+		f("/api/put", `[`+row+`]`, 1, false, false)
+
+		// Empty body isn't an empty batch
+		*rejectEmptyBatches = false
+		f("/api/put", ``, 0, false, true)
+	}
+}
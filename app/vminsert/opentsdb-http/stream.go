@@ -0,0 +1,314 @@
+package opentsdbhttp
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/VictoriaMetrics/VictoriaMetrics/app/vminsert/common"
+	"github.com/VictoriaMetrics/metrics"
+)
+
+var streamParse = flag.Bool("opentsdbhttp.streamParse", false, "Whether to parse OpenTSDB HTTP requests in batches while reading them instead of reading the whole request body into memory. "+
+	"This bounds memory usage for big requests, including gzipped ones. Note that a part of rows may be inserted before an error in the rest of request body is detected")
+
+var unlimitedStreamAuthKey = flag.String("opentsdbhttp.unlimitedStreamAuthKey", "", "authKey, which allows OpenTSDB HTTP requests with `authKey` query arg "+
+	"to exceed -maxInsertRequestSize in -opentsdbhttp.streamParse mode. This removes the safety limit on request size, so pass the authKey only to trusted bulk importers. "+
+	"Requests with any size are rejected by default if they exceed -maxInsertRequestSize")
+
+var unlimitedStreamRequests = metrics.NewCounter(`vm_opentsdbhttp_unlimited_stream_requests_total`)
+
+// isUnlimitedStreamRequest returns true if the size of req body mustn't be limited.
+//
+// This is allowed only in -opentsdbhttp.streamParse mode, since the body is parsed in bounded batches,
+// and only for requests with `authKey` query arg matching -opentsdbhttp.unlimitedStreamAuthKey.
+func isUnlimitedStreamRequest(req *http.Request) bool {
+	if !*streamParse || len(*unlimitedStreamAuthKey) == 0 {
+		return false
+	}
+	return req.URL.Query().Get("authKey") == *unlimitedStreamAuthKey
+}
+
+// streamBatchSize is the approximate size of JSON values from a request body parsed at once in -opentsdbhttp.streamParse mode.
+const streamBatchSize = 1024 * 1024
+
+// jsonStream reads top-level JSON values from a stream one by one.
+//
+// Items of top-level arrays are returned one by one, so the whole array isn't held in memory.
+type jsonStream struct {
+	br bufio.Reader
+
+	// n is the number of bytes read from the stream.
+	n int64
+
+	// docs is the number of top-level JSON documents seen in the stream.
+	docs int
+
+	inArray bool
+	state   int
+}
+
+// jsonStream states inside top-level array.
+const (
+	stateArrayStart = iota
+	stateAfterValue
+	stateAfterComma
+)
+
+func (js *jsonStream) reset(r io.Reader) {
+	js.br.Reset(r)
+	js.n = 0
+	js.docs = 0
+	js.inArray = false
+	js.state = stateArrayStart
+}
+
+// next appends the next JSON value from the stream to dst and returns the result.
+//
+// io.EOF is returned when the stream has been read till the end.
+// Multiple top-level documents are accepted only if -opentsdbhttp.allowConcatenatedJSON is set.
+func (js *jsonStream) next(dst []byte) ([]byte, error) {
+	for {
+		c, err := js.skipWS()
+		if err == io.EOF {
+			if js.inArray {
+				return dst, common.NewParseError(common.ErrBadFormat, "unexpected end of JSON array")
+			}
+			if js.docs == 0 {
+				return dst, common.NewParseError(common.ErrBadFormat, "cannot unmarshal OpenTSDB body, it is empty")
+			}
+			return dst, io.EOF
+		}
+		if err != nil {
+			return dst, err
+		}
+		if !js.inArray {
+			if js.docs > 0 && !*allowConcatenatedJSON {
+				return dst, common.NewParseError(common.ErrBadFormat, "unexpected tail after JSON document at offset %d; see -opentsdbhttp.allowConcatenatedJSON", js.n-1)
+			}
+			js.docs++
+			switch c {
+			case '[':
+				js.inArray = true
+				js.state = stateArrayStart
+				continue
+			case '{':
+				return js.readValue(dst, c)
+			default:
+				return dst, common.NewParseError(common.ErrBadFormat, "cannot unmarshal OpenTSDB body, type is not object or array; got %q at offset %d", c, js.n-1)
+			}
+		}
+		switch js.state {
+		case stateArrayStart:
+			if c == ']' {
+				js.inArray = false
+				continue
+			}
+			js.state = stateAfterValue
+			return js.readValue(dst, c)
+		case stateAfterValue:
+			switch c {
+			case ']':
+				js.inArray = false
+			case ',':
+				js.state = stateAfterComma
+			default:
+				return dst, common.NewParseError(common.ErrBadFormat, "missing `,` between array items at offset %d", js.n-1)
+			}
+		default:
+			if c == ']' && *allowTrailingCommas {
+				// Trailing comma in the top-level array. Items are read one by one, so it cannot be removed by removeTrailingCommas.
+				removedTrailingCommas.Inc()
+				js.inArray = false
+				continue
+			}
+			js.state = stateAfterValue
+			return js.readValue(dst, c)
+		}
+	}
+}
+
+// readValue appends JSON value starting with c to dst and returns the result.
+//
+// The value isn't validated, since it is validated by JSON parser later.
+func (js *jsonStream) readValue(dst []byte, c byte) ([]byte, error) {
+	dst = append(dst, c)
+	switch c {
+	case '{', '[':
+		depth := 1
+		inString := false
+		escaped := false
+		for depth > 0 {
+			c, err := js.readByte()
+			if err != nil {
+				return dst, js.unexpectedEOF(err)
+			}
+			dst = append(dst, c)
+			if inString {
+				switch {
+				case escaped:
+					escaped = false
+				case c == '\\':
+					escaped = true
+				case c == '"':
+					inString = false
+				}
+				continue
+			}
+			switch c {
+			case '"':
+				inString = true
+			case '{', '[':
+				depth++
+			case '}', ']':
+				depth--
+			}
+		}
+		return dst, nil
+	case '"':
+		escaped := false
+		for {
+			c, err := js.readByte()
+			if err != nil {
+				return dst, js.unexpectedEOF(err)
+			}
+			dst = append(dst, c)
+			switch {
+			case escaped:
+				escaped = false
+			case c == '\\':
+				escaped = true
+			case c == '"':
+				return dst, nil
+			}
+		}
+	default:
+		// Read number, true, false or null till the delimiter.
+		for {
+			c, err := js.readByte()
+			if err == io.EOF {
+				return dst, nil
+			}
+			if err != nil {
+				return dst, err
+			}
+			if c == ',' || c == ']' || c == '}' || isJSONWhitespace(c) {
+				_ = js.br.UnreadByte()
+				js.n--
+				return dst, nil
+			}
+			dst = append(dst, c)
+		}
+	}
+}
+
+func (js *jsonStream) unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return common.NewParseError(common.ErrBadFormat, "unexpected end of JSON value at offset %d", js.n)
+	}
+	return err
+}
+
+func (js *jsonStream) skipWS() (byte, error) {
+	for {
+		c, err := js.readByte()
+		if err != nil {
+			return 0, err
+		}
+		if !isJSONWhitespace(c) {
+			return c, nil
+		}
+	}
+}
+
+func (js *jsonStream) readByte() (byte, error) {
+	c, err := js.br.ReadByte()
+	if err != nil {
+		return 0, err
+	}
+	js.n++
+	return c, nil
+}
+
+func isJSONWhitespace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r'
+}
+
+// readStream reads up to streamBatchSize bytes of JSON values from r and unmarshals them into ctx.Rows.
+//
+// It returns false when the whole request body has been read or on error. Call ctx.Error in order to determine the cause.
+// maxSize isn't enforced if ctx.unlimitedSize is set.
+func (ctx *pushCtx) readStream(r io.Reader, maxSize int64) bool {
+	if !ctx.streamStarted {
+		if !ctx.unlimitedSize {
+			r = io.LimitReader(r, maxSize+1)
+		}
+		ctx.stream.reset(r)
+		ctx.stream.skipBOM()
+		ctx.streamStarted = true
+		ctx.startParseDeadline()
+	}
+	if !ctx.checkParseDeadline() {
+		// Abandon the rest of the request body.
+		return false
+	}
+	js := &ctx.stream
+	bb := &ctx.reqBuf
+	bb.B = append(bb.B[:0], '[')
+	values := 0
+	var err error
+	for len(bb.B) < streamBatchSize {
+		n := len(bb.B)
+		if values > 0 {
+			bb.B = append(bb.B, ',')
+		}
+		bb.B, err = js.next(bb.B)
+		if err != nil {
+			bb.B = bb.B[:n]
+			break
+		}
+		values++
+	}
+	bb.B = append(bb.B, ']')
+	maxRequestSize.Update(js.n)
+
+	if js.n > maxSize && !ctx.unlimitedSize {
+		opentsdbReadErrors.Inc()
+		// js.n is the lower bound for the dropped data size, since the rest of the request isn't read.
+		rejectedRequestBytes.Add(int(js.n))
+		ctx.err = fmt.Errorf("too big packed request; mustn't exceed %d bytes", maxSize)
+		return false
+	}
+	if err != nil && err != io.EOF {
+		if common.GetParseErrorCode(err) == nil {
+			opentsdbReadErrors.Inc()
+			ctx.err = fmt.Errorf("cannot read request: %s", err)
+			return false
+		}
+		opentsdbUnmarshalErrors.Inc()
+		opentsdbParseErrorLogger.LogWithRequestID(err, bb.B, ctx.requestID)
+		ctx.err = common.WrapParseError(err, "cannot unmarshal opentsdb http protocol json at offset %d: %s", js.n, err)
+		return false
+	}
+	if err == io.EOF && js.docs > 1 {
+		concatenatedDocuments.Add(js.docs - 1)
+	}
+	if values == 0 {
+		ctx.err = io.EOF
+		return false
+	}
+	if !ctx.unmarshal(removeTrailingCommas(bb.B), maxSize) {
+		return false
+	}
+	if ctx.noDuplicates {
+		ctx.Rows.Rows = ctx.dedup.collapse(ctx.Rows.Rows)
+	}
+	if err == io.EOF {
+		// The whole request body has been read and parsed.
+		// Make sure the next Read call returns false.
+		ctx.err = io.EOF
+	}
+	return true
+}
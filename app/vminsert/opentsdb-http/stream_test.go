@@ -0,0 +1,219 @@
+package opentsdbhttp
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/VictoriaMetrics/VictoriaMetrics/app/vminsert/common"
+)
+
+func TestJSONStreamNext(t *testing.T) {
+	f := func(s string, valuesExpected []string, errExpected bool) {
+		t.Helper()
+		var js jsonStream
+		js.reset(strings.NewReader(s))
+		var values []string
+		var err error
+		for {
+			var v []byte
+			v, err = js.next(nil)
+			if err != nil {
+				break
+			}
+			values = append(values, string(v))
+		}
+		if err == io.EOF {
+			err = nil
+		}
+		if errExpected {
+			if err == nil {
+				t.Fatalf("expecting non-nil error for %q", s)
+			}
+			return
+		}
+		if err != nil {
+			t.Fatalf("unexpected error for %q: %s", s, err)
+		}
+		if strings.Join(values, "|") != strings.Join(valuesExpected, "|") {
+			t.Fatalf("unexpected values for %q; got %q; want %q", s, values, valuesExpected)
+		}
+	}
+
+	f(`{"a":1}`, []string{`{"a":1}`}, false)
+	f(` [ {"a":"}]"} , {"b":[1,{"c":"\"{"}]} ] `, []string{`{"a":"}]"}`, `{"b":[1,{"c":"\"{"}]}`}, false)
+	f(`[]`, nil, false)
+	f(`[1, "x", null]`, []string{`1`, `"x"`, `null`}, false)
+
+	// Empty body
+	f(``, nil, true)
+	f(`  `, nil, true)
+
+	// Truncated body
+	f(`[{"a":1}`, nil, true)
+	f(`[{"a":1},`, nil, true)
+	f(`{"a":`, nil, true)
+
+	// Invalid top-level values
+	f(`123`, nil, true)
+	f(`[{"a":1} {"b":2}]`, nil, true)
+
+	// Concatenated documents are rejected by default
+	f(`{"a":1}{"b":2}`, nil, true)
+}
+
+func TestJSONStreamNextConcatenated(t *testing.T) {
+	*allowConcatenatedJSON = true
+	defer func() {
+		*allowConcatenatedJSON = false
+	}()
+	var js jsonStream
+	js.reset(strings.NewReader(`{"a":1} [{"b":2}]` + "\n" + `{"c":3}`))
+	var values []string
+	for {
+		v, err := js.next(nil)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		values = append(values, string(v))
+	}
+	if s := strings.Join(values, "|"); s != `{"a":1}|{"b":2}|{"c":3}` {
+		t.Fatalf("unexpected values: %q", s)
+	}
+	if js.docs != 3 {
+		t.Fatalf("unexpected number of documents; got %d; want 3", js.docs)
+	}
+}
+
+func TestPushCtxReadStream(t *testing.T) {
+	*streamParse = true
+	defer func() {
+		*streamParse = false
+	}()
+
+	f := func(r io.Reader, maxSize int64, rowsExpected, minReadsExpected int, errExpected bool) {
+		t.Helper()
+		ctx := getPushCtx()
+		defer putPushCtx(ctx)
+		rows := 0
+		reads := 0
+		for ctx.Read(r, maxSize) {
+			rows += len(ctx.Rows.Rows)
+			reads++
+		}
+		err := ctx.Error()
+		if errExpected {
+			if err == nil {
+				t.Fatalf("expecting non-nil error")
+			}
+			return
+		}
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if rows != rowsExpected {
+			t.Fatalf("unexpected number of rows; got %d; want %d", rows, rowsExpected)
+		}
+		if reads < minReadsExpected {
+			t.Fatalf("unexpected number of reads; got %d; want at least %d", reads, minReadsExpected)
+		}
+	}
+
+	row := `{"metric": "foo", "timestamp": 1, "value": 2, "tags": {"a": "b"}}`
+	f(strings.NewReader(row), 1024, 1, 1, false)
+	f(strings.NewReader(`[`+row+`,`+row+`]`), 1024, 2, 1, false)
+	f(strings.NewReader(`[]`), 1024, 0, 0, false)
+
+	// The request exceeding streamBatchSize is parsed in multiple batches.
+	rowsCount := 3 * streamBatchSize / len(row)
+	var bb bytes.Buffer
+	bb.WriteString("[")
+	for i := 0; i < rowsCount; i++ {
+		if i > 0 {
+			bb.WriteString(",")
+		}
+		fmt.Fprintf(&bb, `{"metric": "foo", "timestamp": %d, "value": %d, "tags": {"a": "b"}}`, i, i)
+	}
+	bb.WriteString("]")
+	body := bb.String()
+	f(strings.NewReader(body), int64(len(body)), rowsCount, 3, false)
+
+	// Gzipped request is decompressed in a streaming manner.
+	var zb bytes.Buffer
+	zw := gzip.NewWriter(&zb)
+	if _, err := zw.Write([]byte(body)); err != nil {
+		t.Fatalf("cannot compress body: %s", err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatalf("cannot close gzip writer: %s", err)
+	}
+	zr, err := common.GetGzipReader(&zb)
+	if err != nil {
+		t.Fatalf("cannot create gzip reader: %s", err)
+	}
+	f(zr, int64(len(body)), rowsCount, 3, false)
+	common.PutGzipReader(zr)
+
+	// Too big request
+	f(strings.NewReader(body), int64(len(body)-1), 0, 0, true)
+
+	// Too big request is accepted if its size mustn't be limited.
+	ctx := getPushCtx()
+	ctx.unlimitedSize = true
+	r := strings.NewReader(body)
+	rows := 0
+	for ctx.Read(r, 1024) {
+		rows += len(ctx.Rows.Rows)
+	}
+	if err := ctx.Error(); err != nil {
+		t.Fatalf("unexpected error for unlimited request: %s", err)
+	}
+	if rows != rowsCount {
+		t.Fatalf("unexpected number of rows for unlimited request; got %d; want %d", rows, rowsCount)
+	}
+	putPushCtx(ctx)
+
+	// Invalid requests
+	f(strings.NewReader(``), 1024, 0, 0, true)
+	f(strings.NewReader(`[`+row), 1024, 0, 0, true)
+	f(strings.NewReader(`[{"metric": "foo"}]`), 1024, 0, 0, true)
+	f(strings.NewReader(row+row), 1024, 0, 0, true)
+	f(&errReader{err: fmt.Errorf("network error")}, 1024, 0, 0, true)
+}
+
+func TestIsUnlimitedStreamRequest(t *testing.T) {
+	defer func() {
+		*streamParse = false
+		*unlimitedStreamAuthKey = ""
+	}()
+
+	f := func(url string, streamParseEnabled bool, authKey string, resultExpected bool) {
+		t.Helper()
+		*streamParse = streamParseEnabled
+		*unlimitedStreamAuthKey = authKey
+		req := httptest.NewRequest("POST", url, nil)
+		if result := isUnlimitedStreamRequest(req); result != resultExpected {
+			t.Fatalf("unexpected result for %q; got %v; want %v", url, result, resultExpected)
+		}
+	}
+	f("/api/put?authKey=secret", true, "secret", true)
+	f("/api/put?authKey=secret", false, "secret", false)
+	f("/api/put?authKey=foo", true, "secret", false)
+	f("/api/put", true, "secret", false)
+	f("/api/put?authKey=", true, "", false)
+}
+
+type errReader struct {
+	err error
+}
+
+func (er *errReader) Read(p []byte) (int, error) {
+	return 0, er.err
+}
@@ -0,0 +1,58 @@
+// +build tagscheck
+
+package opentsdbhttp
+
+import (
+	"fmt"
+	"sort"
+	"unsafe"
+
+	"github.com/VictoriaMetrics/metrics"
+)
+
+// checkTagsAliasing returns an error if Tags of a row in rows may be modified via Tags of another row.
+//
+// Row.unmarshal puts tags of all the rows into a shared tagsPool and caps every Row.Tags slice,
+// so rows never share tags except of rows expanded from a single multi-metric object, which share
+// identical read-only Tags. This check verifies the assumption in builds with `tagscheck` tag.
+func checkTagsAliasing(rows []Row) error {
+	type tagsSpan struct {
+		start uintptr
+		end   uintptr
+		row   int
+	}
+	var spans []tagsSpan
+	for i := range rows {
+		tags := rows[i].Tags
+		if len(tags) == 0 {
+			continue
+		}
+		if cap(tags) != len(tags) {
+			tagsAliasingErrors.Inc()
+			return fmt.Errorf("tags of row #%d have capacity %d exceeding their length %d; appending to them may overwrite tags of other rows",
+				i, cap(tags), len(tags))
+		}
+		start := uintptr(unsafe.Pointer(&tags[0]))
+		spans = append(spans, tagsSpan{
+			start: start,
+			end:   start + uintptr(len(tags))*unsafe.Sizeof(tags[0]),
+			row:   i,
+		})
+	}
+	sort.Slice(spans, func(i, j int) bool {
+		return spans[i].start < spans[j].start
+	})
+	for i := 1; i < len(spans); i++ {
+		if spans[i].start == spans[i-1].start && spans[i].end == spans[i-1].end {
+			// Rows expanded from a single multi-metric object share tags.
+			continue
+		}
+		if spans[i].start < spans[i-1].end {
+			tagsAliasingErrors.Inc()
+			return fmt.Errorf("tags of row #%d alias tags of row #%d", spans[i].row, spans[i-1].row)
+		}
+	}
+	return nil
+}
+
+var tagsAliasingErrors = metrics.NewCounter(`vm_opentsdb_tags_aliasing_errors_total{type="opentsdb-http"}`)
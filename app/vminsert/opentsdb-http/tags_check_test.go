@@ -0,0 +1,78 @@
+// +build tagscheck
+
+package opentsdbhttp
+
+import (
+	"testing"
+)
+
+func TestCheckTagsAliasing(t *testing.T) {
+	f := func(rows []Row, errExpected bool) {
+		t.Helper()
+		err := checkTagsAliasing(rows)
+		if errExpected && err == nil {
+			t.Fatalf("expecting non-nil error")
+		}
+		if !errExpected && err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	}
+
+	tagsPool := []Tag{{Key: "a", Value: "b"}, {Key: "c", Value: "d"}, {Key: "e", Value: "f"}}
+
+	// Distinct tags
+	f([]Row{
+		{Tags: tagsPool[0:1:1]},
+		{Tags: tagsPool[1:3:3]},
+	}, false)
+
+	// Identical tags shared by rows expanded from a multi-metric object
+	f([]Row{
+		{Tags: tagsPool[0:2:2]},
+		{Tags: tagsPool[0:2:2]},
+		{Tags: tagsPool[2:3:3]},
+	}, false)
+
+	// Uncapped tags
+	f([]Row{
+		{Tags: tagsPool[0:1]},
+	}, true)
+
+	// Overlapping tags
+	f([]Row{
+		{Tags: tagsPool[1:3:3]},
+		{Tags: tagsPool[0:2:2]},
+	}, true)
+}
+
+func TestRowsUnmarshalNoTagsAliasing(t *testing.T) {
+	f := func(s string, rollup bool) {
+		t.Helper()
+		p := parserPool.Get()
+		defer parserPool.Put(p)
+		v, err := p.Parse(s)
+		if err != nil {
+			t.Fatalf("cannot parse json %q: %s", s, err)
+		}
+		var rows Rows
+		for i := 0; i < 3; i++ {
+			if rollup {
+				err = rows.UnmarshalRollup(v)
+			} else {
+				err = rows.Unmarshal(v)
+			}
+			if err != nil {
+				t.Fatalf("cannot unmarshal %q: %s", s, err)
+			}
+		}
+	}
+	f(`[{"metric": "foo", "timestamp": 1, "value": 2, "tags": {"a": "b", "c": "d"}},
+{"metric": "bar", "timestamp": 1, "value": 2, "tags": {"e": "f", "g": 1}},
+{"metric": "baz", "timestamp": 1, "value": 2, "tags": {"h": "i"}}]`, false)
+	*allowMetricArrays = true
+	f(`[{"metric": ["foo", "bar"], "timestamp": 1, "value": [2, 3], "tags": {"a": "b", "c": "d"}},
+{"metric": "baz", "timestamp": 1, "value": 2, "tags": {"e": "f"}}]`, false)
+	*allowMetricArrays = false
+	f(`[{"metric": "foo", "timestamp": 1, "value": 2, "tags": {"a": "b"}, "interval": "1h", "aggregator": "sum"},
+{"metric": "bar", "timestamp": 1, "value": 2, "tags": {"c": "d"}, "interval": "1h", "groupByAggregator": "max"}]`, true)
+}
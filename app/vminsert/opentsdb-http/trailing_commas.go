@@ -0,0 +1,60 @@
+package opentsdbhttp
+
+import (
+	"bytes"
+	"flag"
+
+	"github.com/VictoriaMetrics/metrics"
+)
+
+var allowTrailingCommas = flag.Bool("opentsdbhttp.allowTrailingCommas", false, "Whether to accept OpenTSDB HTTP request bodies with trailing commas in JSON arrays and objects "+
+	"such as `[{...},]`, which are emitted by some hand-written or buggy JSON producers. Such bodies aren't valid JSON, so they are rejected by default. "+
+	"See vm_opentsdbhttp_trailing_commas_removed_total metric for detecting clients, which must be fixed")
+
+var removedTrailingCommas = metrics.NewCounter(`vm_opentsdbhttp_trailing_commas_removed_total`)
+
+// removeTrailingCommas removes commas followed by `]` or `}` outside JSON strings in data if -opentsdbhttp.allowTrailingCommas is set.
+//
+// data is modified in place, so the returned result is valid until data is changed.
+func removeTrailingCommas(data []byte) []byte {
+	if !*allowTrailingCommas || bytes.IndexByte(data, ',') < 0 {
+		return data
+	}
+	dst := data[:0]
+	removed := 0
+	inString := false
+	escaped := false
+	for i := 0; i < len(data); i++ {
+		c := data[i]
+		if inString {
+			switch {
+			case escaped:
+				escaped = false
+			case c == '\\':
+				escaped = true
+			case c == '"':
+				inString = false
+			}
+		} else if c == '"' {
+			inString = true
+		} else if c == ',' && isTrailingComma(data[i+1:]) {
+			removed++
+			continue
+		}
+		dst = append(dst, c)
+	}
+	if removed > 0 {
+		removedTrailingCommas.Add(removed)
+	}
+	return dst
+}
+
+// isTrailingComma returns true if the comma followed by tail closes a JSON array or object.
+func isTrailingComma(tail []byte) bool {
+	for _, c := range tail {
+		if !isJSONWhitespace(c) {
+			return c == ']' || c == '}'
+		}
+	}
+	return false
+}
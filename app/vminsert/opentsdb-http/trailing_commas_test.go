@@ -0,0 +1,86 @@
+package opentsdbhttp
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRemoveTrailingCommas(t *testing.T) {
+	defer func() {
+		*allowTrailingCommas = false
+	}()
+
+	f := func(s, resultExpected string) {
+		t.Helper()
+		result := removeTrailingCommas([]byte(s))
+		if string(result) != resultExpected {
+			t.Fatalf("unexpected result for %q; got %q; want %q", s, result, resultExpected)
+		}
+	}
+
+	// Trailing commas are preserved by default
+	f(`[{"a":1,},]`, `[{"a":1,},]`)
+
+	*allowTrailingCommas = true
+	f(``, ``)
+	f(`[1,2]`, `[1,2]`)
+	f(`[1,2,]`, `[1,2]`)
+	f(`[{"a":1,"b":[1,],}, ]`, `[{"a":1,"b":[1]} ]`)
+	f("{\"a\":1,\n\t}", "{\"a\":1\n\t}")
+
+	// Commas inside strings are preserved
+	f(`{"a":",]","b":"\",}",}`, `{"a":",]","b":"\",}"}`)
+
+	// Commas at the end of truncated body are preserved, so the body remains invalid
+	f(`[1,`, `[1,`)
+}
+
+func TestPushCtxReadTrailingCommas(t *testing.T) {
+	defer func() {
+		*allowTrailingCommas = false
+		*streamParse = false
+	}()
+
+	f := func(body string, rowsExpected int, errExpected bool) {
+		t.Helper()
+		ctx := getPushCtx()
+		defer putPushCtx(ctx)
+		rows := 0
+		for ctx.Read(strings.NewReader(body), 1024) {
+			rows += len(ctx.Rows.Rows)
+		}
+		err := ctx.Error()
+		if errExpected {
+			if err == nil {
+				t.Fatalf("expecting non-nil error for %q", body)
+			}
+			return
+		}
+		if err != nil {
+			t.Fatalf("unexpected error for %q: %s", body, err)
+		}
+		if rows != rowsExpected {
+			t.Fatalf("unexpected number of rows for %q; got %d; want %d", body, rows, rowsExpected)
+		}
+	}
+
+	row := `{"metric": "foo", "timestamp": 1, "value": 2, "tags": {"a": "b",},}`
+	for _, stream := range []bool{false, true} {
+		*streamParse = stream
+
+		*allowTrailingCommas = false
+		f("["+row+"]", 0, true)
+		f(`[{"metric": "foo", "timestamp": 1, "value": 2, "tags": {"a": "b"}},]`, 0, true)
+
+		*allowTrailingCommas = true
+		n := removedTrailingCommas.Get()
+		f(row, 1, false)
+		f("["+row+", "+row+",\n]", 2, false)
+		if d := removedTrailingCommas.Get() - n; d != 7 {
+			t.Fatalf("unexpected number of removed trailing commas in stream=%v mode; got %d; want 7", stream, d)
+		}
+
+		// Duplicate commas aren't trailing commas
+		f("["+row+",,]", 0, true)
+	}
+}
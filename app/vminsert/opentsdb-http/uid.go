@@ -0,0 +1,107 @@
+package opentsdbhttp
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/VictoriaMetrics/VictoriaMetrics/app/vminsert/common"
+	xxhash "github.com/cespare/xxhash/v2"
+	"github.com/valyala/fastjson"
+)
+
+// uidKinds contains UID kinds supported by /api/uid/assign.
+var uidKinds = []string{"metric", "tagk", "tagv"}
+
+// UIDAssignHandler processes /api/uid/assign requests.
+//
+// VictoriaMetrics doesn't need UIDs, so it returns synthesized UIDs
+// for the requested names. This unblocks clients, which assign UIDs before writing data.
+// UIDs are deterministic hashes of names, so the same name always gets the same UID.
+//
+// See http://opentsdb.net/docs/build/html/api_http/uid/assign.html
+func UIDAssignHandler(w http.ResponseWriter, req *http.Request, maxSize int64) error {
+	var names map[string][]string
+	var err error
+	if req.Method == "POST" {
+		names, err = readUIDAssignBody(req.Body, maxSize)
+		if err != nil {
+			return err
+		}
+	} else {
+		names = make(map[string][]string, len(uidKinds))
+		for _, kind := range uidKinds {
+			if v := req.FormValue(kind); len(v) > 0 {
+				names[kind] = strings.Split(v, ",")
+			}
+		}
+	}
+	if len(names) == 0 {
+		return fmt.Errorf("missing names to assign; pass at least one of %q", uidKinds)
+	}
+	data, err := json.Marshal(assignUIDs(names))
+	if err != nil {
+		return fmt.Errorf("cannot marshal response: %s", err)
+	}
+	common.WriteJSONResponse(w, req, data)
+	return nil
+}
+
+func readUIDAssignBody(r io.Reader, maxSize int64) (map[string][]string, error) {
+	lr := io.LimitReader(r, maxSize+1)
+	data, err := ioutil.ReadAll(lr)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read request: %s", err)
+	}
+	if int64(len(data)) > maxSize {
+		return nil, fmt.Errorf("too big request; mustn't exceed %d bytes", maxSize)
+	}
+	v, err := fastjson.ParseBytes(data)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse json: %s", err)
+	}
+	names := make(map[string][]string, len(uidKinds))
+	for _, kind := range uidKinds {
+		kv := v.Get(kind)
+		if kv == nil {
+			continue
+		}
+		a, err := kv.Array()
+		if err != nil {
+			return nil, fmt.Errorf("%q must be an array of strings: %s", kind, err)
+		}
+		for _, nv := range a {
+			name, err := nv.StringBytes()
+			if err != nil {
+				return nil, fmt.Errorf("%q must be an array of strings: %s", kind, err)
+			}
+			names[kind] = append(names[kind], string(name))
+		}
+	}
+	return names, nil
+}
+
+// assignUIDs returns synthesized UIDs for the given names grouped by UID kind.
+func assignUIDs(names map[string][]string) map[string]map[string]string {
+	result := make(map[string]map[string]string, len(names))
+	for kind, a := range names {
+		m := make(map[string]string, len(a))
+		for _, name := range a {
+			if len(name) == 0 {
+				continue
+			}
+			m[name] = synthesizeUID(kind, name)
+		}
+		result[kind] = m
+	}
+	return result
+}
+
+// synthesizeUID returns 3-byte UID in hex for the given name like OpenTSDB does with default UID width.
+func synthesizeUID(kind, name string) string {
+	h := xxhash.Sum64String(kind + "\x00" + name)
+	return fmt.Sprintf("%06X", h&0xffffff)
+}
@@ -0,0 +1,77 @@
+package opentsdbhttp
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestUIDAssignHandler(t *testing.T) {
+	f := func(req *http.Request, resultExpected map[string]map[string]string) {
+		t.Helper()
+		w := httptest.NewRecorder()
+		if err := UIDAssignHandler(w, req, 1024); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		var result map[string]map[string]string
+		if err := json.Unmarshal(w.Body.Bytes(), &result); err != nil {
+			t.Fatalf("cannot parse response %q: %s", w.Body.String(), err)
+		}
+		if !reflect.DeepEqual(result, resultExpected) {
+			t.Fatalf("unexpected response;\ngot\n%v\nwant\n%v", result, resultExpected)
+		}
+	}
+
+	resultExpected := map[string]map[string]string{
+		"metric": {
+			"sys.cpu.0": synthesizeUID("metric", "sys.cpu.0"),
+			"sys.cpu.1": synthesizeUID("metric", "sys.cpu.1"),
+		},
+		"tagk": {
+			"host": synthesizeUID("tagk", "host"),
+		},
+	}
+
+	// GET request
+	req := httptest.NewRequest("GET", "/api/uid/assign?metric=sys.cpu.0,sys.cpu.1&tagk=host", nil)
+	f(req, resultExpected)
+
+	// POST request
+	req = httptest.NewRequest("POST", "/api/uid/assign", strings.NewReader(`{"metric":["sys.cpu.0","sys.cpu.1"],"tagk":["host"]}`))
+	f(req, resultExpected)
+}
+
+func TestUIDAssignHandlerFailure(t *testing.T) {
+	f := func(req *http.Request) {
+		t.Helper()
+		w := httptest.NewRecorder()
+		if err := UIDAssignHandler(w, req, 1024); err == nil {
+			t.Fatalf("expecting non-nil error")
+		}
+	}
+
+	// Missing names
+	f(httptest.NewRequest("GET", "/api/uid/assign", nil))
+	f(httptest.NewRequest("POST", "/api/uid/assign", strings.NewReader(`{}`)))
+
+	// Invalid json
+	f(httptest.NewRequest("POST", "/api/uid/assign", strings.NewReader(`{"metric":`)))
+	f(httptest.NewRequest("POST", "/api/uid/assign", strings.NewReader(`{"metric":"foo"}`)))
+	f(httptest.NewRequest("POST", "/api/uid/assign", strings.NewReader(`{"metric":[1]}`)))
+
+	// Too big request
+	f(httptest.NewRequest("POST", "/api/uid/assign", strings.NewReader(`{"metric":["`+strings.Repeat("a", 1024)+`"]}`)))
+}
+
+func TestSynthesizeUID(t *testing.T) {
+	uid := synthesizeUID("metric", "foo")
+	if len(uid) != 6 {
+		t.Fatalf("unexpected UID length; got %d; want 6", len(uid))
+	}
+	if uid != synthesizeUID("metric", "foo") {
+		t.Fatalf("UID must be deterministic")
+	}
+}
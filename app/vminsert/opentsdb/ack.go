@@ -0,0 +1,65 @@
+package opentsdb
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/VictoriaMetrics/metrics"
+)
+
+var allowAcks = flag.Bool("opentsdb.allowAcks", false, "Whether to accept acknowledgment mode on TCP OpenTSDB connections. "+
+	"A connection switches to the acknowledgment mode if its first byte is 0x02. After that the server writes `ok N\\n` line "+
+	"after each flushed batch of put lines, where N is the number of accepted rows in the batch. "+
+	"This allows clients implementing flow control. Plaintext connections are accepted as usual")
+
+// ackModeHandshake is the first byte sent by clients switching to the acknowledgment mode.
+//
+// It cannot start plaintext put line.
+const ackModeHandshake = 0x02
+
+// ackWriteTimeout is the maximum duration for writing acknowledgment to the client.
+const ackWriteTimeout = 10 * time.Second
+
+// insertAckHandler processes put lines from c and writes acknowledgment to c after each flushed batch.
+func insertAckHandler(c net.Conn, lm *listenerMetrics) error {
+	return concurrencyLimiter.Do(func() error {
+		return insertAckHandlerInternal(c, lm)
+	})
+}
+
+func insertAckHandlerInternal(c net.Conn, lm *listenerMetrics) error {
+	ctx := getPushCtx()
+	defer putPushCtx(ctx)
+	ctx.Common.SetLabelOrder("opentsdb")
+	ctx.lm = lm
+	for ctx.Read(c) {
+		if len(ctx.Rows.Rows) == 0 {
+			// Do not send acknowledgments for idle connections.
+			continue
+		}
+		if err := ctx.InsertRows(); err != nil {
+			return err
+		}
+		ctx.ackBuf = appendAck(ctx.ackBuf[:0], ctx.Common.RowsCount())
+		if err := c.SetWriteDeadline(time.Now().Add(ackWriteTimeout)); err != nil {
+			return fmt.Errorf("cannot set write deadline: %s", err)
+		}
+		if _, err := c.Write(ctx.ackBuf); err != nil {
+			return fmt.Errorf("cannot write acknowledgment: %s", err)
+		}
+		acksWritten.Inc()
+	}
+	return ctx.Error()
+}
+
+// appendAck appends acknowledgment line for the given number of accepted rows to dst.
+func appendAck(dst []byte, rowsAccepted int) []byte {
+	dst = append(dst, "ok "...)
+	dst = strconv.AppendInt(dst, int64(rowsAccepted), 10)
+	return append(dst, '\n')
+}
+
+var acksWritten = metrics.NewCounter(`vm_opentsdb_acks_written_total`)
@@ -0,0 +1,17 @@
+package opentsdb
+
+import (
+	"testing"
+)
+
+func TestAppendAck(t *testing.T) {
+	f := func(rowsAccepted int, resultExpected string) {
+		t.Helper()
+		result := appendAck(nil, rowsAccepted)
+		if string(result) != resultExpected {
+			t.Fatalf("unexpected ack; got %q; want %q", result, resultExpected)
+		}
+	}
+	f(0, "ok 0\n")
+	f(123, "ok 123\n")
+}
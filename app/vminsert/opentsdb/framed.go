@@ -0,0 +1,158 @@
+package opentsdb
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+
+	"github.com/VictoriaMetrics/VictoriaMetrics/app/vminsert/common"
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/bytesutil"
+	"github.com/VictoriaMetrics/metrics"
+)
+
+var allowFramedGzip = flag.Bool("opentsdb.allowFramedGzip", false, "Whether to accept gzip-compressed framed mode on TCP OpenTSDB connections. "+
+	"A connection switches to the framed mode if its first byte is 0x01. After that every frame must consist of "+
+	"a 4-byte big-endian length followed by gzip-compressed block of put lines. Plaintext connections are accepted as usual")
+
+// framedModeHandshake is the first byte sent by clients switching to the framed mode.
+//
+// It cannot start plaintext put line.
+const framedModeHandshake = 0x01
+
+// maxFrameSize is the maximum size of a single frame in framed mode both before and after decompression.
+const maxFrameSize = 64 * 1024 * 1024
+
+// newConnReader returns a reader for c and the handshake byte sent by the client.
+//
+// Zero handshake byte is returned for plaintext connections.
+func newConnReader(c net.Conn) (net.Conn, byte, error) {
+	if !*allowFramedGzip && !*allowAcks {
+		return c, 0, nil
+	}
+	br := bufio.NewReader(c)
+	b, err := br.Peek(1)
+	if err != nil {
+		if err == io.EOF {
+			return c, 0, nil
+		}
+		return nil, 0, fmt.Errorf("cannot read the first byte: %s", err)
+	}
+	pc := &peekedConn{
+		Conn: c,
+		br:   br,
+	}
+	handshake := b[0]
+	if !(handshake == framedModeHandshake && *allowFramedGzip) && !(handshake == ackModeHandshake && *allowAcks) {
+		return pc, 0, nil
+	}
+	if _, err := br.Discard(1); err != nil {
+		return nil, 0, fmt.Errorf("cannot skip handshake byte: %s", err)
+	}
+	return pc, handshake, nil
+}
+
+// peekedConn is net.Conn with buffered reader, which could be used for peeking data.
+type peekedConn struct {
+	net.Conn
+	br *bufio.Reader
+}
+
+func (pc *peekedConn) Read(p []byte) (int, error) {
+	return pc.br.Read(p)
+}
+
+// insertFramedHandler processes gzip-compressed frames from r.
+func insertFramedHandler(r io.Reader, lm *listenerMetrics) error {
+	return concurrencyLimiter.Do(func() error {
+		return insertFramedHandlerInternal(r, lm)
+	})
+}
+
+func insertFramedHandlerInternal(r io.Reader, lm *listenerMetrics) error {
+	ctx := getPushCtx()
+	defer putPushCtx(ctx)
+	ctx.Common.SetLabelOrder("opentsdb")
+	ctx.lm = lm
+	ctx.retryFailed = true
+	ctx.batchFlushes = true
+	err := ctx.insertFrames(r)
+	// Rows from successfully parsed frames must be written even if the rest of frames cannot be read.
+	if errFlush := ctx.flushDeferred(); err == nil {
+		err = errFlush
+	}
+	return err
+}
+
+func (ctx *pushCtx) insertFrames(r io.Reader) error {
+	for {
+		var err error
+		ctx.frameBuf, err = readFrame(r, ctx.frameBuf[:0])
+		if err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			opentsdbReadErrors.Inc()
+			return err
+		}
+		framesRead.Inc()
+		zr, err := common.GetGzipReader(bytes.NewReader(ctx.frameBuf))
+		if err != nil {
+			opentsdbReadErrors.Inc()
+			return fmt.Errorf("cannot read gzipped frame: %s", err)
+		}
+		ctx.reqBuf, err = readAll(ctx.reqBuf[:0], zr, maxFrameSize)
+		common.PutGzipReader(zr)
+		if err != nil {
+			opentsdbReadErrors.Inc()
+			return fmt.Errorf("cannot decompress frame: %s", err)
+		}
+		if !ctx.unmarshal() {
+			return ctx.Error()
+		}
+		if err := ctx.InsertRows(); err != nil {
+			return err
+		}
+	}
+}
+
+// readFrame reads a single length-prefixed frame from r and appends it to dst.
+//
+// io.EOF is returned if r has no more frames.
+func readFrame(r io.Reader, dst []byte) ([]byte, error) {
+	var lenBuf [4]byte
+	if _, err := io.ReadFull(r, lenBuf[:]); err != nil {
+		if err == io.EOF {
+			return dst, io.EOF
+		}
+		return dst, fmt.Errorf("cannot read frame length: %s", err)
+	}
+	n := binary.BigEndian.Uint32(lenBuf[:])
+	if n > maxFrameSize {
+		return dst, fmt.Errorf("too big frame length: %d bytes; mustn't exceed %d bytes", n, maxFrameSize)
+	}
+	dst = bytesutil.Resize(dst, int(n))
+	if _, err := io.ReadFull(r, dst); err != nil {
+		return dst, fmt.Errorf("cannot read frame with length %d: %s", n, err)
+	}
+	return dst, nil
+}
+
+func readAll(dst []byte, r io.Reader, maxSize int64) ([]byte, error) {
+	bb := bytesutil.ByteBuffer{
+		B: dst,
+	}
+	n, err := bb.ReadFrom(io.LimitReader(r, maxSize+1))
+	if err != nil {
+		return bb.B, err
+	}
+	if n > maxSize {
+		return bb.B, fmt.Errorf("too big decompressed frame; mustn't exceed %d bytes", maxSize)
+	}
+	return bb.B, nil
+}
+
+var framesRead = metrics.NewCounter(`vm_opentsdb_frames_read_total`)
@@ -0,0 +1,158 @@
+package opentsdb
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestNewConnReader(t *testing.T) {
+	defer func(framed, acks bool) {
+		*allowFramedGzip = framed
+		*allowAcks = acks
+	}(*allowFramedGzip, *allowAcks)
+
+	f := func(data []byte, handshakeExpected byte, payloadExpected []byte) {
+		t.Helper()
+		client, server := net.Pipe()
+		go func() {
+			_, _ = client.Write(data)
+			_ = client.Close()
+		}()
+		defer server.Close()
+		r, handshake, err := newConnReader(server)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if handshake != handshakeExpected {
+			t.Fatalf("unexpected handshake; got %d; want %d", handshake, handshakeExpected)
+		}
+		if _, ok := r.(net.Conn); !ok {
+			t.Fatalf("reader must implement net.Conn")
+		}
+		payload, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatalf("cannot read payload: %s", err)
+		}
+		if !bytes.Equal(payload, payloadExpected) {
+			t.Fatalf("unexpected payload; got %q; want %q", payload, payloadExpected)
+		}
+	}
+
+	frame := marshalFrame(t, "put foo 123 456 a=b\n")
+	ackData := append([]byte{ackModeHandshake}, "put foo 123 456 a=b\n"...)
+
+	// Handshakes are ignored if they aren't allowed
+	*allowFramedGzip = false
+	*allowAcks = false
+	f(append([]byte{framedModeHandshake}, frame...), 0, append([]byte{framedModeHandshake}, frame...))
+	f(ackData, 0, ackData)
+
+	*allowFramedGzip = true
+	*allowAcks = true
+
+	// Plaintext
+	f([]byte("put foo 123 456 a=b\n"), 0, []byte("put foo 123 456 a=b\n"))
+
+	// Framed
+	f(append([]byte{framedModeHandshake}, frame...), framedModeHandshake, frame)
+
+	// Acknowledgments
+	f(ackData, ackModeHandshake, []byte("put foo 123 456 a=b\n"))
+}
+
+func TestReadFramedRows(t *testing.T) {
+	var data []byte
+	data = append(data, marshalFrame(t, "put foo 12 3 a=b\nput bar 13 4 c=d\n")...)
+	data = append(data, marshalFrame(t, "put baz 14 5 e=f")...)
+	r := bytes.NewReader(data)
+
+	ctx := getPushCtx()
+	defer putPushCtx(ctx)
+	var metrics []string
+	for {
+		var err error
+		ctx.frameBuf, err = readFrame(r, ctx.frameBuf[:0])
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			t.Fatalf("unexpected error: %s", err)
+		}
+		zr, err := gzip.NewReader(bytes.NewReader(ctx.frameBuf))
+		if err != nil {
+			t.Fatalf("cannot create gzip reader: %s", err)
+		}
+		ctx.reqBuf, err = readAll(ctx.reqBuf[:0], zr, maxFrameSize)
+		if err != nil {
+			t.Fatalf("cannot decompress frame: %s", err)
+		}
+		if !ctx.unmarshal() {
+			t.Fatalf("cannot unmarshal frame: %s", ctx.Error())
+		}
+		for _, r := range ctx.Rows.Rows {
+			metrics = append(metrics, string(append([]byte{}, r.Metric...)))
+			if r.Timestamp%1000 != 0 {
+				t.Fatalf("timestamp must be converted to milliseconds; got %d", r.Timestamp)
+			}
+		}
+	}
+	metricsExpected := []string{"foo", "bar", "baz"}
+	if !reflect.DeepEqual(metrics, metricsExpected) {
+		t.Fatalf("unexpected metrics; got %q; want %q", metrics, metricsExpected)
+	}
+}
+
+func TestReadFrameFailure(t *testing.T) {
+	f := func(data []byte) {
+		t.Helper()
+		_, err := readFrame(bytes.NewReader(data), nil)
+		if err == nil {
+			t.Fatalf("expecting non-nil error")
+		}
+	}
+
+	// Truncated length
+	f([]byte{0, 0})
+
+	// Truncated frame
+	f([]byte{0, 0, 0, 10, 'a'})
+
+	// Too big frame
+	var lenBuf [4]byte
+	binary.BigEndian.PutUint32(lenBuf[:], maxFrameSize+1)
+	f(lenBuf[:])
+}
+
+func TestReadAllTooBig(t *testing.T) {
+	if _, err := readAll(nil, bytes.NewReader(make([]byte, 11)), 10); err == nil {
+		t.Fatalf("expecting non-nil error")
+	}
+	b, err := readAll(nil, bytes.NewReader(make([]byte, 10)), 10)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(b) != 10 {
+		t.Fatalf("unexpected length; got %d; want 10", len(b))
+	}
+}
+
+func marshalFrame(t *testing.T, s string) []byte {
+	t.Helper()
+	var bb bytes.Buffer
+	zw := gzip.NewWriter(&bb)
+	if _, err := zw.Write([]byte(s)); err != nil {
+		t.Fatalf("cannot compress data: %s", err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatalf("cannot close gzip writer: %s", err)
+	}
+	var lenBuf [4]byte
+	binary.BigEndian.PutUint32(lenBuf[:], uint32(bb.Len()))
+	return append(lenBuf[:], bb.Bytes()...)
+}
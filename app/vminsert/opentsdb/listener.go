@@ -0,0 +1,93 @@
+package opentsdb
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/VictoriaMetrics/metrics"
+)
+
+// listenAddr is a single address from -opentsdbListenAddr.
+type listenAddr struct {
+	// name is an optional listener name, which is added as `listener` label to per-listener metrics.
+	name string
+
+	addr string
+}
+
+// parseListenAddrs parses comma-separated list of `[name=]addr` items from -opentsdbListenAddr.
+func parseListenAddrs(s string) ([]listenAddr, error) {
+	var las []listenAddr
+	names := make(map[string]bool)
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if len(item) == 0 {
+			continue
+		}
+		var la listenAddr
+		if n := strings.IndexByte(item, '='); n >= 0 {
+			la.name = item[:n]
+			la.addr = item[n+1:]
+			if len(la.name) == 0 {
+				return nil, fmt.Errorf("missing listener name in %q", item)
+			}
+		} else {
+			la.addr = item
+		}
+		if len(la.addr) == 0 {
+			return nil, fmt.Errorf("missing listen address in %q", item)
+		}
+		if names[la.name] {
+			if len(la.name) == 0 {
+				return nil, fmt.Errorf("only a single unnamed listener is allowed; give names to the rest of listeners with `name=addr` syntax")
+			}
+			return nil, fmt.Errorf("duplicate listener name %q", la.name)
+		}
+		names[la.name] = true
+		las = append(las, la)
+	}
+	if len(las) == 0 {
+		return nil, fmt.Errorf("missing listen addresses")
+	}
+	return las, nil
+}
+
+// listenerMetrics contains metrics for a single OpenTSDB listener.
+type listenerMetrics struct {
+	rowsInserted *metrics.Counter
+
+	writeRequestsTCP *metrics.Counter
+	writeErrorsTCP   *metrics.Counter
+
+	writeRequestsUDP *metrics.Counter
+	writeErrorsUDP   *metrics.Counter
+}
+
+// defaultListenerMetrics is used for the unnamed listener, so its metrics remain unchanged.
+var defaultListenerMetrics = &listenerMetrics{
+	rowsInserted: rowsInserted,
+
+	writeRequestsTCP: writeRequestsTCP,
+	writeErrorsTCP:   writeErrorsTCP,
+
+	writeRequestsUDP: writeRequestsUDP,
+	writeErrorsUDP:   writeErrorsUDP,
+}
+
+// getListenerMetrics returns metrics for the listener with the given name.
+//
+// Metrics for named listeners contain `listener` label with the name.
+func getListenerMetrics(name string) *listenerMetrics {
+	if len(name) == 0 {
+		return defaultListenerMetrics
+	}
+	return &listenerMetrics{
+		rowsInserted: metrics.GetOrCreateCounter(fmt.Sprintf(`vm_rows_inserted_total{type="opentsdb", listener=%q}`, name)),
+
+		writeRequestsTCP: metrics.GetOrCreateCounter(fmt.Sprintf(`vm_opentsdb_requests_total{name="write", net="tcp", listener=%q}`, name)),
+		writeErrorsTCP:   metrics.GetOrCreateCounter(fmt.Sprintf(`vm_opentsdb_request_errors_total{name="write", net="tcp", listener=%q}`, name)),
+
+		writeRequestsUDP: metrics.GetOrCreateCounter(fmt.Sprintf(`vm_opentsdb_requests_total{name="write", net="udp", listener=%q}`, name)),
+		writeErrorsUDP:   metrics.GetOrCreateCounter(fmt.Sprintf(`vm_opentsdb_request_errors_total{name="write", net="udp", listener=%q}`, name)),
+	}
+}
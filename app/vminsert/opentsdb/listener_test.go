@@ -0,0 +1,80 @@
+package opentsdb
+
+import (
+	"testing"
+
+	"github.com/VictoriaMetrics/VictoriaMetrics/app/vminsert/common"
+)
+
+func TestParseListenAddrsSuccess(t *testing.T) {
+	f := func(s string, resultExpected []listenAddr) {
+		t.Helper()
+		las, err := parseListenAddrs(s)
+		if err != nil {
+			t.Fatalf("unexpected error when parsing %q: %s", s, err)
+		}
+		if len(las) != len(resultExpected) {
+			t.Fatalf("unexpected result for %q; got %v; want %v", s, las, resultExpected)
+		}
+		for i := range las {
+			if las[i] != resultExpected[i] {
+				t.Fatalf("unexpected result for %q; got %v; want %v", s, las, resultExpected)
+			}
+		}
+	}
+	f(":4242", []listenAddr{{addr: ":4242"}})
+	f("[::1]:4242", []listenAddr{{addr: "[::1]:4242"}})
+	f("internal=:4242, dmz=:4243", []listenAddr{{name: "internal", addr: ":4242"}, {name: "dmz", addr: ":4243"}})
+	f(":4242,dmz=:4243", []listenAddr{{addr: ":4242"}, {name: "dmz", addr: ":4243"}})
+}
+
+func TestParseListenAddrsFailure(t *testing.T) {
+	f := func(s string) {
+		t.Helper()
+		if _, err := parseListenAddrs(s); err == nil {
+			t.Fatalf("expecting non-nil error when parsing %q", s)
+		}
+	}
+	f("")
+	f(",")
+	f("=:4242")
+	f("dmz=")
+	f(":4242,:4243")
+	f("dmz=:4242,dmz=:4243")
+}
+
+func TestGetListenerMetrics(t *testing.T) {
+	var rc common.RowsCollector
+	common.SetSink(&rc)
+	defer common.SetSink(nil)
+	if lm := getListenerMetrics(""); lm != defaultListenerMetrics {
+		t.Fatalf("expecting default metrics for unnamed listener")
+	}
+	lm := getListenerMetrics("dmz")
+	if lm.rowsInserted == rowsInserted {
+		t.Fatalf("expecting separate rows counter for named listener")
+	}
+	if lm2 := getListenerMetrics("dmz"); lm2.rowsInserted != lm.rowsInserted {
+		t.Fatalf("expecting the same rows counter for the same listener name")
+	}
+
+	rc.Reset(nil)
+
+	ctx := getPushCtx()
+	defer putPushCtx(ctx)
+	ctx.lm = lm
+	if err := ctx.Rows.Unmarshal("put foo 1 2 a=b\n"); err != nil {
+		t.Fatalf("cannot unmarshal rows: %s", err)
+	}
+	n := rowsInserted.Get()
+	nDMZ := lm.rowsInserted.Get()
+	if err := ctx.InsertRows(); err != nil {
+		t.Fatalf("cannot insert rows: %s", err)
+	}
+	if got := lm.rowsInserted.Get() - nDMZ; got != 1 {
+		t.Fatalf("unexpected number of rows for named listener; got %d; want 1", got)
+	}
+	if got := rowsInserted.Get() - n; got != 0 {
+		t.Fatalf("unexpected number of rows for unnamed listener; got %d; want 0", got)
+	}
+}
@@ -1,12 +1,23 @@
 package opentsdb
 
 import (
-	"fmt"
+	"flag"
+	"strconv"
 	"strings"
 
+	"github.com/VictoriaMetrics/VictoriaMetrics/app/vminsert/common"
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/logger"
+	"github.com/VictoriaMetrics/metrics"
 	"github.com/valyala/fastjson/fastfloat"
 )
 
+// AllowNoTags is shared by OpenTSDB telnet and http parsers.
+var AllowNoTags = flag.Bool("opentsdb.allowNoTags", false, "Whether to accept OpenTSDB rows without tags. "+
+	"Such rows are stored as time series with only the metric name. By default they are rejected as in OpenTSDB")
+
+var allowQuotedTagValues = flag.Bool("opentsdb.allowQuotedTagValues", false, "Whether to accept tag values enclosed in double quotes in OpenTSDB put messages, "+
+	`such as host="my server". Quoted values may contain whitespace and quotes escaped with backslash. This deviates from OpenTSDB`)
+
 // Rows contains parsed OpenTSDB rows.
 type Rows struct {
 	Rows []Row
@@ -29,18 +40,23 @@ func (rs *Rows) Reset() {
 	rs.tagsPool = rs.tagsPool[:0]
 }
 
-// Unmarshal unmarshals OpenTSDB put rows from s.
+// Unmarshal unmarshals OpenTSDB put and rollup rows from s.
+//
+// Rollup fields are stored in `rollup_interval`, `rollup_aggregator` and `rollup_group_by_aggregator` tags
+// in the same way as for OpenTSDB HTTP rollup API.
 //
 // See http://opentsdb.net/docs/build/html/api_telnet/put.html
+// and http://opentsdb.net/docs/build/html/api_telnet/rollup.html
 //
 // s must be unchanged until rs is in use.
 func (rs *Rows) Unmarshal(s string) error {
 	var err error
 	rs.Rows, rs.tagsPool, err = unmarshalRows(rs.Rows[:0], s, rs.tagsPool[:0])
+	tagsPoolStats.Update(len(rs.tagsPool), cap(rs.tagsPool))
 	if err != nil {
 		return err
 	}
-	return err
+	return checkTagsAliasing(rs.Rows)
 }
 
 // Row is a single OpenTSDB row.
@@ -60,40 +76,137 @@ func (r *Row) reset() {
 
 func (r *Row) unmarshal(s string, tagsPool []Tag) ([]Tag, error) {
 	r.reset()
-	if !strings.HasPrefix(s, "put ") {
-		return tagsPool, fmt.Errorf("missing `put ` prefix in %q", s)
+	var rf rollupFields
+	switch {
+	case strings.HasPrefix(s, "put "):
+		s = s[len("put "):]
+	case strings.HasPrefix(s, "rollup "):
+		s = s[len("rollup "):]
+		n := strings.IndexByte(s, ' ')
+		if n < 0 {
+			return tagsPool, common.NewParseError(common.ErrBadFormat, "cannot find whitespace between rollup interval and metric in %q", s)
+		}
+		if err := rf.unmarshal(s[:n]); err != nil {
+			return tagsPool, err
+		}
+		s = s[n+1:]
+	default:
+		badPrefixRows.Inc()
+		return tagsPool, common.NewParseError(common.ErrBadFormat, "missing `put ` or `rollup ` prefix in %q", s)
 	}
-	s = s[len("put "):]
 	n := strings.IndexByte(s, ' ')
 	if n < 0 {
-		return tagsPool, fmt.Errorf("cannot find whitespace between metric and timestamp in %q", s)
+		return tagsPool, common.NewParseError(common.ErrMissingTimestamp, "cannot find whitespace between metric and timestamp in %q", s)
+	}
+	metric, err := CheckMetric(s[:n])
+	if err != nil {
+		return tagsPool, err
 	}
-	r.Metric = s[:n]
+	r.Metric = metric
 	tail := s[n+1:]
 	n = strings.IndexByte(tail, ' ')
 	if n < 0 {
-		return tagsPool, fmt.Errorf("cannot find whitespace between timestamp and value in %q", s)
+		return tagsPool, common.NewParseError(common.ErrMissingValue, "cannot find whitespace between timestamp and value in %q", s)
 	}
 	r.Timestamp = int64(fastfloat.ParseBestEffort(tail[:n]))
 	tail = tail[n+1:]
 	n = strings.IndexByte(tail, ' ')
 	if n < 0 {
-		return tagsPool, fmt.Errorf("cannot find whitespace between value and the first tag in %q", s)
+		if !*AllowNoTags {
+			return tagsPool, common.NewParseError(common.ErrMissingTags, "cannot find whitespace between value and the first tag in %q", s)
+		}
+		if r.Value, err = parseValue(tail); err != nil {
+			return tagsPool, err
+		}
+		tail = ""
+	} else {
+		if r.Value, err = parseValue(tail[:n]); err != nil {
+			return tagsPool, err
+		}
+		tail = tail[n+1:]
 	}
-	r.Value = fastfloat.ParseBestEffort(tail[:n])
-	var err error
 	tagsStart := len(tagsPool)
-	tagsPool, err = unmarshalTags(tagsPool, tail[n+1:])
-	if err != nil {
-		return tagsPool, fmt.Errorf("cannot unmarshal tags in %q: %s", s, err)
+	if len(tail) > 0 || !*AllowNoTags {
+		var err error
+		tagsPool, err = unmarshalTags(tagsPool, tail)
+		if err != nil {
+			return tagsPool, common.WrapParseError(err, "cannot unmarshal tags in %q: %s", s, err)
+		}
+	}
+	if len(tagsPool) == tagsStart && !*AllowNoTags {
+		// All the tags have been dropped according to -opentsdb.emptyTagValues.
+		return tagsPool, common.NewParseError(common.ErrMissingTags, "no tags left after dropping tags with empty values in %q", s)
+	}
+	tagsPool = rf.appendTags(tagsPool)
+	if len(tagsPool) == tagsStart {
+		// All the tags have been dropped.
+		return tagsPool, nil
 	}
 	tags := tagsPool[tagsStart:]
 	r.Tags = tags[:len(tags):len(tags)]
 	return tagsPool, nil
 }
 
+// rollupFields contains fields from `rollup` line.
+//
+// See http://opentsdb.net/docs/build/html/user_guide/rollups.html
+type rollupFields struct {
+	interval          string
+	aggregator        string
+	groupByAggregator string
+}
+
+// unmarshal unmarshals rf from `<interval>:<aggregator>[:<groupByAggregator>]` string s.
+//
+// The aggregator may be empty if groupByAggregator is set.
+func (rf *rollupFields) unmarshal(s string) error {
+	n := strings.IndexByte(s, ':')
+	if n <= 0 {
+		return common.NewParseError(common.ErrBadFormat, "missing rollup interval in %q; expecting `<interval>:<aggregator>`", s)
+	}
+	rf.interval = s[:n]
+	rf.aggregator = s[n+1:]
+	if n := strings.IndexByte(rf.aggregator, ':'); n >= 0 {
+		rf.groupByAggregator = rf.aggregator[n+1:]
+		rf.aggregator = rf.aggregator[:n]
+	}
+	if len(rf.aggregator) == 0 && len(rf.groupByAggregator) == 0 {
+		return common.NewParseError(common.ErrBadFormat, "missing rollup aggregator in %q; expecting `<interval>:<aggregator>`", s)
+	}
+	return nil
+}
+
+// appendTags appends rf to dst as tags in the same way as OpenTSDB HTTP rollup fields are stored.
+func (rf *rollupFields) appendTags(dst []Tag) []Tag {
+	if len(rf.interval) == 0 {
+		return dst
+	}
+	dst = append(dst, Tag{
+		Key:   "rollup_interval",
+		Value: rf.interval,
+	})
+	if len(rf.aggregator) > 0 {
+		dst = append(dst, Tag{
+			Key:   "rollup_aggregator",
+			Value: rf.aggregator,
+		})
+	}
+	if len(rf.groupByAggregator) > 0 {
+		dst = append(dst, Tag{
+			Key:   "rollup_group_by_aggregator",
+			Value: rf.groupByAggregator,
+		})
+	}
+	return dst
+}
+
+var badPrefixRows = metrics.NewCounter(`vm_opentsdb_bad_prefix_rows_total`)
+
 func unmarshalRows(dst []Row, s string, tagsPool []Tag) ([]Row, []Tag, error) {
+	// lineNum is 1-based index of the current line in s, so clients may locate the bad line in big batches.
+	lineNum := 0
 	for len(s) > 0 {
+		lineNum++
 		n := strings.IndexByte(s, '\n')
 		if n == 0 {
 			// Skip empty line
@@ -111,7 +224,7 @@ func unmarshalRows(dst []Row, s string, tagsPool []Tag) ([]Row, []Tag, error) {
 			var err error
 			tagsPool, err = r.unmarshal(s, tagsPool)
 			if err != nil {
-				err = fmt.Errorf("cannot unmarshal OpenTSDB line %q: %s", s, err)
+				err = common.WrapParseError(err, "cannot unmarshal OpenTSDB line #%d %q: %s", lineNum, s, err)
 				return dst, tagsPool, err
 			}
 			return dst, tagsPool, nil
@@ -119,7 +232,7 @@ func unmarshalRows(dst []Row, s string, tagsPool []Tag) ([]Row, []Tag, error) {
 		var err error
 		tagsPool, err = r.unmarshal(s[:n], tagsPool)
 		if err != nil {
-			err = fmt.Errorf("cannot unmarshal OpenTSDB line %q: %s", s[:n], err)
+			err = common.WrapParseError(err, "cannot unmarshal OpenTSDB line #%d %q: %s", lineNum, s[:n], err)
 			return dst, tagsPool, err
 		}
 		s = s[n+1:]
@@ -127,6 +240,31 @@ func unmarshalRows(dst []Row, s string, tagsPool []Tag) ([]Row, []Tag, error) {
 	return dst, tagsPool, nil
 }
 
+// parseValue parses OpenTSDB value from s.
+//
+// fastfloat.ParseBestEffort returns 0 for numbers it doesn't support such as `+1` or `.5`,
+// so such numbers are parsed with strconv.ParseFloat. An error is returned for invalid numbers instead of storing 0.
+func parseValue(s string) (float64, error) {
+	v := fastfloat.ParseBestEffort(s)
+	if v != 0 {
+		return v, nil
+	}
+	v, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		if ne, ok := err.(*strconv.NumError); ok && ne.Err == strconv.ErrRange {
+			// Too small numbers are rounded to 0.
+			return v, nil
+		}
+		return 0, common.NewParseError(common.ErrBadValue, "cannot parse value %q", s)
+	}
+	if v != 0 {
+		fallbackValues.Inc()
+	}
+	return v, nil
+}
+
+var fallbackValues = metrics.NewCounter(`vm_opentsdb_fallback_parsed_values_total`)
+
 func unmarshalTags(dst []Tag, s string) ([]Tag, error) {
 	for {
 		if cap(dst) > len(dst) {
@@ -137,16 +275,33 @@ func unmarshalTags(dst []Tag, s string) ([]Tag, error) {
 		tag := &dst[len(dst)-1]
 
 		n := strings.IndexByte(s, ' ')
+		if *allowQuotedTagValues {
+			var err error
+			n, err = indexQuotedTagEnd(s)
+			if err != nil {
+				return dst[:len(dst)-1], err
+			}
+		}
 		if n < 0 {
 			// The last tag found
-			if err := tag.unmarshal(s); err != nil {
+			ok, err := tag.unmarshal(s)
+			if err != nil {
 				return dst[:len(dst)-1], err
 			}
+			if !ok {
+				tag.reset()
+				dst = dst[:len(dst)-1]
+			}
 			return dst, nil
 		}
-		if err := tag.unmarshal(s[:n]); err != nil {
+		ok, err := tag.unmarshal(s[:n])
+		if err != nil {
 			return dst[:len(dst)-1], err
 		}
+		if !ok {
+			tag.reset()
+			dst = dst[:len(dst)-1]
+		}
 		s = s[n+1:]
 	}
 }
@@ -162,16 +317,163 @@ func (t *Tag) reset() {
 	t.Value = ""
 }
 
-func (t *Tag) unmarshal(s string) error {
+// unmarshal unmarshals t from s.
+//
+// It returns false if the tag must be dropped according to -opentsdb.emptyTagValues.
+func (t *Tag) unmarshal(s string) (bool, error) {
 	t.reset()
 	n := strings.IndexByte(s, '=')
 	if n < 0 {
-		return fmt.Errorf("missing tag value for %q", s)
-	}
-	t.Key = s[:n]
-	if len(t.Key) == 0 {
-		return fmt.Errorf("tag key cannot be empty for %q", s)
+		return false, common.NewParseError(common.ErrBadTag, "missing tag value for %q", s)
 	}
 	t.Value = s[n+1:]
-	return nil
+	if *allowQuotedTagValues && strings.HasPrefix(t.Value, `"`) {
+		t.Value = unquoteTagValue(t.Value[1 : len(t.Value)-1])
+	}
+	t.Key, t.Value = TrimTag(s[:n], t.Value)
+	ok, err := CheckTag(t.Key, t.Value)
+	if err != nil {
+		return false, common.WrapParseError(err, "invalid tag %q: %s", s, err)
+	}
+	return ok, nil
+}
+
+var (
+	trimTagValues = flag.Bool("opentsdb.trimTagValues", false, "Whether to trim leading and trailing whitespace from OpenTSDB tag values. "+
+		"This prevents from creating distinct series for values such as `foo` and ` foo `. Applies to both telnet and HTTP OpenTSDB protocols")
+	trimTagKeys = flag.Bool("opentsdb.trimTagKeys", false, "Whether to trim leading and trailing whitespace from OpenTSDB tag keys. "+
+		"Applies to both telnet and HTTP OpenTSDB protocols")
+)
+
+// TrimTag trims whitespace from key and value according to -opentsdb.trimTagKeys and -opentsdb.trimTagValues.
+//
+// Whitespace-only values are replaced with empty values according to -opentsdb.whitespaceTagValues.
+func TrimTag(key, value string) (string, string) {
+	if *whitespaceTagValues == "empty" && isWhitespaceOnly(value) {
+		whitespaceTagValuesEmptied.Inc()
+		value = ""
+	}
+	changed := false
+	if *trimTagKeys {
+		if k := strings.TrimSpace(key); len(k) != len(key) {
+			key = k
+			changed = true
+		}
+	}
+	if *trimTagValues {
+		if v := strings.TrimSpace(value); len(v) != len(value) {
+			value = v
+			changed = true
+		}
+	}
+	if changed {
+		trimmedTags.Inc()
+	}
+	return key, value
+}
+
+var trimmedTags = metrics.NewCounter(`vm_opentsdb_trimmed_tags_total`)
+
+var whitespaceTagValues = flag.String("opentsdb.whitespaceTagValues", "keep", "How to handle OpenTSDB tags with values consisting only of whitespace such as `host=\" \"` or tab. "+
+	"Possible values: `keep` - keep such values, `empty` - treat such values as empty, so they are handled according to -opentsdb.emptyTagValues, "+
+	"`reject` - reject the whole row. Applies to both telnet and HTTP OpenTSDB protocols")
+
+// isWhitespaceOnly returns true if s is non-empty and consists only of whitespace.
+func isWhitespaceOnly(s string) bool {
+	return len(s) > 0 && len(strings.TrimSpace(s)) == 0
+}
+
+var (
+	whitespaceTagValuesEmptied  = metrics.NewCounter(`vm_opentsdb_whitespace_tag_values_total{action="empty"}`)
+	whitespaceTagValuesRejected = metrics.NewCounter(`vm_opentsdb_whitespace_tag_values_total{action="reject"}`)
+)
+
+var emptyTagValues = flag.String("opentsdb.emptyTagValues", "drop", "How to handle OpenTSDB tags with empty values such as `host=`. "+
+	"Possible values: `drop` - drop such tags, since labels with empty values aren't stored, `reject` - reject the whole row. "+
+	"Rows without tags left are rejected unless -opentsdb.allowNoTags is set. "+
+	"Tags with empty keys such as `=foo` are always rejected. Applies to both telnet and HTTP OpenTSDB protocols")
+
+// InitFlags validates OpenTSDB flags shared by telnet and HTTP protocols.
+//
+// InitFlags must be called after flag.Parse call.
+func InitFlags() {
+	switch *emptyTagValues {
+	case "drop", "reject":
+	default:
+		logger.Fatalf("unsupported -opentsdb.emptyTagValues=%q; supported values: drop, reject", *emptyTagValues)
+	}
+	switch *whitespaceTagValues {
+	case "keep", "empty", "reject":
+	default:
+		logger.Fatalf("unsupported -opentsdb.whitespaceTagValues=%q; supported values: keep, empty, reject", *whitespaceTagValues)
+	}
+}
+
+// CheckTag checks the tag with the given key and value.
+//
+// Tags with empty keys are rejected. Tags with empty values are handled according to -opentsdb.emptyTagValues,
+// while tags with whitespace-only values are rejected if -opentsdb.whitespaceTagValues=reject.
+// It returns false if the tag must be dropped. An error is returned if the row with the tag must be rejected.
+func CheckTag(key, value string) (bool, error) {
+	if len(key) == 0 {
+		return false, common.NewParseError(common.ErrBadTag, "tag key cannot be empty")
+	}
+	if len(value) > 0 {
+		if *whitespaceTagValues == "reject" && isWhitespaceOnly(value) {
+			whitespaceTagValuesRejected.Inc()
+			return false, common.NewParseError(common.ErrBadTag, "tag value cannot consist only of whitespace for tag %q", key)
+		}
+		return true, nil
+	}
+	if *emptyTagValues == "reject" {
+		return false, common.NewParseError(common.ErrBadTag, "tag value cannot be empty for tag %q", key)
+	}
+	droppedEmptyTags.Inc()
+	return false, nil
+}
+
+var droppedEmptyTags = metrics.NewCounter(`vm_opentsdb_dropped_empty_tags_total`)
+
+// indexQuotedTagEnd returns the index of whitespace after the first tag in s.
+//
+// The tag value may be enclosed in double quotes. Such a value may contain
+// whitespace and quotes escaped with backslash.
+//
+// -1 is returned if s contains only a single tag.
+func indexQuotedTagEnd(s string) (int, error) {
+	n := strings.IndexByte(s, '=')
+	if n < 0 || n+1 >= len(s) || s[n+1] != '"' {
+		return strings.IndexByte(s, ' '), nil
+	}
+	for i := n + 2; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			// Skip escaped char
+			i++
+		case '"':
+			i++
+			if i == len(s) {
+				return -1, nil
+			}
+			if s[i] != ' ' {
+				return 0, common.NewParseError(common.ErrBadTag, "missing whitespace after quoted tag value in %q", s)
+			}
+			return i, nil
+		}
+	}
+	return 0, common.NewParseError(common.ErrBadTag, "missing closing quote for tag value in %q", s)
+}
+
+func unquoteTagValue(s string) string {
+	if strings.IndexByte(s, '\\') < 0 {
+		return s
+	}
+	b := make([]byte, 0, len(s))
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+1 < len(s) {
+			i++
+		}
+		b = append(b, s[i])
+	}
+	return string(b)
 }
@@ -2,7 +2,10 @@ package opentsdb
 
 import (
 	"reflect"
+	"strings"
 	"testing"
+
+	"github.com/VictoriaMetrics/VictoriaMetrics/app/vminsert/common"
 )
 
 func TestRowsUnmarshalFailure(t *testing.T) {
@@ -22,6 +25,9 @@ func TestRowsUnmarshalFailure(t *testing.T) {
 	// Missing put prefix
 	f("xx")
 
+	// Reserved metric name
+	f("put __name__ 123 43 foo=bar")
+
 	// Missing timestamp
 	f("put aaa")
 
@@ -45,6 +51,13 @@ func TestRowsUnmarshalFailure(t *testing.T) {
 	f("put aaa 123 4.5 =")
 	f("put aaa 123 4.5 =foo")
 	f("put aaa 123 4.5 =foo a=b")
+
+	// Invalid rollup
+	f("rollup 1h:sum")
+	f("rollup 1h foo 123 4.5 a=b")
+	f("rollup :sum foo 123 4.5 a=b")
+	f("rollup 1h: foo 123 4.5 a=b")
+	f("rollup 1h:: foo 123 4.5 a=b")
 }
 
 func TestRowsUnmarshalSuccess(t *testing.T) {
@@ -88,17 +101,13 @@ func TestRowsUnmarshalSuccess(t *testing.T) {
 			}},
 		}},
 	})
-	// Empty tag value
+	// Tags with empty values are dropped
 	f("put foobar 789 -123.456 a= b=c", &Rows{
 		Rows: []Row{{
 			Metric:    "foobar",
 			Value:     -123.456,
 			Timestamp: 789,
 			Tags: []Tag{
-				{
-					Key:   "a",
-					Value: "",
-				},
 				{
 					Key:   "b",
 					Value: "c",
@@ -201,3 +210,406 @@ func TestRowsUnmarshalSuccess(t *testing.T) {
 		},
 	})
 }
+
+func TestRowsUnmarshalAllowNoTags(t *testing.T) {
+	defer func(v bool) {
+		*AllowNoTags = v
+	}(*AllowNoTags)
+	*AllowNoTags = true
+
+	f := func(s string, rowsExpected []Row) {
+		t.Helper()
+		var rows Rows
+		if err := rows.Unmarshal(s); err != nil {
+			t.Fatalf("cannot unmarshal %q: %s", s, err)
+		}
+		if !reflect.DeepEqual(rows.Rows, rowsExpected) {
+			t.Fatalf("unexpected rows;\ngot\n%+v;\nwant\n%+v", rows.Rows, rowsExpected)
+		}
+	}
+	f("put foobar 789 -123.456", []Row{{
+		Metric:    "foobar",
+		Value:     -123.456,
+		Timestamp: 789,
+	}})
+	f("put foobar 789 -123.456 ", []Row{{
+		Metric:    "foobar",
+		Value:     -123.456,
+		Timestamp: 789,
+	}})
+	f("put foo 1 2\nput bar 3 4 a=b", []Row{
+		{
+			Metric:    "foo",
+			Value:     2,
+			Timestamp: 1,
+		},
+		{
+			Metric:    "bar",
+			Tags:      []Tag{{Key: "a", Value: "b"}},
+			Value:     4,
+			Timestamp: 3,
+		},
+	})
+
+	// Invalid tags are still rejected
+	var rows Rows
+	if err := rows.Unmarshal("put foobar 789 -123.456 foo"); err == nil {
+		t.Fatalf("expecting non-nil error")
+	}
+}
+
+func TestRowsUnmarshalRollup(t *testing.T) {
+	f := func(s string, rowsExpected []Row) {
+		t.Helper()
+		var rows Rows
+		if err := rows.Unmarshal(s); err != nil {
+			t.Fatalf("cannot unmarshal %q: %s", s, err)
+		}
+		if !reflect.DeepEqual(rows.Rows, rowsExpected) {
+			t.Fatalf("unexpected rows;\ngot\n%+v;\nwant\n%+v", rows.Rows, rowsExpected)
+		}
+	}
+	f("rollup 1h:sum foo 789 -123.456 a=b", []Row{{
+		Metric:    "foo",
+		Value:     -123.456,
+		Timestamp: 789,
+		Tags: []Tag{
+			{Key: "a", Value: "b"},
+			{Key: "rollup_interval", Value: "1h"},
+			{Key: "rollup_aggregator", Value: "sum"},
+		},
+	}})
+	f("rollup 1h::max foo 789 1 a=b", []Row{{
+		Metric:    "foo",
+		Value:     1,
+		Timestamp: 789,
+		Tags: []Tag{
+			{Key: "a", Value: "b"},
+			{Key: "rollup_interval", Value: "1h"},
+			{Key: "rollup_group_by_aggregator", Value: "max"},
+		},
+	}})
+	f("put foo 1 2 a=b\nrollup 1m:count:sum bar 3 4 c=d", []Row{
+		{
+			Metric:    "foo",
+			Value:     2,
+			Timestamp: 1,
+			Tags:      []Tag{{Key: "a", Value: "b"}},
+		},
+		{
+			Metric:    "bar",
+			Value:     4,
+			Timestamp: 3,
+			Tags: []Tag{
+				{Key: "c", Value: "d"},
+				{Key: "rollup_interval", Value: "1m"},
+				{Key: "rollup_aggregator", Value: "count"},
+				{Key: "rollup_group_by_aggregator", Value: "sum"},
+			},
+		},
+	})
+
+	// Unknown prefix
+	badPrefixRowsBefore := badPrefixRows.Get()
+	var rows Rows
+	if err := rows.Unmarshal("histogram foo 1 2 a=b"); err == nil {
+		t.Fatalf("expecting non-nil error")
+	}
+	if n := badPrefixRows.Get() - badPrefixRowsBefore; n != 1 {
+		t.Fatalf("unexpected number of rows with bad prefix; got %d; want 1", n)
+	}
+}
+
+func TestRowsUnmarshalErrorCode(t *testing.T) {
+	f := func(s string, codeExpected error) {
+		t.Helper()
+		var rows Rows
+		err := rows.Unmarshal(s)
+		if err == nil {
+			t.Fatalf("expecting non-nil error when parsing %q", s)
+		}
+		if common.GetParseErrorCode(err) != codeExpected {
+			t.Fatalf("unexpected error code for %q; got %v; want %v", s, common.GetParseErrorCode(err), codeExpected)
+		}
+	}
+	f("xx", common.ErrBadFormat)
+	f("put aaa", common.ErrMissingTimestamp)
+	f("put aaa 1123", common.ErrMissingValue)
+	f("put aaa 123 43", common.ErrMissingTags)
+	f("put aaa 123 4.5 foo", common.ErrBadTag)
+	f("put aaa 123 4.5 =foo", common.ErrBadTag)
+	f("put aaa 123 4.5 a=b\nput bbb 123", common.ErrMissingValue)
+}
+
+func TestRowsUnmarshalQuotedTagValues(t *testing.T) {
+	defer func(v bool) {
+		*allowQuotedTagValues = v
+	}(*allowQuotedTagValues)
+	*allowQuotedTagValues = true
+
+	f := func(s string, tagsExpected []Tag) {
+		t.Helper()
+		var rows Rows
+		if err := rows.Unmarshal(s); err != nil {
+			t.Fatalf("cannot unmarshal %q: %s", s, err)
+		}
+		if len(rows.Rows) != 1 {
+			t.Fatalf("unexpected number of rows; got %d; want 1", len(rows.Rows))
+		}
+		if !reflect.DeepEqual(rows.Rows[0].Tags, tagsExpected) {
+			t.Fatalf("unexpected tags;\ngot\n%+v;\nwant\n%+v", rows.Rows[0].Tags, tagsExpected)
+		}
+	}
+	f(`put foo 1 2 host="my server"`, []Tag{{Key: "host", Value: "my server"}})
+	f(`put foo 1 2 host="my server" dc=east`, []Tag{
+		{Key: "host", Value: "my server"},
+		{Key: "dc", Value: "east"},
+	})
+	f(`put foo 1 2 a=b host="say \"hi\" now" x=""`, []Tag{
+		{Key: "a", Value: "b"},
+		{Key: "host", Value: `say "hi" now`},
+	})
+	f(`put foo 1 2 path="c:\\dir"`, []Tag{{Key: "path", Value: `c:\dir`}})
+
+	// Quotes inside unquoted values are kept as is
+	f(`put foo 1 2 a=b"c`, []Tag{{Key: "a", Value: `b"c`}})
+
+	fail := func(s string) {
+		t.Helper()
+		var rows Rows
+		if err := rows.Unmarshal(s); err == nil {
+			t.Fatalf("expecting non-nil error when parsing %q", s)
+		}
+	}
+	fail(`put foo 1 2 host="my server`)
+	fail(`put foo 1 2 host="`)
+	fail(`put foo 1 2 host="a"b`)
+	fail(`put foo 1 2 host="a\"`)
+}
+
+func TestRowsUnmarshalQuotedTagValuesDisabled(t *testing.T) {
+	var rows Rows
+	if err := rows.Unmarshal(`put foo 1 2 host="my server"`); err == nil {
+		t.Fatalf("expecting non-nil error for quoted tag value when -opentsdb.allowQuotedTagValues isn't set")
+	}
+}
+
+func TestRowsUnmarshalTrimTags(t *testing.T) {
+	defer func(quoted, keys, values bool) {
+		*allowQuotedTagValues = quoted
+		*trimTagKeys = keys
+		*trimTagValues = values
+	}(*allowQuotedTagValues, *trimTagKeys, *trimTagValues)
+	*allowQuotedTagValues = true
+
+	f := func(s string, tagsExpected []Tag) {
+		t.Helper()
+		var rows Rows
+		if err := rows.Unmarshal(s); err != nil {
+			t.Fatalf("cannot unmarshal %q: %s", s, err)
+		}
+		if !reflect.DeepEqual(rows.Rows[0].Tags, tagsExpected) {
+			t.Fatalf("unexpected tags;\ngot\n%+v;\nwant\n%+v", rows.Rows[0].Tags, tagsExpected)
+		}
+	}
+	const s = "put foo 1 2 a=\" b \" c\t=d\t"
+
+	// Whitespace is kept by default
+	f(s, []Tag{{Key: "a", Value: " b "}, {Key: "c\t", Value: "d\t"}})
+
+	// Trim tag values
+	*trimTagValues = true
+	f(s, []Tag{{Key: "a", Value: "b"}, {Key: "c\t", Value: "d"}})
+
+	// Trim tag keys and values
+	*trimTagKeys = true
+	trimmedBefore := trimmedTags.Get()
+	f(s, []Tag{{Key: "a", Value: "b"}, {Key: "c", Value: "d"}})
+	if n := trimmedTags.Get() - trimmedBefore; n != 2 {
+		t.Fatalf("unexpected number of trimmed tags; got %d; want 2", n)
+	}
+}
+
+func TestRowsUnmarshalEmptyTags(t *testing.T) {
+	defer func(v string) {
+		*emptyTagValues = v
+	}(*emptyTagValues)
+
+	f := func(s string, tagsExpected []Tag) {
+		t.Helper()
+		var rows Rows
+		if err := rows.Unmarshal(s); err != nil {
+			t.Fatalf("cannot unmarshal %q: %s", s, err)
+		}
+		if !reflect.DeepEqual(rows.Rows[0].Tags, tagsExpected) {
+			t.Fatalf("unexpected tags;\ngot\n%+v;\nwant\n%+v", rows.Rows[0].Tags, tagsExpected)
+		}
+	}
+	fail := func(s string) {
+		t.Helper()
+		var rows Rows
+		if err := rows.Unmarshal(s); common.GetParseErrorCode(err) != common.ErrBadTag {
+			t.Fatalf("unexpected error when parsing %q; got %v; want %v", s, err, common.ErrBadTag)
+		}
+	}
+
+	// Empty tag keys are always rejected
+	fail("put foo 1 2 =c")
+
+	// Tags with empty values are dropped by default
+	droppedBefore := droppedEmptyTags.Get()
+	f("put foo 1 2 a= b=c", []Tag{{Key: "b", Value: "c"}})
+	f("put foo 1 2 b=c a=", []Tag{{Key: "b", Value: "c"}})
+	if n := droppedEmptyTags.Get() - droppedBefore; n != 2 {
+		t.Fatalf("unexpected number of dropped tags; got %d; want 2", n)
+	}
+	fail("put foo 1 2 =c")
+
+	// Rows without tags left are rejected unless -opentsdb.allowNoTags is set
+	var rows Rows
+	if err := rows.Unmarshal("put foo 1 2 a="); common.GetParseErrorCode(err) != common.ErrMissingTags {
+		t.Fatalf("unexpected error for row without tags left; got %v; want %v", err, common.ErrMissingTags)
+	}
+	defer func(v bool) {
+		*AllowNoTags = v
+	}(*AllowNoTags)
+	*AllowNoTags = true
+	f("put foo 1 2 a=", nil)
+	*AllowNoTags = false
+
+	// Reject rows with empty tag values
+	*emptyTagValues = "reject"
+	fail("put foo 1 2 a= b=c")
+	fail("put foo 1 2 b=c a=")
+}
+
+func TestRowsUnmarshalWhitespaceTagValues(t *testing.T) {
+	defer func(quoted bool, empty, whitespace string) {
+		*allowQuotedTagValues = quoted
+		*emptyTagValues = empty
+		*whitespaceTagValues = whitespace
+	}(*allowQuotedTagValues, *emptyTagValues, *whitespaceTagValues)
+	*allowQuotedTagValues = true
+
+	f := func(s string, tagsExpected []Tag) {
+		t.Helper()
+		var rows Rows
+		if err := rows.Unmarshal(s); err != nil {
+			t.Fatalf("cannot unmarshal %q: %s", s, err)
+		}
+		if !reflect.DeepEqual(rows.Rows[0].Tags, tagsExpected) {
+			t.Fatalf("unexpected tags;\ngot\n%+v;\nwant\n%+v", rows.Rows[0].Tags, tagsExpected)
+		}
+	}
+	fail := func(s string) {
+		t.Helper()
+		var rows Rows
+		if err := rows.Unmarshal(s); common.GetParseErrorCode(err) != common.ErrBadTag {
+			t.Fatalf("unexpected error when parsing %q; got %v; want %v", s, err, common.ErrBadTag)
+		}
+	}
+	const spaceOnly = `put foo 1 2 a=" " b=c`
+	const tabOnly = "put foo 1 2 a=\t b=c"
+
+	// Whitespace-only values are kept by default
+	f(spaceOnly, []Tag{{Key: "a", Value: " "}, {Key: "b", Value: "c"}})
+	f(tabOnly, []Tag{{Key: "a", Value: "\t"}, {Key: "b", Value: "c"}})
+
+	// Whitespace-only values are treated as empty values
+	*whitespaceTagValues = "empty"
+	f(`put foo 1 2 a=" x "`, []Tag{{Key: "a", Value: " x "}})
+
+	*emptyTagValues = "drop"
+	f(spaceOnly, []Tag{{Key: "b", Value: "c"}})
+	f(tabOnly, []Tag{{Key: "b", Value: "c"}})
+
+	*emptyTagValues = "reject"
+	fail(spaceOnly)
+	fail(tabOnly)
+
+	// Reject rows with whitespace-only values regardless of -opentsdb.emptyTagValues
+	*emptyTagValues = "drop"
+	*whitespaceTagValues = "reject"
+	fail(spaceOnly)
+	fail(tabOnly)
+	f(`put foo 1 2 a= b=c`, []Tag{{Key: "b", Value: "c"}})
+}
+
+func TestRowsUnmarshalValueNotations(t *testing.T) {
+	f := func(value string, valueExpected float64) {
+		t.Helper()
+		var rows Rows
+		s := "put foo 123 " + value + " a=b"
+		if err := rows.Unmarshal(s); err != nil {
+			t.Fatalf("cannot unmarshal %q: %s", s, err)
+		}
+		if len(rows.Rows) != 1 {
+			t.Fatalf("unexpected number of rows for %q; got %d; want 1", s, len(rows.Rows))
+		}
+		if v := rows.Rows[0].Value; v != valueExpected {
+			t.Fatalf("unexpected value for %q; got %v; want %v", value, v, valueExpected)
+		}
+	}
+	f("0", 0)
+	f("-0", 0)
+	f("0.0", 0)
+	f("0e10", 0)
+	f("42", 42)
+	f("-42", -42)
+	f("+42", 42)
+	f("4.5", 4.5)
+	f(".5", 0.5)
+	f("1.", 1)
+	f("-.5", -0.5)
+	f("1e3", 1e3)
+	f("1E3", 1e3)
+	f("1e+3", 1e3)
+	f("1E+3", 1e3)
+	f("1e-3", 1e-3)
+	f("1E-3", 1e-3)
+	f("1.2e+10", 1.2e10)
+	f("1.2E10", 1.2e10)
+	f("-1.2e-10", -1.2e-10)
+	f("+1.5e3", 1.5e3)
+	f(".5e3", 500)
+	f("12345678901234567890e2", 12345678901234567890e2)
+	f("1e-400", 0)
+}
+
+func TestRowsUnmarshalInvalidValue(t *testing.T) {
+	f := func(value string) {
+		t.Helper()
+		var rows Rows
+		s := "put foo 123 " + value + " a=b"
+		err := rows.Unmarshal(s)
+		if common.GetParseErrorCode(err) != common.ErrBadValue {
+			t.Fatalf("expecting ErrBadValue for %q; got %v", s, err)
+		}
+	}
+	f("invalid-value")
+	f("1e")
+	f("1e+")
+	f("1.2.3")
+	f("1e3e3")
+	f("--1")
+	f("1,5")
+}
+
+func TestRowsUnmarshalErrorLineNum(t *testing.T) {
+	f := func(s string, lineNumExpected string) {
+		t.Helper()
+		var rows Rows
+		err := rows.Unmarshal(s)
+		if err == nil {
+			t.Fatalf("expecting non-nil error when parsing %q", s)
+		}
+		if !strings.Contains(err.Error(), lineNumExpected) {
+			t.Fatalf("missing %q in the error for %q: %s", lineNumExpected, s, err)
+		}
+	}
+	f("put aaa", "line #1 ")
+	f("put aaa 123 4.5 a=b\nput bbb 123", "line #2 ")
+
+	// Empty lines are counted
+	f("put aaa 123 4.5 a=b\n\nput bbb 123 4.5\n", "line #3 ")
+}
@@ -22,3 +22,21 @@ cpu.usage_irq 1234556768 0.34432 a=b
 		}
 	})
 }
+
+func BenchmarkRowsUnmarshalManyTags(b *testing.B) {
+	s := `put cpu.usage_user 1234556768 1.23 a=b c=d e=f g=h i=j k=l m=n o=p
+put cpu.usage_system 1234556768 23.344 a=b c=d e=f g=h i=j k=l m=n o=p
+put cpu.usage_iowait 1234556769 3.3443 a=b c=d e=f g=h i=j k=l m=n o=p
+put cpu.usage_irq 1234556768 0.34432 a=b c=d e=f g=h i=j k=l m=n o=p
+`
+	b.SetBytes(int64(len(s)))
+	b.ReportAllocs()
+	b.RunParallel(func(pb *testing.PB) {
+		var rows Rows
+		for pb.Next() {
+			if err := rows.Unmarshal(s); err != nil {
+				panic(fmt.Errorf("cannot unmarshal %q: %s", s, err))
+			}
+		}
+	})
+}
@@ -17,45 +17,85 @@ import (
 var (
 	rowsInserted  = metrics.NewCounter(`vm_rows_inserted_total{type="opentsdb"}`)
 	rowsPerInsert = metrics.NewSummary(`vm_rows_per_insert{type="opentsdb"}`)
+	tagsPerRow    = metrics.NewSummary(`vm_tags_per_row{type="opentsdb"}`)
 )
 
 // insertHandler processes remote write for OpenTSDB put protocol.
 //
 // See http://opentsdb.net/docs/build/html/api_telnet/put.html
-func insertHandler(r io.Reader) error {
-	return concurrencylimiter.Do(func() error {
-		return insertHandlerInternal(r)
+func insertHandler(r io.Reader, lm *listenerMetrics) error {
+	return concurrencyLimiter.Do(func() error {
+		return insertHandlerInternal(r, lm)
 	})
 }
 
-func insertHandlerInternal(r io.Reader) error {
+func insertHandlerInternal(r io.Reader, lm *listenerMetrics) error {
 	ctx := getPushCtx()
 	defer putPushCtx(ctx)
+	ctx.Common.SetLabelOrder("opentsdb")
+	ctx.lm = lm
+	ctx.retryFailed = true
+	ctx.batchFlushes = true
 	for ctx.Read(r) {
 		if err := ctx.InsertRows(); err != nil {
 			return err
 		}
 	}
+	if err := ctx.flushDeferred(); err != nil {
+		return err
+	}
 	return ctx.Error()
 }
 
 func (ctx *pushCtx) InsertRows() error {
 	rows := ctx.Rows.Rows
 	ic := &ctx.Common
-	ic.Reset(len(rows))
+	ic.ResetBatch(len(rows))
 	for i := range rows {
 		r := &rows[i]
+		tagsPerRow.Update(float64(len(r.Tags)))
+		if IsDroppedZeroValue(r.Value) {
+			continue
+		}
 		ic.Labels = ic.Labels[:0]
 		ic.AddLabel("", r.Metric)
+		ok := true
 		for j := range r.Tags {
 			tag := &r.Tags[j]
-			ic.AddLabel(tag.Key, tag.Value)
+			var key string
+			if key, ok = RemapTagKey(tag.Key); !ok {
+				break
+			}
+			ic.AddLabel(key, tag.Value)
+		}
+		if !ok {
+			continue
 		}
 		ic.WriteDataPoint(nil, ic.Labels, r.Timestamp, r.Value)
 	}
-	rowsInserted.Add(len(rows))
+	ctx.getListenerMetrics().rowsInserted.Add(len(rows))
 	rowsPerInsert.Update(float64(len(rows)))
-	return ic.FlushBufs()
+	var err error
+	if ctx.batchFlushes {
+		err = ic.FlushBufsBatched()
+	} else {
+		err = ic.FlushBufs()
+	}
+	return ctx.handleFlushError(err)
+}
+
+// flushDeferred flushes rows deferred because of -insert.minFlushRows. It must be called when the request ends.
+func (ctx *pushCtx) flushDeferred() error {
+	return ctx.handleFlushError(ctx.Common.FlushDeferred())
+}
+
+func (ctx *pushCtx) handleFlushError(err error) error {
+	if err != nil && ctx.retryFailed && retryBuffer != nil {
+		// The client cannot be told to retry, so retain the rows for retrying them later. See -opentsdb.retryBufferRows.
+		ctx.Common.RetryLater(retryBuffer)
+		return nil
+	}
+	return err
 }
 
 const flushTimeout = 3 * time.Second
@@ -85,15 +125,22 @@ func (ctx *pushCtx) Read(r io.Reader) bool {
 			return false
 		}
 	}
+	return ctx.unmarshal()
+}
+
+// unmarshal unmarshals ctx.reqBuf into ctx.Rows.
+func (ctx *pushCtx) unmarshal() bool {
 	if err := ctx.Rows.Unmarshal(bytesutil.ToUnsafeString(ctx.reqBuf)); err != nil {
 		opentsdbUnmarshalErrors.Inc()
-		ctx.err = fmt.Errorf("cannot unmarshal OpenTSDB put protocol data with size %d: %s", len(ctx.reqBuf), err)
+		opentsdbParseErrorLogger.Log(err, ctx.reqBuf)
+		ctx.err = common.WrapParseError(err, "cannot unmarshal OpenTSDB put protocol data with size %d: %s", len(ctx.reqBuf), err)
 		return false
 	}
 
-	// Convert timestamps from seconds to milliseconds
+	// Convert timestamps from seconds to milliseconds and apply -opentsdb.timestampOffsetSeconds.
 	for i := range ctx.Rows.Rows {
-		ctx.Rows.Rows[i].Timestamp *= 1e3
+		r := &ctx.Rows.Rows[i]
+		r.Timestamp = ShiftTimestamp(r.Timestamp * 1e3)
 	}
 	return true
 }
@@ -102,12 +149,30 @@ type pushCtx struct {
 	Rows   Rows
 	Common common.InsertCtx
 
-	reqBuf  []byte
-	tailBuf []byte
+	reqBuf   []byte
+	tailBuf  []byte
+	frameBuf []byte
+	ackBuf   []byte
+
+	// lm contains metrics for the listener, which accepted the data. defaultListenerMetrics are used if it is nil.
+	lm *listenerMetrics
+
+	// retryFailed is set to true if rows, which couldn't be written to the storage, must be retained in retryBuffer.
+	retryFailed bool
+
+	// batchFlushes is set to true if rows from successive batches may be accumulated before flushing them. See -insert.minFlushRows.
+	batchFlushes bool
 
 	err error
 }
 
+func (ctx *pushCtx) getListenerMetrics() *listenerMetrics {
+	if ctx.lm == nil {
+		return defaultListenerMetrics
+	}
+	return ctx.lm
+}
+
 func (ctx *pushCtx) Error() error {
 	if ctx.err == io.EOF {
 		return nil
@@ -120,6 +185,11 @@ func (ctx *pushCtx) reset() {
 	ctx.Common.Reset(0)
 	ctx.reqBuf = ctx.reqBuf[:0]
 	ctx.tailBuf = ctx.tailBuf[:0]
+	ctx.frameBuf = ctx.frameBuf[:0]
+	ctx.ackBuf = ctx.ackBuf[:0]
+	ctx.lm = nil
+	ctx.retryFailed = false
+	ctx.batchFlushes = false
 
 	ctx.err = nil
 }
@@ -130,6 +200,12 @@ var (
 	opentsdbUnmarshalErrors = metrics.NewCounter(`vm_unmarshal_errors_total{name="opentsdb"}`)
 )
 
+var opentsdbParseErrorLogger = common.NewParseErrorLogger("opentsdb")
+
+var concurrencyLimiter = concurrencylimiter.NewLimiter("opentsdb")
+
+var tagsPoolStats = common.NewTagsPoolStats("opentsdb")
+
 func getPushCtx() *pushCtx {
 	select {
 	case ctx := <-pushCtxPoolCh:
@@ -0,0 +1,70 @@
+package opentsdb
+
+import (
+	"flag"
+	"strings"
+
+	"github.com/VictoriaMetrics/VictoriaMetrics/app/vminsert/common"
+	"github.com/VictoriaMetrics/metrics"
+)
+
+var reservedTagKeyPrefix = flag.String("opentsdb.reservedTagKeyPrefix", "exported_", "Prefix to add to OpenTSDB tag keys colliding with reserved label names such as `__name__` or `le`. "+
+	"Such tags could clobber the metric name otherwise. Rows with reserved tag keys are rejected if the prefix is empty. "+
+	"Applies to both telnet and HTTP OpenTSDB protocols")
+
+// RemapTagKey returns label name for the given OpenTSDB tag key.
+//
+// Reserved tag keys are prefixed with -opentsdb.reservedTagKeyPrefix.
+// false is returned if the row containing the tag key must be rejected.
+func RemapTagKey(key string) (string, bool) {
+	if !isReservedTagKey(key) {
+		return key, true
+	}
+	prefix := *reservedTagKeyPrefix
+	if len(prefix) == 0 {
+		reservedTagKeyRejectedRows.Inc()
+		return "", false
+	}
+	reservedTagKeysRenamed.Inc()
+	return prefix + key, true
+}
+
+func isReservedTagKey(key string) bool {
+	return strings.HasPrefix(key, "__") || key == "le"
+}
+
+var (
+	reservedTagKeysRenamed     = metrics.NewCounter(`vm_opentsdb_reserved_tag_keys_renamed_total`)
+	reservedTagKeyRejectedRows = metrics.NewCounter(`vm_opentsdb_reserved_tag_keys_rejected_rows_total`)
+)
+
+var reservedMetricPrefix = flag.String("opentsdb.reservedMetricPrefix", "", "Prefix to add to OpenTSDB metric names colliding with reserved names such as `__name__`. "+
+	"Such metric names shadow internal label semantics. Rows with reserved metric names are rejected if the prefix is empty. "+
+	"Applies to both telnet and HTTP OpenTSDB protocols")
+
+// CheckMetric returns the metric name for the given OpenTSDB metric.
+//
+// Reserved metric names such as `__name__` are prefixed with -opentsdb.reservedMetricPrefix.
+// An error is returned if the row with the metric must be rejected.
+func CheckMetric(metric string) (string, error) {
+	if !isReservedMetric(metric) {
+		return metric, nil
+	}
+	prefix := *reservedMetricPrefix
+	if len(prefix) == 0 {
+		reservedMetricRejectedRows.Inc()
+		return "", common.NewParseError(common.ErrBadMetric, "metric name %q is reserved; see -opentsdb.reservedMetricPrefix", metric)
+	}
+	reservedMetricsRenamed.Inc()
+	return prefix + metric, nil
+}
+
+// isReservedMetric returns true for metric names in the form `__*__` reserved for internal labels such as `__name__`.
+func isReservedMetric(metric string) bool {
+	return len(metric) >= 4 && strings.HasPrefix(metric, "__") && strings.HasSuffix(metric, "__")
+}
+
+var (
+	reservedMetricsRenamed     = metrics.NewCounter(`vm_opentsdb_reserved_metrics_renamed_total`)
+	reservedMetricRejectedRows = metrics.NewCounter(`vm_opentsdb_reserved_metrics_rejected_rows_total`)
+)
@@ -0,0 +1,68 @@
+package opentsdb
+
+import (
+	"testing"
+)
+
+func TestRemapTagKey(t *testing.T) {
+	defer func(v string) {
+		*reservedTagKeyPrefix = v
+	}(*reservedTagKeyPrefix)
+
+	f := func(prefix, key, keyExpected string, okExpected bool) {
+		t.Helper()
+		*reservedTagKeyPrefix = prefix
+		key, ok := RemapTagKey(key)
+		if ok != okExpected {
+			t.Fatalf("unexpected ok; got %v; want %v", ok, okExpected)
+		}
+		if key != keyExpected {
+			t.Fatalf("unexpected key; got %q; want %q", key, keyExpected)
+		}
+	}
+
+	// Regular keys
+	f("exported_", "host", "host", true)
+	f("exported_", "_foo", "_foo", true)
+	f("", "lee", "lee", true)
+
+	// Reserved keys with prefix
+	f("exported_", "__name__", "exported___name__", true)
+	f("exported_", "le", "exported_le", true)
+	f("x_", "__foo", "x___foo", true)
+
+	// Reserved keys without prefix
+	f("", "__name__", "", false)
+	f("", "le", "", false)
+}
+
+func TestCheckMetric(t *testing.T) {
+	defer func(v string) {
+		*reservedMetricPrefix = v
+	}(*reservedMetricPrefix)
+
+	f := func(prefix, metric, metricExpected string, errExpected bool) {
+		t.Helper()
+		*reservedMetricPrefix = prefix
+		metric, err := CheckMetric(metric)
+		if (err != nil) != errExpected {
+			t.Fatalf("unexpected error; got %v; want error: %v", err, errExpected)
+		}
+		if metric != metricExpected {
+			t.Fatalf("unexpected metric; got %q; want %q", metric, metricExpected)
+		}
+	}
+
+	// Regular metrics
+	f("", "cpu.usage", "cpu.usage", false)
+	f("", "__cpu", "__cpu", false)
+	f("", "cpu__", "cpu__", false)
+	f("", "__", "__", false)
+
+	// Reserved metrics are rejected by default
+	f("", "__name__", "", true)
+	f("", "__foo__", "", true)
+
+	// Reserved metrics with prefix
+	f("exported_", "__name__", "exported___name__", false)
+}
@@ -0,0 +1,32 @@
+package opentsdb
+
+import (
+	"flag"
+	"time"
+
+	"github.com/VictoriaMetrics/VictoriaMetrics/app/vminsert/common"
+)
+
+var (
+	retryBufferRows = flag.Int("opentsdb.retryBufferRows", 0, "The maximum number of rows from OpenTSDB put protocol to retain in memory after a failure to write them to the storage. "+
+		"Retained rows are retried every -opentsdb.retryInterval, since plaintext clients cannot be told to retry. The oldest rows are dropped when the buffer is full. "+
+		"Rows in ack mode aren't retained, since the client isn't acknowledged on failure. Zero disables the buffer")
+	retryInterval = flag.Duration("opentsdb.retryInterval", 5*time.Second, "The interval for retrying writes of rows retained because of -opentsdb.retryBufferRows")
+)
+
+// retryBuffer retains rows, which couldn't be written to the storage. It is nil if -opentsdb.retryBufferRows isn't set.
+var retryBuffer *common.RetryBuffer
+
+func startRetryBuffer() {
+	if *retryBufferRows <= 0 {
+		return
+	}
+	retryBuffer = common.NewRetryBuffer("opentsdb", *retryBufferRows, *retryInterval)
+}
+
+func stopRetryBuffer() {
+	if retryBuffer == nil {
+		return
+	}
+	retryBuffer.Stop()
+}
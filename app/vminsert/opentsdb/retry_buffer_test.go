@@ -0,0 +1,43 @@
+package opentsdb
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/VictoriaMetrics/VictoriaMetrics/app/vminsert/common"
+)
+
+func TestInsertRowsRetryBuffer(t *testing.T) {
+	var rc common.RowsCollector
+	common.SetSink(&rc)
+	defer common.SetSink(nil)
+	rc.Reset(fmt.Errorf("storage is unavailable"))
+
+	retryBuffer = common.NewRetryBuffer("opentsdb-test", 10, time.Hour)
+	defer func() {
+		retryBuffer.Stop()
+		retryBuffer = nil
+	}()
+
+	f := func(retryFailed, errExpected bool) {
+		t.Helper()
+		ctx := getPushCtx()
+		defer putPushCtx(ctx)
+		ctx.retryFailed = retryFailed
+		if err := ctx.Rows.Unmarshal("put foo 1 2 a=b\n"); err != nil {
+			t.Fatalf("cannot unmarshal rows: %s", err)
+		}
+		err := ctx.InsertRows()
+		if errExpected && err == nil {
+			t.Fatalf("expecting non-nil error")
+		}
+		if !errExpected && err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	}
+	// Failed rows are retained in the buffer.
+	f(true, false)
+	// Failed rows in ack mode are reported to the client.
+	f(false, true)
+}
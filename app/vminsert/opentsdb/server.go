@@ -1,18 +1,27 @@
 package opentsdb
 
 import (
+	"flag"
 	"net"
 	"runtime"
 	"strings"
 	"sync"
 	"time"
 
+	"github.com/VictoriaMetrics/VictoriaMetrics/app/vminsert/concurrencylimiter"
 	"github.com/VictoriaMetrics/VictoriaMetrics/lib/bytesutil"
 	"github.com/VictoriaMetrics/VictoriaMetrics/lib/logger"
 	"github.com/VictoriaMetrics/VictoriaMetrics/lib/netutil"
 	"github.com/VictoriaMetrics/metrics"
 )
 
+var maxConnections = flag.Int("opentsdb.maxConnections", 0, "The maximum number of concurrent TCP connections to -opentsdbListenAddr. "+
+	"Connections exceeding the limit are closed right after they are accepted. Every connection occupies a -maxConcurrentInserts slot "+
+	"or a slot for opentsdb protocol from -maxConcurrentInsertsPerProtocol while it is served, so keep the limit below the number of slots "+
+	"in order to reject excess connections immediately instead of making them wait for free slots. Zero means no limit")
+
+var connLimiter = concurrencylimiter.NewConnLimiter("opentsdb", maxConnections)
+
 var (
 	writeRequestsTCP = metrics.NewCounter(`vm_opentsdb_requests_total{name="write", net="tcp"}`)
 	writeErrorsTCP   = metrics.NewCounter(`vm_opentsdb_request_errors_total{name="write", net="tcp"}`)
@@ -21,39 +30,77 @@ var (
 	writeErrorsUDP   = metrics.NewCounter(`vm_opentsdb_request_errors_total{name="write", net="udp"}`)
 )
 
-// Serve starts OpenTSDB collector on the given addr.
-func Serve(addr string) {
+// Serve starts OpenTSDB collectors on the given comma-separated addrs.
+//
+// Every address may be prefixed with `name=`. The name is added as `listener` label to per-listener metrics.
+func Serve(addrs string) {
+	las, err := parseListenAddrs(addrs)
+	if err != nil {
+		logger.Fatalf("cannot parse -opentsdbListenAddr=%q: %s", addrs, err)
+	}
+	startRetryBuffer()
+	var wg sync.WaitGroup
+	for _, la := range las {
+		ln := startListener(la)
+		listeners = append(listeners, ln)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ln.serve()
+		}()
+	}
+	wg.Wait()
+}
+
+// listener serves OpenTSDB put protocol over TCP and UDP at a single address.
+type listener struct {
+	addr string
+
+	lnTCP net.Listener
+	lnUDP net.PacketConn
+
+	lm *listenerMetrics
+}
+
+func startListener(la listenAddr) *listener {
+	addr := la.addr
 	logger.Infof("starting TCP OpenTSDB collector at %q", addr)
 	lnTCP, err := netutil.NewTCPListener("opentsdb", addr)
 	if err != nil {
 		logger.Fatalf("cannot start TCP OpenTSDB collector at %q: %s", addr, err)
 	}
-	listenerTCP = lnTCP
 
 	logger.Infof("starting UDP OpenTSDB collector at %q", addr)
 	lnUDP, err := net.ListenPacket("udp4", addr)
 	if err != nil {
 		logger.Fatalf("cannot start UDP OpenTSDB collector at %q: %s", addr, err)
 	}
-	listenerUDP = lnUDP
+	return &listener{
+		addr:  addr,
+		lnTCP: lnTCP,
+		lnUDP: lnUDP,
+		lm:    getListenerMetrics(la.name),
+	}
+}
 
+func (ln *listener) serve() {
 	var wg sync.WaitGroup
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
-		serveTCP(listenerTCP)
-		logger.Infof("stopped TCP OpenTSDB collector at %q", addr)
+		serveTCP(ln.lnTCP, ln.lm)
+		logger.Infof("stopped TCP OpenTSDB collector at %q", ln.addr)
 	}()
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
-		serveUDP(listenerUDP)
-		logger.Infof("stopped UDP OpenTSDB collector at %q", addr)
+		serveUDP(ln.lnUDP, ln.lm)
+		logger.Infof("stopped UDP OpenTSDB collector at %q", ln.addr)
 	}()
 	wg.Wait()
 }
 
-func serveTCP(ln net.Listener) {
+func serveTCP(ln net.Listener, lm *listenerMetrics) {
 	for {
 		c, err := ln.Accept()
 		if err != nil {
@@ -69,18 +116,39 @@ func serveTCP(ln net.Listener) {
 			}
 			logger.Fatalf("unexpected error when accepting TCP OpenTSDB connections: %s", err)
 		}
+		if !connLimiter.Acquire() {
+			// Do not log rejected connections, since this may flood the log when many clients reconnect.
+			_ = c.Close()
+			continue
+		}
 		go func() {
-			writeRequestsTCP.Inc()
-			if err := insertHandler(c); err != nil {
-				writeErrorsTCP.Inc()
+			lm.writeRequestsTCP.Inc()
+			if err := serveConn(c, lm); err != nil {
+				lm.writeErrorsTCP.Inc()
 				logger.Errorf("error in TCP OpenTSDB conn %q<->%q: %s", c.LocalAddr(), c.RemoteAddr(), err)
 			}
 			_ = c.Close()
+			connLimiter.Release()
 		}()
 	}
 }
 
-func serveUDP(ln net.PacketConn) {
+func serveConn(c net.Conn, lm *listenerMetrics) error {
+	r, handshake, err := newConnReader(c)
+	if err != nil {
+		return err
+	}
+	switch handshake {
+	case framedModeHandshake:
+		return insertFramedHandler(r, lm)
+	case ackModeHandshake:
+		return insertAckHandler(r, lm)
+	default:
+		return insertHandler(r, lm)
+	}
+}
+
+func serveUDP(ln net.PacketConn, lm *listenerMetrics) {
 	gomaxprocs := runtime.GOMAXPROCS(-1)
 	var wg sync.WaitGroup
 	for i := 0; i < gomaxprocs; i++ {
@@ -94,7 +162,7 @@ func serveUDP(ln net.PacketConn) {
 				bb.B = bb.B[:cap(bb.B)]
 				n, addr, err := ln.ReadFrom(bb.B)
 				if err != nil {
-					writeErrorsUDP.Inc()
+					lm.writeErrorsUDP.Inc()
 					if ne, ok := err.(net.Error); ok {
 						if ne.Temporary() {
 							time.Sleep(time.Second)
@@ -108,9 +176,9 @@ func serveUDP(ln net.PacketConn) {
 					continue
 				}
 				bb.B = bb.B[:n]
-				writeRequestsUDP.Inc()
-				if err := insertHandler(bb.NewReader()); err != nil {
-					writeErrorsUDP.Inc()
+				lm.writeRequestsUDP.Inc()
+				if err := insertHandler(bb.NewReader(), lm); err != nil {
+					lm.writeErrorsUDP.Inc()
 					logger.Errorf("error in UDP OpenTSDB conn %q<->%q: %s", ln.LocalAddr(), addr, err)
 					continue
 				}
@@ -120,19 +188,19 @@ func serveUDP(ln net.PacketConn) {
 	wg.Wait()
 }
 
-var (
-	listenerTCP net.Listener
-	listenerUDP net.PacketConn
-)
+var listeners []*listener
 
 // Stop stops the server.
 func Stop() {
-	logger.Infof("stopping TCP OpenTSDB server at %q...", listenerTCP.Addr())
-	if err := listenerTCP.Close(); err != nil {
-		logger.Errorf("cannot close TCP OpenTSDB server: %s", err)
-	}
-	logger.Infof("stopping UDP OpenTSDB server at %q...", listenerUDP.LocalAddr())
-	if err := listenerUDP.Close(); err != nil {
-		logger.Errorf("cannot close UDP OpenTSDB server: %s", err)
+	for _, ln := range listeners {
+		logger.Infof("stopping TCP OpenTSDB server at %q...", ln.lnTCP.Addr())
+		if err := ln.lnTCP.Close(); err != nil {
+			logger.Errorf("cannot close TCP OpenTSDB server: %s", err)
+		}
+		logger.Infof("stopping UDP OpenTSDB server at %q...", ln.lnUDP.LocalAddr())
+		if err := ln.lnUDP.Close(); err != nil {
+			logger.Errorf("cannot close UDP OpenTSDB server: %s", err)
+		}
 	}
+	stopRetryBuffer()
 }
@@ -0,0 +1,58 @@
+// +build tagscheck
+
+package opentsdb
+
+import (
+	"testing"
+)
+
+func TestCheckTagsAliasing(t *testing.T) {
+	f := func(rows []Row, errExpected bool) {
+		t.Helper()
+		err := checkTagsAliasing(rows)
+		if errExpected && err == nil {
+			t.Fatalf("expecting non-nil error")
+		}
+		if !errExpected && err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	}
+
+	tagsPool := []Tag{{Key: "a", Value: "b"}, {Key: "c", Value: "d"}, {Key: "e", Value: "f"}}
+
+	// Rows without tags
+	f(nil, false)
+	f([]Row{{Metric: "foo"}, {Metric: "bar"}}, false)
+
+	// Distinct tags
+	f([]Row{
+		{Tags: tagsPool[0:1:1]},
+		{Tags: tagsPool[1:3:3]},
+	}, false)
+
+	// Uncapped tags
+	f([]Row{
+		{Tags: tagsPool[0:1]},
+		{Tags: tagsPool[1:3:3]},
+	}, true)
+
+	// Overlapping tags
+	f([]Row{
+		{Tags: tagsPool[1:3:3]},
+		{Tags: tagsPool[0:2:2]},
+	}, true)
+	f([]Row{
+		{Tags: tagsPool[0:1:1]},
+		{Tags: tagsPool[0:1:1]},
+	}, true)
+}
+
+func TestRowsUnmarshalNoTagsAliasing(t *testing.T) {
+	var rows Rows
+	s := "put foo 1 2 a=b c=d\nput bar 1 2 e=f\nput baz 1 2 g=h i=j k=l\n"
+	for i := 0; i < 3; i++ {
+		if err := rows.Unmarshal(s); err != nil {
+			t.Fatalf("cannot unmarshal %q: %s", s, err)
+		}
+	}
+}
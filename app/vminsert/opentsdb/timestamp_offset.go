@@ -0,0 +1,16 @@
+package opentsdb
+
+import (
+	"flag"
+)
+
+var timestampOffsetSeconds = flag.Int64("opentsdb.timestampOffsetSeconds", 0, "The offset in seconds to add to timestamps of OpenTSDB rows. "+
+	"This allows ingesting data from legacy systems, which send timestamps relative to non-Unix epoch. "+
+	"Applies to both telnet and HTTP OpenTSDB protocols")
+
+// ShiftTimestamp adds -opentsdb.timestampOffsetSeconds to the given timestamp in milliseconds.
+//
+// The timestamp must be already converted to milliseconds.
+func ShiftTimestamp(timestamp int64) int64 {
+	return timestamp + *timestampOffsetSeconds*1e3
+}
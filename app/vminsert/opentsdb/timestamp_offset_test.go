@@ -0,0 +1,37 @@
+package opentsdb
+
+import (
+	"testing"
+)
+
+func TestPushCtxUnmarshalTimestampOffset(t *testing.T) {
+	defer func(v int64) {
+		*timestampOffsetSeconds = v
+	}(*timestampOffsetSeconds)
+
+	f := func(offset int64, s string, timestampExpected int64) {
+		t.Helper()
+		*timestampOffsetSeconds = offset
+		ctx := getPushCtx()
+		defer putPushCtx(ctx)
+		ctx.reqBuf = append(ctx.reqBuf[:0], s...)
+		if !ctx.unmarshal() {
+			t.Fatalf("cannot unmarshal %q: %s", s, ctx.Error())
+		}
+		if len(ctx.Rows.Rows) != 1 {
+			t.Fatalf("unexpected number of rows; got %d; want 1", len(ctx.Rows.Rows))
+		}
+		if ts := ctx.Rows.Rows[0].Timestamp; ts != timestampExpected {
+			t.Fatalf("unexpected timestamp for offset %d; got %d; want %d", offset, ts, timestampExpected)
+		}
+	}
+
+	const s = "put foo 1000 1 bar=baz"
+
+	// No offset by default
+	f(0, s, 1000000)
+
+	// Timestamps are shifted after the conversion to milliseconds
+	f(946684800, s, 946685800000)
+	f(-500, s, 500000)
+}
@@ -0,0 +1,23 @@
+package opentsdb
+
+import (
+	"flag"
+
+	"github.com/VictoriaMetrics/metrics"
+)
+
+var dropZeroValues = flag.Bool("opentsdb.dropZeroValues", false, "Whether to drop OpenTSDB rows with values equal to 0. "+
+	"This may be useful for clients sending 0 for absent readings. Applies to both telnet and HTTP OpenTSDB protocols. "+
+	"See also vm_dropped_zero_value_rows_total metric")
+
+// IsDroppedZeroValue returns true if the row with the given value must be dropped
+// according to -opentsdb.dropZeroValues.
+func IsDroppedZeroValue(v float64) bool {
+	if !*dropZeroValues || v != 0 {
+		return false
+	}
+	droppedZeroValueRows.Inc()
+	return true
+}
+
+var droppedZeroValueRows = metrics.NewCounter(`vm_dropped_zero_value_rows_total`)
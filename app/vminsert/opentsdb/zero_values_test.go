@@ -0,0 +1,31 @@
+package opentsdb
+
+import (
+	"math"
+	"testing"
+)
+
+func TestIsDroppedZeroValue(t *testing.T) {
+	defer func(v bool) {
+		*dropZeroValues = v
+	}(*dropZeroValues)
+
+	f := func(drop bool, v float64, resultExpected bool) {
+		t.Helper()
+		*dropZeroValues = drop
+		result := IsDroppedZeroValue(v)
+		if result != resultExpected {
+			t.Fatalf("unexpected result for %v with -opentsdb.dropZeroValues=%v; got %v; want %v", v, drop, result, resultExpected)
+		}
+	}
+
+	// Zero values are kept by default
+	f(false, 0, false)
+	f(false, 1, false)
+
+	f(true, 0, true)
+	f(true, math.Copysign(0, -1), true)
+	f(true, 1e-10, false)
+	f(true, -1, false)
+	f(true, math.NaN(), false)
+}
@@ -0,0 +1,247 @@
+package otlp
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/VictoriaMetrics/VictoriaMetrics/app/vminsert/common"
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/bytesutil"
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/logger"
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/netutil"
+	"github.com/VictoriaMetrics/metrics"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+var (
+	grpcTLSCertFile = flag.String("otlp.grpcTLSCertFile", "", "Path to file with TLS certificate for -otlp.grpcListenAddr. "+
+		"If empty, then OTLP gRPC is served over plaintext HTTP/2 (h2c), which is the default for OTLP gRPC exporters. See also -otlp.grpcTLSKeyFile")
+	grpcTLSKeyFile = flag.String("otlp.grpcTLSKeyFile", "", "Path to file with TLS key for -otlp.grpcListenAddr. Must be set together with -otlp.grpcTLSCertFile")
+)
+
+// exportPath is the path for OTLP metrics service Export method.
+//
+// See https://github.com/open-telemetry/opentelemetry-proto/blob/main/opentelemetry/proto/collector/metrics/v1/metrics_service.proto
+const exportPath = "/opentelemetry.proto.collector.metrics.v1.MetricsService/Export"
+
+// gRPC status codes.
+//
+// See https://github.com/grpc/grpc/blob/master/doc/statuscodes.md
+const (
+	grpcStatusOK              = 0
+	grpcStatusInvalidArgument = 3
+	grpcStatusUnimplemented   = 12
+	grpcStatusUnavailable     = 14
+)
+
+// ServeGRPC starts OTLP gRPC server for metrics service on the given addr.
+//
+// The server uses TLS if -otlp.grpcTLSCertFile and -otlp.grpcTLSKeyFile are set. Otherwise plaintext HTTP/2 (h2c) is served.
+//
+// maxSize is the maximum size of a single Export message.
+func ServeGRPC(addr string, maxSize int64) {
+	useTLS := len(*grpcTLSCertFile) > 0 || len(*grpcTLSKeyFile) > 0
+	if useTLS && (len(*grpcTLSCertFile) == 0 || len(*grpcTLSKeyFile) == 0) {
+		logger.Fatalf("-otlp.grpcTLSCertFile and -otlp.grpcTLSKeyFile must be set together for -otlp.grpcListenAddr=%q", addr)
+	}
+	scheme := "h2c"
+	if useTLS {
+		scheme = "TLS"
+	}
+	logger.Infof("starting OTLP gRPC server over %s at %q", scheme, addr)
+	ln, err := netutil.NewTCPListener("otlp-grpc", addr)
+	if err != nil {
+		logger.Fatalf("cannot start OTLP gRPC server at %q: %s", addr, err)
+	}
+	var h http.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		grpcHandler(w, r, maxSize)
+	})
+	if !useTLS {
+		h = h2c.NewHandler(h, &http2.Server{})
+	}
+	s := &http.Server{
+		Handler:  h,
+		ErrorLog: logger.StdErrorLogger(),
+	}
+	grpcServerLock.Lock()
+	grpcServer = s
+	grpcServerLock.Unlock()
+	if useTLS {
+		err = s.ServeTLS(ln, *grpcTLSCertFile, *grpcTLSKeyFile)
+	} else {
+		err = s.Serve(ln)
+	}
+	if err != nil {
+		if err == http.ErrServerClosed {
+			logger.Infof("stopped OTLP gRPC server at %q", addr)
+			return
+		}
+		logger.Fatalf("cannot serve OTLP gRPC at %q: %s", addr, err)
+	}
+}
+
+var (
+	grpcServerLock sync.Mutex
+	grpcServer     *http.Server
+)
+
+// StopGRPC stops OTLP gRPC server.
+func StopGRPC() {
+	grpcServerLock.Lock()
+	s := grpcServer
+	grpcServer = nil
+	grpcServerLock.Unlock()
+	if s == nil {
+		// The server isn't started yet.
+		return
+	}
+	logger.Infof("stopping OTLP gRPC server...")
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != nil {
+		logger.Errorf("cannot stop OTLP gRPC server: %s", err)
+	}
+}
+
+func grpcHandler(w http.ResponseWriter, r *http.Request, maxSize int64) {
+	grpcRequests.Inc()
+	if r.URL.Path != exportPath {
+		grpcErrors.Inc()
+		writeGRPCStatus(w, grpcStatusUnimplemented, fmt.Sprintf("unsupported method %q", r.URL.Path))
+		return
+	}
+	encoding := r.Header.Get("Grpc-Encoding")
+	rejectedDataPoints := 0
+	err := concurrencyLimiter.Do(func() error {
+		ctx := getPushCtx()
+		defer putPushCtx(ctx)
+		ctx.Common.SetLabelOrder("otlp")
+		ctx.Common.SetContext(r.Context())
+		if err := ctx.readGRPCMessage(r.Body, encoding, maxSize); err != nil {
+			return &grpcError{code: grpcStatusInvalidArgument, err: err}
+		}
+		if err := ctx.unmarshalProtobuf(); err != nil {
+			return &grpcError{code: grpcStatusInvalidArgument, err: err}
+		}
+		rejectedDataPoints = ctx.Rows.rejectedDataPoints
+		return ctx.InsertRows()
+	})
+	if err != nil {
+		grpcErrors.Inc()
+		code := grpcStatusUnavailable
+		if ge, ok := err.(*grpcError); ok {
+			code = ge.code
+		}
+		logger.Errorf("error in OTLP gRPC request from %q: %s", r.RemoteAddr, err)
+		writeGRPCStatus(w, code, err.Error())
+		return
+	}
+	writeGRPCResponse(w, rejectedDataPoints)
+}
+
+type grpcError struct {
+	code int
+	err  error
+}
+
+func (ge *grpcError) Error() string {
+	return ge.err.Error()
+}
+
+// readGRPCMessage reads a single length-prefixed gRPC message from r into ctx.reqBuf.
+//
+// See https://github.com/grpc/grpc/blob/master/doc/PROTOCOL-HTTP2.md
+func (ctx *pushCtx) readGRPCMessage(r io.Reader, encoding string, maxSize int64) error {
+	otlpReadCalls.Inc()
+	var prefix [5]byte
+	if _, err := io.ReadFull(r, prefix[:]); err != nil {
+		otlpReadErrors.Inc()
+		return fmt.Errorf("cannot read gRPC message prefix: %s", err)
+	}
+	compressed := prefix[0] == 1
+	size := binary.BigEndian.Uint32(prefix[1:])
+	if int64(size) > maxSize {
+		otlpReadErrors.Inc()
+		return fmt.Errorf("too big gRPC message: %d bytes; mustn't exceed %d bytes", size, maxSize)
+	}
+	ctx.reqBuf.B = bytesutil.Resize(ctx.reqBuf.B, int(size))
+	if _, err := io.ReadFull(r, ctx.reqBuf.B); err != nil {
+		otlpReadErrors.Inc()
+		return fmt.Errorf("cannot read gRPC message with size %d bytes: %s", size, err)
+	}
+	if !compressed {
+		return nil
+	}
+	if encoding != "gzip" {
+		otlpReadErrors.Inc()
+		return fmt.Errorf("unsupported gRPC message encoding %q; only gzip is supported", encoding)
+	}
+	zr, err := common.GetGzipReader(bytes.NewReader(ctx.reqBuf.B))
+	if err != nil {
+		otlpReadErrors.Inc()
+		return fmt.Errorf("cannot read gzipped gRPC message: %s", err)
+	}
+	defer common.PutGzipReader(zr)
+	ctx.tmpBuf.Reset()
+	n, err := ctx.tmpBuf.ReadFrom(io.LimitReader(zr, maxSize+1))
+	if err != nil {
+		otlpReadErrors.Inc()
+		return fmt.Errorf("cannot decompress gRPC message: %s", err)
+	}
+	if n > maxSize {
+		otlpReadErrors.Inc()
+		return fmt.Errorf("too big decompressed gRPC message; mustn't exceed %d bytes", maxSize)
+	}
+	ctx.reqBuf, ctx.tmpBuf = ctx.tmpBuf, ctx.reqBuf
+	return nil
+}
+
+func writeGRPCResponse(w http.ResponseWriter, rejectedDataPoints int) {
+	h := w.Header()
+	h.Set("Content-Type", "application/grpc+proto")
+	w.WriteHeader(http.StatusOK)
+	// Empty ExportMetricsServiceResponse message means full success.
+	msg := marshalExportResponse(nil, rejectedDataPoints)
+	var prefix [5]byte
+	binary.BigEndian.PutUint32(prefix[1:], uint32(len(msg)))
+	_, _ = w.Write(prefix[:])
+	_, _ = w.Write(msg)
+	h.Set(http.TrailerPrefix+"Grpc-Status", strconv.Itoa(grpcStatusOK))
+}
+
+// writeGRPCStatus writes Trailers-Only gRPC response with the given status code and message.
+func writeGRPCStatus(w http.ResponseWriter, code int, msg string) {
+	h := w.Header()
+	h.Set("Content-Type", "application/grpc+proto")
+	h.Set("Grpc-Status", strconv.Itoa(code))
+	h.Set("Grpc-Message", percentEncode(msg))
+	w.WriteHeader(http.StatusOK)
+}
+
+// percentEncode encodes s for Grpc-Message header.
+func percentEncode(s string) string {
+	const hex = "0123456789ABCDEF"
+	var b []byte
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c >= ' ' && c <= '~' && c != '%' {
+			b = append(b, c)
+			continue
+		}
+		b = append(b, '%', hex[c>>4], hex[c&0xf])
+	}
+	return string(b)
+}
+
+var (
+	grpcRequests = metrics.NewCounter(`vm_otlp_grpc_requests_total`)
+	grpcErrors   = metrics.NewCounter(`vm_otlp_grpc_request_errors_total`)
+)
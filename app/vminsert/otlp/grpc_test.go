@@ -0,0 +1,194 @@
+package otlp
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/tls"
+	"encoding/binary"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/VictoriaMetrics/VictoriaMetrics/app/vminsert/concurrencylimiter"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+func TestReadGRPCMessageSuccess(t *testing.T) {
+	f := func(data []byte, encoding string, msgExpected []byte) {
+		t.Helper()
+		ctx := getPushCtx()
+		defer putPushCtx(ctx)
+		if err := ctx.readGRPCMessage(bytes.NewReader(data), encoding, 1024); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if !bytes.Equal(ctx.reqBuf.B, msgExpected) {
+			t.Fatalf("unexpected message; got %X; want %X", ctx.reqBuf.B, msgExpected)
+		}
+	}
+	msg := []byte("foobar")
+	f(marshalGRPCMessage(false, nil), "", nil)
+	f(marshalGRPCMessage(false, msg), "", msg)
+	f(marshalGRPCMessage(false, msg), "gzip", msg)
+	f(marshalGRPCMessage(true, compressGzip(t, msg)), "gzip", msg)
+}
+
+func TestReadGRPCMessageFailure(t *testing.T) {
+	f := func(data []byte, encoding string) {
+		t.Helper()
+		ctx := getPushCtx()
+		defer putPushCtx(ctx)
+		if err := ctx.readGRPCMessage(bytes.NewReader(data), encoding, 1024); err == nil {
+			t.Fatalf("expecting non-nil error")
+		}
+	}
+
+	// Truncated prefix
+	f([]byte{0, 0, 0}, "")
+
+	// Truncated message
+	f(marshalGRPCMessage(false, []byte("foobar"))[:8], "")
+
+	// Too big message
+	f(marshalGRPCMessage(false, make([]byte, 1025)), "")
+
+	// Too big decompressed message
+	f(marshalGRPCMessage(true, compressGzip(t, make([]byte, 1025))), "gzip")
+
+	// Unsupported encoding
+	f(marshalGRPCMessage(true, []byte("foobar")), "snappy")
+
+	// Invalid gzip data
+	f(marshalGRPCMessage(true, []byte("foobar")), "gzip")
+}
+
+func TestGRPCHandlerHTTP2(t *testing.T) {
+	concurrencylimiter.Init()
+	s := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		grpcHandler(w, r, 1024)
+	}))
+	s.EnableHTTP2 = true
+	s.StartTLS()
+	defer s.Close()
+	testGRPCHandler(t, s.URL, s.Client())
+}
+
+func TestGRPCHandlerH2C(t *testing.T) {
+	concurrencylimiter.Init()
+	s := httptest.NewServer(h2c.NewHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		grpcHandler(w, r, 1024)
+	}), &http2.Server{}))
+	defer s.Close()
+	c := &http.Client{
+		Transport: &http2.Transport{
+			AllowHTTP: true,
+			DialTLS: func(network, addr string, _ *tls.Config) (net.Conn, error) {
+				return net.Dial(network, addr)
+			},
+		},
+	}
+	testGRPCHandler(t, s.URL, c)
+}
+
+func testGRPCHandler(t *testing.T, url string, c *http.Client) {
+	t.Helper()
+	f := func(path string, body []byte, statusExpected string) {
+		t.Helper()
+		req, err := http.NewRequest("POST", url+path, bytes.NewReader(body))
+		if err != nil {
+			t.Fatalf("cannot create request: %s", err)
+		}
+		req.Header.Set("Content-Type", "application/grpc")
+		resp, err := c.Do(req)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		_, _ = ioutil.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+		if resp.ProtoMajor != 2 {
+			t.Fatalf("unexpected protocol; got %s; want HTTP/2", resp.Proto)
+		}
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("unexpected status code; got %d; want %d", resp.StatusCode, http.StatusOK)
+		}
+		status := resp.Header.Get("Grpc-Status")
+		if status == "" {
+			status = resp.Trailer.Get("Grpc-Status")
+		}
+		if status != statusExpected {
+			t.Fatalf("unexpected grpc-status; got %q; want %q", status, statusExpected)
+		}
+	}
+
+	// Unknown method
+	f("/foo.Bar/Baz", nil, "12")
+
+	// Invalid message
+	f(exportPath, marshalGRPCMessage(false, []byte{0xff}), "3")
+	f(exportPath, []byte{0}, "3")
+}
+
+func TestWriteGRPCResponse(t *testing.T) {
+	f := func(rejectedDataPoints int, bodyExpected []byte) {
+		t.Helper()
+		w := httptest.NewRecorder()
+		writeGRPCResponse(w, rejectedDataPoints)
+		resp := w.Result()
+		if ct := resp.Header.Get("Content-Type"); ct != "application/grpc+proto" {
+			t.Fatalf("unexpected Content-Type; got %q", ct)
+		}
+		if !bytes.Equal(w.Body.Bytes(), bodyExpected) {
+			t.Fatalf("unexpected body; got %X; want %X", w.Body.Bytes(), bodyExpected)
+		}
+		if status := resp.Trailer.Get("Grpc-Status"); status != "0" {
+			t.Fatalf("unexpected grpc-status trailer; got %q; want %q", status, "0")
+		}
+	}
+
+	// Full success
+	f(0, []byte{0, 0, 0, 0, 0})
+
+	// Partial success
+	ps := appendVarintField(nil, 1, 3)
+	ps = appendStringField(ps, 2, rejectedDataPointsMessage)
+	f(3, marshalGRPCMessage(false, appendBytesField(nil, 1, ps)))
+}
+
+func TestPercentEncode(t *testing.T) {
+	f := func(s, resultExpected string) {
+		t.Helper()
+		result := percentEncode(s)
+		if result != resultExpected {
+			t.Fatalf("unexpected result for %q; got %q; want %q", s, result, resultExpected)
+		}
+	}
+	f("", "")
+	f("foo bar", "foo bar")
+	f("100%", "100%25")
+	f("a\nb", "a%0Ab")
+	f("привет", "%D0%BF%D1%80%D0%B8%D0%B2%D0%B5%D1%82")
+}
+
+func marshalGRPCMessage(compressed bool, msg []byte) []byte {
+	var prefix [5]byte
+	if compressed {
+		prefix[0] = 1
+	}
+	binary.BigEndian.PutUint32(prefix[1:], uint32(len(msg)))
+	return append(prefix[:], msg...)
+}
+
+func compressGzip(t *testing.T, data []byte) []byte {
+	t.Helper()
+	var bb bytes.Buffer
+	zw := gzip.NewWriter(&bb)
+	if _, err := zw.Write(data); err != nil {
+		t.Fatalf("cannot compress data: %s", err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatalf("cannot close gzip writer: %s", err)
+	}
+	return bb.Bytes()
+}
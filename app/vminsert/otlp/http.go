@@ -0,0 +1,105 @@
+package otlp
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/VictoriaMetrics/VictoriaMetrics/app/vminsert/common"
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/httpserver"
+	"github.com/VictoriaMetrics/metrics"
+)
+
+var (
+	gzipRequests     = metrics.NewCounter(`vm_insert_requests_total{protocol="otlp", encoding="gzip"}`)
+	identityRequests = metrics.NewCounter(`vm_insert_requests_total{protocol="otlp", encoding="identity"}`)
+)
+
+// InsertHandler processes OTLP/HTTP metrics export requests at /v1/metrics.
+//
+// Both binary protobuf and JSON encodings are accepted depending on Content-Type.
+//
+// See https://github.com/open-telemetry/opentelemetry-proto/blob/main/docs/specification.md#otlphttp
+func InsertHandler(w http.ResponseWriter, req *http.Request, maxSize int64) error {
+	isJSON, err := isJSONContentType(req.Header.Get("Content-Type"))
+	if err != nil {
+		return err
+	}
+	rejectedDataPoints := 0
+	err = concurrencyLimiter.Do(func() error {
+		var err error
+		rejectedDataPoints, err = insertHandlerInternal(req, maxSize, isJSON)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	writeHTTPResponse(w, isJSON, rejectedDataPoints)
+	return nil
+}
+
+func insertHandlerInternal(req *http.Request, maxSize int64, isJSON bool) (int, error) {
+	dr := bodyDumper.NewReader(req, req.Body)
+	defer dr.Finish()
+	r := common.NewReadTimeoutReader(dr)
+	cd, err := common.GetContentDecoder(r, req)
+	if err != nil {
+		return 0, fmt.Errorf("cannot read encoded OTLP request: %s", err)
+	}
+	defer common.PutContentDecoder(cd)
+	if cd.IsEncoded() {
+		gzipRequests.Inc()
+	} else {
+		identityRequests.Inc()
+	}
+	r = cd
+
+	ctx := getPushCtx()
+	defer putPushCtx(ctx)
+	ctx.Common.SetLabelOrder("otlp")
+	ctx.Common.SetExtraLabels(common.GetExtraLabels(req))
+	ctx.Common.SetContext(req.Context())
+	if err := ctx.read(r, maxSize); err != nil {
+		return 0, err
+	}
+	if isJSON {
+		err = ctx.unmarshalJSON()
+	} else {
+		err = ctx.unmarshalProtobuf()
+	}
+	if err != nil {
+		return 0, err
+	}
+	return ctx.Rows.rejectedDataPoints, ctx.InsertRows()
+}
+
+// isJSONContentType returns true if contentType is for JSON-encoded request
+// and false if it is for protobuf-encoded request.
+func isJSONContentType(contentType string) (bool, error) {
+	mediaType := contentType
+	if n := strings.IndexByte(mediaType, ';'); n >= 0 {
+		mediaType = mediaType[:n]
+	}
+	switch strings.TrimSpace(mediaType) {
+	case "application/x-protobuf", "application/protobuf":
+		return false, nil
+	case "application/json":
+		return true, nil
+	default:
+		return false, fmt.Errorf("unsupported Content-Type %q; supported values: application/x-protobuf, application/json", contentType)
+	}
+}
+
+// writeHTTPResponse writes ExportMetricsServiceResponse to w in the encoding of the request.
+func writeHTTPResponse(w http.ResponseWriter, isJSON bool, rejectedDataPoints int) {
+	if isJSON {
+		data := []byte(`{}`)
+		if rejectedDataPoints > 0 {
+			// int64 values are encoded as strings according to protobuf JSON mapping.
+			data = []byte(fmt.Sprintf(`{"partialSuccess":{"rejectedDataPoints":"%d","errorMessage":%q}}`, rejectedDataPoints, rejectedDataPointsMessage))
+		}
+		httpserver.WriteResponse(w, http.StatusOK, "application/json", data)
+		return
+	}
+	httpserver.WriteResponse(w, http.StatusOK, "application/x-protobuf", marshalExportResponse(nil, rejectedDataPoints))
+}
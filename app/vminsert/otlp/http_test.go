@@ -0,0 +1,83 @@
+package otlp
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/VictoriaMetrics/VictoriaMetrics/app/vminsert/concurrencylimiter"
+)
+
+func TestInsertHandlerFailure(t *testing.T) {
+	concurrencylimiter.Init()
+	f := func(contentType, contentEncoding string, body []byte) {
+		t.Helper()
+		req := httptest.NewRequest("POST", "/v1/metrics", bytes.NewReader(body))
+		req.Header.Set("Content-Type", contentType)
+		req.Header.Set("Content-Encoding", contentEncoding)
+		w := httptest.NewRecorder()
+		if err := InsertHandler(w, req, 1024); err == nil {
+			t.Fatalf("expecting non-nil error")
+		}
+	}
+
+	// Unsupported Content-Type
+	f("", "", nil)
+	f("text/plain", "", []byte("foo"))
+
+	// Invalid body
+	f("application/x-protobuf", "", []byte{0xff})
+	f("application/json", "", []byte("foo"))
+	f("application/json; charset=utf-8", "", []byte(`{"resourceMetrics":{}}`))
+
+	// Invalid gzip
+	f("application/json", "gzip", []byte("foo"))
+
+	// Too big request
+	f("application/json", "", make([]byte, 1025))
+}
+
+func TestIsJSONContentType(t *testing.T) {
+	f := func(contentType string, isJSONExpected bool) {
+		t.Helper()
+		isJSON, err := isJSONContentType(contentType)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if isJSON != isJSONExpected {
+			t.Fatalf("unexpected result for %q; got %v; want %v", contentType, isJSON, isJSONExpected)
+		}
+	}
+	f("application/x-protobuf", false)
+	f("application/protobuf", false)
+	f("application/json", true)
+	f("application/json; charset=utf-8", true)
+}
+
+func TestWriteHTTPResponse(t *testing.T) {
+	f := func(isJSON bool, rejectedDataPoints int, contentTypeExpected string, bodyExpected []byte) {
+		t.Helper()
+		w := httptest.NewRecorder()
+		writeHTTPResponse(w, isJSON, rejectedDataPoints)
+		if w.Code != http.StatusOK {
+			t.Fatalf("unexpected status code; got %d; want %d", w.Code, http.StatusOK)
+		}
+		if ct := w.Header().Get("Content-Type"); ct != contentTypeExpected {
+			t.Fatalf("unexpected Content-Type; got %q; want %q", ct, contentTypeExpected)
+		}
+		if !bytes.Equal(w.Body.Bytes(), bodyExpected) {
+			t.Fatalf("unexpected body; got %q; want %q", w.Body.Bytes(), bodyExpected)
+		}
+	}
+
+	// Full success
+	f(false, 0, "application/x-protobuf", nil)
+	f(true, 0, "application/json", []byte(`{}`))
+
+	// Partial success
+	ps := appendVarintField(nil, 1, 2)
+	ps = appendStringField(ps, 2, rejectedDataPointsMessage)
+	f(false, 2, "application/x-protobuf", appendBytesField(nil, 1, ps))
+	f(true, 2, "application/json", []byte(`{"partialSuccess":{"rejectedDataPoints":"2","errorMessage":"exponential histograms aren't supported"}}`))
+}
@@ -0,0 +1,447 @@
+package otlp
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/VictoriaMetrics/VictoriaMetrics/app/vminsert/common"
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/bytesutil"
+	"github.com/valyala/fastjson"
+)
+
+// UnmarshalJSONRequest unmarshals JSON-encoded ExportMetricsServiceRequest from v.
+//
+// The conversion rules are the same as for Unmarshal.
+// 64-bit integers may be passed either as JSON numbers or as strings according to protobuf JSON mapping.
+//
+// See https://github.com/open-telemetry/opentelemetry-proto/blob/main/docs/specification.md#json-protobuf-encoding
+//
+// v must be unchanged until rs is in use.
+func (rs *Rows) UnmarshalJSONRequest(v *fastjson.Value) error {
+	rs.Reset()
+	rs.currentTimestamp = time.Now().UnixNano() / 1e6
+	if v.Type() != fastjson.TypeObject {
+		return fmt.Errorf("request must be a JSON object; got %s", v.Type())
+	}
+	a, err := getArray(v, "resourceMetrics")
+	if err != nil {
+		return err
+	}
+	for _, rm := range a {
+		if err := rs.unmarshalResourceMetricsJSON(rm); err != nil {
+			return fmt.Errorf("cannot unmarshal ResourceMetrics: %s", err)
+		}
+	}
+	return nil
+}
+
+func (rs *Rows) unmarshalResourceMetricsJSON(v *fastjson.Value) error {
+	rs.resourceTags = resetTags(rs.resourceTags)
+	if resource := v.Get("resource"); resource != nil {
+		var err error
+		rs.resourceTags, err = rs.appendAttributesJSON(rs.resourceTags, resource)
+		if err != nil {
+			return fmt.Errorf("cannot unmarshal Resource: %s", err)
+		}
+	}
+	// instrumentationLibraryMetrics is the deprecated name for scopeMetrics.
+	for _, key := range []string{"scopeMetrics", "instrumentationLibraryMetrics"} {
+		a, err := getArray(v, key)
+		if err != nil {
+			return err
+		}
+		for _, sm := range a {
+			metrics, err := getArray(sm, "metrics")
+			if err != nil {
+				return fmt.Errorf("cannot unmarshal ScopeMetrics: %s", err)
+			}
+			for _, metric := range metrics {
+				if err := rs.unmarshalMetricJSON(metric); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func (rs *Rows) unmarshalMetricJSON(v *fastjson.Value) error {
+	name, err := getString(v, "name")
+	if err != nil {
+		return fmt.Errorf("cannot unmarshal Metric: %s", err)
+	}
+	if len(name) == 0 {
+		return fmt.Errorf("missing metric name")
+	}
+	var unmarshalDataPoint func(name string, v *fastjson.Value) error
+	var data *fastjson.Value
+	switch {
+	case v.Exists("gauge"):
+		data = v.Get("gauge")
+		unmarshalDataPoint = rs.unmarshalNumberDataPointJSON
+	case v.Exists("sum"):
+		data = v.Get("sum")
+		unmarshalDataPoint = rs.unmarshalNumberDataPointJSON
+	case v.Exists("histogram"):
+		data = v.Get("histogram")
+		unmarshalDataPoint = rs.unmarshalHistogramDataPointJSON
+	case v.Exists("summary"):
+		data = v.Get("summary")
+		unmarshalDataPoint = rs.unmarshalSummaryDataPointJSON
+	case v.Exists("exponentialHistogram"):
+		// Exponential histograms aren't supported yet.
+		a, err := getArray(v.Get("exponentialHistogram"), "dataPoints")
+		if err != nil {
+			return fmt.Errorf("cannot unmarshal data points for metric %q: %s", name, err)
+		}
+		skippedMetrics.Inc()
+		rs.rejectedDataPoints += len(a)
+		return nil
+	default:
+		return nil
+	}
+	a, err := getArray(data, "dataPoints")
+	if err != nil {
+		return fmt.Errorf("cannot unmarshal data points for metric %q: %s", name, err)
+	}
+	for _, dp := range a {
+		if err := unmarshalDataPoint(name, dp); err != nil {
+			return fmt.Errorf("cannot unmarshal data point for metric %q: %s", name, err)
+		}
+	}
+	return nil
+}
+
+func (rs *Rows) unmarshalNumberDataPointJSON(name string, v *fastjson.Value) error {
+	var err error
+	rs.pointTags, err = rs.appendAttributesJSON(resetTags(rs.pointTags), v)
+	if err != nil {
+		return err
+	}
+	timestamp, err := getUint64(v, "timeUnixNano")
+	if err != nil {
+		return err
+	}
+	var value float64
+	if v.Exists("asInt") {
+		var n int64
+		n, err = getInt64(v, "asInt")
+		value = float64(n)
+	} else {
+		value, err = getFloat64(v, "asDouble")
+	}
+	if err != nil {
+		return err
+	}
+	if err := rs.appendExemplarsJSON(v); err != nil {
+		return err
+	}
+	flags, err := getUint64(v, "flags")
+	if err != nil {
+		return err
+	}
+	if flags&flagNoRecordedValue != 0 {
+		return nil
+	}
+	rs.addNumberPoint(name, rs.timestamp(timestamp), value)
+	return nil
+}
+
+func (rs *Rows) unmarshalHistogramDataPointJSON(name string, v *fastjson.Value) error {
+	var err error
+	rs.pointTags, err = rs.appendAttributesJSON(resetTags(rs.pointTags), v)
+	if err != nil {
+		return err
+	}
+	rs.bucketCounts = rs.bucketCounts[:0]
+	rs.explicitBounds = rs.explicitBounds[:0]
+	timestamp, err := getUint64(v, "timeUnixNano")
+	if err != nil {
+		return err
+	}
+	count, err := getUint64(v, "count")
+	if err != nil {
+		return err
+	}
+	hasSum := v.Exists("sum")
+	sum, err := getFloat64(v, "sum")
+	if err != nil {
+		return err
+	}
+	a, err := getArray(v, "bucketCounts")
+	if err != nil {
+		return err
+	}
+	for _, bc := range a {
+		n, err := parseUint64(bc)
+		if err != nil {
+			return fmt.Errorf("cannot parse bucketCounts item: %s", err)
+		}
+		rs.bucketCounts = append(rs.bucketCounts, n)
+	}
+	a, err = getArray(v, "explicitBounds")
+	if err != nil {
+		return err
+	}
+	for _, eb := range a {
+		f, err := parseFloat64(eb)
+		if err != nil {
+			return fmt.Errorf("cannot parse explicitBounds item: %s", err)
+		}
+		rs.explicitBounds = append(rs.explicitBounds, f)
+	}
+	if err := rs.appendExemplarsJSON(v); err != nil {
+		return err
+	}
+	flags, err := getUint64(v, "flags")
+	if err != nil {
+		return err
+	}
+	if flags&flagNoRecordedValue != 0 {
+		return nil
+	}
+	return rs.addHistogram(name, rs.timestamp(timestamp), count, sum, hasSum, rs.bucketCounts, rs.explicitBounds)
+}
+
+// appendExemplarsJSON sets rs.exemplars to exemplars with non-empty trace IDs from v.
+//
+// Trace IDs are hex-encoded in OTLP JSON.
+func (rs *Rows) appendExemplarsJSON(v *fastjson.Value) error {
+	rs.exemplars = resetExemplars(rs.exemplars)
+	a, err := getArray(v, "exemplars")
+	if err != nil {
+		return err
+	}
+	for _, ev := range a {
+		traceID, err := getString(ev, "traceId")
+		if err != nil {
+			return fmt.Errorf("cannot unmarshal exemplar: %s", err)
+		}
+		if len(traceID) == 0 {
+			continue
+		}
+		timestamp, err := getUint64(ev, "timeUnixNano")
+		if err != nil {
+			return fmt.Errorf("cannot unmarshal exemplar: %s", err)
+		}
+		var value float64
+		if ev.Exists("asInt") {
+			var n int64
+			n, err = getInt64(ev, "asInt")
+			value = float64(n)
+		} else {
+			value, err = getFloat64(ev, "asDouble")
+		}
+		if err != nil {
+			return fmt.Errorf("cannot unmarshal exemplar: %s", err)
+		}
+		rs.exemplars = append(rs.exemplars, common.Exemplar{
+			TraceID:   traceID,
+			Value:     value,
+			Timestamp: int64(timestamp / 1e6),
+		})
+	}
+	return nil
+}
+
+func (rs *Rows) unmarshalSummaryDataPointJSON(name string, v *fastjson.Value) error {
+	var err error
+	rs.pointTags, err = rs.appendAttributesJSON(resetTags(rs.pointTags), v)
+	if err != nil {
+		return err
+	}
+	rs.quantiles = rs.quantiles[:0]
+	timestamp, err := getUint64(v, "timeUnixNano")
+	if err != nil {
+		return err
+	}
+	count, err := getUint64(v, "count")
+	if err != nil {
+		return err
+	}
+	sum, err := getFloat64(v, "sum")
+	if err != nil {
+		return err
+	}
+	a, err := getArray(v, "quantileValues")
+	if err != nil {
+		return err
+	}
+	for _, qv := range a {
+		var q quantileValue
+		if q.quantile, err = getFloat64(qv, "quantile"); err != nil {
+			return fmt.Errorf("cannot unmarshal ValueAtQuantile: %s", err)
+		}
+		if q.value, err = getFloat64(qv, "value"); err != nil {
+			return fmt.Errorf("cannot unmarshal ValueAtQuantile: %s", err)
+		}
+		rs.quantiles = append(rs.quantiles, q)
+	}
+	flags, err := getUint64(v, "flags")
+	if err != nil {
+		return err
+	}
+	if flags&flagNoRecordedValue != 0 {
+		return nil
+	}
+	rs.addSummary(name, rs.timestamp(timestamp), count, sum, rs.quantiles)
+	return nil
+}
+
+// appendAttributesJSON appends tags for `attributes` array from v to dst.
+//
+// Attributes with array and key-value list values are skipped.
+func (rs *Rows) appendAttributesJSON(dst []Tag, v *fastjson.Value) ([]Tag, error) {
+	a, err := getArray(v, "attributes")
+	if err != nil {
+		return dst, err
+	}
+	for _, kv := range a {
+		key, err := getString(kv, "key")
+		if err != nil {
+			return dst, err
+		}
+		if len(key) == 0 {
+			return dst, fmt.Errorf("missing attribute key")
+		}
+		value, ok, err := rs.anyValueStringJSON(kv.Get("value"))
+		if err != nil {
+			return dst, fmt.Errorf("cannot unmarshal value for attribute %q: %s", key, err)
+		}
+		if !ok {
+			skippedAttributes.Inc()
+			continue
+		}
+		dst = append(dst, Tag{
+			Key:   key,
+			Value: value,
+		})
+	}
+	return dst, nil
+}
+
+// anyValueStringJSON returns string representation for AnyValue from v.
+//
+// false is returned for array and key-value list values.
+func (rs *Rows) anyValueStringJSON(v *fastjson.Value) (string, bool, error) {
+	if v == nil {
+		return "", true, nil
+	}
+	switch {
+	case v.Exists("stringValue"):
+		s, err := getString(v, "stringValue")
+		return s, true, err
+	case v.Exists("boolValue"):
+		b, err := v.Get("boolValue").Bool()
+		if err != nil {
+			return "", false, fmt.Errorf("cannot parse boolValue: %s", err)
+		}
+		return strconv.FormatBool(b), true, nil
+	case v.Exists("intValue"):
+		n, err := getInt64(v, "intValue")
+		if err != nil {
+			return "", false, err
+		}
+		return rs.appendString(strconv.AppendInt(rs.buf, n, 10)), true, nil
+	case v.Exists("doubleValue"):
+		f, err := getFloat64(v, "doubleValue")
+		if err != nil {
+			return "", false, err
+		}
+		return rs.appendString(strconv.AppendFloat(rs.buf, f, 'g', -1, 64)), true, nil
+	case v.Exists("bytesValue"):
+		// Bytes are already base64-encoded in JSON.
+		s, err := getString(v, "bytesValue")
+		return s, true, err
+	case v.Exists("arrayValue"), v.Exists("kvlistValue"):
+		return "", false, nil
+	default:
+		return "", true, nil
+	}
+}
+
+func getArray(v *fastjson.Value, key string) ([]*fastjson.Value, error) {
+	av := v.Get(key)
+	if av == nil || av.Type() == fastjson.TypeNull {
+		return nil, nil
+	}
+	a, err := av.Array()
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse %q: %s", key, err)
+	}
+	return a, nil
+}
+
+func getString(v *fastjson.Value, key string) (string, error) {
+	sv := v.Get(key)
+	if sv == nil || sv.Type() == fastjson.TypeNull {
+		return "", nil
+	}
+	b, err := sv.StringBytes()
+	if err != nil {
+		return "", fmt.Errorf("cannot parse %q: %s", key, err)
+	}
+	return bytesutil.ToUnsafeString(b), nil
+}
+
+func getUint64(v *fastjson.Value, key string) (uint64, error) {
+	nv := v.Get(key)
+	if nv == nil || nv.Type() == fastjson.TypeNull {
+		return 0, nil
+	}
+	n, err := parseUint64(nv)
+	if err != nil {
+		return 0, fmt.Errorf("cannot parse %q: %s", key, err)
+	}
+	return n, nil
+}
+
+func getInt64(v *fastjson.Value, key string) (int64, error) {
+	nv := v.Get(key)
+	if nv == nil || nv.Type() == fastjson.TypeNull {
+		return 0, nil
+	}
+	if nv.Type() == fastjson.TypeString {
+		n, err := strconv.ParseInt(bytesutil.ToUnsafeString(nv.GetStringBytes()), 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("cannot parse %q: %s", key, err)
+		}
+		return n, nil
+	}
+	n, err := nv.Int64()
+	if err != nil {
+		return 0, fmt.Errorf("cannot parse %q: %s", key, err)
+	}
+	return n, nil
+}
+
+func getFloat64(v *fastjson.Value, key string) (float64, error) {
+	fv := v.Get(key)
+	if fv == nil || fv.Type() == fastjson.TypeNull {
+		return 0, nil
+	}
+	f, err := parseFloat64(fv)
+	if err != nil {
+		return 0, fmt.Errorf("cannot parse %q: %s", key, err)
+	}
+	return f, nil
+}
+
+// parseUint64 parses uint64 from JSON number or string.
+func parseUint64(v *fastjson.Value) (uint64, error) {
+	if v.Type() == fastjson.TypeString {
+		return strconv.ParseUint(bytesutil.ToUnsafeString(v.GetStringBytes()), 10, 64)
+	}
+	return v.Uint64()
+}
+
+// parseFloat64 parses float64 from JSON number or string.
+//
+// Strings are used for special values such as "NaN" and "Infinity".
+func parseFloat64(v *fastjson.Value) (float64, error) {
+	if v.Type() == fastjson.TypeString {
+		return strconv.ParseFloat(bytesutil.ToUnsafeString(v.GetStringBytes()), 64)
+	}
+	return v.Float64()
+}
@@ -0,0 +1,193 @@
+package otlp
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/VictoriaMetrics/VictoriaMetrics/app/vminsert/common"
+	"github.com/valyala/fastjson"
+)
+
+func TestRowsUnmarshalJSONFailure(t *testing.T) {
+	f := func(s string) {
+		t.Helper()
+		v, err := fastjson.Parse(s)
+		if err != nil {
+			t.Fatalf("cannot parse json %s: %s", s, err)
+		}
+		var rows Rows
+		if err := rows.UnmarshalJSONRequest(v); err == nil {
+			t.Fatalf("expecting non-nil error when parsing %s", s)
+		}
+
+		// Try again
+		if err := rows.UnmarshalJSONRequest(v); err == nil {
+			t.Fatalf("expecting non-nil error when parsing %s", s)
+		}
+	}
+
+	// Invalid request
+	f(`[]`)
+	f(`{"resourceMetrics":{}}`)
+	f(`{"resourceMetrics":[{"scopeMetrics":{}}]}`)
+
+	// Missing metric name
+	f(`{"resourceMetrics":[{"scopeMetrics":[{"metrics":[{"gauge":{}}]}]}]}`)
+
+	// Invalid metric name
+	f(`{"resourceMetrics":[{"scopeMetrics":[{"metrics":[{"name":1}]}]}]}`)
+
+	// Missing attribute key
+	f(`{"resourceMetrics":[{"scopeMetrics":[{"metrics":[{"name":"foo","gauge":{"dataPoints":[{"attributes":[{"value":{"stringValue":"x"}}]}]}}]}]}]}`)
+
+	// Invalid timestamp
+	f(`{"resourceMetrics":[{"scopeMetrics":[{"metrics":[{"name":"foo","gauge":{"dataPoints":[{"timeUnixNano":"foo"}]}}]}]}]}`)
+
+	// Invalid value
+	f(`{"resourceMetrics":[{"scopeMetrics":[{"metrics":[{"name":"foo","gauge":{"dataPoints":[{"asDouble":"foo"}]}}]}]}]}`)
+	f(`{"resourceMetrics":[{"scopeMetrics":[{"metrics":[{"name":"foo","sum":{"dataPoints":[{"asInt":"1.5"}]}}]}]}]}`)
+
+	// Mismatched histogram buckets
+	f(`{"resourceMetrics":[{"scopeMetrics":[{"metrics":[{"name":"foo","histogram":{"dataPoints":[{"bucketCounts":["1","2"],"explicitBounds":[1,2]}]}}]}]}]}`)
+}
+
+func TestRowsUnmarshalJSONSuccess(t *testing.T) {
+	f := func(s string, rowsExpected []Row, rejectedExpected int) {
+		t.Helper()
+		v, err := fastjson.Parse(s)
+		if err != nil {
+			t.Fatalf("cannot parse json %s: %s", s, err)
+		}
+		var rows Rows
+		if err := rows.UnmarshalJSONRequest(v); err != nil {
+			t.Fatalf("cannot unmarshal %s: %s", s, err)
+		}
+		if !reflect.DeepEqual(rows.Rows, rowsExpected) {
+			t.Fatalf("unexpected rows;\ngot\n%+v;\nwant\n%+v", rows.Rows, rowsExpected)
+		}
+		if rows.rejectedDataPoints != rejectedExpected {
+			t.Fatalf("unexpected number of rejected data points; got %d; want %d", rows.rejectedDataPoints, rejectedExpected)
+		}
+
+		// Try unmarshaling again
+		if err := rows.UnmarshalJSONRequest(v); err != nil {
+			t.Fatalf("cannot unmarshal %s: %s", s, err)
+		}
+		if !reflect.DeepEqual(rows.Rows, rowsExpected) {
+			t.Fatalf("unexpected rows;\ngot\n%+v;\nwant\n%+v", rows.Rows, rowsExpected)
+		}
+	}
+
+	const tsExpected = 1600000000123
+
+	// Empty request
+	f(`{}`, nil, 0)
+	f(`{"resourceMetrics":[]}`, nil, 0)
+
+	// Gauge without attributes
+	f(`{"resourceMetrics":[{"scopeMetrics":[{"metrics":[{"name":"temp","gauge":{"dataPoints":[
+		{"timeUnixNano":"1600000000123456789","asDouble":12.5}
+	]}}]}]}]}`, []Row{{
+		Metric:    "temp",
+		Value:     12.5,
+		Timestamp: tsExpected,
+	}}, 0)
+
+	// Sum with int value, resource and data point attributes
+	f(`{"resourceMetrics":[{
+		"resource":{"attributes":[
+			{"key":"service.name","value":{"stringValue":"svc"}},
+			{"key":"host.id","value":{"intValue":"42"}},
+			{"key":"enabled","value":{"boolValue":true}},
+			{"key":"list","value":{"arrayValue":{}}}
+		]},
+		"instrumentationLibraryMetrics":[{"metrics":[{"name":"requests","sum":{"dataPoints":[{
+			"attributes":[
+				{"key":"room","value":{"stringValue":"a"}},
+				{"key":"ratio","value":{"doubleValue":0.25}}
+			],
+			"timeUnixNano":1600000000123456789,
+			"asInt":"7"
+		}]}}]}]
+	}]}`, []Row{{
+		Metric: "requests",
+		Tags: []Tag{
+			{Key: "service.name", Value: "svc"},
+			{Key: "host.id", Value: "42"},
+			{Key: "enabled", Value: "true"},
+			{Key: "room", Value: "a"},
+			{Key: "ratio", Value: "0.25"},
+		},
+		Value:     7,
+		Timestamp: tsExpected,
+	}}, 0)
+
+	// Data point without recorded value
+	f(`{"resourceMetrics":[{"scopeMetrics":[{"metrics":[{"name":"temp","gauge":{"dataPoints":[
+		{"timeUnixNano":"1600000000123456789","asDouble":1,"flags":1}
+	]}}]}]}]}`, nil, 0)
+
+	// Histogram
+	pathTag := Tag{Key: "path", Value: "/"}
+	f(`{"resourceMetrics":[{"scopeMetrics":[{"metrics":[{"name":"latency","histogram":{"dataPoints":[{
+		"attributes":[{"key":"path","value":{"stringValue":"/"}}],
+		"timeUnixNano":"1600000000123456789",
+		"count":"6",
+		"sum":4.5,
+		"bucketCounts":["1","2","3"],
+		"explicitBounds":[0.1,1]
+	}]}}]}]}]}`, []Row{
+		{Metric: "latency_bucket", Tags: []Tag{pathTag, {Key: "le", Value: "0.1"}}, Value: 1, Timestamp: tsExpected},
+		{Metric: "latency_bucket", Tags: []Tag{pathTag, {Key: "le", Value: "1"}}, Value: 3, Timestamp: tsExpected},
+		{Metric: "latency_bucket", Tags: []Tag{pathTag, {Key: "le", Value: "+Inf"}}, Value: 6, Timestamp: tsExpected},
+		{Metric: "latency_sum", Tags: []Tag{pathTag}, Value: 4.5, Timestamp: tsExpected},
+		{Metric: "latency_count", Tags: []Tag{pathTag}, Value: 6, Timestamp: tsExpected},
+	}, 0)
+
+	// Exemplars with trace IDs
+	f(`{"resourceMetrics":[{"scopeMetrics":[{"metrics":[{"name":"requests","sum":{"dataPoints":[{
+		"timeUnixNano":"1600000000123456789",
+		"asInt":"7",
+		"exemplars":[
+			{"timeUnixNano":"1600000000100000000","asInt":"1","traceId":"5b8efff798038103d269b633813fc60c"},
+			{"asDouble":2,"spanId":"eee19b7ec3c1b174"}
+		]
+	}]}},{"name":"latency","histogram":{"dataPoints":[{
+		"timeUnixNano":"1600000000123456789",
+		"count":"6",
+		"bucketCounts":["1","2","3"],
+		"explicitBounds":[0.1,1],
+		"exemplars":[{"asDouble":0.5,"traceId":"aa"},{"asDouble":5,"traceId":"bb"}]
+	}]}}]}]}]}`, []Row{
+		{Metric: "requests", Value: 7, Timestamp: tsExpected, HasExemplar: true, Exemplar: common.Exemplar{
+			TraceID:   "5b8efff798038103d269b633813fc60c",
+			Value:     1,
+			Timestamp: 1600000000100,
+		}},
+		{Metric: "latency_bucket", Tags: []Tag{{Key: "le", Value: "0.1"}}, Value: 1, Timestamp: tsExpected},
+		{Metric: "latency_bucket", Tags: []Tag{{Key: "le", Value: "1"}}, Value: 3, Timestamp: tsExpected,
+			HasExemplar: true, Exemplar: common.Exemplar{TraceID: "aa", Value: 0.5}},
+		{Metric: "latency_bucket", Tags: []Tag{{Key: "le", Value: "+Inf"}}, Value: 6, Timestamp: tsExpected,
+			HasExemplar: true, Exemplar: common.Exemplar{TraceID: "bb", Value: 5}},
+		{Metric: "latency_count", Value: 6, Timestamp: tsExpected},
+	}, 0)
+
+	// Summary
+	f(`{"resourceMetrics":[{"scopeMetrics":[{"metrics":[{"name":"rpc","summary":{"dataPoints":[{
+		"timeUnixNano":"1600000000123456789",
+		"count":"10",
+		"sum":20,
+		"quantileValues":[{"quantile":0.5,"value":1},{"quantile":0.99,"value":2}]
+	}]}}]}]}]}`, []Row{
+		{Metric: "rpc", Tags: []Tag{{Key: "quantile", Value: "0.5"}}, Value: 1, Timestamp: tsExpected},
+		{Metric: "rpc", Tags: []Tag{{Key: "quantile", Value: "0.99"}}, Value: 2, Timestamp: tsExpected},
+		{Metric: "rpc_sum", Value: 20, Timestamp: tsExpected},
+		{Metric: "rpc_count", Value: 10, Timestamp: tsExpected},
+	}, 0)
+
+	// Exponential histograms are rejected
+	f(`{"resourceMetrics":[{"scopeMetrics":[{"metrics":[{"name":"exp","exponentialHistogram":{"dataPoints":[
+		{"timeUnixNano":"1600000000123456789"},
+		{"timeUnixNano":"1600000000123456789"}
+	]}}]}]}]}`, nil, 2)
+}
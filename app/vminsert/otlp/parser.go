@@ -0,0 +1,654 @@
+package otlp
+
+import (
+	"encoding/base64"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/VictoriaMetrics/VictoriaMetrics/app/vminsert/common"
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/bytesutil"
+	"github.com/VictoriaMetrics/metrics"
+)
+
+// Rows contains rows parsed from OTLP ExportMetricsServiceRequest.
+//
+// See https://github.com/open-telemetry/opentelemetry-proto/blob/main/opentelemetry/proto/collector/metrics/v1/metrics_service.proto
+type Rows struct {
+	Rows []Row
+
+	tagsPool []Tag
+
+	// buf holds metric names with suffixes and stringified attribute values.
+	buf []byte
+
+	resourceTags []Tag
+	pointTags    []Tag
+
+	bucketCounts   []uint64
+	explicitBounds []float64
+	quantiles      []quantileValue
+
+	// exemplars contains exemplars with trace IDs for the current data point.
+	exemplars []common.Exemplar
+
+	// rejectedDataPoints is the number of data points, which couldn't be converted into rows.
+	rejectedDataPoints int
+
+	currentTimestamp int64
+}
+
+// Reset resets rs.
+func (rs *Rows) Reset() {
+	// Release references to objects, so they can be GC'ed.
+
+	for i := range rs.Rows {
+		rs.Rows[i].reset()
+	}
+	rs.Rows = rs.Rows[:0]
+
+	rs.tagsPool = resetTags(rs.tagsPool)
+	rs.buf = rs.buf[:0]
+	rs.resourceTags = resetTags(rs.resourceTags)
+	rs.pointTags = resetTags(rs.pointTags)
+	rs.bucketCounts = rs.bucketCounts[:0]
+	rs.explicitBounds = rs.explicitBounds[:0]
+	rs.quantiles = rs.quantiles[:0]
+	rs.exemplars = resetExemplars(rs.exemplars)
+	rs.rejectedDataPoints = 0
+	rs.currentTimestamp = 0
+}
+
+func resetExemplars(exemplars []common.Exemplar) []common.Exemplar {
+	for i := range exemplars {
+		exemplars[i] = common.Exemplar{}
+	}
+	return exemplars[:0]
+}
+
+func resetTags(tags []Tag) []Tag {
+	for i := range tags {
+		tags[i].reset()
+	}
+	return tags[:0]
+}
+
+// Unmarshal unmarshals protobuf-encoded ExportMetricsServiceRequest from src.
+//
+// Gauges and sums are converted into rows with the metric name.
+// Histograms are converted into `<name>_bucket` rows with `le` tag plus `<name>_sum` and `<name>_count` rows.
+// Summaries are converted into rows with `quantile` tag plus `<name>_sum` and `<name>_count` rows.
+// Resource attributes and data point attributes are converted into tags.
+//
+// src must be unchanged until rs is in use.
+func (rs *Rows) Unmarshal(src []byte) error {
+	rs.Reset()
+	rs.currentTimestamp = time.Now().UnixNano() / 1e6
+	return visitFields(src, func(f *field) error {
+		if f.num != 1 {
+			return nil
+		}
+		data, err := f.bytes()
+		if err != nil {
+			return err
+		}
+		if err := rs.unmarshalResourceMetrics(data); err != nil {
+			return fmt.Errorf("cannot unmarshal ResourceMetrics: %s", err)
+		}
+		return nil
+	})
+}
+
+func (rs *Rows) unmarshalResourceMetrics(src []byte) error {
+	// Resource may follow metrics in the message, so read it at first.
+	rs.resourceTags = resetTags(rs.resourceTags)
+	err := visitFields(src, func(f *field) error {
+		if f.num != 1 {
+			return nil
+		}
+		data, err := f.bytes()
+		if err != nil {
+			return err
+		}
+		return visitFields(data, func(f *field) error {
+			if f.num != 1 {
+				return nil
+			}
+			data, err := f.bytes()
+			if err != nil {
+				return err
+			}
+			rs.resourceTags, err = rs.appendAttribute(rs.resourceTags, data)
+			if err != nil {
+				return fmt.Errorf("cannot unmarshal resource attribute: %s", err)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return fmt.Errorf("cannot unmarshal Resource: %s", err)
+	}
+	return visitFields(src, func(f *field) error {
+		// Field #1000 contains deprecated InstrumentationLibraryMetrics with the same layout as ScopeMetrics.
+		if f.num != 2 && f.num != 1000 {
+			return nil
+		}
+		data, err := f.bytes()
+		if err != nil {
+			return err
+		}
+		if err := rs.unmarshalScopeMetrics(data); err != nil {
+			return fmt.Errorf("cannot unmarshal ScopeMetrics: %s", err)
+		}
+		return nil
+	})
+}
+
+func (rs *Rows) unmarshalScopeMetrics(src []byte) error {
+	return visitFields(src, func(f *field) error {
+		if f.num != 2 {
+			return nil
+		}
+		data, err := f.bytes()
+		if err != nil {
+			return err
+		}
+		return rs.unmarshalMetric(data)
+	})
+}
+
+func (rs *Rows) unmarshalMetric(src []byte) error {
+	var name string
+	err := visitFields(src, func(f *field) error {
+		if f.num != 1 {
+			return nil
+		}
+		data, err := f.bytes()
+		if err != nil {
+			return err
+		}
+		name = bytesutil.ToUnsafeString(data)
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("cannot unmarshal Metric: %s", err)
+	}
+	if len(name) == 0 {
+		return fmt.Errorf("missing metric name")
+	}
+	return visitFields(src, func(f *field) error {
+		var unmarshalDataPoint func(name string, src []byte) error
+		switch f.num {
+		case 5, 7:
+			// Gauge and Sum
+			unmarshalDataPoint = rs.unmarshalNumberDataPoint
+		case 9:
+			unmarshalDataPoint = rs.unmarshalHistogramDataPoint
+		case 11:
+			unmarshalDataPoint = rs.unmarshalSummaryDataPoint
+		case 10:
+			// Exponential histograms aren't supported yet.
+			data, err := f.bytes()
+			if err != nil {
+				return err
+			}
+			skippedMetrics.Inc()
+			return visitFields(data, func(f *field) error {
+				if f.num == 1 {
+					rs.rejectedDataPoints++
+				}
+				return nil
+			})
+		default:
+			return nil
+		}
+		data, err := f.bytes()
+		if err != nil {
+			return err
+		}
+		err = visitFields(data, func(f *field) error {
+			if f.num != 1 {
+				return nil
+			}
+			data, err := f.bytes()
+			if err != nil {
+				return err
+			}
+			return unmarshalDataPoint(name, data)
+		})
+		if err != nil {
+			return fmt.Errorf("cannot unmarshal data point for metric %q: %s", name, err)
+		}
+		return nil
+	})
+}
+
+// flagNoRecordedValue is set in data point flags if the data point has no value.
+const flagNoRecordedValue = 1
+
+func (rs *Rows) unmarshalNumberDataPoint(name string, src []byte) error {
+	rs.pointTags = resetTags(rs.pointTags)
+	rs.exemplars = resetExemplars(rs.exemplars)
+	var timestamp uint64
+	var value float64
+	var flags uint64
+	err := visitFields(src, func(f *field) error {
+		var err error
+		switch f.num {
+		case 7:
+			var data []byte
+			if data, err = f.bytes(); err == nil {
+				rs.pointTags, err = rs.appendAttribute(rs.pointTags, data)
+			}
+		case 3:
+			timestamp, err = f.fixed64()
+		case 4:
+			value, err = f.double()
+		case 6:
+			var v uint64
+			v, err = f.fixed64()
+			value = float64(int64(v))
+		case 5:
+			var data []byte
+			if data, err = f.bytes(); err == nil {
+				err = rs.appendExemplar(data)
+			}
+		case 8:
+			flags = f.u64
+		}
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if flags&flagNoRecordedValue != 0 {
+		return nil
+	}
+	rs.addNumberPoint(name, rs.timestamp(timestamp), value)
+	return nil
+}
+
+// addNumberPoint adds a row for gauge or sum data point with rs.pointTags.
+//
+// The last exemplar from rs.exemplars is attached to the row.
+func (rs *Rows) addNumberPoint(name string, timestamp int64, value float64) {
+	rowsLen := len(rs.Rows)
+	rs.addPoint(name, "", timestamp, value, nil)
+	if len(rs.Rows) > rowsLen && len(rs.exemplars) > 0 {
+		rs.Rows[rowsLen].setExemplar(&rs.exemplars[len(rs.exemplars)-1])
+	}
+}
+
+func (rs *Rows) unmarshalHistogramDataPoint(name string, src []byte) error {
+	rs.pointTags = resetTags(rs.pointTags)
+	rs.exemplars = resetExemplars(rs.exemplars)
+	rs.bucketCounts = rs.bucketCounts[:0]
+	rs.explicitBounds = rs.explicitBounds[:0]
+	var timestamp, count, flags uint64
+	var sum float64
+	hasSum := false
+	err := visitFields(src, func(f *field) error {
+		var err error
+		switch f.num {
+		case 9:
+			var data []byte
+			if data, err = f.bytes(); err == nil {
+				rs.pointTags, err = rs.appendAttribute(rs.pointTags, data)
+			}
+		case 3:
+			timestamp, err = f.fixed64()
+		case 4:
+			count, err = f.fixed64()
+		case 5:
+			sum, err = f.double()
+			hasSum = true
+		case 6:
+			rs.bucketCounts, err = f.appendFixed64s(rs.bucketCounts)
+		case 7:
+			rs.explicitBounds, err = f.appendDoubles(rs.explicitBounds)
+		case 8:
+			var data []byte
+			if data, err = f.bytes(); err == nil {
+				err = rs.appendExemplar(data)
+			}
+		case 10:
+			flags = f.u64
+		}
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if flags&flagNoRecordedValue != 0 {
+		return nil
+	}
+	return rs.addHistogram(name, rs.timestamp(timestamp), count, sum, hasSum, rs.bucketCounts, rs.explicitBounds)
+}
+
+func (rs *Rows) unmarshalSummaryDataPoint(name string, src []byte) error {
+	rs.pointTags = resetTags(rs.pointTags)
+	rs.quantiles = rs.quantiles[:0]
+	var timestamp, count, flags uint64
+	var sum float64
+	err := visitFields(src, func(f *field) error {
+		var err error
+		switch f.num {
+		case 7:
+			var data []byte
+			if data, err = f.bytes(); err == nil {
+				rs.pointTags, err = rs.appendAttribute(rs.pointTags, data)
+			}
+		case 3:
+			timestamp, err = f.fixed64()
+		case 4:
+			count, err = f.fixed64()
+		case 5:
+			sum, err = f.double()
+		case 6:
+			var data []byte
+			if data, err = f.bytes(); err == nil {
+				err = rs.appendQuantileValue(data)
+			}
+		case 8:
+			flags = f.u64
+		}
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if flags&flagNoRecordedValue != 0 {
+		return nil
+	}
+	rs.addSummary(name, rs.timestamp(timestamp), count, sum, rs.quantiles)
+	return nil
+}
+
+func (rs *Rows) appendQuantileValue(src []byte) error {
+	var qv quantileValue
+	err := visitFields(src, func(f *field) error {
+		var err error
+		switch f.num {
+		case 1:
+			qv.quantile, err = f.double()
+		case 2:
+			qv.value, err = f.double()
+		}
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("cannot unmarshal ValueAtQuantile: %s", err)
+	}
+	rs.quantiles = append(rs.quantiles, qv)
+	return nil
+}
+
+// appendExemplar appends exemplar from src to rs.exemplars if it has non-empty trace ID.
+func (rs *Rows) appendExemplar(src []byte) error {
+	var e common.Exemplar
+	var traceID []byte
+	err := visitFields(src, func(f *field) error {
+		var err error
+		switch f.num {
+		case 2:
+			var timestamp uint64
+			timestamp, err = f.fixed64()
+			e.Timestamp = int64(timestamp / 1e6)
+		case 3:
+			e.Value, err = f.double()
+		case 6:
+			var v uint64
+			v, err = f.fixed64()
+			e.Value = float64(int64(v))
+		case 5:
+			traceID, err = f.bytes()
+		}
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("cannot unmarshal Exemplar: %s", err)
+	}
+	if isZeroTraceID(traceID) {
+		return nil
+	}
+	e.TraceID = rs.appendString(appendHex(rs.buf, traceID))
+	rs.exemplars = append(rs.exemplars, e)
+	return nil
+}
+
+// isZeroTraceID returns true if traceID is empty or contains only zero bytes, which means an invalid trace ID.
+func isZeroTraceID(traceID []byte) bool {
+	for _, b := range traceID {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func appendHex(dst, src []byte) []byte {
+	const hexChars = "0123456789abcdef"
+	for _, b := range src {
+		dst = append(dst, hexChars[b>>4], hexChars[b&0xf])
+	}
+	return dst
+}
+
+// appendAttribute appends tag for KeyValue from src to dst.
+//
+// Attributes with array and key-value list values are skipped.
+func (rs *Rows) appendAttribute(dst []Tag, src []byte) ([]Tag, error) {
+	var key string
+	var value []byte
+	hasValue := false
+	err := visitFields(src, func(f *field) error {
+		var err error
+		switch f.num {
+		case 1:
+			var data []byte
+			if data, err = f.bytes(); err == nil {
+				key = bytesutil.ToUnsafeString(data)
+			}
+		case 2:
+			value, err = f.bytes()
+			hasValue = true
+		}
+		return err
+	})
+	if err != nil {
+		return dst, err
+	}
+	if len(key) == 0 {
+		return dst, fmt.Errorf("missing attribute key")
+	}
+	v := ""
+	if hasValue {
+		var ok bool
+		v, ok, err = rs.anyValueString(value)
+		if err != nil {
+			return dst, fmt.Errorf("cannot unmarshal value for attribute %q: %s", key, err)
+		}
+		if !ok {
+			skippedAttributes.Inc()
+			return dst, nil
+		}
+	}
+	return append(dst, Tag{
+		Key:   key,
+		Value: v,
+	}), nil
+}
+
+// anyValueString returns string representation for AnyValue from src.
+//
+// false is returned for array and key-value list values.
+func (rs *Rows) anyValueString(src []byte) (string, bool, error) {
+	v := ""
+	ok := true
+	err := visitFields(src, func(f *field) error {
+		switch f.num {
+		case 1:
+			data, err := f.bytes()
+			if err != nil {
+				return err
+			}
+			v = bytesutil.ToUnsafeString(data)
+		case 2:
+			v = strconv.FormatBool(f.u64 != 0)
+		case 3:
+			v = rs.appendString(strconv.AppendInt(rs.buf, int64(f.u64), 10))
+		case 4:
+			d, err := f.double()
+			if err != nil {
+				return err
+			}
+			v = rs.appendString(strconv.AppendFloat(rs.buf, d, 'g', -1, 64))
+		case 7:
+			data, err := f.bytes()
+			if err != nil {
+				return err
+			}
+			v = base64.StdEncoding.EncodeToString(data)
+		case 5, 6:
+			ok = false
+		}
+		return nil
+	})
+	return v, ok, err
+}
+
+// appendString returns a string for the tail of b, which has been appended to rs.buf.
+func (rs *Rows) appendString(b []byte) string {
+	start := len(rs.buf)
+	rs.buf = b
+	return bytesutil.ToUnsafeString(rs.buf[start:])
+}
+
+func (rs *Rows) timestamp(unixNano uint64) int64 {
+	if unixNano == 0 {
+		return rs.currentTimestamp
+	}
+	return int64(unixNano / 1e6)
+}
+
+type quantileValue struct {
+	quantile float64
+	value    float64
+}
+
+// addHistogram adds rows for histogram data point with rs.pointTags.
+//
+// Exemplars from rs.exemplars are attached to `_bucket` rows for the buckets containing exemplar values.
+func (rs *Rows) addHistogram(name string, timestamp int64, count uint64, sum float64, hasSum bool, bucketCounts []uint64, explicitBounds []float64) error {
+	if len(bucketCounts) > 0 && len(bucketCounts) != len(explicitBounds)+1 {
+		return fmt.Errorf("the number of bucket counts must exceed the number of explicit bounds by 1; got %d bucket counts and %d explicit bounds",
+			len(bucketCounts), len(explicitBounds))
+	}
+	if len(bucketCounts) > 0 {
+		bucketsStart := len(rs.Rows)
+		// Convert bucket counts into cumulative counts for `le` buckets.
+		var cumulative uint64
+		for i, bound := range explicitBounds {
+			cumulative += bucketCounts[i]
+			le := rs.appendString(strconv.AppendFloat(rs.buf, bound, 'g', -1, 64))
+			rs.addPoint(name, "_bucket", timestamp, float64(cumulative), &Tag{Key: "le", Value: le})
+		}
+		rs.addPoint(name, "_bucket", timestamp, float64(count), &Tag{Key: "le", Value: "+Inf"})
+
+		// Attach exemplars to the buckets containing their values.
+		for i := range rs.exemplars {
+			e := &rs.exemplars[i]
+			n := sort.SearchFloat64s(explicitBounds, e.Value)
+			rs.Rows[bucketsStart+n].setExemplar(e)
+		}
+	}
+	if hasSum {
+		rs.addPoint(name, "_sum", timestamp, sum, nil)
+	}
+	rs.addPoint(name, "_count", timestamp, float64(count), nil)
+	return nil
+}
+
+// addSummary adds rows for summary data point with rs.pointTags.
+func (rs *Rows) addSummary(name string, timestamp int64, count uint64, sum float64, quantiles []quantileValue) {
+	for _, qv := range quantiles {
+		quantile := rs.appendString(strconv.AppendFloat(rs.buf, qv.quantile, 'g', -1, 64))
+		rs.addPoint(name, "", timestamp, qv.value, &Tag{Key: "quantile", Value: quantile})
+	}
+	rs.addPoint(name, "_sum", timestamp, sum, nil)
+	rs.addPoint(name, "_count", timestamp, float64(count), nil)
+}
+
+// addPoint adds a row with rs.resourceTags, rs.pointTags and the optional extraTag.
+func (rs *Rows) addPoint(name, suffix string, timestamp int64, value float64, extraTag *Tag) {
+	if math.IsNaN(value) && suffix == "" && extraTag == nil {
+		// Skip NaN values for gauges and sums, since they mean missing values.
+		return
+	}
+	metric := name
+	if len(suffix) > 0 {
+		b := append(rs.buf, name...)
+		metric = rs.appendString(append(b, suffix...))
+	}
+	tagsStart := len(rs.tagsPool)
+	rs.tagsPool = append(rs.tagsPool, rs.resourceTags...)
+	rs.tagsPool = append(rs.tagsPool, rs.pointTags...)
+	if extraTag != nil {
+		rs.tagsPool = append(rs.tagsPool, *extraTag)
+	}
+	var tags []Tag
+	if len(rs.tagsPool) > tagsStart {
+		tags = rs.tagsPool[tagsStart:]
+		tags = tags[:len(tags):len(tags)]
+	}
+	rs.Rows = append(rs.Rows, Row{
+		Metric:    metric,
+		Tags:      tags,
+		Value:     value,
+		Timestamp: timestamp,
+	})
+}
+
+var (
+	skippedMetrics    = metrics.NewCounter(`vm_otlp_skipped_metrics_total{reason="unsupported_type"}`)
+	skippedAttributes = metrics.NewCounter(`vm_otlp_skipped_attributes_total{reason="unsupported_type"}`)
+)
+
+// Row is a single OTLP data point.
+type Row struct {
+	Metric    string
+	Tags      []Tag
+	Value     float64
+	Timestamp int64
+
+	// HasExemplar is set to true if the row contains Exemplar with trace ID.
+	HasExemplar bool
+	Exemplar    common.Exemplar
+}
+
+func (r *Row) reset() {
+	r.Metric = ""
+	r.Tags = nil
+	r.Value = 0
+	r.Timestamp = 0
+	r.HasExemplar = false
+	r.Exemplar = common.Exemplar{}
+}
+
+func (r *Row) setExemplar(e *common.Exemplar) {
+	r.HasExemplar = true
+	r.Exemplar = *e
+}
+
+// Tag is an OTLP attribute.
+type Tag struct {
+	Key   string
+	Value string
+}
+
+func (t *Tag) reset() {
+	t.Key = ""
+	t.Value = ""
+}
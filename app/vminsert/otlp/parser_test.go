@@ -0,0 +1,236 @@
+package otlp
+
+import (
+	"encoding/binary"
+	"math"
+	"reflect"
+	"testing"
+
+	"github.com/VictoriaMetrics/VictoriaMetrics/app/vminsert/common"
+)
+
+func TestRowsUnmarshalFailure(t *testing.T) {
+	f := func(data []byte) {
+		t.Helper()
+		var rows Rows
+		if err := rows.Unmarshal(data); err == nil {
+			t.Fatalf("expecting non-nil error when parsing %X", data)
+		}
+
+		// Try again
+		if err := rows.Unmarshal(data); err == nil {
+			t.Fatalf("expecting non-nil error when parsing %X", data)
+		}
+	}
+
+	// Invalid protobuf
+	f([]byte{0xff})
+	f(appendTag(nil, 1, wireTypeBytes))
+	f(appendBytesField(nil, 1, []byte{0x0a, 0x10}))
+
+	// Invalid wire type for ResourceMetrics
+	f(appendFixed64Field(nil, 1, 123))
+
+	// Missing metric name
+	metric := appendBytesField(nil, 5, nil)
+	f(marshalRequest(nil, metric))
+
+	// Missing attribute key
+	attr := appendBytesField(nil, 2, appendStringField(nil, 1, "foo"))
+	dp := appendBytesField(nil, 7, attr)
+	f(marshalRequest(nil, marshalMetric("foo", 5, dp)))
+
+	// Mismatched histogram buckets
+	dp = appendBytesField(nil, 6, marshalFixed64s(1, 2))
+	dp = appendBytesField(dp, 7, marshalDoubles(1, 2))
+	f(marshalRequest(nil, marshalMetric("foo", 9, dp)))
+}
+
+func TestRowsUnmarshalSuccess(t *testing.T) {
+	f := func(data []byte, rowsExpected []Row) {
+		t.Helper()
+		var rows Rows
+		if err := rows.Unmarshal(data); err != nil {
+			t.Fatalf("cannot unmarshal %X: %s", data, err)
+		}
+		if !reflect.DeepEqual(rows.Rows, rowsExpected) {
+			t.Fatalf("unexpected rows;\ngot\n%+v;\nwant\n%+v", rows.Rows, rowsExpected)
+		}
+
+		// Try unmarshaling again
+		if err := rows.Unmarshal(data); err != nil {
+			t.Fatalf("cannot unmarshal %X: %s", data, err)
+		}
+		if !reflect.DeepEqual(rows.Rows, rowsExpected) {
+			t.Fatalf("unexpected rows;\ngot\n%+v;\nwant\n%+v", rows.Rows, rowsExpected)
+		}
+	}
+
+	const ts = 1600000000123456789
+	const tsExpected = 1600000000123
+
+	// Empty request
+	f(nil, nil)
+
+	// Gauge without attributes
+	dp := appendFixed64Field(nil, 3, ts)
+	dp = appendDoubleField(dp, 4, 12.5)
+	f(marshalRequest(nil, marshalMetric("temp", 5, dp)), []Row{{
+		Metric:    "temp",
+		Value:     12.5,
+		Timestamp: tsExpected,
+	}})
+
+	// Sum with int value, resource and data point attributes
+	resource := marshalAttribute(1, "service.name", appendStringField(nil, 1, "svc"))
+	resource = append(resource, marshalAttribute(1, "host.id", appendVarintField(nil, 3, 42))...)
+	resource = append(resource, marshalAttribute(1, "enabled", appendVarintField(nil, 2, 1))...)
+	resource = append(resource, marshalAttribute(1, "list", appendBytesField(nil, 5, nil))...)
+	dp = marshalAttribute(7, "room", appendStringField(nil, 1, "a"))
+	dp = append(dp, marshalAttribute(7, "ratio", appendDoubleField(nil, 4, 0.25))...)
+	dp = appendFixed64Field(dp, 3, ts)
+	dp = appendFixed64Field(dp, 6, uint64(7))
+	f(marshalRequest(resource, marshalMetric("requests", 7, dp)), []Row{{
+		Metric: "requests",
+		Tags: []Tag{
+			{Key: "service.name", Value: "svc"},
+			{Key: "host.id", Value: "42"},
+			{Key: "enabled", Value: "true"},
+			{Key: "room", Value: "a"},
+			{Key: "ratio", Value: "0.25"},
+		},
+		Value:     7,
+		Timestamp: tsExpected,
+	}})
+
+	// Data point without recorded value
+	dp = appendFixed64Field(nil, 3, ts)
+	dp = appendDoubleField(dp, 4, 1)
+	dp = appendVarintField(dp, 8, flagNoRecordedValue)
+	f(marshalRequest(nil, marshalMetric("temp", 5, dp)), nil)
+
+	// Histogram
+	dp = marshalAttribute(9, "path", appendStringField(nil, 1, "/"))
+	dp = appendFixed64Field(dp, 3, ts)
+	dp = appendFixed64Field(dp, 4, 6)
+	dp = appendDoubleField(dp, 5, 4.5)
+	dp = appendBytesField(dp, 6, marshalFixed64s(1, 2, 3))
+	dp = appendBytesField(dp, 7, marshalDoubles(0.1, 1))
+	pathTag := Tag{Key: "path", Value: "/"}
+	f(marshalRequest(nil, marshalMetric("latency", 9, dp)), []Row{
+		{Metric: "latency_bucket", Tags: []Tag{pathTag, {Key: "le", Value: "0.1"}}, Value: 1, Timestamp: tsExpected},
+		{Metric: "latency_bucket", Tags: []Tag{pathTag, {Key: "le", Value: "1"}}, Value: 3, Timestamp: tsExpected},
+		{Metric: "latency_bucket", Tags: []Tag{pathTag, {Key: "le", Value: "+Inf"}}, Value: 6, Timestamp: tsExpected},
+		{Metric: "latency_sum", Tags: []Tag{pathTag}, Value: 4.5, Timestamp: tsExpected},
+		{Metric: "latency_count", Tags: []Tag{pathTag}, Value: 6, Timestamp: tsExpected},
+	})
+
+	// Summary
+	dp = appendFixed64Field(nil, 3, ts)
+	dp = appendFixed64Field(dp, 4, 10)
+	dp = appendDoubleField(dp, 5, 20)
+	dp = appendBytesField(dp, 6, appendDoubleField(appendDoubleField(nil, 1, 0.5), 2, 1))
+	dp = appendBytesField(dp, 6, appendDoubleField(appendDoubleField(nil, 1, 0.99), 2, 2))
+	f(marshalRequest(nil, marshalMetric("rpc", 11, dp)), []Row{
+		{Metric: "rpc", Tags: []Tag{{Key: "quantile", Value: "0.5"}}, Value: 1, Timestamp: tsExpected},
+		{Metric: "rpc", Tags: []Tag{{Key: "quantile", Value: "0.99"}}, Value: 2, Timestamp: tsExpected},
+		{Metric: "rpc_sum", Value: 20, Timestamp: tsExpected},
+		{Metric: "rpc_count", Value: 10, Timestamp: tsExpected},
+	})
+
+	// Exemplars with trace IDs
+	traceID := []byte{0x5b, 0x8e, 0xff, 0xf7, 0x98, 0x03, 0x81, 0x03, 0xd2, 0x69, 0xb6, 0x33, 0x81, 0x3f, 0xc6, 0x0c}
+	exemplar := appendFixed64Field(nil, 2, 1600000000100000000)
+	exemplar = appendFixed64Field(exemplar, 6, 1)
+	exemplar = appendBytesField(exemplar, 5, traceID)
+	dp = appendFixed64Field(nil, 3, ts)
+	dp = appendFixed64Field(dp, 6, 7)
+	dp = appendBytesField(dp, 5, exemplar)
+	// Exemplars without trace IDs are skipped
+	dp = appendBytesField(dp, 5, appendBytesField(appendDoubleField(nil, 3, 2), 5, make([]byte, 16)))
+	f(marshalRequest(nil, marshalMetric("requests", 7, dp)), []Row{{
+		Metric:      "requests",
+		Value:       7,
+		Timestamp:   tsExpected,
+		HasExemplar: true,
+		Exemplar: common.Exemplar{
+			TraceID:   "5b8efff798038103d269b633813fc60c",
+			Value:     1,
+			Timestamp: 1600000000100,
+		},
+	}})
+
+	// Histogram exemplars are attached to buckets containing their values
+	dp = appendFixed64Field(nil, 3, ts)
+	dp = appendFixed64Field(dp, 4, 6)
+	dp = appendBytesField(dp, 6, marshalFixed64s(1, 2, 3))
+	dp = appendBytesField(dp, 7, marshalDoubles(0.1, 1))
+	dp = appendBytesField(dp, 8, appendBytesField(appendDoubleField(nil, 3, 0.1), 5, []byte{0xaa}))
+	dp = appendBytesField(dp, 8, appendBytesField(appendDoubleField(nil, 3, 5), 5, []byte{0xbb}))
+	f(marshalRequest(nil, marshalMetric("latency", 9, dp)), []Row{
+		{Metric: "latency_bucket", Tags: []Tag{{Key: "le", Value: "0.1"}}, Value: 1, Timestamp: tsExpected,
+			HasExemplar: true, Exemplar: common.Exemplar{TraceID: "aa", Value: 0.1}},
+		{Metric: "latency_bucket", Tags: []Tag{{Key: "le", Value: "1"}}, Value: 3, Timestamp: tsExpected},
+		{Metric: "latency_bucket", Tags: []Tag{{Key: "le", Value: "+Inf"}}, Value: 6, Timestamp: tsExpected,
+			HasExemplar: true, Exemplar: common.Exemplar{TraceID: "bb", Value: 5}},
+		{Metric: "latency_count", Value: 6, Timestamp: tsExpected},
+	})
+
+	// Exponential histograms are skipped
+	dp = appendFixed64Field(nil, 3, ts)
+	f(marshalRequest(nil, marshalMetric("exp", 10, dp)), nil)
+}
+
+func marshalRequest(resource, metric []byte) []byte {
+	scopeMetrics := appendBytesField(nil, 2, metric)
+	rm := appendBytesField(nil, 1, resource)
+	rm = appendBytesField(rm, 2, scopeMetrics)
+	return appendBytesField(nil, 1, rm)
+}
+
+func marshalMetric(name string, typeField uint64, dp []byte) []byte {
+	metric := appendStringField(nil, 1, name)
+	return appendBytesField(metric, typeField, appendBytesField(nil, 1, dp))
+}
+
+// marshalAttribute returns KeyValue field with the given number and AnyValue.
+func marshalAttribute(num uint64, key string, anyValue []byte) []byte {
+	kv := appendStringField(nil, 1, key)
+	kv = appendBytesField(kv, 2, anyValue)
+	return appendBytesField(nil, num, kv)
+}
+
+func marshalFixed64s(a ...uint64) []byte {
+	var dst []byte
+	for _, v := range a {
+		dst = appendUint64(dst, v)
+	}
+	return dst
+}
+
+func marshalDoubles(a ...float64) []byte {
+	var dst []byte
+	for _, v := range a {
+		dst = appendUint64(dst, math.Float64bits(v))
+	}
+	return dst
+}
+
+func appendUint64(dst []byte, v uint64) []byte {
+	var b [8]byte
+	binary.LittleEndian.PutUint64(b[:], v)
+	return append(dst, b[:]...)
+}
+
+func appendFixed64Field(dst []byte, num, v uint64) []byte {
+	dst = appendTag(dst, num, wireTypeFixed64)
+	return appendUint64(dst, v)
+}
+
+func appendDoubleField(dst []byte, num uint64, v float64) []byte {
+	return appendFixed64Field(dst, num, math.Float64bits(v))
+}
+
+func appendStringField(dst []byte, num uint64, s string) []byte {
+	return appendBytesField(dst, num, []byte(s))
+}
@@ -0,0 +1,181 @@
+package otlp
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+)
+
+// Protobuf wire types.
+//
+// See https://developers.google.com/protocol-buffers/docs/encoding#structure
+const (
+	wireTypeVarint  = 0
+	wireTypeFixed64 = 1
+	wireTypeBytes   = 2
+	wireTypeFixed32 = 5
+)
+
+// field is a single protobuf field.
+type field struct {
+	num      uint64
+	wireType uint64
+
+	// u64 contains the value for varint, fixed64 and fixed32 wire types.
+	u64 uint64
+
+	// data contains the value for length-delimited wire type.
+	data []byte
+}
+
+// readField reads the next field from src into f and returns the tail of src.
+func readField(src []byte, f *field) ([]byte, error) {
+	tag, n := binary.Uvarint(src)
+	if n <= 0 {
+		return src, fmt.Errorf("cannot read field tag")
+	}
+	src = src[n:]
+	f.num = tag >> 3
+	f.wireType = tag & 0x7
+	f.u64 = 0
+	f.data = nil
+	if f.num == 0 {
+		return src, fmt.Errorf("invalid field number 0")
+	}
+	switch f.wireType {
+	case wireTypeVarint:
+		v, n := binary.Uvarint(src)
+		if n <= 0 {
+			return src, fmt.Errorf("cannot read varint for field #%d", f.num)
+		}
+		f.u64 = v
+		return src[n:], nil
+	case wireTypeFixed64:
+		if len(src) < 8 {
+			return src, fmt.Errorf("cannot read fixed64 for field #%d", f.num)
+		}
+		f.u64 = binary.LittleEndian.Uint64(src)
+		return src[8:], nil
+	case wireTypeBytes:
+		size, n := binary.Uvarint(src)
+		if n <= 0 {
+			return src, fmt.Errorf("cannot read length for field #%d", f.num)
+		}
+		src = src[n:]
+		if uint64(len(src)) < size {
+			return src, fmt.Errorf("too short data for field #%d; got %d bytes; want %d bytes", f.num, len(src), size)
+		}
+		f.data = src[:size]
+		return src[size:], nil
+	case wireTypeFixed32:
+		if len(src) < 4 {
+			return src, fmt.Errorf("cannot read fixed32 for field #%d", f.num)
+		}
+		f.u64 = uint64(binary.LittleEndian.Uint32(src))
+		return src[4:], nil
+	default:
+		return src, fmt.Errorf("unsupported wire type %d for field #%d", f.wireType, f.num)
+	}
+}
+
+// visitFields calls callback for every field in src.
+func visitFields(src []byte, callback func(f *field) error) error {
+	var f field
+	for len(src) > 0 {
+		var err error
+		src, err = readField(src, &f)
+		if err != nil {
+			return err
+		}
+		if err := callback(&f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// double returns f value as float64.
+func (f *field) double() (float64, error) {
+	if f.wireType != wireTypeFixed64 {
+		return 0, fmt.Errorf("unexpected wire type %d for double field #%d", f.wireType, f.num)
+	}
+	return math.Float64frombits(f.u64), nil
+}
+
+// fixed64 returns f value as uint64.
+func (f *field) fixed64() (uint64, error) {
+	if f.wireType != wireTypeFixed64 {
+		return 0, fmt.Errorf("unexpected wire type %d for fixed64 field #%d", f.wireType, f.num)
+	}
+	return f.u64, nil
+}
+
+// bytes returns f value for length-delimited field.
+func (f *field) bytes() ([]byte, error) {
+	if f.wireType != wireTypeBytes {
+		return nil, fmt.Errorf("unexpected wire type %d for length-delimited field #%d", f.wireType, f.num)
+	}
+	return f.data, nil
+}
+
+// appendFixed64s appends repeated fixed64 values from f to dst.
+//
+// Both packed and unpacked encodings are supported.
+func (f *field) appendFixed64s(dst []uint64) ([]uint64, error) {
+	switch f.wireType {
+	case wireTypeFixed64:
+		return append(dst, f.u64), nil
+	case wireTypeBytes:
+		if len(f.data)%8 != 0 {
+			return dst, fmt.Errorf("invalid length for packed fixed64 field #%d: %d bytes", f.num, len(f.data))
+		}
+		for b := f.data; len(b) > 0; b = b[8:] {
+			dst = append(dst, binary.LittleEndian.Uint64(b))
+		}
+		return dst, nil
+	default:
+		return dst, fmt.Errorf("unexpected wire type %d for repeated fixed64 field #%d", f.wireType, f.num)
+	}
+}
+
+// appendDoubles appends repeated double values from f to dst.
+//
+// Both packed and unpacked encodings are supported.
+func (f *field) appendDoubles(dst []float64) ([]float64, error) {
+	switch f.wireType {
+	case wireTypeFixed64:
+		return append(dst, math.Float64frombits(f.u64)), nil
+	case wireTypeBytes:
+		if len(f.data)%8 != 0 {
+			return dst, fmt.Errorf("invalid length for packed double field #%d: %d bytes", f.num, len(f.data))
+		}
+		for b := f.data; len(b) > 0; b = b[8:] {
+			dst = append(dst, math.Float64frombits(binary.LittleEndian.Uint64(b)))
+		}
+		return dst, nil
+	default:
+		return dst, fmt.Errorf("unexpected wire type %d for repeated double field #%d", f.wireType, f.num)
+	}
+}
+
+// appendTag appends field tag with the given number and wire type to dst.
+func appendTag(dst []byte, num, wireType uint64) []byte {
+	return appendVarint(dst, num<<3|wireType)
+}
+
+func appendVarint(dst []byte, v uint64) []byte {
+	var b [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(b[:], v)
+	return append(dst, b[:n]...)
+}
+
+func appendVarintField(dst []byte, num, v uint64) []byte {
+	dst = appendTag(dst, num, wireTypeVarint)
+	return appendVarint(dst, v)
+}
+
+func appendBytesField(dst []byte, num uint64, b []byte) []byte {
+	dst = appendTag(dst, num, wireTypeBytes)
+	dst = appendVarint(dst, uint64(len(b)))
+	return append(dst, b...)
+}
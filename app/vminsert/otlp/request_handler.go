@@ -0,0 +1,169 @@
+package otlp
+
+import (
+	"fmt"
+	"io"
+	"runtime"
+	"sync"
+
+	"github.com/VictoriaMetrics/VictoriaMetrics/app/vminsert/common"
+	"github.com/VictoriaMetrics/VictoriaMetrics/app/vminsert/concurrencylimiter"
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/bytesutil"
+	"github.com/VictoriaMetrics/metrics"
+	"github.com/valyala/fastjson"
+)
+
+var (
+	rowsInserted  = metrics.NewCounter(`vm_rows_inserted_total{type="otlp"}`)
+	rowsPerInsert = metrics.NewSummary(`vm_rows_per_insert{type="otlp"}`)
+	tagsPerRow    = metrics.NewSummary(`vm_tags_per_row{type="otlp"}`)
+)
+
+func (ctx *pushCtx) InsertRows() error {
+	rows := ctx.Rows.Rows
+	ic := &ctx.Common
+	if err := ic.ValidateTimestamps(len(rows), func(i int) int64 { return rows[i].Timestamp }); err != nil {
+		return err
+	}
+	ic.Reset(len(rows))
+	tagsTotal := 0
+	for i := range rows {
+		r := &rows[i]
+		tagsTotal += len(r.Tags)
+		ic.Labels = ic.Labels[:0]
+		ic.AddLabel("", r.Metric)
+		for j := range r.Tags {
+			tag := &r.Tags[j]
+			ic.AddLabel(tag.Key, tag.Value)
+		}
+		if r.HasExemplar {
+			ic.WriteDataPointWithExemplar(ic.Labels, r.Timestamp, r.Value, &r.Exemplar)
+			continue
+		}
+		ic.WriteDataPointInterned(nil, ic.Labels, r.Timestamp, r.Value)
+	}
+	rowsInserted.Add(len(rows))
+	rowsPerInsert.Update(float64(len(rows)))
+	if len(rows) > 0 {
+		tagsPerRow.Update(float64(tagsTotal) / float64(len(rows)))
+	}
+	return ic.FlushBufs()
+}
+
+// rejectedDataPointsMessage is sent in partial success response when some data points have been rejected.
+const rejectedDataPointsMessage = "exponential histograms aren't supported"
+
+// marshalExportResponse appends protobuf-encoded ExportMetricsServiceResponse to dst.
+//
+// The response contains partial success if rejectedDataPoints > 0.
+func marshalExportResponse(dst []byte, rejectedDataPoints int) []byte {
+	if rejectedDataPoints <= 0 {
+		return dst
+	}
+	var ps []byte
+	ps = appendVarintField(ps, 1, uint64(rejectedDataPoints))
+	ps = appendBytesField(ps, 2, []byte(rejectedDataPointsMessage))
+	return appendBytesField(dst, 1, ps)
+}
+
+// read reads the whole request body from r into ctx.reqBuf.
+func (ctx *pushCtx) read(r io.Reader, maxSize int64) error {
+	otlpReadCalls.Inc()
+	lr := io.LimitReader(r, maxSize+1)
+	reqLen, err := common.ReadRequestBody(&ctx.reqBuf, lr)
+	maxRequestSize.Update(reqLen)
+	if err != nil {
+		otlpReadErrors.Inc()
+		return fmt.Errorf("cannot read request: %s", err)
+	}
+	if reqLen > maxSize {
+		otlpReadErrors.Inc()
+		// reqLen is the lower bound for the dropped data size, since the rest of the request isn't read.
+		rejectedRequestBytes.Add(int(reqLen))
+		return fmt.Errorf("too big request; mustn't exceed %d bytes", maxSize)
+	}
+	return nil
+}
+
+// unmarshalJSON unmarshals JSON-encoded ExportMetricsServiceRequest from ctx.reqBuf.
+func (ctx *pushCtx) unmarshalJSON() error {
+	v, err := ctx.parser.ParseBytes(ctx.reqBuf.B)
+	if err != nil {
+		otlpUnmarshalErrors.Inc()
+		otlpParseErrorLogger.Log(err, ctx.reqBuf.B)
+		return fmt.Errorf("cannot parse OTLP JSON request with size %d bytes: %s", len(ctx.reqBuf.B), err)
+	}
+	if err := ctx.Rows.UnmarshalJSONRequest(v); err != nil {
+		otlpUnmarshalErrors.Inc()
+		otlpParseErrorLogger.Log(err, ctx.reqBuf.B)
+		return fmt.Errorf("cannot unmarshal OTLP JSON ExportMetricsServiceRequest with size %d bytes: %s", len(ctx.reqBuf.B), err)
+	}
+	return nil
+}
+
+// unmarshalProtobuf unmarshals protobuf-encoded ExportMetricsServiceRequest from ctx.reqBuf.
+func (ctx *pushCtx) unmarshalProtobuf() error {
+	if err := ctx.Rows.Unmarshal(ctx.reqBuf.B); err != nil {
+		otlpUnmarshalErrors.Inc()
+		otlpParseErrorLogger.Log(err, ctx.reqBuf.B)
+		return fmt.Errorf("cannot unmarshal OTLP ExportMetricsServiceRequest with size %d bytes: %s", len(ctx.reqBuf.B), err)
+	}
+	return nil
+}
+
+var (
+	otlpReadCalls       = metrics.NewCounter(`vm_read_calls_total{name="otlp"}`)
+	otlpReadErrors      = metrics.NewCounter(`vm_read_errors_total{name="otlp"}`)
+	otlpUnmarshalErrors = metrics.NewCounter(`vm_unmarshal_errors_total{name="otlp"}`)
+
+	rejectedRequestBytes = metrics.NewCounter(`vm_rejected_request_bytes_total{protocol="otlp"}`)
+)
+
+var otlpParseErrorLogger = common.NewParseErrorLogger("otlp")
+
+var concurrencyLimiter = concurrencylimiter.NewLimiter("otlp")
+
+var maxRequestSize = common.NewMaxRequestSize("otlp")
+
+var bodyDumper = common.NewBodyDumper("otlp")
+
+type pushCtx struct {
+	Rows   Rows
+	Common common.InsertCtx
+
+	reqBuf bytesutil.ByteBuffer
+	tmpBuf bytesutil.ByteBuffer
+	parser fastjson.Parser
+}
+
+func (ctx *pushCtx) reset() {
+	ctx.Rows.Reset()
+	ctx.Common.Reset(0)
+	ctx.Common.SetContext(nil)
+	common.ReleaseReadBuffer(&ctx.reqBuf)
+	ctx.tmpBuf.Reset()
+}
+
+func getPushCtx() *pushCtx {
+	select {
+	case ctx := <-pushCtxPoolCh:
+		return ctx
+	default:
+		if v := pushCtxPool.Get(); v != nil {
+			return v.(*pushCtx)
+		}
+		return &pushCtx{}
+	}
+}
+
+func putPushCtx(ctx *pushCtx) {
+	ctx.reset()
+	select {
+	case pushCtxPoolCh <- ctx:
+	default:
+		pushCtxPool.Put(ctx)
+	}
+}
+
+var pushCtxPool sync.Pool
+var pushCtxPoolCh = make(chan *pushCtx, runtime.GOMAXPROCS(-1))
@@ -0,0 +1,370 @@
+package prometheustext
+
+import (
+	"flag"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+var dropExemplars = flag.Bool("openmetrics.dropExemplars", false, "Whether to drop exemplars from OpenMetrics data without parsing them. "+
+	"By default exemplars are parsed and malformed exemplars result in errors")
+
+// Rows contains parsed Prometheus text exposition format rows.
+type Rows struct {
+	Rows []Row
+
+	// EOF is set to true if `# EOF` line has been found by Unmarshal in OpenMetrics data.
+	//
+	// It is preserved across Unmarshal calls until Reset, so data sent after `# EOF`
+	// is detected in subsequent blocks of the same stream.
+	EOF bool
+
+	tagsPool []Tag
+}
+
+// Reset resets rs.
+func (rs *Rows) Reset() {
+	// Reset items, so they can be GC'ed
+
+	for i := range rs.Rows {
+		rs.Rows[i].reset()
+	}
+	rs.Rows = rs.Rows[:0]
+	rs.EOF = false
+
+	for i := range rs.tagsPool {
+		rs.tagsPool[i].reset()
+	}
+	rs.tagsPool = rs.tagsPool[:0]
+}
+
+// Unmarshal unmarshals Prometheus text exposition format rows from s.
+//
+// OpenMetrics format is expected if openMetrics is set. In this case timestamps are in seconds,
+// exemplars are allowed and nothing except empty lines may follow `# EOF` line.
+// Timestamps in Prometheus text format are in milliseconds.
+//
+// See https://github.com/prometheus/docs/blob/master/content/docs/instrumenting/exposition_formats.md
+// and https://github.com/OpenObservability/OpenMetrics/blob/main/specification/OpenMetrics.md
+//
+// s must be unchanged until rs is in use.
+func (rs *Rows) Unmarshal(s string, openMetrics bool) error {
+	var err error
+	rs.Rows, rs.tagsPool, rs.EOF, err = unmarshalRows(rs.Rows[:0], s, rs.tagsPool[:0], rs.EOF, openMetrics)
+	tagsPoolStats.Update(len(rs.tagsPool), cap(rs.tagsPool))
+	return err
+}
+
+// Row is a single Prometheus text exposition format row.
+type Row struct {
+	Metric    string
+	Tags      []Tag
+	Value     float64
+	Timestamp int64
+
+	// HasExemplar is set to true if the row contains Exemplar.
+	//
+	// Exemplars are supported only in OpenMetrics format.
+	HasExemplar bool
+	Exemplar    Exemplar
+}
+
+func (r *Row) reset() {
+	r.Metric = ""
+	r.Tags = nil
+	r.Value = 0
+	r.Timestamp = 0
+	r.HasExemplar = false
+	r.Exemplar.reset()
+}
+
+// Exemplar is an OpenMetrics exemplar.
+type Exemplar struct {
+	Tags  []Tag
+	Value float64
+
+	// Timestamp is in milliseconds. It is zero if the exemplar has no timestamp.
+	Timestamp int64
+}
+
+func (e *Exemplar) reset() {
+	e.Tags = nil
+	e.Value = 0
+	e.Timestamp = 0
+}
+
+func (r *Row) unmarshal(s string, tagsPool []Tag, openMetrics bool) ([]Tag, error) {
+	r.reset()
+	n := strings.IndexAny(s, "{ \t")
+	if n == 0 {
+		return tagsPool, fmt.Errorf("missing metric name")
+	}
+	if n < 0 {
+		return tagsPool, fmt.Errorf("missing value")
+	}
+	r.Metric = s[:n]
+	tail := s[n:]
+	if tail[0] == '{' {
+		tagsStart := len(tagsPool)
+		var err error
+		tagsPool, tail, err = unmarshalTags(tagsPool, tail[1:])
+		if err != nil {
+			return tagsPool, fmt.Errorf("cannot unmarshal labels: %s", err)
+		}
+		if tags := tagsPool[tagsStart:]; len(tags) > 0 {
+			r.Tags = tags[:len(tags):len(tags)]
+		}
+	}
+
+	if n := strings.IndexByte(tail, '#'); n >= 0 {
+		if !openMetrics {
+			return tagsPool, fmt.Errorf("exemplars are supported only in OpenMetrics format")
+		}
+		exemplar := tail[n+1:]
+		tail = tail[:n]
+		if !*dropExemplars {
+			var err error
+			tagsPool, err = r.Exemplar.unmarshal(exemplar, tagsPool)
+			if err != nil {
+				return tagsPool, fmt.Errorf("cannot unmarshal exemplar: %s", err)
+			}
+			r.HasExemplar = true
+		}
+	}
+
+	v, ts, err := unmarshalValueAndTimestamp(tail, openMetrics)
+	if err != nil {
+		return tagsPool, err
+	}
+	r.Value = v
+	r.Timestamp = ts
+	return tagsPool, nil
+}
+
+// traceIDTagKeys contains exemplar label names with trace IDs.
+var traceIDTagKeys = []string{"trace_id", "traceID", "traceId"}
+
+// traceID returns the trace ID from e labels. An empty string is returned if e has no trace ID.
+func (e *Exemplar) traceID() string {
+	for _, tag := range e.Tags {
+		for _, key := range traceIDTagKeys {
+			if tag.Key == key {
+				return tag.Value
+			}
+		}
+	}
+	return ""
+}
+
+func (e *Exemplar) unmarshal(s string, tagsPool []Tag) ([]Tag, error) {
+	e.reset()
+	s = skipSpaces(s)
+	if len(s) == 0 || s[0] != '{' {
+		return tagsPool, fmt.Errorf("missing exemplar labels")
+	}
+	tagsStart := len(tagsPool)
+	var err error
+	tagsPool, s, err = unmarshalTags(tagsPool, s[1:])
+	if err != nil {
+		return tagsPool, fmt.Errorf("cannot unmarshal labels: %s", err)
+	}
+	if tags := tagsPool[tagsStart:]; len(tags) > 0 {
+		e.Tags = tags[:len(tags):len(tags)]
+	}
+	e.Value, e.Timestamp, err = unmarshalValueAndTimestamp(s, true)
+	return tagsPool, err
+}
+
+// unmarshalValueAndTimestamp parses `value [timestamp]` from s.
+//
+// The returned timestamp is in milliseconds. It is zero if s has no timestamp.
+func unmarshalValueAndTimestamp(s string, openMetrics bool) (float64, int64, error) {
+	s = skipSpaces(s)
+	n := strings.IndexAny(s, " \t")
+	if n < 0 {
+		v, err := parseValue(s)
+		return v, 0, err
+	}
+	v, err := parseValue(s[:n])
+	if err != nil {
+		return 0, 0, err
+	}
+	s = strings.TrimRight(skipSpaces(s[n+1:]), " \t")
+	if len(s) == 0 {
+		return v, 0, nil
+	}
+	if openMetrics {
+		// OpenMetrics timestamps are in seconds and may contain fractional part.
+		f, err := strconv.ParseFloat(s, 64)
+		if err != nil || math.IsNaN(f) || math.IsInf(f, 0) {
+			return 0, 0, fmt.Errorf("cannot parse timestamp %q", s)
+		}
+		return v, int64(math.Round(f * 1e3)), nil
+	}
+	ts, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return 0, 0, fmt.Errorf("cannot parse timestamp %q: %s", s, err)
+	}
+	return v, ts, nil
+}
+
+func parseValue(s string) (float64, error) {
+	if len(s) == 0 {
+		return 0, fmt.Errorf("missing value")
+	}
+	v, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, fmt.Errorf("cannot parse value %q", s)
+	}
+	return v, nil
+}
+
+func unmarshalRows(dst []Row, s string, tagsPool []Tag, eof, openMetrics bool) ([]Row, []Tag, bool, error) {
+	for len(s) > 0 {
+		var line string
+		n := strings.IndexByte(s, '\n')
+		if n < 0 {
+			// The last line.
+			line = s
+			s = ""
+		} else {
+			line = s[:n]
+			s = s[n+1:]
+		}
+		line = skipSpaces(strings.TrimRight(line, "\r"))
+		if len(line) == 0 {
+			// Skip empty line
+			continue
+		}
+		if eof {
+			return dst, tagsPool, eof, fmt.Errorf("unexpected line after `# EOF`: %q", line)
+		}
+		if line[0] == '#' {
+			if openMetrics && line == "# EOF" {
+				eof = true
+			}
+			// Skip comments, HELP, TYPE and UNIT lines.
+			continue
+		}
+		if cap(dst) > len(dst) {
+			dst = dst[:len(dst)+1]
+		} else {
+			dst = append(dst, Row{})
+		}
+		r := &dst[len(dst)-1]
+		var err error
+		tagsPool, err = r.unmarshal(line, tagsPool, openMetrics)
+		if err != nil {
+			err = fmt.Errorf("cannot unmarshal Prometheus line %q: %s", line, err)
+			return dst, tagsPool, eof, err
+		}
+	}
+	return dst, tagsPool, eof, nil
+}
+
+// unmarshalTags unmarshals `name="value",...}` labels from s.
+//
+// It returns the tail of s after the closing brace.
+func unmarshalTags(dst []Tag, s string) ([]Tag, string, error) {
+	for {
+		s = skipSpaces(s)
+		if len(s) == 0 {
+			return dst, s, fmt.Errorf("missing closing brace")
+		}
+		if s[0] == '}' {
+			return dst, s[1:], nil
+		}
+		n := strings.IndexByte(s, '=')
+		if n < 0 {
+			return dst, s, fmt.Errorf("missing `=` after label name in %q", s)
+		}
+		key := strings.TrimRight(s[:n], " \t")
+		if len(key) == 0 {
+			return dst, s, fmt.Errorf("label name cannot be empty")
+		}
+		s = skipSpaces(s[n+1:])
+		if len(s) == 0 || s[0] != '"' {
+			return dst, s, fmt.Errorf("missing opening quote for label %q value", key)
+		}
+		value, tail, err := unquoteTagValue(s[1:])
+		if err != nil {
+			return dst, s, fmt.Errorf("cannot unmarshal label %q value: %s", key, err)
+		}
+		if cap(dst) > len(dst) {
+			dst = dst[:len(dst)+1]
+		} else {
+			dst = append(dst, Tag{})
+		}
+		tag := &dst[len(dst)-1]
+		tag.Key = key
+		tag.Value = value
+
+		s = skipSpaces(tail)
+		if len(s) > 0 && s[0] == ',' {
+			s = s[1:]
+			continue
+		}
+		if len(s) == 0 || s[0] != '}' {
+			return dst, s, fmt.Errorf("missing comma or closing brace after label %q", key)
+		}
+	}
+}
+
+// unquoteTagValue returns label value from s, which must start after the opening quote.
+//
+// It returns the tail of s after the closing quote.
+func unquoteTagValue(s string) (string, string, error) {
+	n := strings.IndexByte(s, '"')
+	if n < 0 {
+		return "", s, fmt.Errorf("missing closing quote")
+	}
+	if strings.IndexByte(s[:n], '\\') < 0 {
+		// Fast path - the value has no escape sequences.
+		return s[:n], s[n+1:], nil
+	}
+
+	// Slow path - unescape the value.
+	b := make([]byte, 0, n)
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; c {
+		case '"':
+			return string(b), s[i+1:], nil
+		case '\\':
+			i++
+			if i >= len(s) {
+				return "", s, fmt.Errorf("missing closing quote")
+			}
+			switch s[i] {
+			case 'n':
+				b = append(b, '\n')
+			case '\\', '"':
+				b = append(b, s[i])
+			default:
+				b = append(b, '\\', s[i])
+			}
+		default:
+			b = append(b, c)
+		}
+	}
+	return "", s, fmt.Errorf("missing closing quote")
+}
+
+func skipSpaces(s string) string {
+	for len(s) > 0 && (s[0] == ' ' || s[0] == '\t') {
+		s = s[1:]
+	}
+	return s
+}
+
+// Tag is a Prometheus label.
+type Tag struct {
+	Key   string
+	Value string
+}
+
+func (t *Tag) reset() {
+	t.Key = ""
+	t.Value = ""
+}
@@ -0,0 +1,288 @@
+package prometheustext
+
+import (
+	"math"
+	"reflect"
+	"testing"
+)
+
+func TestRowsUnmarshalFailure(t *testing.T) {
+	f := func(s string, openMetrics bool) {
+		t.Helper()
+		var rows Rows
+		if err := rows.Unmarshal(s, openMetrics); err == nil {
+			t.Fatalf("expecting non-nil error when parsing %q", s)
+		}
+
+		// Try again
+		rows.Reset()
+		if err := rows.Unmarshal(s, openMetrics); err == nil {
+			t.Fatalf("expecting non-nil error when parsing %q", s)
+		}
+	}
+
+	// Missing value
+	f("foo", false)
+	f("foo{bar=\"baz\"}", false)
+	f("foo ", false)
+
+	// Missing metric name
+	f("{bar=\"baz\"} 1", false)
+
+	// Invalid value
+	f("foo bar", false)
+
+	// Invalid timestamp
+	f("foo 1 bar", false)
+	f("foo 1 1.5", false)
+	f("foo 1 bar", true)
+	f("foo 1 NaN", true)
+
+	// Invalid labels
+	f("foo{bar} 1", false)
+	f("foo{bar=baz} 1", false)
+	f("foo{bar=\"baz} 1", false)
+	f("foo{bar=\"baz\" 1", false)
+	f("foo{=\"baz\"} 1", false)
+	f("foo{bar=\"baz\"x=\"y\"} 1", false)
+
+	// Exemplars in Prometheus text format
+	f("foo 1 # {trace_id=\"abc\"} 1", false)
+
+	// Invalid exemplars
+	f("foo 1 # trace_id=\"abc\" 1", true)
+	f("foo 1 # {trace_id=\"abc\"}", true)
+	f("foo 1 # {trace_id=\"abc\"} bar", true)
+
+	// Data after # EOF
+	f("# EOF\nfoo 1", true)
+	f("foo 1\n# EOF\n# HELP foo bar", true)
+}
+
+func TestRowsUnmarshalSuccess(t *testing.T) {
+	f := func(s string, openMetrics bool, rowsExpected *Rows) {
+		t.Helper()
+		var rows Rows
+		if err := rows.Unmarshal(s, openMetrics); err != nil {
+			t.Fatalf("cannot unmarshal %q: %s", s, err)
+		}
+		if !reflect.DeepEqual(rows.Rows, rowsExpected.Rows) {
+			t.Fatalf("unexpected rows;\ngot\n%+v;\nwant\n%+v", rows.Rows, rowsExpected.Rows)
+		}
+		if rows.EOF != rowsExpected.EOF {
+			t.Fatalf("unexpected EOF; got %v; want %v", rows.EOF, rowsExpected.EOF)
+		}
+
+		// Try unmarshaling again
+		rows.Reset()
+		if err := rows.Unmarshal(s, openMetrics); err != nil {
+			t.Fatalf("cannot unmarshal %q: %s", s, err)
+		}
+		if !reflect.DeepEqual(rows.Rows, rowsExpected.Rows) {
+			t.Fatalf("unexpected rows;\ngot\n%+v;\nwant\n%+v", rows.Rows, rowsExpected.Rows)
+		}
+
+		rows.Reset()
+		if len(rows.Rows) != 0 {
+			t.Fatalf("non-empty rows after reset: %+v", rows.Rows)
+		}
+	}
+
+	// Empty line
+	f("", false, &Rows{})
+	f("\n\n", false, &Rows{})
+
+	// Comments
+	f("# HELP foo bar\n# TYPE foo counter\n", false, &Rows{})
+
+	// Single line
+	f("foo 1.5", false, &Rows{
+		Rows: []Row{{
+			Metric: "foo",
+			Value:  1.5,
+		}},
+	})
+
+	// Timestamp in milliseconds
+	f("foo 1.5 1234567890123\r\n", false, &Rows{
+		Rows: []Row{{
+			Metric:    "foo",
+			Value:     1.5,
+			Timestamp: 1234567890123,
+		}},
+	})
+
+	// Labels
+	f(`foo{bar="baz", x = "y",} -2 1000`, false, &Rows{
+		Rows: []Row{{
+			Metric:    "foo",
+			Tags:      []Tag{{Key: "bar", Value: "baz"}, {Key: "x", Value: "y"}},
+			Value:     -2,
+			Timestamp: 1000,
+		}},
+	})
+	f(`foo{} 1`, false, &Rows{
+		Rows: []Row{{
+			Metric: "foo",
+			Value:  1,
+		}},
+	})
+
+	// Escaped label values
+	f(`foo{bar="a\"b\\c\nd#}"} 1`, false, &Rows{
+		Rows: []Row{{
+			Metric: "foo",
+			Tags:   []Tag{{Key: "bar", Value: "a\"b\\c\nd#}"}},
+			Value:  1,
+		}},
+	})
+
+	// Special values
+	f("foo +Inf\nbar -Inf", false, &Rows{
+		Rows: []Row{
+			{
+				Metric: "foo",
+				Value:  math.Inf(1),
+			},
+			{
+				Metric: "bar",
+				Value:  math.Inf(-1),
+			},
+		},
+	})
+
+	// Multiple lines
+	f("# TYPE foo counter\n  foo_total 2 1000\n\nfoo_created 1.5e9 1000\n", false, &Rows{
+		Rows: []Row{
+			{
+				Metric:    "foo_total",
+				Value:     2,
+				Timestamp: 1000,
+			},
+			{
+				Metric:    "foo_created",
+				Value:     1.5e9,
+				Timestamp: 1000,
+			},
+		},
+	})
+
+	// OpenMetrics timestamps are in seconds
+	f("foo_total 2 1520879607.789\nfoo_created 1520872607.123 1520879607\n# EOF\n", true, &Rows{
+		Rows: []Row{
+			{
+				Metric:    "foo_total",
+				Value:     2,
+				Timestamp: 1520879607789,
+			},
+			{
+				Metric:    "foo_created",
+				Value:     1520872607.123,
+				Timestamp: 1520879607000,
+			},
+		},
+		EOF: true,
+	})
+
+	// OpenMetrics exemplars
+	f(`foo_bucket{le="0.5"} 3 # {trace_id="KOO5S4vxi0o"} 0.67 1520879607.789`+"\n"+
+		`foo_bucket{le="+Inf"} 4 1520879608 # {} 1.5`+"\n# EOF", true, &Rows{
+		Rows: []Row{
+			{
+				Metric:      "foo_bucket",
+				Tags:        []Tag{{Key: "le", Value: "0.5"}},
+				Value:       3,
+				HasExemplar: true,
+				Exemplar: Exemplar{
+					Tags:      []Tag{{Key: "trace_id", Value: "KOO5S4vxi0o"}},
+					Value:     0.67,
+					Timestamp: 1520879607789,
+				},
+			},
+			{
+				Metric:      "foo_bucket",
+				Tags:        []Tag{{Key: "le", Value: "+Inf"}},
+				Value:       4,
+				Timestamp:   1520879608000,
+				HasExemplar: true,
+				Exemplar: Exemplar{
+					Value: 1.5,
+				},
+			},
+		},
+		EOF: true,
+	})
+
+	// Empty lines after # EOF
+	f("foo 1\n# EOF\n\n", true, &Rows{
+		Rows: []Row{{
+			Metric: "foo",
+			Value:  1,
+		}},
+		EOF: true,
+	})
+
+	// # EOF has no special meaning in Prometheus text format
+	f("# EOF\nfoo 1", false, &Rows{
+		Rows: []Row{{
+			Metric: "foo",
+			Value:  1,
+		}},
+	})
+}
+
+func TestRowsUnmarshalDropExemplars(t *testing.T) {
+	defer func(v bool) {
+		*dropExemplars = v
+	}(*dropExemplars)
+	*dropExemplars = true
+
+	var rows Rows
+	s := `foo_bucket{le="0.5"} 3 1520879607 # {trace_id="abc" 0.67` + "\n# EOF"
+	if err := rows.Unmarshal(s, true); err != nil {
+		t.Fatalf("cannot unmarshal %q: %s", s, err)
+	}
+	rowsExpected := []Row{{
+		Metric:    "foo_bucket",
+		Tags:      []Tag{{Key: "le", Value: "0.5"}},
+		Value:     3,
+		Timestamp: 1520879607000,
+	}}
+	if !reflect.DeepEqual(rows.Rows, rowsExpected) {
+		t.Fatalf("unexpected rows;\ngot\n%+v;\nwant\n%+v", rows.Rows, rowsExpected)
+	}
+}
+
+func TestExemplarTraceID(t *testing.T) {
+	f := func(s, traceIDExpected string) {
+		t.Helper()
+		var rows Rows
+		if err := rows.Unmarshal(s+"\n# EOF", true); err != nil {
+			t.Fatalf("cannot unmarshal %q: %s", s, err)
+		}
+		if traceID := rows.Rows[0].Exemplar.traceID(); traceID != traceIDExpected {
+			t.Fatalf("unexpected trace ID for %q; got %q; want %q", s, traceID, traceIDExpected)
+		}
+	}
+	f(`foo 1 # {trace_id="abc"} 0.67`, "abc")
+	f(`foo 1 # {span_id="x",traceID="abc"} 0.67`, "abc")
+	f(`foo 1 # {traceId="abc"} 0.67`, "abc")
+	f(`foo 1 # {span_id="x"} 0.67`, "")
+	f(`foo 1 # {} 0.67`, "")
+}
+
+func TestRowsUnmarshalEOFAcrossCalls(t *testing.T) {
+	var rows Rows
+	if err := rows.Unmarshal("foo 1\n# EOF", true); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if !rows.EOF {
+		t.Fatalf("expecting EOF to be set")
+	}
+	if err := rows.Unmarshal("\n", true); err != nil {
+		t.Fatalf("unexpected error for empty line after # EOF: %s", err)
+	}
+	if err := rows.Unmarshal("bar 2", true); err == nil {
+		t.Fatalf("expecting non-nil error for data after # EOF")
+	}
+}
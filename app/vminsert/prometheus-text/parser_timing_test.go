@@ -0,0 +1,24 @@
+package prometheustext
+
+import (
+	"fmt"
+	"testing"
+)
+
+func BenchmarkRowsUnmarshal(b *testing.B) {
+	s := `cpu_usage{mode="user"} 1.23 1234556768
+cpu_usage{mode="system"} 23.344 1234556768
+cpu_usage{mode="iowait"} 3.3443 1234556769
+cpu_usage{mode="irq"} 0.34432 1234556768
+`
+	b.SetBytes(int64(len(s)))
+	b.ReportAllocs()
+	b.RunParallel(func(pb *testing.PB) {
+		var rows Rows
+		for pb.Next() {
+			if err := rows.Unmarshal(s, false); err != nil {
+				panic(fmt.Errorf("cannot unmarshal %q: %s", s, err))
+			}
+		}
+	})
+}
@@ -0,0 +1,243 @@
+package prometheustext
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/VictoriaMetrics/VictoriaMetrics/app/vminsert/common"
+	"github.com/VictoriaMetrics/VictoriaMetrics/app/vminsert/concurrencylimiter"
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/bytesutil"
+	"github.com/VictoriaMetrics/metrics"
+)
+
+var (
+	rowsInserted  = metrics.NewCounter(`vm_rows_inserted_total{type="prometheus-text"}`)
+	rowsPerInsert = metrics.NewSummary(`vm_rows_per_insert{type="prometheus-text"}`)
+	tagsPerRow    = metrics.NewSummary(`vm_tags_per_row{type="prometheus-text"}`)
+
+	gzipRequests        = metrics.NewCounter(`vm_insert_requests_total{protocol="prometheus-text", encoding="gzip"}`)
+	identityRequests    = metrics.NewCounter(`vm_insert_requests_total{protocol="prometheus-text", encoding="identity"}`)
+	openMetricsRequests = metrics.NewCounter(`vm_openmetrics_requests_total`)
+
+	// VictoriaMetrics doesn't store exemplars, so they are ignored after parsing
+	// unless their trace IDs are stored according to -insert.exemplarTraceIDs.
+	ignoredExemplars = metrics.NewCounter(`vm_openmetrics_ignored_exemplars_total`)
+)
+
+var useServerTime = flag.Bool("prometheusImport.useServerTime", false, "Whether to ignore timestamps in requests to /api/v1/import/prometheus "+
+	"and store all the data points with the server time instead. This may be enabled for a single request with `use_server_time=1` query arg")
+
+// InsertHandler processes data in Prometheus text exposition format or in OpenMetrics format.
+//
+// OpenMetrics format is detected by `Content-Type: application/openmetrics-text` request header.
+// OpenMetrics data must end with `# EOF` line.
+//
+// See https://github.com/prometheus/docs/blob/master/content/docs/instrumenting/exposition_formats.md
+func InsertHandler(req *http.Request) error {
+	return concurrencyLimiter.Do(func() error {
+		return insertHandlerInternal(req)
+	})
+}
+
+// InsertReader processes data in Prometheus text exposition format or in OpenMetrics format from r.
+//
+// r must contain decoded data, for instance, a file from multipart request. Query args and headers are taken from req.
+func InsertReader(req *http.Request, r io.Reader, openMetrics bool) error {
+	return concurrencyLimiter.Do(func() error {
+		return insertReader(req, r, openMetrics)
+	})
+}
+
+func insertHandlerInternal(req *http.Request) error {
+	openMetrics := isOpenMetrics(req.Header.Get("Content-Type"))
+	dr := bodyDumper.NewReader(req, req.Body)
+	defer dr.Finish()
+	r := common.NewReadTimeoutReader(dr)
+	cd, err := common.GetContentDecoder(r, req)
+	if err != nil {
+		return fmt.Errorf("cannot read encoded Prometheus text exposition data: %s", err)
+	}
+	defer common.PutContentDecoder(cd)
+	if cd.IsEncoded() {
+		gzipRequests.Inc()
+	} else {
+		identityRequests.Inc()
+	}
+	return insertReader(req, cd, openMetrics)
+}
+
+func insertReader(req *http.Request, r io.Reader, openMetrics bool) error {
+	if openMetrics {
+		openMetricsRequests.Inc()
+	}
+	ctx := getPushCtx()
+	defer putPushCtx(ctx)
+	ctx.Common.SetLabelOrder("prometheus-text")
+	ctx.openMetrics = openMetrics
+	ctx.Common.SetExtraLabels(common.GetExtraLabels(req))
+	ctx.Common.SetServerTimestamp(common.GetServerTimestamp(req, *useServerTime))
+	ctx.Common.SetContext(req.Context())
+	for ctx.Read(r) {
+		if err := ctx.InsertRows(); err != nil {
+			return err
+		}
+	}
+	if err := ctx.Error(); err != nil {
+		return err
+	}
+	if openMetrics && !ctx.Rows.EOF {
+		return fmt.Errorf("missing `# EOF` line in the end of OpenMetrics data")
+	}
+	return nil
+}
+
+// isOpenMetrics returns true if contentType corresponds to OpenMetrics format.
+func isOpenMetrics(contentType string) bool {
+	if n := strings.IndexByte(contentType, ';'); n >= 0 {
+		contentType = contentType[:n]
+	}
+	return strings.TrimSpace(contentType) == "application/openmetrics-text"
+}
+
+func (ctx *pushCtx) InsertRows() error {
+	rows := ctx.Rows.Rows
+	ic := &ctx.Common
+	ic.Reset(len(rows))
+	tagsTotal := 0
+	for i := range rows {
+		r := &rows[i]
+		tagsTotal += len(r.Tags)
+		ic.Labels = ic.Labels[:0]
+		ic.AddLabel("", r.Metric)
+		for j := range r.Tags {
+			tag := &r.Tags[j]
+			ic.AddLabel(tag.Key, tag.Value)
+		}
+		if !r.HasExemplar {
+			ic.WriteDataPoint(nil, ic.Labels, r.Timestamp, r.Value)
+			continue
+		}
+		ctx.exemplar.TraceID = r.Exemplar.traceID()
+		ctx.exemplar.Value = r.Exemplar.Value
+		ctx.exemplar.Timestamp = r.Exemplar.Timestamp
+		if !ic.WriteDataPointWithExemplar(ic.Labels, r.Timestamp, r.Value, &ctx.exemplar) {
+			ignoredExemplars.Inc()
+		}
+	}
+	rowsInserted.Add(len(rows))
+	rowsPerInsert.Update(float64(len(rows)))
+	if len(rows) > 0 {
+		tagsPerRow.Update(float64(tagsTotal) / float64(len(rows)))
+	}
+	return ic.FlushBufs()
+}
+
+func (ctx *pushCtx) Read(r io.Reader) bool {
+	prometheusTextReadCalls.Inc()
+	if ctx.err != nil {
+		return false
+	}
+	ctx.reqBuf, ctx.tailBuf, ctx.err = common.ReadLinesBlock(r, ctx.reqBuf, ctx.tailBuf)
+	if ctx.err != nil {
+		if ctx.err != io.EOF {
+			prometheusTextReadErrors.Inc()
+			ctx.err = fmt.Errorf("cannot read Prometheus text exposition data: %s", ctx.err)
+		}
+		return false
+	}
+	if err := ctx.Rows.Unmarshal(bytesutil.ToUnsafeString(ctx.reqBuf), ctx.openMetrics); err != nil {
+		prometheusTextUnmarshalErrors.Inc()
+		prometheusTextParseErrorLogger.Log(err, ctx.reqBuf)
+		ctx.err = fmt.Errorf("cannot unmarshal Prometheus text exposition data with size %d: %s", len(ctx.reqBuf), err)
+		return false
+	}
+
+	// Fill missing timestamps with the current timestamp in milliseconds.
+	currentTimestamp := time.Now().UnixNano() / 1e6
+	rows := ctx.Rows.Rows
+	for i := range rows {
+		r := &rows[i]
+		if r.Timestamp == 0 {
+			r.Timestamp = currentTimestamp
+		}
+	}
+	return true
+}
+
+type pushCtx struct {
+	Rows   Rows
+	Common common.InsertCtx
+
+	reqBuf  []byte
+	tailBuf []byte
+
+	openMetrics bool
+
+	// exemplar holds the trace ID of the exemplar for the currently written row.
+	exemplar common.Exemplar
+
+	err error
+}
+
+func (ctx *pushCtx) Error() error {
+	if ctx.err == io.EOF {
+		return nil
+	}
+	return ctx.err
+}
+
+func (ctx *pushCtx) reset() {
+	ctx.Rows.Reset()
+	ctx.Common.Reset(0)
+	ctx.Common.SetContext(nil)
+	ctx.reqBuf = ctx.reqBuf[:0]
+	ctx.tailBuf = ctx.tailBuf[:0]
+	ctx.openMetrics = false
+	ctx.exemplar = common.Exemplar{}
+
+	ctx.err = nil
+}
+
+var (
+	prometheusTextReadCalls       = metrics.NewCounter(`vm_read_calls_total{name="prometheus-text"}`)
+	prometheusTextReadErrors      = metrics.NewCounter(`vm_read_errors_total{name="prometheus-text"}`)
+	prometheusTextUnmarshalErrors = metrics.NewCounter(`vm_unmarshal_errors_total{name="prometheus-text"}`)
+)
+
+var prometheusTextParseErrorLogger = common.NewParseErrorLogger("prometheus-text")
+
+var concurrencyLimiter = concurrencylimiter.NewLimiter("prometheus-text")
+
+var bodyDumper = common.NewBodyDumper("prometheus-text")
+
+var tagsPoolStats = common.NewTagsPoolStats("prometheus-text")
+
+func getPushCtx() *pushCtx {
+	select {
+	case ctx := <-pushCtxPoolCh:
+		return ctx
+	default:
+		if v := pushCtxPool.Get(); v != nil {
+			return v.(*pushCtx)
+		}
+		return &pushCtx{}
+	}
+}
+
+func putPushCtx(ctx *pushCtx) {
+	ctx.reset()
+	select {
+	case pushCtxPoolCh <- ctx:
+	default:
+		pushCtxPool.Put(ctx)
+	}
+}
+
+var pushCtxPool sync.Pool
+var pushCtxPoolCh = make(chan *pushCtx, runtime.GOMAXPROCS(-1))
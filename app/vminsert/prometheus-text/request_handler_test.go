@@ -0,0 +1,39 @@
+package prometheustext
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestIsOpenMetrics(t *testing.T) {
+	f := func(contentType string, resultExpected bool) {
+		t.Helper()
+		result := isOpenMetrics(contentType)
+		if result != resultExpected {
+			t.Fatalf("unexpected result for %q; got %v; want %v", contentType, result, resultExpected)
+		}
+	}
+	f("", false)
+	f("text/plain", false)
+	f("text/plain; version=0.0.4", false)
+	f("application/openmetrics-text", true)
+	f("application/openmetrics-text; version=1.0.0; charset=utf-8", true)
+}
+
+func TestInsertHandlerMissingEOF(t *testing.T) {
+	f := func(contentType string, errExpected bool) {
+		t.Helper()
+		req := httptest.NewRequest("POST", "/api/v1/import/prometheus", strings.NewReader(""))
+		req.Header.Set("Content-Type", contentType)
+		err := insertHandlerInternal(req)
+		if errExpected && err == nil {
+			t.Fatalf("expecting non-nil error for Content-Type %q", contentType)
+		}
+		if !errExpected && err != nil {
+			t.Fatalf("unexpected error for Content-Type %q: %s", contentType, err)
+		}
+	}
+	f("text/plain", false)
+	f("application/openmetrics-text", true)
+}
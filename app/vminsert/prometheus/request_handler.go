@@ -19,7 +19,7 @@ var (
 
 // InsertHandler processes remote write for prometheus.
 func InsertHandler(r *http.Request, maxSize int64) error {
-	return concurrencylimiter.Do(func() error {
+	return concurrencyLimiter.Do(func() error {
 		return insertHandlerInternal(r, maxSize)
 	})
 }
@@ -27,6 +27,9 @@ func InsertHandler(r *http.Request, maxSize int64) error {
 func insertHandlerInternal(r *http.Request, maxSize int64) error {
 	ctx := getPushCtx()
 	defer putPushCtx(ctx)
+	ctx.Common.SetLabelOrder("prometheus")
+	ctx.Common.SetExtraLabels(common.GetExtraLabels(r))
+	ctx.Common.SetContext(r.Context())
 	if err := ctx.Read(r, maxSize); err != nil {
 		return err
 	}
@@ -36,6 +39,12 @@ func insertHandlerInternal(r *http.Request, maxSize int64) error {
 		rowsLen += len(timeseries[i].Samples)
 	}
 	ic := &ctx.Common
+	for i := range timeseries {
+		samples := timeseries[i].Samples
+		if err := ic.ValidateTimestamps(len(samples), func(j int) int64 { return samples[j].Timestamp }); err != nil {
+			return err
+		}
+	}
 	ic.Reset(rowsLen)
 	rowsTotal := 0
 	for i := range timeseries {
@@ -61,6 +70,7 @@ type pushCtx struct {
 
 func (ctx *pushCtx) reset() {
 	ctx.Common.Reset(0)
+	ctx.Common.SetContext(nil)
 	ctx.req.Reset()
 	ctx.reqBuf = ctx.reqBuf[:0]
 }
@@ -68,14 +78,18 @@ func (ctx *pushCtx) reset() {
 func (ctx *pushCtx) Read(r *http.Request, maxSize int64) error {
 	prometheusReadCalls.Inc()
 
+	dr := bodyDumper.NewReader(r, r.Body)
+	defer dr.Finish()
 	var err error
-	ctx.reqBuf, err = prompb.ReadSnappy(ctx.reqBuf[:0], r.Body, maxSize)
+	ctx.reqBuf, err = prompb.ReadSnappy(ctx.reqBuf[:0], common.NewReadTimeoutReader(dr), maxSize)
 	if err != nil {
 		prometheusReadErrors.Inc()
 		return fmt.Errorf("cannot read prompb.WriteRequest: %s", err)
 	}
+	maxRequestSize.Update(int64(len(ctx.reqBuf)))
 	if err = ctx.req.Unmarshal(ctx.reqBuf); err != nil {
 		prometheusUnmarshalErrors.Inc()
+		prometheusParseErrorLogger.Log(err, ctx.reqBuf)
 		return fmt.Errorf("cannot unmarshal prompb.WriteRequest with size %d bytes: %s", len(ctx.reqBuf), err)
 	}
 	return nil
@@ -87,6 +101,14 @@ var (
 	prometheusUnmarshalErrors = metrics.NewCounter(`vm_unmarshal_errors_total{name="prometheus"}`)
 )
 
+var prometheusParseErrorLogger = common.NewParseErrorLogger("prometheus")
+
+var concurrencyLimiter = concurrencylimiter.NewLimiter("prometheus")
+
+var maxRequestSize = common.NewMaxRequestSize("prometheus")
+
+var bodyDumper = common.NewBodyDumper("prometheus")
+
 func getPushCtx() *pushCtx {
 	select {
 	case ctx := <-pushCtxPoolCh:
@@ -78,6 +78,22 @@ func AddRows(mrs []storage.MetricRow) error {
 	return err
 }
 
+// GetMinMaxTimestamps returns the range of timestamps in milliseconds accepted by AddRows.
+func GetMinMaxTimestamps() (int64, int64) {
+	WG.Add(1)
+	minTimestamp, maxTimestamp := Storage.MinMaxTimestamps()
+	WG.Done()
+	return minTimestamp, maxTimestamp
+}
+
+// FlushToDisk flushes all the recently added rows to disk.
+func FlushToDisk() error {
+	WG.Add(1)
+	err := Storage.FlushToDisk()
+	WG.Done()
+	return err
+}
+
 // DeleteMetrics deletes metrics matching tfss.
 //
 // Returns the number of deleted metrics.
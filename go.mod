@@ -14,6 +14,7 @@ require (
 	github.com/valyala/gozstd v1.5.1
 	github.com/valyala/histogram v1.0.1
 	github.com/valyala/quicktemplate v1.1.1
+	golang.org/x/net v0.0.0-20190724013045-ca1201d0de80
 	golang.org/x/sys v0.0.0-20190804053845-51ab0e2deafa
 )
 
@@ -33,6 +33,8 @@ var (
 	pprofAuthKey     = flag.String("pprofAuthKey", "", "Auth key for /debug/pprof. It overrides httpAuth settings")
 
 	disableResponseCompression = flag.Bool("http.disableResponseCompression", false, "Disable compression of HTTP responses for saving CPU resources. By default compression is enabled to save network bandwidth")
+	compressionMinSize         = flag.Int("http.responseCompressionMinSize", 1024, "The minimum size of response body in bytes for compressing responses "+
+		"written via WriteResponse and error responses for clients accepting gzip. Smaller responses are sent uncompressed, since the compression isn't worth it for them")
 )
 
 var (
@@ -231,16 +233,14 @@ func maybeGzipResponseWriter(w http.ResponseWriter, r *http.Request) http.Respon
 	if *disableResponseCompression {
 		return w
 	}
-	ae := r.Header.Get("Accept-Encoding")
-	if ae == "" {
+	if !acceptsGzip(r.Header.Get("Accept-Encoding")) {
 		return w
 	}
-	ae = strings.ToLower(ae)
-	n := strings.Index(ae, "gzip")
-	if n < 0 {
+	h := w.Header()
+	if h.Get("Content-Encoding") != "" {
+		// The response is already encoded. Do not compress it twice.
 		return w
 	}
-	h := w.Header()
 	h.Set("Content-Encoding", "gzip")
 	zw := getGzipWriter(w)
 	bw := getBufioWriter(zw)
@@ -252,6 +252,40 @@ func maybeGzipResponseWriter(w http.ResponseWriter, r *http.Request) http.Respon
 	return zrw
 }
 
+// acceptsGzip returns true if the given Accept-Encoding header value
+// explicitly advertises gzip support.
+//
+// See https://tools.ietf.org/html/rfc7231#section-5.3.4
+func acceptsGzip(ae string) bool {
+	for _, item := range strings.Split(ae, ",") {
+		coding := item
+		params := ""
+		if n := strings.IndexByte(item, ';'); n >= 0 {
+			coding = item[:n]
+			params = item[n+1:]
+		}
+		coding = strings.ToLower(strings.TrimSpace(coding))
+		if coding != "gzip" && coding != "x-gzip" {
+			continue
+		}
+		return !isZeroQValue(params)
+	}
+	return false
+}
+
+func isZeroQValue(params string) bool {
+	for _, param := range strings.Split(params, ";") {
+		param = strings.TrimSpace(param)
+		n := strings.IndexByte(param, '=')
+		if n < 0 || strings.ToLower(strings.TrimSpace(param[:n])) != "q" {
+			continue
+		}
+		q, err := strconv.ParseFloat(strings.TrimSpace(param[n+1:]), 64)
+		return err != nil || q <= 0
+	}
+	return false
+}
+
 // DisableResponseCompression disables response compression on w.
 //
 // The function must be called before the first w.Write* call.
@@ -259,6 +293,25 @@ func DisableResponseCompression(w http.ResponseWriter) {
 	w.Header().Del("Content-Encoding")
 }
 
+// WriteResponse writes data with the given statusCode and contentType to w.
+//
+// The response is compressed if the client accepts gzip and data isn't shorter than -http.responseCompressionMinSize.
+// Content-Length header is set for uncompressed responses.
+func WriteResponse(w http.ResponseWriter, statusCode int, contentType string, data []byte) {
+	h := w.Header()
+	if len(data) < *compressionMinSize {
+		DisableResponseCompression(w)
+	}
+	if contentType != "" {
+		h.Set("Content-Type", contentType)
+	}
+	if h.Get("Content-Encoding") == "" {
+		h.Set("Content-Length", strconv.Itoa(len(data)))
+	}
+	w.WriteHeader(statusCode)
+	_, _ = w.Write(data)
+}
+
 // EnableCORS enables https://developer.mozilla.org/en-US/docs/Web/HTTP/CORS
 // on the response.
 func EnableCORS(w http.ResponseWriter, _ *http.Request) {
@@ -331,6 +384,13 @@ func (zrw *gzipResponseWriter) WriteHeader(statusCode int) {
 
 // Implements http.Flusher
 func (zrw *gzipResponseWriter) Flush() {
+	if zrw.disableCompression {
+		// Do not write gzip header to uncompressed response body.
+		if fw, ok := zrw.ResponseWriter.(http.Flusher); ok {
+			fw.Flush()
+		}
+		return
+	}
 	if err := zrw.bw.Flush(); err != nil && !isTrivialNetworkError(err) {
 		logger.Errorf("gzipResponseWriter.Flush (buffer): %s", err)
 	}
@@ -348,7 +408,10 @@ func (zrw *gzipResponseWriter) Close() error {
 		return nil
 	}
 	zrw.Flush()
-	err := zrw.zw.Close()
+	var err error
+	if !zrw.disableCompression {
+		err = zrw.zw.Close()
+	}
 	putGzipWriter(zrw.zw)
 	zrw.zw = nil
 	putBufioWriter(zrw.bw)
@@ -420,9 +483,14 @@ var (
 )
 
 // Errorf writes formatted error message to w and to logger.
+//
+// The error response is compressed if the client accepts gzip and the message isn't shorter than -http.responseCompressionMinSize.
 func Errorf(w http.ResponseWriter, format string, args ...interface{}) {
 	errStr := fmt.Sprintf(format, args...)
 	logger.Errorf("%s", errStr)
+	if len(errStr) < *compressionMinSize {
+		DisableResponseCompression(w)
+	}
 	http.Error(w, errStr, http.StatusBadRequest)
 }
 
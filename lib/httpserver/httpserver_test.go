@@ -0,0 +1,191 @@
+package httpserver
+
+import (
+	"compress/gzip"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestAcceptsGzip(t *testing.T) {
+	f := func(ae string, resultExpected bool) {
+		t.Helper()
+		result := acceptsGzip(ae)
+		if result != resultExpected {
+			t.Fatalf("unexpected result for Accept-Encoding %q; got %v; want %v", ae, result, resultExpected)
+		}
+	}
+
+	// Missing or identity-only encodings
+	f("", false)
+	f("identity", false)
+	f("deflate, br", false)
+	f("*", false)
+
+	// Gzip variants
+	f("gzip", true)
+	f("GZIP", true)
+	f(" gzip ", true)
+	f("x-gzip", true)
+	f("deflate, gzip", true)
+	f("gzip;q=0.5, identity", true)
+	f("gzip; q=1", true)
+
+	// Gzip explicitly disabled or malformed
+	f("gzip;q=0", false)
+	f("gzip; q=0.000", false)
+	f("gzip;q=foo", false)
+	f("gzipped", false)
+	f("identity;q=1, gzip;q=0", false)
+}
+
+func TestMaybeGzipResponseWriter(t *testing.T) {
+	f := func(ae string, gzipExpected bool) {
+		t.Helper()
+		r := httptest.NewRequest("GET", "/", nil)
+		if ae != "" {
+			r.Header.Set("Accept-Encoding", ae)
+		}
+		w := httptest.NewRecorder()
+		rw := maybeGzipResponseWriter(w, r)
+		_, isGzip := rw.(*gzipResponseWriter)
+		if isGzip != gzipExpected {
+			t.Fatalf("unexpected gzip response writer for Accept-Encoding %q; got %v; want %v", ae, isGzip, gzipExpected)
+		}
+		ce := w.Header().Get("Content-Encoding")
+		if gzipExpected && ce != "gzip" {
+			t.Fatalf("unexpected Content-Encoding for Accept-Encoding %q; got %q; want %q", ae, ce, "gzip")
+		}
+		if !gzipExpected && ce != "" {
+			t.Fatalf("unexpected Content-Encoding for Accept-Encoding %q; got %q; want empty", ae, ce)
+		}
+	}
+
+	f("", false)
+	f("identity", false)
+	f("gzip;q=0", false)
+	f("gzip", true)
+	f("deflate, gzip", true)
+}
+
+func TestMaybeGzipResponseWriterAlreadyEncoded(t *testing.T) {
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("Accept-Encoding", "gzip")
+	w := httptest.NewRecorder()
+	w.Header().Set("Content-Encoding", "br")
+	rw := maybeGzipResponseWriter(w, r)
+	if _, ok := rw.(*gzipResponseWriter); ok {
+		t.Fatalf("the response mustn't be compressed twice")
+	}
+	if ce := w.Header().Get("Content-Encoding"); ce != "br" {
+		t.Fatalf("unexpected Content-Encoding; got %q; want %q", ce, "br")
+	}
+	rw.WriteHeader(http.StatusOK)
+}
+
+func TestErrorfCompression(t *testing.T) {
+	f := func(ae, errStr string, gzipExpected bool) {
+		t.Helper()
+		r := httptest.NewRequest("GET", "/", nil)
+		if ae != "" {
+			r.Header.Set("Accept-Encoding", ae)
+		}
+		w := httptest.NewRecorder()
+		gzipHandler(func(w http.ResponseWriter, r *http.Request) bool {
+			Errorf(w, "%s", errStr)
+			return true
+		})(w, r)
+		if w.Code != http.StatusBadRequest {
+			t.Fatalf("unexpected status code; got %d; want %d", w.Code, http.StatusBadRequest)
+		}
+		ce := w.Header().Get("Content-Encoding")
+		body := w.Body.String()
+		if gzipExpected {
+			if ce != "gzip" {
+				t.Fatalf("unexpected Content-Encoding; got %q; want %q", ce, "gzip")
+			}
+			zr, err := gzip.NewReader(w.Body)
+			if err != nil {
+				t.Fatalf("cannot read gzipped response: %s", err)
+			}
+			data, err := ioutil.ReadAll(zr)
+			if err != nil {
+				t.Fatalf("cannot decompress response: %s", err)
+			}
+			body = string(data)
+		} else if ce != "" {
+			t.Fatalf("unexpected Content-Encoding; got %q; want empty", ce)
+		}
+		if body != errStr+"\n" {
+			t.Fatalf("unexpected response body; got %q; want %q", body, errStr+"\n")
+		}
+	}
+	bigErr := strings.Repeat("cannot parse row; ", 100)
+
+	f("", "small error", false)
+	f("", bigErr, false)
+
+	// Small errors aren't compressed
+	f("gzip", "small error", false)
+
+	// Big errors are compressed for clients accepting gzip
+	f("gzip", bigErr, true)
+}
+
+func TestWriteResponse(t *testing.T) {
+	f := func(ae string, data []byte, gzipExpected bool) {
+		t.Helper()
+		r := httptest.NewRequest("GET", "/", nil)
+		if ae != "" {
+			r.Header.Set("Accept-Encoding", ae)
+		}
+		w := httptest.NewRecorder()
+		gzipHandler(func(w http.ResponseWriter, r *http.Request) bool {
+			WriteResponse(w, http.StatusOK, "application/json", data)
+			return true
+		})(w, r)
+		if w.Code != http.StatusOK {
+			t.Fatalf("unexpected status code; got %d; want %d", w.Code, http.StatusOK)
+		}
+		if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+			t.Fatalf("unexpected Content-Type; got %q; want %q", ct, "application/json")
+		}
+		ce := w.Header().Get("Content-Encoding")
+		cl := w.Header().Get("Content-Length")
+		body := w.Body.Bytes()
+		if gzipExpected {
+			if ce != "gzip" {
+				t.Fatalf("unexpected Content-Encoding; got %q; want %q", ce, "gzip")
+			}
+			if cl != "" {
+				t.Fatalf("unexpected Content-Length for compressed response: %q", cl)
+			}
+			zr, err := gzip.NewReader(w.Body)
+			if err != nil {
+				t.Fatalf("cannot read gzipped response: %s", err)
+			}
+			if body, err = ioutil.ReadAll(zr); err != nil {
+				t.Fatalf("cannot decompress response: %s", err)
+			}
+		} else {
+			if ce != "" {
+				t.Fatalf("unexpected Content-Encoding; got %q; want empty", ce)
+			}
+			if cl != strconv.Itoa(len(data)) {
+				t.Fatalf("unexpected Content-Length; got %q; want %d", cl, len(data))
+			}
+		}
+		if string(body) != string(data) {
+			t.Fatalf("unexpected response body; got %q; want %q", body, data)
+		}
+	}
+	bigData := []byte(`[` + strings.Repeat(`{"foo":"bar"},`, 100) + `{}]`)
+
+	f("", []byte(`{}`), false)
+	f("", bigData, false)
+	f("gzip", []byte(`{}`), false)
+	f("gzip", bigData, true)
+}
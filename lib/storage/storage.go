@@ -161,6 +161,21 @@ func (s *Storage) debugFlush() {
 	s.idb().tb.DebugFlush()
 }
 
+// FlushToDisk flushes all the recently added data to disk.
+//
+// Rows added before the call are persisted to disk when the call returns,
+// so they survive unclean shutdown. Index entries for new time series
+// are persisted to disk as well.
+//
+// This is an expensive call, since it flushes the whole storage.
+func (s *Storage) FlushToDisk() error {
+	if err := s.tb.flushToDisk(); err != nil {
+		return err
+	}
+	s.idb().tb.DebugFlush()
+	return nil
+}
+
 func (s *Storage) getDeletedMetricIDs() map[uint64]struct{} {
 	return s.idb().getDeletedMetricIDs()
 }
@@ -772,6 +787,13 @@ var (
 	addRowsTimeout       = 30 * time.Second
 )
 
+// MinMaxTimestamps returns the range of timestamps in milliseconds accepted by s.
+//
+// Rows with timestamps outside the range are skipped by AddRows.
+func (s *Storage) MinMaxTimestamps() (int64, int64) {
+	return s.tb.getMinMaxTimestamps()
+}
+
 func (s *Storage) add(rows []rawRow, mrs []MetricRow, precisionBits uint8) ([]rawRow, error) {
 	var errors []error
 	var is *indexSearch
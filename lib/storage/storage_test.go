@@ -629,6 +629,46 @@ func TestStorageAddRows(t *testing.T) {
 	}
 }
 
+func TestStorageFlushToDisk(t *testing.T) {
+	path := "TestStorageFlushToDisk"
+	s, err := OpenStorage(path, 0)
+	if err != nil {
+		t.Fatalf("cannot open storage: %s", err)
+	}
+	var mn MetricName
+	mn.MetricGroup = []byte("foo")
+	mn.Tags = []Tag{
+		{[]byte("job"), []byte("webservice")},
+	}
+	metricNameRaw := mn.marshalRaw(nil)
+	var mrs []MetricRow
+	for i := 0; i < 100; i++ {
+		mrs = append(mrs, MetricRow{
+			MetricNameRaw: metricNameRaw,
+			Timestamp:     time.Now().UnixNano()/1e6 + int64(i),
+			Value:         float64(i),
+		})
+	}
+	if err := s.AddRows(mrs, defaultPrecisionBits); err != nil {
+		t.Fatalf("unexpected error when adding mrs: %s", err)
+	}
+	if err := s.FlushToDisk(); err != nil {
+		t.Fatalf("unexpected error when flushing data to disk: %s", err)
+	}
+	var m Metrics
+	s.UpdateMetrics(&m)
+	if m.TableMetrics.PendingRows != 0 {
+		t.Fatalf("unexpected number of pending rows; got %d; want 0", m.TableMetrics.PendingRows)
+	}
+	if m.TableMetrics.SmallRowsCount != uint64(len(mrs)) {
+		t.Fatalf("unexpected number of rows; got %d; want %d", m.TableMetrics.SmallRowsCount, len(mrs))
+	}
+	s.MustClose()
+	if err := os.RemoveAll(path); err != nil {
+		t.Fatalf("cannot remove %q: %s", path, err)
+	}
+}
+
 func testStorageAddRows(s *Storage) error {
 	const rowsPerAdd = 1e3
 	const addsCount = 10
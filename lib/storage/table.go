@@ -223,6 +223,20 @@ func (tb *table) flushRawRows() {
 	}
 }
 
+// flushToDisk flushes all the pending rows and inmemory parts to disk.
+func (tb *table) flushToDisk() error {
+	ptws := tb.GetPartitions(nil)
+	defer tb.PutPartitions(ptws)
+
+	for _, ptw := range ptws {
+		ptw.pt.flushRawRows(nil, true)
+		if _, err := ptw.pt.flushInmemoryParts(nil, true); err != nil {
+			return fmt.Errorf("cannot flush inmemory parts for partition %q: %s", ptw.pt.name, err)
+		}
+	}
+	return nil
+}
+
 // TableMetrics contains essential metrics for the table.
 type TableMetrics struct {
 	partitionMetrics